@@ -63,6 +63,9 @@ type Client struct {
 	Public       bool     `protobuf:"varint,5,opt,name=public" json:"public,omitempty"`
 	Name         string   `protobuf:"bytes,6,opt,name=name" json:"name,omitempty"`
 	LogoUrl      string   `protobuf:"bytes,7,opt,name=logo_url,json=logoUrl" json:"logo_url,omitempty"`
+	ClientUrl    string   `protobuf:"bytes,8,opt,name=client_url,json=clientUrl" json:"client_url,omitempty"`
+	PolicyUrl    string   `protobuf:"bytes,9,opt,name=policy_url,json=policyUrl" json:"policy_url,omitempty"`
+	TosUrl       string   `protobuf:"bytes,10,opt,name=tos_url,json=tosUrl" json:"tos_url,omitempty"`
 }
 
 func (m *Client) Reset()                    { *m = Client{} }
@@ -119,6 +122,27 @@ func (m *Client) GetLogoUrl() string {
 	return ""
 }
 
+func (m *Client) GetClientUrl() string {
+	if m != nil {
+		return m.ClientUrl
+	}
+	return ""
+}
+
+func (m *Client) GetPolicyUrl() string {
+	if m != nil {
+		return m.PolicyUrl
+	}
+	return ""
+}
+
+func (m *Client) GetTosUrl() string {
+	if m != nil {
+		return m.TosUrl
+	}
+	return ""
+}
+
 // CreateClientReq is a request to make a client.
 type CreateClientReq struct {
 	Client *Client `protobuf:"bytes,1,opt,name=client" json:"client,omitempty"`
@@ -203,6 +227,9 @@ type UpdateClientReq struct {
 	TrustedPeers []string `protobuf:"bytes,3,rep,name=trusted_peers,json=trustedPeers" json:"trusted_peers,omitempty"`
 	Name         string   `protobuf:"bytes,4,opt,name=name" json:"name,omitempty"`
 	LogoUrl      string   `protobuf:"bytes,5,opt,name=logo_url,json=logoUrl" json:"logo_url,omitempty"`
+	ClientUrl    string   `protobuf:"bytes,6,opt,name=client_url,json=clientUrl" json:"client_url,omitempty"`
+	PolicyUrl    string   `protobuf:"bytes,7,opt,name=policy_url,json=policyUrl" json:"policy_url,omitempty"`
+	TosUrl       string   `protobuf:"bytes,8,opt,name=tos_url,json=tosUrl" json:"tos_url,omitempty"`
 }
 
 func (m *UpdateClientReq) Reset()                    { *m = UpdateClientReq{} }
@@ -245,6 +272,27 @@ func (m *UpdateClientReq) GetLogoUrl() string {
 	return ""
 }
 
+func (m *UpdateClientReq) GetClientUrl() string {
+	if m != nil {
+		return m.ClientUrl
+	}
+	return ""
+}
+
+func (m *UpdateClientReq) GetPolicyUrl() string {
+	if m != nil {
+		return m.PolicyUrl
+	}
+	return ""
+}
+
+func (m *UpdateClientReq) GetTosUrl() string {
+	if m != nil {
+		return m.TosUrl
+	}
+	return ""
+}
+
 // UpdateClientResp returns the reponse form updating a client.
 type UpdateClientResp struct {
 	NotFound bool `protobuf:"varint,1,opt,name=not_found,json=notFound" json:"not_found,omitempty"`
@@ -1029,58 +1077,61 @@ var _Dex_serviceDesc = grpc.ServiceDesc{
 func init() { proto.RegisterFile("api/api.proto", fileDescriptor0) }
 
 var fileDescriptor0 = []byte{
-	// 848 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x8c, 0x56, 0xdb, 0x4e, 0xf3, 0x46,
-	0x10, 0x4e, 0x62, 0x92, 0x38, 0x93, 0xf3, 0x36, 0x3f, 0x84, 0xa0, 0x4a, 0xb0, 0xa8, 0x12, 0xa8,
-	0x52, 0x28, 0x54, 0x6a, 0xa5, 0xa2, 0xd2, 0x03, 0xb4, 0x05, 0xa9, 0xaa, 0x90, 0xd5, 0xf4, 0xb2,
-	0x96, 0x89, 0x07, 0x58, 0x61, 0x6c, 0x77, 0x77, 0x43, 0x68, 0x2f, 0xfb, 0x18, 0x7d, 0x9b, 0xbe,
-	0xd9, 0xaf, 0x5d, 0x6f, 0x82, 0x0f, 0x81, 0x70, 0xe7, 0xf9, 0x76, 0xe6, 0x9b, 0xf3, 0xc8, 0xd0,
-	0xf6, 0x62, 0x76, 0xe4, 0xc5, 0x6c, 0x1c, 0xf3, 0x48, 0x46, 0xc4, 0xf2, 0x62, 0x46, 0xff, 0x2f,
-	0x43, 0xed, 0x3c, 0x60, 0x18, 0x4a, 0xd2, 0x81, 0x0a, 0xf3, 0x87, 0xe5, 0xdd, 0xf2, 0x41, 0xc3,
-	0xa9, 0x30, 0x9f, 0x6c, 0x42, 0x4d, 0xe0, 0x94, 0xa3, 0x1c, 0x56, 0x34, 0x66, 0x24, 0xb2, 0x0f,
-	0x6d, 0x8e, 0x3e, 0xe3, 0x38, 0x95, 0xee, 0x8c, 0x33, 0x31, 0xb4, 0x76, 0xad, 0x83, 0x86, 0xd3,
-	0x5a, 0x80, 0x13, 0xce, 0x84, 0x52, 0x92, 0x7c, 0x26, 0x24, 0xfa, 0x6e, 0x8c, 0xc8, 0xc5, 0x70,
-	0x23, 0x51, 0x32, 0xe0, 0xb5, 0xc2, 0x94, 0x87, 0x78, 0x76, 0x13, 0xb0, 0xe9, 0xb0, 0xba, 0x5b,
-	0x3e, 0xb0, 0x1d, 0x23, 0x11, 0x02, 0x1b, 0xa1, 0xf7, 0x88, 0xc3, 0x9a, 0xf6, 0xab, 0xbf, 0xc9,
-	0x36, 0xd8, 0x41, 0x74, 0x17, 0xb9, 0x33, 0x1e, 0x0c, 0xeb, 0x1a, 0xaf, 0x2b, 0x79, 0xc2, 0x03,
-	0xfa, 0x15, 0x74, 0xcf, 0x39, 0x7a, 0x12, 0x93, 0x44, 0x1c, 0xfc, 0x8b, 0xec, 0x43, 0x6d, 0xaa,
-	0x05, 0x9d, 0x4f, 0xf3, 0xa4, 0x39, 0x56, 0x79, 0x9b, 0x77, 0xf3, 0x44, 0xff, 0x84, 0x5e, 0xd6,
-	0x4e, 0xc4, 0xe4, 0x33, 0xe8, 0x78, 0x01, 0x47, 0xcf, 0xff, 0xdb, 0xc5, 0x67, 0x26, 0xa4, 0xd0,
-	0x04, 0xb6, 0xd3, 0x36, 0xe8, 0x4f, 0x1a, 0x4c, 0xf1, 0x57, 0x5e, 0xe7, 0xdf, 0x83, 0xee, 0x05,
-	0x06, 0x98, 0x8e, 0x2b, 0x57, 0x63, 0x7a, 0x04, 0xbd, 0xac, 0x8a, 0x88, 0xc9, 0x0e, 0x34, 0xc2,
-	0x48, 0xba, 0xb7, 0xd1, 0x2c, 0xf4, 0x8d, 0x77, 0x3b, 0x8c, 0xe4, 0xcf, 0x4a, 0xa6, 0xff, 0x95,
-	0xa1, 0x3b, 0x89, 0x7d, 0xef, 0x0d, 0xd2, 0x62, 0x83, 0x2a, 0xef, 0x69, 0x90, 0xb5, 0xa2, 0x41,
-	0x8b, 0x46, 0x6c, 0xbc, 0xd2, 0x88, 0x6a, 0xb6, 0x11, 0x47, 0xd0, 0xcb, 0xc6, 0xb6, 0x2e, 0x1b,
-	0x06, 0xf6, 0xb5, 0x27, 0xc4, 0x3c, 0xe2, 0x3e, 0x19, 0x40, 0x15, 0x1f, 0x3d, 0x16, 0x98, 0x44,
-	0x12, 0x41, 0x45, 0x70, 0xef, 0x89, 0x7b, 0x5d, 0xe6, 0x96, 0xa3, 0xbf, 0xc9, 0x08, 0xec, 0x99,
-	0x40, 0xae, 0x23, 0xb3, 0xb4, 0xf2, 0x52, 0x26, 0x5b, 0x50, 0x57, 0xdf, 0x2e, 0xf3, 0x4d, 0xd0,
-	0x35, 0x25, 0x5e, 0xf9, 0xf4, 0x0c, 0xfa, 0x49, 0xb3, 0x17, 0x0e, 0x55, 0xe5, 0x0e, 0xc1, 0x8e,
-	0x8d, 0x68, 0x06, 0xa5, 0xad, 0x1b, 0xb9, 0xd4, 0x59, 0x3e, 0xd3, 0x53, 0x20, 0x79, 0xfb, 0x77,
-	0x8f, 0x0b, 0xbd, 0x83, 0x7e, 0x52, 0x98, 0xb4, 0xf3, 0xd5, 0x09, 0x6f, 0x83, 0x1d, 0xe2, 0xdc,
-	0x4d, 0x25, 0x5d, 0x0f, 0x71, 0x7e, 0xa9, 0xf2, 0xde, 0x83, 0x96, 0x7a, 0xca, 0xe5, 0xde, 0x0c,
-	0x71, 0x3e, 0x31, 0x10, 0x3d, 0x06, 0x92, 0x77, 0xb4, 0xae, 0x07, 0x87, 0xd0, 0x4f, 0x46, 0x70,
-	0x6d, 0x6c, 0x8a, 0x3d, 0xaf, 0xba, 0x8e, 0xbd, 0x0f, 0xdd, 0x5f, 0x99, 0x90, 0x29, 0x6e, 0xfa,
-	0x1d, 0xf4, 0xb2, 0x90, 0x88, 0xc9, 0xe7, 0xd0, 0x58, 0x54, 0x5a, 0x95, 0xd0, 0x2a, 0x76, 0xe2,
-	0xe5, 0x9d, 0xb6, 0x00, 0xfe, 0x40, 0x2e, 0x58, 0x14, 0x2a, 0xba, 0xaf, 0xa1, 0xb9, 0x94, 0x44,
-	0x9c, 0x5c, 0x2d, 0xfe, 0x84, 0xdc, 0x84, 0x6e, 0x24, 0xd2, 0x03, 0x75, 0xef, 0x74, 0x49, 0xab,
-	0x8e, 0x3e, 0x7d, 0xff, 0x40, 0xd7, 0xc1, 0x5b, 0x8e, 0xe2, 0xfe, 0xf7, 0xe8, 0x01, 0x43, 0x07,
-	0x6f, 0x0b, 0x9b, 0xb4, 0x03, 0x8d, 0x64, 0x97, 0xd5, 0x3c, 0x25, 0x57, 0xd0, 0x4e, 0x80, 0x2b,
-	0x9f, 0x7c, 0x0a, 0x30, 0xd5, 0x13, 0xe1, 0xbb, 0x9e, 0xd4, 0xab, 0x60, 0x39, 0x0d, 0x83, 0xfc,
-	0x20, 0x95, 0x6d, 0xe0, 0x09, 0xa9, 0xda, 0xe5, 0xeb, 0x4b, 0x66, 0x39, 0xb6, 0x02, 0x26, 0x02,
-	0x55, 0xd1, 0x3b, 0xaa, 0x06, 0xc6, 0xbf, 0xaa, 0x78, 0x6a, 0x70, 0xcb, 0x99, 0xc1, 0xfd, 0x2d,
-	0xa9, 0xe0, 0x52, 0x55, 0xc4, 0xe4, 0x14, 0x3a, 0x3c, 0x11, 0x5d, 0xa9, 0x42, 0x5f, 0x94, 0x6c,
-	0xa0, 0x4b, 0x96, 0x4b, 0xca, 0x69, 0xf3, 0x14, 0x20, 0xe8, 0x25, 0xf4, 0x1c, 0x7c, 0x8a, 0x1e,
-	0xf0, 0x1d, 0xce, 0xdf, 0x2c, 0x00, 0xfd, 0x02, 0xfa, 0x39, 0xa6, 0x35, 0xd3, 0x70, 0xf2, 0x6f,
-	0x15, 0xac, 0x0b, 0x7c, 0x26, 0xdf, 0x42, 0x2b, 0x7d, 0x79, 0x49, 0x12, 0x78, 0xee, 0x88, 0x8f,
-	0x3e, 0xac, 0x40, 0x45, 0x4c, 0x4b, 0xca, 0x3c, 0x7d, 0x67, 0x8c, 0x79, 0xee, 0x2c, 0x1a, 0xf3,
-	0xfc, 0x41, 0x4a, 0xcc, 0xd3, 0x47, 0xd7, 0x98, 0xe7, 0x4e, 0xb5, 0x31, 0xcf, 0x5f, 0x67, 0x5a,
-	0x22, 0xe7, 0xd0, 0xc9, 0x5e, 0x02, 0xb2, 0x99, 0x0a, 0x34, 0x35, 0xe9, 0xa3, 0xad, 0x95, 0xf8,
-	0x82, 0x24, 0xbb, 0xa8, 0x86, 0xa4, 0x70, 0x26, 0x0c, 0x49, 0x71, 0xab, 0x13, 0x92, 0xec, 0x3e,
-	0x1a, 0x92, 0xc2, 0x3e, 0x1b, 0x92, 0xe2, 0xf2, 0xd2, 0x12, 0x39, 0x83, 0x76, 0x7a, 0x1d, 0x85,
-	0x29, 0x47, 0x6e, 0x6b, 0x4d, 0x39, 0xf2, 0x8b, 0x4b, 0x4b, 0xe4, 0x18, 0xe0, 0x17, 0x94, 0x66,
-	0x05, 0x49, 0x57, 0xab, 0xbd, 0xac, 0xe7, 0xa8, 0x97, 0x05, 0xb4, 0xc9, 0x37, 0xd0, 0x4c, 0x8d,
-	0x34, 0xf9, 0x64, 0x49, 0xfd, 0x32, 0x92, 0xa3, 0x41, 0x11, 0xd4, 0xb6, 0xdf, 0x43, 0x3b, 0x33,
-	0x74, 0xe4, 0x83, 0x19, 0xfa, 0xec, 0x48, 0x8f, 0x36, 0x57, 0xc1, 0x8a, 0xe1, 0xc7, 0x01, 0x90,
-	0x69, 0xf4, 0x38, 0x9e, 0x46, 0x1c, 0x23, 0x31, 0xf6, 0xf1, 0x59, 0x69, 0xde, 0xd4, 0xf4, 0x4f,
-	0xd1, 0x97, 0x1f, 0x03, 0x00, 0x00, 0xff, 0xff, 0xd1, 0x00, 0x08, 0xae, 0x25, 0x09, 0x00, 0x00,
+	// 889 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x8c, 0x56, 0xdb, 0x6e, 0xdb, 0x46,
+	0x10, 0xad, 0x44, 0x4b, 0xa2, 0x46, 0xf7, 0xad, 0x65, 0x29, 0x0c, 0x0a, 0x38, 0x0c, 0x0a, 0x38,
+	0x28, 0x20, 0x37, 0x29, 0xd0, 0x02, 0x0d, 0x9a, 0x5e, 0x9c, 0xb6, 0x09, 0x50, 0x14, 0x01, 0x51,
+	0xf5, 0xb1, 0x04, 0x23, 0x8e, 0xe3, 0x45, 0x68, 0x2e, 0xbb, 0xbb, 0x8a, 0x9c, 0x3e, 0xf6, 0x2b,
+	0xfa, 0x9b, 0xfd, 0x83, 0x60, 0x2f, 0x94, 0x49, 0x8a, 0x91, 0xfc, 0xc6, 0x39, 0xb3, 0x73, 0x76,
+	0xe7, 0xcc, 0x45, 0x82, 0x41, 0x94, 0xd1, 0xf3, 0x28, 0xa3, 0x8b, 0x8c, 0x33, 0xc9, 0x88, 0x13,
+	0x65, 0xd4, 0xff, 0xaf, 0x09, 0xed, 0x8b, 0x84, 0x62, 0x2a, 0xc9, 0x10, 0x9a, 0x34, 0x9e, 0x37,
+	0x4e, 0x1b, 0x67, 0xdd, 0xa0, 0x49, 0x63, 0x72, 0x02, 0x6d, 0x81, 0x2b, 0x8e, 0x72, 0xde, 0xd4,
+	0x98, 0xb5, 0xc8, 0x43, 0x18, 0x70, 0x8c, 0x29, 0xc7, 0x95, 0x0c, 0xd7, 0x9c, 0x8a, 0xb9, 0x73,
+	0xea, 0x9c, 0x75, 0x83, 0x7e, 0x0e, 0x2e, 0x39, 0x15, 0xea, 0x90, 0xe4, 0x6b, 0x21, 0x31, 0x0e,
+	0x33, 0x44, 0x2e, 0xe6, 0x47, 0xe6, 0x90, 0x05, 0x5f, 0x29, 0x4c, 0xdd, 0x90, 0xad, 0x5f, 0x27,
+	0x74, 0x35, 0x6f, 0x9d, 0x36, 0xce, 0xdc, 0xc0, 0x5a, 0x84, 0xc0, 0x51, 0x1a, 0x5d, 0xe3, 0xbc,
+	0xad, 0xef, 0xd5, 0xdf, 0xe4, 0x1e, 0xb8, 0x09, 0x7b, 0xc3, 0xc2, 0x35, 0x4f, 0xe6, 0x1d, 0x8d,
+	0x77, 0x94, 0xbd, 0xe4, 0x09, 0xf9, 0x0c, 0x60, 0xa5, 0x53, 0xd0, 0x4e, 0x57, 0x3b, 0xbb, 0x06,
+	0xb1, 0xee, 0x8c, 0x25, 0x74, 0xf5, 0x5e, 0xbb, 0xbb, 0xc6, 0x6d, 0x10, 0xe5, 0x9e, 0x41, 0x47,
+	0x32, 0xa1, 0x7d, 0x60, 0xf2, 0x94, 0x4c, 0x2c, 0x79, 0xe2, 0x7f, 0x0d, 0xa3, 0x0b, 0x8e, 0x91,
+	0x44, 0xa3, 0x4f, 0x80, 0x7f, 0x93, 0x87, 0xd0, 0x36, 0xbc, 0x5a, 0xa6, 0xde, 0x93, 0xde, 0x42,
+	0xc9, 0x69, 0xfd, 0xd6, 0xe5, 0xff, 0x05, 0xe3, 0x72, 0x9c, 0xc8, 0xc8, 0xe7, 0x30, 0x8c, 0x12,
+	0x8e, 0x51, 0xfc, 0x3e, 0xc4, 0x1b, 0x2a, 0xa4, 0xd0, 0x04, 0x6e, 0x30, 0xb0, 0xe8, 0xcf, 0x1a,
+	0x2c, 0xf0, 0x37, 0x3f, 0xce, 0xff, 0x00, 0x46, 0xcf, 0x31, 0xc1, 0xe2, 0xbb, 0x2a, 0xa5, 0xf3,
+	0xcf, 0x61, 0x5c, 0x3e, 0x22, 0x32, 0x72, 0x1f, 0xba, 0x29, 0x93, 0xe1, 0x25, 0x5b, 0xa7, 0xb1,
+	0xbd, 0xdd, 0x4d, 0x99, 0xfc, 0x45, 0xd9, 0xfe, 0xff, 0x0d, 0x18, 0x2d, 0xb3, 0x38, 0xda, 0x43,
+	0xba, 0x5b, 0xf7, 0xe6, 0x5d, 0xea, 0xee, 0xd4, 0xd4, 0x3d, 0xaf, 0xef, 0xd1, 0x47, 0xea, 0xdb,
+	0xda, 0x57, 0xdf, 0xf6, 0xfe, 0xfa, 0x76, 0xf6, 0xd4, 0xd7, 0x2d, 0xd5, 0xf7, 0x1c, 0xc6, 0xe5,
+	0x94, 0x0f, 0x89, 0x44, 0xc1, 0x7d, 0x15, 0x09, 0xb1, 0x61, 0x3c, 0x26, 0xc7, 0xd0, 0xc2, 0xeb,
+	0x88, 0x26, 0x56, 0x1f, 0x63, 0xa8, 0xc4, 0xae, 0x22, 0x71, 0xa5, 0xab, 0xd7, 0x0f, 0xf4, 0x37,
+	0xf1, 0xc0, 0x5d, 0x0b, 0xe4, 0x3a, 0x61, 0x47, 0x1f, 0xde, 0xda, 0xea, 0x6d, 0xea, 0x3b, 0xa4,
+	0xb1, 0xd5, 0xa2, 0xad, 0xcc, 0x97, 0xb1, 0xff, 0x0c, 0x26, 0xa6, 0x87, 0xf2, 0x0b, 0x55, 0x41,
+	0x1e, 0x81, 0x9b, 0x59, 0xd3, 0xf6, 0xdf, 0x40, 0xf7, 0xc7, 0xf6, 0xcc, 0xd6, 0xed, 0x3f, 0x05,
+	0x52, 0x8d, 0xbf, 0x73, 0x17, 0xfa, 0x6f, 0x60, 0x62, 0x84, 0x29, 0x5e, 0x5e, 0x9f, 0xf0, 0x3d,
+	0x70, 0x53, 0xdc, 0x84, 0x85, 0xa4, 0x3b, 0x29, 0x6e, 0x5e, 0xa8, 0xbc, 0x1f, 0x40, 0x5f, 0xb9,
+	0x2a, 0xb9, 0xf7, 0x52, 0xdc, 0x2c, 0x2d, 0xe4, 0x3f, 0x06, 0x52, 0xbd, 0xe8, 0x50, 0x0d, 0x1e,
+	0xc1, 0xc4, 0x74, 0xf6, 0xc1, 0xb7, 0x29, 0xf6, 0xea, 0xd1, 0x43, 0xec, 0x13, 0x18, 0xfd, 0x46,
+	0x85, 0x2c, 0x70, 0xfb, 0xdf, 0xc3, 0xb8, 0x0c, 0x89, 0x8c, 0x7c, 0x01, 0xdd, 0x5c, 0x69, 0x25,
+	0xa1, 0xb3, 0x5b, 0x89, 0x5b, 0xbf, 0xdf, 0x07, 0xf8, 0x13, 0xb9, 0xa0, 0x2c, 0x55, 0x74, 0xdf,
+	0x40, 0x6f, 0x6b, 0x89, 0xcc, 0xec, 0x58, 0xfe, 0x0e, 0xb9, 0x7d, 0xba, 0xb5, 0xc8, 0x18, 0xd4,
+	0x76, 0xd6, 0x92, 0xb6, 0x02, 0xf5, 0xe9, 0xff, 0x03, 0xa3, 0x00, 0x2f, 0x39, 0x8a, 0xab, 0x3f,
+	0xd8, 0x5b, 0x4c, 0x03, 0xbc, 0xdc, 0x19, 0xd0, 0xfb, 0x60, 0xa7, 0x42, 0xf5, 0x93, 0xd9, 0xd9,
+	0xae, 0x01, 0x5e, 0xc6, 0x7a, 0x88, 0x74, 0x47, 0xc4, 0x61, 0x24, 0xf5, 0x84, 0x39, 0x41, 0xd7,
+	0x22, 0x3f, 0x4a, 0x15, 0x9b, 0x44, 0x42, 0xaa, 0x72, 0xc5, 0x7a, 0xc4, 0x9c, 0xc0, 0x55, 0xc0,
+	0x52, 0xa0, 0x12, 0x7d, 0xa8, 0x34, 0xb0, 0xf7, 0x2b, 0xc5, 0x0b, 0x8d, 0xdb, 0x28, 0x35, 0xee,
+	0xef, 0x30, 0x2a, 0x1d, 0x15, 0x19, 0x79, 0x0a, 0x43, 0x6e, 0xcc, 0x50, 0xaa, 0xa7, 0xe7, 0x92,
+	0x1d, 0x6b, 0xc9, 0x2a, 0x49, 0x05, 0x03, 0x5e, 0x00, 0x84, 0xff, 0x02, 0xc6, 0x01, 0xbe, 0x63,
+	0x6f, 0xf1, 0x0e, 0x97, 0xef, 0x15, 0xc0, 0xff, 0x12, 0x26, 0x15, 0xa6, 0x03, 0xdd, 0xf0, 0xe4,
+	0xdf, 0x16, 0x38, 0xcf, 0xf1, 0x86, 0x7c, 0x07, 0xfd, 0xe2, 0x42, 0x27, 0xe6, 0xe1, 0x95, 0xdf,
+	0x06, 0x6f, 0x5a, 0x83, 0x8a, 0xcc, 0xff, 0x44, 0x85, 0x17, 0xf7, 0x8c, 0x0d, 0xaf, 0x6c, 0x5b,
+	0x6f, 0x5a, 0x83, 0xe6, 0xe1, 0xc5, 0x5d, 0x6e, 0xc3, 0x2b, 0xbf, 0x00, 0xde, 0xb4, 0x06, 0xd5,
+	0xe1, 0x17, 0x30, 0x2c, 0x6f, 0x02, 0x72, 0x52, 0x78, 0x68, 0xa1, 0xd3, 0xbd, 0x59, 0x2d, 0x9e,
+	0x93, 0x94, 0x07, 0xd5, 0x92, 0xec, 0xac, 0x09, 0x6f, 0x56, 0x8b, 0xe7, 0x24, 0xe5, 0x79, 0xb4,
+	0x24, 0x3b, 0xf3, 0xec, 0xcd, 0x6a, 0x71, 0x4d, 0xf2, 0x0c, 0x06, 0xc5, 0x71, 0x14, 0x56, 0x8e,
+	0xca, 0xd4, 0x7a, 0xd3, 0x1a, 0x54, 0xc7, 0x3f, 0x06, 0xf8, 0x15, 0xa5, 0x1d, 0x41, 0x32, 0xd2,
+	0xc7, 0x6e, 0xc7, 0xd3, 0x1b, 0x97, 0x01, 0x1d, 0xf2, 0x2d, 0xf4, 0x0a, 0x2d, 0x4d, 0x3e, 0xdd,
+	0x52, 0xdf, 0xb6, 0xa4, 0x77, 0xbc, 0x0b, 0xea, 0xd8, 0x1f, 0x60, 0x50, 0x6a, 0x3a, 0x32, 0xb5,
+	0x4d, 0x5f, 0x6e, 0x69, 0xef, 0xa4, 0x0e, 0x56, 0x0c, 0x3f, 0x1d, 0x03, 0x59, 0xb1, 0xeb, 0xc5,
+	0x8a, 0x71, 0x64, 0x62, 0x11, 0xe3, 0x8d, 0x3a, 0xf9, 0xba, 0xad, 0xff, 0xc2, 0x7d, 0xf5, 0x61,
+	0x00, 0x23, 0x84, 0xec, 0xe7, 0xd3, 0x09, 0x00, 0x00,
 }
@@ -27,6 +27,16 @@ type Config struct {
 	GRPC      GRPC      `json:"grpc"`
 	Expiry    Expiry    `json:"expiry"`
 	Logger    Logger    `json:"logger"`
+	AdminAPI  AdminAPI  `json:"adminAPI"`
+	SelfTest  SelfTest  `json:"selfTest"`
+
+	ClientValidation ClientValidation `json:"clientValidation"`
+
+	Maintenance Maintenance `json:"maintenance"`
+
+	DirectorySync DirectorySync `json:"directorySync"`
+
+	SMS SMS `json:"sms"`
 
 	Frontend server.WebConfig `json:"frontend"`
 
@@ -91,11 +101,180 @@ func (p *password) UnmarshalJSON(b []byte) error {
 // OAuth2 describes enabled OAuth2 extensions.
 type OAuth2 struct {
 	ResponseTypes []string `json:"responseTypes"`
+	// If specified, only these combinations of the response types, such as
+	// "code" or "code id_token", may be requested.
+	ResponseTypeCombinations []string `json:"responseTypeCombinations"`
+	// If specified, the name of an ID token claim holding the ID of the connector
+	// the user logged in with. Only included for the "federated:id" scope.
+	ConnectorIDClaim string `json:"connectorIDClaim"`
+	// If specified, an authorization request parameter selecting the connector
+	// like "connector_id", for clients sending "idp" or "kc_idp_hint".
+	ConnectorIDParameter string `json:"connectorIDParameter"`
+	// If specified, the claims each scope releases in ID tokens, mapped to the
+	// user attribute they hold. Custom scopes may be added, and listing the
+	// "email", "groups" or "profile" scope replaces its default claims.
+	ScopeClaims map[string]map[string]string `json:"scopeClaims"`
+	// If specified, attributes derived from the user's other attributes by
+	// expressions such as `{{ index (split .email "@") 0 }}`, which scopeClaims
+	// can release. Expressions which fail leave their claim out.
+	ClaimExpressions map[string]string `json:"claimExpressions"`
+	// If specified, the JWKS URIs of peer dex instances serving the same
+	// issuer, such as the other half of a blue/green deployment. ID tokens
+	// they signed are accepted by the identities endpoint and token exchange.
+	PeerJWKSURIs []string `json:"peerJWKSURIs"`
+	// If specified, public clients must use PKCE to request authorization codes.
+	// Older clients which don't support it will fail to log in.
+	RequirePKCE bool `json:"requirePKCE"`
+	// If "ignore", redirect URIs differing from the registered ones only by a
+	// trailing slash are accepted. Defaults to "strict".
+	RedirectURITrailingSlash string `json:"redirectURITrailingSlash"`
+	// If "peers-only", ID tokens requested with cross-client scopes are only
+	// issued to the peers, rather than to the requesting client as well.
+	// Defaults to "client-first". Clients may set their own policy.
+	CrossClientAudience string `json:"crossClientAudience"`
+	// If specified, the maximum lengths of authorization requests and of their
+	// "scope", "claims" and "request" parameters, and the maximum number of
+	// distinct scopes requested.
+	RequestLimits server.AuthRequestLimits `json:"requestLimits"`
+	// If specified, the maximum number of logins started but not completed
+	// yet, in total and per IP address.
+	PendingLoginLimits server.PendingLoginLimits `json:"pendingLoginLimits"`
+	// If specified, the maximum size of ID tokens in bytes, and whether
+	// larger ones are rejected or trimmed of the listed claims.
+	IDTokenSizeLimit server.IDTokenSizeLimit `json:"idTokenSizeLimit"`
+	// If specified, ID tokens carry a "nbf" claim, which some verifiers
+	// require. It's set to the issue time, less the optional leeway for
+	// clients whose clocks run behind, such as "30s".
+	IDTokenNotBefore bool   `json:"idTokenNotBefore"`
+	NotBeforeLeeway  string `json:"notBeforeLeeway"`
+	// If specified, a policy service called before ID tokens are issued, which
+	// can add claims to them or deny them.
+	TokenWebhook TokenWebhook `json:"tokenWebhook"`
+	// If specified, the algorithm ID tokens are signed with: "RS256" (the
+	// default), "ES256", "ES384" or "ES512". A change takes effect at the next
+	// key rotation.
+	SigningAlgorithm string `json:"signingAlgorithm"`
+	// If specified, the number of random bytes in generated client secrets,
+	// authorization codes, access tokens and refresh tokens. Defaults to 32,
+	// and can't be less than 16.
+	SecretBytes int `json:"secretBytes"`
+	// If specified, requirements client secrets set through the gRPC and admin
+	// APIs must meet. Generated secrets aren't checked.
+	SecretPolicy SecretPolicy `json:"secretPolicy"`
+	// If specified, redirect URIs of static clients and of clients created or
+	// updated through the gRPC API must use https, except loopback ones used by
+	// native apps. AllowHTTPRedirectURIs turns the check off, for development
+	// environments sharing the production config.
+	RequireHTTPSRedirectURIs bool `json:"requireHTTPSRedirectURIs"`
+	AllowHTTPRedirectURIs    bool `json:"allowHTTPRedirectURIs"`
+	// If specified, the resource servers clients may request access tokens
+	// for with the "resource" parameter, and whether those tokens are opaque
+	// or JWTs.
+	Resources []server.Resource `json:"resources"`
+	// If specified, clients may exchange ID tokens issued to them for ID tokens
+	// addressed to clients listing them as trusted peers, recording the chain
+	// of clients in the "act" claim. Limits how many times a user's token can
+	// be delegated this way.
+	TokenExchangeMaxDepth int `json:"tokenExchangeMaxDepth"`
+	// If specified, clients may ask for the authorization response as a JWT
+	// signed by dex, with the "jwt", "query.jwt" and "fragment.jwt" response
+	// modes.
+	JWTResponseModes bool `json:"jwtResponseModes"`
+	// If specified, what to do when a connector returns a user without an
+	// email: "proceed" (the default), "reject" or "prompt" the user for one.
+	MissingEmailPolicy string `json:"missingEmailPolicy"`
+	// If specified, the token endpoint also takes JSON request bodies.
+	JSONTokenRequests bool `json:"jsonTokenRequests"`
+	// If specified, authorization requests with an unsupported response type
+	// get an error page rather than redirecting the error to the client.
+	DirectResponseTypeErrors bool `json:"directResponseTypeErrors"`
+	// If specified, the HTTP status codes of error responses by OAuth2 error
+	// code, for example 503 for "temporarily_unavailable".
+	ErrorStatusCodes map[string]int `json:"errorStatusCodes"`
+	// If specified, how long responses to failed authentication attempts are
+	// delayed for, plus a random jitter, for example "200ms" and "300ms".
+	AuthFailureDelay  string `json:"authFailureDelay"`
+	AuthFailureJitter string `json:"authFailureJitter"`
 	// If specified, do not prompt the user to approve client authorization. The
 	// act of logging in implies authorization.
 	SkipApprovalScreen bool `json:"skipApprovalScreen"`
 }
 
+// TokenWebhook is the config for the webhook called before ID tokens are
+// issued.
+type TokenWebhook struct {
+	URL string `json:"url"`
+	// How long to wait for the webhook, for example "2s". Defaults to 5 seconds.
+	Timeout string `json:"timeout"`
+	// If set, tokens are issued without the webhook's claims when it fails.
+	// Otherwise token requests fail as well.
+	FailOpen bool `json:"failOpen"`
+}
+
+// SecretPolicy is the config for rejecting weak client secrets.
+type SecretPolicy struct {
+	MinLength int `json:"minLength"`
+	// Minimum entropy in bits, estimated from how often each character of a
+	// secret occurs.
+	MinEntropyBits int `json:"minEntropyBits"`
+	// Path to a file of known compromised secrets, one per line.
+	DenylistFile string `json:"denylistFile"`
+}
+
+// Maintenance configures the server's maintenance mode, which can also be toggled
+// at runtime through the admin API.
+type Maintenance struct {
+	// If set, the server starts refusing new logins.
+	Enabled bool `json:"enabled"`
+	// How long token requests are still served after maintenance starts.
+	// Defaults to the auth code expiry.
+	DrainPeriod string `json:"drainPeriod"`
+}
+
+// DirectorySync configures checking users against the directories of
+// connectors which support it, such as LDAP.
+type DirectorySync struct {
+	// How often to check. Disabled if empty.
+	Interval string `json:"interval"`
+	// If set, users removed from the directory are disabled. Otherwise they're
+	// only logged.
+	Prune bool `json:"prune"`
+}
+
+// SMS enables the SMS second factor for users with a phone number.
+type SMS struct {
+	// "webhook" posts messages to a gateway, "log" only logs them, codes
+	// included, for development. Disabled if empty.
+	Sender string `json:"sender"`
+	// The URL messages are posted to by the "webhook" sender.
+	WebhookURL string `json:"webhookURL"`
+	// If specified, how long codes are valid for, at most 15m. Defaults to 5m.
+	CodeValidFor string `json:"codeValidFor"`
+	// If specified, the number of codes sent to a user per period. Defaults
+	// to 3 per 15m.
+	RateLimit SMSRateLimit `json:"rateLimit"`
+}
+
+// SMSRateLimit limits the number of codes sent to a user.
+type SMSRateLimit struct {
+	Codes  int    `json:"codes"`
+	Period string `json:"period"`
+}
+
+// SelfTest configures the checks run by the server before serving traffic.
+type SelfTest struct {
+	Enabled bool `json:"enabled"`
+	// If set, log a failed self-test instead of refusing to start.
+	WarnOnly bool `json:"warnOnly"`
+}
+
+// ClientValidation configures the checks of stored clients run on startup.
+type ClientValidation struct {
+	Enabled bool `json:"enabled"`
+	// If set, refuse to start if a client is invalid instead of logging it.
+	Strict bool `json:"strict"`
+}
+
 // Web is the config format for the HTTP server.
 type Web struct {
 	HTTP           string   `json:"http"`
@@ -103,6 +282,42 @@ type Web struct {
 	TLSCert        string   `json:"tlsCert"`
 	TLSKey         string   `json:"tlsKey"`
 	AllowedOrigins []string `json:"allowedOrigins"`
+
+	// If specified, an HTTP address serving the admin endpoints, which are
+	// then no longer served by the public listeners, and metrics, which are
+	// still served by the telemetry listener.
+	Internal string `json:"internal"`
+
+	// Caching headers for the discovery, keys and token endpoints.
+	CachePolicies server.CachePolicies `json:"cachePolicies"`
+
+	// How long connector health checks are reused for, for example "30s".
+	ConnectorHealthTTL string `json:"connectorHealthTTL"`
+
+	// If specified, how often the login URLs of connectors are fetched to
+	// check the upstream providers are reachable, for example "1m".
+	LoginProbeInterval string `json:"loginProbeInterval"`
+
+	// If specified, what to do when the issuer uses plaintext HTTP: "allow",
+	// "warn" to add a warning to the discovery document, or "reject" to
+	// refuse to serve it.
+	HTTPIssuer string `json:"httpIssuer"`
+
+	// Security headers, such as Strict-Transport-Security, sent with every
+	// response.
+	SecurityHeaders server.SecurityHeaders `json:"securityHeaders"`
+
+	// If set, the HTTPS listener asks clients for a certificate, which the
+	// clientcert connector logs users in with. Clients without one can still
+	// connect.
+	RequestClientCert bool `json:"requestClientCert"`
+
+	// If specified, how long clients have to send the headers of a request,
+	// then its body, for example "10s". Connections sending them more slowly
+	// are closed rather than tying up the server, and the token endpoint
+	// answers requests whose body doesn't arrive in time with an error.
+	ReadHeaderTimeout string `json:"readHeaderTimeout"`
+	ReadBodyTimeout   string `json:"readBodyTimeout"`
 }
 
 // Telemetry is the config format for telemetry including the HTTP server config.
@@ -119,10 +334,66 @@ type GRPC struct {
 	TLSClientCA string `json:"tlsClientCA"`
 }
 
+// AdminAPI is the config for the admin HTTP endpoints served under the issuer.
+type AdminAPI struct {
+	// Bearer token admins must present. The endpoints are disabled if empty.
+	Key string `json:"key"`
+
+	// bcrypt cost for passwords of users created through the API. Defaults to 12.
+	PasswordHashCost int `json:"passwordHashCost"`
+
+	// IDs of the clients whose ID tokens users may present to the /identities
+	// endpoint to manage their own identities. It refuses all tokens if empty.
+	IdentitiesClients []string `json:"identitiesClients"`
+}
+
 // Storage holds app's storage configuration.
 type Storage struct {
 	Type   string        `json:"type"`
 	Config StorageConfig `json:"config"`
+
+	Retry StorageRetry `json:"retry"`
+
+	Encryption StorageEncryption `json:"encryption"`
+
+	ClientCache StorageClientCache `json:"clientCache"`
+}
+
+// StorageRetry configures how storage operations on the login and token paths
+// are retried after transient failures, such as a dropped database connection.
+type StorageRetry struct {
+	// Number of times an operation is attempted. Defaults to 3, set to 1 to
+	// disable retries.
+	Attempts int `json:"attempts"`
+	// Delay before the first retry, doubled for each one after that. Defaults
+	// to 100ms.
+	Backoff string `json:"backoff"`
+	// Maximum delay between two attempts. Defaults to 2s.
+	MaxBackoff string `json:"maxBackoff"`
+}
+
+// StorageClientCache caches client lookups in memory, sparing the storage a
+// query on every authorization and token request. Clients changed through
+// another dex instance are only seen once they expire from the cache.
+type StorageClientCache struct {
+	// How long clients are cached for, such as "30s". Disabled if empty.
+	TTL string `json:"ttl"`
+	// Maximum number of clients cached. Defaults to 1000.
+	Size int `json:"size"`
+}
+
+// StorageEncryption encrypts the claims and connector data of sessions at rest.
+type StorageEncryption struct {
+	// The first key encrypts new sessions, all of them decrypt. Disabled if
+	// empty.
+	Keys []StorageEncryptionKey `json:"keys"`
+}
+
+// StorageEncryptionKey is a base64 encoded, 32 byte key. Environment
+// variables, such as "$DEX_STORAGE_KEY", are expanded.
+type StorageEncryptionKey struct {
+	ID  string `json:"id"`
+	Key string `json:"key"`
 }
 
 // StorageConfig is a configuration that can create a storage.
@@ -144,6 +415,11 @@ func (s *Storage) UnmarshalJSON(b []byte) error {
 	var store struct {
 		Type   string          `json:"type"`
 		Config json.RawMessage `json:"config"`
+		Retry  StorageRetry    `json:"retry"`
+
+		Encryption StorageEncryption `json:"encryption"`
+
+		ClientCache StorageClientCache `json:"clientCache"`
 	}
 	if err := json.Unmarshal(b, &store); err != nil {
 		return fmt.Errorf("parse storage: %v", err)
@@ -163,6 +439,11 @@ func (s *Storage) UnmarshalJSON(b []byte) error {
 	*s = Storage{
 		Type:   store.Type,
 		Config: storageConfig,
+		Retry:  store.Retry,
+
+		Encryption: store.Encryption,
+
+		ClientCache: store.ClientCache,
 	}
 	return nil
 }
@@ -174,6 +455,31 @@ type Connector struct {
 	Name string `json:"name"`
 	ID   string `json:"id"`
 
+	// If specified, users with a verified email outside of these domains can't
+	// login through the connector. "*.example.com" allows any subdomain.
+	AllowedEmailDomains []string `json:"allowedEmailDomains"`
+
+	// If specified, only these clients may have users login through the
+	// connector.
+	AllowedClients []string `json:"allowedClients"`
+
+	// Headers added to the HTTP requests the connector makes upstream. Values
+	// starting with a "$" read from the environment.
+	Headers map[string]string `json:"headers"`
+
+	// If specified, replaces the issuer's name and logo on the pages shown
+	// while users login through the connector.
+	Branding storage.ConnectorBranding `json:"branding"`
+
+	// If set to false, only users which already exist, such as ones created
+	// through the admin API, can login through the connector. Defaults to
+	// creating users the first time they login.
+	JITProvisioning *bool `json:"jitProvisioning"`
+
+	// Attributes identities returned by the connector must have, such as
+	// "email". Logins without them are refused.
+	RequiredAttributes []string `json:"requiredAttributes"`
+
 	Config server.ConnectorConfig `json:"config"`
 }
 
@@ -185,6 +491,16 @@ func (c *Connector) UnmarshalJSON(b []byte) error {
 		Name string `json:"name"`
 		ID   string `json:"id"`
 
+		AllowedEmailDomains []string `json:"allowedEmailDomains"`
+		AllowedClients      []string `json:"allowedClients"`
+
+		Headers map[string]string `json:"headers"`
+
+		Branding storage.ConnectorBranding `json:"branding"`
+
+		JITProvisioning    *bool    `json:"jitProvisioning"`
+		RequiredAttributes []string `json:"requiredAttributes"`
+
 		Config json.RawMessage `json:"config"`
 	}
 	if err := json.Unmarshal(b, &conn); err != nil {
@@ -202,11 +518,20 @@ func (c *Connector) UnmarshalJSON(b []byte) error {
 			return fmt.Errorf("parse connector config: %v", err)
 		}
 	}
+	for name, value := range conn.Headers {
+		conn.Headers[name] = os.ExpandEnv(value)
+	}
 	*c = Connector{
-		Type:   conn.Type,
-		Name:   conn.Name,
-		ID:     conn.ID,
-		Config: connConfig,
+		Type:                conn.Type,
+		Name:                conn.Name,
+		ID:                  conn.ID,
+		AllowedEmailDomains: conn.AllowedEmailDomains,
+		AllowedClients:      conn.AllowedClients,
+		Headers:             conn.Headers,
+		Branding:            conn.Branding,
+		JITProvisioning:     conn.JITProvisioning,
+		RequiredAttributes:  conn.RequiredAttributes,
+		Config:              connConfig,
 	}
 	return nil
 }
@@ -219,10 +544,16 @@ func ToStorageConnector(c Connector) (storage.Connector, error) {
 	}
 
 	return storage.Connector{
-		ID:     c.ID,
-		Type:   c.Type,
-		Name:   c.Name,
-		Config: data,
+		ID:                  c.ID,
+		Type:                c.Type,
+		Name:                c.Name,
+		Config:              data,
+		AllowedEmailDomains: c.AllowedEmailDomains,
+		AllowedClients:      c.AllowedClients,
+		Headers:             c.Headers,
+		Branding:            c.Branding,
+		JITProvisioning:     c.JITProvisioning,
+		RequiredAttributes:  c.RequiredAttributes,
 	}, nil
 }
 
@@ -236,6 +567,23 @@ type Expiry struct {
 
 	// AuthRequests defines the duration of time for which the AuthRequests will be valid.
 	AuthRequests string `json:"authRequests"`
+
+	// PendingLogins defines how long users have to complete a login once sent
+	// to a connector. Defaults to the auth request expiry.
+	PendingLogins string `json:"pendingLogins"`
+
+	// AuthCodes defines the duration of time for which authorization codes can be exchanged.
+	AuthCodes string `json:"authCodes"`
+
+	// RefreshTokens defines the duration of time after login for which refresh
+	// tokens can be used, and RefreshTokensIdle the duration after their last
+	// use. Both are unlimited by default.
+	RefreshTokens     string `json:"refreshTokens"`
+	RefreshTokensIdle string `json:"refreshTokensIdle"`
+
+	// SessionsIdle defines the duration after which a login ends if none of
+	// the refresh tokens issued for it has been used. Unlimited by default.
+	SessionsIdle string `json:"sessionsIdle"`
 }
 
 // Logger holds configuration required to customize logging for dex.
@@ -245,4 +593,8 @@ type Logger struct {
 
 	// Format specifies the format to be used for logging.
 	Format string `json:"format"`
+
+	// If specified, log every token issued with its ID, client, subject,
+	// connector, scopes and lifetime. Tokens themselves are never logged.
+	TokenIssuance bool `json:"tokenIssuance"`
 }
@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -83,6 +84,7 @@ func serve(cmd *cobra.Command, args []string) error {
 		{c.Web.HTTP == "" && c.Web.HTTPS == "", "must supply a HTTP/HTTPS  address to listen on"},
 		{c.Web.HTTPS != "" && c.Web.TLSCert == "", "no cert specified for HTTPS"},
 		{c.Web.HTTPS != "" && c.Web.TLSKey == "", "no private key specified for HTTPS"},
+		{c.Web.HTTPS == "" && c.Web.RequestClientCert, "cannot request client certificates without HTTPS"},
 		{c.GRPC.TLSCert != "" && c.GRPC.Addr == "", "no address specified for gRPC"},
 		{c.GRPC.TLSKey != "" && c.GRPC.Addr == "", "no address specified for gRPC"},
 		{(c.GRPC.TLSCert == "") != (c.GRPC.TLSKey == ""), "must specific both a gRPC TLS cert and key"},
@@ -159,8 +161,83 @@ func serve(cmd *cobra.Command, args []string) error {
 	}
 	logger.Infof("config storage: %s", c.Storage.Type)
 
+	retry := storage.RetryConfig{Attempts: c.Storage.Retry.Attempts}
+	if retry.Attempts < 0 {
+		return fmt.Errorf("invalid config value %d for storage retry attempts", retry.Attempts)
+	}
+	if c.Storage.Retry.Backoff != "" {
+		if retry.Backoff, err = time.ParseDuration(c.Storage.Retry.Backoff); err != nil {
+			return fmt.Errorf("invalid config value %q for storage retry backoff: %v", c.Storage.Retry.Backoff, err)
+		}
+	}
+	if c.Storage.Retry.MaxBackoff != "" {
+		if retry.MaxBackoff, err = time.ParseDuration(c.Storage.Retry.MaxBackoff); err != nil {
+			return fmt.Errorf("invalid config value %q for storage retry max backoff: %v", c.Storage.Retry.MaxBackoff, err)
+		}
+	}
+	s = storage.WithRetries(s, retry, logger)
+
+	if len(c.Storage.Encryption.Keys) > 0 {
+		keys := make([]storage.EncryptionKey, len(c.Storage.Encryption.Keys))
+		for i, k := range c.Storage.Encryption.Keys {
+			key, err := base64.StdEncoding.DecodeString(os.ExpandEnv(k.Key))
+			if err != nil {
+				return fmt.Errorf("invalid config value for storage encryption key %q: %v", k.ID, err)
+			}
+			keys[i] = storage.EncryptionKey{ID: k.ID, Key: key}
+		}
+		if s, err = storage.WithEncryption(s, keys); err != nil {
+			return fmt.Errorf("invalid config: storage encryption: %v", err)
+		}
+		logger.Infof("config storage encryption key: %s", keys[0].ID)
+	}
+
+	if c.Storage.ClientCache.TTL != "" {
+		cache := storage.ClientCacheConfig{Size: c.Storage.ClientCache.Size}
+		if cache.TTL, err = time.ParseDuration(c.Storage.ClientCache.TTL); err != nil || cache.TTL <= 0 {
+			return fmt.Errorf("invalid config value %q for storage client cache TTL", c.Storage.ClientCache.TTL)
+		}
+		if cache.Size < 0 {
+			return fmt.Errorf("invalid config value %d for storage client cache size", cache.Size)
+		}
+		s = storage.WithClientCache(s, cache)
+		logger.Infof("config storage client cache TTL: %s", cache.TTL)
+	}
+
+	requireHTTPSRedirectURIs := c.OAuth2.RequireHTTPSRedirectURIs
+	if requireHTTPSRedirectURIs && c.OAuth2.AllowHTTPRedirectURIs {
+		logger.Errorf("config allows plaintext HTTP redirect URIs, don't use it in production")
+		requireHTTPSRedirectURIs = false
+	}
+
 	if len(c.StaticClients) > 0 {
 		for _, client := range c.StaticClients {
+			if len(client.DefaultScopes) > 0 && !client.OAuth2Only {
+				hasOpenID := false
+				for _, scope := range client.DefaultScopes {
+					hasOpenID = hasOpenID || scope == "openid"
+				}
+				if !hasOpenID {
+					return fmt.Errorf("invalid config: default scopes of client %q must include \"openid\"", client.ID)
+				}
+			}
+			if client.DefaultRedirectURI != "" {
+				registered := false
+				for _, uri := range client.RedirectURIs {
+					registered = registered || uri == client.DefaultRedirectURI
+				}
+				if !registered {
+					return fmt.Errorf("invalid config: default redirect URI of client %q must be one of its redirect URIs", client.ID)
+				}
+			}
+			if err := server.ValidateClaimRenames(client.ClaimRenames); err != nil {
+				return fmt.Errorf("invalid config: claim renames of client %q: %v", client.ID, err)
+			}
+			if requireHTTPSRedirectURIs {
+				if err := server.ValidateHTTPSRedirectURIs(client.RedirectURIs); err != nil {
+					return fmt.Errorf("invalid config: client %q: %v", client.ID, err)
+				}
+			}
 			logger.Infof("config static client: %s", client.ID)
 		}
 		s = storage.WithStaticClients(s, c.StaticClients)
@@ -206,9 +283,24 @@ func serve(cmd *cobra.Command, args []string) error {
 	if len(c.OAuth2.ResponseTypes) > 0 {
 		logger.Infof("config response types accepted: %s", c.OAuth2.ResponseTypes)
 	}
+	if len(c.OAuth2.ResponseTypeCombinations) > 0 {
+		logger.Infof("config response type combinations accepted: %q", c.OAuth2.ResponseTypeCombinations)
+	}
 	if c.OAuth2.SkipApprovalScreen {
 		logger.Infof("config skipping approval screen")
 	}
+	if c.OAuth2.RequirePKCE {
+		logger.Infof("config requiring PKCE for public clients")
+	}
+	if c.OAuth2.ConnectorIDParameter != "" {
+		logger.Infof("config connector ID parameter: %s", c.OAuth2.ConnectorIDParameter)
+	}
+	if c.OAuth2.RedirectURITrailingSlash != "" {
+		logger.Infof("config redirect URI trailing slash policy: %s", c.OAuth2.RedirectURITrailingSlash)
+	}
+	if c.OAuth2.CrossClientAudience != "" {
+		logger.Infof("config cross-client audience policy: %s", c.OAuth2.CrossClientAudience)
+	}
 	if len(c.Web.AllowedOrigins) > 0 {
 		logger.Infof("config allowed origins: %s", c.Web.AllowedOrigins)
 	}
@@ -217,15 +309,40 @@ func serve(cmd *cobra.Command, args []string) error {
 	now := func() time.Time { return time.Now().UTC() }
 
 	serverConfig := server.Config{
-		SupportedResponseTypes: c.OAuth2.ResponseTypes,
-		SkipApprovalScreen:     c.OAuth2.SkipApprovalScreen,
-		AllowedOrigins:         c.Web.AllowedOrigins,
-		Issuer:                 c.Issuer,
-		Storage:                s,
-		Web:                    c.Frontend,
-		Logger:                 logger,
-		Now:                    now,
-		PrometheusRegistry:     prometheusRegistry,
+		SupportedResponseTypes:   c.OAuth2.ResponseTypes,
+		ResponseTypeCombinations: c.OAuth2.ResponseTypeCombinations,
+		ConnectorIDClaim:         c.OAuth2.ConnectorIDClaim,
+		ConnectorIDParameter:     c.OAuth2.ConnectorIDParameter,
+		ScopeClaims:              c.OAuth2.ScopeClaims,
+		ClaimExpressions:         c.OAuth2.ClaimExpressions,
+		PeerJWKSURIs:             c.OAuth2.PeerJWKSURIs,
+		RequirePKCE:              c.OAuth2.RequirePKCE,
+		RedirectURITrailingSlash: c.OAuth2.RedirectURITrailingSlash,
+		CrossClientAudience:      c.OAuth2.CrossClientAudience,
+		AuthRequestLimits:        c.OAuth2.RequestLimits,
+		PendingLoginLimits:       c.OAuth2.PendingLoginLimits,
+		IDTokenSizeLimit:         c.OAuth2.IDTokenSizeLimit,
+		IDTokenNotBefore:         c.OAuth2.IDTokenNotBefore,
+		SkipApprovalScreen:       c.OAuth2.SkipApprovalScreen,
+		AllowedOrigins:           c.Web.AllowedOrigins,
+		CachePolicies:            c.Web.CachePolicies,
+		SecurityHeaders:          c.Web.SecurityHeaders,
+		AdminAPIKey:              c.AdminAPI.Key,
+		IdentitiesClients:        c.AdminAPI.IdentitiesClients,
+		PasswordHashCost:         c.AdminAPI.PasswordHashCost,
+		InternalAdminAPI:         c.Web.Internal != "",
+		MaintenanceMode:          c.Maintenance.Enabled,
+		SelfTest:                 c.SelfTest.Enabled,
+		SelfTestWarnOnly:         c.SelfTest.WarnOnly,
+		ValidateClients:          c.ClientValidation.Enabled,
+		ValidateClientsStrict:    c.ClientValidation.Strict,
+		RequireHTTPSRedirectURIs: requireHTTPSRedirectURIs,
+		Issuer:                   c.Issuer,
+		Storage:                  s,
+		Web:                      c.Frontend,
+		Logger:                   logger,
+		Now:                      now,
+		PrometheusRegistry:       prometheusRegistry,
 	}
 	if c.Expiry.SigningKeys != "" {
 		signingKeys, err := time.ParseDuration(c.Expiry.SigningKeys)
@@ -251,6 +368,252 @@ func serve(cmd *cobra.Command, args []string) error {
 		logger.Infof("config auth requests valid for: %v", authRequests)
 		serverConfig.AuthRequestsValidFor = authRequests
 	}
+	if c.Expiry.PendingLogins != "" {
+		pendingLogins, err := time.ParseDuration(c.Expiry.PendingLogins)
+		if err != nil {
+			return fmt.Errorf("invalid config value %q for pending login expiry: %v", c.Expiry.PendingLogins, err)
+		}
+		if pendingLogins <= 0 {
+			return fmt.Errorf("invalid config value %q for pending login expiry: must be positive", c.Expiry.PendingLogins)
+		}
+		logger.Infof("config pending logins valid for: %v", pendingLogins)
+		serverConfig.PendingLoginsValidFor = pendingLogins
+	}
+	if c.Expiry.AuthCodes != "" {
+		authCodes, err := time.ParseDuration(c.Expiry.AuthCodes)
+		if err != nil {
+			return fmt.Errorf("invalid config value %q for auth code expiry: %v", c.Expiry.AuthCodes, err)
+		}
+		logger.Infof("config auth codes valid for: %v", authCodes)
+		serverConfig.AuthCodesValidFor = authCodes
+	}
+	if c.Expiry.RefreshTokens != "" {
+		refreshTokens, err := time.ParseDuration(c.Expiry.RefreshTokens)
+		if err != nil {
+			return fmt.Errorf("invalid config value %q for refresh token expiry: %v", c.Expiry.RefreshTokens, err)
+		}
+		logger.Infof("config refresh tokens valid for: %v", refreshTokens)
+		serverConfig.RefreshTokensValidFor = refreshTokens
+	}
+	if c.Expiry.RefreshTokensIdle != "" {
+		idle, err := time.ParseDuration(c.Expiry.RefreshTokensIdle)
+		if err != nil {
+			return fmt.Errorf("invalid config value %q for refresh token idle expiry: %v", c.Expiry.RefreshTokensIdle, err)
+		}
+		logger.Infof("config refresh tokens expire when unused for: %v", idle)
+		serverConfig.RefreshTokensIdleTimeout = idle
+	}
+	if c.Expiry.SessionsIdle != "" {
+		idle, err := time.ParseDuration(c.Expiry.SessionsIdle)
+		if err != nil {
+			return fmt.Errorf("invalid config value %q for session idle expiry: %v", c.Expiry.SessionsIdle, err)
+		}
+		logger.Infof("config login sessions expire when unused for: %v", idle)
+		serverConfig.SessionIdleTimeout = idle
+	}
+	if c.OAuth2.NotBeforeLeeway != "" {
+		leeway, err := time.ParseDuration(c.OAuth2.NotBeforeLeeway)
+		if err != nil {
+			return fmt.Errorf("invalid config value %q for not before leeway: %v", c.OAuth2.NotBeforeLeeway, err)
+		}
+		logger.Infof("config id tokens valid from %v before they're issued", leeway)
+		serverConfig.NotBeforeLeeway = leeway
+	}
+	if c.Maintenance.DrainPeriod != "" {
+		drain, err := time.ParseDuration(c.Maintenance.DrainPeriod)
+		if err != nil {
+			return fmt.Errorf("invalid config value %q for maintenance drain period: %v", c.Maintenance.DrainPeriod, err)
+		}
+		serverConfig.MaintenanceDrainPeriod = drain
+	}
+	if c.OAuth2.TokenWebhook.URL != "" {
+		serverConfig.TokenWebhook = server.TokenWebhook{
+			URL:      c.OAuth2.TokenWebhook.URL,
+			FailOpen: c.OAuth2.TokenWebhook.FailOpen,
+		}
+		if c.OAuth2.TokenWebhook.Timeout != "" {
+			timeout, err := time.ParseDuration(c.OAuth2.TokenWebhook.Timeout)
+			if err != nil {
+				return fmt.Errorf("invalid config value %q for token webhook timeout: %v", c.OAuth2.TokenWebhook.Timeout, err)
+			}
+			serverConfig.TokenWebhook.Timeout = timeout
+		}
+		logger.Infof("config token webhook: %s, fail open: %t", c.OAuth2.TokenWebhook.URL, c.OAuth2.TokenWebhook.FailOpen)
+	}
+	if c.OAuth2.SigningAlgorithm != "" {
+		serverConfig.SigningAlgorithm = c.OAuth2.SigningAlgorithm
+		logger.Infof("config signing algorithm: %s", c.OAuth2.SigningAlgorithm)
+	}
+	if c.OAuth2.SecretBytes != 0 {
+		if c.OAuth2.SecretBytes < 16 {
+			return fmt.Errorf("invalid config value %d for secret bytes: must be at least 16", c.OAuth2.SecretBytes)
+		}
+		serverConfig.SecretGenerator = server.NewSecretGenerator(c.OAuth2.SecretBytes)
+		logger.Infof("config secret bytes: %d", c.OAuth2.SecretBytes)
+	}
+	if p := c.OAuth2.SecretPolicy; p != (SecretPolicy{}) {
+		if p.MinLength < 0 || p.MinEntropyBits < 0 {
+			return fmt.Errorf("invalid config value for secret policy: minimums can't be negative")
+		}
+		serverConfig.SecretPolicy = server.SecretPolicy{MinLength: p.MinLength, MinEntropyBits: p.MinEntropyBits}
+		if p.DenylistFile != "" {
+			denylist, err := server.LoadSecretDenylist(p.DenylistFile)
+			if err != nil {
+				return fmt.Errorf("invalid config value %q for secret denylist file: %v", p.DenylistFile, err)
+			}
+			serverConfig.SecretPolicy.Denylist = denylist
+		}
+		logger.Infof("config secret policy: min length %d, min entropy %d bits, %d denied secrets",
+			p.MinLength, p.MinEntropyBits, len(serverConfig.SecretPolicy.Denylist))
+	}
+	if len(c.OAuth2.Resources) > 0 {
+		serverConfig.Resources = c.OAuth2.Resources
+		for _, r := range c.OAuth2.Resources {
+			format := r.AccessTokenFormat
+			if format == "" {
+				format = "opaque"
+			}
+			logger.Infof("config resource: %s, access token format: %s", r.URI, format)
+		}
+	}
+	if c.OAuth2.TokenExchangeMaxDepth != 0 {
+		if c.OAuth2.TokenExchangeMaxDepth < 0 {
+			return fmt.Errorf("invalid config value %d for token exchange max depth", c.OAuth2.TokenExchangeMaxDepth)
+		}
+		serverConfig.TokenExchangeMaxDepth = c.OAuth2.TokenExchangeMaxDepth
+		logger.Infof("config token exchange: max depth %d", c.OAuth2.TokenExchangeMaxDepth)
+	}
+	if c.OAuth2.JWTResponseModes {
+		serverConfig.JWTResponseModes = true
+		logger.Infof("config JWT response modes enabled")
+	}
+	if c.OAuth2.MissingEmailPolicy != "" {
+		switch c.OAuth2.MissingEmailPolicy {
+		case "proceed", "reject", "prompt":
+		default:
+			return fmt.Errorf("invalid config value %q for missing email policy", c.OAuth2.MissingEmailPolicy)
+		}
+		serverConfig.MissingEmailPolicy = c.OAuth2.MissingEmailPolicy
+		logger.Infof("config missing email policy: %s", c.OAuth2.MissingEmailPolicy)
+	}
+	if c.Logger.TokenIssuance {
+		serverConfig.LogTokenIssuance = true
+		logger.Infof("config logging token issuance")
+	}
+	if c.OAuth2.JSONTokenRequests {
+		serverConfig.JSONTokenRequests = true
+		logger.Infof("config JSON token requests enabled")
+	}
+	if c.OAuth2.AuthFailureDelay != "" {
+		delay, err := time.ParseDuration(c.OAuth2.AuthFailureDelay)
+		if err != nil || delay < 0 {
+			return fmt.Errorf("invalid config value %q for auth failure delay", c.OAuth2.AuthFailureDelay)
+		}
+		serverConfig.AuthFailureDelay = delay
+	}
+	if c.OAuth2.AuthFailureJitter != "" {
+		jitter, err := time.ParseDuration(c.OAuth2.AuthFailureJitter)
+		if err != nil || jitter < 0 {
+			return fmt.Errorf("invalid config value %q for auth failure jitter", c.OAuth2.AuthFailureJitter)
+		}
+		serverConfig.AuthFailureJitter = jitter
+	}
+	if serverConfig.AuthFailureDelay > 0 || serverConfig.AuthFailureJitter > 0 {
+		logger.Infof("config auth failure delay: %v, jitter: %v", serverConfig.AuthFailureDelay, serverConfig.AuthFailureJitter)
+	}
+	if l := c.OAuth2.PendingLoginLimits; l.Total != 0 || l.PerIP != 0 {
+		logger.Infof("config pending login limits: total %d, per IP %d", l.Total, l.PerIP)
+	}
+	if c.OAuth2.DirectResponseTypeErrors {
+		serverConfig.DirectResponseTypeErrors = true
+		logger.Infof("config direct response type errors enabled")
+	}
+	if len(c.OAuth2.ErrorStatusCodes) > 0 {
+		serverConfig.ErrorStatusCodes = c.OAuth2.ErrorStatusCodes
+		logger.Infof("config error status codes: %v", c.OAuth2.ErrorStatusCodes)
+	}
+	if c.Web.ConnectorHealthTTL != "" {
+		ttl, err := time.ParseDuration(c.Web.ConnectorHealthTTL)
+		if err != nil {
+			return fmt.Errorf("invalid config value %q for connector health TTL: %v", c.Web.ConnectorHealthTTL, err)
+		}
+		serverConfig.ConnectorHealthTTL = ttl
+	}
+	if c.Web.HTTPIssuer != "" {
+		switch c.Web.HTTPIssuer {
+		case "allow", "warn", "reject":
+		default:
+			return fmt.Errorf("invalid config value %q for HTTP issuer policy", c.Web.HTTPIssuer)
+		}
+		serverConfig.HTTPIssuerPolicy = c.Web.HTTPIssuer
+		logger.Infof("config HTTP issuer policy: %s", c.Web.HTTPIssuer)
+	}
+	if c.Web.LoginProbeInterval != "" {
+		interval, err := time.ParseDuration(c.Web.LoginProbeInterval)
+		if err != nil {
+			return fmt.Errorf("invalid config value %q for login probe interval: %v", c.Web.LoginProbeInterval, err)
+		}
+		logger.Infof("config login probes every: %v", interval)
+		serverConfig.LoginProbeInterval = interval
+	}
+	if c.DirectorySync.Interval != "" {
+		interval, err := time.ParseDuration(c.DirectorySync.Interval)
+		if err != nil {
+			return fmt.Errorf("invalid config value %q for directory sync interval: %v", c.DirectorySync.Interval, err)
+		}
+		logger.Infof("config directory sync every: %v, prune: %t", interval, c.DirectorySync.Prune)
+		serverConfig.DirectorySyncInterval = interval
+		serverConfig.PruneDirectoryUsers = c.DirectorySync.Prune
+	}
+
+	if c.SMS.Sender != "" {
+		switch c.SMS.Sender {
+		case "log":
+			serverConfig.SMS.Sender = server.NewLogSMSSender(logger)
+		case "webhook":
+			if c.SMS.WebhookURL == "" {
+				return fmt.Errorf("invalid config: sms webhookURL is required for the webhook sender")
+			}
+			serverConfig.SMS.Sender = server.NewWebhookSMSSender(c.SMS.WebhookURL, nil)
+		default:
+			return fmt.Errorf("invalid config value %q for sms sender", c.SMS.Sender)
+		}
+		if c.SMS.CodeValidFor != "" {
+			validFor, err := time.ParseDuration(c.SMS.CodeValidFor)
+			if err != nil {
+				return fmt.Errorf("invalid config value %q for sms code lifetime: %v", c.SMS.CodeValidFor, err)
+			}
+			serverConfig.SMS.CodeValidFor = validFor
+		}
+		if c.SMS.RateLimit.Period != "" {
+			period, err := time.ParseDuration(c.SMS.RateLimit.Period)
+			if err != nil {
+				return fmt.Errorf("invalid config value %q for sms rate limit period: %v", c.SMS.RateLimit.Period, err)
+			}
+			serverConfig.SMS.RateLimitPeriod = period
+		}
+		serverConfig.SMS.MaxCodes = c.SMS.RateLimit.Codes
+		logger.Infof("config sms second factor: sender %q", c.SMS.Sender)
+	}
+
+	// The server's timeouts for reading a request include the time taken by
+	// its headers.
+	var readHeaderTimeout, readTimeout time.Duration
+	if c.Web.ReadHeaderTimeout != "" {
+		timeout, err := time.ParseDuration(c.Web.ReadHeaderTimeout)
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("invalid config value %q for read header timeout", c.Web.ReadHeaderTimeout)
+		}
+		readHeaderTimeout = timeout
+	}
+	if c.Web.ReadBodyTimeout != "" {
+		timeout, err := time.ParseDuration(c.Web.ReadBodyTimeout)
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("invalid config value %q for read body timeout", c.Web.ReadBodyTimeout)
+		}
+		readTimeout = readHeaderTimeout + timeout
+		logger.Infof("config read timeouts: headers %v, body %v", readHeaderTimeout, timeout)
+	}
 
 	serv, err := server.NewServer(context.Background(), serverConfig)
 	if err != nil {
@@ -260,7 +623,24 @@ func serve(cmd *cobra.Command, args []string) error {
 	telemetryServ := http.NewServeMux()
 	telemetryServ.Handle("/metrics", promhttp.HandlerFor(prometheusRegistry, promhttp.HandlerOpts{}))
 
-	errc := make(chan error, 3)
+	errc := make(chan error, 4)
+	if c.Web.Internal != "" {
+		internalServ := http.NewServeMux()
+		internalServ.Handle("/metrics", promhttp.HandlerFor(prometheusRegistry, promhttp.HandlerOpts{}))
+		internalServ.Handle("/", serv.InternalHandler())
+
+		logger.Infof("listening (http/internal) on %s", c.Web.Internal)
+		internalSrv := &http.Server{
+			Addr:              c.Web.Internal,
+			Handler:           internalServ,
+			ReadHeaderTimeout: readHeaderTimeout,
+			ReadTimeout:       readTimeout,
+		}
+		go func() {
+			err := internalSrv.ListenAndServe()
+			errc <- fmt.Errorf("listening on %s failed: %v", c.Web.Internal, err)
+		}()
+	}
 	if c.Telemetry.HTTP != "" {
 		logger.Infof("listening (http/telemetry) on %s", c.Telemetry.HTTP)
 		go func() {
@@ -270,20 +650,32 @@ func serve(cmd *cobra.Command, args []string) error {
 	}
 	if c.Web.HTTP != "" {
 		logger.Infof("listening (http) on %s", c.Web.HTTP)
+		httpSrv := &http.Server{
+			Addr:              c.Web.HTTP,
+			Handler:           serv,
+			ReadHeaderTimeout: readHeaderTimeout,
+			ReadTimeout:       readTimeout,
+		}
 		go func() {
-			err := http.ListenAndServe(c.Web.HTTP, serv)
+			err := httpSrv.ListenAndServe()
 			errc <- fmt.Errorf("listening on %s failed: %v", c.Web.HTTP, err)
 		}()
 	}
 	if c.Web.HTTPS != "" {
 		httpsSrv := &http.Server{
-			Addr:    c.Web.HTTPS,
-			Handler: serv,
+			Addr:              c.Web.HTTPS,
+			Handler:           serv,
+			ReadHeaderTimeout: readHeaderTimeout,
+			ReadTimeout:       readTimeout,
 			TLSConfig: &tls.Config{
 				PreferServerCipherSuites: true,
 				MinVersion:               tls.VersionTLS12,
 			},
 		}
+		if c.Web.RequestClientCert {
+			// Certificates are verified by the clientcert connector.
+			httpsSrv.TLSConfig.ClientAuth = tls.RequestClientCert
+		}
 
 		logger.Infof("listening (https) on %s", c.Web.HTTPS)
 		go func() {
@@ -300,7 +692,11 @@ func serve(cmd *cobra.Command, args []string) error {
 					return fmt.Errorf("listening on %s failed: %v", c.GRPC.Addr, err)
 				}
 				s := grpc.NewServer(grpcOptions...)
-				api.RegisterDexServer(s, server.NewAPI(serverConfig.Storage, logger))
+				api.RegisterDexServer(s, server.NewAPIWithOptions(serverConfig.Storage, logger, server.APIOptions{
+					Secrets:                  serverConfig.SecretGenerator,
+					SecretPolicy:             serverConfig.SecretPolicy,
+					RequireHTTPSRedirectURIs: serverConfig.RequireHTTPSRedirectURIs,
+				}))
 				grpcMetrics.InitializeMetrics(s)
 				err = s.Serve(list)
 				return fmt.Errorf("listening on %s failed: %v", c.GRPC.Addr, err)
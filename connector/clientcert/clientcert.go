@@ -0,0 +1,286 @@
+// Package clientcert implements a connector which logs users in with the X.509
+// client certificate they present to dex, such as one from a smartcard.
+package clientcert
+
+import (
+	"bytes"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/dexidp/dex/connector"
+	"github.com/dexidp/dex/pkg/log"
+)
+
+// Config holds the configuration parameters for the client certificate
+// connector.
+//
+// An example config:
+//
+//	type: clientcert
+//	id: smartcard
+//	name: Smartcard
+//	config:
+//	  rootCA: /etc/dex/piv-ca.pem
+//	  crlFile: /etc/dex/piv-ca.crl
+type Config struct {
+	// Path to the PEM encoded CA certificates client certificates must chain
+	// up to.
+	RootCA string `json:"rootCA"`
+	// Base64 encoded PEM data containing root CAs, instead of RootCA.
+	RootCAData []byte `json:"rootCAData"`
+
+	// Optional path to the PEM or DER encoded CRLs of the CAs. It's read at
+	// every login, so it can be updated without restarting dex. If set, a
+	// current CRL of the certificate's issuer is required.
+	CRLFile string `json:"crlFile"`
+}
+
+// Open returns a connector which authenticates users with client certificates.
+func (c *Config) Open(id string, logger log.Logger) (connector.Connector, error) {
+	data := c.RootCAData
+	if len(data) == 0 {
+		if c.RootCA == "" {
+			return nil, errors.New("clientcert: no rootCA specified")
+		}
+		var err error
+		if data, err = ioutil.ReadFile(c.RootCA); err != nil {
+			return nil, fmt.Errorf("clientcert: read ca file: %v", err)
+		}
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(data) {
+		return nil, errors.New("clientcert: no certs found in ca file")
+	}
+	return &certConnector{
+		roots:      roots,
+		crlFile:    c.CRLFile,
+		pathSuffix: "/" + id,
+		now:        time.Now,
+		logger:     logger,
+	}, nil
+}
+
+var _ connector.CallbackConnector = (*certConnector)(nil)
+
+type certConnector struct {
+	roots      *x509.CertPool
+	crlFile    string
+	pathSuffix string
+	now        func() time.Time
+	logger     log.Logger
+}
+
+// LoginURL points at the connector's own callback, where the certificate of
+// the TLS connection is checked.
+func (c *certConnector) LoginURL(s connector.Scopes, callbackURL, state string) (string, error) {
+	u, err := url.Parse(callbackURL)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse callbackURL %q: %v", callbackURL, err)
+	}
+	u.Path = u.Path + c.pathSuffix
+	v := u.Query()
+	v.Set("state", state)
+	u.RawQuery = v.Encode()
+	return u.String(), nil
+}
+
+// HandleCallback verifies the client certificate of the request's TLS
+// connection and returns the identity in its subject alternative names.
+func (c *certConnector) HandleCallback(s connector.Scopes, r *http.Request) (connector.Identity, error) {
+	if r.TLS == nil {
+		return connector.Identity{}, errors.New("clientcert: dex must be served over HTTPS to log in with a certificate")
+	}
+	certs := r.TLS.PeerCertificates
+	if len(certs) == 0 {
+		return connector.Identity{}, errors.New("clientcert: no client certificate presented")
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	chains, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         c.roots,
+		Intermediates: intermediates,
+		CurrentTime:   c.now(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return connector.Identity{}, fmt.Errorf("clientcert: verify certificate: %v", err)
+	}
+	if c.crlFile != "" {
+		if err := c.checkRevoked(chains[0]); err != nil {
+			return connector.Identity{}, fmt.Errorf("clientcert: %v", err)
+		}
+	}
+	return identity(certs[0])
+}
+
+// checkRevoked checks each certificate of a verified chain, but the root,
+// against the CRLs. A CRL is required for the client certificate itself.
+func (c *certConnector) checkRevoked(chain []*x509.Certificate) error {
+	crls, err := readCRLs(c.crlFile)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(chain)-1; i++ {
+		cert, issuer := chain[i], chain[i+1]
+		var crl *pkix.CertificateList
+		for _, l := range crls {
+			if crlIssuedBy(l, cert) && issuer.CheckCRLSignature(l) == nil {
+				crl = l
+				break
+			}
+		}
+		if crl == nil {
+			if i == 0 {
+				return fmt.Errorf("no CRL for issuer %q", cert.Issuer)
+			}
+			continue
+		}
+		if crl.HasExpired(c.now()) {
+			return fmt.Errorf("CRL of issuer %q expired at %s", cert.Issuer, crl.TBSCertList.NextUpdate)
+		}
+		for _, revoked := range crl.TBSCertList.RevokedCertificates {
+			if revoked.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+				return fmt.Errorf("certificate %q of issuer %q is revoked", cert.Subject, cert.Issuer)
+			}
+		}
+	}
+	return nil
+}
+
+// crlIssuedBy reports if the issuer of crl is the issuer of cert.
+func crlIssuedBy(crl *pkix.CertificateList, cert *x509.Certificate) bool {
+	var name pkix.Name
+	name.FillFromRDNSequence(&crl.TBSCertList.Issuer)
+	return name.String() == cert.Issuer.String()
+}
+
+func readCRLs(path string) ([]*pkix.CertificateList, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read crl file: %v", err)
+	}
+	if !bytes.Contains(data, []byte("-----BEGIN")) {
+		crl, err := x509.ParseDERCRL(data)
+		if err != nil {
+			return nil, fmt.Errorf("parse crl: %v", err)
+		}
+		return []*pkix.CertificateList{crl}, nil
+	}
+	var crls []*pkix.CertificateList
+	for {
+		var block *pem.Block
+		if block, data = pem.Decode(data); block == nil {
+			break
+		}
+		if block.Type != "X509 CRL" {
+			continue
+		}
+		crl, err := x509.ParseDERCRL(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parse crl: %v", err)
+		}
+		crls = append(crls, crl)
+	}
+	return crls, nil
+}
+
+var (
+	oidSubjectAltName = asn1.ObjectIdentifier{2, 5, 29, 17}
+	// Microsoft's user principal name, used by smartcards for Windows logon.
+	oidUPN = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 20, 2, 3}
+)
+
+// identity maps the user principal name or email of a certificate's subject
+// alternative names to an identity. The UPN is preferred as the user's ID,
+// since it's what smartcards are issued for.
+func identity(cert *x509.Certificate) (connector.Identity, error) {
+	upn, err := principalName(cert)
+	if err != nil {
+		return connector.Identity{}, fmt.Errorf("clientcert: %v", err)
+	}
+	var email string
+	if len(cert.EmailAddresses) > 0 {
+		email = cert.EmailAddresses[0]
+	}
+
+	ident := connector.Identity{
+		UserID:   upn,
+		Username: upn,
+	}
+	if email != "" {
+		ident.Email = email
+		ident.EmailVerified = true
+		if ident.UserID == "" {
+			ident.UserID = email
+			ident.Username = email
+		}
+	}
+	if ident.UserID == "" {
+		return connector.Identity{}, fmt.Errorf("clientcert: certificate %q has no email or UPN", cert.Subject)
+	}
+	return ident, nil
+}
+
+// otherName is the otherName choice of a GeneralName.
+//
+// https://tools.ietf.org/html/rfc5280#section-4.2.1.6
+type otherName struct {
+	TypeID asn1.ObjectIdentifier
+	Value  asn1.RawValue `asn1:"explicit,tag:0"`
+}
+
+// principalName returns the UPN in a certificate's subject alternative names,
+// which crypto/x509 doesn't parse.
+func principalName(cert *x509.Certificate) (string, error) {
+	var ext *pkix.Extension
+	for i := range cert.Extensions {
+		if cert.Extensions[i].Id.Equal(oidSubjectAltName) {
+			ext = &cert.Extensions[i]
+			break
+		}
+	}
+	if ext == nil {
+		return "", nil
+	}
+
+	var names asn1.RawValue
+	if rest, err := asn1.Unmarshal(ext.Value, &names); err != nil || len(rest) != 0 || !names.IsCompound {
+		return "", errors.New("malformed subject alternative names")
+	}
+	data := names.Bytes
+	for len(data) > 0 {
+		var name asn1.RawValue
+		var err error
+		if data, err = asn1.Unmarshal(data, &name); err != nil {
+			return "", errors.New("malformed subject alternative names")
+		}
+		if name.Class != asn1.ClassContextSpecific || name.Tag != 0 {
+			continue
+		}
+		var on otherName
+		if _, err := asn1.UnmarshalWithParams(name.FullBytes, &on, "tag:0"); err != nil {
+			return "", errors.New("malformed other name")
+		}
+		if !on.TypeID.Equal(oidUPN) {
+			continue
+		}
+		var upn string
+		// A raw value isn't unwrapped from its explicit tag.
+		if _, err := asn1.Unmarshal(on.Value.Bytes, &upn); err != nil {
+			return "", errors.New("malformed user principal name")
+		}
+		return upn, nil
+	}
+	return "", nil
+}
@@ -0,0 +1,174 @@
+package clientcert
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/dexidp/dex/connector"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert, key}
+}
+
+// issue returns a client certificate with a UPN and an email in its subject
+// alternative names.
+func (ca *testCA) issue(t *testing.T, serial int64, upn, email string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upnValue, err := asn1.MarshalWithParams(upn, "utf8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The value of an otherName is explicitly tagged, which encoding/asn1
+	// doesn't do for raw values.
+	name, err := asn1.MarshalWithParams(struct {
+		TypeID asn1.ObjectIdentifier
+		Value  asn1.RawValue
+	}{oidUPN, asn1.RawValue{Class: asn1.ClassContextSpecific, IsCompound: true, Bytes: upnValue}}, "tag:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	san, err := asn1.Marshal([]asn1.RawValue{
+		{FullBytes: name},
+		{Class: asn1.ClassContextSpecific, Tag: 1, Bytes: []byte(email)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:    big.NewInt(serial),
+		Subject:         pkix.Name{CommonName: upn},
+		NotBefore:       time.Now().Add(-time.Hour),
+		NotAfter:        time.Now().Add(time.Hour),
+		KeyUsage:        x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		ExtraExtensions: []pkix.Extension{{Id: oidSubjectAltName, Value: san}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func (ca *testCA) crl(t *testing.T, revoked ...int64) []byte {
+	var entries []pkix.RevokedCertificate
+	for _, serial := range revoked {
+		entries = append(entries, pkix.RevokedCertificate{
+			SerialNumber:   big.NewInt(serial),
+			RevocationTime: time.Now(),
+		})
+	}
+	der, err := ca.cert.CreateCRL(rand.Reader, ca.key, entries, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der})
+}
+
+func TestHandleCallback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dex-clientcert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t, "PIV CA")
+	crlFile := filepath.Join(dir, "ca.crl")
+	if err := ioutil.WriteFile(crlFile, ca.crl(t, 3), 0600); err != nil {
+		t.Fatal(err)
+	}
+	caData := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+
+	tests := []struct {
+		name    string
+		cert    *x509.Certificate
+		wantErr bool
+	}{
+		{"valid", ca.issue(t, 2, "jane@corp.example.com", "jane@example.com"), false},
+		{"untrusted", newTestCA(t, "Other CA").issue(t, 2, "jane@corp.example.com", "jane@example.com"), true},
+		{"revoked", ca.issue(t, 3, "jane@corp.example.com", "jane@example.com"), true},
+		{"no certificate", nil, true},
+	}
+	for _, tc := range tests {
+		c := &Config{RootCAData: caData, CRLFile: crlFile}
+		conn, err := c.Open("smartcard", &logrus.Logger{})
+		if err != nil {
+			t.Fatalf("open connector: %v", err)
+		}
+
+		r := httptest.NewRequest("GET", "https://dex.example.com/callback/smartcard?state=foo", nil)
+		r.TLS = &tls.ConnectionState{}
+		if tc.cert != nil {
+			r.TLS.PeerCertificates = []*x509.Certificate{tc.cert}
+		}
+		ident, err := conn.(connector.CallbackConnector).HandleCallback(connector.Scopes{}, r)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected the certificate to be rejected", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: handle callback: %v", tc.name, err)
+			continue
+		}
+		want := connector.Identity{
+			UserID:        "jane@corp.example.com",
+			Username:      "jane@corp.example.com",
+			Email:         "jane@example.com",
+			EmailVerified: true,
+		}
+		if ident.UserID != want.UserID || ident.Username != want.Username || ident.Email != want.Email || !ident.EmailVerified {
+			t.Errorf("%s: expected identity %+v, got %+v", tc.name, want, ident)
+		}
+	}
+}
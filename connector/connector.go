@@ -3,7 +3,9 @@ package connector
 
 import (
 	"context"
+	"errors"
 	"net/http"
+	"time"
 )
 
 // Connector is a mechanism for federating login to a remote identity service.
@@ -30,6 +32,10 @@ type Identity struct {
 
 	Groups []string
 
+	// URL of the user's profile picture. Only http and https URLs are passed
+	// on to clients.
+	Picture string
+
 	// ConnectorData holds data used by the connector for subsequent requests after initial
 	// authentication, such as access tokens for upstream provides.
 	//
@@ -90,6 +96,52 @@ type SAMLConnector interface {
 	HandlePOST(s Scopes, samlResponse, inResponseTo string) (identity Identity, err error)
 }
 
+// WebAuthnConnector is an interface implemented by connectors which log users
+// in with a security key or passkey. The server renders a page which runs the
+// WebAuthn ceremonies in the browser with the options the connector returns,
+// then POSTs the browser's response to the connector.
+//
+// The state passed to each method identifies the login, so challenges can be
+// bound to it.
+type WebAuthnConnector interface {
+	// LoginOptions returns the JSON options passed to navigator.credentials.get.
+	LoginOptions(state string) ([]byte, error)
+
+	// Login verifies the assertion the browser POSTed. The returned bool is
+	// false if the assertion was invalid, rather than the server failing.
+	Login(ctx context.Context, s Scopes, state string, r *http.Request) (identity Identity, valid bool, err error)
+
+	// EnrollOptions returns the JSON options passed to
+	// navigator.credentials.create to register a credential for a user, who
+	// proves who they are with an enrollment code.
+	EnrollOptions(state, username, code string) ([]byte, error)
+
+	// Enroll registers the credential the browser POSTed.
+	Enroll(state string, r *http.Request) error
+}
+
+// MagicLinkConnector is an interface implemented by connectors which log users
+// in by emailing them a link. The server asks the user for their email and
+// generates a signed, single-use link, which the connector delivers. Following
+// the link logs the user in with the identity the connector returns for the
+// email.
+type MagicLinkConnector interface {
+	// SendLink emails a login link. It returns ErrRateLimited if too many
+	// links were sent to the address recently.
+	SendLink(ctx context.Context, email, link string) error
+
+	// LinkValidFor returns how long links can be followed for.
+	LinkValidFor() time.Duration
+
+	// Identity returns the identity of the owner of an email, who followed a
+	// link sent to it.
+	Identity(email string) (Identity, error)
+}
+
+// ErrRateLimited is returned by connectors refusing a request because too many
+// similar ones were made recently.
+var ErrRateLimited = errors.New("too many requests")
+
 // RefreshConnector is a connector that can update the client claims.
 type RefreshConnector interface {
 	// Refresh is called when a client attempts to claim a refresh token. The
@@ -97,3 +149,56 @@ type RefreshConnector interface {
 	// changes since the token was last refreshed.
 	Refresh(ctx context.Context, s Scopes, identity Identity) (Identity, error)
 }
+
+// ScopeGranter is an optional interface for connectors which grant scopes
+// beyond the ones the client requested based on the authenticated identity,
+// for example an "admin" scope to members of a group. The server drops granted
+// scopes the client couldn't have requested itself.
+type ScopeGranter interface {
+	// GrantScopes returns the scopes to add to the requested ones. It's called
+	// once per login, and the scopes are kept when tokens are refreshed.
+	GrantScopes(identity Identity, requested []string) []string
+}
+
+// HealthChecker is an optional interface for connectors which can check that
+// their upstream identity provider is reachable and correctly configured.
+type HealthChecker interface {
+	Healthy(ctx context.Context) error
+}
+
+// ChainConnector is a connector which doesn't authenticate users itself. The
+// server sends users on to the first connector of the chain which is healthy,
+// for example a corporate identity provider with local passwords as a
+// fallback. Connectors which don't implement HealthChecker count as healthy.
+type ChainConnector interface {
+	// Chain returns the IDs of the connectors, in order of preference.
+	Chain() []string
+}
+
+// UserLister is an optional interface for directory connectors, such as LDAP,
+// which can enumerate their users. The server uses it to find users that were
+// removed from the directory.
+type UserLister interface {
+	// ListUserIDs returns the Identity.UserID of every user able to login.
+	ListUserIDs(ctx context.Context) ([]string, error)
+}
+
+// ChallengeError is returned by a CallbackConnector's HandleCallback when the
+// request lacks credentials the browser has to be challenged for with an HTTP
+// 401 response, such as a Kerberos ticket.
+type ChallengeError struct {
+	// Value of the WWW-Authenticate header, for example "Negotiate". If empty
+	// the browser can't answer the challenge and isn't sent it again.
+	Challenge string
+
+	// Optional connector to send the user to if the browser can't answer the
+	// challenge.
+	FallbackConnectorID string
+}
+
+func (e *ChallengeError) Error() string {
+	if e.Challenge == "" {
+		return "browser can't provide the required credentials"
+	}
+	return "authentication required: " + e.Challenge
+}
@@ -0,0 +1,60 @@
+// Package fallback implements a connector which sends users to the first
+// healthy connector of a chain.
+package fallback
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dexidp/dex/connector"
+	"github.com/dexidp/dex/pkg/log"
+)
+
+// Config holds the configuration parameters for the fallback connector. Users
+// logging in through it are sent to the first of the connectors which is
+// healthy, and the connector they logged in with is the one recorded in their
+// tokens.
+//
+// An example config:
+//
+//	type: fallback
+//	id: corp
+//	name: Example Inc.
+//	config:
+//	  connectors:
+//	  - corp-oidc
+//	  - local
+type Config struct {
+	// IDs of the connectors, in order of preference.
+	Connectors []string `json:"connectors"`
+}
+
+// Open returns a connector which routes logins through a chain of connectors.
+func (c *Config) Open(id string, logger log.Logger) (connector.Connector, error) {
+	if len(c.Connectors) < 2 {
+		return nil, errors.New("fallback: at least two connectors must be specified")
+	}
+	seen := make(map[string]bool, len(c.Connectors))
+	for _, connID := range c.Connectors {
+		switch {
+		case connID == "":
+			return nil, errors.New("fallback: connector IDs can't be empty")
+		case connID == id:
+			return nil, errors.New("fallback: connector can't fall back to itself")
+		case seen[connID]:
+			return nil, fmt.Errorf("fallback: connector %q is listed twice", connID)
+		}
+		seen[connID] = true
+	}
+	return &fallbackConnector{chain: c.Connectors}, nil
+}
+
+var _ connector.ChainConnector = (*fallbackConnector)(nil)
+
+type fallbackConnector struct {
+	chain []string
+}
+
+func (c *fallbackConnector) Chain() []string {
+	return c.chain
+}
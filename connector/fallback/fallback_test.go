@@ -0,0 +1,41 @@
+package fallback
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/dexidp/dex/connector"
+)
+
+func TestOpen(t *testing.T) {
+	tests := []struct {
+		name       string
+		connectors []string
+		wantErr    bool
+	}{
+		{"valid", []string{"oidc", "local"}, false},
+		{"single connector", []string{"oidc"}, true},
+		{"itself", []string{"oidc", "corp"}, true},
+		{"duplicate", []string{"oidc", "local", "oidc"}, true},
+		{"empty ID", []string{"oidc", ""}, true},
+	}
+	logger := &logrus.Logger{Out: ioutil.Discard, Formatter: &logrus.TextFormatter{}}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := Config{Connectors: tc.connectors}
+			conn, err := c.Open("corp", logger)
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Fatalf("wanted error %t, got %v", tc.wantErr, err)
+			}
+			if err != nil {
+				return
+			}
+			if chain := conn.(connector.ChainConnector).Chain(); !reflect.DeepEqual(chain, tc.connectors) {
+				t.Errorf("expected chain %q, got %q", tc.connectors, chain)
+			}
+		})
+	}
+}
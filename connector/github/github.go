@@ -269,6 +269,7 @@ func (c *githubConnector) HandleCallback(s connector.Scopes, r *http.Request) (i
 		Username:      username,
 		Email:         user.Email,
 		EmailVerified: true,
+		Picture:       user.AvatarURL,
 	}
 	if c.useLoginAsID {
 		identity.UserID = user.Login
@@ -317,6 +318,7 @@ func (c *githubConnector) Refresh(ctx context.Context, s connector.Scopes, ident
 	}
 	identity.Username = username
 	identity.Email = user.Email
+	identity.Picture = user.AvatarURL
 
 	// Only set identity.Groups if 'orgs', 'org', or 'groups' scope are specified.
 	if c.groupsRequired(s.Groups) {
@@ -544,10 +546,11 @@ func getPagination(apiURL string, resp *http.Response) string {
 // user holds GitHub user information (relevant to dex) as defined by
 // https://developer.github.com/v3/users/#response-with-public-profile-information
 type user struct {
-	Name  string `json:"name"`
-	Login string `json:"login"`
-	ID    int    `json:"id"`
-	Email string `json:"email"`
+	Name      string `json:"name"`
+	Login     string `json:"login"`
+	ID        int    `json:"id"`
+	Email     string `json:"email"`
+	AvatarURL string `json:"avatar_url"`
 }
 
 // user queries the GitHub API for profile information using the provided client.
@@ -0,0 +1,300 @@
+// Package httpapi implements a connector which checks usernames and passwords
+// against an external HTTP API.
+package httpapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/dexidp/dex/connector"
+	"github.com/dexidp/dex/pkg/log"
+)
+
+// defaultRequestTemplate is used to build the login request body if the config
+// doesn't specify one.
+const defaultRequestTemplate = `{"username": {{json .Username}}, "password": {{json .Password}}}`
+
+// Config holds the configuration parameters for the HTTP API connector.
+//
+// An example config:
+//
+//	type: httpapi
+//	id: httpapi
+//	name: Corporate Login
+//	config:
+//	  url: https://auth.example.com/api/login
+//	  requestTemplate: '{"login": {{json .Username}}, "secret": {{json .Password}}}'
+//	  responseMapping:
+//	    userID: user.id
+//	    email: user.mail
+//	    groups: user.roles
+type Config struct {
+	// URL the credentials are POSTed to. A 200 response means the credentials
+	// are valid, any other status that they aren't.
+	URL string `json:"url"`
+
+	// URL requested by health checks. Defaults to URL. Any response other than
+	// a server error counts as healthy.
+	HealthURL string `json:"healthURL"`
+
+	// Template for the request body, executed with the .Username and .Password
+	// of the login attempt. The "json" function quotes a value as a JSON string.
+	RequestTemplate string `json:"requestTemplate"`
+	// Content type of the request body. Defaults to "application/json".
+	ContentType string `json:"contentType"`
+	// Additional headers sent with every request, for example an API key.
+	Headers map[string]string `json:"headers"`
+
+	// Where to find the identity in the JSON response.
+	ResponseMapping ResponseMapping `json:"responseMapping"`
+
+	// Label for the username field on the login page. Defaults to "Username".
+	UsernamePrompt string `json:"usernamePrompt"`
+
+	// Timeout for requests to the API, as a duration string. Defaults to "10s".
+	Timeout string `json:"timeout"`
+}
+
+// ResponseMapping holds dot separated paths, such as "data.user.id", to the
+// identity's fields in a successful login response.
+type ResponseMapping struct {
+	// Defaults to "id". Required to be present in the response.
+	UserID string `json:"userID"`
+	// Defaults to "username". If absent the submitted username is used.
+	Username string `json:"username"`
+	// Defaults to "email".
+	Email string `json:"email"`
+	// Defaults to "email_verified".
+	EmailVerified string `json:"emailVerified"`
+	// Defaults to "groups". Must point at a list of strings.
+	Groups string `json:"groups"`
+}
+
+// Open returns a connector which checks credentials against an HTTP API.
+func (c *Config) Open(id string, logger log.Logger) (connector.Connector, error) {
+	if c.URL == "" {
+		return nil, errors.New("httpapi: no url specified")
+	}
+
+	reqTmpl := c.RequestTemplate
+	if reqTmpl == "" {
+		reqTmpl = defaultRequestTemplate
+	}
+	tmpl, err := template.New("request").Funcs(template.FuncMap{"json": jsonString}).Parse(reqTmpl)
+	if err != nil {
+		return nil, fmt.Errorf("httpapi: parse request template: %v", err)
+	}
+
+	timeout := 10 * time.Second
+	if c.Timeout != "" {
+		if timeout, err = time.ParseDuration(c.Timeout); err != nil {
+			return nil, fmt.Errorf("httpapi: parse timeout: %v", err)
+		}
+	}
+
+	m := c.ResponseMapping
+	if m.UserID == "" {
+		m.UserID = "id"
+	}
+	if m.Username == "" {
+		m.Username = "username"
+	}
+	if m.Email == "" {
+		m.Email = "email"
+	}
+	if m.EmailVerified == "" {
+		m.EmailVerified = "email_verified"
+	}
+	if m.Groups == "" {
+		m.Groups = "groups"
+	}
+
+	conn := &httpConnector{
+		url:         c.URL,
+		healthURL:   c.HealthURL,
+		tmpl:        tmpl,
+		contentType: c.ContentType,
+		headers:     c.Headers,
+		mapping:     m,
+		prompt:      c.UsernamePrompt,
+		client:      &http.Client{Timeout: timeout},
+		logger:      logger,
+	}
+	if conn.healthURL == "" {
+		conn.healthURL = c.URL
+	}
+	if conn.contentType == "" {
+		conn.contentType = "application/json"
+	}
+	return conn, nil
+}
+
+var (
+	_ connector.PasswordConnector = (*httpConnector)(nil)
+	_ connector.HealthChecker     = (*httpConnector)(nil)
+)
+
+type httpConnector struct {
+	url         string
+	healthURL   string
+	tmpl        *template.Template
+	contentType string
+	headers     map[string]string
+	mapping     ResponseMapping
+	prompt      string
+
+	client *http.Client
+	logger log.Logger
+}
+
+func jsonString(s string) (string, error) {
+	b, err := json.Marshal(s)
+	return string(b), err
+}
+
+func (c *httpConnector) Prompt() string { return c.prompt }
+
+func (c *httpConnector) newRequest(ctx context.Context, method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range c.headers {
+		req.Header.Set(k, v)
+	}
+	return req.WithContext(ctx), nil
+}
+
+func (c *httpConnector) Login(ctx context.Context, s connector.Scopes, username, password string) (ident connector.Identity, validPass bool, err error) {
+	if username == "" || password == "" {
+		return ident, false, nil
+	}
+
+	var body bytes.Buffer
+	data := struct{ Username, Password string }{username, password}
+	if err := c.tmpl.Execute(&body, data); err != nil {
+		return ident, false, fmt.Errorf("httpapi: execute request template: %v", err)
+	}
+	req, err := c.newRequest(ctx, "POST", c.url, &body)
+	if err != nil {
+		return ident, false, fmt.Errorf("httpapi: new request: %v", err)
+	}
+	req.Header.Set("Content-Type", c.contentType)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return ident, false, fmt.Errorf("httpapi: login request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		c.logger.Infof("httpapi: login for user %q rejected with status %s", username, resp.Status)
+		return ident, false, nil
+	}
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return ident, false, fmt.Errorf("httpapi: read response: %v", err)
+	}
+	if ident, err = c.identity(respBody); err != nil {
+		return ident, false, fmt.Errorf("httpapi: %v", err)
+	}
+	if ident.Username == "" {
+		ident.Username = username
+	}
+	if !s.Groups {
+		ident.Groups = nil
+	}
+	return ident, true, nil
+}
+
+// identity maps a login response to an identity.
+func (c *httpConnector) identity(body []byte) (ident connector.Identity, err error) {
+	d := json.NewDecoder(bytes.NewReader(body))
+	d.UseNumber()
+	var resp interface{}
+	if err := d.Decode(&resp); err != nil {
+		return ident, fmt.Errorf("decode response: %v", err)
+	}
+
+	userID, ok := lookup(resp, c.mapping.UserID)
+	switch id := userID.(type) {
+	case string:
+		ident.UserID = id
+	case json.Number:
+		ident.UserID = id.String()
+	}
+	if !ok || ident.UserID == "" {
+		return ident, fmt.Errorf("response has no user ID at %q", c.mapping.UserID)
+	}
+
+	if v, ok := lookup(resp, c.mapping.Username); ok {
+		if ident.Username, ok = v.(string); !ok {
+			return ident, fmt.Errorf("username at %q is not a string", c.mapping.Username)
+		}
+	}
+	if v, ok := lookup(resp, c.mapping.Email); ok {
+		if ident.Email, ok = v.(string); !ok {
+			return ident, fmt.Errorf("email at %q is not a string", c.mapping.Email)
+		}
+	}
+	if v, ok := lookup(resp, c.mapping.EmailVerified); ok {
+		if ident.EmailVerified, ok = v.(bool); !ok {
+			return ident, fmt.Errorf("email verified at %q is not a boolean", c.mapping.EmailVerified)
+		}
+	}
+	if v, ok := lookup(resp, c.mapping.Groups); ok {
+		groups, ok := v.([]interface{})
+		if !ok {
+			return ident, fmt.Errorf("groups at %q is not a list", c.mapping.Groups)
+		}
+		for _, g := range groups {
+			group, ok := g.(string)
+			if !ok {
+				return ident, fmt.Errorf("groups at %q is not a list of strings", c.mapping.Groups)
+			}
+			ident.Groups = append(ident.Groups, group)
+		}
+	}
+	return ident, nil
+}
+
+// lookup walks a dot separated path through decoded JSON objects.
+func lookup(v interface{}, path string) (interface{}, bool) {
+	for _, key := range strings.Split(path, ".") {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if v, ok = obj[key]; !ok || v == nil {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// Healthy checks that the API can be reached.
+func (c *httpConnector) Healthy(ctx context.Context) error {
+	req, err := c.newRequest(ctx, "GET", c.healthURL, nil)
+	if err != nil {
+		return fmt.Errorf("httpapi: new request: %v", err)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("httpapi: health check: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("httpapi: health check returned %s", resp.Status)
+	}
+	return nil
+}
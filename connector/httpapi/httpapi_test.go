@@ -0,0 +1,131 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/dexidp/dex/connector"
+)
+
+func newTestAPI(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if got := r.Header.Get("X-Api-Key"); got != "key" {
+			t.Errorf("expected configured header to be sent, got %q", got)
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("read body: %v", err)
+			return
+		}
+		var req struct {
+			Login  string `json:"login"`
+			Secret string `json:"secret"`
+		}
+		if err := json.Unmarshal(body, &req); err != nil {
+			t.Errorf("request body %q is not valid JSON: %v", body, err)
+		}
+		if req.Login != "jane" || req.Secret != `pass"word` {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"user": {"id": 42, "mail": "jane@example.com", "verified": true, "roles": ["admins", "devs"]}}`))
+	}))
+}
+
+func openTestConnector(t *testing.T, url string) *httpConnector {
+	c := Config{
+		URL:             url,
+		RequestTemplate: `{"login": {{json .Username}}, "secret": {{json .Password}}}`,
+		Headers:         map[string]string{"X-Api-Key": "key"},
+		ResponseMapping: ResponseMapping{
+			UserID:        "user.id",
+			Email:         "user.mail",
+			EmailVerified: "user.verified",
+			Groups:        "user.roles",
+		},
+	}
+	logger := &logrus.Logger{Out: ioutil.Discard, Formatter: &logrus.TextFormatter{}}
+	conn, err := c.Open("httpapi", logger)
+	if err != nil {
+		t.Fatalf("open connector: %v", err)
+	}
+	return conn.(*httpConnector)
+}
+
+func TestLogin(t *testing.T) {
+	s := newTestAPI(t)
+	defer s.Close()
+	conn := openTestConnector(t, s.URL)
+
+	ident, valid, err := conn.Login(context.Background(), connector.Scopes{Groups: true}, "jane", `pass"word`)
+	if err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	if !valid {
+		t.Fatal("expected valid credentials")
+	}
+	if ident.UserID != "42" || ident.Username != "jane" || ident.Email != "jane@example.com" || !ident.EmailVerified {
+		t.Errorf("unexpected identity: %+v", ident)
+	}
+	if len(ident.Groups) != 2 || ident.Groups[0] != "admins" || ident.Groups[1] != "devs" {
+		t.Errorf("unexpected groups: %q", ident.Groups)
+	}
+
+	ident, valid, err = conn.Login(context.Background(), connector.Scopes{}, "jane", `pass"word`)
+	if err != nil || !valid {
+		t.Fatalf("login without groups scope: valid=%t, err=%v", valid, err)
+	}
+	if len(ident.Groups) != 0 {
+		t.Errorf("expected no groups without the groups scope, got %q", ident.Groups)
+	}
+}
+
+func TestLoginFailure(t *testing.T) {
+	s := newTestAPI(t)
+	defer s.Close()
+	conn := openTestConnector(t, s.URL)
+
+	_, valid, err := conn.Login(context.Background(), connector.Scopes{}, "jane", "wrong")
+	if err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	if valid {
+		t.Error("expected invalid credentials")
+	}
+}
+
+func TestLoginMissingUserID(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"user": {"mail": "jane@example.com"}}`))
+	}))
+	defer s.Close()
+	conn := openTestConnector(t, s.URL)
+
+	if _, _, err := conn.Login(context.Background(), connector.Scopes{}, "jane", "password"); err == nil {
+		t.Error("expected an error for a response without a user ID")
+	}
+}
+
+func TestHealthy(t *testing.T) {
+	s := newTestAPI(t)
+	conn := openTestConnector(t, s.URL)
+	if err := conn.Healthy(context.Background()); err != nil {
+		t.Errorf("expected API to be healthy: %v", err)
+	}
+
+	s.Close()
+	if err := conn.Healthy(context.Background()); err == nil {
+		t.Error("expected health check to fail when the API is down")
+	}
+}
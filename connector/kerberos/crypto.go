@@ -0,0 +1,208 @@
+package kerberos
+
+import (
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Encryption types from RFC 3962. These are the only ones supported, older
+// DES and RC4 based types should be disabled in any current realm.
+const (
+	etypeAES128 = 17
+	etypeAES256 = 18
+)
+
+// Key usage numbers from RFC 4120 section 7.5.1.
+const (
+	usageTicket          = 2
+	usageAPReqAuthorizer = 11
+)
+
+const hmacSize = 12 // HMAC-SHA1-96
+
+func keySize(etype int32) (int, error) {
+	switch etype {
+	case etypeAES128:
+		return 16, nil
+	case etypeAES256:
+		return 32, nil
+	default:
+		return 0, fmt.Errorf("unsupported encryption type %d", etype)
+	}
+}
+
+// decrypt decrypts and checks the integrity of ciphertext encrypted with the
+// AES-CTS-HMAC-SHA1-96 profile of RFC 3962, returning the plaintext without
+// its confounder.
+func decrypt(etype int32, key []byte, usage uint32, ciphertext []byte) ([]byte, error) {
+	size, err := keySize(etype)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != size {
+		return nil, fmt.Errorf("expected %d byte key, got %d", size, len(key))
+	}
+	if len(ciphertext) < aes.BlockSize+hmacSize {
+		return nil, errors.New("ciphertext too short")
+	}
+
+	ke, err := deriveKey(key, usageConstant(usage, 0xAA))
+	if err != nil {
+		return nil, err
+	}
+	ki, err := deriveKey(key, usageConstant(usage, 0x55))
+	if err != nil {
+		return nil, err
+	}
+
+	ct, mac := ciphertext[:len(ciphertext)-hmacSize], ciphertext[len(ciphertext)-hmacSize:]
+	plaintext, err := ctsDecrypt(ke, ct)
+	if err != nil {
+		return nil, err
+	}
+	h := hmac.New(sha1.New, ki)
+	h.Write(plaintext)
+	if !hmac.Equal(h.Sum(nil)[:hmacSize], mac) {
+		return nil, errors.New("integrity check failed")
+	}
+	return plaintext[aes.BlockSize:], nil
+}
+
+func usageConstant(usage uint32, b byte) []byte {
+	c := make([]byte, 5)
+	binary.BigEndian.PutUint32(c, usage)
+	c[4] = b
+	return c
+}
+
+// deriveKey implements DK from RFC 3961 section 5.1. The random-to-key
+// function of the AES types is the identity.
+func deriveKey(key, constant []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	state := constant
+	if len(state) != aes.BlockSize {
+		state = nfold(constant, aes.BlockSize)
+	}
+	var derived []byte
+	for len(derived) < len(key) {
+		next := make([]byte, aes.BlockSize)
+		block.Encrypt(next, state)
+		derived = append(derived, next...)
+		state = next
+	}
+	return derived[:len(key)], nil
+}
+
+// nfold stretches or folds in to n bytes as described in RFC 3961 section 5.1.
+func nfold(in []byte, n int) []byte {
+	inBits, outBits := len(in)*8, n*8
+	lcm := inBits * outBits / gcd(inBits, outBits)
+
+	// Concatenate copies of the input, each rotated 13 bits further right than
+	// the last, until the result is lcm bits long.
+	buf := make([]byte, lcm/8)
+	for i := 0; i < lcm/inBits; i++ {
+		rotated := rotateRight(in, 13*i)
+		copy(buf[i*len(in):], rotated)
+	}
+
+	// Add the n byte blocks together with one's complement addition.
+	out := make([]byte, n)
+	for i := 0; i < len(buf); i += n {
+		carry := 0
+		for j := n - 1; j >= 0; j-- {
+			sum := int(out[j]) + int(buf[i+j]) + carry
+			out[j] = byte(sum)
+			carry = sum >> 8
+		}
+		for j := n - 1; carry != 0 && j >= 0; j-- {
+			sum := int(out[j]) + carry
+			out[j] = byte(sum)
+			carry = sum >> 8
+		}
+	}
+	return out
+}
+
+func rotateRight(b []byte, bits int) []byte {
+	n := len(b) * 8
+	bits %= n
+	out := make([]byte, len(b))
+	for i := 0; i < n; i++ {
+		if b[i/8]&(0x80>>uint(i%8)) != 0 {
+			j := (i + bits) % n
+			out[j/8] |= 0x80 >> uint(j%8)
+		}
+	}
+	return out
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// ctsDecrypt decrypts AES in CBC mode with ciphertext stealing and a zero
+// initial vector, as specified in RFC 3962 section 5.
+func ctsDecrypt(key, ct []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	const bs = aes.BlockSize
+	if len(ct) < bs {
+		return nil, errors.New("ciphertext shorter than one block")
+	}
+	pt := make([]byte, len(ct))
+	if len(ct) == bs {
+		block.Decrypt(pt, ct)
+		return pt, nil
+	}
+
+	// The last block may be partial, the one before it is always full.
+	r := len(ct) % bs
+	if r == 0 {
+		r = bs
+	}
+	last := len(ct) - r
+	penultimate := last - bs
+
+	// Regular CBC decryption of all but the last two blocks.
+	prev := make([]byte, bs)
+	for i := 0; i < penultimate; i += bs {
+		block.Decrypt(pt[i:i+bs], ct[i:i+bs])
+		xor(pt[i:i+bs], prev)
+		prev = ct[i : i+bs]
+	}
+
+	// The final two blocks were swapped and the last one truncated to r bytes.
+	// Decrypting the full block yields the last plaintext block XORed with the
+	// complete second to last ciphertext block, which recovers the bytes that
+	// were stolen from it.
+	d := make([]byte, bs)
+	block.Decrypt(d, ct[penultimate:last])
+	full := make([]byte, bs)
+	copy(full, ct[last:])
+	copy(full[r:], d[r:])
+	for i := 0; i < r; i++ {
+		pt[last+i] = d[i] ^ ct[last+i]
+	}
+	block.Decrypt(pt[penultimate:last], full)
+	xor(pt[penultimate:last], prev)
+	return pt, nil
+}
+
+func xor(dst, src []byte) {
+	for i := range dst {
+		dst[i] ^= src[i]
+	}
+}
@@ -0,0 +1,171 @@
+package kerberos
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"testing"
+)
+
+// encrypt is the inverse of decrypt, used to build test tickets.
+func encrypt(t *testing.T, key []byte, usage uint32, plaintext []byte) []byte {
+	ke, err := deriveKey(key, usageConstant(usage, 0xAA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ki, err := deriveKey(key, usageConstant(usage, 0x55))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, aes.BlockSize, aes.BlockSize+len(plaintext))
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	data = append(data, plaintext...)
+	h := hmac.New(sha1.New, ki)
+	h.Write(data)
+	return append(ctsEncrypt(t, ke, data), h.Sum(nil)[:hmacSize]...)
+}
+
+func ctsEncrypt(t *testing.T, key, pt []byte) []byte {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	padded := make([]byte, (len(pt)+aes.BlockSize-1)/aes.BlockSize*aes.BlockSize)
+	copy(padded, pt)
+	ct := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(block, make([]byte, aes.BlockSize)).CryptBlocks(ct, padded)
+	if n := len(ct); n > aes.BlockSize {
+		last := append([]byte(nil), ct[n-aes.BlockSize:]...)
+		copy(ct[n-aes.BlockSize:], ct[n-2*aes.BlockSize:n-aes.BlockSize])
+		copy(ct[n-2*aes.BlockSize:], last)
+	}
+	return ct[:len(pt)]
+}
+
+func TestNFold(t *testing.T) {
+	// Test vectors from RFC 3961 appendix A.1.
+	tests := []struct {
+		in   string
+		bits int
+		want string
+	}{
+		{"012345", 64, "be072631276b1955"},
+		{"password", 56, "78a07b6caf85fa"},
+		{"Rough Consensus, and Running Code", 64, "bb6ed30870b7f0e0"},
+		{"password", 168, "59e4a8ca7c0385c3c37b3f6d2000247cb6e6bd5b3e"},
+		{"MASSACHVSETTS INSTITVTE OF TECHNOLOGY", 192, "db3b0d8f0b061e603282b308a50841229ad798fab9540c1b"},
+		{"Q", 168, "518a54a215a8452a518a54a215a8452a518a54a215"},
+		{"ba", 168, "fb25d531ae8974499f52fd92ea9857c4ba24cf297e"},
+		{"kerberos", 64, "6b65726265726f73"},
+		{"kerberos", 128, "6b65726265726f737b9b5b2b93132b93"},
+		{"kerberos", 168, "8372c236344e5f1550cd0747e15d62ca7a5a3bcea4"},
+		{"kerberos", 256, "6b65726265726f737b9b5b2b93132b935c9bdcdad95c9899c4cae4dee6d6cae4"},
+	}
+	for _, tc := range tests {
+		if got := hex.EncodeToString(nfold([]byte(tc.in), tc.bits/8)); got != tc.want {
+			t.Errorf("%d-fold(%q): expected %s, got %s", tc.bits, tc.in, tc.want, got)
+		}
+	}
+}
+
+func TestDeriveKey(t *testing.T) {
+	// Test vectors from RFC 3962 appendix B. The key string-to-key returns
+	// for a passphrase is DK(PBKDF2(passphrase), "kerberos").
+	tests := []struct {
+		pbkdf2, key string
+	}{
+		{"cdedb5281bb2f801565a1122b2563515", "42263c6e89f4fc28b8df68ee09799f15"},
+		{"cdedb5281bb2f801565a1122b25635150ad1f7a04bb9f3a333ecc0e2e1f70837", "fe697b52bc0d3ce14432ba036a92e65bbb52280990a2fa27883998d72af30161"},
+		{"01dbee7f4a9e243e988b62c73cda935d", "c651bf29e2300ac27fa469d693bdda13"},
+		{"01dbee7f4a9e243e988b62c73cda935da05378b93244ec8f48a99e61ad799d86", "a2e16d16b36069c135d5e9d2e25f896102685618b95914b467c67622225824ff"},
+		{"5c08eb61fdf71e4e4ec3cf6ba1f5512b", "4c01cd46d632d01e6dbe230a01ed642a"},
+		{"5c08eb61fdf71e4e4ec3cf6ba1f5512ba7e52ddbc5e5142f708a31e2e62b1e13", "55a6ac740ad17b4846941051e1e8b0a7548d93b0ab30a8bc3ff16280382b8c2a"},
+	}
+	for _, tc := range tests {
+		tkey, _ := hex.DecodeString(tc.pbkdf2)
+		got, err := deriveKey(tkey, []byte("kerberos"))
+		if err != nil {
+			t.Errorf("derive key from %s: %v", tc.pbkdf2, err)
+			continue
+		}
+		if hex.EncodeToString(got) != tc.key {
+			t.Errorf("derive key from %s: expected %s, got %x", tc.pbkdf2, tc.key, got)
+		}
+	}
+}
+
+func TestCTS(t *testing.T) {
+	// Test vectors from RFC 3962 appendix B.
+	key, _ := hex.DecodeString("636869636b656e207465726979616b69")
+	tests := []struct {
+		plaintext, ciphertext string
+	}{
+		{
+			"4920776f756c64206c696b652074686520",
+			"c6353568f2bf8cb4d8a580362da7ff7f97",
+		},
+		{
+			"4920776f756c64206c696b65207468652047656e6572616c20476175277320",
+			"fc00783e0efdb2c1d445d4c8eff7ed2297687268d6ecccc0c07b25e25ecfe5",
+		},
+		{
+			"4920776f756c64206c696b65207468652047656e6572616c2047617527732043",
+			"39312523a78662d5be7fcbcc98ebf5a897687268d6ecccc0c07b25e25ecfe584",
+		},
+		{
+			"4920776f756c64206c696b65207468652047656e6572616c20476175277320436869636b656e2c20706c656173652c",
+			"97687268d6ecccc0c07b25e25ecfe584b3fffd940c16a18c1b5549d2f838029e39312523a78662d5be7fcbcc98ebf5",
+		},
+		{
+			"4920776f756c64206c696b65207468652047656e6572616c20476175277320436869636b656e2c20706c656173652c20",
+			"97687268d6ecccc0c07b25e25ecfe5849dad8bbb96c4cdc03bc103e1a194bbd839312523a78662d5be7fcbcc98ebf5a8",
+		},
+		{
+			"4920776f756c64206c696b65207468652047656e6572616c20476175277320436869636b656e2c20706c656173652c20616e6420776f6e746f6e20736f75702e",
+			"97687268d6ecccc0c07b25e25ecfe58439312523a78662d5be7fcbcc98ebf5a84807efe836ee89a526730dbc2f7bc8409dad8bbb96c4cdc03bc103e1a194bbd8",
+		},
+	}
+	for _, tc := range tests {
+		pt, _ := hex.DecodeString(tc.plaintext)
+		ct, _ := hex.DecodeString(tc.ciphertext)
+		got, err := ctsDecrypt(key, ct)
+		if err != nil {
+			t.Errorf("decrypt %d bytes: %v", len(ct), err)
+			continue
+		}
+		if !bytes.Equal(got, pt) {
+			t.Errorf("decrypt %d bytes: expected %x, got %x", len(ct), pt, got)
+		}
+		if got := ctsEncrypt(t, key, pt); !bytes.Equal(got, ct) {
+			t.Errorf("encrypt %d bytes: expected %x, got %x", len(pt), ct, got)
+		}
+	}
+}
+
+func TestDecrypt(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 32)
+	plaintext := []byte("a message longer than a single block")
+	ciphertext := encrypt(t, key, usageTicket, plaintext)
+
+	got, err := decrypt(etypeAES256, key, usageTicket, ciphertext)
+	if err != nil {
+		t.Fatalf("decrypt: %v", err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Errorf("expected %q, got %q", plaintext, got)
+	}
+
+	if _, err := decrypt(etypeAES256, key, usageAPReqAuthorizer, ciphertext); err == nil {
+		t.Error("expected decrypting with another key usage to fail")
+	}
+	ciphertext[len(ciphertext)-1] ^= 1
+	if _, err := decrypt(etypeAES256, key, usageTicket, ciphertext); err == nil {
+		t.Error("expected integrity check to fail for a modified ciphertext")
+	}
+}
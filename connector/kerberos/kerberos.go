@@ -0,0 +1,166 @@
+// Package kerberos implements a connector which logs users in with the
+// Kerberos ticket their browser presents through SPNEGO ("Negotiate").
+package kerberos
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dexidp/dex/connector"
+	"github.com/dexidp/dex/pkg/log"
+)
+
+// Config holds the configuration parameters for the Kerberos connector.
+//
+// An example config:
+//
+//	type: kerberos
+//	id: kerberos
+//	name: Windows Login
+//	config:
+//	  keytabFile: /etc/dex/dex.keytab
+//	  servicePrincipal: HTTP/dex.example.com@EXAMPLE.COM
+//	  fallbackConnector: ldap
+//	  emailDomain: example.com
+type Config struct {
+	// Keytab holding the keys of the HTTP service principal of the host dex is
+	// served from. Only AES encryption types are supported.
+	KeytabFile string `json:"keytabFile"`
+
+	// If set, only tickets for this service principal are accepted. Defaults
+	// to any principal in the keytab.
+	ServicePrincipal string `json:"servicePrincipal"`
+
+	// ID of a connector users are sent to when their browser doesn't negotiate
+	// a Kerberos ticket.
+	FallbackConnector string `json:"fallbackConnector"`
+
+	// If set, users get a verified email of their username at this domain.
+	EmailDomain string `json:"emailDomain"`
+
+	// Maximum clock skew between dex and clients, as a duration string.
+	// Defaults to "5m".
+	MaxClockSkew string `json:"maxClockSkew"`
+}
+
+// validator authenticates a GSSAPI token and returns the client principal.
+type validator interface {
+	Validate(token []byte, now time.Time) (principal string, err error)
+	Healthy() error
+}
+
+// Open returns a connector which authenticates users with SPNEGO.
+func (c *Config) Open(id string, logger log.Logger) (connector.Connector, error) {
+	if c.KeytabFile == "" {
+		return nil, errors.New("kerberos: no keytabFile specified")
+	}
+	if c.FallbackConnector == id {
+		return nil, errors.New("kerberos: connector can't fall back to itself")
+	}
+	skew := 5 * time.Minute
+	if c.MaxClockSkew != "" {
+		var err error
+		if skew, err = time.ParseDuration(c.MaxClockSkew); err != nil {
+			return nil, fmt.Errorf("kerberos: parse maxClockSkew: %v", err)
+		}
+	}
+	v := &keytabValidator{
+		keytabFile:       c.KeytabFile,
+		servicePrincipal: c.ServicePrincipal,
+		maxClockSkew:     skew,
+	}
+	if err := v.Healthy(); err != nil {
+		return nil, fmt.Errorf("kerberos: %v", err)
+	}
+	return &kerberosConnector{
+		validator:   v,
+		fallback:    c.FallbackConnector,
+		emailDomain: c.EmailDomain,
+		pathSuffix:  "/" + id,
+		now:         time.Now,
+		logger:      logger,
+	}, nil
+}
+
+var (
+	_ connector.CallbackConnector = (*kerberosConnector)(nil)
+	_ connector.HealthChecker     = (*kerberosConnector)(nil)
+)
+
+type kerberosConnector struct {
+	validator   validator
+	fallback    string
+	emailDomain string
+	pathSuffix  string
+	now         func() time.Time
+	logger      log.Logger
+}
+
+// LoginURL points at the connector's own callback, which is where the browser
+// is challenged, so web servers in front of dex can treat it specially.
+func (c *kerberosConnector) LoginURL(s connector.Scopes, callbackURL, state string) (string, error) {
+	u, err := url.Parse(callbackURL)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse callbackURL %q: %v", callbackURL, err)
+	}
+	u.Path = u.Path + c.pathSuffix
+	v := u.Query()
+	v.Set("state", state)
+	u.RawQuery = v.Encode()
+	return u.String(), nil
+}
+
+// HandleCallback authenticates the ticket in the "Authorization: Negotiate"
+// header, or asks the server to challenge the browser for one.
+func (c *kerberosConnector) HandleCallback(s connector.Scopes, r *http.Request) (connector.Identity, error) {
+	auth := r.Header.Get("Authorization")
+	const prefix = "negotiate "
+	if len(auth) <= len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return connector.Identity{}, &connector.ChallengeError{Challenge: "Negotiate", FallbackConnectorID: c.fallback}
+	}
+	token, err := base64.StdEncoding.DecodeString(strings.TrimSpace(auth[len(prefix):]))
+	if err != nil {
+		return connector.Identity{}, fmt.Errorf("kerberos: decode negotiate token: %v", err)
+	}
+
+	principal, err := c.validator.Validate(token, c.now())
+	if err != nil {
+		if err == errNotKerberos {
+			c.logger.Infof("kerberos: browser didn't negotiate kerberos")
+			return connector.Identity{}, &connector.ChallengeError{FallbackConnectorID: c.fallback}
+		}
+		return connector.Identity{}, fmt.Errorf("kerberos: %v", err)
+	}
+	return c.identity(principal), nil
+}
+
+// identity maps a principal such as "jane@EXAMPLE.COM" to an identity.
+func (c *kerberosConnector) identity(principal string) connector.Identity {
+	username := principal
+	if i := strings.LastIndex(principal, "@"); i >= 0 {
+		username = principal[:i]
+	}
+	ident := connector.Identity{
+		UserID:   principal,
+		Username: username,
+	}
+	if c.emailDomain != "" {
+		ident.Email = username + "@" + c.emailDomain
+		ident.EmailVerified = true
+	}
+	return ident
+}
+
+// Healthy checks that the keytab can still be loaded.
+func (c *kerberosConnector) Healthy(ctx context.Context) error {
+	if err := c.validator.Healthy(); err != nil {
+		return fmt.Errorf("kerberos: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,314 @@
+package kerberos
+
+import (
+	"bytes"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/dexidp/dex/connector"
+)
+
+type stubValidator struct {
+	principals map[string]string
+}
+
+func (v stubValidator) Validate(token []byte, now time.Time) (string, error) {
+	if bytes.HasPrefix(token, []byte("NTLMSSP\x00")) {
+		return "", errNotKerberos
+	}
+	if p, ok := v.principals[string(token)]; ok {
+		return p, nil
+	}
+	return "", errors.New("invalid ticket")
+}
+
+func (v stubValidator) Healthy() error { return nil }
+
+func newTestConnector() *kerberosConnector {
+	return &kerberosConnector{
+		validator:   stubValidator{map[string]string{"ticket": "jane@EXAMPLE.COM"}},
+		fallback:    "ldap",
+		emailDomain: "example.com",
+		pathSuffix:  "/kerberos",
+		now:         time.Now,
+		logger:      &logrus.Logger{Out: ioutil.Discard, Formatter: &logrus.TextFormatter{}},
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	conn := newTestConnector()
+
+	loginURL, err := conn.LoginURL(connector.Scopes{}, "https://dex.example.com/callback", "state")
+	if err != nil {
+		t.Fatalf("login url: %v", err)
+	}
+	if want := "https://dex.example.com/callback/kerberos?state=state"; loginURL != want {
+		t.Errorf("expected login URL %q, got %q", want, loginURL)
+	}
+
+	callback := func(authorization string) (connector.Identity, error) {
+		r := httptest.NewRequest("GET", loginURL, nil)
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		return conn.HandleCallback(connector.Scopes{}, r)
+	}
+	encode := func(token string) string {
+		return base64.StdEncoding.EncodeToString([]byte(token))
+	}
+
+	_, err = callback("")
+	challenge, ok := err.(*connector.ChallengeError)
+	if !ok || challenge.Challenge != "Negotiate" || challenge.FallbackConnectorID != "ldap" {
+		t.Errorf("expected a Negotiate challenge falling back to ldap, got %v", err)
+	}
+
+	_, err = callback("Negotiate " + encode("NTLMSSP\x00\x01"))
+	challenge, ok = err.(*connector.ChallengeError)
+	if !ok || challenge.Challenge != "" || challenge.FallbackConnectorID != "ldap" {
+		t.Errorf("expected fallback without a challenge for NTLM, got %v", err)
+	}
+
+	ident, err := callback("Negotiate " + encode("ticket"))
+	if err != nil {
+		t.Fatalf("handle callback: %v", err)
+	}
+	want := connector.Identity{
+		UserID:        "jane@EXAMPLE.COM",
+		Username:      "jane",
+		Email:         "jane@example.com",
+		EmailVerified: true,
+	}
+	if ident.UserID != want.UserID || ident.Username != want.Username || ident.Email != want.Email || !ident.EmailVerified {
+		t.Errorf("expected identity %+v, got %+v", want, ident)
+	}
+
+	_, err = callback("Negotiate " + encode("forged"))
+	if _, ok := err.(*connector.ChallengeError); err == nil || ok {
+		t.Errorf("expected an invalid ticket to fail authentication, got %v", err)
+	}
+}
+
+const testService = "HTTP/dex.example.com@EXAMPLE.COM"
+
+// writeKeytab writes a keytab with a single AES256 key for testService.
+func writeKeytab(t *testing.T, dir string, key []byte) string {
+	str := func(b *bytes.Buffer, s string) {
+		binary.Write(b, binary.BigEndian, uint16(len(s)))
+		b.WriteString(s)
+	}
+	var entry bytes.Buffer
+	binary.Write(&entry, binary.BigEndian, uint16(2))
+	str(&entry, "EXAMPLE.COM")
+	str(&entry, "HTTP")
+	str(&entry, "dex.example.com")
+	binary.Write(&entry, binary.BigEndian, uint32(1))          // name type
+	binary.Write(&entry, binary.BigEndian, uint32(1500000000)) // timestamp
+	entry.WriteByte(3)                                         // key version
+	binary.Write(&entry, binary.BigEndian, uint16(etypeAES256))
+	str(&entry, string(key))
+	binary.Write(&entry, binary.BigEndian, uint32(3))
+
+	keytab := bytes.NewBuffer([]byte{0x05, 0x02})
+	// A hole left by a deleted entry.
+	binary.Write(keytab, binary.BigEndian, int32(-4))
+	keytab.Write(make([]byte, 4))
+	binary.Write(keytab, binary.BigEndian, int32(entry.Len()))
+	keytab.Write(entry.Bytes())
+
+	path := filepath.Join(dir, "dex.keytab")
+	if err := ioutil.WriteFile(path, keytab.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func mustMarshal(t *testing.T, v interface{}, params string) []byte {
+	b, err := asn1.MarshalWithParams(v, params)
+	if err != nil {
+		t.Fatalf("marshal %T: %v", v, err)
+	}
+	return b
+}
+
+// explicit tags a raw value, which asn1.Marshal doesn't do for them.
+func explicit(tag int, b []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: tag, IsCompound: true, Bytes: b}
+}
+
+// gssToken wraps an inner token in an RFC 2743 InitialContextToken.
+func gssToken(t *testing.T, mech asn1.ObjectIdentifier, inner []byte) []byte {
+	return mustMarshal(t, asn1.RawValue{
+		Class:      asn1.ClassApplication,
+		Tag:        0,
+		IsCompound: true,
+		Bytes:      append(mustMarshal(t, mech, ""), inner...),
+	}, "")
+}
+
+// newTestToken builds the SPNEGO token a browser would send for a ticket
+// issued at issued to jane@EXAMPLE.COM, with the given ticket flags set.
+func newTestToken(t *testing.T, serviceKey []byte, issued time.Time, flags ...int) []byte {
+	sessionKey := bytes.Repeat([]byte{0x17}, 16)
+	client := principalName{NameType: 1, NameString: []string{"jane"}}
+
+	flagBits := asn1.BitString{Bytes: make([]byte, 4), BitLength: 32}
+	for _, f := range flags {
+		flagBits.Bytes[f/8] |= 0x80 >> uint(f%8)
+	}
+	encPart := encTicketPart{
+		Flags:     flagBits,
+		Key:       encryptionKey{KeyType: etypeAES128, KeyValue: sessionKey},
+		CRealm:    "EXAMPLE.COM",
+		CName:     client,
+		Transited: explicit(4, []byte{0x30, 0x00}),
+		AuthTime:  issued.UTC().Truncate(time.Second),
+		EndTime:   issued.Add(10 * time.Hour).UTC().Truncate(time.Second),
+	}
+	tkt := ticket{
+		TktVNO: 5,
+		Realm:  "EXAMPLE.COM",
+		SName:  principalName{NameType: 2, NameString: []string{"HTTP", "dex.example.com"}},
+		EncPart: encryptedData{
+			EType:  etypeAES256,
+			KVNO:   3,
+			Cipher: encrypt(t, serviceKey, usageTicket, mustMarshal(t, encPart, "application,explicit,tag:3")),
+		},
+	}
+	auth := authenticator{
+		AuthenticatorVNO: 5,
+		CRealm:           "EXAMPLE.COM",
+		CName:            client,
+		CUSec:            issued.Nanosecond() / 1000,
+		CTime:            issued.UTC().Truncate(time.Second),
+	}
+	req := apReq{
+		PVNO:    5,
+		MsgType: 14,
+		Ticket:  explicit(3, mustMarshal(t, tkt, "application,explicit,tag:1")),
+		Authenticator: encryptedData{
+			EType:  etypeAES128,
+			Cipher: encrypt(t, sessionKey, usageAPReqAuthorizer, mustMarshal(t, auth, "application,explicit,tag:2")),
+		},
+	}
+	krb5Token := gssToken(t, oidKRB5, append([]byte{0x01, 0x00}, mustMarshal(t, req, "application,explicit,tag:14")...))
+
+	init := negTokenInit{
+		MechTypes: []asn1.ObjectIdentifier{oidMSKRB5, oidKRB5},
+		MechToken: krb5Token,
+	}
+	choice := asn1.RawValue{
+		Class:      asn1.ClassContextSpecific,
+		Tag:        0,
+		IsCompound: true,
+		Bytes:      mustMarshal(t, init, ""),
+	}
+	return gssToken(t, oidSPNEGO, mustMarshal(t, choice, ""))
+}
+
+func TestKeytabValidator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dex-kerberos")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	serviceKey := bytes.Repeat([]byte{0x42}, 32)
+	v := &keytabValidator{
+		keytabFile:       writeKeytab(t, dir, serviceKey),
+		servicePrincipal: testService,
+		maxClockSkew:     5 * time.Minute,
+	}
+	if err := v.Healthy(); err != nil {
+		t.Fatalf("expected keytab to be healthy: %v", err)
+	}
+
+	now := time.Now()
+	principal, err := v.Validate(newTestToken(t, serviceKey, now), now)
+	if err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	if principal != "jane@EXAMPLE.COM" {
+		t.Errorf("expected principal %q, got %q", "jane@EXAMPLE.COM", principal)
+	}
+
+	if _, err := v.Validate(newTestToken(t, serviceKey, now.Add(-time.Hour)), now); err == nil {
+		t.Error("expected a stale authenticator to be rejected")
+	}
+	if _, err := v.Validate(newTestToken(t, serviceKey, now.Add(time.Second), flagInvalid), now); err == nil {
+		t.Error("expected a ticket flagged invalid to be rejected")
+	}
+	if _, err := v.Validate(newTestToken(t, serviceKey, now.Add(2*time.Second), flagPostdated), now); err == nil {
+		t.Error("expected a postdated ticket to be rejected")
+	}
+	if _, err := v.Validate(newTestToken(t, bytes.Repeat([]byte{0x24}, 32), now), now); err == nil {
+		t.Error("expected a ticket encrypted with another key to be rejected")
+	}
+	if _, err := v.Validate([]byte("NTLMSSP\x00\x01"), now); err != errNotKerberos {
+		t.Errorf("expected NTLM token to be reported as not kerberos, got %v", err)
+	}
+
+	os.Remove(v.keytabFile)
+	if err := v.Healthy(); err == nil {
+		t.Error("expected health check to fail without a keytab")
+	}
+}
+
+func TestKeytabValidatorReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dex-kerberos")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	serviceKey := bytes.Repeat([]byte{0x42}, 32)
+	v := &keytabValidator{
+		keytabFile:       writeKeytab(t, dir, serviceKey),
+		servicePrincipal: testService,
+		maxClockSkew:     5 * time.Minute,
+	}
+
+	now := time.Now()
+	token := newTestToken(t, serviceKey, now)
+	if _, err := v.Validate(token, now); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	if _, err := v.Validate(token, now.Add(time.Second)); err == nil {
+		t.Error("expected a replayed authenticator to be rejected")
+	}
+	if _, err := v.Validate(newTestToken(t, serviceKey, now.Add(time.Microsecond)), now); err != nil {
+		t.Errorf("expected a new authenticator to be accepted: %v", err)
+	}
+
+	// Once the authenticator is outside the clock skew it's dropped from the
+	// cache, as it's refused for its time anyway.
+	later := now.Add(10 * time.Minute)
+	if _, err := v.Validate(newTestToken(t, serviceKey, later), later); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	if n := len(v.replays.entries); n != 1 {
+		t.Errorf("expected expired authenticators to be evicted, got %d entries", n)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	c := Config{KeytabFile: "/nonexistent/dex.keytab"}
+	logger := &logrus.Logger{Out: ioutil.Discard, Formatter: &logrus.TextFormatter{}}
+	if _, err := c.Open("kerberos", logger); err == nil {
+		t.Error("expected opening the connector to fail without a loadable keytab")
+	}
+	c = Config{KeytabFile: "/nonexistent/dex.keytab", FallbackConnector: "kerberos"}
+	if _, err := c.Open("kerberos", logger); err == nil {
+		t.Error("expected opening the connector to fail when it falls back to itself")
+	}
+}
@@ -0,0 +1,130 @@
+package kerberos
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// keytabEntry is a key of a service principal read from a keytab file.
+type keytabEntry struct {
+	// Principal name, such as "HTTP/dex.example.com@EXAMPLE.COM".
+	Principal string
+	KVNO      uint32
+	EType     int32
+	Key       []byte
+}
+
+// loadKeytab reads a keytab file in the version 2 format written by MIT
+// Kerberos, Heimdal and ktpass.
+func loadKeytab(path string) ([]keytabEntry, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseKeytab(data)
+}
+
+func parseKeytab(data []byte) ([]keytabEntry, error) {
+	if len(data) < 2 || data[0] != 0x05 {
+		return nil, errors.New("not a keytab file")
+	}
+	if data[1] != 0x02 {
+		return nil, fmt.Errorf("unsupported keytab version %d", data[1])
+	}
+
+	var entries []keytabEntry
+	r := &keytabReader{b: data[2:]}
+	for len(r.b) > 0 {
+		size := int32(r.uint32())
+		if r.err != nil {
+			break
+		}
+		if size < 0 {
+			// A hole left by a deleted entry.
+			r.bytes(int(-size))
+			continue
+		}
+		record := &keytabReader{b: r.bytes(int(size))}
+		if r.err != nil {
+			break
+		}
+		entry, err := record.entry()
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return entries, nil
+}
+
+type keytabReader struct {
+	b   []byte
+	err error
+}
+
+func (r *keytabReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > len(r.b) {
+		r.err = errors.New("keytab truncated")
+		return nil
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *keytabReader) uint16() uint16 {
+	b := r.bytes(2)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(b)
+}
+
+func (r *keytabReader) uint32() uint32 {
+	b := r.bytes(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (r *keytabReader) string() string {
+	return string(r.bytes(int(r.uint16())))
+}
+
+func (r *keytabReader) entry() (keytabEntry, error) {
+	var e keytabEntry
+	n := int(r.uint16())
+	realm := r.string()
+	components := make([]string, n)
+	for i := range components {
+		components[i] = r.string()
+	}
+	r.uint32() // name type
+	r.uint32() // timestamp
+	if vno := r.bytes(1); vno != nil {
+		e.KVNO = uint32(vno[0])
+	}
+	e.EType = int32(r.uint16())
+	e.Key = r.bytes(int(r.uint16()))
+	if r.err != nil {
+		return e, r.err
+	}
+	// Newer implementations append the full 32 bit key version.
+	if len(r.b) >= 4 {
+		if kvno := r.uint32(); kvno != 0 {
+			e.KVNO = kvno
+		}
+	}
+	e.Principal = strings.Join(components, "/") + "@" + realm
+	return e, nil
+}
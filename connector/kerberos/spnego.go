@@ -0,0 +1,314 @@
+package kerberos
+
+import (
+	"bytes"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	oidSPNEGO = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 2}
+	oidKRB5   = asn1.ObjectIdentifier{1, 2, 840, 113554, 1, 2, 2}
+	// Windows clients may advertise Kerberos under this incorrect OID.
+	oidMSKRB5 = asn1.ObjectIdentifier{1, 2, 840, 48018, 1, 2, 2}
+)
+
+// errNotKerberos is returned for tokens that don't carry a Kerberos ticket,
+// for example when the browser falls back to NTLM.
+var errNotKerberos = errors.New("token doesn't use Kerberos")
+
+// negTokenInit is the SPNEGO message sent by the browser, RFC 4178 section 4.2.1.
+type negTokenInit struct {
+	MechTypes   []asn1.ObjectIdentifier `asn1:"explicit,tag:0"`
+	ReqFlags    asn1.BitString          `asn1:"explicit,optional,tag:1"`
+	MechToken   []byte                  `asn1:"explicit,optional,tag:2"`
+	MechListMIC []byte                  `asn1:"explicit,optional,tag:3"`
+}
+
+// Kerberos messages from RFC 4120 section 5, reduced to the fields needed to
+// authenticate an AP-REQ.
+
+type principalName struct {
+	NameType   int32    `asn1:"explicit,tag:0"`
+	NameString []string `asn1:"explicit,tag:1"`
+}
+
+func (p principalName) String() string {
+	return strings.Join(p.NameString, "/")
+}
+
+type encryptedData struct {
+	EType  int32  `asn1:"explicit,tag:0"`
+	KVNO   int    `asn1:"explicit,optional,tag:1"`
+	Cipher []byte `asn1:"explicit,tag:2"`
+}
+
+type encryptionKey struct {
+	KeyType  int32  `asn1:"explicit,tag:0"`
+	KeyValue []byte `asn1:"explicit,tag:1"`
+}
+
+type apReq struct {
+	PVNO      int            `asn1:"explicit,tag:0"`
+	MsgType   int            `asn1:"explicit,tag:1"`
+	APOptions asn1.BitString `asn1:"explicit,tag:2"`
+	// Raw values keep their explicit tag, the ticket itself is in Bytes.
+	Ticket        asn1.RawValue `asn1:"explicit,tag:3"`
+	Authenticator encryptedData `asn1:"explicit,tag:4"`
+}
+
+type ticket struct {
+	TktVNO  int           `asn1:"explicit,tag:0"`
+	Realm   string        `asn1:"explicit,tag:1"`
+	SName   principalName `asn1:"explicit,tag:2"`
+	EncPart encryptedData `asn1:"explicit,tag:3"`
+}
+
+type encTicketPart struct {
+	Flags             asn1.BitString `asn1:"explicit,tag:0"`
+	Key               encryptionKey  `asn1:"explicit,tag:1"`
+	CRealm            string         `asn1:"explicit,tag:2"`
+	CName             principalName  `asn1:"explicit,tag:3"`
+	Transited         asn1.RawValue  `asn1:"explicit,tag:4"`
+	AuthTime          time.Time      `asn1:"generalized,explicit,tag:5"`
+	StartTime         time.Time      `asn1:"generalized,explicit,optional,tag:6"`
+	EndTime           time.Time      `asn1:"generalized,explicit,tag:7"`
+	RenewTill         time.Time      `asn1:"generalized,explicit,optional,tag:8"`
+	CAddr             asn1.RawValue  `asn1:"explicit,optional,tag:9"`
+	AuthorizationData asn1.RawValue  `asn1:"explicit,optional,tag:10"`
+}
+
+type authenticator struct {
+	AuthenticatorVNO  int           `asn1:"explicit,tag:0"`
+	CRealm            string        `asn1:"explicit,tag:1"`
+	CName             principalName `asn1:"explicit,tag:2"`
+	Cksum             asn1.RawValue `asn1:"explicit,optional,tag:3"`
+	CUSec             int           `asn1:"explicit,tag:4"`
+	CTime             time.Time     `asn1:"generalized,explicit,tag:5"`
+	SubKey            asn1.RawValue `asn1:"explicit,optional,tag:6"`
+	SeqNumber         int64         `asn1:"explicit,optional,tag:7"`
+	AuthorizationData asn1.RawValue `asn1:"explicit,optional,tag:8"`
+}
+
+// unwrapGSSToken splits an RFC 2743 InitialContextToken into its mechanism
+// and inner token.
+func unwrapGSSToken(token []byte) (asn1.ObjectIdentifier, []byte, error) {
+	var outer asn1.RawValue
+	if _, err := asn1.Unmarshal(token, &outer); err != nil {
+		return nil, nil, fmt.Errorf("parse gss token: %v", err)
+	}
+	if outer.Class != asn1.ClassApplication || outer.Tag != 0 {
+		return nil, nil, errNotKerberos
+	}
+	var mech asn1.ObjectIdentifier
+	inner, err := asn1.Unmarshal(outer.Bytes, &mech)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parse gss mechanism: %v", err)
+	}
+	return mech, inner, nil
+}
+
+// parseAPReq extracts the Kerberos AP-REQ from the token a browser sent in its
+// "Authorization: Negotiate" header. Both SPNEGO wrapped and raw Kerberos
+// tokens are accepted.
+func parseAPReq(token []byte) (*apReq, error) {
+	if bytes.HasPrefix(token, []byte("NTLMSSP\x00")) {
+		return nil, errNotKerberos
+	}
+	mech, inner, err := unwrapGSSToken(token)
+	if err != nil {
+		return nil, err
+	}
+
+	if mech.Equal(oidSPNEGO) {
+		var choice asn1.RawValue
+		if _, err := asn1.Unmarshal(inner, &choice); err != nil {
+			return nil, fmt.Errorf("parse spnego token: %v", err)
+		}
+		if choice.Class != asn1.ClassContextSpecific || choice.Tag != 0 {
+			return nil, errors.New("expected spnego negTokenInit")
+		}
+		var init negTokenInit
+		if _, err := asn1.Unmarshal(choice.Bytes, &init); err != nil {
+			return nil, fmt.Errorf("parse spnego negTokenInit: %v", err)
+		}
+		// Only the optimistic token of the preferred mechanism is sent, so
+		// Kerberos must come first.
+		if len(init.MechTypes) == 0 || len(init.MechToken) == 0 ||
+			!(init.MechTypes[0].Equal(oidKRB5) || init.MechTypes[0].Equal(oidMSKRB5)) {
+			return nil, errNotKerberos
+		}
+		if mech, inner, err = unwrapGSSToken(init.MechToken); err != nil {
+			return nil, err
+		}
+	}
+
+	if !mech.Equal(oidKRB5) && !mech.Equal(oidMSKRB5) {
+		return nil, errNotKerberos
+	}
+	// RFC 1964 section 1.1.1, the AP-REQ follows a two byte token ID.
+	if len(inner) < 2 || inner[0] != 0x01 || inner[1] != 0x00 {
+		return nil, errors.New("expected kerberos AP-REQ")
+	}
+	var req apReq
+	if _, err := asn1.UnmarshalWithParams(inner[2:], &req, "application,explicit,tag:14"); err != nil {
+		return nil, fmt.Errorf("parse AP-REQ: %v", err)
+	}
+	return &req, nil
+}
+
+// Ticket flags from RFC 4120 section 5.3.
+const (
+	flagPostdated = 6
+	flagInvalid   = 7
+)
+
+// replayCache remembers the authenticators accepted within the allowed clock
+// skew, as required by RFC 4120 section 3.2.3. It's kept in memory, so it only
+// protects against replays to the same dex instance.
+type replayCache struct {
+	mu      sync.Mutex
+	entries map[replayKey]time.Time
+}
+
+// replayKey identifies an authenticator by its client and timestamp, which a
+// client never reuses.
+type replayKey struct {
+	client string
+	ctime  int64
+	cusec  int
+}
+
+// add records an authenticator until it expires, reporting false if it was
+// seen before.
+func (c *replayCache) add(key replayKey, expiry, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, exp := range c.entries {
+		if now.After(exp) {
+			delete(c.entries, k)
+		}
+	}
+	if _, ok := c.entries[key]; ok {
+		return false
+	}
+	if c.entries == nil {
+		c.entries = make(map[replayKey]time.Time)
+	}
+	c.entries[key] = expiry
+	return true
+}
+
+// keytabValidator authenticates AP-REQs using the service keys in a keytab.
+type keytabValidator struct {
+	keytabFile string
+	// If set, only tickets for this principal are accepted.
+	servicePrincipal string
+	maxClockSkew     time.Duration
+
+	replays replayCache
+}
+
+// Validate returns the client principal, such as "jane@EXAMPLE.COM", a token
+// authenticates.
+func (v *keytabValidator) Validate(token []byte, now time.Time) (string, error) {
+	req, err := parseAPReq(token)
+	if err != nil {
+		return "", err
+	}
+	var tkt ticket
+	if _, err := asn1.UnmarshalWithParams(req.Ticket.Bytes, &tkt, "application,explicit,tag:1"); err != nil {
+		return "", fmt.Errorf("parse ticket: %v", err)
+	}
+	service := tkt.SName.String() + "@" + tkt.Realm
+	if v.servicePrincipal != "" && !strings.EqualFold(service, v.servicePrincipal) {
+		return "", fmt.Errorf("ticket is for service %q", service)
+	}
+
+	entries, err := loadKeytab(v.keytabFile)
+	if err != nil {
+		return "", fmt.Errorf("load keytab: %v", err)
+	}
+	var key []byte
+	for _, e := range entries {
+		if strings.EqualFold(e.Principal, service) && e.EType == tkt.EncPart.EType &&
+			(tkt.EncPart.KVNO == 0 || e.KVNO == uint32(tkt.EncPart.KVNO)) {
+			key = e.Key
+		}
+	}
+	if key == nil {
+		return "", fmt.Errorf("no key in keytab for %q with encryption type %d and version %d", service, tkt.EncPart.EType, tkt.EncPart.KVNO)
+	}
+
+	plaintext, err := decrypt(tkt.EncPart.EType, key, usageTicket, tkt.EncPart.Cipher)
+	if err != nil {
+		return "", fmt.Errorf("decrypt ticket: %v", err)
+	}
+	var encPart encTicketPart
+	if _, err := asn1.UnmarshalWithParams(plaintext, &encPart, "application,explicit,tag:3"); err != nil {
+		return "", fmt.Errorf("parse ticket: %v", err)
+	}
+	// Postdated tickets are issued invalid and must be validated by the KDC
+	// before use, which dex can't check without contacting it.
+	if encPart.Flags.At(flagInvalid) == 1 {
+		return "", errors.New("ticket is flagged invalid")
+	}
+	if encPart.Flags.At(flagPostdated) == 1 {
+		return "", errors.New("postdated tickets are not accepted")
+	}
+	start := encPart.StartTime
+	if start.IsZero() {
+		start = encPart.AuthTime
+	}
+	if !encPart.EndTime.After(start) {
+		return "", errors.New("ticket ends before it starts")
+	}
+	if now.Add(v.maxClockSkew).Before(start) || now.Add(-v.maxClockSkew).After(encPart.EndTime) {
+		return "", errors.New("ticket is not valid at this time")
+	}
+
+	plaintext, err = decrypt(encPart.Key.KeyType, encPart.Key.KeyValue, usageAPReqAuthorizer, req.Authenticator.Cipher)
+	if err != nil {
+		return "", fmt.Errorf("decrypt authenticator: %v", err)
+	}
+	var auth authenticator
+	if _, err := asn1.UnmarshalWithParams(plaintext, &auth, "application,explicit,tag:2"); err != nil {
+		return "", fmt.Errorf("parse authenticator: %v", err)
+	}
+	client := encPart.CName.String() + "@" + encPart.CRealm
+	if auth.CName.String()+"@"+auth.CRealm != client {
+		return "", errors.New("authenticator doesn't match ticket")
+	}
+	if skew := now.Sub(auth.CTime); skew > v.maxClockSkew || -skew > v.maxClockSkew {
+		return "", errors.New("authenticator is outside the allowed clock skew")
+	}
+	if auth.CUSec < 0 || auth.CUSec > 999999 {
+		return "", errors.New("authenticator has an invalid timestamp")
+	}
+	seen := replayKey{client: client, ctime: auth.CTime.Unix(), cusec: auth.CUSec}
+	if !v.replays.add(seen, auth.CTime.Add(v.maxClockSkew), now) {
+		return "", errors.New("authenticator has already been used")
+	}
+	return client, nil
+}
+
+// Healthy checks that the keytab can be loaded and holds at least one key.
+func (v *keytabValidator) Healthy() error {
+	entries, err := loadKeytab(v.keytabFile)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if v.servicePrincipal == "" || strings.EqualFold(e.Principal, v.servicePrincipal) {
+			return nil
+		}
+	}
+	if v.servicePrincipal != "" {
+		return fmt.Errorf("keytab has no keys for %q", v.servicePrincipal)
+	}
+	return errors.New("keytab is empty")
+}
@@ -136,6 +136,10 @@ type Config struct {
 		// The attribute of the group that represents its name.
 		NameAttr string `json:"nameAttr"`
 	} `json:"groupSearch"`
+
+	// Scopes granted to members of a group, keyed by the group's name. Groups
+	// are searched for on every login if set.
+	GroupScopes map[string][]string `json:"groupScopes"`
 }
 
 func scopeString(i int) string {
@@ -264,6 +268,8 @@ type ldapConnector struct {
 var (
 	_ connector.PasswordConnector = (*ldapConnector)(nil)
 	_ connector.RefreshConnector  = (*ldapConnector)(nil)
+	_ connector.HealthChecker     = (*ldapConnector)(nil)
+	_ connector.ScopeGranter      = (*ldapConnector)(nil)
 )
 
 // do initializes a connection to the LDAP directory and passes it to the
@@ -455,7 +461,7 @@ func (c *ldapConnector) Login(ctx context.Context, s connector.Scopes, username,
 		return connector.Identity{}, false, err
 	}
 
-	if s.Groups {
+	if s.Groups || len(c.GroupScopes) > 0 {
 		groups, err := c.groups(ctx, user)
 		if err != nil {
 			return connector.Identity{}, false, fmt.Errorf("ldap: failed to query groups: %v", err)
@@ -519,6 +525,14 @@ func (c *ldapConnector) Refresh(ctx context.Context, s connector.Scopes, ident c
 	return newIdent, nil
 }
 
+func (c *ldapConnector) GrantScopes(ident connector.Identity, requested []string) []string {
+	var scopes []string
+	for _, group := range ident.Groups {
+		scopes = append(scopes, c.GroupScopes[group]...)
+	}
+	return scopes
+}
+
 func (c *ldapConnector) groups(ctx context.Context, user ldap.Entry) ([]string, error) {
 	if c.GroupSearch.BaseDN == "" {
 		c.logger.Debugf("No groups returned for %q because no groups baseDN has been configured.", getAttr(user, c.UserSearch.NameAttr))
@@ -576,6 +590,45 @@ func (c *ldapConnector) groups(ctx context.Context, user ldap.Entry) ([]string,
 	return groupNames, nil
 }
 
+// Healthy connects to the directory and performs the initial bind.
+func (c *ldapConnector) Healthy(ctx context.Context) error {
+	return c.do(ctx, func(conn *ldap.Conn) error { return nil })
+}
+
+// ListUserIDs returns the ID attribute of every entry matching the user search.
+func (c *ldapConnector) ListUserIDs(ctx context.Context) ([]string, error) {
+	filter := fmt.Sprintf("(%s=*)", c.UserSearch.Username)
+	if c.UserSearch.Filter != "" {
+		filter = fmt.Sprintf("(&%s%s)", c.UserSearch.Filter, filter)
+	}
+	req := &ldap.SearchRequest{
+		BaseDN:     c.UserSearch.BaseDN,
+		Filter:     filter,
+		Scope:      c.userSearchScope,
+		Attributes: []string{c.UserSearch.IDAttr},
+	}
+
+	var ids []string
+	err := c.do(ctx, func(conn *ldap.Conn) error {
+		c.logger.Infof("performing ldap search %s %s %s",
+			req.BaseDN, scopeString(req.Scope), req.Filter)
+		resp, err := conn.SearchWithPaging(req, 500)
+		if err != nil {
+			return fmt.Errorf("ldap: search with filter %q failed: %v", req.Filter, err)
+		}
+		for _, entry := range resp.Entries {
+			if id := getAttr(*entry, c.UserSearch.IDAttr); id != "" {
+				ids = append(ids, id)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
 func (c *ldapConnector) Prompt() string {
 	return c.UsernamePrompt
 }
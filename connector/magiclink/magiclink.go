@@ -0,0 +1,245 @@
+// Package magiclink implements a connector which logs users in with a link
+// emailed to them.
+package magiclink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dexidp/dex/connector"
+	"github.com/dexidp/dex/pkg/log"
+)
+
+// Config holds the configuration parameters for the magic link connector.
+// Anyone who can receive email at an address can log in as its owner, so the
+// connector is usually combined with allowedEmailDomains.
+//
+// An example config:
+//
+//	type: magiclink
+//	id: email
+//	name: Email
+//	config:
+//	  smtp:
+//	    host: smtp.example.com:587
+//	    username: dex
+//	    password: $SMTP_PASSWORD
+//	  from: "Example Login <login@example.com>"
+//	  linkValidFor: 10m
+//	  rateLimit:
+//	    links: 3
+//	    period: 15m
+type Config struct {
+	SMTP SMTP `json:"smtp"`
+
+	// Sender of the emails.
+	From string `json:"from"`
+
+	// Subject of the emails. Defaults to "Your login link".
+	Subject string `json:"subject"`
+
+	// How long links can be followed for. Defaults to 10 minutes, and can't
+	// exceed an hour.
+	LinkValidFor string `json:"linkValidFor"`
+
+	RateLimit RateLimit `json:"rateLimit"`
+}
+
+// SMTP is the server the emails are sent through.
+type SMTP struct {
+	// Host and port of the server. STARTTLS is used if the server supports it.
+	Host string `json:"host"`
+
+	// Credentials for PLAIN authentication, if the server requires it. They're
+	// only sent over TLS, or to localhost.
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// RateLimit limits the number of links sent to an address.
+type RateLimit struct {
+	// Defaults to 3.
+	Links int `json:"links"`
+
+	// Defaults to 15 minutes.
+	Period string `json:"period"`
+}
+
+const maxLinkValidFor = time.Hour
+
+// Open returns a connector which emails users a login link.
+func (c *Config) Open(id string, logger log.Logger) (connector.Connector, error) {
+	if c.SMTP.Host == "" {
+		return nil, errors.New("magiclink: no smtp.host specified")
+	}
+	if _, _, err := net.SplitHostPort(c.SMTP.Host); err != nil {
+		return nil, fmt.Errorf("magiclink: smtp.host %q must include a port", c.SMTP.Host)
+	}
+	from, err := mail.ParseAddress(c.From)
+	if err != nil {
+		return nil, fmt.Errorf("magiclink: invalid from address %q: %v", c.From, err)
+	}
+
+	linkValidFor, err := parseDuration(c.LinkValidFor, 10*time.Minute)
+	if err != nil {
+		return nil, fmt.Errorf("magiclink: invalid linkValidFor: %v", err)
+	}
+	if linkValidFor > maxLinkValidFor {
+		return nil, fmt.Errorf("magiclink: linkValidFor can't exceed %s", maxLinkValidFor)
+	}
+	period, err := parseDuration(c.RateLimit.Period, 15*time.Minute)
+	if err != nil {
+		return nil, fmt.Errorf("magiclink: invalid rateLimit.period: %v", err)
+	}
+	links := c.RateLimit.Links
+	if links == 0 {
+		links = 3
+	}
+	if links < 0 {
+		return nil, errors.New("magiclink: rateLimit.links can't be negative")
+	}
+
+	subject := c.Subject
+	if subject == "" {
+		subject = "Your login link"
+	}
+	conn := &magicLinkConnector{
+		from:         from,
+		subject:      subject,
+		linkValidFor: linkValidFor,
+		links:        links,
+		period:       period,
+		sent:         make(map[string][]time.Time),
+		now:          time.Now,
+		logger:       logger,
+	}
+	var auth smtp.Auth
+	if c.SMTP.Username != "" {
+		host, _, _ := net.SplitHostPort(c.SMTP.Host)
+		auth = smtp.PlainAuth("", c.SMTP.Username, c.SMTP.Password, host)
+	}
+	conn.send = func(to string, msg []byte) error {
+		return smtp.SendMail(c.SMTP.Host, auth, from.Address, []string{to}, msg)
+	}
+	return conn, nil
+}
+
+func parseDuration(s string, defaultValue time.Duration) (time.Duration, error) {
+	if s == "" {
+		return defaultValue, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("%q must be positive", s)
+	}
+	return d, nil
+}
+
+var _ connector.MagicLinkConnector = (*magicLinkConnector)(nil)
+
+type magicLinkConnector struct {
+	from         *mail.Address
+	subject      string
+	linkValidFor time.Duration
+
+	// At most links are sent to an address per period.
+	links  int
+	period time.Duration
+
+	mu sync.Mutex
+	// When links were sent to each address within the last period, guarded
+	// by the mutex. They're only kept in memory, so each dex instance
+	// enforces the limit separately.
+	sent map[string][]time.Time
+
+	send   func(to string, msg []byte) error
+	now    func() time.Time
+	logger log.Logger
+}
+
+// allowSend records a link being sent to an address, unless too many already
+// were within the period.
+func (c *magicLinkConnector) allowSend(email string) bool {
+	now := c.now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for addr, times := range c.sent {
+		recent := times[:0]
+		for _, t := range times {
+			if now.Sub(t) < c.period {
+				recent = append(recent, t)
+			}
+		}
+		if len(recent) == 0 {
+			delete(c.sent, addr)
+		} else {
+			c.sent[addr] = recent
+		}
+	}
+	if len(c.sent[email]) >= c.links {
+		return false
+	}
+	c.sent[email] = append(c.sent[email], now)
+	return true
+}
+
+// SendLink emails a login link to an address.
+func (c *magicLinkConnector) SendLink(ctx context.Context, email, link string) error {
+	addr, err := mail.ParseAddress(email)
+	if err != nil {
+		return fmt.Errorf("magiclink: invalid email %q: %v", email, err)
+	}
+	email = strings.ToLower(addr.Address)
+	if !c.allowSend(email) {
+		c.logger.Infof("magiclink: too many links sent to %q", email)
+		return connector.ErrRateLimited
+	}
+
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", c.from.String())
+	fmt.Fprintf(&msg, "To: %s\r\n", email)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", c.subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", c.now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("\r\n")
+	fmt.Fprintf(&msg, "Follow this link to log in:\r\n\r\n%s\r\n\r\n", link)
+	fmt.Fprintf(&msg, "The link can be used once, within %s. If you didn't try to log in, you can ignore this email.\r\n", c.linkValidFor)
+
+	if err := c.send(email, []byte(msg.String())); err != nil {
+		return fmt.Errorf("magiclink: send email: %v", err)
+	}
+	return nil
+}
+
+func (c *magicLinkConnector) LinkValidFor() time.Duration {
+	return c.linkValidFor
+}
+
+// Identity returns the identity of the owner of an email, which is verified
+// since they received the link. Addresses are case insensitive in practice,
+// so the lowercased address is the user ID.
+func (c *magicLinkConnector) Identity(email string) (connector.Identity, error) {
+	addr, err := mail.ParseAddress(email)
+	if err != nil {
+		return connector.Identity{}, fmt.Errorf("magiclink: invalid email %q: %v", email, err)
+	}
+	email = strings.ToLower(addr.Address)
+	return connector.Identity{
+		UserID:        email,
+		Username:      email,
+		Email:         email,
+		EmailVerified: true,
+	}, nil
+}
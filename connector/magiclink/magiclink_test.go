@@ -0,0 +1,125 @@
+package magiclink
+
+import (
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/dexidp/dex/connector"
+)
+
+type sentMessage struct {
+	to  string
+	msg string
+}
+
+func openTestConnector(t *testing.T, c Config) (*magicLinkConnector, *[]sentMessage) {
+	logger := &logrus.Logger{Out: ioutil.Discard, Formatter: &logrus.TextFormatter{}}
+	conn, err := c.Open("email", logger)
+	if err != nil {
+		t.Fatalf("open connector: %v", err)
+	}
+	mc := conn.(*magicLinkConnector)
+	var sent []sentMessage
+	mc.send = func(to string, msg []byte) error {
+		sent = append(sent, sentMessage{to, string(msg)})
+		return nil
+	}
+	return mc, &sent
+}
+
+func TestOpen(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr bool
+	}{
+		{"valid", Config{SMTP: SMTP{Host: "smtp.example.com:587"}, From: "login@example.com"}, false},
+		{"no host", Config{From: "login@example.com"}, true},
+		{"no port", Config{SMTP: SMTP{Host: "smtp.example.com"}, From: "login@example.com"}, true},
+		{"invalid from", Config{SMTP: SMTP{Host: "smtp.example.com:587"}, From: "login"}, true},
+		{"long links", Config{SMTP: SMTP{Host: "smtp.example.com:587"}, From: "login@example.com", LinkValidFor: "2h"}, true},
+		{"negative links", Config{SMTP: SMTP{Host: "smtp.example.com:587"}, From: "login@example.com", RateLimit: RateLimit{Links: -1}}, true},
+	}
+	logger := &logrus.Logger{Out: ioutil.Discard, Formatter: &logrus.TextFormatter{}}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := tc.config.Open("email", logger)
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Errorf("wanted error %t, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestSendLink(t *testing.T) {
+	conn, sent := openTestConnector(t, Config{
+		SMTP:         SMTP{Host: "smtp.example.com:587"},
+		From:         "Example Login <login@example.com>",
+		LinkValidFor: "5m",
+	})
+	link := "https://dex.example.com/magiclink?token=abc"
+	if err := conn.SendLink(context.Background(), "Jane@Example.com", link); err != nil {
+		t.Fatalf("send link: %v", err)
+	}
+	if len(*sent) != 1 {
+		t.Fatalf("expected 1 email, got %d", len(*sent))
+	}
+	m := (*sent)[0]
+	if m.to != "jane@example.com" {
+		t.Errorf("expected email to jane@example.com, got %q", m.to)
+	}
+	for _, want := range []string{"From: \"Example Login\" <login@example.com>\r\n", "Subject: Your login link\r\n", link, "within 5m0s"} {
+		if !strings.Contains(m.msg, want) {
+			t.Errorf("expected email to contain %q, got:\n%s", want, m.msg)
+		}
+	}
+}
+
+func TestSendLinkRateLimit(t *testing.T) {
+	conn, sent := openTestConnector(t, Config{
+		SMTP:      SMTP{Host: "smtp.example.com:587"},
+		From:      "login@example.com",
+		RateLimit: RateLimit{Links: 2, Period: "10m"},
+	})
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	conn.now = func() time.Time { return now }
+
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if err := conn.SendLink(ctx, "jane@example.com", "link"); err != nil {
+			t.Fatalf("send link %d: %v", i, err)
+		}
+	}
+	// Addresses are limited regardless of case.
+	if err := conn.SendLink(ctx, "JANE@example.com", "link"); err != connector.ErrRateLimited {
+		t.Fatalf("expected rate limit error, got %v", err)
+	}
+	if err := conn.SendLink(ctx, "joe@example.com", "link"); err != nil {
+		t.Fatalf("other addresses shouldn't be limited: %v", err)
+	}
+
+	now = now.Add(10 * time.Minute)
+	if err := conn.SendLink(ctx, "jane@example.com", "link"); err != nil {
+		t.Fatalf("expected links to be sent once the period passed: %v", err)
+	}
+	if len(*sent) != 4 {
+		t.Errorf("expected 4 emails, got %d", len(*sent))
+	}
+}
+
+func TestIdentity(t *testing.T) {
+	conn, _ := openTestConnector(t, Config{SMTP: SMTP{Host: "smtp.example.com:587"}, From: "login@example.com"})
+	identity, err := conn.Identity("Jane@Example.com")
+	if err != nil {
+		t.Fatalf("identity: %v", err)
+	}
+	want := connector.Identity{UserID: "jane@example.com", Username: "jane@example.com", Email: "jane@example.com", EmailVerified: true}
+	if identity.UserID != want.UserID || identity.Username != want.Username || identity.Email != want.Email || !identity.EmailVerified {
+		t.Errorf("expected identity %+v, got %+v", want, identity)
+	}
+}
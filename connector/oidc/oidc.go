@@ -36,6 +36,10 @@ type Config struct {
 	// Optional list of whitelisted domains when using Google
 	// If this field is nonempty, only users from a listed domain will be allowed to log in
 	HostedDomains []string `json:"hostedDomains"`
+
+	// HTTPClient, if set, makes the requests to the provider when opening
+	// the connector, such as fetching its discovery document and keys.
+	HTTPClient *http.Client `json:"-"`
 }
 
 // Domains that don't support basic auth. golang.org/x/oauth2 has an internal
@@ -77,6 +81,9 @@ func registerBrokenAuthHeaderProvider(url string) {
 // OpenID Connect provider.
 func (c *Config) Open(id string, logger log.Logger) (conn connector.Connector, err error) {
 	ctx, cancel := context.WithCancel(context.Background())
+	if c.HTTPClient != nil {
+		ctx = oidc.ClientContext(ctx, c.HTTPClient)
+	}
 
 	provider, err := oidc.NewProvider(ctx, c.Issuer)
 	if err != nil {
@@ -190,6 +197,7 @@ func (c *oidcConnector) HandleCallback(s connector.Scopes, r *http.Request) (ide
 		Email         string `json:"email"`
 		EmailVerified bool   `json:"email_verified"`
 		HostedDomain  string `json:"hd"`
+		Picture       string `json:"picture"`
 	}
 	if err := idToken.Claims(&claims); err != nil {
 		return identity, fmt.Errorf("oidc: failed to decode claims: %v", err)
@@ -214,6 +222,7 @@ func (c *oidcConnector) HandleCallback(s connector.Scopes, r *http.Request) (ide
 		Username:      claims.Username,
 		Email:         claims.Email,
 		EmailVerified: claims.EmailVerified,
+		Picture:       claims.Picture,
 	}
 	return identity, nil
 }
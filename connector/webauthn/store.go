@@ -0,0 +1,83 @@
+package webauthn
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/dexidp/dex/storage"
+)
+
+// store keeps the registered credentials and outstanding challenges of a
+// connector in dex's storage, so they're shared by all dex instances.
+type store struct {
+	s      storage.Storage
+	connID string
+}
+
+// key returns the storage ID of a credential or challenge of the connector.
+func (st *store) key(kind string, id []byte) string {
+	h := sha256.New()
+	h.Write([]byte(kind + "\x00" + st.connID + "\x00"))
+	h.Write(id)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (st *store) getCredential(id []byte) (storage.WebAuthnCredential, error) {
+	return st.s.GetWebAuthnCredential(st.key("credential", id))
+}
+
+// listCredentials returns the credentials of a user.
+func (st *store) listCredentials(userID string) ([]storage.WebAuthnCredential, error) {
+	creds, err := st.s.ListWebAuthnCredentials()
+	if err != nil {
+		return nil, err
+	}
+	var userCreds []storage.WebAuthnCredential
+	for _, c := range creds {
+		if c.ConnectorID == st.connID && c.UserID == userID {
+			userCreds = append(userCreds, c)
+		}
+	}
+	return userCreds, nil
+}
+
+func (st *store) addCredential(c storage.WebAuthnCredential) error {
+	c.ID = st.key("credential", c.CredentialID)
+	c.ConnectorID = st.connID
+	return st.s.CreateWebAuthnCredential(c)
+}
+
+// updateCredential changes a credential atomically, so concurrent logins
+// can't both pass the signature counter check.
+func (st *store) updateCredential(id []byte, updater func(c storage.WebAuthnCredential) (storage.WebAuthnCredential, error)) error {
+	return st.s.UpdateWebAuthnCredential(st.key("credential", id), updater)
+}
+
+// putChallenge stores the challenge of a ceremony, replacing any previous one.
+func (st *store) putChallenge(key string, value []byte, userID string, expiry time.Time) error {
+	id := st.key("challenge", []byte(key))
+	if err := st.s.DeleteWebAuthnChallenge(id); err != nil && err != storage.ErrNotFound {
+		return err
+	}
+	return st.s.CreateWebAuthnChallenge(storage.WebAuthnChallenge{
+		ID:     id,
+		Value:  value,
+		UserID: userID,
+		Expiry: expiry,
+	})
+}
+
+// takeChallenge returns the challenge of a ceremony and deletes it. Deletes
+// are atomic, so only one instance can take a challenge.
+func (st *store) takeChallenge(key string) (storage.WebAuthnChallenge, error) {
+	id := st.key("challenge", []byte(key))
+	ch, err := st.s.GetWebAuthnChallenge(id)
+	if err != nil {
+		return ch, err
+	}
+	if err := st.s.DeleteWebAuthnChallenge(id); err != nil {
+		return ch, err
+	}
+	return ch, nil
+}
@@ -0,0 +1,563 @@
+// Package webauthn implements a connector which logs users in with a security
+// key or passkey, using the Web Authentication API.
+package webauthn
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/dexidp/dex/connector"
+	"github.com/dexidp/dex/pkg/log"
+	"github.com/dexidp/dex/storage"
+)
+
+// Config holds the configuration parameters for the WebAuthn connector.
+//
+// An example config:
+//
+//	type: webauthn
+//	id: passkey
+//	name: Passkey
+//	config:
+//	  rpID: dex.example.com
+//	  origin: https://dex.example.com
+//	  users:
+//	  - userID: 08a8684b-db88-4b73-90a9-3cd1661f5466
+//	    username: jane
+//	    email: jane@example.com
+//	    # bcrypt hash of the string "password"
+//	    enrollmentCodeHash: "$2a$10$2b2cU8CPhOTaGrs1HRQuAueS7JTT5ZHsHSzYiFPm1leZck7Mc8T4W"
+type Config struct {
+	// The relying party ID credentials are scoped to: the domain dex is served
+	// from, or a parent domain of it.
+	RPID string `json:"rpID"`
+
+	// The origin of dex's pages, such as "https://dex.example.com".
+	Origin string `json:"origin"`
+
+	// Name shown by browsers when registering a credential. Defaults to "dex".
+	RPName string `json:"rpName"`
+
+	// Users who may log in with the connector.
+	Users []User `json:"users"`
+
+	// Storage registered credentials and outstanding challenges are kept in,
+	// set by the server.
+	Storage storage.Storage `json:"-"`
+}
+
+// User is a user who may register a credential.
+type User struct {
+	UserID   string `json:"userID"`
+	Username string `json:"username"`
+	Email    string `json:"email"`
+
+	// bcrypt hash of the code the user proves who they are with to register
+	// their first credential. Further credentials can't be registered with it,
+	// so once a credential is lost an admin has to remove it.
+	EnrollmentCodeHash string `json:"enrollmentCodeHash"`
+}
+
+// challengeTimeout is how long the browser has to answer a challenge.
+const challengeTimeout = 5 * time.Minute
+
+// Open returns a connector which authenticates users with WebAuthn
+// credentials.
+func (c *Config) Open(id string, logger log.Logger) (connector.Connector, error) {
+	if c.RPID == "" {
+		return nil, errors.New("webauthn: no rpID specified")
+	}
+	u, err := url.Parse(c.Origin)
+	if err != nil || u.Scheme != "https" && u.Hostname() != "localhost" || u.Host == "" {
+		return nil, fmt.Errorf("webauthn: origin %q must be an https URL", c.Origin)
+	}
+	if u.Hostname() != c.RPID && !hasDomainSuffix(u.Hostname(), c.RPID) {
+		return nil, fmt.Errorf("webauthn: origin %q isn't within the rpID %q", c.Origin, c.RPID)
+	}
+	if c.Storage == nil {
+		return nil, errors.New("webauthn: no storage to keep credentials in")
+	}
+
+	users := make(map[string]User, len(c.Users))
+	for _, user := range c.Users {
+		if user.UserID == "" || user.Username == "" {
+			return nil, errors.New("webauthn: users must have a userID and a username")
+		}
+		if _, ok := users[user.UserID]; ok {
+			return nil, fmt.Errorf("webauthn: user ID %q configured twice", user.UserID)
+		}
+		if user.EnrollmentCodeHash != "" {
+			if _, err := bcrypt.Cost([]byte(user.EnrollmentCodeHash)); err != nil {
+				return nil, fmt.Errorf("webauthn: user %q: malformed enrollmentCodeHash: %v", user.Username, err)
+			}
+		}
+		users[user.UserID] = user
+	}
+
+	rpName := c.RPName
+	if rpName == "" {
+		rpName = "dex"
+	}
+	return &webauthnConnector{
+		rpID:   c.RPID,
+		rpName: rpName,
+		origin: c.Origin,
+		users:  users,
+		store:  &store{s: c.Storage, connID: id},
+		now:    time.Now,
+		logger: logger,
+	}, nil
+}
+
+func hasDomainSuffix(host, domain string) bool {
+	return len(host) > len(domain) && host[len(host)-len(domain)-1:] == "."+domain
+}
+
+var _ connector.WebAuthnConnector = (*webauthnConnector)(nil)
+
+type webauthnConnector struct {
+	rpID   string
+	rpName string
+	origin string
+	users  map[string]User
+	store  *store
+
+	now    func() time.Time
+	logger log.Logger
+}
+
+// newChallenge creates a challenge for a login or enrollment, replacing any
+// previous one.
+func (c *webauthnConnector) newChallenge(key, userID string) ([]byte, error) {
+	value := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, value); err != nil {
+		return nil, fmt.Errorf("webauthn: generate challenge: %v", err)
+	}
+	if err := c.store.putChallenge(key, value, userID, c.now().Add(challengeTimeout)); err != nil {
+		return nil, fmt.Errorf("webauthn: store challenge: %v", err)
+	}
+	return value, nil
+}
+
+// takeChallenge returns an outstanding challenge, which can only be answered
+// once.
+func (c *webauthnConnector) takeChallenge(key string) (storage.WebAuthnChallenge, bool, error) {
+	ch, err := c.store.takeChallenge(key)
+	if err != nil {
+		if err == storage.ErrNotFound {
+			return ch, false, nil
+		}
+		return ch, false, fmt.Errorf("webauthn: take challenge: %v", err)
+	}
+	if c.now().After(ch.Expiry) {
+		return ch, false, nil
+	}
+	return ch, true, nil
+}
+
+var b64 = base64.RawURLEncoding
+
+// LoginOptions asks for any credential registered for the relying party, so
+// the user doesn't have to enter a username first.
+func (c *webauthnConnector) LoginOptions(state string) ([]byte, error) {
+	value, err := c.newChallenge("login:"+state, "")
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(map[string]interface{}{
+		"challenge":        b64.EncodeToString(value),
+		"rpId":             c.rpID,
+		"timeout":          int64(challengeTimeout / time.Millisecond),
+		"userVerification": "preferred",
+	})
+}
+
+// Login verifies the assertion in the "credentialID", "clientDataJSON",
+// "authenticatorData" and "signature" form values, which are base64url
+// encoded.
+func (c *webauthnConnector) Login(ctx context.Context, s connector.Scopes, state string, r *http.Request) (connector.Identity, bool, error) {
+	ch, ok, err := c.takeChallenge("login:" + state)
+	if err != nil {
+		return connector.Identity{}, false, err
+	}
+	if !ok {
+		c.logger.Infof("webauthn: no outstanding login challenge")
+		return connector.Identity{}, false, nil
+	}
+	var fields [4][]byte
+	for i, name := range []string{"credentialID", "clientDataJSON", "authenticatorData", "signature"} {
+		var err error
+		if fields[i], err = b64.DecodeString(r.PostFormValue(name)); err != nil || len(fields[i]) == 0 {
+			c.logger.Infof("webauthn: malformed %s", name)
+			return connector.Identity{}, false, nil
+		}
+	}
+	credID, clientDataJSON, rawAuthData, signature := fields[0], fields[1], fields[2], fields[3]
+
+	cred, err := c.store.getCredential(credID)
+	if err != nil {
+		if err == storage.ErrNotFound {
+			c.logger.Infof("webauthn: unknown credential %s", b64.EncodeToString(credID))
+			return connector.Identity{}, false, nil
+		}
+		return connector.Identity{}, false, fmt.Errorf("webauthn: %v", err)
+	}
+	if err := c.verifyClientData(clientDataJSON, "webauthn.get", ch.Value); err != nil {
+		c.logger.Infof("webauthn: %v", err)
+		return connector.Identity{}, false, nil
+	}
+	authData, err := c.parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		c.logger.Infof("webauthn: %v", err)
+		return connector.Identity{}, false, nil
+	}
+	if err := verifySignature(cred.PublicKey, rawAuthData, clientDataJSON, signature); err != nil {
+		c.logger.Infof("webauthn: credential %s: %v", b64.EncodeToString(credID), err)
+		return connector.Identity{}, false, nil
+	}
+
+	err = c.store.updateCredential(credID, func(old storage.WebAuthnCredential) (storage.WebAuthnCredential, error) {
+		// Authenticators which don't count signatures always report zero.
+		if (old.SignCount != 0 || authData.signCount != 0) && authData.signCount <= old.SignCount {
+			return old, errCloned
+		}
+		old.SignCount = authData.signCount
+		return old, nil
+	})
+	if err == errCloned {
+		c.logger.Errorf("webauthn: credential %s of user %q reported signature count %d after %d, it may have been cloned",
+			b64.EncodeToString(credID), cred.UserID, authData.signCount, cred.SignCount)
+		return connector.Identity{}, false, nil
+	}
+	if err != nil {
+		return connector.Identity{}, false, fmt.Errorf("webauthn: %v", err)
+	}
+
+	user, ok := c.users[cred.UserID]
+	if !ok {
+		c.logger.Infof("webauthn: credential %s belongs to unknown user %q", b64.EncodeToString(credID), cred.UserID)
+		return connector.Identity{}, false, nil
+	}
+	return connector.Identity{
+		UserID:        user.UserID,
+		Username:      user.Username,
+		Email:         user.Email,
+		EmailVerified: user.Email != "",
+	}, true, nil
+}
+
+// dummyHash is compared against when a user can't enroll.
+const dummyHash = "$2a$10$2b2cU8CPhOTaGrs1HRQuAueS7JTT5ZHsHSzYiFPm1leZck7Mc8T4W"
+
+var errCloned = errors.New("signature counter didn't increase")
+
+// COSE algorithm identifiers of the supported credential types.
+//
+// https://www.iana.org/assignments/cose/cose.xhtml#algorithms
+const (
+	coseES256 = -7
+	coseRS256 = -257
+)
+
+// EnrollOptions checks the user's enrollment code and asks for a new
+// discoverable credential, which the user can later log in with without
+// entering their username.
+func (c *webauthnConnector) EnrollOptions(state, username, code string) ([]byte, error) {
+	var user User
+	for _, u := range c.users {
+		if u.Username == username {
+			user = u
+			break
+		}
+	}
+	// Compare against a hash either way, so response times don't reveal
+	// which users exist.
+	hash := user.EnrollmentCodeHash
+	if hash == "" {
+		hash = dummyHash
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(code)); err != nil || user.EnrollmentCodeHash == "" {
+		return nil, errors.New("webauthn: invalid username or enrollment code")
+	}
+	creds, err := c.store.listCredentials(user.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("webauthn: %v", err)
+	}
+	if len(creds) > 0 {
+		return nil, fmt.Errorf("webauthn: user %q already registered a credential", user.Username)
+	}
+
+	value, err := c.newChallenge("enroll:"+state, user.UserID)
+	if err != nil {
+		return nil, err
+	}
+	type param struct {
+		Type string `json:"type"`
+		Alg  int    `json:"alg"`
+	}
+	return json.Marshal(map[string]interface{}{
+		"challenge": b64.EncodeToString(value),
+		"rp":        map[string]string{"id": c.rpID, "name": c.rpName},
+		"user": map[string]string{
+			"id":          b64.EncodeToString([]byte(user.UserID)),
+			"name":        user.Username,
+			"displayName": user.Username,
+		},
+		"pubKeyCredParams": []param{{"public-key", coseES256}, {"public-key", coseRS256}},
+		"timeout":          int64(challengeTimeout / time.Millisecond),
+		"attestation":      "none",
+		"authenticatorSelection": map[string]string{
+			"residentKey":      "required",
+			"userVerification": "preferred",
+		},
+	})
+}
+
+// Enroll registers the credential in the "clientDataJSON" and
+// "attestationObject" form values, which are base64url encoded. Attestation
+// statements aren't verified, any authenticator is accepted.
+func (c *webauthnConnector) Enroll(state string, r *http.Request) error {
+	ch, ok, err := c.takeChallenge("enroll:" + state)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("webauthn: no outstanding enrollment challenge")
+	}
+	clientDataJSON, err := b64.DecodeString(r.PostFormValue("clientDataJSON"))
+	if err != nil {
+		return errors.New("webauthn: malformed clientDataJSON")
+	}
+	attestation, err := b64.DecodeString(r.PostFormValue("attestationObject"))
+	if err != nil {
+		return errors.New("webauthn: malformed attestationObject")
+	}
+	if err := c.verifyClientData(clientDataJSON, "webauthn.create", ch.Value); err != nil {
+		return fmt.Errorf("webauthn: %v", err)
+	}
+
+	obj, _, err := decodeCBOR(attestation)
+	if err != nil {
+		return fmt.Errorf("webauthn: malformed attestationObject: %v", err)
+	}
+	m, _ := obj.(map[interface{}]interface{})
+	rawAuthData, ok := m["authData"].([]byte)
+	if !ok {
+		return errors.New("webauthn: attestationObject has no authData")
+	}
+	authData, err := c.parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return fmt.Errorf("webauthn: %v", err)
+	}
+	if authData.credentialID == nil {
+		return errors.New("webauthn: authData has no attested credential")
+	}
+	pub, err := parseCOSEKey(authData.publicKey)
+	if err != nil {
+		return fmt.Errorf("webauthn: %v", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return fmt.Errorf("webauthn: marshal public key: %v", err)
+	}
+
+	err = c.store.addCredential(storage.WebAuthnCredential{
+		CredentialID: authData.credentialID,
+		UserID:       ch.UserID,
+		PublicKey:    der,
+		SignCount:    authData.signCount,
+		CreatedAt:    c.now(),
+	})
+	if err == storage.ErrAlreadyExists {
+		return errors.New("webauthn: credential already registered")
+	}
+	if err != nil {
+		return fmt.Errorf("webauthn: %v", err)
+	}
+	c.logger.Infof("webauthn: registered credential %s for user %q", b64.EncodeToString(authData.credentialID), ch.UserID)
+	return nil
+}
+
+// verifyClientData checks the client data the browser collected for a
+// ceremony.
+//
+// https://www.w3.org/TR/webauthn-2/#dictionary-client-data
+func (c *webauthnConnector) verifyClientData(data []byte, typ string, challenge []byte) error {
+	var cd struct {
+		Type      string `json:"type"`
+		Challenge string `json:"challenge"`
+		Origin    string `json:"origin"`
+	}
+	if err := json.Unmarshal(data, &cd); err != nil {
+		return fmt.Errorf("malformed clientDataJSON: %v", err)
+	}
+	if cd.Type != typ {
+		return fmt.Errorf("expected client data of type %q, got %q", typ, cd.Type)
+	}
+	got, err := b64.DecodeString(cd.Challenge)
+	if err != nil || subtle.ConstantTimeCompare(got, challenge) != 1 {
+		return errors.New("client data doesn't answer the challenge")
+	}
+	if cd.Origin != c.origin {
+		return fmt.Errorf("client data from unexpected origin %q", cd.Origin)
+	}
+	return nil
+}
+
+// Flags of the authenticator data.
+const (
+	flagUserPresent  = 0x01
+	flagAttestedData = 0x40
+)
+
+type authenticatorData struct {
+	signCount uint32
+	// Only set when registering a credential.
+	credentialID []byte
+	publicKey    []byte // COSE encoded.
+}
+
+// parseAuthenticatorData parses authenticator data, checking it's for the
+// relying party and that the user was present.
+//
+// https://www.w3.org/TR/webauthn-2/#sctn-authenticator-data
+func (c *webauthnConnector) parseAuthenticatorData(data []byte) (authenticatorData, error) {
+	if len(data) < 37 {
+		return authenticatorData{}, errors.New("authenticator data too short")
+	}
+	rpIDHash := sha256.Sum256([]byte(c.rpID))
+	if !bytes.Equal(data[:32], rpIDHash[:]) {
+		return authenticatorData{}, errors.New("authenticator data is for another relying party")
+	}
+	flags := data[32]
+	if flags&flagUserPresent == 0 {
+		return authenticatorData{}, errors.New("user wasn't present")
+	}
+	a := authenticatorData{signCount: binary.BigEndian.Uint32(data[33:37])}
+	if flags&flagAttestedData == 0 {
+		return a, nil
+	}
+
+	// The AAGUID of the authenticator, then the length of the credential ID.
+	rest := data[37:]
+	if len(rest) < 18 {
+		return authenticatorData{}, errors.New("attested credential data too short")
+	}
+	n := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if len(rest) < n {
+		return authenticatorData{}, errors.New("attested credential data too short")
+	}
+	a.credentialID, rest = rest[:n], rest[n:]
+	_, after, err := decodeCBOR(rest)
+	if err != nil {
+		return authenticatorData{}, fmt.Errorf("malformed credential public key: %v", err)
+	}
+	a.publicKey = rest[:len(rest)-len(after)]
+	return a, nil
+}
+
+// parseCOSEKey parses a P-256 ECDSA or an RSA public key.
+//
+// https://tools.ietf.org/html/rfc8152#section-13
+func parseCOSEKey(data []byte) (crypto.PublicKey, error) {
+	v, _, err := decodeCBOR(data)
+	if err != nil {
+		return nil, fmt.Errorf("malformed credential public key: %v", err)
+	}
+	m, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("malformed credential public key")
+	}
+	bytesParam := func(label int64) []byte {
+		b, _ := m[label].([]byte)
+		return b
+	}
+
+	alg, _ := m[int64(3)].(int64)
+	switch alg {
+	case coseES256:
+		// Key type EC2 on curve P-256.
+		if kty, _ := m[int64(1)].(int64); kty != 2 {
+			return nil, errors.New("ES256 key must have key type EC2")
+		}
+		if crv, _ := m[int64(-1)].(int64); crv != 1 {
+			return nil, errors.New("ES256 key must be on curve P-256")
+		}
+		x, y := bytesParam(-2), bytesParam(-3)
+		if len(x) != 32 || len(y) != 32 {
+			return nil, errors.New("malformed EC2 key coordinates")
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, errors.New("EC2 key isn't on its curve")
+		}
+		return pub, nil
+	case coseRS256:
+		if kty, _ := m[int64(1)].(int64); kty != 3 {
+			return nil, errors.New("RS256 key must have key type RSA")
+		}
+		n, e := bytesParam(-1), bytesParam(-2)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("RSA keys must be at least 2048 bits")
+		}
+		exp := new(big.Int).SetBytes(e)
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exp.Int64())}, nil
+	}
+	return nil, fmt.Errorf("unsupported credential algorithm %d", alg)
+}
+
+// ecdsaSignature is the ASN.1 encoding of ECDSA signatures made by
+// authenticators.
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+// verifySignature checks an assertion signature, which covers the
+// authenticator data and the hash of the client data.
+func verifySignature(publicKey, authData, clientDataJSON, signature []byte) error {
+	pub, err := x509.ParsePKIXPublicKey(publicKey)
+	if err != nil {
+		return fmt.Errorf("parse public key: %v", err)
+	}
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	digest := sha256.Sum256(append(append([]byte(nil), authData...), clientDataHash[:]...))
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		var sig ecdsaSignature
+		if rest, err := asn1.Unmarshal(signature, &sig); err != nil || len(rest) != 0 {
+			return errors.New("invalid signature")
+		}
+		if sig.R == nil || sig.S == nil || !ecdsa.Verify(pub, digest[:], sig.R, sig.S) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], signature); err != nil {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported public key type %T", pub)
+}
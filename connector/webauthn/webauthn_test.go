@@ -0,0 +1,405 @@
+package webauthn
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/dexidp/dex/connector"
+	"github.com/dexidp/dex/storage"
+	"github.com/dexidp/dex/storage/memory"
+)
+
+const (
+	testRPID   = "dex.example.com"
+	testOrigin = "https://dex.example.com"
+)
+
+var testLogger = &logrus.Logger{Out: ioutil.Discard, Formatter: &logrus.TextFormatter{}}
+
+func newTestConnector(t *testing.T) *webauthnConnector {
+	return openTestConnector(t, memory.New(testLogger))
+}
+
+// openTestConnector opens a connector keeping its state in s, like one of
+// several dex instances sharing a storage.
+func openTestConnector(t *testing.T, s storage.Storage) *webauthnConnector {
+	hash, err := bcrypt.GenerateFromPassword([]byte("enroll-me"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Config{
+		RPID:   testRPID,
+		Origin: testOrigin,
+		Users: []User{{
+			UserID:             "0-385-28089-0",
+			Username:           "jane",
+			Email:              "jane@example.com",
+			EnrollmentCodeHash: string(hash),
+		}},
+		Storage: s,
+	}
+	conn, err := c.Open("webauthn", testLogger)
+	if err != nil {
+		t.Fatalf("open connector: %v", err)
+	}
+	return conn.(*webauthnConnector)
+}
+
+// authenticator stubs a security key holding a single ES256 credential.
+type authenticator struct {
+	key       *ecdsa.PrivateKey
+	id        []byte
+	signCount uint32
+
+	// Overrides of what the browser and authenticator report, for tests of
+	// invalid responses.
+	rpID   string
+	origin string
+}
+
+func newAuthenticator(t *testing.T) *authenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &authenticator{key: key, id: []byte("credential-1"), rpID: testRPID, origin: testOrigin}
+}
+
+func (a *authenticator) clientData(t *testing.T, typ string, options []byte) []byte {
+	var opts struct {
+		Challenge string `json:"challenge"`
+	}
+	if err := json.Unmarshal(options, &opts); err != nil {
+		t.Fatalf("unmarshal options: %v", err)
+	}
+	data, err := json.Marshal(map[string]string{"type": typ, "challenge": opts.Challenge, "origin": a.origin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func (a *authenticator) authData(flags byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+	data := append(rpIDHash[:], flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(data[33:], a.signCount)
+	return data
+}
+
+// padded returns the big-endian bytes of n, left-padded to size.
+func padded(n *big.Int, size int) []byte {
+	b := n.Bytes()
+	return append(make([]byte, size-len(b)), b...)
+}
+
+// create answers navigator.credentials.create.
+func (a *authenticator) create(t *testing.T, options []byte) url.Values {
+	authData := a.authData(flagUserPresent | flagAttestedData)
+	authData = append(authData, make([]byte, 16)...) // AAGUID
+	authData = append(authData, byte(len(a.id)>>8), byte(len(a.id)))
+	authData = append(authData, a.id...)
+	authData = append(authData, cborMap(
+		cborInt(1), cborInt(2), // kty: EC2
+		cborInt(3), cborInt(coseES256), // alg
+		cborInt(-1), cborInt(1), // crv: P-256
+		cborInt(-2), cborBytes(padded(a.key.X, 32)),
+		cborInt(-3), cborBytes(padded(a.key.Y, 32)),
+	)...)
+	attestation := cborMap(
+		cborText("fmt"), cborText("none"),
+		cborText("attStmt"), cborMap(),
+		cborText("authData"), cborBytes(authData),
+	)
+	return url.Values{
+		"clientDataJSON":    {b64.EncodeToString(a.clientData(t, "webauthn.create", options))},
+		"attestationObject": {b64.EncodeToString(attestation)},
+	}
+}
+
+// get answers navigator.credentials.get, incrementing the signature counter.
+func (a *authenticator) get(t *testing.T, options []byte) url.Values {
+	a.signCount++
+	authData := a.authData(flagUserPresent)
+	clientData := a.clientData(t, "webauthn.get", options)
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte(nil), authData...), clientDataHash[:]...))
+	r, s, err := ecdsa.Sign(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := asn1.Marshal(ecdsaSignature{r, s})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return url.Values{
+		"credentialID":      {b64.EncodeToString(a.id)},
+		"clientDataJSON":    {b64.EncodeToString(clientData)},
+		"authenticatorData": {b64.EncodeToString(authData)},
+		"signature":         {b64.EncodeToString(sig)},
+	}
+}
+
+func postForm(form url.Values) *http.Request {
+	r := httptest.NewRequest("POST", "/", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return r
+}
+
+func enroll(t *testing.T, c *webauthnConnector, a *authenticator) {
+	options, err := c.EnrollOptions("enroll-state", "jane", "enroll-me")
+	if err != nil {
+		t.Fatalf("enrollment options: %v", err)
+	}
+	if err := c.Enroll("enroll-state", postForm(a.create(t, options))); err != nil {
+		t.Fatalf("enroll: %v", err)
+	}
+}
+
+func login(t *testing.T, c *webauthnConnector, state string, form url.Values) (connector.Identity, bool) {
+	ident, valid, err := c.Login(context.Background(), connector.Scopes{}, state, postForm(form))
+	if err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	return ident, valid
+}
+
+func TestEnrollAndLogin(t *testing.T) {
+	c := newTestConnector(t)
+	a := newAuthenticator(t)
+	enroll(t, c, a)
+
+	for i := 0; i < 2; i++ {
+		options, err := c.LoginOptions("state")
+		if err != nil {
+			t.Fatalf("login options: %v", err)
+		}
+		ident, valid := login(t, c, "state", a.get(t, options))
+		if !valid {
+			t.Fatalf("login %d: expected a valid assertion", i)
+		}
+		want := connector.Identity{UserID: "0-385-28089-0", Username: "jane", Email: "jane@example.com", EmailVerified: true}
+		if !reflect.DeepEqual(ident, want) {
+			t.Errorf("expected identity %+v, got %+v", want, ident)
+		}
+	}
+
+	cred, err := c.store.getCredential(a.id)
+	if err != nil {
+		t.Fatalf("get credential: %v", err)
+	}
+	if cred.SignCount != 2 {
+		t.Errorf("expected the stored signature count to be 2, got %d", cred.SignCount)
+	}
+}
+
+func TestSharedStorage(t *testing.T) {
+	s := memory.New(testLogger)
+	c1, c2 := openTestConnector(t, s), openTestConnector(t, s)
+	a := newAuthenticator(t)
+	enroll(t, c1, a)
+
+	// A login started on one instance completes on another.
+	options, err := c1.LoginOptions("state")
+	if err != nil {
+		t.Fatalf("login options: %v", err)
+	}
+	form := a.get(t, options)
+	if _, valid := login(t, c2, "state", form); !valid {
+		t.Fatal("expected the assertion to be accepted by another instance")
+	}
+	// The challenge was taken by the instance which answered it.
+	if _, valid := login(t, c1, "state", form); valid {
+		t.Error("expected a replayed assertion to be rejected")
+	}
+}
+
+func TestEnrollmentCode(t *testing.T) {
+	c := newTestConnector(t)
+	if _, err := c.EnrollOptions("state", "jane", "wrong"); err == nil {
+		t.Errorf("expected a wrong enrollment code to be rejected")
+	}
+	if _, err := c.EnrollOptions("state", "john", "enroll-me"); err == nil {
+		t.Errorf("expected an unknown user to be rejected")
+	}
+
+	enroll(t, c, newAuthenticator(t))
+	if _, err := c.EnrollOptions("state", "jane", "enroll-me"); err == nil {
+		t.Errorf("expected the enrollment code to only register the first credential")
+	}
+}
+
+func TestEnrollRejected(t *testing.T) {
+	c := newTestConnector(t)
+	a := newAuthenticator(t)
+	a.origin = "https://evil.example.com"
+	options, err := c.EnrollOptions("state", "jane", "enroll-me")
+	if err != nil {
+		t.Fatalf("enrollment options: %v", err)
+	}
+	if err := c.Enroll("state", postForm(a.create(t, options))); err == nil {
+		t.Errorf("expected a credential created for another origin to be rejected")
+	}
+}
+
+func TestLoginRejected(t *testing.T) {
+	tests := []struct {
+		name string
+		// answer returns a response to the options of a login with the
+		// state "state", and the state it's POSTed with.
+		answer func(t *testing.T, c *webauthnConnector, a *authenticator, options []byte) (url.Values, string)
+	}{
+		{
+			name: "wrong origin",
+			answer: func(t *testing.T, c *webauthnConnector, a *authenticator, options []byte) (url.Values, string) {
+				a.origin = "https://evil.example.com"
+				return a.get(t, options), "state"
+			},
+		},
+		{
+			name: "wrong relying party",
+			answer: func(t *testing.T, c *webauthnConnector, a *authenticator, options []byte) (url.Values, string) {
+				a.rpID = "evil.example.com"
+				return a.get(t, options), "state"
+			},
+		},
+		{
+			name: "challenge of another login",
+			answer: func(t *testing.T, c *webauthnConnector, a *authenticator, options []byte) (url.Values, string) {
+				if _, err := c.LoginOptions("other-state"); err != nil {
+					t.Fatal(err)
+				}
+				return a.get(t, options), "other-state"
+			},
+		},
+		{
+			name: "expired challenge",
+			answer: func(t *testing.T, c *webauthnConnector, a *authenticator, options []byte) (url.Values, string) {
+				c.now = func() time.Time { return time.Now().Add(challengeTimeout + time.Minute) }
+				return a.get(t, options), "state"
+			},
+		},
+		{
+			name: "replayed assertion",
+			answer: func(t *testing.T, c *webauthnConnector, a *authenticator, options []byte) (url.Values, string) {
+				form := a.get(t, options)
+				if _, valid := login(t, c, "state", form); !valid {
+					t.Fatal("expected the first login to succeed")
+				}
+				return form, "state"
+			},
+		},
+		{
+			name: "signature counter not increased",
+			answer: func(t *testing.T, c *webauthnConnector, a *authenticator, options []byte) (url.Values, string) {
+				// Another authenticator holding a copy of the key logs in.
+				if _, valid := login(t, c, "state", a.get(t, options)); !valid {
+					t.Fatal("expected the first login to succeed")
+				}
+				options, err := c.LoginOptions("state")
+				if err != nil {
+					t.Fatal(err)
+				}
+				a.signCount--
+				return a.get(t, options), "state"
+			},
+		},
+		{
+			name: "bad signature",
+			answer: func(t *testing.T, c *webauthnConnector, a *authenticator, options []byte) (url.Values, string) {
+				form := a.get(t, options)
+				form.Set("authenticatorData", b64.EncodeToString(a.authData(flagUserPresent|0x04)))
+				return form, "state"
+			},
+		},
+		{
+			name: "unknown credential",
+			answer: func(t *testing.T, c *webauthnConnector, a *authenticator, options []byte) (url.Values, string) {
+				a.id = []byte("credential-2")
+				return a.get(t, options), "state"
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestConnector(t)
+			a := newAuthenticator(t)
+			enroll(t, c, a)
+			options, err := c.LoginOptions("state")
+			if err != nil {
+				t.Fatalf("login options: %v", err)
+			}
+			form, state := tc.answer(t, c, a, options)
+			if _, valid := login(t, c, state, form); valid {
+				t.Errorf("expected the assertion to be rejected")
+			}
+		})
+	}
+}
+
+func TestChallengesAreUnique(t *testing.T) {
+	c := newTestConnector(t)
+	seen := make(map[string]bool)
+	for i := 0; i < 10; i++ {
+		options, err := c.LoginOptions("state")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var opts struct {
+			Challenge string `json:"challenge"`
+		}
+		if err := json.Unmarshal(options, &opts); err != nil {
+			t.Fatal(err)
+		}
+		if seen[opts.Challenge] {
+			t.Fatalf("challenge %q issued twice", opts.Challenge)
+		}
+		seen[opts.Challenge] = true
+	}
+}
+
+func cborHead(major byte, n int) []byte {
+	switch {
+	case n < 24:
+		return []byte{major<<5 | byte(n)}
+	case n < 1<<8:
+		return []byte{major<<5 | 24, byte(n)}
+	}
+	return []byte{major<<5 | 25, byte(n >> 8), byte(n)}
+}
+
+func cborInt(i int) []byte {
+	if i >= 0 {
+		return cborHead(0, i)
+	}
+	return cborHead(1, -1-i)
+}
+
+func cborBytes(b []byte) []byte { return append(cborHead(2, len(b)), b...) }
+
+func cborText(s string) []byte { return append(cborHead(3, len(s)), s...) }
+
+func cborMap(items ...[]byte) []byte {
+	m := cborHead(5, len(items)/2)
+	for _, item := range items {
+		m = append(m, item...)
+	}
+	return m
+}
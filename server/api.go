@@ -3,6 +3,7 @@ package server
 import (
 	"errors"
 	"fmt"
+	"net/url"
 
 	"golang.org/x/crypto/bcrypt"
 
@@ -34,15 +35,44 @@ const (
 
 // NewAPI returns a server which implements the gRPC API interface.
 func NewAPI(s storage.Storage, logger log.Logger) api.DexServer {
+	return NewAPIWithOptions(s, logger, APIOptions{})
+}
+
+// APIOptions holds the optional settings of the gRPC API.
+type APIOptions struct {
+	// Creates the secrets of new clients. Defaults to random secrets.
+	Secrets SecretGenerator
+
+	// Secrets passed by callers must meet the policy.
+	SecretPolicy SecretPolicy
+
+	// If set, redirect URIs of clients must use https, except loopback ones
+	// used by native apps.
+	RequireHTTPSRedirectURIs bool
+}
+
+// NewAPIWithOptions returns a server which implements the gRPC API interface,
+// configured by opts.
+func NewAPIWithOptions(s storage.Storage, logger log.Logger, opts APIOptions) api.DexServer {
+	secrets := opts.Secrets
+	if secrets == nil {
+		secrets = NewSecretGenerator(defaultSecretBytes)
+	}
 	return dexAPI{
-		s:      s,
-		logger: logger,
+		s:            s,
+		logger:       logger,
+		secrets:      secrets,
+		policy:       opts.SecretPolicy,
+		requireHTTPS: opts.RequireHTTPSRedirectURIs,
 	}
 }
 
 type dexAPI struct {
-	s      storage.Storage
-	logger log.Logger
+	s            storage.Storage
+	logger       log.Logger
+	secrets      SecretGenerator
+	policy       SecretPolicy
+	requireHTTPS bool
 }
 
 func (d dexAPI) CreateClient(ctx context.Context, req *api.CreateClientReq) (*api.CreateClientResp, error) {
@@ -50,11 +80,22 @@ func (d dexAPI) CreateClient(ctx context.Context, req *api.CreateClientReq) (*ap
 		return nil, errors.New("no client supplied")
 	}
 
+	if err := validateClientURLs(req.Client.LogoUrl, req.Client.ClientUrl, req.Client.PolicyUrl, req.Client.TosUrl); err != nil {
+		return nil, fmt.Errorf("create client: %v", err)
+	}
+	if d.requireHTTPS {
+		if err := ValidateHTTPSRedirectURIs(req.Client.RedirectUris); err != nil {
+			return nil, fmt.Errorf("create client: %v", err)
+		}
+	}
+
 	if req.Client.Id == "" {
 		req.Client.Id = storage.NewID()
 	}
 	if req.Client.Secret == "" {
-		req.Client.Secret = storage.NewID() + storage.NewID()
+		req.Client.Secret = d.secrets.Secret()
+	} else if err := d.policy.Check(req.Client.Secret); err != nil {
+		return nil, fmt.Errorf("create client: %v", err)
 	}
 
 	c := storage.Client{
@@ -65,6 +106,9 @@ func (d dexAPI) CreateClient(ctx context.Context, req *api.CreateClientReq) (*ap
 		Public:       req.Client.Public,
 		Name:         req.Client.Name,
 		LogoURL:      req.Client.LogoUrl,
+		ClientURL:    req.Client.ClientUrl,
+		PolicyURL:    req.Client.PolicyUrl,
+		TOSURL:       req.Client.TosUrl,
 	}
 	if err := d.s.CreateClient(c); err != nil {
 		if err == storage.ErrAlreadyExists {
@@ -83,6 +127,14 @@ func (d dexAPI) UpdateClient(ctx context.Context, req *api.UpdateClientReq) (*ap
 	if req.Id == "" {
 		return nil, errors.New("update client: no client ID supplied")
 	}
+	if err := validateClientURLs(req.LogoUrl, req.ClientUrl, req.PolicyUrl, req.TosUrl); err != nil {
+		return nil, fmt.Errorf("update client: %v", err)
+	}
+	if d.requireHTTPS {
+		if err := ValidateHTTPSRedirectURIs(req.RedirectUris); err != nil {
+			return nil, fmt.Errorf("update client: %v", err)
+		}
+	}
 
 	err := d.s.UpdateClient(req.Id, func(old storage.Client) (storage.Client, error) {
 		if req.RedirectUris != nil {
@@ -97,6 +149,15 @@ func (d dexAPI) UpdateClient(ctx context.Context, req *api.UpdateClientReq) (*ap
 		if req.LogoUrl != "" {
 			old.LogoURL = req.LogoUrl
 		}
+		if req.ClientUrl != "" {
+			old.ClientURL = req.ClientUrl
+		}
+		if req.PolicyUrl != "" {
+			old.PolicyURL = req.PolicyUrl
+		}
+		if req.TosUrl != "" {
+			old.TOSURL = req.TosUrl
+		}
 		return old, nil
 	})
 
@@ -122,6 +183,26 @@ func (d dexAPI) DeleteClient(ctx context.Context, req *api.DeleteClientReq) (*ap
 	return &api.DeleteClientResp{}, nil
 }
 
+// validateClientURLs checks that the logo, home page, policy and terms of
+// service links of a client, which are shown to end users, are https URLs.
+func validateClientURLs(logoURL, clientURL, policyURL, tosURL string) error {
+	for _, u := range []struct{ name, value string }{
+		{"logo_url", logoURL},
+		{"client_url", clientURL},
+		{"policy_url", policyURL},
+		{"tos_url", tosURL},
+	} {
+		if u.value == "" {
+			continue
+		}
+		parsed, err := url.Parse(u.value)
+		if err != nil || parsed.Scheme != "https" || parsed.Host == "" {
+			return fmt.Errorf("%s must be an https URL, got %q", u.name, u.value)
+		}
+	}
+	return nil
+}
+
 // checkCost returns an error if the hash provided does not meet lower or upper
 // bound cost requirements.
 func checkCost(hash []byte) error {
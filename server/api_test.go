@@ -4,6 +4,7 @@ import (
 	"context"
 	"net"
 	"os"
+	"strconv"
 	"testing"
 	"time"
 
@@ -451,6 +452,61 @@ func TestUpdateClient(t *testing.T) {
 	}
 }
 
+func TestCreateClientURLs(t *testing.T) {
+	logger := &logrus.Logger{
+		Out:       os.Stderr,
+		Formatter: &logrus.TextFormatter{DisableColors: true},
+		Level:     logrus.DebugLevel,
+	}
+
+	s := memory.New(logger)
+	client := newAPI(s, logger, t)
+	defer client.Close()
+	ctx := context.Background()
+
+	for _, c := range []*api.Client{
+		{Id: "http-logo", LogoUrl: "http://example.com/logo.png"},
+		{Id: "http-home", ClientUrl: "http://example.com"},
+		{Id: "relative-policy", PolicyUrl: "/privacy"},
+		{Id: "ftp-tos", TosUrl: "ftp://example.com/terms"},
+	} {
+		if _, err := client.CreateClient(ctx, &api.CreateClientReq{Client: c}); err == nil {
+			t.Errorf("%s: expected client with a non-https URL to be rejected", c.Id)
+		}
+		if _, err := s.GetClient(c.Id); err != storage.ErrNotFound {
+			t.Errorf("%s: expected rejected client not to be stored, got %v", c.Id, err)
+		}
+	}
+
+	want := &api.Client{
+		Id:        "branded",
+		Name:      "Example App",
+		LogoUrl:   "https://example.com/logo.png",
+		ClientUrl: "https://example.com",
+		PolicyUrl: "https://example.com/privacy",
+		TosUrl:    "https://example.com/terms",
+	}
+	resp, err := client.CreateClient(ctx, &api.CreateClientReq{Client: want})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+	if resp.Client.ClientUrl != want.ClientUrl || resp.Client.PolicyUrl != want.PolicyUrl || resp.Client.TosUrl != want.TosUrl {
+		t.Errorf("expected response to include the client's URLs, got %+v", resp.Client)
+	}
+
+	got, err := s.GetClient("branded")
+	if err != nil {
+		t.Fatalf("get client: %v", err)
+	}
+	if got.LogoURL != want.LogoUrl || got.ClientURL != want.ClientUrl || got.PolicyURL != want.PolicyUrl || got.TOSURL != want.TosUrl {
+		t.Errorf("expected stored client to have the requested URLs, got %+v", got)
+	}
+
+	if _, err := client.UpdateClient(ctx, &api.UpdateClientReq{Id: "branded", TosUrl: "http://example.com/terms"}); err == nil {
+		t.Error("expected update with a non-https URL to be rejected")
+	}
+}
+
 func find(item string, items []string) bool {
 	for _, i := range items {
 		if item == i {
@@ -459,3 +515,86 @@ func find(item string, items []string) bool {
 	}
 	return false
 }
+
+func TestAPISecretPolicy(t *testing.T) {
+	logger := &logrus.Logger{
+		Out:       os.Stderr,
+		Formatter: &logrus.TextFormatter{DisableColors: true},
+		Level:     logrus.DebugLevel,
+	}
+	ctx := context.Background()
+
+	s := memory.New(logger)
+	d := NewAPIWithOptions(s, logger, APIOptions{
+		Secrets:      NewSecretGenerator(32),
+		SecretPolicy: SecretPolicy{MinLength: 16},
+	})
+	if _, err := d.CreateClient(ctx, &api.CreateClientReq{Client: &api.Client{Id: "weak", Secret: "short"}}); err == nil {
+		t.Errorf("expected a secret shorter than the policy allows to be rejected")
+	}
+	resp, err := d.CreateClient(ctx, &api.CreateClientReq{Client: &api.Client{Id: "generated"}})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+	if len(resp.Client.Secret) < 32 {
+		t.Errorf("expected a secret from the configured generator, got %q", resp.Client.Secret)
+	}
+
+	// Without options, any secret passed by the caller is accepted.
+	d = NewAPI(s, logger)
+	if _, err := d.CreateClient(ctx, &api.CreateClientReq{Client: &api.Client{Id: "weak", Secret: "short"}}); err != nil {
+		t.Errorf("expected the secret to be accepted without a policy: %v", err)
+	}
+}
+
+func TestAPIRequireHTTPSRedirectURIs(t *testing.T) {
+	logger := &logrus.Logger{
+		Out:       os.Stderr,
+		Formatter: &logrus.TextFormatter{DisableColors: true},
+		Level:     logrus.DebugLevel,
+	}
+	ctx := context.Background()
+
+	s := memory.New(logger)
+	d := NewAPIWithOptions(s, logger, APIOptions{RequireHTTPSRedirectURIs: true})
+
+	tests := []struct {
+		uri   string
+		valid bool
+	}{
+		{uri: "https://app.example.com/callback", valid: true},
+		{uri: "http://127.0.0.1:5555/callback", valid: true},
+		{uri: "http://[::1]:5555/callback", valid: true},
+		{uri: "http://localhost/callback", valid: true},
+		{uri: "com.example.app:/callback", valid: true},
+		{uri: "http://app.example.com/callback"},
+		{uri: "HTTP://app.example.com/callback"},
+		{uri: "http://localhost.example.com/callback"},
+	}
+	for i, tc := range tests {
+		id := "client-" + strconv.Itoa(i)
+		_, err := d.CreateClient(ctx, &api.CreateClientReq{Client: &api.Client{Id: id, RedirectUris: []string{tc.uri}}})
+		if tc.valid && err != nil {
+			t.Errorf("%s: expected redirect URI to be accepted: %v", tc.uri, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("%s: expected plaintext HTTP redirect URI to be rejected", tc.uri)
+		}
+	}
+
+	if _, err := d.CreateClient(ctx, &api.CreateClientReq{Client: &api.Client{Id: "app", RedirectUris: []string{"https://app.example.com/callback"}}}); err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+	if _, err := d.UpdateClient(ctx, &api.UpdateClientReq{Id: "app", RedirectUris: []string{"http://app.example.com/callback"}}); err == nil {
+		t.Error("expected an update to a plaintext HTTP redirect URI to be rejected")
+	}
+	if c, _ := s.GetClient("app"); len(c.RedirectURIs) != 1 || c.RedirectURIs[0] != "https://app.example.com/callback" {
+		t.Errorf("expected the rejected update not to be applied, got %q", c.RedirectURIs)
+	}
+
+	// In development, with the check turned off, plaintext HTTP is accepted.
+	d = NewAPI(s, logger)
+	if _, err := d.UpdateClient(ctx, &api.UpdateClientReq{Id: "app", RedirectUris: []string{"http://app.example.com/callback"}}); err != nil {
+		t.Errorf("expected a plaintext HTTP redirect URI to be accepted without enforcement: %v", err)
+	}
+}
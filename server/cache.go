@@ -0,0 +1,199 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CachePolicy holds the caching headers sent with an endpoint's responses.
+// Headers with empty values aren't sent.
+type CachePolicy struct {
+	CacheControl string `json:"cacheControl"`
+	Pragma       string `json:"pragma"`
+	Expires      string `json:"expires"`
+}
+
+// CachePolicies configures the caching headers of endpoints that proxies and
+// CDNs commonly sit in front of.
+type CachePolicies struct {
+	// Defaults to no caching headers.
+	Discovery CachePolicy `json:"discovery"`
+
+	// Defaults to a max-age lasting until the next key rotation. A configured
+	// max-age is capped to the same limit.
+	Keys CachePolicy `json:"keys"`
+
+	// Token responses carry credentials and must never be cached. Defaults to
+	// "Cache-Control: no-store" and "Pragma: no-cache". Policies that would let
+	// a response be cached are rejected.
+	Token CachePolicy `json:"token"`
+}
+
+func (p CachePolicy) set(w http.ResponseWriter) {
+	if p.CacheControl != "" {
+		w.Header().Set("Cache-Control", p.CacheControl)
+	}
+	if p.Pragma != "" {
+		w.Header().Set("Pragma", p.Pragma)
+	}
+	if p.Expires != "" {
+		w.Header().Set("Expires", p.Expires)
+	}
+}
+
+// capMaxAge lowers the max-age and s-maxage directives of a Cache-Control
+// header so the response isn't cached for longer than limit.
+func capMaxAge(cacheControl string, limit time.Duration) string {
+	directives := strings.Split(cacheControl, ",")
+	for i, directive := range directives {
+		d := strings.TrimSpace(directive)
+		eq := strings.Index(d, "=")
+		if eq < 0 {
+			continue
+		}
+		switch strings.ToLower(d[:eq]) {
+		case "max-age", "s-maxage":
+			n, err := strconv.Atoi(strings.Trim(d[eq+1:], `"`))
+			if max := int(limit.Seconds()); err != nil || n > max {
+				directives[i] = fmt.Sprintf(" %s=%d", d[:eq], max)
+				if i == 0 {
+					directives[i] = directives[i][1:]
+				}
+			}
+		}
+	}
+	return strings.Join(directives, ",")
+}
+
+// tokenCachePolicy fills in the defaults for the token endpoint's policy and
+// checks that it can't be used to cache token responses.
+//
+// See: https://tools.ietf.org/html/rfc6749#section-5.1
+func tokenCachePolicy(p CachePolicy) (CachePolicy, error) {
+	if p.CacheControl == "" {
+		p.CacheControl = "no-store"
+	}
+	if p.Pragma == "" {
+		p.Pragma = "no-cache"
+	}
+
+	noStore := false
+	for _, directive := range strings.Split(p.CacheControl, ",") {
+		name, value := strings.ToLower(strings.TrimSpace(directive)), ""
+		if i := strings.Index(name, "="); i >= 0 {
+			name, value = name[:i], strings.Trim(name[i+1:], `"`)
+		}
+		switch name {
+		case "no-store":
+			noStore = true
+		case "public", "immutable", "stale-while-revalidate", "stale-if-error":
+			return p, fmt.Errorf("token cache-control directive %q allows caching", name)
+		case "max-age", "s-maxage":
+			if n, err := strconv.Atoi(value); err != nil || n > 0 {
+				return p, fmt.Errorf("token cache-control directive %q allows caching", directive)
+			}
+		}
+	}
+	if !noStore {
+		return p, fmt.Errorf("token cache-control %q must include no-store", p.CacheControl)
+	}
+	if !strings.EqualFold(p.Pragma, "no-cache") {
+		return p, fmt.Errorf("token pragma must be no-cache, got %q", p.Pragma)
+	}
+	if p.Expires != "" && p.Expires != "0" {
+		return p, fmt.Errorf("token expires must be 0, got %q", p.Expires)
+	}
+	return p, nil
+}
+
+// minGzipSize is the smallest response body worth compressing. Smaller bodies
+// barely shrink, if at all, once gzip's header and footer are added.
+const minGzipSize = 1024
+
+// writeCacheableJSON writes a JSON response whose caching headers have already
+// been set. It adds an ETag, answering requests which already have the body
+// with 304 Not Modified, and gzips large bodies for clients which accept it.
+func writeCacheableJSON(w http.ResponseWriter, r *http.Request, data []byte) {
+	sum := sha256.Sum256(data)
+	etag := hex.EncodeToString(sum[:16])
+
+	compress := len(data) >= minGzipSize
+	if compress {
+		// Caches must not serve the compressed body to clients which don't
+		// accept it, even when this one does.
+		w.Header().Add("Vary", "Accept-Encoding")
+		compress = acceptsGzip(r)
+	}
+	if compress {
+		// Each encoding is a different representation, with its own ETag.
+		etag += "-gzip"
+	}
+	etag = `"` + etag + `"`
+	w.Header().Set("ETag", etag)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if compress {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		// Writes to a bytes.Buffer can't fail.
+		gz.Write(data)
+		gz.Close()
+		data = buf.Bytes()
+		w.Header().Set("Content-Encoding", "gzip")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
+
+// acceptsGzip reports if the Accept-Encoding header of a request allows a
+// gzipped response.
+func acceptsGzip(r *http.Request) bool {
+	accepted := false
+	for _, coding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		params := strings.Split(coding, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		if name != "gzip" && name != "*" {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[len("q="):], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		// An explicit gzip coding takes precedence over the wildcard.
+		if name == "gzip" {
+			return q > 0
+		}
+		accepted = q > 0
+	}
+	return accepted
+}
+
+// etagMatches reports if an If-None-Match header lists the ETag, using the
+// weak comparison If-None-Match calls for.
+//
+// See: https://tools.ietf.org/html/rfc7232#section-3.2
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,279 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/dexidp/dex/storage"
+	"github.com/dexidp/dex/storage/memory"
+)
+
+func TestTokenCachePolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  CachePolicy
+		wantErr bool
+	}{
+		{
+			name:   "defaults",
+			policy: CachePolicy{},
+		},
+		{
+			name:   "extra directives",
+			policy: CachePolicy{CacheControl: "no-store, no-cache, private, max-age=0"},
+		},
+		{
+			name:    "missing no-store",
+			policy:  CachePolicy{CacheControl: "no-cache"},
+			wantErr: true,
+		},
+		{
+			name:    "public",
+			policy:  CachePolicy{CacheControl: "no-store, public"},
+			wantErr: true,
+		},
+		{
+			name:    "max-age",
+			policy:  CachePolicy{CacheControl: "no-store, max-age=3600"},
+			wantErr: true,
+		},
+		{
+			name:    "shared max-age",
+			policy:  CachePolicy{CacheControl: "No-Store, S-MaxAge=60"},
+			wantErr: true,
+		},
+		{
+			name:    "pragma",
+			policy:  CachePolicy{Pragma: "cache"},
+			wantErr: true,
+		},
+		{
+			name:    "expires",
+			policy:  CachePolicy{Expires: "Thu, 01 Dec 2094 16:00:00 GMT"},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := tokenCachePolicy(tc.policy)
+			if err != nil {
+				if !tc.wantErr {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if tc.wantErr {
+				t.Fatalf("expected error for policy %+v", tc.policy)
+			}
+			if !strings.Contains(p.CacheControl, "no-store") {
+				t.Errorf("expected no-store, got %q", p.CacheControl)
+			}
+		})
+	}
+}
+
+func TestTokenEndpointNoStore(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, server := newTestServer(ctx, t, func(c *Config) {
+		c.CachePolicies.Discovery = CachePolicy{CacheControl: "public, max-age=3600"}
+		c.CachePolicies.Token = CachePolicy{CacheControl: "no-store, private"}
+	})
+	defer httpServer.Close()
+
+	rr := httptest.NewRecorder()
+	server.ServeHTTP(rr, httptest.NewRequest("POST", "/token", nil))
+	if got := rr.Header().Get("Cache-Control"); got != "no-store, private" {
+		t.Errorf("expected token Cache-Control %q, got %q", "no-store, private", got)
+	}
+	if got := rr.Header().Get("Pragma"); got != "no-cache" {
+		t.Errorf("expected token Pragma no-cache, got %q", got)
+	}
+
+	rr = httptest.NewRecorder()
+	server.ServeHTTP(rr, httptest.NewRequest("GET", "/.well-known/openid-configuration", nil))
+	if got := rr.Header().Get("Cache-Control"); got != "public, max-age=3600" {
+		t.Errorf("expected discovery Cache-Control to be configurable, got %q", got)
+	}
+}
+
+func TestCacheableTokenPolicyRejected(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, server := newTestServer(ctx, t, nil)
+	defer httpServer.Close()
+
+	config := Config{
+		Issuer:        httpServer.URL,
+		Storage:       server.storage,
+		CachePolicies: CachePolicies{Token: CachePolicy{CacheControl: "public, max-age=600"}},
+		Web:           WebConfig{Dir: "../web"},
+		Logger:        logger,
+	}
+	if _, err := newServer(ctx, config, staticRotationStrategy(testKey)); err == nil {
+		t.Fatal("expected server to reject a cacheable token policy")
+	}
+}
+
+func TestKeysMaxAgeBeforeRotation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	now := time.Now()
+	s := memory.New(logger)
+	if err := s.CreateConnector(storage.Connector{ID: "mock", Type: "mockCallback", Name: "Mock"}); err != nil {
+		t.Fatalf("create connector: %v", err)
+	}
+	config := Config{
+		Issuer:             "https://dex.example.com",
+		Storage:            s,
+		Web:                WebConfig{Dir: "../web"},
+		Logger:             logger,
+		PrometheusRegistry: prometheus.NewRegistry(),
+		Now:                func() time.Time { return now },
+	}
+	strategy := staticRotationStrategy(testKey)
+	strategy.rotationFrequency = time.Hour
+	server, err := newServer(ctx, config, strategy)
+	if err != nil {
+		t.Fatalf("new server: %v", err)
+	}
+
+	maxAge := func() string {
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, httptest.NewRequest("GET", "/keys", nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected 200 got %d", rr.Code)
+		}
+		return rr.Header().Get("Cache-Control")
+	}
+
+	if got, want := maxAge(), "max-age=3600, must-revalidate"; got != want {
+		t.Errorf("expected Cache-Control %q right after rotation, got %q", want, got)
+	}
+	now = now.Add(50 * time.Minute)
+	if got, want := maxAge(), "max-age=600, must-revalidate"; got != want {
+		t.Errorf("expected Cache-Control %q as rotation approaches, got %q", want, got)
+	}
+
+	server.cachePolicies.Keys = CachePolicy{CacheControl: "public, max-age=86400"}
+	if got, want := maxAge(), "public, max-age=600"; got != want {
+		t.Errorf("expected configured max-age to be capped to %q, got %q", want, got)
+	}
+
+	rr := httptest.NewRecorder()
+	server.ServeHTTP(rr, httptest.NewRequest("GET", "/.well-known/openid-configuration", nil))
+	if !strings.Contains(rr.Body.String(), `"key_rotation_interval": 3600`) {
+		t.Errorf("expected discovery to advertise the key rotation interval: %s", rr.Body)
+	}
+}
+
+func TestCompressedResponses(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, server := newTestServer(ctx, t, func(c *Config) {
+		c.CachePolicies.Discovery = CachePolicy{CacheControl: "public, max-age=3600", Expires: "Thu, 01 Dec 2094 16:00:00 GMT"}
+	})
+	defer httpServer.Close()
+
+	// Keep a few rotated keys around, as a long lived deployment would.
+	if err := server.storage.UpdateKeys(func(keys storage.Keys) (storage.Keys, error) {
+		for i := 0; i < 3; i++ {
+			keys.VerificationKeys = append(keys.VerificationKeys, storage.VerificationKey{
+				PublicKey: keys.SigningKeyPub,
+				Expiry:    server.now().Add(time.Hour),
+			})
+		}
+		return keys, nil
+	}); err != nil {
+		t.Fatalf("update keys: %v", err)
+	}
+
+	get := func(path string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, req)
+		return rr
+	}
+
+	for _, path := range []string{"/.well-known/openid-configuration", "/keys"} {
+		plain := get(path, nil)
+		if plain.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d", path, plain.Code)
+		}
+		if plain.Body.Len() < minGzipSize {
+			t.Fatalf("%s: body of %d bytes is too small to be compressed", path, plain.Body.Len())
+		}
+		if got := plain.Header().Get("Content-Encoding"); got != "" {
+			t.Errorf("%s: expected no encoding without Accept-Encoding, got %q", path, got)
+		}
+
+		rr := get(path, http.Header{"Accept-Encoding": {"deflate, gzip;q=0.8"}})
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d", path, rr.Code)
+		}
+		h := rr.Header()
+		if h.Get("Content-Encoding") != "gzip" || h.Get("Vary") != "Accept-Encoding" {
+			t.Errorf("%s: expected gzip encoding varying on Accept-Encoding, got %q and %q", path, h.Get("Content-Encoding"), h.Get("Vary"))
+		}
+		for _, name := range []string{"Content-Type", "Cache-Control", "Expires"} {
+			if h.Get(name) != plain.Header().Get(name) {
+				t.Errorf("%s: expected %s %q, got %q", path, name, plain.Header().Get(name), h.Get(name))
+			}
+		}
+		if h.Get("Content-Length") != strconv.Itoa(rr.Body.Len()) {
+			t.Errorf("%s: expected Content-Length %d, got %q", path, rr.Body.Len(), h.Get("Content-Length"))
+		}
+		etag := h.Get("ETag")
+		if etag == "" || etag == plain.Header().Get("ETag") {
+			t.Errorf("%s: expected the compressed body to have its own ETag, got %q", path, etag)
+		}
+
+		gz, err := gzip.NewReader(rr.Body)
+		if err != nil {
+			t.Fatalf("%s: read gzip: %v", path, err)
+		}
+		body, err := ioutil.ReadAll(gz)
+		if err != nil {
+			t.Fatalf("%s: decompress: %v", path, err)
+		}
+		if !bytes.Equal(body, plain.Body.Bytes()) || !json.Valid(body) {
+			t.Errorf("%s: expected the decompressed body to be the JSON served uncompressed, got %s", path, body)
+		}
+
+		rr = get(path, http.Header{"Accept-Encoding": {"gzip"}, "If-None-Match": {etag}})
+		if rr.Code != http.StatusNotModified || rr.Body.Len() != 0 {
+			t.Errorf("%s: expected 304 with no body for a matching ETag, got %d", path, rr.Code)
+		}
+		if rr = get(path, http.Header{"Accept-Encoding": {"gzip;q=0"}}); rr.Header().Get("Content-Encoding") != "" {
+			t.Errorf("%s: expected no compression when gzip is refused", path)
+		}
+	}
+
+	// Small bodies aren't worth compressing.
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	writeCacheableJSON(rr, req, []byte(`{}`))
+	if rr.Header().Get("Content-Encoding") != "" || rr.Body.String() != `{}` {
+		t.Errorf("expected a small body to be sent uncompressed, got %q", rr.Body)
+	}
+}
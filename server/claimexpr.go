@@ -0,0 +1,97 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/dexidp/dex/storage"
+)
+
+// maxClaimExprLength is the longest value a claim expression may produce.
+const maxClaimExprLength = 1024
+
+// claimExprFuncs are the only functions claim expressions can call, besides
+// the builtins of text/template. None have side effects.
+var claimExprFuncs = template.FuncMap{
+	"split":     strings.Split,
+	"join":      strings.Join,
+	"lower":     strings.ToLower,
+	"upper":     strings.ToUpper,
+	"trim":      strings.TrimSpace,
+	"hasPrefix": strings.HasPrefix,
+	"hasSuffix": strings.HasSuffix,
+	"replace": func(s, old, new string) string {
+		return strings.Replace(s, old, new, -1)
+	},
+}
+
+// newClaimExprs parses the expressions deriving user attributes from others,
+// such as `{{ index (split .email "@") 0 }}`. Expressions are text/template
+// templates run against the user's attributes, and can only call the
+// functions of claimExprFuncs.
+func newClaimExprs(exprs map[string]string) (map[string]*template.Template, error) {
+	parsed := make(map[string]*template.Template, len(exprs))
+	for attr, expr := range exprs {
+		switch attr {
+		case "":
+			return nil, errors.New("claim expression without a name")
+		case attrUserID, attrUsername, attrEmail, attrEmailVerified, attrGroups, attrPicture, attrUpdatedAt:
+			return nil, fmt.Errorf("claim expression %q would replace a user attribute", attr)
+		}
+		// Attributes the user doesn't have are errors, rather than "<no value>".
+		tmpl, err := template.New(attr).Funcs(claimExprFuncs).Option("missingkey=error").Parse(expr)
+		if err != nil {
+			return nil, fmt.Errorf("claim expression %q: %v", attr, err)
+		}
+		parsed[attr] = tmpl
+	}
+	return parsed, nil
+}
+
+// errClaimExprTooLong stops claim expressions producing overly long values.
+var errClaimExprTooLong = fmt.Errorf("value is longer than %d bytes", maxClaimExprLength)
+
+type limitedBuffer struct {
+	bytes.Buffer
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.Len()+len(p) > maxClaimExprLength {
+		return 0, errClaimExprTooLong
+	}
+	return b.Buffer.Write(p)
+}
+
+// evalClaimExpr runs a claim expression against the attributes the user has.
+func evalClaimExpr(tmpl *template.Template, claims storage.Claims) (string, error) {
+	data := make(map[string]interface{})
+	for _, attr := range []string{attrUserID, attrUsername, attrEmail, attrEmailVerified, attrGroups, attrPicture, attrUpdatedAt} {
+		if value, ok := claimValue(claims, attr); ok {
+			data[attr] = value
+		}
+	}
+	var buf limitedBuffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// claimValue returns the value of a user attribute, or of an attribute
+// derived from them by a claim expression. Expressions which fail are logged
+// and their attribute left out, like one the user doesn't have.
+func (s *Server) claimValue(claims storage.Claims, attr string) (interface{}, bool) {
+	tmpl, ok := s.claimExprs[attr]
+	if !ok {
+		return claimValue(claims, attr)
+	}
+	value, err := evalClaimExpr(tmpl, claims)
+	if err != nil {
+		s.logger.Errorf("claim expression %q failed for user %q, leaving it out: %v", attr, claims.UserID, err)
+		return nil, false
+	}
+	return value, value != ""
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/dexidp/dex/storage"
+)
+
+// User attributes the claims released by a scope can hold.
+const (
+	attrUserID        = "user_id"
+	attrUsername      = "username"
+	attrEmail         = "email"
+	attrEmailVerified = "email_verified"
+	attrGroups        = "groups"
+	attrPicture       = "picture"
+	attrUpdatedAt     = "updated_at"
+)
+
+// defaultScopeClaims maps the scopes dex has always supported to the ID token
+// claims they release, and the user attribute each claim holds.
+var defaultScopeClaims = map[string]map[string]string{
+	scopeEmail: {
+		"email":          attrEmail,
+		"email_verified": attrEmailVerified,
+	},
+	scopeGroups: {
+		"groups": attrGroups,
+	},
+	scopeProfile: {
+		"name":       attrUsername,
+		"picture":    attrPicture,
+		"updated_at": attrUpdatedAt,
+	},
+}
+
+// userClaims are the claims of idTokenClaims which describe the user, rather
+// than the token, and so may be released by a scope.
+var userClaims = map[string]bool{
+	"email":          true,
+	"email_verified": true,
+	"groups":         true,
+	"name":           true,
+	"picture":        true,
+	"updated_at":     true,
+}
+
+// newScopeClaims merges the configured scope policies with the defaults. A
+// configured scope replaces the default claims of that scope. Claims may hold
+// the attributes derived by claim expressions too.
+func newScopeClaims(policies map[string]map[string]string, connectorIDClaim string, claimExprs map[string]*template.Template) (map[string]map[string]string, error) {
+	scopeClaims := make(map[string]map[string]string, len(defaultScopeClaims)+len(policies))
+	for scope, claims := range defaultScopeClaims {
+		scopeClaims[scope] = claims
+	}
+	for scope, claims := range policies {
+		switch {
+		case scope == "" || strings.ContainsAny(scope, " \t\n"):
+			return nil, fmt.Errorf("invalid scope %q", scope)
+		case scope == scopeOpenID, scope == scopeOfflineAccess, scope == scopeFederatedID,
+			strings.HasPrefix(scope, scopeCrossClientPrefix):
+			return nil, fmt.Errorf("scope %q can't be configured to release claims", scope)
+		}
+		for claim, attr := range claims {
+			if claim == "" {
+				return nil, fmt.Errorf("scope %q releases a claim without a name", scope)
+			}
+			if (reservedClaim(claim) && !userClaims[claim]) || claim == connectorIDClaim {
+				return nil, fmt.Errorf("scope %q can't release reserved claim %q", scope, claim)
+			}
+			switch attr {
+			case attrUserID, attrUsername, attrEmail, attrEmailVerified, attrGroups, attrPicture, attrUpdatedAt:
+			default:
+				if _, ok := claimExprs[attr]; ok {
+					continue
+				}
+				return nil, fmt.Errorf("scope %q releases claim %q with unknown user attribute %q", scope, claim, attr)
+			}
+		}
+		scopeClaims[scope] = claims
+	}
+	return scopeClaims, nil
+}
+
+// claimValue returns the value of a user attribute, and whether the user has
+// one. Unset attributes are left out of tokens, and email_verified along with
+// a missing email.
+func claimValue(claims storage.Claims, attr string) (interface{}, bool) {
+	switch attr {
+	case attrUserID:
+		return claims.UserID, claims.UserID != ""
+	case attrUsername:
+		return claims.Username, claims.Username != ""
+	case attrEmail:
+		return claims.Email, claims.Email != ""
+	case attrEmailVerified:
+		return claims.EmailVerified, claims.Email != ""
+	case attrGroups:
+		return claims.Groups, len(claims.Groups) > 0
+	case attrPicture:
+		return claims.Picture, claims.Picture != ""
+	case attrUpdatedAt:
+		// Sent as the number of seconds since the epoch.
+		return claims.UpdatedAt.Unix(), !claims.UpdatedAt.IsZero()
+	}
+	return nil, false
+}
+
+// releasedClaims returns the claims the scopes of a request release for a
+// user. Nothing is released unless the "openid" scope was granted.
+func (s *Server) releasedClaims(claims storage.Claims, scopes []string) map[string]interface{} {
+	hasOpenIDScope := false
+	for _, scope := range scopes {
+		if scope == scopeOpenID {
+			hasOpenIDScope = true
+		}
+	}
+	if !hasOpenIDScope {
+		return nil
+	}
+
+	released := make(map[string]interface{})
+	for _, scope := range scopes {
+		for claim, attr := range s.scopeClaims[scope] {
+			if value, ok := s.claimValue(claims, attr); ok {
+				released[claim] = value
+			}
+		}
+	}
+	return released
+}
+
+// releasesGroups reports if any of the scopes releases the user's groups, which
+// connectors only look up when asked to.
+func (s *Server) releasesGroups(scopes []string) bool {
+	for _, scope := range scopes {
+		if scope == scopeGroups {
+			return true
+		}
+		for _, attr := range s.scopeClaims[scope] {
+			if attr == attrGroups {
+				return true
+			}
+			// Err on the side of looking up groups for expressions which
+			// might use them.
+			if tmpl, ok := s.claimExprs[attr]; ok && strings.Contains(tmpl.Root.String(), attrGroups) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ValidateClaimRenames checks the claim renames of a client. Only claims
+// describing the user can be renamed, and not to a name ID tokens already use
+// or another claim is renamed to.
+func ValidateClaimRenames(renames map[string]string) error {
+	targets := make(map[string]string, len(renames))
+	for claim, name := range renames {
+		if !userClaims[claim] {
+			return fmt.Errorf("claim %q can't be renamed", claim)
+		}
+		if name == "" || reservedClaim(name) {
+			return fmt.Errorf("claim %q can't be renamed to %q", claim, name)
+		}
+		if other, ok := targets[name]; ok {
+			return fmt.Errorf("claims %q and %q are both renamed to %q", other, claim, name)
+		}
+		targets[name] = claim
+	}
+	return nil
+}
+
+// renameClaims renames the claims of an ID token payload for a client which
+// expects non-standard names.
+func renameClaims(payload []byte, renames map[string]string) ([]byte, error) {
+	var claims map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, err
+	}
+	for claim, name := range renames {
+		if value, ok := claims[claim]; ok {
+			delete(claims, claim)
+			claims[name] = value
+		}
+	}
+	return json.Marshal(claims)
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/dexidp/dex/storage"
+)
+
+// clientProblems returns what's wrong with the configuration of a client.
+// Clients loaded from a database or config file aren't validated the way
+// clients created through the APIs are, so these problems would otherwise
+// only surface when the client is first used.
+func clientProblems(c storage.Client) []string {
+	var problems []string
+	if c.ID == "" {
+		problems = append(problems, "no client ID")
+	}
+	if !c.Public && c.Secret == "" {
+		problems = append(problems, "confidential client has no secret")
+	}
+	for _, uri := range c.RedirectURIs {
+		if err := checkRedirectURI(uri); err != nil {
+			problems = append(problems, fmt.Sprintf("redirect URI %q: %v", uri, err))
+		}
+	}
+	if c.DefaultRedirectURI != "" {
+		registered := false
+		for _, uri := range c.RedirectURIs {
+			registered = registered || uri == c.DefaultRedirectURI
+		}
+		if !registered {
+			problems = append(problems, "default redirect URI must be one of its redirect URIs")
+		}
+	}
+	if err := validateClientURLs(c.LogoURL, c.ClientURL, c.PolicyURL, c.TOSURL); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if c.CrossClientAudience != "" && !validCrossClientAudience(c.CrossClientAudience) {
+		problems = append(problems, fmt.Sprintf("unknown cross-client audience policy %q", c.CrossClientAudience))
+	}
+	if c.BackchannelLogoutURI != "" {
+		if u, err := url.Parse(c.BackchannelLogoutURI); err != nil || !u.IsAbs() || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("back-channel logout URI %q must be an absolute URL", c.BackchannelLogoutURI))
+		}
+	}
+	for _, combination := range c.ResponseTypes {
+		if err := validateResponseTypeCombination(strings.Fields(combination)); err != nil {
+			problems = append(problems, fmt.Sprintf("response types %q: %v", combination, err))
+		}
+	}
+	if len(c.DefaultScopes) > 0 && !c.OAuth2Only {
+		hasOpenID := false
+		for _, scope := range c.DefaultScopes {
+			hasOpenID = hasOpenID || scope == scopeOpenID
+		}
+		if !hasOpenID {
+			problems = append(problems, `default scopes must include "openid"`)
+		}
+	}
+	if err := ValidateClaimRenames(c.ClaimRenames); err != nil {
+		problems = append(problems, fmt.Sprintf("claim renames: %v", err))
+	}
+	return problems
+}
+
+// checkRedirectURI checks that a registered redirect URI is absolute and has
+// no fragment. Native apps may use the out-of-band URI or a private scheme.
+func checkRedirectURI(uri string) error {
+	if uri == redirectURIOOB {
+		return nil
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return err
+	}
+	if !u.IsAbs() {
+		return fmt.Errorf("not an absolute URI")
+	}
+	if (u.Scheme == "http" || u.Scheme == "https") && u.Host == "" {
+		return fmt.Errorf("no host")
+	}
+	if u.Fragment != "" {
+		return fmt.Errorf("must not have a fragment")
+	}
+	return nil
+}
+
+// ValidateHTTPSRedirectURIs checks that redirect URIs don't use plaintext
+// HTTP. Loopback URIs, which native apps listen on for the response, are
+// allowed, as are the private URI schemes of native apps.
+func ValidateHTTPSRedirectURIs(uris []string) error {
+	for _, uri := range uris {
+		u, err := url.Parse(uri)
+		if err != nil {
+			return fmt.Errorf("invalid redirect URI %q: %v", uri, err)
+		}
+		if !strings.EqualFold(u.Scheme, "http") {
+			continue
+		}
+		host := u.Hostname()
+		if strings.EqualFold(host, "localhost") {
+			continue
+		}
+		if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+			continue
+		}
+		return fmt.Errorf("redirect URI %q must use https", uri)
+	}
+	return nil
+}
+
+// validateClients checks every client in the storage on startup, logs the
+// problems found, and returns an error naming the invalid clients.
+func (s *Server) validateClients() error {
+	clients, err := s.storage.ListClients()
+	if err != nil {
+		return fmt.Errorf("list clients: %v", err)
+	}
+	var invalid []string
+	for _, c := range clients {
+		problems := clientProblems(c)
+		if s.requireHTTPSRedirectURIs {
+			if err := ValidateHTTPSRedirectURIs(c.RedirectURIs); err != nil {
+				problems = append(problems, err.Error())
+			}
+		}
+		for _, p := range problems {
+			s.logger.Errorf("client %q is invalid: %s", c.ID, p)
+		}
+		if len(problems) > 0 {
+			invalid = append(invalid, fmt.Sprintf("%q", c.ID))
+		}
+	}
+	if len(invalid) > 0 {
+		sort.Strings(invalid)
+		return fmt.Errorf("%d of %d clients are invalid: %s", len(invalid), len(clients), strings.Join(invalid, ", "))
+	}
+	s.logger.Infof("validated %d clients", len(clients))
+	return nil
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/dexidp/dex/storage"
+	"github.com/dexidp/dex/storage/memory"
+)
+
+func TestClientProblems(t *testing.T) {
+	valid := storage.Client{
+		ID:           "valid",
+		Secret:       "secret",
+		RedirectURIs: []string{"https://app.example.com/callback", "http://127.0.0.1:5555/callback", redirectURIOOB, "com.example.app:/callback"},
+	}
+	if problems := clientProblems(valid); len(problems) != 0 {
+		t.Errorf("expected no problems with a valid client, got %q", problems)
+	}
+
+	tests := []struct {
+		name    string
+		client  storage.Client
+		problem string
+	}{
+		{
+			name:    "relative redirect URI",
+			client:  storage.Client{ID: "a", Secret: "s", RedirectURIs: []string{"/callback"}},
+			problem: "not an absolute URI",
+		},
+		{
+			name:    "redirect URI with a fragment",
+			client:  storage.Client{ID: "a", Secret: "s", RedirectURIs: []string{"https://app.example.com/callback#frag"}},
+			problem: "fragment",
+		},
+		{
+			name:    "redirect URI without a host",
+			client:  storage.Client{ID: "a", Secret: "s", RedirectURIs: []string{"https:///callback"}},
+			problem: "no host",
+		},
+		{
+			name:    "confidential client without a secret",
+			client:  storage.Client{ID: "a", RedirectURIs: []string{"https://app.example.com/callback"}},
+			problem: "no secret",
+		},
+		{
+			name:    "unregistered default redirect URI",
+			client:  storage.Client{ID: "a", Secret: "s", DefaultRedirectURI: "https://other.example.com/callback"},
+			problem: "default redirect URI",
+		},
+		{
+			name:    "http logo URL",
+			client:  storage.Client{ID: "a", Secret: "s", LogoURL: "http://app.example.com/logo.png"},
+			problem: "logo_url",
+		},
+		{
+			name:    "unknown response type",
+			client:  storage.Client{ID: "a", Secret: "s", ResponseTypes: []string{"code device"}},
+			problem: "unknown response type",
+		},
+		{
+			name:    "unknown cross-client audience policy",
+			client:  storage.Client{ID: "a", Secret: "s", CrossClientAudience: "client-only"},
+			problem: "cross-client audience",
+		},
+	}
+	for _, tc := range tests {
+		problems := clientProblems(tc.client)
+		if len(problems) != 1 || !strings.Contains(problems[0], tc.problem) {
+			t.Errorf("%s: expected a problem mentioning %q, got %q", tc.name, tc.problem, problems)
+		}
+	}
+}
+
+func TestValidateClientsOnStartup(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	newConfig := func(strict bool) Config {
+		s := memory.New(logger)
+		if err := s.CreateConnector(storage.Connector{ID: "mock", Type: "mockCallback", Name: "Mock"}); err != nil {
+			t.Fatalf("create connector: %v", err)
+		}
+		clients := []storage.Client{
+			{ID: "good", Secret: "secret", RedirectURIs: []string{"https://good.example.com/callback"}},
+			{ID: "bad", Secret: "secret", RedirectURIs: []string{"bad.example.com/callback"}},
+		}
+		for _, c := range clients {
+			if err := s.CreateClient(c); err != nil {
+				t.Fatalf("create client: %v", err)
+			}
+		}
+		return Config{
+			Issuer:                "https://dex.example.com",
+			Storage:               s,
+			Web:                   WebConfig{Dir: "../web"},
+			Logger:                logger,
+			PrometheusRegistry:    prometheus.NewRegistry(),
+			ValidateClients:       true,
+			ValidateClientsStrict: strict,
+		}
+	}
+
+	server, err := newServer(ctx, newConfig(false), staticRotationStrategy(testKey))
+	if err != nil {
+		t.Fatalf("expected server to start when invalid clients are only logged: %v", err)
+	}
+	err = server.validateClients()
+	if err == nil {
+		t.Fatal("expected validation to report the invalid client")
+	}
+	if !strings.Contains(err.Error(), `"bad"`) || strings.Contains(err.Error(), `"good"`) {
+		t.Errorf("expected only the invalid client to be reported, got %v", err)
+	}
+
+	if _, err := newServer(ctx, newConfig(true), staticRotationStrategy(testKey)); err == nil {
+		t.Error("expected strict client validation to fail startup")
+	}
+}
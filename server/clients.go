@@ -0,0 +1,110 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/dexidp/dex/storage"
+)
+
+var errRotationInProgress = errors.New("client already has a previous secret")
+
+// clientSecretMatches reports if secret is one of the client's active secrets.
+func clientSecretMatches(client storage.Client, secret string) bool {
+	eq := func(a, b string) bool {
+		return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+	}
+	if eq(client.Secret, secret) {
+		return true
+	}
+	return client.PreviousSecret != "" && eq(client.PreviousSecret, secret)
+}
+
+// handleAdminClientSecret rotates a client's secret on POST, optionally to the
+// secret given in a body of the form {"secret": "..."}, which must meet the
+// secret policy. The old secret keeps
+// working until it's retired on DELETE, but only one rotation can be in
+// progress at a time.
+func (s *Server) handleAdminClientSecret(w http.ResponseWriter, r *http.Request) {
+	clientID := mux.Vars(r)["client"]
+
+	var updater func(old storage.Client) (storage.Client, error)
+	switch r.Method {
+	case http.MethodPost:
+		var req struct {
+			Secret string `json:"secret"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				s.tokenErrHelper(w, errInvalidRequest, `Request body must be of the form {"secret": "..."}.`, http.StatusBadRequest)
+				return
+			}
+		}
+		if req.Secret == "" {
+			req.Secret = s.secrets.Secret()
+		} else if err := s.secretPolicy.Check(req.Secret); err != nil {
+			s.tokenErrHelper(w, errInvalidClientMetadata, err.(*WeakSecretError).Reason, http.StatusBadRequest)
+			return
+		}
+		updater = func(old storage.Client) (storage.Client, error) {
+			if old.PreviousSecret != "" {
+				return old, errRotationInProgress
+			}
+			old.PreviousSecret = old.Secret
+			old.Secret = req.Secret
+			old.SecretRotatedAt = s.now()
+			return old, nil
+		}
+	case http.MethodDelete:
+		updater = func(old storage.Client) (storage.Client, error) {
+			old.PreviousSecret = ""
+			return old, nil
+		}
+	default:
+		w.Header().Set("Allow", "POST, DELETE")
+		s.tokenErrHelper(w, errInvalidRequest, "Unsupported request method.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var client storage.Client
+	err := s.storage.UpdateClient(clientID, func(old storage.Client) (storage.Client, error) {
+		c, err := updater(old)
+		client = c
+		return c, err
+	})
+	switch err {
+	case nil:
+	case storage.ErrNotFound:
+		s.tokenErrHelper(w, errInvalidRequest, "Client not found.", http.StatusNotFound)
+		return
+	case errRotationInProgress:
+		s.tokenErrHelper(w, errInvalidRequest, "The previous secret must be retired before rotating again.", http.StatusConflict)
+		return
+	default:
+		s.logger.Errorf("failed to update client secret: %v", err)
+		s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		s.logger.Infof("retired previous secret of client %q", clientID)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	s.logger.Infof("rotated secret of client %q", clientID)
+
+	data, err := json.Marshal(struct {
+		Secret string `json:"secret"`
+	}{client.Secret})
+	if err != nil {
+		s.logger.Errorf("failed to marshal client secret: %v", err)
+		s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
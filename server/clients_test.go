@@ -0,0 +1,124 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dexidp/dex/storage"
+)
+
+func TestClientSecretRotation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, server := newTestServer(ctx, t, func(c *Config) {
+		c.AdminAPIKey = "admin-key"
+	})
+	defer httpServer.Close()
+
+	client := storage.Client{
+		ID:           "client",
+		Secret:       "old-secret",
+		RedirectURIs: []string{"https://example.com/callback"},
+	}
+	if err := server.storage.CreateClient(client); err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	admin := func(method, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/admin/clients/client/secret", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer admin-key")
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, req)
+		return rr
+	}
+	authenticates := func(secret string) bool {
+		c := client
+		c.Secret = secret
+		rr := exchangeTestAuthCode(server, c, newTestAuthCode(t, server, client))
+		if rr.Code != http.StatusOK && rr.Code != http.StatusUnauthorized {
+			t.Fatalf("unexpected token response %d: %s", rr.Code, rr.Body)
+		}
+		return rr.Code == http.StatusOK
+	}
+
+	rr := admin("POST", `{"secret": "new-secret"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 rotating secret, got %d: %s", rr.Code, rr.Body)
+	}
+	var resp struct {
+		Secret string `json:"secret"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil || resp.Secret != "new-secret" {
+		t.Errorf("expected new secret in response, got %s", rr.Body)
+	}
+
+	if !authenticates("new-secret") {
+		t.Error("expected new secret to authenticate")
+	}
+	if !authenticates("old-secret") {
+		t.Error("expected old secret to authenticate during the overlap")
+	}
+	if rr := admin("POST", ""); rr.Code != http.StatusConflict {
+		t.Errorf("expected 409 rotating before the previous secret is retired, got %d", rr.Code)
+	}
+
+	if rr := admin("DELETE", ""); rr.Code != http.StatusNoContent {
+		t.Fatalf("expected 204 retiring previous secret, got %d: %s", rr.Code, rr.Body)
+	}
+	if authenticates("old-secret") {
+		t.Error("expected old secret to be rejected after it was retired")
+	}
+	if !authenticates("new-secret") {
+		t.Error("expected new secret to authenticate after the old one was retired")
+	}
+}
+
+func TestClientSecretPolicy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, server := newTestServer(ctx, t, func(c *Config) {
+		c.AdminAPIKey = "admin-key"
+		c.SecretPolicy = SecretPolicy{MinLength: 16, MinEntropyBits: 64}
+	})
+	defer httpServer.Close()
+
+	client := storage.Client{ID: "client", Secret: "old-secret", RedirectURIs: []string{"https://example.com/callback"}}
+	if err := server.storage.CreateClient(client); err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+	rotate := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/admin/clients/client/secret", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer admin-key")
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := rotate(`{"secret": "password"}`)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected a weak secret to be rejected with 400, got %d: %s", rr.Code, rr.Body)
+	}
+	var errResp struct {
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &errResp); err != nil {
+		t.Fatalf("unmarshal error response: %v", err)
+	}
+	if errResp.Error != errInvalidClientMetadata || errResp.Description == "" {
+		t.Errorf("expected an %q error with a description, got %s", errInvalidClientMetadata, rr.Body)
+	}
+	if c, err := server.storage.GetClient("client"); err != nil || c.Secret != "old-secret" {
+		t.Errorf("expected the rejected secret not to be stored, got %+v, %v", c, err)
+	}
+
+	if rr := rotate(`{"secret": "qy7T2pX9vLm4Rk8WzN3bHc6J"}`); rr.Code != http.StatusOK {
+		t.Errorf("expected a strong secret to be accepted, got %d: %s", rr.Code, rr.Body)
+	}
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dexidp/dex/storage"
+)
+
+// maxCodeReuseGrace caps the grace period clients can be configured with.
+// Repeated exchanges from double-mounted pages arrive within milliseconds.
+const maxCodeReuseGrace = 10 * time.Second
+
+// redeemedCode remembers the tokens an authorization code was exchanged for,
+// for clients with a code reuse grace period.
+type redeemedCode struct {
+	clientID string
+	// Hash of the parameters of the exchange, which a repeat must match.
+	request [sha256.Size]byte
+
+	idToken      string
+	accessToken  string
+	refreshToken string
+	refreshID    string
+	scopes       []string
+	expiry       time.Time
+
+	// Until when a repeat gets the same tokens.
+	graceEnd time.Time
+	// Until when a reuse is detected, which is when the code would have
+	// expired.
+	forgetAt time.Time
+}
+
+// redeemedCodes holds codes recently exchanged by clients with a grace
+// period. They're only kept in memory, so a repeat handled by another dex
+// instance fails like any reuse of a code.
+type redeemedCodes struct {
+	mu    sync.Mutex
+	codes map[string]redeemedCode
+}
+
+func (c *redeemedCodes) add(code string, redeemed redeemedCode, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.codes == nil {
+		c.codes = make(map[string]redeemedCode)
+	}
+	for k, r := range c.codes {
+		if now.After(r.forgetAt) {
+			delete(c.codes, k)
+		}
+	}
+	c.codes[code] = redeemed
+}
+
+func (c *redeemedCodes) get(code string, now time.Time) (redeemedCode, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r, ok := c.codes[code]
+	if !ok || now.After(r.forgetAt) {
+		return redeemedCode{}, false
+	}
+	return r, true
+}
+
+func (c *redeemedCodes) delete(code string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.codes, code)
+}
+
+// codeExchangeHash identifies the parameters of a code exchange.
+func codeExchangeHash(r *http.Request) [sha256.Size]byte {
+	return sha256.Sum256([]byte(r.PostFormValue("redirect_uri") + "\x00" + r.PostFormValue("code_verifier")))
+}
+
+// codeReuseGrace returns the client's grace period for repeated exchanges of
+// a code.
+func codeReuseGrace(client storage.Client) time.Duration {
+	grace := time.Duration(client.CodeReuseGraceSeconds) * time.Second
+	if grace > maxCodeReuseGrace {
+		return maxCodeReuseGrace
+	}
+	return grace
+}
+
+// handleRedeemedCode handles an exchange of a code which was already
+// exchanged, returning false if the code isn't known. A repeat of the
+// exchange within the client's grace period gets the same tokens. Any other
+// reuse suggests the code was stolen, so the refresh token issued for it is
+// revoked.
+//
+// https://tools.ietf.org/html/rfc6749#section-4.1.2
+func (s *Server) handleRedeemedCode(w http.ResponseWriter, r *http.Request, client storage.Client, code string) bool {
+	now := s.now()
+	redeemed, ok := s.redeemedCodes.get(code, now)
+	if !ok || redeemed.clientID != client.ID {
+		return false
+	}
+	if !now.After(redeemed.graceEnd) && codeExchangeHash(r) == redeemed.request {
+		s.logger.Infof("client %q repeated the exchange of an authorization code, returning the same tokens", client.ID)
+		s.writeAccessToken(w, redeemed.idToken, redeemed.accessToken, redeemed.refreshToken, redeemed.scopes, redeemed.expiry)
+		return true
+	}
+
+	// Once a reuse is detected, even repeats get an error.
+	s.redeemedCodes.delete(code)
+	s.logger.Errorf("authorization code of client %q was reused, revoking the tokens issued for it", client.ID)
+	if redeemed.refreshID != "" {
+		refresh, err := s.storage.GetRefresh(redeemed.refreshID)
+		if err == nil {
+			err = s.deleteRefreshToken(refresh)
+		}
+		if err != nil && err != storage.ErrNotFound {
+			s.logger.Errorf("failed to revoke refresh token: %v", err)
+		}
+	}
+	s.tokenErrHelper(w, errInvalidGrant, "Authorization code has already been used.", http.StatusBadRequest)
+	return true
+}
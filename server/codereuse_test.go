@@ -0,0 +1,93 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/dexidp/dex/storage"
+)
+
+func TestCodeReuseGrace(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	now := time.Now()
+	httpServer, server := newTestServer(ctx, t, func(c *Config) {
+		c.Now = func() time.Time { return now }
+	})
+	defer httpServer.Close()
+
+	client := storage.Client{
+		ID:                    "spa",
+		Secret:                "secret",
+		RedirectURIs:          []string{"https://spa.example.com/callback"},
+		CodeReuseGraceSeconds: 2,
+	}
+	strict := storage.Client{
+		ID:           "strict",
+		Secret:       "secret",
+		RedirectURIs: []string{"https://strict.example.com/callback"},
+	}
+	for _, c := range []storage.Client{client, strict} {
+		if err := server.storage.CreateClient(c); err != nil {
+			t.Fatalf("create client: %v", err)
+		}
+	}
+
+	newCode := func(c storage.Client) string {
+		code := storage.AuthCode{
+			ID:          storage.NewID(),
+			ClientID:    c.ID,
+			RedirectURI: c.RedirectURIs[0],
+			Scopes:      []string{scopeOpenID, scopeOfflineAccess},
+			ConnectorID: "mock",
+			Claims:      storage.Claims{UserID: "1"},
+			Expiry:      now.Add(time.Minute),
+		}
+		if err := server.storage.CreateAuthCode(code); err != nil {
+			t.Fatalf("create auth code: %v", err)
+		}
+		return code.ID
+	}
+	type tokenResponse struct {
+		AccessToken  string `json:"access_token"`
+		IDToken      string `json:"id_token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	exchange := func(c storage.Client, code string, wantStatus int) tokenResponse {
+		rr := exchangeTestAuthCode(server, c, code)
+		if rr.Code != wantStatus {
+			t.Fatalf("expected status %d exchanging code, got %d: %s", wantStatus, rr.Code, rr.Body)
+		}
+		var resp tokenResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("unmarshal token response: %v", err)
+		}
+		return resp
+	}
+
+	code := newCode(client)
+	first := exchange(client, code, http.StatusOK)
+	now = now.Add(time.Second)
+	if repeat := exchange(client, code, http.StatusOK); repeat != first {
+		t.Errorf("expected a repeat within the grace period to return the same tokens, got %+v and %+v", first, repeat)
+	}
+
+	// A reuse after the grace period is treated as theft of the code.
+	now = now.Add(2 * time.Second)
+	exchange(client, code, http.StatusBadRequest)
+	tokens, err := server.storage.ListRefreshTokens()
+	if err != nil {
+		t.Fatalf("list refresh tokens: %v", err)
+	}
+	if len(tokens) != 0 {
+		t.Errorf("expected the refresh token issued for the reused code to be revoked, got %d tokens", len(tokens))
+	}
+
+	strictCode := newCode(strict)
+	exchange(strict, strictCode, http.StatusOK)
+	exchange(strict, strictCode, http.StatusBadRequest)
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"golang.org/x/oauth2"
+
+	"github.com/dexidp/dex/storage"
+)
+
+// requestIDHeader carries the ID of the request being served, which is passed
+// on to the requests connectors make upstream for tracing.
+const requestIDHeader = "X-Request-Id"
+
+type requestIDKey struct{}
+
+// connectorTransport adds the headers configured for a connector, and the ID
+// of the request being served, to the requests the connector makes.
+type connectorTransport struct {
+	headers map[string]string
+	base    http.RoundTripper
+}
+
+func (t connectorTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	// Round trippers must not modify the request, add the headers to a copy.
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.Header = make(http.Header, len(r.Header)+len(t.headers)+1)
+	for name, values := range r.Header {
+		r2.Header[name] = append([]string(nil), values...)
+	}
+	r = r2
+	for name, value := range t.headers {
+		// Never replace the headers the connector sets itself, such as its
+		// credentials.
+		if r.Header.Get(name) == "" {
+			r.Header.Set(name, value)
+		}
+	}
+	if id, ok := r.Context().Value(requestIDKey{}).(string); ok && r.Header.Get(requestIDHeader) == "" {
+		r.Header.Set(requestIDHeader, id)
+	}
+	return t.base.RoundTrip(r)
+}
+
+// newConnectorHTTPClient returns the client making the requests of a connector
+// with the headers.
+func newConnectorHTTPClient(headers map[string]string) *http.Client {
+	return &http.Client{Transport: connectorTransport{headers, http.DefaultTransport}}
+}
+
+// connectorTypesWithHeaders are the connector types making their upstream
+// requests through the connector's HTTP client: OIDC connectors are given it,
+// and the ones built on golang.org/x/oauth2 get it from connectorContext.
+// Other types would ignore the headers configured.
+var connectorTypesWithHeaders = map[string]bool{
+	"oidc":            true,
+	"github":          true,
+	"gitlab":          true,
+	"linkedin":        true,
+	"microsoft":       true,
+	"bitbucket-cloud": true,
+}
+
+// validateConnectorHeaders checks the headers configured for a connector, and
+// that the connector sends them. Authorization can't be set, connectors send
+// their own credentials.
+func validateConnectorHeaders(conn storage.Connector) error {
+	if len(conn.Headers) == 0 {
+		return nil
+	}
+	if !connectorTypesWithHeaders[conn.Type] {
+		return fmt.Errorf("connectors of type %q don't support headers", conn.Type)
+	}
+	if conn.Type == "github" {
+		// GitHub connectors with a root CA use their own HTTP client.
+		var config struct {
+			RootCA string `json:"rootCA"`
+		}
+		if err := json.Unmarshal(conn.Config, &config); err == nil && config.RootCA != "" {
+			return errors.New("headers can't be used with a GitHub connector configured with a rootCA")
+		}
+	}
+	for name, value := range conn.Headers {
+		if name == "" || strings.ContainsAny(name, " \t\r\n:") {
+			return fmt.Errorf("invalid header name %q", name)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("invalid value for header %q", name)
+		}
+		switch http.CanonicalHeaderKey(name) {
+		case "Authorization", "Host", requestIDHeader:
+			return fmt.Errorf("header %q can't be set", name)
+		}
+	}
+	return nil
+}
+
+// connectorContext returns the context of r for the calls to conn, making its
+// upstream requests through the connector's HTTP client. Connectors built on
+// golang.org/x/oauth2 use it, unless they bring their own client.
+func connectorContext(r *http.Request, conn Connector) context.Context {
+	ctx := r.Context()
+	if id := r.Header.Get(requestIDHeader); id != "" {
+		ctx = context.WithValue(ctx, requestIDKey{}, id)
+	}
+	if conn.httpClient == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, oauth2.HTTPClient, conn.httpClient)
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/oauth2"
+
+	"github.com/dexidp/dex/storage"
+)
+
+func TestConnectorHeaders(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, server := newTestServer(ctx, t, nil)
+	defer httpServer.Close()
+
+	var (
+		mu       sync.Mutex
+		received = make(map[string]http.Header)
+	)
+	var upstream *httptest.Server
+	upstream = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		received[r.URL.Path] = r.Header
+		mu.Unlock()
+		if r.URL.Path == "/.well-known/openid-configuration" {
+			json.NewEncoder(w).Encode(map[string]string{
+				"issuer":                 upstream.URL,
+				"authorization_endpoint": upstream.URL + "/auth",
+				"token_endpoint":         upstream.URL + "/token",
+				"jwks_uri":               upstream.URL + "/keys",
+			})
+		}
+	}))
+	defer upstream.Close()
+
+	config, err := json.Marshal(map[string]string{
+		"issuer":      upstream.URL,
+		"clientID":    "dex",
+		"redirectURI": httpServer.URL + "/callback",
+	})
+	if err != nil {
+		t.Fatalf("marshal config: %v", err)
+	}
+	conn := storage.Connector{
+		ID:      "upstream",
+		Type:    "oidc",
+		Name:    "Upstream",
+		Config:  config,
+		Headers: map[string]string{"X-Api-Key": "key", "x-tenant-id": "tenant"},
+	}
+	c, err := server.OpenConnector(conn)
+	if err != nil {
+		t.Fatalf("open connector: %v", err)
+	}
+	header := func(path, name string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		h, ok := received[path]
+		if !ok {
+			t.Fatalf("expected a request to %s", path)
+		}
+		return h.Get(name)
+	}
+	if got := header("/.well-known/openid-configuration", "X-Api-Key"); got != "key" {
+		t.Errorf("expected the discovery request to carry the header, got %q", got)
+	}
+
+	// Requests made while serving a request go through the client of the
+	// connector, carrying the ID of the request served.
+	r := httptest.NewRequest("GET", "/callback", nil)
+	r.Header.Set(requestIDHeader, "request-1")
+	client, ok := connectorContext(r, c).Value(oauth2.HTTPClient).(*http.Client)
+	if !ok {
+		t.Fatalf("expected the context to carry the connector's HTTP client")
+	}
+	req, err := http.NewRequest("POST", upstream.URL+"/token", nil)
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	req.Header.Set("X-Api-Key", "set-by-connector")
+	resp, err := client.Do(req.WithContext(connectorContext(r, c)))
+	if err != nil {
+		t.Fatalf("request token: %v", err)
+	}
+	resp.Body.Close()
+	if got := header("/token", "X-Tenant-Id"); got != "tenant" {
+		t.Errorf("expected header X-Tenant-Id to be %q, got %q", "tenant", got)
+	}
+	if got := header("/token", "X-Api-Key"); got != "set-by-connector" {
+		t.Errorf("expected the header set by the connector to be kept, got %q", got)
+	}
+	if got := header("/token", requestIDHeader); got != "request-1" {
+		t.Errorf("expected the request ID to be passed on, got %q", got)
+	}
+	if got := req.Header.Get("X-Tenant-Id"); got != "" {
+		t.Errorf("expected the connector's request not to be modified, got header %q", got)
+	}
+
+	for _, headers := range []map[string]string{
+		{"Authorization": "Bearer token"},
+		{"authorization": "Bearer token"},
+		{"X-Request-Id": "1"},
+		{"X Api Key": "key"},
+		{"X-Api-Key": "key\r\nX-Other: value"},
+	} {
+		conn.Headers = headers
+		if _, err := server.OpenConnector(conn); err == nil {
+			t.Errorf("expected headers %q to be rejected", headers)
+		}
+	}
+
+	// Connectors which would ignore the headers refuse them.
+	for _, c := range []storage.Connector{
+		{ID: "keystone", Type: "keystone", Config: []byte(`{"keystoneHost": "https://keystone.example.com"}`)},
+		{ID: "httpapi", Type: "httpapi", Config: []byte(`{"url": "https://api.example.com"}`)},
+		{ID: "github", Type: "github", Config: []byte(`{"clientID": "dex", "rootCA": "/etc/dex/ca.pem"}`)},
+	} {
+		c.Headers = map[string]string{"X-Api-Key": "key"}
+		if _, err := server.OpenConnector(c); err == nil || !strings.Contains(err.Error(), "header") {
+			t.Errorf("expected headers to be rejected for connector %q, got %v", c.ID, err)
+		}
+	}
+}
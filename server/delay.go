@@ -0,0 +1,69 @@
+package server
+
+import (
+	"context"
+	cryptorand "crypto/rand"
+	"encoding/binary"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// failureDelay slows down responses to failed authentication attempts, such
+// as a wrong client secret or password, by a fixed delay plus a random
+// jitter. It makes guessing credentials slower, and hides timing differences
+// between the ways an attempt can fail, such as an unknown user or a wrong
+// password. Successful attempts aren't delayed.
+type failureDelay struct {
+	delay  time.Duration
+	jitter time.Duration
+
+	mu   sync.Mutex
+	rand *rand.Rand // Guarded by the mutex.
+
+	sleep func(ctx context.Context, d time.Duration)
+}
+
+func newFailureDelay(delay, jitter time.Duration) *failureDelay {
+	if delay <= 0 && jitter <= 0 {
+		return nil
+	}
+	var seed int64
+	if err := binary.Read(cryptorand.Reader, binary.LittleEndian, &seed); err != nil {
+		seed = time.Now().UnixNano()
+	}
+	return &failureDelay{
+		delay:  delay,
+		jitter: jitter,
+		rand:   rand.New(rand.NewSource(seed)),
+		sleep:  sleepContext,
+	}
+}
+
+// wait blocks for the delay of a failed attempt, or until the request is
+// canceled. It's a no-op if no delay is configured.
+func (d *failureDelay) wait(ctx context.Context) {
+	if d == nil {
+		return
+	}
+	d.sleep(ctx, d.next())
+}
+
+func (d *failureDelay) next() time.Duration {
+	delay := d.delay
+	if d.jitter > 0 {
+		d.mu.Lock()
+		delay += time.Duration(d.rand.Int63n(int64(d.jitter)))
+		d.mu.Unlock()
+	}
+	return delay
+}
+
+func sleepContext(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+	case <-t.C:
+	}
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dexidp/dex/storage"
+)
+
+func TestAuthFailureDelay(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, server := newTestServer(ctx, t, func(c *Config) {
+		c.AuthFailureDelay = 100 * time.Millisecond
+		c.AuthFailureJitter = 50 * time.Millisecond
+	})
+	defer httpServer.Close()
+
+	var slept []time.Duration
+	server.failureDelay.rand = rand.New(rand.NewSource(1))
+	server.failureDelay.sleep = func(ctx context.Context, d time.Duration) { slept = append(slept, d) }
+	expected := rand.New(rand.NewSource(1))
+
+	client := storage.Client{ID: "client", Secret: "secret", RedirectURIs: []string{"https://example.com/callback"}}
+	if err := server.storage.CreateClient(client); err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		clientID  string
+		secret    string
+		wantCode  int
+		wantDelay bool
+	}{
+		{"wrong secret", client.ID, "wrong", http.StatusUnauthorized, true},
+		{"unknown client", "unknown", "secret", http.StatusUnauthorized, true},
+		{"authenticated", client.ID, client.Secret, http.StatusBadRequest, false},
+	}
+	for _, tc := range tests {
+		slept = nil
+		form := url.Values{"grant_type": {grantTypeAuthorizationCode}, "code": {"unknown"}}
+		r := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.SetBasicAuth(tc.clientID, tc.secret)
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, r)
+		if rr.Code != tc.wantCode {
+			t.Errorf("%s: expected %d, got %d: %s", tc.name, tc.wantCode, rr.Code, rr.Body)
+		}
+		if !tc.wantDelay {
+			if len(slept) != 0 {
+				t.Errorf("%s: expected no delay, got %v", tc.name, slept)
+			}
+			continue
+		}
+		want := 100*time.Millisecond + time.Duration(expected.Int63n(int64(50*time.Millisecond)))
+		if len(slept) != 1 || slept[0] != want {
+			t.Errorf("%s: expected a delay of %v, got %v", tc.name, want, slept)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"net/http"
+	"net/mail"
+	"strings"
+
+	"github.com/dexidp/dex/storage"
+)
+
+// Policies for identities a connector returns without an email.
+const (
+	// Log the user in, leaving the email claims out of tokens.
+	missingEmailProceed = "proceed"
+	// Refuse the login.
+	missingEmailReject = "reject"
+	// Ask the user for an email, which is never considered verified.
+	missingEmailPrompt = "prompt"
+)
+
+func validMissingEmailPolicy(policy string) bool {
+	switch policy {
+	case missingEmailProceed, missingEmailReject, missingEmailPrompt:
+		return true
+	}
+	return false
+}
+
+// awaitingEmail reports if an authorization request waits for the user to
+// supply the email their identity is missing.
+func (s *Server) awaitingEmail(authReq storage.AuthRequest) bool {
+	return s.missingEmailPolicy == missingEmailPrompt && authReq.Claims.Email == ""
+}
+
+// parseEmail checks an email entered by a user, returning it without a
+// display name.
+func parseEmail(email string) (string, bool) {
+	addr, err := mail.ParseAddress(strings.TrimSpace(email))
+	if err != nil || addr.Name != "" || strings.HasSuffix(addr.Address, "@") {
+		return "", false
+	}
+	return addr.Address, true
+}
+
+// handleEmailPrompt asks users whose identity has no email for one after
+// they've logged in through a connector, when the missing email policy is
+// "prompt". The login continues once they've entered a valid email.
+func (s *Server) handleEmailPrompt(w http.ResponseWriter, r *http.Request) {
+	if s.maintenance.loginsBlocked() {
+		s.renderError(w, http.StatusServiceUnavailable, "Logins are temporarily disabled for maintenance. Please try again later.")
+		return
+	}
+
+	authReq, err := s.storage.GetAuthRequest(r.FormValue("req"))
+	if err != nil {
+		s.logger.Errorf("Failed to get auth request: %v", err)
+		if err == storage.ErrNotFound {
+			s.renderError(w, http.StatusBadRequest, "Login session expired.")
+		} else {
+			s.renderError(w, http.StatusInternalServerError, "Database error.")
+		}
+		return
+	}
+	if authReq.LoggedIn || authReq.Claims.UserID == "" || !s.awaitingEmail(authReq) {
+		s.renderError(w, http.StatusBadRequest, "Login process is not awaiting an email address.")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if err := s.templates.email(w, r.URL.String(), "", false); err != nil {
+			s.logger.Errorf("Server template error: %v", err)
+		}
+	case http.MethodPost:
+		email, ok := parseEmail(r.FormValue("email"))
+		if !ok {
+			if err := s.templates.email(w, r.URL.String(), r.FormValue("email"), true); err != nil {
+				s.logger.Errorf("Server template error: %v", err)
+			}
+			return
+		}
+
+		// The second factor is still asked for once the email is known.
+		user, err := s.storage.GetUserByRemoteIdentity(authReq.ConnectorID, authReq.Claims.UserID)
+		if err != nil && err != storage.ErrNotFound {
+			s.logger.Errorf("Failed to get user: %v", err)
+			s.renderError(w, http.StatusInternalServerError, "Database error.")
+			return
+		}
+		secondFactor := s.secondFactorPath(user)
+
+		updater := func(a storage.AuthRequest) (storage.AuthRequest, error) {
+			a.Claims.Email = email
+			a.Claims.EmailVerified = false
+			a.LoggedIn = secondFactor == ""
+			return a, nil
+		}
+		if err := s.storage.UpdateAuthRequest(authReq.ID, updater); err != nil {
+			s.logger.Errorf("Failed to update auth request: %v", err)
+			s.renderError(w, http.StatusInternalServerError, "Database error.")
+			return
+		}
+		if secondFactor != "" {
+			http.Redirect(w, r, s.absPath(secondFactor)+"?req="+authReq.ID, http.StatusSeeOther)
+			return
+		}
+		s.logger.Infof("login successful: connector %q, username=%q, email=%q, groups=%q",
+			authReq.ConnectorID, authReq.Claims.Username, email+" (unverified)", authReq.Claims.Groups)
+		http.Redirect(w, r, s.absPath("/approval")+"?req="+authReq.ID, http.StatusSeeOther)
+	default:
+		s.renderError(w, http.StatusBadRequest, "Unsupported request method.")
+	}
+}
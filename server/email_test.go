@@ -0,0 +1,171 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	jose "gopkg.in/square/go-jose.v2"
+
+	"github.com/dexidp/dex/connector"
+	"github.com/dexidp/dex/storage"
+)
+
+func TestMissingEmailPolicy(t *testing.T) {
+	client := storage.Client{ID: "client", Secret: "secret", RedirectURIs: []string{"https://example.com/callback"}}
+	identity := connector.Identity{UserID: "no-email", Username: "jane"}
+
+	// login finalizes a login without an email, returning the redirect.
+	login := func(t *testing.T, s *Server) (storage.AuthRequest, string, error) {
+		authReq := storage.AuthRequest{
+			ID:            storage.NewID(),
+			ClientID:      client.ID,
+			ConnectorID:   "mock",
+			RedirectURI:   client.RedirectURIs[0],
+			ResponseTypes: []string{responseTypeCode},
+			Scopes:        []string{scopeOpenID, scopeEmail},
+			Expiry:        s.now().Add(time.Hour),
+		}
+		if err := s.storage.CreateAuthRequest(authReq); err != nil {
+			t.Fatalf("create auth request: %v", err)
+		}
+		redirect, err := s.finalizeLogin(identity, authReq, Connector{})
+		return authReq, redirect, err
+	}
+	// idTokenClaims completes a logged in request, returning the claims of
+	// the ID token.
+	idTokenClaims := func(t *testing.T, s *Server, id string) map[string]interface{} {
+		authReq, err := s.storage.GetAuthRequest(id)
+		if err != nil {
+			t.Fatalf("get auth request: %v", err)
+		}
+		if !authReq.LoggedIn {
+			t.Fatal("expected the auth request to be logged in")
+		}
+		rr := httptest.NewRecorder()
+		s.sendCodeResponse(rr, httptest.NewRequest("GET", "/approval", nil), authReq)
+		u, err := url.Parse(rr.Header().Get("Location"))
+		if err != nil {
+			t.Fatalf("parse redirect: %v", err)
+		}
+		rr = exchangeTestAuthCode(s, client, u.Query().Get("code"))
+		var resp struct {
+			IDToken string `json:"id_token"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil || resp.IDToken == "" {
+			t.Fatalf("expected an ID token, got %d: %s", rr.Code, rr.Body)
+		}
+		jws, err := jose.ParseSigned(resp.IDToken)
+		if err != nil {
+			t.Fatalf("parse ID token: %v", err)
+		}
+		var claims map[string]interface{}
+		if err := json.Unmarshal(jws.UnsafePayloadWithoutVerification(), &claims); err != nil {
+			t.Fatalf("unmarshal ID token: %v", err)
+		}
+		return claims
+	}
+	newServer := func(t *testing.T, ctx context.Context, policy string) (*httptest.Server, *Server) {
+		httpServer, s := newTestServer(ctx, t, func(c *Config) {
+			c.MissingEmailPolicy = policy
+		})
+		if err := s.storage.CreateClient(client); err != nil {
+			t.Fatalf("create client: %v", err)
+		}
+		return httpServer, s
+	}
+
+	t.Run("proceed", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		httpServer, s := newServer(t, ctx, "")
+		defer httpServer.Close()
+
+		authReq, redirect, err := login(t, s)
+		if err != nil {
+			t.Fatalf("finalize login: %v", err)
+		}
+		if !strings.HasPrefix(redirect, "/approval?") {
+			t.Errorf("expected a redirect to the approval page, got %q", redirect)
+		}
+		claims := idTokenClaims(t, s, authReq.ID)
+		for _, claim := range []string{"email", "email_verified"} {
+			if v, ok := claims[claim]; ok {
+				t.Errorf("expected no %s claim, got %v", claim, v)
+			}
+		}
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		httpServer, s := newServer(t, ctx, missingEmailReject)
+		defer httpServer.Close()
+
+		authReq, _, err := login(t, s)
+		if err != errEmailMissing {
+			t.Fatalf("expected the login to be refused, got %v", err)
+		}
+		rr := httptest.NewRecorder()
+		s.denyLogin(rr, httptest.NewRequest("GET", "/callback", nil), authReq, identity, err)
+		u, err := url.Parse(rr.Header().Get("Location"))
+		if err != nil {
+			t.Fatalf("parse redirect: %v", err)
+		}
+		if got := u.Query().Get("error"); got != errAccessDenied {
+			t.Errorf("expected an access_denied error, got %q", got)
+		}
+	})
+
+	t.Run("prompt", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		httpServer, s := newServer(t, ctx, missingEmailPrompt)
+		defer httpServer.Close()
+
+		authReq, redirect, err := login(t, s)
+		if err != nil {
+			t.Fatalf("finalize login: %v", err)
+		}
+		if redirect != "/email?req="+authReq.ID {
+			t.Fatalf("expected a redirect to the email page, got %q", redirect)
+		}
+		if a, err := s.storage.GetAuthRequest(authReq.ID); err != nil || a.LoggedIn {
+			t.Fatalf("expected auth request not to be logged in before entering an email: %v", err)
+		}
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, httptest.NewRequest("GET", "/approval?req="+authReq.ID, nil))
+		if rr.Code == http.StatusOK {
+			t.Error("expected approval to fail before entering an email")
+		}
+
+		post := func(email string) *httptest.ResponseRecorder {
+			form := url.Values{"email": {email}}
+			req := httptest.NewRequest("POST", redirect, strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rr := httptest.NewRecorder()
+			s.ServeHTTP(rr, req)
+			return rr
+		}
+		if rr := post("Jane <jane@example.com>"); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "Invalid email address.") {
+			t.Errorf("expected an invalid email to be asked for again, got %d", rr.Code)
+		}
+		rr = post("jane@example.com")
+		if location := rr.Header().Get("Location"); rr.Code != http.StatusSeeOther || !strings.HasPrefix(location, "/approval?") {
+			t.Fatalf("expected a redirect to the approval page, got %d %q", rr.Code, location)
+		}
+
+		claims := idTokenClaims(t, s, authReq.ID)
+		if claims["email"] != "jane@example.com" {
+			t.Errorf("expected the entered email, got %v", claims["email"])
+		}
+		if claims["email_verified"] != false {
+			t.Errorf("expected the entered email to be unverified, got %v", claims["email_verified"])
+		}
+	})
+}
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	jose "gopkg.in/square/go-jose.v2"
+
+	"github.com/dexidp/dex/storage"
+)
+
+// actor identifies a party acting on behalf of a token's subject, and through
+// its own act claim, the parties that acted before it.
+//
+// See: https://tools.ietf.org/html/rfc8693#section-4.1
+type actor struct {
+	Subject string `json:"sub"`
+	Actor   *actor `json:"act,omitempty"`
+}
+
+// depth returns the number of parties in the chain.
+func (a *actor) depth() int {
+	n := 0
+	for ; a != nil; a = a.Actor {
+		n++
+	}
+	return n
+}
+
+// Claims of the subject token not carried over to the exchanged token, which
+// are set anew or only apply to the subject token.
+var exchangeDroppedClaims = []string{
+	"iss", "aud", "exp", "iat", "nbf", "azp", "nonce", "at_hash", "c_hash", "act", "may_act", "scope",
+}
+
+// handleTokenExchange exchanges an ID token issued to the client for one
+// addressed to another client, which must list the client as a trusted peer.
+// The client becomes the outermost actor of the new token's act claim. If the
+// token may be exchanged again, its may_act claim names the audience as the
+// only party allowed to do so.
+//
+// https://tools.ietf.org/html/rfc8693#section-2.1
+func (s *Server) handleTokenExchange(w http.ResponseWriter, r *http.Request, client storage.Client, resource *Resource) {
+	if s.tokenExchangeMaxDepth == 0 {
+		s.tokenErrHelper(w, errUnsupportedGrantType, "Token exchange is not enabled.", http.StatusBadRequest)
+		return
+	}
+	if resource != nil {
+		s.tokenErrHelper(w, errInvalidTarget, "Token exchange only issues ID tokens, use the audience parameter.", http.StatusBadRequest)
+		return
+	}
+	subjectToken := r.PostFormValue("subject_token")
+	if subjectToken == "" || r.PostFormValue("subject_token_type") != tokenTypeIDToken {
+		s.tokenErrHelper(w, errInvalidRequest, "An ID token must be given as the subject token.", http.StatusBadRequest)
+		return
+	}
+	if t := r.PostFormValue("requested_token_type"); t != "" && t != tokenTypeIDToken {
+		s.tokenErrHelper(w, errInvalidRequest, "Only ID tokens can be requested.", http.StatusBadRequest)
+		return
+	}
+	if r.PostFormValue("actor_token") != "" {
+		s.tokenErrHelper(w, errInvalidRequest, "Actor tokens are not supported, the client is the actor.", http.StatusBadRequest)
+		return
+	}
+	target := r.PostFormValue("audience")
+	if target == "" {
+		s.tokenErrHelper(w, errInvalidRequest, "Required param: audience.", http.StatusBadRequest)
+		return
+	}
+
+	claims, err := s.verifyIDToken(subjectToken)
+	if err != nil {
+		s.logger.Errorf("token exchange: invalid subject token: %v", err)
+		s.tokenErrHelper(w, errInvalidGrant, "Invalid subject token.", http.StatusBadRequest)
+		return
+	}
+	if !claims.Audience.contains(client.ID) {
+		s.tokenErrHelper(w, errInvalidGrant, "Subject token was not issued to the client.", http.StatusBadRequest)
+		return
+	}
+	if claims.MayAct != nil && claims.MayAct.Subject != client.ID {
+		s.tokenErrHelper(w, errInvalidGrant, "Client may not act on behalf of the subject token.", http.StatusBadRequest)
+		return
+	}
+	depth := claims.Actor.depth()
+	if depth >= s.tokenExchangeMaxDepth {
+		s.tokenErrHelper(w, errInvalidGrant, "Subject token may not be delegated further.", http.StatusBadRequest)
+		return
+	}
+	if !clientAllowsAudience(client, target) {
+		s.tokenErrHelper(w, errInvalidTarget, fmt.Sprintf("Client can't request audience %q.", target), http.StatusBadRequest)
+		return
+	}
+	trusted, err := s.validateCrossClientTrust(client.ID, target)
+	if err != nil {
+		s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+	if !trusted {
+		s.tokenErrHelper(w, errInvalidTarget, fmt.Sprintf("Client %q does not trust the client.", target), http.StatusBadRequest)
+		return
+	}
+
+	act := &actor{Subject: client.ID, Actor: claims.Actor}
+	var mayAct *actor
+	if depth+1 < s.tokenExchangeMaxDepth {
+		mayAct = &actor{Subject: target}
+	}
+	idToken, expiry, err := s.newExchangedIDToken(subjectToken, claims, target, client.ID, act, mayAct)
+	if err != nil {
+		s.logger.Errorf("token exchange: failed to create ID token: %v", err)
+		s.signingErrHelper(w, err)
+		return
+	}
+	s.logger.Infof("token exchange: client %q delegated a token to %q, %d actors", client.ID, target, act.depth())
+	s.logTokenIssued(grantTypeTokenExchange, client.ID, nil, idToken, expiry)
+
+	resp := struct {
+		AccessToken     string `json:"access_token"`
+		IssuedTokenType string `json:"issued_token_type"`
+		TokenType       string `json:"token_type"`
+		ExpiresIn       int    `json:"expires_in"`
+	}{
+		idToken,
+		tokenTypeIDToken,
+		// The issued token isn't an access token.
+		"N_A",
+		int(expiry.Sub(s.now()).Seconds()),
+	}
+	data, err := json.Marshal(resp)
+	if err != nil {
+		s.logger.Errorf("failed to marshal token exchange response: %v", err)
+		s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
+
+// newExchangedIDToken signs a copy of a verified subject token for a new
+// audience, recording the actors. It doesn't outlive the subject token.
+func (s *Server) newExchangedIDToken(subjectToken string, claims idTokenClaims, aud, azp string, act, mayAct *actor) (idToken string, expiry time.Time, err error) {
+	jws, err := jose.ParseSigned(subjectToken)
+	if err != nil {
+		return "", expiry, err
+	}
+	var tok map[string]interface{}
+	if err := json.Unmarshal(jws.UnsafePayloadWithoutVerification(), &tok); err != nil {
+		return "", expiry, fmt.Errorf("unmarshal subject token: %v", err)
+	}
+	for _, claim := range exchangeDroppedClaims {
+		delete(tok, claim)
+	}
+
+	issuedAt := s.now()
+	expiry = issuedAt.Add(s.idTokensValidFor)
+	if subjectExpiry := time.Unix(claims.Expiry, 0); subjectExpiry.Before(expiry) {
+		expiry = subjectExpiry
+	}
+	tok["iss"] = s.issuerURL.String()
+	tok["aud"] = aud
+	tok["azp"] = azp
+	tok["iat"] = issuedAt.Unix()
+	tok["exp"] = expiry.Unix()
+	tok["jti"] = storage.NewID()
+	if s.notBefore {
+		tok["nbf"] = issuedAt.Add(-s.notBeforeLeeway).Unix()
+	}
+	tok["act"] = act
+	if mayAct != nil {
+		tok["may_act"] = mayAct
+	}
+
+	keys, err := s.getKeys()
+	if err != nil {
+		return "", expiry, err
+	}
+	signingKey, err := s.signingKey(keys)
+	if err != nil {
+		return "", expiry, err
+	}
+	payload, err := json.Marshal(tok)
+	if err != nil {
+		return "", expiry, fmt.Errorf("could not serialize claims: %v", err)
+	}
+	if idToken, err = signPayload(signingKey, payload); err != nil {
+		// Signer errors are returned as is, so the client is told to retry.
+		if _, ok := err.(signerError); ok {
+			return "", expiry, err
+		}
+		return "", expiry, fmt.Errorf("failed to sign payload: %v", err)
+	}
+	return idToken, expiry, nil
+}
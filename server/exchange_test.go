@@ -0,0 +1,130 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dexidp/dex/storage"
+)
+
+func TestTokenExchange(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, server := newTestServer(ctx, t, func(c *Config) {
+		c.TokenExchangeMaxDepth = 2
+	})
+	defer httpServer.Close()
+
+	// Each client trusts the one before it.
+	clients := map[string]storage.Client{
+		"frontend": {ID: "frontend", Secret: "secret", RedirectURIs: []string{"https://frontend.example.com/callback"}, AllowedAudiences: []string{"api", "database"}},
+		"api":      {ID: "api", Secret: "secret", TrustedPeers: []string{"frontend"}, AllowedAudiences: []string{"backend"}},
+		"backend":  {ID: "backend", Secret: "secret", TrustedPeers: []string{"api"}, AllowedAudiences: []string{"database"}},
+		"database": {ID: "database", Secret: "secret", TrustedPeers: []string{"backend"}},
+	}
+	for _, c := range clients {
+		if err := server.storage.CreateClient(c); err != nil {
+			t.Fatalf("create client: %v", err)
+		}
+	}
+
+	rr := exchangeTestAuthCode(server, clients["frontend"], newTestAuthCode(t, server, clients["frontend"]))
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &tokens); err != nil || tokens.IDToken == "" {
+		t.Fatalf("expected an ID token, got %d: %s", rr.Code, rr.Body)
+	}
+	login, err := server.verifyIDToken(tokens.IDToken)
+	if err != nil {
+		t.Fatalf("verify ID token: %v", err)
+	}
+
+	exchange := func(clientID, subjectToken, aud string) *httptest.ResponseRecorder {
+		form := url.Values{
+			"grant_type":         {grantTypeTokenExchange},
+			"subject_token":      {subjectToken},
+			"subject_token_type": {tokenTypeIDToken},
+			"audience":           {aud},
+		}
+		req := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(clientID, "secret")
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, req)
+		return rr
+	}
+	exchanged := func(rr *httptest.ResponseRecorder) (string, idTokenClaims) {
+		t.Helper()
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected 200 exchanging token, got %d: %s", rr.Code, rr.Body)
+		}
+		var resp struct {
+			AccessToken     string `json:"access_token"`
+			IssuedTokenType string `json:"issued_token_type"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("unmarshal response: %v", err)
+		}
+		if resp.IssuedTokenType != tokenTypeIDToken {
+			t.Errorf("expected an ID token to be issued, got %q", resp.IssuedTokenType)
+		}
+		claims, err := server.verifyIDToken(resp.AccessToken)
+		if err != nil {
+			t.Fatalf("verify exchanged token: %v", err)
+		}
+		if claims.Subject != login.Subject {
+			t.Errorf("expected the subject %q to be kept, got %q", login.Subject, claims.Subject)
+		}
+		return resp.AccessToken, claims
+	}
+	errorCode := func(rr *httptest.ResponseRecorder) string {
+		var resp struct {
+			Error string `json:"error"`
+		}
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		return resp.Error
+	}
+
+	// First hop: the frontend calls the API on behalf of the user.
+	apiToken, claims := exchanged(exchange("frontend", tokens.IDToken, "api"))
+	if !reflect.DeepEqual(claims.Audience, audience{"api"}) {
+		t.Errorf("expected audience api, got %v", claims.Audience)
+	}
+	if want := (&actor{Subject: "frontend"}); !reflect.DeepEqual(claims.Actor, want) {
+		t.Errorf("expected act %+v, got %+v", want, claims.Actor)
+	}
+	if want := (&actor{Subject: "api"}); !reflect.DeepEqual(claims.MayAct, want) {
+		t.Errorf("expected may_act %+v, got %+v", want, claims.MayAct)
+	}
+
+	// Only the API may exchange its token.
+	if rr := exchange("backend", apiToken, "database"); errorCode(rr) != errInvalidGrant {
+		t.Errorf("expected invalid_grant exchanging another client's token, got %d: %s", rr.Code, rr.Body)
+	}
+
+	// Second hop: the API calls the backend, nesting the actors.
+	backendToken, claims := exchanged(exchange("api", apiToken, "backend"))
+	want := &actor{Subject: "api", Actor: &actor{Subject: "frontend"}}
+	if !reflect.DeepEqual(claims.Actor, want) {
+		t.Errorf("expected act %+v, got %+v", want, claims.Actor)
+	}
+	if claims.MayAct != nil {
+		t.Errorf("expected no may_act at the maximum depth, got %+v", claims.MayAct)
+	}
+	if rr := exchange("backend", backendToken, "database"); errorCode(rr) != errInvalidGrant {
+		t.Errorf("expected invalid_grant delegating past the maximum depth, got %d: %s", rr.Code, rr.Body)
+	}
+
+	// The database doesn't trust the frontend.
+	if rr := exchange("frontend", tokens.IDToken, "database"); errorCode(rr) != errInvalidTarget {
+		t.Errorf("expected invalid_target for an audience not trusting the client, got %d: %s", rr.Code, rr.Body)
+	}
+}
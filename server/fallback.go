@@ -0,0 +1,88 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/dexidp/dex/connector"
+	"github.com/dexidp/dex/storage"
+)
+
+// handleChainLogin sends a user logging in through a chain connector on to the
+// first of its connectors which is healthy. The login then continues as if the
+// user picked that connector, so it's the one recorded in their tokens.
+func (s *Server) handleChainLogin(w http.ResponseWriter, r *http.Request, authReq storage.AuthRequest, connID string, chain connector.ChainConnector) {
+	if id := s.chainPick(connID, chain, s.connectorHealth.check(false)); id != "" {
+		http.Redirect(w, r, s.absPath("/auth", id)+"?req="+authReq.ID, http.StatusFound)
+		return
+	}
+	s.logger.Errorf("connector %q: no healthy connector in chain", connID)
+	s.renderError(w, http.StatusServiceUnavailable, "Login is temporarily unavailable. Please try again later.")
+}
+
+// chainPick returns the first connector of a chain which is healthy, or an
+// empty string if there is none.
+func (s *Server) chainPick(connID string, chain connector.ChainConnector, health map[string]error) string {
+	for _, id := range chain.Chain() {
+		conn, err := s.getConnector(id)
+		if err != nil {
+			s.logger.Errorf("connector %q: failed to get chained connector %q: %v", connID, id, err)
+			continue
+		}
+		// Chains could otherwise send users around in circles.
+		if _, ok := conn.Connector.(connector.ChainConnector); ok {
+			s.logger.Errorf("connector %q: chained connector %q can't be a chain itself", connID, id)
+			continue
+		}
+		if err := health[id]; err != nil {
+			s.logger.Infof("connector %q: skipping unhealthy connector %q", connID, id)
+			continue
+		}
+		return id
+	}
+	return ""
+}
+
+// chainPreferringOther returns the ID of a chain connector listing connID as a
+// fallback which would send users to a connector it prefers, or an empty
+// string.
+// Users can't log in through such a fallback directly, or they could skip the
+// connector the chain prefers, such as by logging in with a local password
+// while the corporate identity provider is up.
+func (s *Server) chainPreferringOther(connID string) (string, error) {
+	connectors, err := s.storage.ListConnectors()
+	if err != nil {
+		return "", err
+	}
+	var health map[string]error
+	for _, c := range connectors {
+		if c.ID == connID {
+			continue
+		}
+		conn, err := s.getConnector(c.ID)
+		if err != nil {
+			continue
+		}
+		chain, ok := conn.Connector.(connector.ChainConnector)
+		if !ok || chainIndex(chain, connID) <= 0 {
+			continue
+		}
+		if health == nil {
+			health = s.connectorHealth.check(false)
+		}
+		if id := s.chainPick(c.ID, chain, health); id != "" && chainIndex(chain, id) < chainIndex(chain, connID) {
+			return c.ID, nil
+		}
+	}
+	return "", nil
+}
+
+// chainIndex returns the position of a connector in a chain, or -1 if the
+// chain doesn't list it.
+func chainIndex(chain connector.ChainConnector, connID string) int {
+	for i, id := range chain.Chain() {
+		if id == connID {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dexidp/dex/connector"
+	"github.com/dexidp/dex/connector/mock"
+	"github.com/dexidp/dex/storage"
+)
+
+type checkedCallbackConnector struct {
+	connector.CallbackConnector
+	err error
+}
+
+func (c *checkedCallbackConnector) Healthy(ctx context.Context) error {
+	return c.err
+}
+
+func TestChainConnector(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	now := time.Now()
+	httpServer, server := newTestServer(ctx, t, func(c *Config) {
+		c.Now = func() time.Time { return now }
+		c.ConnectorHealthTTL = 10 * time.Second
+	})
+	defer httpServer.Close()
+
+	client := storage.Client{ID: "client", Secret: "secret", RedirectURIs: []string{"https://example.com/callback"}}
+	if err := server.storage.CreateClient(client); err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+	for _, c := range []storage.Connector{
+		{ID: "primary", Type: "mockCallback", Name: "Primary", ResourceVersion: "1"},
+		{ID: "chain", Type: "fallback", Name: "Chain", ResourceVersion: "1", Config: []byte(`{"connectors": ["primary", "mock"]}`)},
+	} {
+		if err := server.storage.CreateConnector(c); err != nil {
+			t.Fatalf("create connector: %v", err)
+		}
+	}
+	primary := &checkedCallbackConnector{CallbackConnector: mock.NewCallbackConnector(logger).(connector.CallbackConnector)}
+	server.mu.Lock()
+	server.connectors["primary"] = Connector{ResourceVersion: "1", Connector: primary}
+	server.mu.Unlock()
+
+	get := func(target string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, httptest.NewRequest("GET", target, nil))
+		return rr
+	}
+	// login starts a login through the chain, returning the ID of the auth
+	// request and where the user was sent.
+	login := func() (string, string) {
+		authReq := storage.AuthRequest{
+			ID:            storage.NewID(),
+			ClientID:      client.ID,
+			RedirectURI:   client.RedirectURIs[0],
+			State:         "state",
+			ResponseTypes: []string{responseTypeCode},
+			Scopes:        []string{scopeOpenID},
+			Expiry:        now.Add(time.Hour),
+		}
+		if err := server.storage.CreateAuthRequest(authReq); err != nil {
+			t.Fatalf("create auth request: %v", err)
+		}
+		rr := get("/auth/chain?req=" + authReq.ID)
+		if rr.Code != http.StatusFound {
+			t.Fatalf("expected a redirect to a chained connector, got %d: %s", rr.Code, rr.Body)
+		}
+		return authReq.ID, rr.Header().Get("Location")
+	}
+
+	id, location := login()
+	if location != "/auth/primary?req="+id {
+		t.Errorf("expected a healthy primary connector to be used, got redirected to %q", location)
+	}
+
+	// Users can't skip a healthy primary connector by picking the fallback.
+	id, _ = login()
+	if rr := get("/auth/mock?req=" + id); rr.Header().Get("Location") != "/auth/chain?req="+id {
+		t.Errorf("expected a direct login through the fallback to go through the chain, got %d %q", rr.Code, rr.Header().Get("Location"))
+	}
+	if rr := get("/auth/primary?req=" + id); rr.Code != http.StatusFound || rr.Header().Get("Location") == "/auth/chain?req="+id {
+		t.Errorf("expected a direct login through the primary connector to be allowed, got %d %q", rr.Code, rr.Header().Get("Location"))
+	}
+
+	primary.err = errors.New("upstream unreachable")
+	now = now.Add(11 * time.Second)
+	id, location = login()
+	if location != "/auth/mock?req="+id {
+		t.Fatalf("expected an unhealthy primary connector to be skipped, got redirected to %q", location)
+	}
+	if rr := get(location); rr.Code != http.StatusFound {
+		t.Fatalf("expected a redirect to the fallback connector, got %d: %s", rr.Code, rr.Body)
+	}
+	if rr := get("/callback?state=" + id); rr.Code != http.StatusSeeOther {
+		t.Fatalf("expected the login to complete, got %d: %s", rr.Code, rr.Body)
+	}
+	a, err := server.storage.GetAuthRequest(id)
+	if err != nil {
+		t.Fatalf("get auth request: %v", err)
+	}
+	if !a.LoggedIn || a.ConnectorID != "mock" {
+		t.Errorf("expected a login through the fallback connector, got logged in %t through %q", a.LoggedIn, a.ConnectorID)
+	}
+}
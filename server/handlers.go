@@ -5,9 +5,12 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"html"
+	"io"
+	"mime"
+	"net"
 	"net/http"
 	"net/url"
-	"path"
 	"sort"
 	"strconv"
 	"strings"
@@ -106,11 +109,28 @@ func (h *healthChecker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "Health check passed in %s", t)
 }
 
+// publicKeySet returns the keys published by the keys endpoint. The signing key
+// must not be nil.
+func publicKeySet(keys storage.Keys) jose.JSONWebKeySet {
+	jwks := jose.JSONWebKeySet{
+		Keys: make([]jose.JSONWebKey, len(keys.VerificationKeys)+1),
+	}
+	jwks.Keys[0] = *keys.SigningKeyPub
+	for i, verificationKey := range keys.VerificationKeys {
+		jwks.Keys[i+1] = *verificationKey.PublicKey
+	}
+	return jwks
+}
+
 func (s *Server) handlePublicKeys(w http.ResponseWriter, r *http.Request) {
 	// TODO(ericchiang): Cache this.
-	keys, err := s.storage.GetKeys()
+	keys, err := s.getKeys()
 	if err != nil {
 		s.logger.Errorf("failed to get keys: %v", err)
+		if _, ok := err.(signerError); ok {
+			s.renderError(w, http.StatusServiceUnavailable, "Keys are temporarily unavailable.")
+			return
+		}
 		s.renderError(w, http.StatusInternalServerError, "Internal server error.")
 		return
 	}
@@ -121,26 +141,57 @@ func (s *Server) handlePublicKeys(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	jwks := jose.JSONWebKeySet{
-		Keys: make([]jose.JSONWebKey, len(keys.VerificationKeys)+1),
-	}
-	jwks.Keys[0] = *keys.SigningKeyPub
-	for i, verificationKey := range keys.VerificationKeys {
-		jwks.Keys[i+1] = *verificationKey.PublicKey
-	}
-
-	data, err := json.MarshalIndent(jwks, "", "  ")
+	data, err := json.MarshalIndent(publicKeySet(keys), "", "  ")
 	if err != nil {
 		s.logger.Errorf("failed to marshal discovery data: %v", err)
 		s.renderError(w, http.StatusInternalServerError, "Internal server error.")
 		return
 	}
+	// Clients must not cache the keys past the next rotation, or they'll miss
+	// the key newly issued tokens are signed with.
 	maxAge := keys.NextRotation.Sub(s.now())
-	if maxAge < (time.Minute * 2) {
-		maxAge = time.Minute * 2
+	if maxAge < 0 {
+		maxAge = 0
+	}
+	s.cachePolicies.Keys.set(w)
+	if s.cachePolicies.Keys.CacheControl == "" {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d, must-revalidate", int(maxAge.Seconds())))
+	} else {
+		w.Header().Set("Cache-Control", capMaxAge(s.cachePolicies.Keys.CacheControl, maxAge))
 	}
+	writeCacheableJSON(w, r, data)
+}
 
-	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d, must-revalidate", int(maxAge.Seconds())))
+type connectorListing struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+	Name string `json:"name"`
+}
+
+// handleConnectors lists the connectors users can login with, in the order of
+// the login page. Custom login pages can use it to link to the authorization
+// endpoint with a "connector_id" parameter.
+func (s *Server) handleConnectors(w http.ResponseWriter, r *http.Request) {
+	connectors, err := s.storage.ListConnectors()
+	if err != nil {
+		s.logger.Errorf("failed to list connectors: %v", err)
+		s.renderError(w, http.StatusInternalServerError, "Internal server error.")
+		return
+	}
+	sort.Slice(connectors, func(i, j int) bool { return connectors[i].Name < connectors[j].Name })
+
+	resp := struct {
+		Connectors []connectorListing `json:"connectors"`
+	}{make([]connectorListing, len(connectors))}
+	for i, c := range connectors {
+		resp.Connectors[i] = connectorListing{ID: c.ID, Type: c.Type, Name: c.Name}
+	}
+	data, err := json.MarshalIndent(resp, "", "  ")
+	if err != nil {
+		s.logger.Errorf("failed to marshal connectors: %v", err)
+		s.renderError(w, http.StatusInternalServerError, "Internal server error.")
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
 	w.Write(data)
@@ -151,32 +202,119 @@ type discovery struct {
 	Auth          string   `json:"authorization_endpoint"`
 	Token         string   `json:"token_endpoint"`
 	Keys          string   `json:"jwks_uri"`
+	EndSession    string   `json:"end_session_endpoint"`
 	ResponseTypes []string `json:"response_types_supported"`
 	Subjects      []string `json:"subject_types_supported"`
 	IDTokenAlgs   []string `json:"id_token_signing_alg_values_supported"`
 	Scopes        []string `json:"scopes_supported"`
 	AuthMethods   []string `json:"token_endpoint_auth_methods_supported"`
 	Claims        []string `json:"claims_supported"`
+	ClaimsParam   bool     `json:"claims_parameter_supported"`
+	ResponseModes []string `json:"response_modes_supported,omitempty"`
+
+	AuthorizationSigningAlgs []string `json:"authorization_signing_alg_values_supported,omitempty"`
+
+	CodeChallengeMethods []string `json:"code_challenge_methods_supported"`
+
+	BackchannelLogout        bool `json:"backchannel_logout_supported"`
+	BackchannelLogoutSession bool `json:"backchannel_logout_session_supported"`
+
+	// Not part of the spec. Hints at how long, in seconds, a key is used for
+	// signing before being rotated.
+	KeyRotationInterval int64 `json:"key_rotation_interval,omitempty"`
+
+	// Not part of the spec. Set if the issuer uses plaintext HTTP and the
+	// server is configured to warn about it.
+	Warning string `json:"warning,omitempty"`
+}
+
+// Policies for issuers using plaintext HTTP.
+const (
+	// Serve the discovery document as usual.
+	httpIssuerAllow = "allow"
+	// Serve it with a warning field.
+	httpIssuerWarn = "warn"
+	// Refuse to serve it.
+	httpIssuerReject = "reject"
+)
+
+func validHTTPIssuerPolicy(policy string) bool {
+	switch policy {
+	case httpIssuerAllow, httpIssuerWarn, httpIssuerReject:
+		return true
+	}
+	return false
 }
 
+const httpIssuerWarning = "The issuer uses plaintext HTTP, tokens and credentials sent to it aren't protected. Serve it over HTTPS."
+
 func (s *Server) discoveryHandler() (http.HandlerFunc, error) {
+	// Behind an edge which doesn't terminate TLS, every endpoint below would
+	// be advertised over plaintext HTTP.
+	if s.issuerURL.Scheme == "http" && s.httpIssuerPolicy == httpIssuerReject {
+		s.logger.Errorf("issuer %q uses plaintext HTTP, refusing to serve discovery", s.issuerURL.String())
+		return func(w http.ResponseWriter, r *http.Request) {
+			s.tokenErrHelper(w, errServerError, "The issuer uses plaintext HTTP, which the server configuration disallows.", http.StatusInternalServerError)
+		}, nil
+	}
+
 	d := discovery{
-		Issuer:      s.issuerURL.String(),
-		Auth:        s.absURL("/auth"),
-		Token:       s.absURL("/token"),
-		Keys:        s.absURL("/keys"),
-		Subjects:    []string{"public"},
-		IDTokenAlgs: []string{string(jose.RS256)},
-		Scopes:      []string{"openid", "email", "groups", "profile", "offline_access"},
-		AuthMethods: []string{"client_secret_basic"},
+		Issuer:               s.issuerURL.String(),
+		Auth:                 s.absURL("/auth"),
+		Token:                s.absURL("/token"),
+		Keys:                 s.absURL("/keys"),
+		EndSession:           s.absURL("/logout"),
+		Subjects:             []string{"public"},
+		IDTokenAlgs:          []string{string(jose.RS256)},
+		AuthMethods:          []string{"client_secret_basic"},
+		ClaimsParam:          true,
+		CodeChallengeMethods: []string{codeChallengeMethodS256, codeChallengeMethodPlain},
+		BackchannelLogout:    true,
+		KeyRotationInterval:  int64(s.keyRotationInterval.Seconds()),
+		// Logout tokens always carry a sid.
+		BackchannelLogoutSession: true,
 		Claims: []string{
-			"aud", "email", "email_verified", "exp",
-			"iat", "iss", "locale", "name", "sub",
+			"aud", "auth_time", "email", "email_verified", "exp",
+			"iat", "iss", "locale", "name", "picture", "sid", "sub",
 		},
 	}
 
-	for responseType := range s.supportedResponseTypes {
-		d.ResponseTypes = append(d.ResponseTypes, responseType)
+	if s.issuerURL.Scheme == "http" && s.httpIssuerPolicy == httpIssuerWarn {
+		s.logger.Errorf("issuer %q uses plaintext HTTP", s.issuerURL.String())
+		d.Warning = httpIssuerWarning
+	}
+
+	// RS256 is always listed, as OpenID Connect requires it. That also covers
+	// the keys still verifying tokens after moving to another algorithm.
+	if s.signingAlgorithm != jose.RS256 {
+		d.IDTokenAlgs = append(d.IDTokenAlgs, string(s.signingAlgorithm))
+	}
+	if s.jwtResponseModes {
+		d.ResponseModes = []string{"query", "fragment", responseModeJWT, responseModeQueryJWT, responseModeFragmentJWT}
+		// Authorization responses are signed with the same keys as ID tokens.
+		d.AuthorizationSigningAlgs = append([]string(nil), d.IDTokenAlgs...)
+	}
+
+	var scopes []string
+	claims := make(map[string]bool)
+	for _, claim := range d.Claims {
+		claims[claim] = true
+	}
+	for scope, scopeClaims := range s.scopeClaims {
+		scopes = append(scopes, scope)
+		for claim := range scopeClaims {
+			if !claims[claim] {
+				claims[claim] = true
+				d.Claims = append(d.Claims, claim)
+			}
+		}
+	}
+	sort.Strings(scopes)
+	sort.Strings(d.Claims)
+	d.Scopes = append(append([]string{scopeOpenID}, scopes...), scopeOfflineAccess)
+
+	for combination := range s.responseTypeCombinations {
+		d.ResponseTypes = append(d.ResponseTypes, combination)
 	}
 	sort.Strings(d.ResponseTypes)
 
@@ -186,9 +324,8 @@ func (s *Server) discoveryHandler() (http.HandlerFunc, error) {
 	}
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
-		w.Write(data)
+		s.cachePolicies.Discovery.set(w)
+		writeCacheableJSON(w, r, data)
 	}), nil
 }
 
@@ -207,7 +344,17 @@ func (s *Server) handleAuthorization(w http.ResponseWriter, r *http.Request) {
 		// Otherwise render the error to the user.
 		//
 		// TODO(ericchiang): Should we just always render the error?
-		s.renderError(w, err.Status(), err.Error())
+		s.renderAuthError(w, r, err)
+		return
+	}
+
+	if s.maintenance.loginsBlocked() {
+		err := &authErr{authReq.State, authReq.RedirectURI, errTemporarilyUnavailable, "Logins are temporarily disabled for maintenance."}
+		if handler, ok := err.Handle(); ok {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		s.renderError(w, http.StatusServiceUnavailable, "Logins are temporarily disabled for maintenance. Please try again later.")
 		return
 	}
 
@@ -217,7 +364,18 @@ func (s *Server) handleAuthorization(w http.ResponseWriter, r *http.Request) {
 	//
 	// See: https://github.com/dexidp/dex/issues/646
 	authReq.Expiry = s.now().Add(s.authRequestsValidFor)
+	if !s.pendingLogins.start(authReq.ID, remoteIP(r), authReq.Expiry, s.now()) {
+		s.logger.Errorf("too many pending logins, refusing login from %s for client %q", remoteIP(r), authReq.ClientID)
+		err := &authErr{authReq.State, authReq.RedirectURI, errTemporarilyUnavailable, "Too many logins in progress."}
+		if handler, ok := err.Handle(); ok {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		s.renderError(w, http.StatusTooManyRequests, "Too many logins in progress. Please try again later.")
+		return
+	}
 	if err := s.storage.CreateAuthRequest(authReq); err != nil {
+		s.pendingLogins.end(authReq.ID)
 		s.logger.Errorf("Failed to create authorization request: %v", err)
 		s.renderError(w, http.StatusInternalServerError, "Failed to connect to the database.")
 		return
@@ -225,11 +383,46 @@ func (s *Server) handleAuthorization(w http.ResponseWriter, r *http.Request) {
 
 	connectors, e := s.storage.ListConnectors()
 	if e != nil {
-		s.logger.Errorf("Failed to get list of connectors: %v", err)
+		s.pendingLogins.end(authReq.ID)
+		s.logger.Errorf("Failed to get list of connectors: %v", e)
 		s.renderError(w, http.StatusInternalServerError, "Failed to retrieve connector list.")
 		return
 	}
 
+	// Frontends rendering their own login options, see handleConnectors, pass
+	// the one the user picked.
+	if connID, _ := s.requestedConnectorID(r.Form); connID != "" {
+		for _, c := range connectors {
+			if c.ID == connID {
+				if !clientAllowed(c.AllowedClients, authReq.ClientID) {
+					s.pendingLogins.end(authReq.ID)
+					s.logger.Errorf("client %q is not allowed to use connector %q", authReq.ClientID, c.ID)
+					s.denyAuthorization(w, r, authReq, "The client is not allowed to use the requested connector.")
+					return
+				}
+				http.Redirect(w, r, s.absPath("/auth", c.ID)+"?req="+authReq.ID, http.StatusFound)
+				return
+			}
+		}
+		s.pendingLogins.end(authReq.ID)
+		s.renderError(w, http.StatusBadRequest, "Requested connector does not exist.")
+		return
+	}
+
+	allowed := connectors[:0]
+	for _, c := range connectors {
+		if clientAllowed(c.AllowedClients, authReq.ClientID) {
+			allowed = append(allowed, c)
+		}
+	}
+	connectors = allowed
+	if len(connectors) == 0 {
+		s.pendingLogins.end(authReq.ID)
+		s.logger.Errorf("client %q is not allowed to use any connector", authReq.ClientID)
+		s.denyAuthorization(w, r, authReq, "The client is not allowed to use any connector.")
+		return
+	}
+
 	if len(connectors) == 1 {
 		for _, c := range connectors {
 			// TODO(ericchiang): Make this pass on r.URL.RawQuery and let something latter
@@ -257,7 +450,71 @@ func (s *Server) handleAuthorization(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// renderLoginExpired tells users their login wasn't completed in time, offering
+// to start it again through the same connector. The expired request is
+// replaced by a new one with the same parameters.
+func (s *Server) renderLoginExpired(w http.ResponseWriter, r *http.Request, authReq storage.AuthRequest, connID string) {
+	restarted := authReq
+	restarted.ID = storage.NewID()
+	restarted.Expiry = s.now().Add(s.authRequestsValidFor)
+	restarted.LoggedIn = false
+	restarted.Claims = storage.Claims{}
+	restarted.ConnectorData = nil
+	restarted.SecondFactorFailures = 0
+	if err := s.storage.DeleteAuthRequest(authReq.ID); err != nil && err != storage.ErrNotFound {
+		s.logger.Errorf("Failed to delete authorization request: %v", err)
+	}
+	s.pendingLogins.end(authReq.ID)
+	if !s.pendingLogins.start(restarted.ID, remoteIP(r), restarted.Expiry, s.now()) {
+		s.logger.Errorf("too many pending logins, refusing to restart login from %s for client %q", remoteIP(r), authReq.ClientID)
+		s.renderError(w, http.StatusTooManyRequests, "Too many logins in progress. Please try again later.")
+		return
+	}
+	if err := s.storage.CreateAuthRequest(restarted); err != nil {
+		s.pendingLogins.end(restarted.ID)
+		s.logger.Errorf("Failed to create authorization request: %v", err)
+		s.renderError(w, http.StatusInternalServerError, "Failed to connect to the database.")
+		return
+	}
+	s.logger.Infof("login expired before it was completed: connector %q, client %q", connID, authReq.ClientID)
+
+	retryURL := s.absPath("/auth", connID) + "?req=" + restarted.ID
+	if err := s.templates.retry(w, http.StatusBadRequest, "Your login session expired, please retry.", retryURL); err != nil {
+		s.logger.Errorf("Server template error: %v", err)
+	}
+}
+
+// clientAllowed reports if a client may use a connector which allows the
+// given clients. Any client is allowed if the list is empty.
+func clientAllowed(allowed []string, clientID string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, id := range allowed {
+		if id == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+// denyAuthorization redirects back to the client with an access_denied error,
+// or renders the error if the client can't be redirected to.
+func (s *Server) denyAuthorization(w http.ResponseWriter, r *http.Request, authReq storage.AuthRequest, description string) {
+	err := &authErr{authReq.State, authReq.RedirectURI, errAccessDenied, description}
+	if handler, ok := err.Handle(); ok {
+		handler.ServeHTTP(w, r)
+		return
+	}
+	s.renderError(w, http.StatusForbidden, description)
+}
+
 func (s *Server) handleConnectorLogin(w http.ResponseWriter, r *http.Request) {
+	if s.maintenance.loginsBlocked() {
+		s.renderError(w, http.StatusServiceUnavailable, "Logins are temporarily disabled for maintenance. Please try again later.")
+		return
+	}
+
 	connID := mux.Vars(r)["connector"]
 	conn, err := s.getConnector(connID)
 	if err != nil {
@@ -266,33 +523,69 @@ func (s *Server) handleConnectorLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Pages of the login carry the connector's branding.
+	tmpls := s.templates.withBranding(conn.Branding)
+
 	authReqID := r.FormValue("req")
 
 	authReq, err := s.storage.GetAuthRequest(authReqID)
 	if err != nil {
 		s.logger.Errorf("Failed to get auth request: %v", err)
 		if err == storage.ErrNotFound {
-			s.renderError(w, http.StatusBadRequest, "Login session expired.")
+			s.renderErrorWith(w, tmpls, http.StatusBadRequest, "Login session expired.")
 		} else {
-			s.renderError(w, http.StatusInternalServerError, "Database error.")
+			s.renderErrorWith(w, tmpls, http.StatusInternalServerError, "Database error.")
 		}
 		return
 	}
+	if s.now().After(authReq.Expiry) {
+		s.renderLoginExpired(w, r, authReq, connID)
+		return
+	}
+
+	if !clientAllowed(conn.AllowedClients, authReq.ClientID) {
+		s.logger.Errorf("client %q is not allowed to use connector %q", authReq.ClientID, connID)
+		s.denyAuthorization(w, r, authReq, "The client is not allowed to use the requested connector.")
+		return
+	}
+
+	if chain, ok := conn.Connector.(connector.ChainConnector); ok {
+		s.handleChainLogin(w, r, authReq, connID, chain)
+		return
+	}
+	chainID, err := s.chainPreferringOther(connID)
+	if err != nil {
+		s.logger.Errorf("Failed to list connectors: %v", err)
+		s.renderErrorWith(w, tmpls, http.StatusInternalServerError, "Database error.")
+		return
+	}
+	if chainID != "" {
+		s.logger.Infof("connector %q: sending login back through chain %q, which prefers a healthy connector", connID, chainID)
+		http.Redirect(w, r, s.absPath("/auth", chainID)+"?req="+authReq.ID, http.StatusFound)
+		return
+	}
 
-	// Set the connector being used for the login.
-	if authReq.ConnectorID != connID {
+	// Set the connector being used for the login. Once sent to it, users may
+	// have a limited time to complete the login. Sending them again, such as
+	// when they reload the page, never extends it.
+	pendingExpiry := s.now().Add(s.pendingLoginsValidFor)
+	startsLogin := r.Method == http.MethodGet && s.pendingLoginsValidFor != 0 && pendingExpiry.Before(authReq.Expiry)
+	if authReq.ConnectorID != connID || startsLogin {
 		updater := func(a storage.AuthRequest) (storage.AuthRequest, error) {
 			a.ConnectorID = connID
+			if startsLogin && pendingExpiry.Before(a.Expiry) {
+				a.Expiry = pendingExpiry
+			}
 			return a, nil
 		}
 		if err := s.storage.UpdateAuthRequest(authReqID, updater); err != nil {
 			s.logger.Errorf("Failed to set connector ID on auth request: %v", err)
-			s.renderError(w, http.StatusInternalServerError, "Database error.")
+			s.renderErrorWith(w, tmpls, http.StatusInternalServerError, "Database error.")
 			return
 		}
 	}
 
-	scopes := parseScopes(authReq.Scopes)
+	scopes := s.parseScopes(authReq.Scopes)
 	showBacklink := len(s.connectors) > 1
 
 	switch r.Method {
@@ -305,19 +598,19 @@ func (s *Server) handleConnectorLogin(w http.ResponseWriter, r *http.Request) {
 			callbackURL, err := conn.LoginURL(scopes, s.absURL("/callback"), authReqID)
 			if err != nil {
 				s.logger.Errorf("Connector %q returned error when creating callback: %v", connID, err)
-				s.renderError(w, http.StatusInternalServerError, "Login error.")
+				s.renderErrorWith(w, tmpls, http.StatusInternalServerError, "Login error.")
 				return
 			}
 			http.Redirect(w, r, callbackURL, http.StatusFound)
 		case connector.PasswordConnector:
-			if err := s.templates.password(w, r.URL.String(), "", usernamePrompt(conn), false, showBacklink); err != nil {
+			if err := tmpls.password(w, r.URL.String(), "", usernamePrompt(conn), false, showBacklink); err != nil {
 				s.logger.Errorf("Server template error: %v", err)
 			}
 		case connector.SAMLConnector:
 			action, value, err := conn.POSTData(scopes, authReqID)
 			if err != nil {
 				s.logger.Errorf("Creating SAML data: %v", err)
-				s.renderError(w, http.StatusInternalServerError, "Connector Login Error")
+				s.renderErrorWith(w, tmpls, http.StatusInternalServerError, "Connector Login Error")
 				return
 			}
 
@@ -338,41 +631,69 @@ func (s *Server) handleConnectorLogin(w http.ResponseWriter, r *http.Request) {
 				</script>
 			  </body>
 			  </html>`, action, value, authReqID)
+		case connector.WebAuthnConnector:
+			options, err := conn.LoginOptions(authReqID)
+			if err != nil {
+				s.logger.Errorf("Connector %q returned error when creating WebAuthn options: %v", connID, err)
+				s.renderErrorWith(w, tmpls, http.StatusInternalServerError, "Login error.")
+				return
+			}
+			if err := tmpls.webauthn(w, r.URL.String(), string(options), false, showBacklink); err != nil {
+				s.logger.Errorf("Server template error: %v", err)
+			}
+		case connector.MagicLinkConnector:
+			if err := tmpls.magicLink(w, r.URL.String(), "", false, false, false, showBacklink); err != nil {
+				s.logger.Errorf("Server template error: %v", err)
+			}
 		default:
-			s.renderError(w, http.StatusBadRequest, "Requested resource does not exist.")
+			s.renderErrorWith(w, tmpls, http.StatusBadRequest, "Requested resource does not exist.")
 		}
 	case http.MethodPost:
+		if webauthnConn, ok := conn.Connector.(connector.WebAuthnConnector); ok {
+			s.handleWebAuthnPOST(w, r, authReq, conn, webauthnConn, scopes, showBacklink)
+			return
+		}
+		if magicLinkConn, ok := conn.Connector.(connector.MagicLinkConnector); ok {
+			s.handleMagicLinkPOST(w, r, authReq, tmpls, magicLinkConn, showBacklink)
+			return
+		}
+
 		passwordConnector, ok := conn.Connector.(connector.PasswordConnector)
 		if !ok {
-			s.renderError(w, http.StatusBadRequest, "Requested resource does not exist.")
+			s.renderErrorWith(w, tmpls, http.StatusBadRequest, "Requested resource does not exist.")
 			return
 		}
 
 		username := r.FormValue("login")
 		password := r.FormValue("password")
 
-		identity, ok, err := passwordConnector.Login(r.Context(), scopes, username, password)
+		identity, ok, err := passwordConnector.Login(connectorContext(r, conn), scopes, username, password)
 		if err != nil {
 			s.logger.Errorf("Failed to login user: %v", err)
-			s.renderError(w, http.StatusInternalServerError, "Login error.")
+			s.renderErrorWith(w, tmpls, http.StatusInternalServerError, "Login error.")
 			return
 		}
 		if !ok {
-			if err := s.templates.password(w, r.URL.String(), username, usernamePrompt(passwordConnector), true, showBacklink); err != nil {
+			s.failureDelay.wait(r.Context())
+			if err := tmpls.password(w, r.URL.String(), username, usernamePrompt(passwordConnector), true, showBacklink); err != nil {
 				s.logger.Errorf("Server template error: %v", err)
 			}
 			return
 		}
-		redirectURL, err := s.finalizeLogin(identity, authReq, conn.Connector)
+		redirectURL, err := s.finalizeLogin(identity, authReq, conn)
+		if loginDenied(err) {
+			s.denyLogin(w, r, authReq, identity, err)
+			return
+		}
 		if err != nil {
 			s.logger.Errorf("Failed to finalize login: %v", err)
-			s.renderError(w, http.StatusInternalServerError, "Login error.")
+			s.renderErrorWith(w, tmpls, http.StatusInternalServerError, "Login error.")
 			return
 		}
 
 		http.Redirect(w, r, redirectURL, http.StatusSeeOther)
 	default:
-		s.renderError(w, http.StatusBadRequest, "Unsupported request method.")
+		s.renderErrorWith(w, tmpls, http.StatusBadRequest, "Unsupported request method.")
 	}
 }
 
@@ -397,14 +718,19 @@ func (s *Server) handleConnectorCallback(w http.ResponseWriter, r *http.Request)
 	authReq, err := s.storage.GetAuthRequest(authID)
 	if err != nil {
 		if err == storage.ErrNotFound {
+			// Most likely a login which took too long and was garbage collected.
 			s.logger.Errorf("Invalid 'state' parameter provided: %v", err)
-			s.renderError(w, http.StatusInternalServerError, "Requested resource does not exist.")
+			s.renderError(w, http.StatusBadRequest, "Login session expired. Please return to the application and sign in again.")
 			return
 		}
 		s.logger.Errorf("Failed to get auth request: %v", err)
 		s.renderError(w, http.StatusInternalServerError, "Database error.")
 		return
 	}
+	if s.now().After(authReq.Expiry) {
+		s.renderLoginExpired(w, r, authReq, authReq.ConnectorID)
+		return
+	}
 
 	if connID := mux.Vars(r)["connector"]; connID != "" && connID != authReq.ConnectorID {
 		s.logger.Errorf("Connector mismatch: authentication started with id %q, but callback for id %q was triggered", authReq.ConnectorID, connID)
@@ -419,57 +745,175 @@ func (s *Server) handleConnectorCallback(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	tmpls := s.templates.withBranding(conn.Branding)
+
 	var identity connector.Identity
+	ctx := connectorContext(r, conn)
 	switch conn := conn.Connector.(type) {
 	case connector.CallbackConnector:
 		if r.Method != http.MethodGet {
 			s.logger.Errorf("SAML request mapped to OAuth2 connector")
-			s.renderError(w, http.StatusBadRequest, "Invalid request")
+			s.renderErrorWith(w, tmpls, http.StatusBadRequest, "Invalid request")
 			return
 		}
-		identity, err = conn.HandleCallback(parseScopes(authReq.Scopes), r)
+		identity, err = conn.HandleCallback(s.parseScopes(authReq.Scopes), r.WithContext(ctx))
 	case connector.SAMLConnector:
 		if r.Method != http.MethodPost {
 			s.logger.Errorf("OAuth2 request mapped to SAML connector")
-			s.renderError(w, http.StatusBadRequest, "Invalid request")
+			s.renderErrorWith(w, tmpls, http.StatusBadRequest, "Invalid request")
 			return
 		}
-		identity, err = conn.HandlePOST(parseScopes(authReq.Scopes), r.PostFormValue("SAMLResponse"), authReq.ID)
+		identity, err = conn.HandlePOST(s.parseScopes(authReq.Scopes), r.PostFormValue("SAMLResponse"), authReq.ID)
 	default:
-		s.renderError(w, http.StatusInternalServerError, "Requested resource does not exist.")
+		s.renderErrorWith(w, tmpls, http.StatusInternalServerError, "Requested resource does not exist.")
 		return
 	}
 
+	if challenge, ok := err.(*connector.ChallengeError); ok {
+		s.challengeBrowser(w, r, authReq, challenge)
+		return
+	}
 	if err != nil {
 		s.logger.Errorf("Failed to authenticate: %v", err)
-		s.renderError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to authenticate: %v", err))
+		s.renderErrorWith(w, tmpls, http.StatusInternalServerError, fmt.Sprintf("Failed to authenticate: %v", err))
 		return
 	}
 
-	redirectURL, err := s.finalizeLogin(identity, authReq, conn.Connector)
+	redirectURL, err := s.finalizeLogin(identity, authReq, conn)
+	if loginDenied(err) {
+		s.denyLogin(w, r, authReq, identity, err)
+		return
+	}
 	if err != nil {
 		s.logger.Errorf("Failed to finalize login: %v", err)
-		s.renderError(w, http.StatusInternalServerError, "Login error.")
+		s.renderErrorWith(w, tmpls, http.StatusInternalServerError, "Login error.")
 		return
 	}
 
 	http.Redirect(w, r, redirectURL, http.StatusSeeOther)
 }
 
+// challengeBrowser asks the browser for the credentials a connector requires.
+// Browsers which can't answer the challenge render the response body instead,
+// which sends them on to the fallback connector if there is one.
+func (s *Server) challengeBrowser(w http.ResponseWriter, r *http.Request, authReq storage.AuthRequest, challenge *connector.ChallengeError) {
+	var fallbackURL string
+	if challenge.FallbackConnectorID != "" {
+		fallbackURL = s.absPath("/auth", challenge.FallbackConnectorID) + "?req=" + authReq.ID
+	}
+
+	if challenge.Challenge == "" {
+		if fallbackURL == "" {
+			s.renderError(w, http.StatusUnauthorized, "Your browser did not provide the credentials required to login.")
+			return
+		}
+		http.Redirect(w, r, fallbackURL, http.StatusFound)
+		return
+	}
+
+	w.Header().Set("WWW-Authenticate", challenge.Challenge)
+	if fallbackURL == "" {
+		s.renderError(w, http.StatusUnauthorized, "Your browser did not provide the credentials required to login.")
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusUnauthorized)
+	fmt.Fprintf(w, `<!DOCTYPE html>
+	  <html lang="en">
+	  <head>
+	    <meta http-equiv="refresh" content="0;url=%[1]s">
+	    <title>Redirecting</title>
+	  </head>
+	  <body>
+	    <a href="%[1]s">Continue to login</a>
+	  </body>
+	  </html>`, html.EscapeString(fallbackURL))
+}
+
+// pictureURL returns the picture URL provided by a connector if it's safe to
+// hand to clients, or an empty string otherwise.
+func (s *Server) pictureURL(connID, picture string) string {
+	if picture == "" {
+		return ""
+	}
+	u, err := url.Parse(picture)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		s.logger.Errorf("connector %q provided an invalid picture URL, dropping it", connID)
+		return ""
+	}
+	return picture
+}
+
 // finalizeLogin associates the user's identity with the current AuthRequest, then returns
 // the approval page's path.
-func (s *Server) finalizeLogin(identity connector.Identity, authReq storage.AuthRequest, conn connector.Connector) (string, error) {
+func (s *Server) finalizeLogin(identity connector.Identity, authReq storage.AuthRequest, conn Connector) (string, error) {
+	if identity.Email != "" && identity.EmailVerified && !emailDomainAllowed(conn.AllowedEmailDomains, identity.Email) {
+		return "", errEmailDomainNotAllowed
+	}
+	if identity.Email == "" && s.missingEmailPolicy == missingEmailReject {
+		return "", errEmailMissing
+	}
+	// A client removed since the request was made is refused a code when the
+	// login completes.
+	client, err := s.storage.GetClient(authReq.ClientID)
+	if err != nil && err != storage.ErrNotFound {
+		return "", fmt.Errorf("failed to get client: %v", err)
+	}
+	if client.RequireEmailVerified && !identity.EmailVerified {
+		return "", errEmailNotVerified
+	}
+
 	claims := storage.Claims{
 		UserID:        identity.UserID,
 		Username:      identity.Username,
 		Email:         identity.Email,
 		EmailVerified: identity.EmailVerified,
 		Groups:        identity.Groups,
+		Picture:       s.pictureURL(authReq.ConnectorID, identity.Picture),
+		AuthTime:      s.now(),
+		SessionID:     storage.NewID(),
+	}
+
+	user, err := s.linkIdentity(conn, authReq.ConnectorID, identity)
+	if err == errUserNotFound || err == errAttributeMissing {
+		return "", err
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to link identity: %v", err)
+	}
+	claims.UpdatedAt = user.UpdatedAt
+	// Check before marking the request as logged in so it can't be approved.
+	disabled, err := s.userDisabled(authReq.ConnectorID, identity.UserID)
+	if err != nil {
+		return "", err
+	}
+	if disabled {
+		return "", errUserDisabled
+	}
+
+	scopes := authReq.Scopes
+	if granter, ok := conn.Connector.(connector.ScopeGranter); ok {
+		scopes, err = s.grantScopes(client, scopes, granter.GrantScopes(identity, scopes))
+		if err != nil {
+			return "", err
+		}
 	}
 
+	// Users who enrolled a TOTP device, or who have a phone number with the
+	// SMS second factor enabled, aren't logged in until they've entered a code.
+	secondFactor := s.secondFactorPath(user)
+	// Users without an email may have to supply one first.
+	awaitingEmail := identity.Email == "" && s.missingEmailPolicy == missingEmailPrompt
+
 	updater := func(a storage.AuthRequest) (storage.AuthRequest, error) {
-		a.LoggedIn = true
+		if s.pendingLoginsValidFor != 0 {
+			// The login is no longer pending, leave the usual time to
+			// approve it.
+			a.Expiry = s.now().Add(s.authRequestsValidFor)
+		}
+		a.LoggedIn = secondFactor == "" && !awaitingEmail
 		a.Claims = claims
+		a.Scopes = scopes
 		a.ConnectorData = identity.ConnectorData
 		return a, nil
 	}
@@ -482,10 +926,33 @@ func (s *Server) finalizeLogin(identity connector.Identity, authReq storage.Auth
 		email = email + " (unverified)"
 	}
 
+	if awaitingEmail {
+		s.logger.Infof("login requires an email: connector %q, username=%q", authReq.ConnectorID, claims.Username)
+		return s.absPath("/email") + "?req=" + authReq.ID, nil
+	}
+	if secondFactor != "" {
+		s.logger.Infof("login requires a second factor: connector %q, username=%q, email=%q",
+			authReq.ConnectorID, claims.Username, email)
+		return s.absPath(secondFactor) + "?req=" + authReq.ID, nil
+	}
+
 	s.logger.Infof("login successful: connector %q, username=%q, email=%q, groups=%q",
 		authReq.ConnectorID, claims.Username, email, claims.Groups)
 
-	return path.Join(s.issuerURL.Path, "/approval") + "?req=" + authReq.ID, nil
+	return s.absPath("/approval") + "?req=" + authReq.ID, nil
+}
+
+// secondFactorPath returns the path of the page asking a user for their second
+// factor, or "" if they don't have one. A TOTP device takes precedence over a
+// phone number.
+func (s *Server) secondFactorPath(user storage.User) string {
+	switch {
+	case user.TOTP.Confirmed:
+		return "/totp"
+	case s.smsSender != nil && user.Phone != "":
+		return "/sms"
+	}
+	return ""
 }
 
 func (s *Server) handleApproval(w http.ResponseWriter, r *http.Request) {
@@ -513,7 +980,7 @@ func (s *Server) handleApproval(w http.ResponseWriter, r *http.Request) {
 			s.renderError(w, http.StatusInternalServerError, "Failed to retrieve client.")
 			return
 		}
-		if err := s.templates.approval(w, authReq.ID, authReq.Claims.Username, client.Name, authReq.Scopes); err != nil {
+		if err := s.templates.approval(w, authReq.ID, authReq.Claims.Username, client, authReq.Scopes); err != nil {
 			s.logger.Errorf("Server template error: %v", err)
 		}
 	case http.MethodPost:
@@ -525,11 +992,37 @@ func (s *Server) handleApproval(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// checkRedirectURI checks the redirect URI of an auth request is still
+// registered for its client, which may have been changed or removed since the
+// request was made. If it isn't, the request is ended and an error page
+// rendered rather than sending the user to it.
+func (s *Server) checkRedirectURI(w http.ResponseWriter, authReq storage.AuthRequest) bool {
+	client, err := s.storage.GetClient(authReq.ClientID)
+	if err != nil && err != storage.ErrNotFound {
+		s.logger.Errorf("Failed to get client %q: %v", authReq.ClientID, err)
+		s.renderError(w, http.StatusInternalServerError, "Failed to retrieve client.")
+		return false
+	}
+	if err == nil && validateRedirectURI(client, authReq.RedirectURI, s.ignoreTrailingSlash) {
+		return true
+	}
+	s.logger.Errorf("redirect_uri %q is no longer registered for client %q", authReq.RedirectURI, authReq.ClientID)
+	if err := s.storage.DeleteAuthRequest(authReq.ID); err != nil && err != storage.ErrNotFound {
+		s.logger.Errorf("Failed to delete authorization request: %v", err)
+	}
+	s.pendingLogins.end(authReq.ID)
+	s.renderError(w, http.StatusBadRequest, "The application's redirect URI is no longer registered. Please try logging in again from the application.")
+	return false
+}
+
 func (s *Server) sendCodeResponse(w http.ResponseWriter, r *http.Request, authReq storage.AuthRequest) {
 	if s.now().After(authReq.Expiry) {
 		s.renderError(w, http.StatusBadRequest, "User session has expired.")
 		return
 	}
+	if !s.checkRedirectURI(w, authReq) {
+		return
+	}
 
 	if err := s.storage.DeleteAuthRequest(authReq.ID); err != nil {
 		if err != storage.ErrNotFound {
@@ -540,6 +1033,7 @@ func (s *Server) sendCodeResponse(w http.ResponseWriter, r *http.Request, authRe
 		}
 		return
 	}
+	s.pendingLogins.end(authReq.ID)
 	u, err := url.Parse(authReq.RedirectURI)
 	if err != nil {
 		s.renderError(w, http.StatusInternalServerError, "Invalid redirect URI.")
@@ -559,22 +1053,24 @@ func (s *Server) sendCodeResponse(w http.ResponseWriter, r *http.Request, authRe
 		idToken       string
 		idTokenExpiry time.Time
 
-		accessToken = storage.NewID()
+		accessToken = s.secrets.Secret()
 	)
 
 	for _, responseType := range authReq.ResponseTypes {
 		switch responseType {
 		case responseTypeCode:
 			code = storage.AuthCode{
-				ID:            storage.NewID(),
-				ClientID:      authReq.ClientID,
-				ConnectorID:   authReq.ConnectorID,
-				Nonce:         authReq.Nonce,
-				Scopes:        authReq.Scopes,
-				Claims:        authReq.Claims,
-				Expiry:        s.now().Add(time.Minute * 30),
-				RedirectURI:   authReq.RedirectURI,
-				ConnectorData: authReq.ConnectorData,
+				ID:              s.secrets.Secret(),
+				ClientID:        authReq.ClientID,
+				ConnectorID:     authReq.ConnectorID,
+				Nonce:           authReq.Nonce,
+				Scopes:          authReq.Scopes,
+				RequestedClaims: authReq.RequestedClaims,
+				Claims:          authReq.Claims,
+				Expiry:          s.now().Add(s.authCodesValidFor),
+				RedirectURI:     authReq.RedirectURI,
+				ConnectorData:   authReq.ConnectorData,
+				PKCE:            authReq.PKCE,
 			}
 			if err := s.storage.CreateAuthCode(code); err != nil {
 				s.logger.Errorf("Failed to create auth code: %v", err)
@@ -595,17 +1091,30 @@ func (s *Server) sendCodeResponse(w http.ResponseWriter, r *http.Request, authRe
 		case responseTypeIDToken:
 			implicitOrHybrid = true
 			var err error
-			idToken, idTokenExpiry, err = s.newIDToken(authReq.ClientID, authReq.Claims, authReq.Scopes, authReq.Nonce, accessToken, authReq.ConnectorID)
+			idToken, idTokenExpiry, err = s.newIDToken(authReq.ClientID, authReq.Claims, authReq.Scopes, authReq.RequestedClaims, authReq.Nonce, accessToken, authReq.ConnectorID)
 			if err != nil {
+				if _, ok := err.(essentialClaimError); ok {
+					s.renderError(w, http.StatusBadRequest, "The client requires information your account doesn't provide.")
+					return
+				}
+				if _, ok := err.(tokenDeniedError); ok {
+					err := &authErr{authReq.State, authReq.RedirectURI, errAccessDenied, err.Error()}
+					if handler, ok := err.Handle(); ok {
+						handler.ServeHTTP(w, r)
+						return
+					}
+					s.renderError(w, http.StatusForbidden, err.Description)
+					return
+				}
 				s.logger.Errorf("failed to create ID token: %v", err)
-				s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+				s.signingErrHelper(w, err)
 				return
 			}
 		}
 	}
 
+	v := url.Values{}
 	if implicitOrHybrid {
-		v := url.Values{}
 		v.Set("access_token", accessToken)
 		v.Set("token_type", "bearer")
 		v.Set("state", authReq.State)
@@ -623,7 +1132,31 @@ func (s *Server) sendCodeResponse(w http.ResponseWriter, r *http.Request, authRe
 		if code.ID != "" {
 			v.Set("code", code.ID)
 		}
+		if idToken != "" {
+			s.logTokenIssued(grantTypeImplicit, authReq.ClientID, authReq.Scopes, idToken, idTokenExpiry)
+		}
+	} else {
+		v.Set("code", code.ID)
+		v.Set("state", authReq.State)
+	}
+
+	inFragment := implicitOrHybrid
+	if authReq.ResponseMode != "" {
+		// The values are replaced by a signed JWT holding them, returned as the
+		// "response" parameter.
+		//
+		// https://openid.net/specs/oauth-v2-jarm.html#section-2.3
+		response, err := s.newAuthResponseJWT(authReq.ClientID, v)
+		if err != nil {
+			s.logger.Errorf("failed to sign authorization response: %v", err)
+			s.renderError(w, http.StatusInternalServerError, "Internal server error.")
+			return
+		}
+		v = url.Values{"response": {response}}
+		inFragment = authReq.ResponseMode == responseModeFragmentJWT
+	}
 
+	if inFragment {
 		// Implicit and hybrid flows return their values as part of the fragment.
 		//
 		//   HTTP/1.1 303 See Other
@@ -644,8 +1177,9 @@ func (s *Server) sendCodeResponse(w http.ResponseWriter, r *http.Request, authRe
 		//     &state=af0ifjsldkj
 		//
 		q := u.Query()
-		q.Set("code", code.ID)
-		q.Set("state", authReq.State)
+		for k := range v {
+			q.Set(k, v.Get(k))
+		}
 		u.RawQuery = q.Encode()
 	}
 
@@ -653,6 +1187,18 @@ func (s *Server) sendCodeResponse(w http.ResponseWriter, r *http.Request, authRe
 }
 
 func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+	// Applies to both successful and error responses.
+	s.cachePolicies.Token.set(w)
+
+	if s.maintenance.tokensBlocked(s.now()) {
+		s.tokenErrHelper(w, errTemporarilyUnavailable, "Server is down for maintenance.", http.StatusServiceUnavailable)
+		return
+	}
+	if err := s.parseTokenRequestBody(r); err != nil {
+		s.writeError(w, err)
+		return
+	}
+
 	clientID, clientSecret, ok := r.BasicAuth()
 	if ok {
 		var err error
@@ -675,33 +1221,141 @@ func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
 			s.logger.Errorf("failed to get client: %v", err)
 			s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
 		} else {
+			s.failureDelay.wait(r.Context())
 			s.tokenErrHelper(w, errInvalidClient, "Invalid client credentials.", http.StatusUnauthorized)
 		}
 		return
 	}
-	if client.Secret != clientSecret {
+	if !clientSecretMatches(client, clientSecret) {
+		s.failureDelay.wait(r.Context())
 		s.tokenErrHelper(w, errInvalidClient, "Invalid client credentials.", http.StatusUnauthorized)
 		return
 	}
 
 	grantType := r.PostFormValue("grant_type")
+	resource, err := s.requestedResource(r)
+	if err != nil {
+		s.tokenErrHelper(w, errInvalidTarget, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if resource != nil && !clientAllowsAudience(client, resource.URI) {
+		s.tokenErrHelper(w, errInvalidTarget, fmt.Sprintf("Client can't request resource %q.", resource.URI), http.StatusBadRequest)
+		return
+	}
 	switch grantType {
 	case grantTypeAuthorizationCode:
-		s.handleAuthCode(w, r, client)
+		s.handleAuthCode(w, r, client, resource)
 	case grantTypeRefreshToken:
-		s.handleRefreshToken(w, r, client)
+		s.handleRefreshToken(w, r, client, resource)
+	case grantTypeTokenExchange:
+		s.handleTokenExchange(w, r, client, resource)
 	default:
 		s.tokenErrHelper(w, errInvalidGrant, "", http.StatusBadRequest)
 	}
 }
 
+// Maximum size of JSON token request bodies.
+const maxJSONTokenRequestBody = 1 << 20
+
+// Memory used for multipart token request bodies, the default of
+// http.Request.FormValue, beyond which files are stored on disk.
+const maxMultipartTokenRequestMemory = 32 << 20
+
+// parseTokenRequestBody checks the content type of a token request. Form
+// encoded bodies are parsed as usual. JSON bodies, when enabled, are parsed
+// into r.PostForm, so their parameters are read the same way. They must be an
+// object of strings or arrays of strings.
+func (s *Server) parseTokenRequestBody(r *http.Request) error {
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return &oauthError{Code: errInvalidRequest, Description: "Invalid content type.", HTTPStatus: http.StatusUnsupportedMediaType}
+	}
+	switch mediaType {
+	case "application/x-www-form-urlencoded", "multipart/form-data":
+		return parseTokenRequestForm(r, mediaType)
+	case "application/json":
+		if s.jsonTokenRequests {
+			break
+		}
+		fallthrough
+	default:
+		return &oauthError{Code: errInvalidRequest, Description: fmt.Sprintf("Unsupported content type %q.", mediaType), HTTPStatus: http.StatusUnsupportedMediaType}
+	}
+
+	var params map[string]json.RawMessage
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxJSONTokenRequestBody)).Decode(&params); err != nil {
+		if requestTimedOut(r, err) {
+			return errRequestTimeout
+		}
+		return &oauthError{Code: errInvalidRequest, Description: "Request body must be a JSON object."}
+	}
+	form := url.Values{}
+	for name, raw := range params {
+		var value string
+		if err := json.Unmarshal(raw, &value); err == nil {
+			form.Set(name, value)
+			continue
+		}
+		var values []string
+		if err := json.Unmarshal(raw, &values); err != nil {
+			return &oauthError{Code: errInvalidRequest, Description: fmt.Sprintf("Parameter %q must be a string or an array of strings.", name)}
+		}
+		form[name] = values
+	}
+	r.PostForm = form
+	return nil
+}
+
+// errRequestTimeout is returned when the body of a token request isn't
+// received before the server's read timeout, or the request's deadline.
+var errRequestTimeout = &oauthError{Code: errInvalidRequest, Description: "Request body was not received in time.", HTTPStatus: http.StatusRequestTimeout}
+
+// parseTokenRequestForm reads a form token request body, so clients sending
+// it too slowly get an error rather than having the request handled with the
+// parameters received so far.
+func parseTokenRequestForm(r *http.Request, mediaType string) error {
+	if r.Context().Err() != nil {
+		return errRequestTimeout
+	}
+	var err error
+	if mediaType == "multipart/form-data" {
+		err = r.ParseMultipartForm(maxMultipartTokenRequestMemory)
+	} else {
+		err = r.ParseForm()
+	}
+	if err == nil {
+		return nil
+	}
+	if requestTimedOut(r, err) {
+		return errRequestTimeout
+	}
+	return &oauthError{Code: errInvalidRequest, Description: "Invalid request body."}
+}
+
+// requestTimedOut reports whether reading a request failed because its
+// deadline passed. The server cancels the context of requests it fails to
+// read, such as when its read timeout passes.
+func requestTimedOut(r *http.Request, err error) bool {
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return true
+	}
+	return r.Context().Err() != nil
+}
+
 // handle an access token request https://tools.ietf.org/html/rfc6749#section-4.1.3
-func (s *Server) handleAuthCode(w http.ResponseWriter, r *http.Request, client storage.Client) {
+func (s *Server) handleAuthCode(w http.ResponseWriter, r *http.Request, client storage.Client, resource *Resource) {
 	code := r.PostFormValue("code")
 	redirectURI := r.PostFormValue("redirect_uri")
 
 	authCode, err := s.storage.GetAuthCode(code)
-	if err != nil || s.now().After(authCode.Expiry) || authCode.ClientID != client.ID {
+	if err == storage.ErrNotFound && s.handleRedeemedCode(w, r, client, code) {
+		return
+	}
+	if err != nil || authCode.ClientID != client.ID {
 		if err != storage.ErrNotFound {
 			s.logger.Errorf("failed to get auth code: %v", err)
 			s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
@@ -710,17 +1364,55 @@ func (s *Server) handleAuthCode(w http.ResponseWriter, r *http.Request, client s
 		}
 		return
 	}
+	if s.now().After(authCode.Expiry) {
+		s.tokenErrHelper(w, errInvalidGrant, "Authorization code has expired.", http.StatusBadRequest)
+		return
+	}
 
+	// Codes requested without a redirect URI, for the client's default one,
+	// are exchanged without one too.
+	if redirectURI == "" && client.DefaultRedirectURI != "" {
+		redirectURI = client.DefaultRedirectURI
+	}
 	if authCode.RedirectURI != redirectURI {
 		s.tokenErrHelper(w, errInvalidRequest, "redirect_uri did not match URI from initial request.", http.StatusBadRequest)
 		return
 	}
 
-	accessToken := storage.NewID()
-	idToken, expiry, err := s.newIDToken(client.ID, authCode.Claims, authCode.Scopes, authCode.Nonce, accessToken, authCode.ConnectorID)
+	if err := verifyCodeVerifier(authCode.PKCE, r.PostFormValue("code_verifier")); err != nil {
+		s.tokenErrHelper(w, errInvalidGrant, fmt.Sprintf("PKCE verification failed: %v.", err), http.StatusBadRequest)
+		return
+	}
+
+	// The user may have been disabled after the code was issued.
+	if disabled, err := s.userDisabled(authCode.ConnectorID, authCode.Claims.UserID); err != nil || disabled {
+		if err != nil {
+			s.logger.Errorf("failed to get user: %v", err)
+			s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+		} else {
+			s.tokenErrHelper(w, errInvalidGrant, "User account is disabled.", http.StatusBadRequest)
+		}
+		return
+	}
+
+	accessToken, err := s.newAccessToken(resource, client.ID, authCode.Claims, authCode.Scopes, authCode.ConnectorID)
 	if err != nil {
+		s.logger.Errorf("failed to create access token: %v", err)
+		s.signingErrHelper(w, err)
+		return
+	}
+	idToken, expiry, err := s.newIDTokenIfOpenID(client.ID, authCode.Claims, authCode.Scopes, authCode.RequestedClaims, authCode.Nonce, accessToken, authCode.ConnectorID)
+	if err != nil {
+		if _, ok := err.(essentialClaimError); ok {
+			s.tokenErrHelper(w, errInvalidRequest, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, ok := err.(tokenDeniedError); ok {
+			s.tokenErrHelper(w, errAccessDenied, err.Error(), http.StatusForbidden)
+			return
+		}
 		s.logger.Errorf("failed to create ID token: %v", err)
-		s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+		s.signingErrHelper(w, err)
 		return
 	}
 
@@ -753,19 +1445,21 @@ func (s *Server) handleAuthCode(w http.ResponseWriter, r *http.Request, client s
 		}
 		return false
 	}()
-	var refreshToken string
+	var refreshToken, refreshID string
 	if reqRefresh {
 		refresh := storage.RefreshToken{
-			ID:            storage.NewID(),
-			Token:         storage.NewID(),
-			ClientID:      authCode.ClientID,
-			ConnectorID:   authCode.ConnectorID,
-			Scopes:        authCode.Scopes,
-			Claims:        authCode.Claims,
-			Nonce:         authCode.Nonce,
-			ConnectorData: authCode.ConnectorData,
-			CreatedAt:     s.now(),
-			LastUsed:      s.now(),
+			ID:              storage.NewID(),
+			Token:           s.secrets.Secret(),
+			ClientID:        authCode.ClientID,
+			ConnectorID:     authCode.ConnectorID,
+			Scopes:          authCode.Scopes,
+			RequestedClaims: authCode.RequestedClaims,
+			Claims:          authCode.Claims,
+			Nonce:           authCode.Nonce,
+			ConnectorData:   authCode.ConnectorData,
+			CreatedAt:       s.now(),
+			LastUsed:        s.now(),
+			IDTokenJTI:      issuedJTI(idToken),
 		}
 		token := &internal.RefreshToken{
 			RefreshId: refresh.ID,
@@ -782,6 +1476,7 @@ func (s *Server) handleAuthCode(w http.ResponseWriter, r *http.Request, client s
 			s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
 			return
 		}
+		refreshID = refresh.ID
 
 		// deleteToken determines if we need to delete the newly created refresh token
 		// due to a failure in updating/creating the OfflineSession object for the
@@ -852,11 +1547,58 @@ func (s *Server) handleAuthCode(w http.ResponseWriter, r *http.Request, client s
 
 		}
 	}
-	s.writeAccessToken(w, idToken, accessToken, refreshToken, expiry)
+	if grace := codeReuseGrace(client); grace > 0 {
+		s.redeemedCodes.add(code, redeemedCode{
+			clientID:     client.ID,
+			request:      codeExchangeHash(r),
+			idToken:      idToken,
+			accessToken:  accessToken,
+			refreshToken: refreshToken,
+			refreshID:    refreshID,
+			scopes:       authCode.Scopes,
+			expiry:       expiry,
+			graceEnd:     s.now().Add(grace),
+			forgetAt:     authCode.Expiry,
+		}, s.now())
+	}
+	s.logTokenIssued(grantTypeAuthorizationCode, client.ID, authCode.Scopes, idToken, expiry)
+	s.writeAccessToken(w, idToken, accessToken, refreshToken, authCode.Scopes, expiry)
 }
 
 // handle a refresh token request https://tools.ietf.org/html/rfc6749#section-6
-func (s *Server) handleRefreshToken(w http.ResponseWriter, r *http.Request, client storage.Client) {
+// refreshTokenExpired describes why a refresh token has expired, either past
+// its absolute lifetime or its idle timeout, or returns an empty string if it
+// hasn't.
+func (s *Server) refreshTokenExpired(refresh storage.RefreshToken) string {
+	now := s.now()
+	if s.refreshTokensValidFor > 0 && now.After(refresh.CreatedAt.Add(s.refreshTokensValidFor)) {
+		return fmt.Sprintf("issued more than %s ago", s.refreshTokensValidFor)
+	}
+	if s.refreshTokensIdleTimeout > 0 && now.After(refresh.LastUsed.Add(s.refreshTokensIdleTimeout)) {
+		return fmt.Sprintf("unused for more than %s", s.refreshTokensIdleTimeout)
+	}
+	return ""
+}
+
+// deleteRefreshToken removes a refresh token along with its reference in the
+// user's offline session.
+func (s *Server) deleteRefreshToken(refresh storage.RefreshToken) error {
+	err := s.storage.UpdateOfflineSessions(refresh.Claims.UserID, refresh.ConnectorID, func(old storage.OfflineSessions) (storage.OfflineSessions, error) {
+		if ref, ok := old.Refresh[refresh.ClientID]; ok && ref.ID == refresh.ID {
+			delete(old.Refresh, refresh.ClientID)
+		}
+		return old, nil
+	})
+	if err != nil && err != storage.ErrNotFound {
+		return fmt.Errorf("update offline session: %v", err)
+	}
+	if err := s.storage.DeleteRefresh(refresh.ID); err != nil && err != storage.ErrNotFound {
+		return fmt.Errorf("delete refresh token: %v", err)
+	}
+	return nil
+}
+
+func (s *Server) handleRefreshToken(w http.ResponseWriter, r *http.Request, client storage.Client, resource *Resource) {
 	code := r.PostFormValue("refresh_token")
 	scope := r.PostFormValue("scope")
 	if code == "" {
@@ -885,9 +1627,10 @@ func (s *Server) handleRefreshToken(w http.ResponseWriter, r *http.Request, clie
 		}
 		return
 	}
+	// Refresh tokens are bound to the client they were issued to.
 	if refresh.ClientID != client.ID {
 		s.logger.Errorf("client %s trying to claim token for client %s", client.ID, refresh.ClientID)
-		s.tokenErrHelper(w, errInvalidRequest, "Refresh token is invalid or has already been claimed by another client.", http.StatusBadRequest)
+		s.tokenErrHelper(w, errInvalidGrant, "Refresh token is invalid or has already been claimed by another client.", http.StatusBadRequest)
 		return
 	}
 	if refresh.Token != token.Token {
@@ -895,6 +1638,48 @@ func (s *Server) handleRefreshToken(w http.ResponseWriter, r *http.Request, clie
 		s.tokenErrHelper(w, errInvalidRequest, "Refresh token is invalid or has already been claimed by another client.", http.StatusBadRequest)
 		return
 	}
+	if reason := s.refreshTokenExpired(refresh); reason != "" {
+		s.logger.Infof("refresh token %s expired: %s", refresh.ID, reason)
+		// Expired tokens can never be used again, so the user has to login to
+		// get a new one. Clean them up rather than waiting for a revocation.
+		if err := s.deleteRefreshToken(refresh); err != nil {
+			s.logger.Errorf("failed to delete expired refresh token: %v", err)
+		}
+		s.tokenErrHelper(w, errInvalidGrant, "Refresh token has expired.", http.StatusBadRequest)
+		return
+	}
+	if s.sessionIdleTimeout > 0 && refresh.Claims.SessionID != "" {
+		lastUsed, err := s.sessionLastUsed(refresh)
+		if err != nil {
+			s.logger.Errorf("failed to get login session: %v", err)
+			s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+			return
+		}
+		if s.now().After(lastUsed.Add(s.sessionIdleTimeout)) {
+			s.logger.Infof("refresh token %s expired: login session unused for more than %s", refresh.ID, s.sessionIdleTimeout)
+			// The session has ended for all its clients.
+			if _, err := s.endSession(refresh.Claims.UserID, refresh.ConnectorID, sessionIDHash(refresh.Claims.SessionID)); err != nil {
+				s.logger.Errorf("failed to end idle login session: %v", err)
+			}
+			s.tokenErrHelper(w, errInvalidGrant, "Login session has expired.", http.StatusBadRequest)
+			return
+		}
+	}
+	// Revoking the last ID token issued with a refresh token revokes the
+	// refresh token too, so the client can't get a replacement.
+	if revoked, err := s.tokenRevoked(refresh.IDTokenJTI); err != nil || revoked {
+		if err != nil {
+			s.logger.Errorf("failed to check revocation: %v", err)
+			s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+			return
+		}
+		s.logger.Infof("refresh token %s was revoked with its ID token %q", refresh.ID, refresh.IDTokenJTI)
+		if err := s.deleteRefreshToken(refresh); err != nil {
+			s.logger.Errorf("failed to delete revoked refresh token: %v", err)
+		}
+		s.tokenErrHelper(w, errInvalidGrant, "Refresh token has been revoked.", http.StatusBadRequest)
+		return
+	}
 
 	// Per the OAuth2 spec, if the client has omitted the scopes, default to the original
 	// authorized scopes.
@@ -927,6 +1712,28 @@ func (s *Server) handleRefreshToken(w http.ResponseWriter, r *http.Request, clie
 		scopes = requestedScopes
 	}
 
+	// Refresh tokens are also bound to the connector the user logged in with,
+	// and stop working once it's removed.
+	if _, err := s.storage.GetConnector(refresh.ConnectorID); err != nil {
+		if err != storage.ErrNotFound {
+			s.logger.Errorf("failed to get connector %q: %v", refresh.ConnectorID, err)
+			s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+			return
+		}
+		s.logger.Errorf("refresh token %s was issued by removed connector %q", refresh.ID, refresh.ConnectorID)
+		s.tokenErrHelper(w, errInvalidGrant, "Connector used to log in is no longer available.", http.StatusBadRequest)
+		return
+	}
+	if disabled, err := s.userDisabled(refresh.ConnectorID, refresh.Claims.UserID); err != nil || disabled {
+		if err != nil {
+			s.logger.Errorf("failed to get user: %v", err)
+			s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+		} else {
+			s.logger.Errorf("refresh token %s belongs to a disabled user", refresh.ID)
+			s.tokenErrHelper(w, errInvalidGrant, "User account is disabled.", http.StatusBadRequest)
+		}
+		return
+	}
 	conn, err := s.getConnector(refresh.ConnectorID)
 	if err != nil {
 		s.logger.Errorf("connector with ID %q not found: %v", refresh.ConnectorID, err)
@@ -939,6 +1746,7 @@ func (s *Server) handleRefreshToken(w http.ResponseWriter, r *http.Request, clie
 		Email:         refresh.Claims.Email,
 		EmailVerified: refresh.Claims.EmailVerified,
 		Groups:        refresh.Claims.Groups,
+		Picture:       refresh.Claims.Picture,
 		ConnectorData: refresh.ConnectorData,
 	}
 
@@ -947,14 +1755,49 @@ func (s *Server) handleRefreshToken(w http.ResponseWriter, r *http.Request, clie
 	//
 	// TODO(ericchiang): We may want a strict mode where connectors that don't implement
 	// this interface can't perform refreshing.
+	updatedAt := refresh.Claims.UpdatedAt
 	if refreshConn, ok := conn.Connector.(connector.RefreshConnector); ok {
-		newIdent, err := refreshConn.Refresh(r.Context(), parseScopes(scopes), ident)
+		newIdent, err := refreshConn.Refresh(connectorContext(r, conn), s.parseScopes(scopes), ident)
 		if err != nil {
 			s.logger.Errorf("failed to refresh identity: %v", err)
 			s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
 			return
 		}
 		ident = newIdent
+		if ident.Email == "" {
+			switch s.missingEmailPolicy {
+			case missingEmailReject:
+				s.tokenErrHelper(w, errInvalidGrant, "User account has no email address.", http.StatusBadRequest)
+				return
+			case missingEmailPrompt:
+				// Keep the email the user entered when logging in.
+				ident.Email = refresh.Claims.Email
+				ident.EmailVerified = false
+			}
+		}
+
+		// Record any changes to the profile the connector found.
+		user, err := s.linkIdentity(conn, refresh.ConnectorID, ident)
+		if err == errUserNotFound {
+			s.logger.Errorf("refresh token %s belongs to a user which no longer exists", refresh.ID)
+			s.tokenErrHelper(w, errInvalidGrant, "User account does not exist.", http.StatusBadRequest)
+			return
+		}
+		if err == errAttributeMissing {
+			s.tokenErrHelper(w, errInvalidGrant, "The login provider didn't return all the required user information.", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			s.logger.Errorf("failed to link identity: %v", err)
+			s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+			return
+		}
+		updatedAt = user.UpdatedAt
+	}
+	if client.RequireEmailVerified && !ident.EmailVerified {
+		s.logger.Errorf("refresh token %s belongs to a user without a verified email", refresh.ID)
+		s.tokenErrHelper(w, errInvalidGrant, "Email address is not verified.", http.StatusBadRequest)
+		return
 	}
 
 	claims := storage.Claims{
@@ -963,19 +1806,37 @@ func (s *Server) handleRefreshToken(w http.ResponseWriter, r *http.Request, clie
 		Email:         ident.Email,
 		EmailVerified: ident.EmailVerified,
 		Groups:        ident.Groups,
+		Picture:       s.pictureURL(refresh.ConnectorID, ident.Picture),
+		UpdatedAt:     updatedAt,
+		// The user didn't authenticate again.
+		AuthTime:  refresh.Claims.AuthTime,
+		SessionID: refresh.Claims.SessionID,
 	}
 
-	accessToken := storage.NewID()
-	idToken, expiry, err := s.newIDToken(client.ID, claims, scopes, refresh.Nonce, accessToken, refresh.ConnectorID)
+	accessToken, err := s.newAccessToken(resource, client.ID, claims, scopes, refresh.ConnectorID)
 	if err != nil {
+		s.logger.Errorf("failed to create access token: %v", err)
+		s.signingErrHelper(w, err)
+		return
+	}
+	idToken, expiry, err := s.newIDTokenIfOpenID(client.ID, claims, scopes, refresh.RequestedClaims, refresh.Nonce, accessToken, refresh.ConnectorID)
+	if err != nil {
+		if _, ok := err.(essentialClaimError); ok {
+			s.tokenErrHelper(w, errInvalidRequest, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, ok := err.(tokenDeniedError); ok {
+			s.tokenErrHelper(w, errAccessDenied, err.Error(), http.StatusForbidden)
+			return
+		}
 		s.logger.Errorf("failed to create ID token: %v", err)
-		s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+		s.signingErrHelper(w, err)
 		return
 	}
 
 	newToken := &internal.RefreshToken{
 		RefreshId: refresh.ID,
-		Token:     storage.NewID(),
+		Token:     s.secrets.Secret(),
 	}
 	rawNewToken, err := internal.Marshal(newToken)
 	if err != nil {
@@ -997,8 +1858,11 @@ func (s *Server) handleRefreshToken(w http.ResponseWriter, r *http.Request, clie
 		old.Claims.Email = ident.Email
 		old.Claims.EmailVerified = ident.EmailVerified
 		old.Claims.Groups = ident.Groups
+		old.Claims.Picture = claims.Picture
+		old.Claims.UpdatedAt = claims.UpdatedAt
 		old.ConnectorData = ident.ConnectorData
 		old.LastUsed = lastUsed
+		old.IDTokenJTI = issuedJTI(idToken)
 		return old, nil
 	}
 
@@ -1023,10 +1887,11 @@ func (s *Server) handleRefreshToken(w http.ResponseWriter, r *http.Request, clie
 		return
 	}
 
-	s.writeAccessToken(w, idToken, accessToken, rawNewToken, expiry)
+	s.logTokenIssued(grantTypeRefreshToken, client.ID, scopes, idToken, expiry)
+	s.writeAccessToken(w, idToken, accessToken, rawNewToken, scopes, expiry)
 }
 
-func (s *Server) writeAccessToken(w http.ResponseWriter, idToken, accessToken, refreshToken string, expiry time.Time) {
+func (s *Server) writeAccessToken(w http.ResponseWriter, idToken, accessToken, refreshToken string, scopes []string, expiry time.Time) {
 	// TODO(ericchiang): figure out an access token story and support the user info
 	// endpoint. For now use a random value so no one depends on the access_token
 	// holding a specific structure.
@@ -1035,13 +1900,18 @@ func (s *Server) writeAccessToken(w http.ResponseWriter, idToken, accessToken, r
 		TokenType    string `json:"token_type"`
 		ExpiresIn    int    `json:"expires_in"`
 		RefreshToken string `json:"refresh_token,omitempty"`
-		IDToken      string `json:"id_token"`
+		// Not issued to plain OAuth2 requests.
+		IDToken string `json:"id_token,omitempty"`
+		// Scopes may differ from the requested ones if the connector granted
+		// more.
+		Scope string `json:"scope,omitempty"`
 	}{
 		accessToken,
 		"bearer",
 		int(expiry.Sub(s.now()).Seconds()),
 		refreshToken,
 		idToken,
+		strings.Join(scopes, " "),
 	}
 	data, err := json.Marshal(resp)
 	if err != nil {
@@ -1055,15 +1925,84 @@ func (s *Server) writeAccessToken(w http.ResponseWriter, idToken, accessToken, r
 }
 
 func (s *Server) renderError(w http.ResponseWriter, status int, description string) {
-	if err := s.templates.err(w, status, description); err != nil {
+	s.renderErrorWith(w, s.templates, status, description)
+}
+
+// renderErrorWith renders an error page with the given templates, such as the
+// ones of a connector with its own branding.
+func (s *Server) renderErrorWith(w http.ResponseWriter, tmpls *templates, status int, description string) {
+	if err := tmpls.err(w, status, description); err != nil {
 		s.logger.Errorf("Server template error: %v", err)
 	}
 }
 
+// renderAuthError responds with an authorization error that can't be sent to
+// the client's redirect URI. Browsers get an error page and API clients, which
+// ask for JSON, an OAuth2 error response.
+func (s *Server) renderAuthError(w http.ResponseWriter, r *http.Request, err *authErr) {
+	if prefersJSON(r) {
+		s.writeError(w, err.oauthError())
+		return
+	}
+	s.renderError(w, s.errorStatus(err.oauthError()), err.Description)
+}
+
+// prefersJSON reports if the Accept header of a request ranks JSON above HTML.
+// Wildcards are ignored, so requests without a preference get HTML.
+func prefersJSON(r *http.Request) bool {
+	htmlQ, jsonQ := -1.0, -1.0
+	for _, mediaRange := range strings.Split(r.Header.Get("Accept"), ",") {
+		params := strings.Split(mediaRange, ";")
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		switch strings.ToLower(strings.TrimSpace(params[0])) {
+		case "text/html":
+			if q > htmlQ {
+				htmlQ = q
+			}
+		case "application/json":
+			if q > jsonQ {
+				jsonQ = q
+			}
+		}
+	}
+	return jsonQ > 0 && jsonQ > htmlQ
+}
+
 func (s *Server) tokenErrHelper(w http.ResponseWriter, typ string, description string, statusCode int) {
-	if err := tokenErr(w, typ, description, statusCode); err != nil {
-		s.logger.Errorf("token error response: %v", err)
+	s.writeError(w, &oauthError{Code: typ, Description: description, HTTPStatus: statusCode})
+}
+
+// writeError writes an error as an OAuth2 error response. Errors other than
+// an oauthError are logged, and only reported as a server_error.
+func (s *Server) writeError(w http.ResponseWriter, err error) {
+	oauthErr, ok := err.(*oauthError)
+	if !ok {
+		s.logger.Errorf("internal error: %v", err)
+		oauthErr = &oauthError{Code: errServerError, HTTPStatus: http.StatusInternalServerError}
+	}
+	data := struct {
+		Error       string `json:"error"`
+		Description string `json:"error_description,omitempty"`
+		State       string `json:"state,omitempty"`
+	}{oauthErr.Code, oauthErr.Description, oauthErr.State}
+	body, err := json.Marshal(data)
+	if err != nil {
+		s.logger.Errorf("failed to marshal error response: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(s.errorStatus(oauthErr))
+	w.Write(body)
 }
 
 // Check for username prompt override from connector. Defaults to "Username".
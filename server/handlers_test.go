@@ -1,12 +1,21 @@
 package server
 
 import (
+	"bufio"
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/dexidp/dex/server/internal"
 	"github.com/dexidp/dex/storage"
 )
 
@@ -48,3 +57,1547 @@ func TestHandleHealthFailure(t *testing.T) {
 		t.Errorf("expected 500 got %d", rr.Code)
 	}
 }
+
+type countingHealthChecker struct {
+	calls int32
+	err   error
+}
+
+func (c *countingHealthChecker) Healthy(ctx context.Context) error {
+	atomic.AddInt32(&c.calls, 1)
+	return c.err
+}
+
+func TestHandleConnectorHealth(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	now := time.Now()
+	httpServer, server := newTestServer(ctx, t, func(c *Config) {
+		c.Now = func() time.Time { return now }
+		c.ConnectorHealthTTL = 10 * time.Second
+	})
+	defer httpServer.Close()
+
+	checker := &countingHealthChecker{}
+	server.mu.Lock()
+	server.connectors["mock"] = Connector{ResourceVersion: "1", Connector: checker}
+	server.mu.Unlock()
+
+	get := func(path string) int {
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		return rr.Code
+	}
+
+	for i := 0; i < 3; i++ {
+		if code := get("/healthz/connectors"); code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", code)
+		}
+	}
+	if calls := atomic.LoadInt32(&checker.calls); calls != 1 {
+		t.Errorf("expected checks within the TTL to reuse the first result, connector was checked %d times", calls)
+	}
+
+	checker.err = errors.New("upstream unreachable")
+	if code := get("/healthz/connectors"); code != http.StatusOK {
+		t.Errorf("expected the cached result within the TTL, got %d", code)
+	}
+	if code := get("/healthz/connectors?fresh=1"); code != http.StatusServiceUnavailable {
+		t.Errorf("expected a fresh check to report the failure, got %d", code)
+	}
+
+	checker.err = nil
+	now = now.Add(11 * time.Second)
+	if code := get("/healthz/connectors"); code != http.StatusOK {
+		t.Errorf("expected a new check after the TTL, got %d", code)
+	}
+	if calls := atomic.LoadInt32(&checker.calls); calls != 3 {
+		t.Errorf("expected the connector to be checked 3 times, got %d", calls)
+	}
+}
+
+func TestConnectorRecovery(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, server := newTestServer(ctx, t, nil)
+	defer httpServer.Close()
+
+	checker := &countingHealthChecker{}
+	server.mu.Lock()
+	server.connectors["mock"] = Connector{ResourceVersion: "1", Connector: checker}
+	server.mu.Unlock()
+
+	reopened := 0
+	server.connectorHealth.reopen = func(id string) error {
+		if id != "mock" {
+			t.Errorf("expected connector mock to be reopened, got %q", id)
+		}
+		reopened++
+		return nil
+	}
+
+	failure := errors.New("upstream unreachable")
+	for i, step := range []struct {
+		err          error
+		wantReopened int
+	}{
+		{nil, 0},
+		{failure, 0},
+		{failure, 0},
+		{nil, 1},
+		{nil, 1},
+		{failure, 1},
+		{nil, 2},
+	} {
+		checker.err = step.err
+		server.connectorHealth.check(true)
+		if reopened != step.wantReopened {
+			t.Fatalf("check %d: expected the connector to be reopened %d times, got %d", i, step.wantReopened, reopened)
+		}
+	}
+
+	// Reopening replaces the connector in use.
+	server.connectorHealth.reopen = server.reopenConnector
+	checker.err = failure
+	server.connectorHealth.check(true)
+	checker.err = nil
+	server.connectorHealth.check(true)
+	server.mu.Lock()
+	conn := server.connectors["mock"]
+	server.mu.Unlock()
+	if conn.Connector == checker {
+		t.Errorf("expected the recovered connector to be reopened")
+	}
+}
+
+func TestAuthCodeExpiry(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	now := time.Now()
+	httpServer, server := newTestServer(ctx, t, func(c *Config) {
+		c.Now = func() time.Time { return now }
+		c.AuthCodesValidFor = 5 * time.Minute
+	})
+	defer httpServer.Close()
+
+	client := storage.Client{
+		ID:           "client",
+		Secret:       "secret",
+		RedirectURIs: []string{"https://example.com/callback"},
+	}
+	if err := server.storage.CreateClient(client); err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	expired := newTestAuthCode(t, server, client)
+	now = now.Add(6 * time.Minute)
+	fresh := newTestAuthCode(t, server, client)
+
+	if rr := exchangeTestAuthCode(server, client, fresh); rr.Code != http.StatusOK {
+		t.Errorf("expected fresh code to be exchanged, got %d: %s", rr.Code, rr.Body)
+	}
+
+	rr := exchangeTestAuthCode(server, client, expired)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected expired code to be rejected, got %d: %s", rr.Code, rr.Body)
+	}
+	var resp struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("unmarshal error response: %v", err)
+	}
+	if resp.Error != errInvalidGrant {
+		t.Errorf("expected error %q, got %q", errInvalidGrant, resp.Error)
+	}
+}
+
+// newTestAuthCode issues a code to the client the same way the authorization
+// endpoint does after a successful login.
+func newTestAuthCode(t *testing.T, s *Server, client storage.Client) string {
+	authReq := storage.AuthRequest{
+		ID:            storage.NewID(),
+		ClientID:      client.ID,
+		ConnectorID:   "mock",
+		ResponseTypes: []string{responseTypeCode},
+		Scopes:        []string{scopeOpenID},
+		RedirectURI:   client.RedirectURIs[0],
+		LoggedIn:      true,
+		Claims:        storage.Claims{UserID: "1"},
+		Expiry:        s.now().Add(time.Hour),
+	}
+	if err := s.storage.CreateAuthRequest(authReq); err != nil {
+		t.Fatalf("create auth request: %v", err)
+	}
+	rr := httptest.NewRecorder()
+	s.sendCodeResponse(rr, httptest.NewRequest("GET", "/approval", nil), authReq)
+	u, err := url.Parse(rr.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("parse redirect: %v", err)
+	}
+	return u.Query().Get("code")
+}
+
+func exchangeTestAuthCode(s *Server, client storage.Client, code string) *httptest.ResponseRecorder {
+	form := url.Values{
+		"grant_type":   {grantTypeAuthorizationCode},
+		"code":         {code},
+		"redirect_uri": {client.RedirectURIs[0]},
+	}
+	req := httptest.NewRequest("POST", s.absPath("/token"), strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(client.ID, client.Secret)
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, req)
+	return rr
+}
+
+// testTokens are the tokens a client ends up with after testLoginFlow.
+type testTokens struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	IDToken      string `json:"id_token"`
+	Scope        string `json:"scope"`
+
+	// Claims of the ID token, once verified.
+	Claims idTokenClaims `json:"-"`
+}
+
+// testLogin logs a user in through the authorization endpoint the way a
+// browser would: it follows the redirects to the connector, back through its
+// callback and past the approval page, and returns the code sent to the
+// client's redirect URI. params add to, or replace, the parameters of the
+// authorization request, which default to a code request for the openid scope.
+func testLogin(t *testing.T, s *Server, client storage.Client, params url.Values) string {
+	t.Helper()
+	q := url.Values{
+		"client_id":     {client.ID},
+		"redirect_uri":  {client.RedirectURIs[0]},
+		"response_type": {responseTypeCode},
+		"scope":         {scopeOpenID},
+		"state":         {"test-state"},
+	}
+	for k, v := range params {
+		q[k] = v
+	}
+
+	req := httptest.NewRequest("GET", s.absPath("/auth")+"?"+q.Encode(), nil)
+	for hops := 0; hops < 10; hops++ {
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, req)
+
+		if rr.Code == http.StatusOK && req.URL.Path == s.absPath("/approval") {
+			form := url.Values{"req": {req.URL.Query().Get("req")}, "approval": {"approve"}}
+			req = httptest.NewRequest("POST", s.absPath("/approval"), strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			continue
+		}
+		location := rr.Header().Get("Location")
+		if location == "" {
+			t.Fatalf("login stopped at %s with %d: %s", req.URL.Path, rr.Code, rr.Body)
+		}
+		u, err := url.Parse(location)
+		if err != nil {
+			t.Fatalf("parse redirect %q: %v", location, err)
+		}
+		if strings.HasPrefix(location, q.Get("redirect_uri")) {
+			if errCode := u.Query().Get("error"); errCode != "" {
+				t.Fatalf("login failed: %s: %s", errCode, u.Query().Get("error_description"))
+			}
+			if state := u.Query().Get("state"); state != q.Get("state") {
+				t.Fatalf("expected state %q, got %q", q.Get("state"), state)
+			}
+			return u.Query().Get("code")
+		}
+		req = httptest.NewRequest("GET", u.RequestURI(), nil)
+	}
+	t.Fatalf("login didn't reach the client's redirect URI")
+	return ""
+}
+
+// testLoginFlow logs a user in with testLogin, exchanges the code at the token
+// endpoint and returns the tokens with the claims of the verified ID token.
+func testLoginFlow(t *testing.T, s *Server, client storage.Client, params url.Values) testTokens {
+	t.Helper()
+	code := testLogin(t, s, client, params)
+	rr := exchangeTestAuthCode(s, client, code)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("exchange code: expected 200, got %d: %s", rr.Code, rr.Body)
+	}
+	var tokens testTokens
+	if err := json.Unmarshal(rr.Body.Bytes(), &tokens); err != nil {
+		t.Fatalf("unmarshal token response: %v", err)
+	}
+	claims, err := s.verifyIDToken(tokens.IDToken)
+	if err != nil {
+		t.Fatalf("verify id token: %v", err)
+	}
+	tokens.Claims = claims
+	return tokens
+}
+
+func TestLoginFlow(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for _, skipApproval := range []bool{true, false} {
+		httpServer, server := newTestServer(ctx, t, func(c *Config) {
+			c.Issuer = c.Issuer + "/dex"
+		})
+		defer httpServer.Close()
+		server.skipApproval = skipApproval
+
+		client := storage.Client{ID: "client", Secret: "secret", RedirectURIs: []string{"https://example.com/callback"}}
+		if err := server.storage.CreateClient(client); err != nil {
+			t.Fatalf("create client: %v", err)
+		}
+
+		tokens := testLoginFlow(t, server, client, url.Values{
+			"scope": {"openid email offline_access"},
+			"nonce": {"test-nonce"},
+		})
+		claims := tokens.Claims
+		if len(claims.Audience) != 1 || claims.Audience[0] != client.ID {
+			t.Errorf("expected audience %q, got %q", client.ID, claims.Audience)
+		}
+		if claims.Nonce != "test-nonce" {
+			t.Errorf("expected nonce %q, got %q", "test-nonce", claims.Nonce)
+		}
+		// The identity returned by the mock connector.
+		if claims.Email != "kilgore@kilgore.trout" {
+			t.Errorf("expected the mock connector's email, got %q", claims.Email)
+		}
+		var subject internal.IDTokenSubject
+		if err := internal.Unmarshal(claims.Subject, &subject); err != nil {
+			t.Fatalf("unmarshal subject: %v", err)
+		}
+		if subject.ConnId != "mock" || subject.UserId != "0-385-28089-0" {
+			t.Errorf("expected the mock connector's user, got %+v", subject)
+		}
+		if tokens.AccessToken == "" || tokens.RefreshToken == "" {
+			t.Errorf("expected an access and a refresh token, got %+v", tokens)
+		}
+	}
+}
+
+func TestOAuth2OnlyClient(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, server := newTestServer(ctx, t, func(c *Config) {
+		c.SupportedResponseTypes = []string{responseTypeCode, responseTypeIDToken}
+	})
+	defer httpServer.Close()
+
+	oauth2Client := storage.Client{ID: "gateway", Secret: "secret", RedirectURIs: []string{"https://gateway.example.com/callback"}, OAuth2Only: true}
+	oidcClient := storage.Client{ID: "app", Secret: "secret", RedirectURIs: []string{"https://app.example.com/callback"}}
+	for _, c := range []storage.Client{oauth2Client, oidcClient} {
+		if err := server.storage.CreateClient(c); err != nil {
+			t.Fatalf("create client: %v", err)
+		}
+	}
+
+	type tokenResponse struct {
+		AccessToken  string  `json:"access_token"`
+		RefreshToken string  `json:"refresh_token"`
+		IDToken      *string `json:"id_token"`
+	}
+	decode := func(rr *httptest.ResponseRecorder) tokenResponse {
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body)
+		}
+		var resp tokenResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("unmarshal token response: %v", err)
+		}
+		return resp
+	}
+
+	code := testLogin(t, server, oauth2Client, url.Values{"scope": {"offline_access"}})
+	resp := decode(exchangeTestAuthCode(server, oauth2Client, code))
+	if resp.AccessToken == "" || resp.RefreshToken == "" {
+		t.Errorf("expected an access and a refresh token, got %+v", resp)
+	}
+	if resp.IDToken != nil {
+		t.Errorf("expected no ID token without the openid scope, got %q", *resp.IDToken)
+	}
+
+	form := url.Values{"grant_type": {grantTypeRefreshToken}, "refresh_token": {resp.RefreshToken}}
+	req := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(oauth2Client.ID, oauth2Client.Secret)
+	rr := httptest.NewRecorder()
+	server.ServeHTTP(rr, req)
+	if resp := decode(rr); resp.AccessToken == "" || resp.IDToken != nil {
+		t.Errorf("expected a refresh without an ID token, got %+v", resp)
+	}
+
+	// With openid, the client gets an ID token as usual.
+	tokens := testLoginFlow(t, server, oauth2Client, url.Values{"scope": {"openid"}})
+	if tokens.IDToken == "" {
+		t.Errorf("expected an ID token with the openid scope")
+	}
+
+	authError := func(client storage.Client, responseType string) string {
+		q := url.Values{
+			"client_id":     {client.ID},
+			"redirect_uri":  {client.RedirectURIs[0]},
+			"response_type": {responseType},
+			"scope":         {"email"},
+			"nonce":         {"nonce"},
+		}
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, httptest.NewRequest("GET", "/auth?"+q.Encode(), nil))
+		u, err := url.Parse(rr.Header().Get("Location"))
+		if err != nil {
+			t.Fatalf("parse redirect: %v", err)
+		}
+		return u.Query().Get("error")
+	}
+	if got := authError(oidcClient, responseTypeCode); got != errInvalidScope {
+		t.Errorf("expected a client without oauth2Only to require openid, got error %q", got)
+	}
+	if got := authError(oauth2Client, responseTypeIDToken); got != errInvalidRequest {
+		t.Errorf("expected the id_token response type to require openid, got error %q", got)
+	}
+}
+
+func TestRefreshTokenBinding(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, server := newTestServer(ctx, t, nil)
+	defer httpServer.Close()
+
+	clientA := storage.Client{ID: "client-a", Secret: "secret-a", RedirectURIs: []string{"https://a.example.com/callback"}}
+	clientB := storage.Client{ID: "client-b", Secret: "secret-b", RedirectURIs: []string{"https://b.example.com/callback"}}
+	for _, c := range []storage.Client{clientA, clientB} {
+		if err := server.storage.CreateClient(c); err != nil {
+			t.Fatalf("create client: %v", err)
+		}
+	}
+
+	offlineSession := storage.OfflineSessions{
+		UserID:  "1",
+		ConnID:  "mock",
+		Refresh: make(map[string]*storage.RefreshTokenRef),
+	}
+	if err := server.storage.CreateOfflineSessions(offlineSession); err != nil {
+		t.Fatalf("create offline session: %v", err)
+	}
+
+	newRefreshToken := func() string {
+		refresh := storage.RefreshToken{
+			ID:          storage.NewID(),
+			Token:       storage.NewID(),
+			ClientID:    clientA.ID,
+			ConnectorID: "mock",
+			Scopes:      []string{scopeOpenID, scopeOfflineAccess},
+			Claims:      storage.Claims{UserID: "1"},
+			CreatedAt:   server.now(),
+			LastUsed:    server.now(),
+		}
+		if err := server.storage.CreateRefresh(refresh); err != nil {
+			t.Fatalf("create refresh token: %v", err)
+		}
+		err := server.storage.UpdateOfflineSessions("1", "mock", func(old storage.OfflineSessions) (storage.OfflineSessions, error) {
+			old.Refresh[clientA.ID] = &storage.RefreshTokenRef{ID: refresh.ID, ClientID: clientA.ID}
+			return old, nil
+		})
+		if err != nil {
+			t.Fatalf("update offline session: %v", err)
+		}
+		token, err := internal.Marshal(&internal.RefreshToken{RefreshId: refresh.ID, Token: refresh.Token})
+		if err != nil {
+			t.Fatalf("marshal refresh token: %v", err)
+		}
+		return token
+	}
+
+	useRefreshToken := func(client storage.Client, token string) (int, string) {
+		form := url.Values{
+			"grant_type":    {grantTypeRefreshToken},
+			"refresh_token": {token},
+		}
+		req := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(client.ID, client.Secret)
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, req)
+
+		var resp struct {
+			Error string `json:"error"`
+		}
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		return rr.Code, resp.Error
+	}
+
+	if code, errType := useRefreshToken(clientB, newRefreshToken()); code != http.StatusBadRequest || errType != errInvalidGrant {
+		t.Errorf("expected another client's refresh token to be rejected with %q, got %d %q", errInvalidGrant, code, errType)
+	}
+	if code, _ := useRefreshToken(clientA, newRefreshToken()); code != http.StatusOK {
+		t.Errorf("expected refresh token to be accepted from the client it was issued to, got %d", code)
+	}
+
+	token := newRefreshToken()
+	if err := server.storage.DeleteConnector("mock"); err != nil {
+		t.Fatalf("delete connector: %v", err)
+	}
+	if code, errType := useRefreshToken(clientA, token); code != http.StatusBadRequest || errType != errInvalidGrant {
+		t.Errorf("expected refresh token from a removed connector to be rejected with %q, got %d %q", errInvalidGrant, code, errType)
+	}
+}
+
+func TestRefreshTokenExpiry(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	now := time.Now()
+	httpServer, server := newTestServer(ctx, t, func(c *Config) {
+		c.Now = func() time.Time { return now }
+		c.IDTokensValidFor = time.Hour
+		c.RefreshTokensValidFor = 2 * time.Hour
+		c.RefreshTokensIdleTimeout = time.Hour
+	})
+	defer httpServer.Close()
+
+	client := storage.Client{ID: "client", Secret: "secret", RedirectURIs: []string{"https://example.com/callback"}}
+	if err := server.storage.CreateClient(client); err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+	offlineSession := storage.OfflineSessions{
+		UserID:  "1",
+		ConnID:  "mock",
+		Refresh: make(map[string]*storage.RefreshTokenRef),
+	}
+	if err := server.storage.CreateOfflineSessions(offlineSession); err != nil {
+		t.Fatalf("create offline session: %v", err)
+	}
+
+	newRefreshToken := func() string {
+		refresh := storage.RefreshToken{
+			ID:          storage.NewID(),
+			Token:       storage.NewID(),
+			ClientID:    client.ID,
+			ConnectorID: "mock",
+			Scopes:      []string{scopeOpenID, scopeOfflineAccess},
+			Claims:      storage.Claims{UserID: "1"},
+			CreatedAt:   now,
+			LastUsed:    now,
+		}
+		if err := server.storage.CreateRefresh(refresh); err != nil {
+			t.Fatalf("create refresh token: %v", err)
+		}
+		err := server.storage.UpdateOfflineSessions("1", "mock", func(old storage.OfflineSessions) (storage.OfflineSessions, error) {
+			old.Refresh[client.ID] = &storage.RefreshTokenRef{ID: refresh.ID, ClientID: client.ID}
+			return old, nil
+		})
+		if err != nil {
+			t.Fatalf("update offline session: %v", err)
+		}
+		token, err := internal.Marshal(&internal.RefreshToken{RefreshId: refresh.ID, Token: refresh.Token})
+		if err != nil {
+			t.Fatalf("marshal refresh token: %v", err)
+		}
+		return token
+	}
+
+	// useRefreshToken returns the refresh token issued in exchange, or the
+	// error of the token response.
+	useRefreshToken := func(token string) (string, string) {
+		form := url.Values{
+			"grant_type":    {grantTypeRefreshToken},
+			"refresh_token": {token},
+		}
+		req := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(client.ID, client.Secret)
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, req)
+
+		var resp struct {
+			RefreshToken string `json:"refresh_token"`
+			Error        string `json:"error"`
+		}
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		return resp.RefreshToken, resp.Error
+	}
+
+	// Each use within the idle timeout extends the token's life, up to its
+	// absolute lifetime.
+	token := newRefreshToken()
+	for i := 0; i < 2; i++ {
+		now = now.Add(50 * time.Minute)
+		var errType string
+		if token, errType = useRefreshToken(token); errType != "" {
+			t.Fatalf("use %d: expected refresh token to be accepted, got %q", i, errType)
+		}
+	}
+	now = now.Add(50 * time.Minute)
+	if _, errType := useRefreshToken(token); errType != errInvalidGrant {
+		t.Errorf("expected refresh token past its absolute lifetime to be rejected with %q, got %q", errInvalidGrant, errType)
+	}
+	// Expired tokens are deleted, along with their offline session reference.
+	checkDeleted := func(token string) {
+		var rt internal.RefreshToken
+		if err := internal.Unmarshal(token, &rt); err != nil {
+			t.Fatalf("unmarshal refresh token: %v", err)
+		}
+		if _, err := server.storage.GetRefresh(rt.RefreshId); err != storage.ErrNotFound {
+			t.Errorf("expected expired refresh token to be deleted, got %v", err)
+		}
+		session, err := server.storage.GetOfflineSessions("1", "mock")
+		if err != nil {
+			t.Fatalf("get offline session: %v", err)
+		}
+		if _, ok := session.Refresh[client.ID]; ok {
+			t.Errorf("expected expired refresh token to be removed from the offline session")
+		}
+	}
+	checkDeleted(token)
+
+	token = newRefreshToken()
+	now = now.Add(61 * time.Minute)
+	if _, errType := useRefreshToken(token); errType != errInvalidGrant {
+		t.Errorf("expected idle refresh token to be rejected with %q, got %q", errInvalidGrant, errType)
+	}
+	checkDeleted(token)
+}
+
+func TestSessionIdleTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	now := time.Now()
+	httpServer, server := newTestServer(ctx, t, func(c *Config) {
+		c.Now = func() time.Time { return now }
+		c.IDTokensValidFor = time.Hour
+		c.RefreshTokensValidFor = 24 * time.Hour
+		c.SessionIdleTimeout = time.Hour
+	})
+	defer httpServer.Close()
+
+	clientA := storage.Client{ID: "client-a", Secret: "secret-a", RedirectURIs: []string{"https://a.example.com/callback"}}
+	clientB := storage.Client{ID: "client-b", Secret: "secret-b", RedirectURIs: []string{"https://b.example.com/callback"}}
+
+	// Both clients take part in the same login.
+	tokens := make(map[string]string)
+	for _, c := range []storage.Client{clientA, clientB} {
+		if err := server.storage.CreateClient(c); err != nil {
+			t.Fatalf("create client: %v", err)
+		}
+		code := storage.AuthCode{
+			ID:          storage.NewID(),
+			ClientID:    c.ID,
+			RedirectURI: c.RedirectURIs[0],
+			Scopes:      []string{scopeOpenID, scopeOfflineAccess},
+			ConnectorID: "mock",
+			Claims:      storage.Claims{UserID: "1", SessionID: "session-1"},
+			Expiry:      now.Add(time.Hour),
+		}
+		if err := server.storage.CreateAuthCode(code); err != nil {
+			t.Fatalf("create auth code: %v", err)
+		}
+		var resp struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+		if err := json.Unmarshal(exchangeTestAuthCode(server, c, code.ID).Body.Bytes(), &resp); err != nil {
+			t.Fatalf("unmarshal token response: %v", err)
+		}
+		tokens[c.ID] = resp.RefreshToken
+	}
+
+	refresh := func(client storage.Client) string {
+		form := url.Values{
+			"grant_type":    {grantTypeRefreshToken},
+			"refresh_token": {tokens[client.ID]},
+		}
+		req := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(client.ID, client.Secret)
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, req)
+
+		var resp struct {
+			RefreshToken string `json:"refresh_token"`
+			Error        string `json:"error"`
+		}
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		if resp.RefreshToken != "" {
+			tokens[client.ID] = resp.RefreshToken
+		}
+		return resp.Error
+	}
+
+	// Using a refresh token of one client keeps the session alive for the
+	// other, although its own token has been idle for longer.
+	now = now.Add(50 * time.Minute)
+	if errType := refresh(clientA); errType != "" {
+		t.Fatalf("refresh client a: %s", errType)
+	}
+	now = now.Add(50 * time.Minute)
+	if errType := refresh(clientB); errType != "" {
+		t.Fatalf("expected the session used by another client to be alive, got %s", errType)
+	}
+
+	// The session expires on idle long before its absolute lifetime, ending
+	// it for both clients.
+	now = now.Add(61 * time.Minute)
+	if errType := refresh(clientA); errType != errInvalidGrant {
+		t.Errorf("expected refresh token of an idle session to be rejected with %q, got %q", errInvalidGrant, errType)
+	}
+	refreshTokens, err := server.storage.ListRefreshTokens()
+	if err != nil {
+		t.Fatalf("list refresh tokens: %v", err)
+	}
+	if len(refreshTokens) != 0 {
+		t.Errorf("expected the refresh tokens of the idle session to be deleted, got %d", len(refreshTokens))
+	}
+}
+
+func TestHandleConnectors(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, server := newTestServer(ctx, t, nil)
+	defer httpServer.Close()
+
+	for _, c := range []storage.Connector{
+		{ID: "zeta", Type: "mockCallback", Name: "Zeta", ResourceVersion: "1", Config: []byte(`{"secret":"hunter2"}`)},
+		{ID: "alpha", Type: "mockPassword", Name: "Alpha", ResourceVersion: "1"},
+	} {
+		if err := server.storage.CreateConnector(c); err != nil {
+			t.Fatalf("create connector: %v", err)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	server.ServeHTTP(rr, httptest.NewRequest("GET", "/connectors", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body)
+	}
+	if strings.Contains(rr.Body.String(), "hunter2") {
+		t.Errorf("expected connector config not to be listed, got %s", rr.Body)
+	}
+	var resp struct {
+		Connectors []connectorListing `json:"connectors"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("unmarshal connectors: %v", err)
+	}
+	want := []connectorListing{
+		{ID: "alpha", Type: "mockPassword", Name: "Alpha"},
+		{ID: "mock", Type: "mockCallback", Name: "Mock"},
+		{ID: "zeta", Type: "mockCallback", Name: "Zeta"},
+	}
+	if len(resp.Connectors) != len(want) {
+		t.Fatalf("expected connectors %v, got %v", want, resp.Connectors)
+	}
+	for i := range want {
+		if resp.Connectors[i] != want[i] {
+			t.Errorf("expected connectors %v, got %v", want, resp.Connectors)
+			break
+		}
+	}
+
+	client := storage.Client{ID: "client", Secret: "secret", RedirectURIs: []string{"https://example.com/callback"}}
+	if err := server.storage.CreateClient(client); err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+	for connID, wantCode := range map[string]int{"zeta": http.StatusFound, "missing": http.StatusBadRequest} {
+		q := url.Values{
+			"client_id":     {client.ID},
+			"redirect_uri":  {client.RedirectURIs[0]},
+			"response_type": {"code"},
+			"scope":         {"openid"},
+			"connector_id":  {connID},
+		}
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, httptest.NewRequest("GET", "/auth?"+q.Encode(), nil))
+		if rr.Code != wantCode {
+			t.Errorf("connector_id %q: expected %d, got %d", connID, wantCode, rr.Code)
+		}
+		if wantCode == http.StatusFound && !strings.HasPrefix(rr.Header().Get("Location"), "/auth/zeta?req=") {
+			t.Errorf("connector_id %q: expected a redirect to the connector, got %q", connID, rr.Header().Get("Location"))
+		}
+	}
+}
+
+func TestConnectorIDParameter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, server := newTestServer(ctx, t, func(c *Config) {
+		c.ConnectorIDParameter = "kc_idp_hint"
+	})
+	defer httpServer.Close()
+
+	zeta := storage.Connector{ID: "zeta", Type: "mockCallback", Name: "Zeta", ResourceVersion: "1", Config: []byte(`{}`)}
+	if err := server.storage.CreateConnector(zeta); err != nil {
+		t.Fatalf("create connector: %v", err)
+	}
+	client := storage.Client{ID: "client", Secret: "secret", RedirectURIs: []string{"https://example.com/callback"}}
+	if err := server.storage.CreateClient(client); err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	authorize := func(params map[string]string) *httptest.ResponseRecorder {
+		q := url.Values{
+			"client_id":     {client.ID},
+			"redirect_uri":  {client.RedirectURIs[0]},
+			"response_type": {"code"},
+			"scope":         {"openid"},
+			"state":         {"state"},
+		}
+		for k, v := range params {
+			q.Set(k, v)
+		}
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, httptest.NewRequest("GET", "/auth?"+q.Encode(), nil))
+		return rr
+	}
+
+	for _, params := range []map[string]string{
+		{"kc_idp_hint": "zeta"},
+		{"kc_idp_hint": "zeta", "connector_id": "zeta"},
+		{"connector_id": "zeta"},
+	} {
+		rr := authorize(params)
+		if rr.Code != http.StatusFound || !strings.HasPrefix(rr.Header().Get("Location"), "/auth/zeta?req=") {
+			t.Errorf("%v: expected a redirect to the connector, got %d %q", params, rr.Code, rr.Header().Get("Location"))
+		}
+	}
+
+	rr := authorize(map[string]string{"kc_idp_hint": "zeta", "connector_id": "mock"})
+	u, err := url.Parse(rr.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("parse location: %v", err)
+	}
+	if rr.Code != http.StatusSeeOther || u.Query().Get("error") != errInvalidRequest {
+		t.Errorf("expected conflicting parameters to be rejected with %q, got %d %q", errInvalidRequest, rr.Code, rr.Header().Get("Location"))
+	}
+
+	config := Config{
+		Issuer:               httpServer.URL,
+		Storage:              server.storage,
+		Web:                  WebConfig{Dir: "../web"},
+		Logger:               logger,
+		ConnectorIDParameter: "state",
+	}
+	if _, err := newServer(ctx, config, staticRotationStrategy(testKey)); err == nil {
+		t.Error("expected server to reject a connector ID parameter named after a standard parameter")
+	}
+}
+
+func TestConnectorAllowedClients(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, server := newTestServer(ctx, t, nil)
+	defer httpServer.Close()
+
+	restricted := storage.Connector{ID: "restricted", Type: "mockCallback", Name: "Restricted", ResourceVersion: "1", Config: []byte(`{}`), AllowedClients: []string{"allowed"}}
+	if err := server.storage.CreateConnector(restricted); err != nil {
+		t.Fatalf("create connector: %v", err)
+	}
+	for _, id := range []string{"allowed", "other"} {
+		client := storage.Client{ID: id, Secret: "secret", RedirectURIs: []string{"https://example.com/callback"}}
+		if err := server.storage.CreateClient(client); err != nil {
+			t.Fatalf("create client: %v", err)
+		}
+	}
+
+	authorize := func(clientID, connID string) *httptest.ResponseRecorder {
+		q := url.Values{
+			"client_id":     {clientID},
+			"redirect_uri":  {"https://example.com/callback"},
+			"response_type": {"code"},
+			"scope":         {"openid"},
+			"state":         {"state"},
+		}
+		if connID != "" {
+			q.Set("connector_id", connID)
+		}
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, httptest.NewRequest("GET", "/auth?"+q.Encode(), nil))
+		return rr
+	}
+	accessDenied := func(rr *httptest.ResponseRecorder) bool {
+		u, err := url.Parse(rr.Header().Get("Location"))
+		return err == nil && rr.Code == http.StatusSeeOther && u.Query().Get("error") == errAccessDenied
+	}
+
+	rr := authorize("allowed", "restricted")
+	if rr.Code != http.StatusFound || !strings.HasPrefix(rr.Header().Get("Location"), "/auth/restricted?req=") {
+		t.Errorf("expected an allowed client to be redirected to the connector, got %d %q", rr.Code, rr.Header().Get("Location"))
+	}
+
+	rr = authorize("other", "restricted")
+	if !accessDenied(rr) {
+		t.Errorf("expected access_denied for a client the connector doesn't allow, got %d %q", rr.Code, rr.Header().Get("Location"))
+	}
+
+	// The restricted connector isn't offered, leaving only the mock connector.
+	rr = authorize("other", "")
+	location := rr.Header().Get("Location")
+	if rr.Code != http.StatusFound || !strings.HasPrefix(location, "/auth/mock?req=") {
+		t.Fatalf("expected a redirect to the only allowed connector, got %d %q", rr.Code, location)
+	}
+
+	// Nor can it be used by going to it directly.
+	reqID := strings.TrimPrefix(location, "/auth/mock?req=")
+	rr = httptest.NewRecorder()
+	server.ServeHTTP(rr, httptest.NewRequest("GET", "/auth/restricted?req="+reqID, nil))
+	if !accessDenied(rr) {
+		t.Errorf("expected access_denied logging in through a connector the client isn't allowed, got %d %q", rr.Code, rr.Header().Get("Location"))
+	}
+}
+
+func TestAuthorizationErrorFormat(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, server := newTestServer(ctx, t, nil)
+	defer httpServer.Close()
+
+	client := storage.Client{ID: "client", Secret: "secret", RedirectURIs: []string{"https://example.com/callback"}}
+	if err := server.storage.CreateClient(client); err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		redirectURI string
+		accept      string
+		wantCode    int
+		wantJSON    bool
+	}{
+		{"browser", "https://evil.example.com/callback", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", http.StatusBadRequest, false},
+		{"no preference", "https://evil.example.com/callback", "*/*", http.StatusBadRequest, false},
+		{"api client", "https://evil.example.com/callback", "application/json", http.StatusBadRequest, true},
+		{"redirectable", client.RedirectURIs[0], "application/json", http.StatusSeeOther, false},
+	}
+	for _, tc := range tests {
+		q := url.Values{
+			"client_id":     {client.ID},
+			"redirect_uri":  {tc.redirectURI},
+			"response_type": {"unknown"},
+			"scope":         {"openid"},
+		}
+		req := httptest.NewRequest("GET", "/auth?"+q.Encode(), nil)
+		req.Header.Set("Accept", tc.accept)
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, req)
+		if rr.Code != tc.wantCode {
+			t.Errorf("%s: expected %d, got %d: %s", tc.name, tc.wantCode, rr.Code, rr.Body)
+			continue
+		}
+		if tc.wantCode == http.StatusSeeOther {
+			if location := rr.Header().Get("Location"); !strings.HasPrefix(location, client.RedirectURIs[0]+"?") {
+				t.Errorf("%s: expected a redirect to the client, got %q", tc.name, location)
+			}
+			continue
+		}
+
+		var resp struct {
+			Error string `json:"error"`
+		}
+		isJSON := json.Unmarshal(rr.Body.Bytes(), &resp) == nil
+		if isJSON != tc.wantJSON {
+			t.Errorf("%s: expected JSON %t, got %s", tc.name, tc.wantJSON, rr.Body)
+		}
+		if tc.wantJSON && resp.Error != errInvalidRequest {
+			t.Errorf("%s: expected error %q, got %q", tc.name, errInvalidRequest, resp.Error)
+		}
+	}
+}
+
+func TestUnsupportedResponseTypeError(t *testing.T) {
+	tests := []struct {
+		name         string
+		direct       bool
+		responseType string
+	}{
+		{"redirect", false, "token id_token"},
+		{"redirect combination", false, "code id_token"},
+		{"direct", true, "token id_token"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			httpServer, server := newTestServer(ctx, t, func(c *Config) {
+				c.SupportedResponseTypes = []string{responseTypeCode, responseTypeIDToken}
+				c.ResponseTypeCombinations = []string{"code"}
+				c.DirectResponseTypeErrors = tc.direct
+			})
+			defer httpServer.Close()
+
+			client := storage.Client{ID: "client", Secret: "secret", RedirectURIs: []string{"https://example.com/callback"}}
+			if err := server.storage.CreateClient(client); err != nil {
+				t.Fatalf("create client: %v", err)
+			}
+			q := url.Values{
+				"client_id":     {client.ID},
+				"redirect_uri":  {client.RedirectURIs[0]},
+				"response_type": {tc.responseType},
+				"scope":         {"openid"},
+				"state":         {"xyz"},
+				"nonce":         {"nonce"},
+			}
+			rr := httptest.NewRecorder()
+			server.ServeHTTP(rr, httptest.NewRequest("GET", "/auth?"+q.Encode(), nil))
+
+			if tc.direct {
+				if rr.Code != http.StatusBadRequest || rr.Header().Get("Location") != "" {
+					t.Fatalf("expected a 400 error page, got %d %q", rr.Code, rr.Header().Get("Location"))
+				}
+				return
+			}
+			if rr.Code != http.StatusSeeOther {
+				t.Fatalf("expected a redirect to the client, got %d: %s", rr.Code, rr.Body)
+			}
+			u, err := url.Parse(rr.Header().Get("Location"))
+			if err != nil {
+				t.Fatalf("parse location: %v", err)
+			}
+			if got := u.Query().Get("error"); got != errUnsupportedResponseType {
+				t.Errorf("expected error %q, got %q", errUnsupportedResponseType, got)
+			}
+			if got := u.Query().Get("state"); got != "xyz" {
+				t.Errorf("expected the state to be echoed, got %q", got)
+			}
+		})
+	}
+}
+
+func TestMaxAgeZero(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	now := time.Now()
+	httpServer, server := newTestServer(ctx, t, func(c *Config) {
+		c.Now = func() time.Time { return now }
+	})
+	defer httpServer.Close()
+
+	client := storage.Client{ID: "client", Secret: "secret", RedirectURIs: []string{"https://example.com/callback"}}
+	if err := server.storage.CreateClient(client); err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	// login runs an authorization request with max_age=0 through the mock
+	// connector and returns the auth_time of the resulting ID token.
+	login := func() int64 {
+		q := url.Values{
+			"client_id":     {client.ID},
+			"redirect_uri":  {client.RedirectURIs[0]},
+			"response_type": {"code"},
+			"scope":         {"openid"},
+			"max_age":       {"0"},
+		}
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, httptest.NewRequest("GET", "/auth?"+q.Encode(), nil))
+		location := rr.Header().Get("Location")
+		if !strings.HasPrefix(location, "/auth/mock?") {
+			t.Fatalf("expected a redirect to the connector, got %d %q", rr.Code, location)
+		}
+
+		rr = httptest.NewRecorder()
+		server.ServeHTTP(rr, httptest.NewRequest("GET", location, nil))
+		location = rr.Header().Get("Location")
+		if !strings.Contains(location, "/callback?") {
+			t.Fatalf("expected a redirect to the connector login, got %d %q", rr.Code, location)
+		}
+		u, err := url.Parse(location)
+		if err != nil {
+			t.Fatalf("parse location: %v", err)
+		}
+
+		rr = httptest.NewRecorder()
+		server.ServeHTTP(rr, httptest.NewRequest("GET", "/callback?"+u.RawQuery, nil))
+		location = rr.Header().Get("Location")
+		rr = httptest.NewRecorder()
+		server.ServeHTTP(rr, httptest.NewRequest("GET", location, nil))
+		u, err = url.Parse(rr.Header().Get("Location"))
+		if err != nil || u.Query().Get("code") == "" {
+			t.Fatalf("expected a redirect with a code, got %d %q", rr.Code, rr.Header().Get("Location"))
+		}
+
+		form := url.Values{
+			"grant_type":   {grantTypeAuthorizationCode},
+			"code":         {u.Query().Get("code")},
+			"redirect_uri": {client.RedirectURIs[0]},
+		}
+		r := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.SetBasicAuth(client.ID, client.Secret)
+		rr = httptest.NewRecorder()
+		server.ServeHTTP(rr, r)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("exchange code: expected 200, got %d: %s", rr.Code, rr.Body)
+		}
+		var resp struct {
+			IDToken string `json:"id_token"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("unmarshal token response: %v", err)
+		}
+		claims, err := server.verifyIDToken(resp.IDToken)
+		if err != nil {
+			t.Fatalf("verify id token: %v", err)
+		}
+		return claims.AuthTime
+	}
+
+	if got := login(); got != now.Unix() {
+		t.Errorf("expected auth_time %d, got %d", now.Unix(), got)
+	}
+	// A second request right after the first one must go through the
+	// connector again, and record the new login.
+	now = now.Add(time.Minute)
+	if got := login(); got != now.Unix() {
+		t.Errorf("expected auth_time %d after logging in again, got %d", now.Unix(), got)
+	}
+}
+
+func TestForcedReauthPreservesRequest(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, server := newTestServer(ctx, t, nil)
+	defer httpServer.Close()
+
+	client := storage.Client{ID: "client", Secret: "secret", RedirectURIs: []string{"https://example.com/one", "https://example.com/two"}}
+	if err := server.storage.CreateClient(client); err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	q := url.Values{
+		"client_id":             {client.ID},
+		"redirect_uri":          {client.RedirectURIs[1]},
+		"response_type":         {"code"},
+		"scope":                 {"openid email offline_access"},
+		"state":                 {"the-state"},
+		"nonce":                 {"the-nonce"},
+		"code_challenge":        {"E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"},
+		"code_challenge_method": {codeChallengeMethodS256},
+		"claims":                {`{"id_token": {"name": {"essential": true}}}`},
+		"prompt":                {"login"},
+		"max_age":               {"0"},
+	}
+
+	// Follow the redirects through the mock connector back to the client.
+	location := "/auth?" + q.Encode()
+	for i := 0; i < 5 && !strings.HasPrefix(location, "https://example.com"); i++ {
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, httptest.NewRequest("GET", location, nil))
+		if rr.Code != http.StatusFound && rr.Code != http.StatusSeeOther {
+			t.Fatalf("expected a redirect from %q, got %d: %s", location, rr.Code, rr.Body)
+		}
+		location = rr.Header().Get("Location")
+		if u, err := url.Parse(location); err == nil && u.Host != "" && u.Host != "example.com" {
+			location = u.RequestURI()
+		}
+	}
+	u, err := url.Parse(location)
+	if err != nil {
+		t.Fatalf("parse redirect: %v", err)
+	}
+	if got := u.Scheme + "://" + u.Host + u.Path; got != client.RedirectURIs[1] {
+		t.Fatalf("expected a redirect to %q, got %q", client.RedirectURIs[1], location)
+	}
+	if got := u.Query().Get("state"); got != "the-state" {
+		t.Errorf("expected state %q, got %q", "the-state", got)
+	}
+
+	form := url.Values{
+		"grant_type":    {grantTypeAuthorizationCode},
+		"code":          {u.Query().Get("code")},
+		"redirect_uri":  {client.RedirectURIs[1]},
+		"code_verifier": {verifier},
+	}
+	r := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.SetBasicAuth(client.ID, client.Secret)
+	rr := httptest.NewRecorder()
+	server.ServeHTTP(rr, r)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("exchange code: expected 200, got %d: %s", rr.Code, rr.Body)
+	}
+	var resp struct {
+		IDToken      string `json:"id_token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("unmarshal token response: %v", err)
+	}
+	if resp.RefreshToken == "" {
+		t.Errorf("expected the offline_access scope to yield a refresh token")
+	}
+	claims, err := server.verifyIDToken(resp.IDToken)
+	if err != nil {
+		t.Fatalf("verify id token: %v", err)
+	}
+	if claims.Nonce != "the-nonce" || claims.Email == "" || claims.Name != "Kilgore Trout" || claims.AuthTime == 0 {
+		t.Errorf("expected the nonce, scopes and requested claims to be preserved, got %+v", claims)
+	}
+}
+
+func TestPendingLoginTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	now := time.Now()
+	httpServer, server := newTestServer(ctx, t, func(c *Config) {
+		c.Now = func() time.Time { return now }
+		c.PendingLoginsValidFor = 5 * time.Minute
+		c.PendingLoginLimits = PendingLoginLimits{Total: 10}
+	})
+	defer httpServer.Close()
+
+	client := storage.Client{ID: "client", Secret: "secret", RedirectURIs: []string{"https://example.com/callback"}}
+	if err := server.storage.CreateClient(client); err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	get := func(target string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, httptest.NewRequest("GET", target, nil))
+		return rr
+	}
+	// startLogin sends the user to the mock connector, returning the ID of
+	// the pending request.
+	startLogin := func() string {
+		authReq := storage.AuthRequest{
+			ID:            storage.NewID(),
+			ClientID:      client.ID,
+			RedirectURI:   client.RedirectURIs[0],
+			State:         "state",
+			ResponseTypes: []string{responseTypeCode},
+			Scopes:        []string{scopeOpenID},
+			Expiry:        now.Add(time.Hour),
+		}
+		if err := server.storage.CreateAuthRequest(authReq); err != nil {
+			t.Fatalf("create auth request: %v", err)
+		}
+		if rr := get("/auth/mock?req=" + authReq.ID); rr.Code != http.StatusFound {
+			t.Fatalf("expected a redirect to the connector, got %d: %s", rr.Code, rr.Body)
+		}
+		a, err := server.storage.GetAuthRequest(authReq.ID)
+		if err != nil {
+			t.Fatalf("get auth request: %v", err)
+		}
+		if want := now.Add(5 * time.Minute); !a.Expiry.Equal(want) {
+			t.Errorf("expected a pending login to expire at %v, got %v", want, a.Expiry)
+		}
+		return authReq.ID
+	}
+
+	// Reloading the connector's page doesn't keep the login pending longer.
+	id := startLogin()
+	now = now.Add(4 * time.Minute)
+	if rr := get("/auth/mock?req=" + id); rr.Code != http.StatusFound {
+		t.Fatalf("expected a redirect to the connector, got %d: %s", rr.Code, rr.Body)
+	}
+	if a, err := server.storage.GetAuthRequest(id); err != nil || !a.Expiry.Equal(now.Add(time.Minute)) {
+		t.Errorf("expected reloading not to extend the pending login, got expiry %v (%v)", a.Expiry, err)
+	}
+	now = now.Add(2 * time.Minute)
+	if rr := get("/callback?state=" + id); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected a callback after the first pending expiry to fail, got %d: %s", rr.Code, rr.Body)
+	}
+
+	// A login completed in time gets the usual time for approval.
+	id = startLogin()
+	now = now.Add(4 * time.Minute)
+	if rr := get("/callback?state=" + id); rr.Code != http.StatusSeeOther {
+		t.Fatalf("expected a login in time to succeed, got %d: %s", rr.Code, rr.Body)
+	}
+	a, err := server.storage.GetAuthRequest(id)
+	if err != nil {
+		t.Fatalf("get auth request: %v", err)
+	}
+	if want := now.Add(24 * time.Hour); !a.LoggedIn || !a.Expiry.Equal(want) {
+		t.Errorf("expected a logged in request expiring at %v, got logged in %t, expiry %v", want, a.LoggedIn, a.Expiry)
+	}
+
+	// A late callback restarts the login with a new request.
+	id = startLogin()
+	now = now.Add(6 * time.Minute)
+	rr := get("/callback?state=" + id)
+	if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "Your login session expired, please retry.") {
+		t.Fatalf("expected a late callback to render the expired page, got %d: %s", rr.Code, rr.Body)
+	}
+	if _, err := server.storage.GetAuthRequest(id); err != storage.ErrNotFound {
+		t.Errorf("expected the expired request to be deleted, got %v", err)
+	}
+	i := strings.Index(rr.Body.String(), "/auth/mock?req=")
+	if i < 0 {
+		t.Fatalf("expected a link restarting the login, got %s", rr.Body)
+	}
+	retryID := strings.TrimPrefix(strings.SplitN(rr.Body.String()[i:], `"`, 2)[0], "/auth/mock?req=")
+	if _, ok := server.pendingLogins.pending[retryID]; !ok {
+		t.Errorf("expected the restarted login to count as pending")
+	}
+	if rr := get("/auth/mock?req=" + retryID); rr.Code != http.StatusFound {
+		t.Fatalf("expected the restarted login to redirect to the connector, got %d: %s", rr.Code, rr.Body)
+	}
+	if rr := get("/callback?state=" + retryID); rr.Code != http.StatusSeeOther {
+		t.Errorf("expected the restarted login to succeed, got %d: %s", rr.Code, rr.Body)
+	}
+
+	// Once garbage collected, the user is sent back to the application.
+	id = startLogin()
+	now = now.Add(6 * time.Minute)
+	if _, err := server.storage.GarbageCollect(now); err != nil {
+		t.Fatalf("garbage collect: %v", err)
+	}
+	if _, err := server.storage.GetAuthRequest(id); err != storage.ErrNotFound {
+		t.Fatalf("expected the pending login to be garbage collected, got %v", err)
+	}
+	rr = get("/callback?state=" + id)
+	if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "Login session expired.") {
+		t.Errorf("expected a callback after garbage collection to render the expired page, got %d: %s", rr.Code, rr.Body)
+	}
+}
+
+func TestRedirectURIRemovedMidLogin(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, server := newTestServer(ctx, t, nil)
+	defer httpServer.Close()
+
+	client := storage.Client{ID: "client", Secret: "secret", RedirectURIs: []string{"https://example.com/callback"}}
+	if err := server.storage.CreateClient(client); err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+	authReq := storage.AuthRequest{
+		ID:            storage.NewID(),
+		ClientID:      client.ID,
+		ConnectorID:   "mock",
+		RedirectURI:   client.RedirectURIs[0],
+		State:         "state",
+		ResponseTypes: []string{responseTypeCode},
+		Scopes:        []string{scopeOpenID},
+		Expiry:        server.now().Add(time.Minute),
+	}
+	if err := server.storage.CreateAuthRequest(authReq); err != nil {
+		t.Fatalf("create auth request: %v", err)
+	}
+
+	// The client's only redirect URI is replaced while the user is logging in.
+	if err := server.storage.UpdateClient(client.ID, func(old storage.Client) (storage.Client, error) {
+		old.RedirectURIs = []string{"https://example.com/new-callback"}
+		return old, nil
+	}); err != nil {
+		t.Fatalf("update client: %v", err)
+	}
+
+	rr := httptest.NewRecorder()
+	server.ServeHTTP(rr, httptest.NewRequest("GET", "/callback?state="+authReq.ID, nil))
+	if rr.Code != http.StatusSeeOther {
+		t.Fatalf("expected a redirect to the approval page, got %d: %s", rr.Code, rr.Body)
+	}
+	approval := rr.Header().Get("Location")
+
+	rr = httptest.NewRecorder()
+	server.ServeHTTP(rr, httptest.NewRequest("GET", approval, nil))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected an error page, got %d", rr.Code)
+	}
+	if location := rr.Header().Get("Location"); location != "" {
+		t.Errorf("expected no redirect, got one to %q", location)
+	}
+	if !strings.Contains(rr.Body.String(), "no longer registered") {
+		t.Errorf("expected the error page to explain the redirect URI is unregistered, got %s", rr.Body)
+	}
+	if _, err := server.storage.GetAuthRequest(authReq.ID); err != storage.ErrNotFound {
+		t.Errorf("expected the auth request to be deleted, got %v", err)
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, server := newTestServer(ctx, t, nil)
+	defer httpServer.Close()
+
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "token error",
+			err:        &oauthError{Code: errInvalidGrant, Description: "Invalid or expired code.", HTTPStatus: http.StatusBadRequest},
+			wantStatus: http.StatusBadRequest,
+			wantBody:   `{"error":"invalid_grant","error_description":"Invalid or expired code."}`,
+		},
+		{
+			name:       "default status",
+			err:        &oauthError{Code: errUnsupportedGrantType},
+			wantStatus: http.StatusBadRequest,
+			wantBody:   `{"error":"unsupported_grant_type"}`,
+		},
+		{
+			name:       "client authentication",
+			err:        &oauthError{Code: errInvalidClient, Description: "Invalid client credentials.", HTTPStatus: http.StatusUnauthorized},
+			wantStatus: http.StatusUnauthorized,
+			wantBody:   `{"error":"invalid_client","error_description":"Invalid client credentials."}`,
+		},
+		{
+			name:       "authorization error echoes state",
+			err:        (&authErr{State: "af0ifjsldkj", Type: errInvalidScope, Description: "Unrecognized scope."}).oauthError(),
+			wantStatus: http.StatusBadRequest,
+			wantBody:   `{"error":"invalid_scope","error_description":"Unrecognized scope.","state":"af0ifjsldkj"}`,
+		},
+		{
+			name:       "annotated oauth error is hidden",
+			err:        fmt.Errorf("exchange code: %v", &oauthError{Code: errAccessDenied, HTTPStatus: http.StatusForbidden}),
+			wantStatus: http.StatusInternalServerError,
+			wantBody:   `{"error":"server_error"}`,
+		},
+		{
+			name:       "internal error is hidden",
+			err:        errors.New("database is on fire"),
+			wantStatus: http.StatusInternalServerError,
+			wantBody:   `{"error":"server_error"}`,
+		},
+	}
+	for _, tc := range tests {
+		rr := httptest.NewRecorder()
+		server.writeError(rr, tc.err)
+		if rr.Code != tc.wantStatus {
+			t.Errorf("%s: expected status %d, got %d", tc.name, tc.wantStatus, rr.Code)
+		}
+		if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s: expected a JSON response, got %q", tc.name, ct)
+		}
+		if got := rr.Body.String(); got != tc.wantBody {
+			t.Errorf("%s: expected body %s, got %s", tc.name, tc.wantBody, got)
+		}
+	}
+}
+
+func TestTokenRequestContentTypes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, server := newTestServer(ctx, t, func(c *Config) {
+		c.JSONTokenRequests = true
+	})
+	defer httpServer.Close()
+
+	client := storage.Client{ID: "client", Secret: "secret", RedirectURIs: []string{"https://example.com/callback"}}
+	if err := server.storage.CreateClient(client); err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	post := func(s *Server, contentType, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/token", strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		req.SetBasicAuth(client.ID, client.Secret)
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, req)
+		return rr
+	}
+	idToken := func(rr *httptest.ResponseRecorder) string {
+		var resp struct {
+			IDToken string `json:"id_token"`
+		}
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		return resp.IDToken
+	}
+
+	form := url.Values{
+		"grant_type":   {grantTypeAuthorizationCode},
+		"code":         {newTestAuthCode(t, server, client)},
+		"redirect_uri": {client.RedirectURIs[0]},
+	}
+	if rr := post(server, "application/x-www-form-urlencoded", form.Encode()); rr.Code != http.StatusOK || idToken(rr) == "" {
+		t.Errorf("expected a form encoded request to succeed, got %d: %s", rr.Code, rr.Body)
+	}
+
+	body, err := json.Marshal(map[string]string{
+		"grant_type":   grantTypeAuthorizationCode,
+		"code":         newTestAuthCode(t, server, client),
+		"redirect_uri": client.RedirectURIs[0],
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rr := post(server, "application/json; charset=utf-8", string(body)); rr.Code != http.StatusOK || idToken(rr) == "" {
+		t.Errorf("expected a JSON request to succeed, got %d: %s", rr.Code, rr.Body)
+	}
+
+	if rr := post(server, "application/json", `{"grant_type": 1}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected a JSON request with a non-string parameter to be rejected, got %d: %s", rr.Code, rr.Body)
+	}
+	if rr := post(server, "text/plain", form.Encode()); rr.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("expected an unsupported content type to be rejected with 415, got %d: %s", rr.Code, rr.Body)
+	}
+
+	// JSON bodies are only taken when enabled.
+	httpServer2, server2 := newTestServer(ctx, t, nil)
+	defer httpServer2.Close()
+	if rr := post(server2, "application/json", string(body)); rr.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("expected a JSON request to be rejected with 415 when not enabled, got %d: %s", rr.Code, rr.Body)
+	}
+}
+
+func TestSlowTokenRequestBody(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, server := newTestServer(ctx, t, nil)
+	defer httpServer.Close()
+
+	// Like a listener configured with a read timeout.
+	const readTimeout = 200 * time.Millisecond
+	slowServer := httptest.NewUnstartedServer(server)
+	slowServer.Config.ReadTimeout = readTimeout
+	slowServer.Start()
+	defer slowServer.Close()
+
+	conn, err := net.Dial("tcp", slowServer.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	// Only part of the body announced is ever sent.
+	start := time.Now()
+	fmt.Fprint(conn, "POST /token HTTP/1.1\r\n"+
+		"Host: "+slowServer.Listener.Addr().String()+"\r\n"+
+		"Content-Type: application/x-www-form-urlencoded\r\n"+
+		"Content-Length: 100\r\n"+
+		"\r\n"+
+		"grant_type=authorization_code&client_id=cli")
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestTimeout {
+		t.Errorf("expected a slow request body to time out, got %s", resp.Status)
+	}
+	if elapsed := time.Since(start); elapsed > readTimeout+2*time.Second {
+		t.Errorf("expected the request to be aborted after %s, took %s", readTimeout, elapsed)
+	}
+	var tokenErr struct {
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenErr); err != nil || tokenErr.Error != errInvalidRequest {
+		t.Errorf("expected an %q error, got %q (%v)", errInvalidRequest, tokenErr.Error, err)
+	}
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+)
+
+// SecurityHeaders are set on every response of the public handler. Empty
+// values use the defaults and "-" disables a header. Handlers which need a
+// different value, such as a page meant to be framed, override it.
+type SecurityHeaders struct {
+	// Defaults to "max-age=31536000" if the issuer is served over HTTPS, and
+	// isn't sent otherwise.
+	StrictTransportSecurity string `json:"strictTransportSecurity"`
+
+	// Default to "nosniff", "DENY", "frame-ancestors 'none'" and "no-referrer".
+	ContentTypeOptions    string `json:"contentTypeOptions"`
+	FrameOptions          string `json:"frameOptions"`
+	ContentSecurityPolicy string `json:"contentSecurityPolicy"`
+	ReferrerPolicy        string `json:"referrerPolicy"`
+
+	// Replaces the Content-Security-Policy of the logout endpoint, which
+	// relying parties may load in an iframe to end the session. Defaults to
+	// "frame-ancestors *". X-Frame-Options isn't sent with it.
+	LogoutContentSecurityPolicy string `json:"logoutContentSecurityPolicy"`
+}
+
+func header(val, defaultValue string) string {
+	switch val {
+	case "":
+		return defaultValue
+	case "-":
+		return ""
+	}
+	return val
+}
+
+// handler wraps h to set the headers on its responses.
+func (sh SecurityHeaders) handler(issuerURL *url.URL, h http.Handler) http.Handler {
+	hsts := ""
+	if issuerURL.Scheme == "https" {
+		hsts = "max-age=31536000"
+	}
+	headers := map[string]string{
+		"Strict-Transport-Security": header(sh.StrictTransportSecurity, hsts),
+		"X-Content-Type-Options":    header(sh.ContentTypeOptions, "nosniff"),
+		"X-Frame-Options":           header(sh.FrameOptions, "DENY"),
+		"Content-Security-Policy":   header(sh.ContentSecurityPolicy, "frame-ancestors 'none'"),
+		"Referrer-Policy":           header(sh.ReferrerPolicy, "no-referrer"),
+	}
+	logoutHeaders := make(map[string]string, len(headers))
+	for name, val := range headers {
+		logoutHeaders[name] = val
+	}
+	logoutHeaders["Content-Security-Policy"] = header(sh.LogoutContentSecurityPolicy, "frame-ancestors *")
+	delete(logoutHeaders, "X-Frame-Options")
+	for _, m := range []map[string]string{headers, logoutHeaders} {
+		for name, val := range m {
+			if val == "" {
+				delete(m, name)
+			}
+		}
+	}
+
+	logoutPath := path.Join(issuerURL.Path, "/logout")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		set := headers
+		if r.URL.Path == logoutPath {
+			set = logoutHeaders
+		}
+		for name, val := range set {
+			w.Header().Set(name, val)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
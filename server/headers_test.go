@@ -0,0 +1,110 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestSecurityHeaders(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, server := newTestServer(ctx, t, nil)
+	defer httpServer.Close()
+
+	want := map[string]string{
+		"X-Content-Type-Options":  "nosniff",
+		"X-Frame-Options":         "DENY",
+		"Content-Security-Policy": "frame-ancestors 'none'",
+		"Referrer-Policy":         "no-referrer",
+	}
+	for _, path := range []string{"/.well-known/openid-configuration", "/auth/mock?req=missing"} {
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		for name, val := range want {
+			if got := rr.Header().Get(name); got != val {
+				t.Errorf("%s: expected %s %q, got %q", path, name, val, got)
+			}
+		}
+		// The test server's issuer is served over plain HTTP.
+		if got := rr.Header().Get("Strict-Transport-Security"); got != "" {
+			t.Errorf("%s: expected no Strict-Transport-Security header, got %q", path, got)
+		}
+	}
+}
+
+func TestSecurityHeadersOverride(t *testing.T) {
+	issuerURL, _ := url.Parse("https://dex.example.com")
+	headers := SecurityHeaders{
+		StrictTransportSecurity: "max-age=60",
+		FrameOptions:            "-",
+	}
+
+	// A page meant to be framed by relying parties replaces the policy.
+	framed := headers.handler(issuerURL, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Security-Policy", "frame-ancestors https://app.example.com")
+	}))
+	rr := httptest.NewRecorder()
+	framed.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+
+	want := map[string]string{
+		"Strict-Transport-Security": "max-age=60",
+		"X-Content-Type-Options":    "nosniff",
+		"X-Frame-Options":           "",
+		"Content-Security-Policy":   "frame-ancestors https://app.example.com",
+	}
+	for name, val := range want {
+		if got := rr.Header().Get(name); got != val {
+			t.Errorf("expected %s %q, got %q", name, val, got)
+		}
+	}
+
+	rr = httptest.NewRecorder()
+	SecurityHeaders{}.handler(issuerURL, http.NotFoundHandler()).ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	if got := rr.Header().Get("Strict-Transport-Security"); got != "max-age=31536000" {
+		t.Errorf("expected the default Strict-Transport-Security for an HTTPS issuer, got %q", got)
+	}
+}
+
+func TestLogoutSecurityHeaders(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, server := newTestServer(ctx, t, nil)
+	defer httpServer.Close()
+
+	get := func(path string) http.Header {
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		return rr.Header()
+	}
+	auth, logout := get("/auth?client_id=missing"), get("/logout")
+
+	// The logout page may be framed by relying parties, the login pages not.
+	if got := auth.Get("Content-Security-Policy"); got != "frame-ancestors 'none'" {
+		t.Errorf("/auth: expected Content-Security-Policy %q, got %q", "frame-ancestors 'none'", got)
+	}
+	if got := logout.Get("Content-Security-Policy"); got != "frame-ancestors *" {
+		t.Errorf("/logout: expected Content-Security-Policy %q, got %q", "frame-ancestors *", got)
+	}
+	if got := logout.Get("X-Frame-Options"); got != "" {
+		t.Errorf("/logout: expected no X-Frame-Options, got %q", got)
+	}
+	if auth.Get("Content-Security-Policy") == logout.Get("Content-Security-Policy") {
+		t.Errorf("expected /logout to have a different Content-Security-Policy than /auth")
+	}
+	if got := logout.Get("X-Content-Type-Options"); got != "nosniff" {
+		t.Errorf("/logout: expected the other security headers to be kept, got X-Content-Type-Options %q", got)
+	}
+
+	issuerURL, _ := url.Parse("https://dex.example.com/dex")
+	h := SecurityHeaders{LogoutContentSecurityPolicy: "frame-ancestors https://app.example.com"}.handler(issuerURL, http.NotFoundHandler())
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", "/dex/logout", nil))
+	if got := rr.Header().Get("Content-Security-Policy"); got != "frame-ancestors https://app.example.com" {
+		t.Errorf("expected the configured logout Content-Security-Policy, got %q", got)
+	}
+}
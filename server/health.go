@@ -0,0 +1,192 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/dexidp/dex/connector"
+)
+
+// connectorHealth checks the connectors which implement
+// connector.HealthChecker. Results are reused for a short time so frequent
+// probes don't turn into a stream of requests to upstream providers, and
+// concurrent probes share a single check.
+//
+// Connectors which recover after failing a check are opened again, so state
+// they cached from the upstream provider, such as its discovery document or
+// keys, doesn't outlive an outage.
+type connectorHealth struct {
+	s   *Server
+	ttl time.Duration
+
+	recoveries *prometheus.CounterVec
+	// Opens a recovered connector again, reopenConnector outside of tests.
+	reopen func(id string) error
+
+	mu sync.Mutex
+	// Guarded by the mutex.
+	checked time.Time
+	results map[string]error
+	// Closed when the check in progress, if any, completes.
+	running chan struct{}
+}
+
+// check returns the health of each connector, from the last check unless it's
+// older than the TTL or fresh is set.
+func (h *connectorHealth) check(fresh bool) map[string]error {
+	h.mu.Lock()
+	if h.running != nil {
+		// Another request is already checking, wait for its results.
+		running := h.running
+		h.mu.Unlock()
+		<-running
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		return h.results
+	}
+	if !fresh && h.results != nil && h.s.now().Before(h.checked.Add(h.ttl)) {
+		defer h.mu.Unlock()
+		return h.results
+	}
+	running := make(chan struct{})
+	h.running = running
+	h.mu.Unlock()
+
+	// Not bound to the request, which other requests may be waiting on.
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	results := h.s.checkConnectors(ctx)
+	cancel()
+
+	h.mu.Lock()
+	previous := h.results
+	h.results = results
+	h.checked = h.s.now()
+	h.running = nil
+	h.mu.Unlock()
+	close(running)
+
+	for id, err := range results {
+		if err == nil && previous[id] != nil {
+			h.recover(id)
+		}
+	}
+	return results
+}
+
+// recover reopens a connector which passed its health check after failing
+// the previous one.
+func (h *connectorHealth) recover(id string) {
+	h.s.logger.Infof("connector %q recovered, reopening it", id)
+	h.recoveries.WithLabelValues(id).Inc()
+	if err := h.reopen(id); err != nil {
+		h.s.logger.Errorf("failed to reopen recovered connector %q: %v", id, err)
+	}
+}
+
+// reopenConnector opens a connector again from its storage object, replacing
+// the one in use.
+func (s *Server) reopenConnector(id string) error {
+	conn, err := s.storage.GetConnector(id)
+	if err != nil {
+		return fmt.Errorf("get connector: %v", err)
+	}
+	_, err = s.OpenConnector(conn)
+	return err
+}
+
+// checkConnectors runs the health checks of all connectors concurrently.
+func (s *Server) checkConnectors(ctx context.Context) map[string]error {
+	results := make(map[string]error)
+	connectors, err := s.storage.ListConnectors()
+	if err != nil {
+		s.logger.Errorf("connector health check: failed to list connectors: %v", err)
+		return results
+	}
+
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	for _, c := range connectors {
+		conn, err := s.getConnector(c.ID)
+		if err != nil {
+			results[c.ID] = err
+			continue
+		}
+		checker, ok := conn.Connector.(connector.HealthChecker)
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			err := checker.Healthy(ctx)
+			mu.Lock()
+			results[id] = err
+			mu.Unlock()
+		}(c.ID)
+	}
+	wg.Wait()
+
+	for id, err := range results {
+		if err != nil {
+			s.logger.Errorf("connector %q health check failed: %v", id, err)
+		}
+	}
+	return results
+}
+
+type loginProbeStatus struct {
+	Status    string `json:"status"`
+	LatencyMS int64  `json:"latencyMs"`
+}
+
+// ServeHTTP reports the health of connectors which support checking it, and
+// the last login probes if enabled. It fails if any of them is unhealthy.
+// Errors are only logged, since they can reveal details of upstream providers.
+// Pass "fresh=1" to skip the cache, which doesn't apply to login probes.
+func (h *connectorHealth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fresh, _ := strconv.ParseBool(r.URL.Query().Get("fresh"))
+	results := h.check(fresh)
+
+	status := http.StatusOK
+	resp := struct {
+		Connectors  map[string]string           `json:"connectors"`
+		LoginProbes map[string]loginProbeStatus `json:"loginProbes,omitempty"`
+	}{Connectors: make(map[string]string, len(results))}
+	for id, err := range results {
+		resp.Connectors[id] = "ok"
+		if err != nil {
+			resp.Connectors[id] = "failed"
+			status = http.StatusServiceUnavailable
+		}
+	}
+	if h.s.loginProbes != nil {
+		probes := h.s.loginProbes.last()
+		resp.LoginProbes = make(map[string]loginProbeStatus, len(probes))
+		for id, result := range probes {
+			probe := loginProbeStatus{Status: "ok", LatencyMS: int64(result.latency / time.Millisecond)}
+			if result.err != nil {
+				probe.Status = "failed"
+				status = http.StatusServiceUnavailable
+			}
+			resp.LoginProbes[id] = probe
+		}
+	}
+	data, err := json.Marshal(resp)
+	if err != nil {
+		h.s.logger.Errorf("failed to marshal connector health: %v", err)
+		h.s.renderError(w, http.StatusInternalServerError, "Internal server error.")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
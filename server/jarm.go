@@ -0,0 +1,69 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// Response modes returning the authorization response as a signed JWT.
+//
+// https://openid.net/specs/oauth-v2-jarm.html
+const (
+	responseModeJWT         = "jwt"
+	responseModeQueryJWT    = "query.jwt"
+	responseModeFragmentJWT = "fragment.jwt"
+)
+
+// authResponseValidFor is how long a signed authorization response is valid.
+// Clients process it as soon as the browser is redirected.
+const authResponseValidFor = 10 * time.Minute
+
+// jwtResponseMode resolves the response_mode of an authorization request to
+// one of the JWT response modes, or to "" for any other mode. Responses
+// carrying tokens aren't put in the query.
+func jwtResponseMode(mode string, returnsTokens bool) (string, error) {
+	switch mode {
+	case responseModeJWT:
+		if returnsTokens {
+			return responseModeFragmentJWT, nil
+		}
+		return responseModeQueryJWT, nil
+	case responseModeQueryJWT:
+		if returnsTokens {
+			return "", fmt.Errorf("Response mode %q can't be used with response types returning tokens.", mode)
+		}
+		return mode, nil
+	case responseModeFragmentJWT:
+		return mode, nil
+	}
+	return "", nil
+}
+
+// newAuthResponseJWT signs the parameters of an authorization response for a
+// client.
+func (s *Server) newAuthResponseJWT(clientID string, params url.Values) (string, error) {
+	claims := map[string]interface{}{
+		"iss": s.issuerURL.String(),
+		"aud": clientID,
+		"exp": s.now().Add(authResponseValidFor).Unix(),
+	}
+	for k := range params {
+		claims[k] = params.Get(k)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", fmt.Errorf("could not serialize claims: %v", err)
+	}
+
+	keys, err := s.getKeys()
+	if err != nil {
+		return "", err
+	}
+	signingKey, err := s.signingKey(keys)
+	if err != nil {
+		return "", err
+	}
+	return signPayload(signingKey, payload)
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	jose "gopkg.in/square/go-jose.v2"
+
+	"github.com/dexidp/dex/storage"
+)
+
+func TestJWTResponseModes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, server := newTestServer(ctx, t, func(c *Config) {
+		c.JWTResponseModes = true
+		c.SupportedResponseTypes = []string{responseTypeCode, responseTypeIDToken, responseTypeToken}
+	})
+	defer httpServer.Close()
+
+	client := storage.Client{ID: "client", Secret: "secret", RedirectURIs: []string{"https://client.example.com/callback"}}
+	if err := server.storage.CreateClient(client); err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	get := func(target string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, httptest.NewRequest("GET", target, nil))
+		return rr
+	}
+
+	var d discovery
+	if err := json.Unmarshal(get("/.well-known/openid-configuration").Body.Bytes(), &d); err != nil {
+		t.Fatalf("unmarshal discovery: %v", err)
+	}
+	if !reflect.DeepEqual(d.AuthorizationSigningAlgs, d.IDTokenAlgs) {
+		t.Errorf("expected authorization responses to be signed like ID tokens %v, got %v", d.IDTokenAlgs, d.AuthorizationSigningAlgs)
+	}
+	var jwks jose.JSONWebKeySet
+	if err := json.Unmarshal(get("/keys").Body.Bytes(), &jwks); err != nil {
+		t.Fatalf("unmarshal keys: %v", err)
+	}
+
+	// authorize runs an authorization request through to the redirect back
+	// to the client.
+	authorize := func(responseType, responseMode string) (*url.URL, *authErr) {
+		q := url.Values{
+			"client_id":     {client.ID},
+			"redirect_uri":  {client.RedirectURIs[0]},
+			"response_type": {responseType},
+			"response_mode": {responseMode},
+			"scope":         {scopeOpenID},
+			"state":         {"af0ifjsldkj"},
+			"nonce":         {"n-0S6_WzA2Mj"},
+		}
+		authReq, err := server.parseAuthorizationRequest(httptest.NewRequest("GET", "/auth?"+q.Encode(), nil))
+		if err != nil {
+			return nil, err
+		}
+		authReq.ConnectorID = "mock"
+		authReq.LoggedIn = true
+		authReq.Claims = storage.Claims{UserID: "1"}
+		authReq.Expiry = server.now().Add(time.Hour)
+		if err := server.storage.CreateAuthRequest(authReq); err != nil {
+			t.Fatalf("create auth request: %v", err)
+		}
+		rr := httptest.NewRecorder()
+		server.sendCodeResponse(rr, httptest.NewRequest("GET", "/approval", nil), authReq)
+		if rr.Code != http.StatusSeeOther {
+			t.Fatalf("expected a redirect, got %d: %s", rr.Code, rr.Body)
+		}
+		u, parseErr := url.Parse(rr.Header().Get("Location"))
+		if parseErr != nil {
+			t.Fatalf("parse redirect: %v", parseErr)
+		}
+		return u, nil
+	}
+	// verify checks a signed response against the published keys.
+	verify := func(response string) map[string]interface{} {
+		t.Helper()
+		jws, err := jose.ParseSigned(response)
+		if err != nil {
+			t.Fatalf("parse response: %v", err)
+		}
+		keys := jwks.Key(jws.Signatures[0].Header.KeyID)
+		if len(keys) == 0 {
+			t.Fatalf("response signed with unpublished key %q", jws.Signatures[0].Header.KeyID)
+		}
+		payload, err := jws.Verify(keys[0])
+		if err != nil {
+			t.Fatalf("verify response: %v", err)
+		}
+		var claims map[string]interface{}
+		if err := json.Unmarshal(payload, &claims); err != nil {
+			t.Fatalf("unmarshal response: %v", err)
+		}
+		if claims["iss"] != server.issuerURL.String() {
+			t.Errorf("expected issuer %q, got %v", server.issuerURL.String(), claims["iss"])
+		}
+		if claims["aud"] != client.ID {
+			t.Errorf("expected audience %q, got %v", client.ID, claims["aud"])
+		}
+		if claims["state"] != "af0ifjsldkj" {
+			t.Errorf("expected the state in the response, got %v", claims["state"])
+		}
+		return claims
+	}
+
+	// The code flow defaults to the query.
+	u, err := authorize(responseTypeCode, responseModeJWT)
+	if err != nil {
+		t.Fatalf("parse authorization request: %v", err)
+	}
+	q := u.Query()
+	if q.Get("code") != "" || q.Get("state") != "" {
+		t.Errorf("expected the response values to only be part of the JWT, got %s", u)
+	}
+	claims := verify(q.Get("response"))
+	code, _ := claims["code"].(string)
+	if code == "" {
+		t.Fatalf("expected a code in the response, got %v", claims)
+	}
+	if rr := exchangeTestAuthCode(server, client, code); rr.Code != http.StatusOK {
+		t.Errorf("expected the code of the response to be exchangeable, got %d: %s", rr.Code, rr.Body)
+	}
+
+	// The hybrid flow returns its tokens in the fragment.
+	u, err = authorize("code id_token", responseModeFragmentJWT)
+	if err != nil {
+		t.Fatalf("parse authorization request: %v", err)
+	}
+	fragment, parseErr := url.ParseQuery(u.Fragment)
+	if parseErr != nil {
+		t.Fatalf("parse fragment: %v", parseErr)
+	}
+	if u.RawQuery != "" {
+		t.Errorf("expected an empty query, got %s", u)
+	}
+	claims = verify(fragment.Get("response"))
+	if claims["code"] == nil || claims["id_token"] == nil {
+		t.Errorf("expected a code and an ID token in the response, got %v", claims)
+	}
+
+	if _, err := authorize("code token", responseModeQueryJWT); err == nil {
+		t.Error("expected tokens in the query to be rejected")
+	}
+}
@@ -0,0 +1,278 @@
+package server
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/pbkdf2"
+	jose "gopkg.in/square/go-jose.v2"
+
+	"github.com/dexidp/dex/storage"
+)
+
+const (
+	keyBackupVersion = 1
+	// PBKDF2 iterations used to derive the encryption key from a passphrase.
+	keyBackupIterations = 600000
+	// Backups asking for more iterations are rejected rather than tying up
+	// the server.
+	maxKeyBackupIterations = 10000000
+)
+
+var errWrongPassphrase = errors.New("wrong passphrase or corrupted key backup")
+
+// keyBackup is an exported key set, encrypted with AES-GCM under a key derived
+// from a passphrase.
+type keyBackup struct {
+	Version    int    `json:"version"`
+	Iterations int    `json:"iterations"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// keyConflictError is returned when importing a key whose ID is already used
+// by a different key.
+type keyConflictError struct {
+	keyID string
+}
+
+func (e keyConflictError) Error() string {
+	return fmt.Sprintf("a different key with ID %q already exists", e.keyID)
+}
+
+func keyBackupCipher(passphrase string, salt []byte, iterations int) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(pbkdf2.Key([]byte(passphrase), salt, iterations, 32, sha256.New))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealKeys encrypts a key set under a passphrase.
+func sealKeys(keys storage.Keys, passphrase string) (keyBackup, error) {
+	plaintext, err := json.Marshal(keys)
+	if err != nil {
+		return keyBackup{}, fmt.Errorf("marshal keys: %v", err)
+	}
+	salt := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return keyBackup{}, err
+	}
+	aead, err := keyBackupCipher(passphrase, salt, keyBackupIterations)
+	if err != nil {
+		return keyBackup{}, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return keyBackup{}, err
+	}
+	return keyBackup{
+		Version:    keyBackupVersion,
+		Iterations: keyBackupIterations,
+		Salt:       salt,
+		Nonce:      nonce,
+		Ciphertext: aead.Seal(nil, nonce, plaintext, nil),
+	}, nil
+}
+
+// openKeys decrypts a key set encrypted by sealKeys.
+func openKeys(backup keyBackup, passphrase string) (storage.Keys, error) {
+	if backup.Version != keyBackupVersion {
+		return storage.Keys{}, fmt.Errorf("unsupported key backup version %d", backup.Version)
+	}
+	if backup.Iterations <= 0 || backup.Iterations > maxKeyBackupIterations {
+		return storage.Keys{}, fmt.Errorf("invalid number of iterations %d", backup.Iterations)
+	}
+	aead, err := keyBackupCipher(passphrase, backup.Salt, backup.Iterations)
+	if err != nil {
+		return storage.Keys{}, err
+	}
+	if len(backup.Nonce) != aead.NonceSize() {
+		return storage.Keys{}, errWrongPassphrase
+	}
+	plaintext, err := aead.Open(nil, backup.Nonce, backup.Ciphertext, nil)
+	if err != nil {
+		return storage.Keys{}, errWrongPassphrase
+	}
+	var keys storage.Keys
+	if err := json.Unmarshal(plaintext, &keys); err != nil {
+		return storage.Keys{}, fmt.Errorf("unmarshal keys: %v", err)
+	}
+
+	if keys.SigningKey == nil || keys.SigningKeyPub == nil || keys.SigningKey.IsPublic() {
+		return storage.Keys{}, errors.New("key backup holds no private signing key")
+	}
+	if keys.SigningKey.KeyID == "" || keys.SigningKey.KeyID != keys.SigningKeyPub.KeyID {
+		return storage.Keys{}, errors.New("key backup holds mismatched signing keys")
+	}
+	if _, err := signatureAlgorithm(keys.SigningKey); err != nil {
+		return storage.Keys{}, err
+	}
+	for _, vk := range keys.VerificationKeys {
+		if vk.PublicKey == nil || vk.PublicKey.KeyID == "" {
+			return storage.Keys{}, errors.New("key backup holds a verification key without an ID")
+		}
+	}
+	return keys, nil
+}
+
+// mergeKeys imports a key set into the current one. The imported signing key
+// replaces the current one, which is kept for verifying the tokens it signed.
+// The imported key is rotated as usual once its next rotation has passed.
+func mergeKeys(current, imported storage.Keys, now time.Time, idTokensValidFor time.Duration) (storage.Keys, error) {
+	thumbprints := make(map[string]string)
+	addKey := func(k *jose.JSONWebKey) error {
+		if k == nil {
+			return nil
+		}
+		thumbprint, err := k.Thumbprint(crypto.SHA256)
+		if err != nil {
+			return err
+		}
+		if t, ok := thumbprints[k.KeyID]; ok && t != string(thumbprint) {
+			return keyConflictError{k.KeyID}
+		}
+		thumbprints[k.KeyID] = string(thumbprint)
+		return nil
+	}
+	if err := addKey(current.SigningKeyPub); err != nil {
+		return storage.Keys{}, err
+	}
+	for _, vk := range current.VerificationKeys {
+		if err := addKey(vk.PublicKey); err != nil {
+			return storage.Keys{}, err
+		}
+	}
+	if err := addKey(imported.SigningKeyPub); err != nil {
+		return storage.Keys{}, err
+	}
+	for _, vk := range imported.VerificationKeys {
+		if err := addKey(vk.PublicKey); err != nil {
+			return storage.Keys{}, err
+		}
+	}
+
+	merged := storage.Keys{
+		SigningKey:    imported.SigningKey,
+		SigningKeyPub: imported.SigningKeyPub,
+		NextRotation:  imported.NextRotation,
+	}
+	seen := map[string]bool{imported.SigningKeyPub.KeyID: true}
+	addVerificationKey := func(vk storage.VerificationKey) {
+		if seen[vk.PublicKey.KeyID] || now.After(vk.Expiry) {
+			return
+		}
+		seen[vk.PublicKey.KeyID] = true
+		merged.VerificationKeys = append(merged.VerificationKeys, vk)
+	}
+	if current.SigningKeyPub != nil {
+		addVerificationKey(storage.VerificationKey{
+			PublicKey: current.SigningKeyPub,
+			Expiry:    now.Add(idTokensValidFor),
+		})
+	}
+	for _, vk := range current.VerificationKeys {
+		addVerificationKey(vk)
+	}
+	for _, vk := range imported.VerificationKeys {
+		addVerificationKey(vk)
+	}
+	return merged, nil
+}
+
+// handleAdminKeysExport returns the key set, including the private signing
+// key, encrypted under the passphrase given in a body of the form
+// {"passphrase": "..."}. It's only served by the internal handler.
+func (s *Server) handleAdminKeysExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		s.tokenErrHelper(w, errInvalidRequest, "Unsupported request method.", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Passphrase string `json:"passphrase"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Passphrase == "" {
+		s.tokenErrHelper(w, errInvalidRequest, `Request body must be of the form {"passphrase": "..."}.`, http.StatusBadRequest)
+		return
+	}
+
+	keys, err := s.storage.GetKeys()
+	if err != nil {
+		if err == storage.ErrNotFound {
+			s.tokenErrHelper(w, errInvalidRequest, "No keys to export.", http.StatusNotFound)
+			return
+		}
+		s.logger.Errorf("failed to get keys: %v", err)
+		s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+	if keys.SigningKey == nil {
+		s.tokenErrHelper(w, errInvalidRequest, "No keys to export.", http.StatusNotFound)
+		return
+	}
+	backup, err := sealKeys(keys, req.Passphrase)
+	if err != nil {
+		s.logger.Errorf("failed to encrypt keys: %v", err)
+		s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+	data, err := json.Marshal(backup)
+	if err != nil {
+		s.logger.Errorf("failed to marshal key backup: %v", err)
+		s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+	s.logger.Infof("exported signing key %q", keys.SigningKey.KeyID)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// handleAdminKeysImport restores a key set exported by handleAdminKeysExport,
+// given in a body of the form {"passphrase": "...", "keys": {...}}. Its
+// signing key is used from then on. It's only served by the internal handler.
+func (s *Server) handleAdminKeysImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		s.tokenErrHelper(w, errInvalidRequest, "Unsupported request method.", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Passphrase string     `json:"passphrase"`
+		Keys       *keyBackup `json:"keys"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Passphrase == "" || req.Keys == nil {
+		s.tokenErrHelper(w, errInvalidRequest, `Request body must be of the form {"passphrase": "...", "keys": {...}}.`, http.StatusBadRequest)
+		return
+	}
+	imported, err := openKeys(*req.Keys, req.Passphrase)
+	if err != nil {
+		s.tokenErrHelper(w, errInvalidRequest, fmt.Sprintf("Invalid key backup: %v.", err), http.StatusBadRequest)
+		return
+	}
+
+	err = s.storage.UpdateKeys(func(old storage.Keys) (storage.Keys, error) {
+		return mergeKeys(old, imported, s.now(), s.idTokensValidFor)
+	})
+	if err != nil {
+		if _, ok := err.(keyConflictError); ok {
+			s.tokenErrHelper(w, errInvalidRequest, fmt.Sprintf("Can't import keys: %v.", err), http.StatusConflict)
+			return
+		}
+		s.logger.Errorf("failed to import keys: %v", err)
+		s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+	s.logger.Infof("imported signing key %q", imported.SigningKey.KeyID)
+	w.WriteHeader(http.StatusNoContent)
+}
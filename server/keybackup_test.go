@@ -0,0 +1,149 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	jose "gopkg.in/square/go-jose.v2"
+
+	"github.com/dexidp/dex/storage"
+)
+
+func TestKeyBackup(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	config := func(c *Config) {
+		c.Issuer = "https://dex.example.com"
+		c.AdminAPIKey = "admin-key"
+		c.InternalAdminAPI = true
+	}
+	httpServer1, server1 := newTestServer(ctx, t, config)
+	defer httpServer1.Close()
+	httpServer2, server2 := newTestServer(ctx, t, config)
+	defer httpServer2.Close()
+
+	// Both test servers sign with the same key, so give the first its own.
+	newKey := func(keyID string) (*jose.JSONWebKey, *jose.JSONWebKey) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &jose.JSONWebKey{Key: key, KeyID: keyID, Algorithm: "ES256", Use: "sig"},
+			&jose.JSONWebKey{Key: key.Public(), KeyID: keyID, Algorithm: "ES256", Use: "sig"}
+	}
+	priv, pub := newKey("backed-up")
+	err := server1.storage.UpdateKeys(func(storage.Keys) (storage.Keys, error) {
+		return storage.Keys{SigningKey: priv, SigningKeyPub: pub, NextRotation: time.Now().Add(time.Hour)}, nil
+	})
+	if err != nil {
+		t.Fatalf("update keys: %v", err)
+	}
+
+	client := storage.Client{ID: "client", Secret: "secret", RedirectURIs: []string{"https://example.com/callback"}}
+	idToken := func(s *Server) string {
+		if err := s.storage.CreateClient(client); err != nil && err != storage.ErrAlreadyExists {
+			t.Fatalf("create client: %v", err)
+		}
+		rr := exchangeTestAuthCode(s, client, newTestAuthCode(t, s, client))
+		var resp struct {
+			IDToken string `json:"id_token"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil || resp.IDToken == "" {
+			t.Fatalf("expected an ID token, got %d: %s", rr.Code, rr.Body)
+		}
+		return resp.IDToken
+	}
+	keyID := func(token string) string {
+		jws, err := jose.ParseSigned(token)
+		if err != nil {
+			t.Fatalf("parse token: %v", err)
+		}
+		return jws.Signatures[0].Header.KeyID
+	}
+	post := func(h http.Handler, target string, body interface{}) *httptest.ResponseRecorder {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest("POST", target, bytes.NewReader(data))
+		req.Header.Set("Authorization", "Bearer admin-key")
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+
+	token := idToken(server1)
+	if _, err := server2.verifyIDToken(token); err == nil {
+		t.Fatal("expected a token of the first server not to verify before importing its keys")
+	}
+
+	passphrase := map[string]string{"passphrase": "correct horse battery staple"}
+	if rr := post(server1, "/admin/keys/export", passphrase); rr.Code != http.StatusNotFound {
+		t.Errorf("expected the export endpoint to be unreachable on the public handler, got %d", rr.Code)
+	}
+	rr := post(server1.InternalHandler(), "/admin/keys/export", passphrase)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 exporting keys, got %d: %s", rr.Code, rr.Body)
+	}
+	if bytes.Contains(rr.Body.Bytes(), []byte("backed-up")) {
+		t.Errorf("expected exported keys to be encrypted, got %s", rr.Body)
+	}
+	var backup keyBackup
+	if err := json.Unmarshal(rr.Body.Bytes(), &backup); err != nil {
+		t.Fatalf("unmarshal key backup: %v", err)
+	}
+
+	rr = post(server2.InternalHandler(), "/admin/keys/import", map[string]interface{}{"passphrase": "wrong", "keys": backup})
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 importing with the wrong passphrase, got %d: %s", rr.Code, rr.Body)
+	}
+	rr = post(server2.InternalHandler(), "/admin/keys/import", map[string]interface{}{"passphrase": passphrase["passphrase"], "keys": backup})
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("expected 204 importing keys, got %d: %s", rr.Code, rr.Body)
+	}
+
+	if _, err := server2.verifyIDToken(token); err != nil {
+		t.Errorf("expected a token of the first server to verify after importing its keys: %v", err)
+	}
+	if kid := keyID(idToken(server2)); kid != "backed-up" {
+		t.Errorf("expected tokens to be signed with the imported key, got key ID %q", kid)
+	}
+	keys, err := server2.storage.GetKeys()
+	if err != nil {
+		t.Fatalf("get keys: %v", err)
+	}
+	if len(keys.VerificationKeys) != 1 {
+		t.Errorf("expected the replaced signing key to be kept for verification, got %d verification keys", len(keys.VerificationKeys))
+	}
+
+	// Importing the same keys again is fine, a different key with the same ID
+	// isn't.
+	rr = post(server2.InternalHandler(), "/admin/keys/import", map[string]interface{}{"passphrase": passphrase["passphrase"], "keys": backup})
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("expected 204 importing the same keys again, got %d: %s", rr.Code, rr.Body)
+	}
+	priv, pub = newKey("backed-up")
+	conflicting, err := sealKeys(storage.Keys{SigningKey: priv, SigningKeyPub: pub, NextRotation: time.Now().Add(time.Hour)}, "passphrase")
+	if err != nil {
+		t.Fatalf("seal keys: %v", err)
+	}
+	rr = post(server2.InternalHandler(), "/admin/keys/import", map[string]interface{}{"passphrase": "passphrase", "keys": conflicting})
+	if rr.Code != http.StatusConflict {
+		t.Errorf("expected 409 importing a different key with an existing ID, got %d: %s", rr.Code, rr.Body)
+	}
+	if kid := keyID(idToken(server2)); kid != "backed-up" {
+		t.Errorf("expected a rejected import not to change the signing key, got key ID %q", kid)
+	}
+	if _, err := server2.verifyIDToken(token); err != nil {
+		t.Errorf("expected a rejected import not to change the signing key: %v", err)
+	}
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"fmt"
+	"time"
+)
+
+const day = 24 * time.Hour
+
+// lifetime is a configured duration, with defaults applied, and the range it
+// must be within. The bounds catch mistakes such as a missing unit or a token
+// valid for years rather than restrict deployments.
+type lifetime struct {
+	name  string
+	value time.Duration
+	min   time.Duration
+	max   time.Duration
+	// Zero means the lifetime is disabled or unlimited.
+	optional bool
+}
+
+func (l lifetime) validate() error {
+	switch {
+	case l.value == 0 && l.optional:
+		return nil
+	case l.value < 0:
+		return fmt.Errorf("%s expiry %s can't be negative", l.name, l.value)
+	case l.value < l.min:
+		return fmt.Errorf("%s expiry %s is shorter than the minimum of %s", l.name, l.value, l.min)
+	case l.value > l.max:
+		return fmt.Errorf("%s expiry %s is longer than the maximum of %s", l.name, l.value, l.max)
+	}
+	return nil
+}
+
+// validateLifetimes checks the lifetimes of a config against sane bounds, and
+// for settings which contradict each other.
+func validateLifetimes(c Config) error {
+	var (
+		idTokens     = lifetime{"ID token", value(c.IDTokensValidFor, 24*time.Hour), 10 * time.Second, 30 * day, false}
+		authRequests = lifetime{"auth request", value(c.AuthRequestsValidFor, 24*time.Hour), time.Minute, 7 * day, false}
+		authCodes    = lifetime{"auth code", value(c.AuthCodesValidFor, 30*time.Minute), 10 * time.Second, day, false}
+		signingKeys  = lifetime{"signing key", value(c.RotateKeysAfter, 6*time.Hour), time.Minute, 365 * day, false}
+		pending      = lifetime{"pending login", c.PendingLoginsValidFor, 10 * time.Second, 7 * day, true}
+		refresh      = lifetime{"refresh token", c.RefreshTokensValidFor, time.Minute, 5 * 365 * day, true}
+		refreshIdle  = lifetime{"refresh token idle", c.RefreshTokensIdleTimeout, time.Minute, 5 * 365 * day, true}
+		sessionIdle  = lifetime{"session idle", c.SessionIdleTimeout, time.Minute, 5 * 365 * day, true}
+	)
+	for _, l := range []lifetime{idTokens, authRequests, authCodes, signingKeys, pending, refresh, refreshIdle, sessionIdle} {
+		if err := l.validate(); err != nil {
+			return err
+		}
+	}
+
+	// Access tokens live as long as ID tokens, clients refresh them once
+	// they've expired.
+	for _, l := range []lifetime{refresh, refreshIdle, sessionIdle} {
+		if l.value != 0 && l.value < idTokens.value {
+			return fmt.Errorf("%s expiry %s is shorter than the ID token expiry %s, tokens couldn't be refreshed", l.name, l.value, idTokens.value)
+		}
+	}
+	for _, l := range []lifetime{refreshIdle, sessionIdle} {
+		if refresh.value != 0 && l.value > refresh.value {
+			return fmt.Errorf("%s expiry %s is longer than the refresh token expiry %s", l.name, l.value, refresh.value)
+		}
+	}
+	if pending.value > authRequests.value {
+		return fmt.Errorf("pending login expiry %s is longer than the auth request expiry %s", pending.value, authRequests.value)
+	}
+	return nil
+}
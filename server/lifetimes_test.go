@@ -0,0 +1,72 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateLifetimes(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr string
+	}{
+		{name: "defaults"},
+		{
+			name:   "all set",
+			config: Config{IDTokensValidFor: time.Hour, AuthCodesValidFor: 5 * time.Minute, PendingLoginsValidFor: 10 * time.Minute, RefreshTokensValidFor: 720 * time.Hour, RefreshTokensIdleTimeout: 168 * time.Hour, SessionIdleTimeout: 72 * time.Hour},
+		},
+		{
+			name:    "ten year ID tokens",
+			config:  Config{IDTokensValidFor: 10 * 365 * 24 * time.Hour},
+			wantErr: "ID token expiry 87600h0m0s is longer than the maximum",
+		},
+		{
+			name:    "auth codes without a unit",
+			config:  Config{AuthCodesValidFor: 600},
+			wantErr: "auth code expiry 600ns is shorter than the minimum",
+		},
+		{
+			name:    "negative refresh tokens",
+			config:  Config{RefreshTokensValidFor: -time.Hour},
+			wantErr: "refresh token expiry -1h0m0s can't be negative",
+		},
+		{
+			name:    "refresh tokens shorter than ID tokens",
+			config:  Config{IDTokensValidFor: 2 * time.Hour, RefreshTokensValidFor: time.Hour},
+			wantErr: "refresh token expiry 1h0m0s is shorter than the ID token expiry",
+		},
+		{
+			name:    "idle refresh tokens shorter than ID tokens",
+			config:  Config{RefreshTokensIdleTimeout: time.Hour},
+			wantErr: "refresh token idle expiry 1h0m0s is shorter than the ID token expiry",
+		},
+		{
+			name:    "idle longer than absolute refresh token expiry",
+			config:  Config{RefreshTokensValidFor: 48 * time.Hour, RefreshTokensIdleTimeout: 72 * time.Hour},
+			wantErr: "refresh token idle expiry 72h0m0s is longer than the refresh token expiry",
+		},
+		{
+			name:    "idle sessions longer than absolute refresh token expiry",
+			config:  Config{RefreshTokensValidFor: 48 * time.Hour, SessionIdleTimeout: 72 * time.Hour},
+			wantErr: "session idle expiry 72h0m0s is longer than the refresh token expiry",
+		},
+		{
+			name:    "pending logins outliving auth requests",
+			config:  Config{AuthRequestsValidFor: time.Hour, PendingLoginsValidFor: 2 * time.Hour},
+			wantErr: "pending login expiry 2h0m0s is longer than the auth request expiry",
+		},
+	}
+	for _, tc := range tests {
+		err := validateLifetimes(tc.config)
+		switch {
+		case tc.wantErr == "" && err != nil:
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+		case tc.wantErr != "" && err == nil:
+			t.Errorf("%s: expected error %q", tc.name, tc.wantErr)
+		case tc.wantErr != "" && !strings.Contains(err.Error(), tc.wantErr):
+			t.Errorf("%s: expected error %q, got %q", tc.name, tc.wantErr, err)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+// AuthRequestLimits caps the size of authorization requests, which end up in
+// URLs, logs and the request headers of proxies in front of the server. Zero
+// values use the defaults and negative values disable a limit.
+type AuthRequestLimits struct {
+	// Length of the query string and form body combined. Defaults to 8192.
+	Query int `json:"query"`
+
+	// Lengths of the "scope", "claims" and "request" parameters. Default to
+	// 1024, 4096 and 4096.
+	Scope   int `json:"scope"`
+	Claims  int `json:"claims"`
+	Request int `json:"request"`
+
+	// Number of distinct scopes, which bounds the size of tokens and of the
+	// stored requests. Defaults to 32.
+	ScopeCount int `json:"scopeCount"`
+}
+
+func limit(val, defaultValue int) int {
+	if val == 0 {
+		return defaultValue
+	}
+	return val
+}
+
+func (l AuthRequestLimits) withDefaults() AuthRequestLimits {
+	return AuthRequestLimits{
+		Query:   limit(l.Query, 8192),
+		Scope:   limit(l.Scope, 1024),
+		Claims:  limit(l.Claims, 4096),
+		Request: limit(l.Request, 4096),
+
+		ScopeCount: limit(l.ScopeCount, 32),
+	}
+}
+
+// check returns a description of the first limit a parsed authorization
+// request exceeds, or an empty string if it's within all of them.
+func (l AuthRequestLimits) check(r *http.Request) string {
+	exceeds := func(n, max int) bool { return max > 0 && n > max }
+
+	n := len(r.URL.RawQuery)
+	if r.PostForm != nil {
+		n += len(r.PostForm.Encode())
+	}
+	if exceeds(n, l.Query) {
+		return fmt.Sprintf("Authorization request exceeds the maximum length of %d bytes.", l.Query)
+	}
+	for _, p := range []struct {
+		name string
+		max  int
+	}{
+		{"scope", l.Scope},
+		{"claims", l.Claims},
+		{"request", l.Request},
+	} {
+		if exceeds(len(r.Form.Get(p.name)), p.max) {
+			return fmt.Sprintf("Parameter %q exceeds the maximum length of %d bytes.", p.name, p.max)
+		}
+	}
+	return ""
+}
+
+// IDTokenSizeLimit caps the size of signed ID tokens. Clients often keep them
+// in cookies or forward them in headers, which break past a few kilobytes,
+// usually because of users in many groups.
+type IDTokenSizeLimit struct {
+	// Maximum length of a signed ID token in bytes. Zero disables the limit.
+	MaxBytes int `json:"maxBytes"`
+
+	// What to do with larger tokens: "reject" them, the default, or "trim"
+	// the claims listed in TrimClaims until they fit.
+	Policy string `json:"policy"`
+
+	// Claims dropped from oversized tokens, in order. Defaults to "groups".
+	// Claims the client requested as essential are kept.
+	TrimClaims []string `json:"trimClaims"`
+}
+
+const (
+	idTokenSizePolicyReject = "reject"
+	idTokenSizePolicyTrim   = "trim"
+)
+
+// Claims which clients and verifiers rely on, and which can't be trimmed.
+var untrimmableClaims = map[string]bool{
+	"iss":       true,
+	"sub":       true,
+	"aud":       true,
+	"exp":       true,
+	"iat":       true,
+	"jti":       true,
+	"auth_time": true,
+	"nbf":       true,
+	"azp":       true,
+	"nonce":     true,
+	"sid":       true,
+	"at_hash":   true,
+	"act":       true,
+	"may_act":   true,
+}
+
+func (l IDTokenSizeLimit) withDefaults() IDTokenSizeLimit {
+	if l.Policy == "" {
+		l.Policy = idTokenSizePolicyReject
+	}
+	if len(l.TrimClaims) == 0 {
+		l.TrimClaims = []string{"groups"}
+	}
+	return l
+}
+
+func (l IDTokenSizeLimit) validate() error {
+	if l.MaxBytes < 0 {
+		return errors.New("maximum size can't be negative")
+	}
+	switch l.Policy {
+	case "", idTokenSizePolicyReject, idTokenSizePolicyTrim:
+	default:
+		return fmt.Errorf("unknown policy %q", l.Policy)
+	}
+	for _, claim := range l.TrimClaims {
+		if untrimmableClaims[claim] {
+			return fmt.Errorf("claim %q can't be trimmed", claim)
+		}
+	}
+	return nil
+}
+
+// fitIDToken enforces the ID token size limit on a signed token. Oversized
+// tokens are signed again without the claims the policy lets it trim, or
+// denied.
+func (s *Server) fitIDToken(clientID string, signingKey jose.SigningKey, payload []byte, idToken string, requestedClaims map[string]bool, renames map[string]string) (string, error) {
+	l := s.idTokenSizeLimit
+	if l.MaxBytes == 0 || len(idToken) <= l.MaxBytes {
+		return idToken, nil
+	}
+	size := len(idToken)
+
+	if l.Policy == idTokenSizePolicyTrim {
+		var tok map[string]json.RawMessage
+		if err := json.Unmarshal(payload, &tok); err != nil {
+			return "", fmt.Errorf("could not parse claims: %v", err)
+		}
+		var trimmed []string
+		for _, claim := range l.TrimClaims {
+			if requestedClaims[claim] {
+				continue
+			}
+			// Claims are trimmed under the name the client gets them as.
+			if name, ok := renames[claim]; ok {
+				claim = name
+			}
+			if _, ok := tok[claim]; !ok {
+				continue
+			}
+			delete(tok, claim)
+			trimmed = append(trimmed, claim)
+
+			payload, err := json.Marshal(tok)
+			if err != nil {
+				return "", fmt.Errorf("could not serialize claims: %v", err)
+			}
+			if idToken, err = signPayload(signingKey, payload); err != nil {
+				return "", err
+			}
+			if len(idToken) <= l.MaxBytes {
+				s.logger.Infof("ID token for client %q of %d bytes exceeded the maximum of %d, trimmed claims: %s",
+					clientID, size, l.MaxBytes, strings.Join(trimmed, ", "))
+				return idToken, nil
+			}
+		}
+	}
+
+	s.logger.Errorf("ID token for client %q of %d bytes exceeds the maximum of %d", clientID, size, l.MaxBytes)
+	return "", tokenDeniedError{"The ID token would exceed the maximum size."}
+}
+
+// PendingLoginLimits caps the number of logins started but not completed yet,
+// so a flood of authorization requests can't exhaust the storage. Zero values
+// disable a limit.
+type PendingLoginLimits struct {
+	// Across all users.
+	Total int `json:"total"`
+
+	// Per IP address logins are started from.
+	PerIP int `json:"perIP"`
+}
+
+func (l PendingLoginLimits) validate() error {
+	if l.Total < 0 || l.PerIP < 0 {
+		return errors.New("pending login limits can't be negative")
+	}
+	return nil
+}
+
+// pendingLogin is a login counted against the limits.
+type pendingLogin struct {
+	ip     string
+	expiry time.Time
+}
+
+// pendingLoginLimiter counts the logins started, until they complete or their
+// auth request expires. It's only kept in memory, so each dex instance
+// enforces the limits separately.
+type pendingLoginLimiter struct {
+	limits PendingLoginLimits
+
+	mu sync.Mutex
+	// Logins by auth request ID, guarded by the mutex.
+	pending map[string]pendingLogin
+}
+
+func newPendingLoginLimiter(limits PendingLoginLimits) *pendingLoginLimiter {
+	return &pendingLoginLimiter{limits: limits, pending: make(map[string]pendingLogin)}
+}
+
+// start records a login started from an IP address, unless it would exceed
+// the limits.
+func (l *pendingLoginLimiter) start(authReqID, ip string, expiry, now time.Time) bool {
+	if l.limits.Total == 0 && l.limits.PerIP == 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fromIP := 0
+	for id, p := range l.pending {
+		if now.After(p.expiry) {
+			delete(l.pending, id)
+		} else if p.ip == ip {
+			fromIP++
+		}
+	}
+	if l.limits.Total > 0 && len(l.pending) >= l.limits.Total {
+		return false
+	}
+	if l.limits.PerIP > 0 && fromIP >= l.limits.PerIP {
+		return false
+	}
+	l.pending[authReqID] = pendingLogin{ip, expiry}
+	return true
+}
+
+// end frees the capacity held by a login which completed or was refused.
+func (l *pendingLoginLimiter) end(authReqID string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.pending, authReqID)
+}
+
+// remoteIP returns the IP address a request comes from.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,320 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/dexidp/dex/server/internal"
+	"github.com/dexidp/dex/storage"
+)
+
+// sessionIDHash returns the sid claim of a login, so ID tokens don't expose
+// the session ID stored with its refresh tokens.
+func sessionIDHash(sessionID string) string {
+	sum := sha256.Sum256([]byte(sessionID))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// handleLogout implements RP-initiated logout. It ends the login the ID token
+// passed as id_token_hint was issued for by deleting the refresh tokens of
+// that login, then redirects to post_logout_redirect_uri if given.
+//
+// https://openid.net/specs/openid-connect-rpinitiated-1_0.html
+func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		s.renderError(w, http.StatusMethodNotAllowed, "Method not supported.")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		s.renderError(w, http.StatusBadRequest, "Failed to parse request.")
+		return
+	}
+	hint := r.Form.Get("id_token_hint")
+	if hint == "" {
+		s.renderError(w, http.StatusBadRequest, "No id_token_hint provided.")
+		return
+	}
+	// The ID token has usually expired by the time the user logs out.
+	claims, err := s.verifyIDTokenSignature(hint)
+	if err != nil {
+		s.logger.Errorf("logout: invalid id_token_hint: %v", err)
+		s.renderError(w, http.StatusBadRequest, "Invalid id_token_hint.")
+		return
+	}
+
+	redirectURI := r.Form.Get("post_logout_redirect_uri")
+	if redirectURI != "" {
+		ok, err := s.postLogoutRedirectAllowed(claims, redirectURI)
+		if err != nil {
+			s.logger.Errorf("logout: failed to get client: %v", err)
+			s.renderError(w, http.StatusInternalServerError, "Internal server error.")
+			return
+		}
+		if !ok {
+			s.renderError(w, http.StatusBadRequest, "Unregistered post_logout_redirect_uri.")
+			return
+		}
+	}
+
+	// Tokens issued before dex recorded sessions have no sid, and nothing to
+	// end.
+	if claims.SessionID != "" {
+		var sub internal.IDTokenSubject
+		if err := internal.Unmarshal(claims.Subject, &sub); err != nil {
+			s.logger.Errorf("logout: failed to unmarshal subject: %v", err)
+			s.renderError(w, http.StatusBadRequest, "Invalid id_token_hint.")
+			return
+		}
+		clientIDs, err := s.endSession(sub.UserId, sub.ConnId, claims.SessionID)
+		if err != nil {
+			s.logger.Errorf("logout: %v", err)
+			s.renderError(w, http.StatusInternalServerError, "Internal server error.")
+			return
+		}
+		// The client logging the user out took part in the session too, even
+		// if it holds no refresh token.
+		if clientID := idTokenClientID(claims); clientID != "" {
+			clientIDs[clientID] = true
+		}
+		s.notifyLogout(claims.Subject, claims.SessionID, clientIDs)
+	}
+
+	if redirectURI == "" {
+		if err := s.templates.logout(w); err != nil {
+			s.logger.Errorf("Server template error: %v", err)
+		}
+		return
+	}
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		s.renderError(w, http.StatusBadRequest, "Invalid post_logout_redirect_uri.")
+		return
+	}
+	if state := r.Form.Get("state"); state != "" {
+		q := u.Query()
+		q.Set("state", state)
+		u.RawQuery = q.Encode()
+	}
+	http.Redirect(w, r, u.String(), http.StatusSeeOther)
+}
+
+// postLogoutRedirectAllowed reports if a redirect URI is registered for the
+// client an ID token was issued to.
+func (s *Server) postLogoutRedirectAllowed(claims idTokenClaims, redirectURI string) (bool, error) {
+	client, err := s.storage.GetClient(idTokenClientID(claims))
+	if err != nil {
+		if err == storage.ErrNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	for _, uri := range client.RedirectURIs {
+		if uri == redirectURI {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// idTokenClientID returns the client an ID token was issued to.
+func idTokenClientID(claims idTokenClaims) string {
+	if claims.AuthorizingParty != "" {
+		return claims.AuthorizingParty
+	}
+	if len(claims.Audience) > 0 {
+		return claims.Audience[0]
+	}
+	return ""
+}
+
+// endSession deletes the refresh tokens of the user's login with the given
+// sid, returning the clients they were issued to. Refresh tokens of other
+// logins by the same user are kept.
+func (s *Server) endSession(userID, connID, sid string) (map[string]bool, error) {
+	clientIDs := make(map[string]bool)
+	session, err := s.storage.GetOfflineSessions(userID, connID)
+	if err != nil {
+		if err == storage.ErrNotFound {
+			return clientIDs, nil
+		}
+		return nil, fmt.Errorf("get offline session: %v", err)
+	}
+	for _, ref := range session.Refresh {
+		refresh, err := s.storage.GetRefresh(ref.ID)
+		if err != nil {
+			if err == storage.ErrNotFound {
+				continue
+			}
+			return nil, fmt.Errorf("get refresh token: %v", err)
+		}
+		if refresh.Claims.SessionID == "" || sessionIDHash(refresh.Claims.SessionID) != sid {
+			continue
+		}
+		if err := s.deleteRefreshToken(refresh); err != nil {
+			return nil, err
+		}
+		clientIDs[refresh.ClientID] = true
+	}
+	return clientIDs, nil
+}
+
+// sessionLastUsed returns when a refresh token of the login with the given
+// session ID was last used, starting from one of them.
+func (s *Server) sessionLastUsed(refresh storage.RefreshToken) (time.Time, error) {
+	lastUsed := refresh.LastUsed
+	session, err := s.storage.GetOfflineSessions(refresh.Claims.UserID, refresh.ConnectorID)
+	if err != nil {
+		if err == storage.ErrNotFound {
+			return lastUsed, nil
+		}
+		return lastUsed, fmt.Errorf("get offline session: %v", err)
+	}
+	for _, ref := range session.Refresh {
+		if ref.ID == refresh.ID || ref.LastUsed.Before(lastUsed) {
+			continue
+		}
+		other, err := s.storage.GetRefresh(ref.ID)
+		if err != nil {
+			if err == storage.ErrNotFound {
+				continue
+			}
+			return lastUsed, fmt.Errorf("get refresh token: %v", err)
+		}
+		if other.Claims.SessionID == refresh.Claims.SessionID && other.LastUsed.After(lastUsed) {
+			lastUsed = other.LastUsed
+		}
+	}
+	return lastUsed, nil
+}
+
+// backchannelLogout configures the delivery of logout tokens.
+type backchannelLogout struct {
+	client *http.Client
+	// Deliveries are retried, doubling the delay between attempts.
+	attempts   int
+	retryDelay time.Duration
+}
+
+// backchannelLogoutEvent is the event of a logout token.
+//
+// https://openid.net/specs/openid-connect-backchannel-1_0.html#LogoutToken
+const backchannelLogoutEvent = "http://schemas.openid.net/event/backchannel-logout"
+
+// logoutTokenType is the "typ" header of logout tokens, which distinguishes
+// them from ID tokens.
+const logoutTokenType = "logout+jwt"
+
+type logoutTokenClaims struct {
+	Issuer    string              `json:"iss"`
+	Subject   string              `json:"sub"`
+	Audience  audience            `json:"aud"`
+	IssuedAt  int64               `json:"iat"`
+	Expiry    int64               `json:"exp"`
+	JWTID     string              `json:"jti"`
+	SessionID string              `json:"sid"`
+	Events    map[string]struct{} `json:"events"`
+}
+
+// notifyLogout sends a logout token to the clients which registered a
+// back-channel logout URI. Deliveries happen in the background so a slow
+// client doesn't hold up the user.
+func (s *Server) notifyLogout(subject, sid string, clientIDs map[string]bool) {
+	for clientID := range clientIDs {
+		client, err := s.storage.GetClient(clientID)
+		if err != nil {
+			if err != storage.ErrNotFound {
+				s.logger.Errorf("back-channel logout: failed to get client %q: %v", clientID, err)
+			}
+			continue
+		}
+		if client.BackchannelLogoutURI == "" {
+			continue
+		}
+		token, err := s.newLogoutToken(client.ID, subject, sid)
+		if err != nil {
+			s.logger.Errorf("back-channel logout: failed to create logout token for client %q: %v", client.ID, err)
+			continue
+		}
+		go s.sendLogoutToken(client.ID, client.BackchannelLogoutURI, token)
+	}
+}
+
+func (s *Server) newLogoutToken(clientID, subject, sid string) (string, error) {
+	keys, err := s.getKeys()
+	if err != nil {
+		return "", fmt.Errorf("get keys: %v", err)
+	}
+	signingKey, err := s.signingKey(keys)
+	if err != nil {
+		return "", err
+	}
+
+	issuedAt := s.now()
+	payload, err := json.Marshal(logoutTokenClaims{
+		Issuer:    s.issuerURL.String(),
+		Subject:   subject,
+		Audience:  audience{clientID},
+		IssuedAt:  issuedAt.Unix(),
+		Expiry:    issuedAt.Add(2 * time.Minute).Unix(),
+		JWTID:     storage.NewID(),
+		SessionID: sid,
+		Events:    map[string]struct{}{backchannelLogoutEvent: {}},
+	})
+	if err != nil {
+		return "", fmt.Errorf("marshal logout token: %v", err)
+	}
+	return signTypedPayload(signingKey, logoutTokenType, payload)
+}
+
+// sendLogoutToken POSTs a logout token to a client, retrying on network and
+// server errors. A client error means the client rejected the token, which
+// retrying won't change.
+func (s *Server) sendLogoutToken(clientID, uri, token string) {
+	b := s.backchannelLogout
+	delay := b.retryDelay
+	for attempt := 1; ; attempt++ {
+		err := b.post(uri, token)
+		if err == nil {
+			return
+		}
+		if _, ok := err.(logoutRejectedError); ok || attempt >= b.attempts {
+			s.logger.Errorf("back-channel logout: failed to notify client %q: %v", clientID, err)
+			return
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// logoutRejectedError is returned when a client answers a logout token with a
+// client error.
+type logoutRejectedError struct {
+	status string
+}
+
+func (e logoutRejectedError) Error() string {
+	return "logout token rejected: " + e.status
+}
+
+func (b *backchannelLogout) post(uri, token string) error {
+	resp, err := b.client.PostForm(uri, url.Values{"logout_token": {token}})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<16))
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		return logoutRejectedError{resp.Status}
+	}
+	return fmt.Errorf("unexpected response: %s", resp.Status)
+}
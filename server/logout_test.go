@@ -0,0 +1,248 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dexidp/dex/storage"
+)
+
+func TestLogout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, server := newTestServer(ctx, t, nil)
+	defer httpServer.Close()
+
+	clientA := storage.Client{ID: "client-a", Secret: "secret-a", RedirectURIs: []string{"https://a.example.com/callback"}}
+	clientB := storage.Client{ID: "client-b", Secret: "secret-b", RedirectURIs: []string{"https://b.example.com/callback"}}
+	for _, c := range []storage.Client{clientA, clientB} {
+		if err := server.storage.CreateClient(c); err != nil {
+			t.Fatalf("create client: %v", err)
+		}
+	}
+
+	// login signs the user in to a client, returning the ID token.
+	login := func(client storage.Client, sessionID string) string {
+		code := storage.AuthCode{
+			ID:          storage.NewID(),
+			ClientID:    client.ID,
+			RedirectURI: client.RedirectURIs[0],
+			Scopes:      []string{scopeOpenID, scopeOfflineAccess},
+			ConnectorID: "mock",
+			Claims:      storage.Claims{UserID: "1", SessionID: sessionID},
+			Expiry:      server.now().Add(time.Hour),
+		}
+		if err := server.storage.CreateAuthCode(code); err != nil {
+			t.Fatalf("create auth code: %v", err)
+		}
+		rr := exchangeTestAuthCode(server, client, code.ID)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("exchange code: expected 200, got %d: %s", rr.Code, rr.Body)
+		}
+		var resp struct {
+			IDToken string `json:"id_token"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("unmarshal token response: %v", err)
+		}
+		return resp.IDToken
+	}
+	idTokenA := login(clientA, "session-a")
+	login(clientB, "session-b")
+
+	claims, err := server.verifyIDToken(idTokenA)
+	if err != nil {
+		t.Fatalf("verify id token: %v", err)
+	}
+	if claims.SessionID == "" || claims.SessionID != sessionIDHash("session-a") {
+		t.Fatalf("expected sid %q, got %q", sessionIDHash("session-a"), claims.SessionID)
+	}
+
+	form := url.Values{
+		"id_token_hint":            {idTokenA},
+		"post_logout_redirect_uri": {"https://evil.example.com"},
+	}
+	r := httptest.NewRequest("POST", "/logout", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	server.ServeHTTP(rr, r)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected an unregistered redirect to be rejected, got %d", rr.Code)
+	}
+
+	// An ID token commonly expires before the user logs out.
+	server.now = func() time.Time { return time.Now().Add(48 * time.Hour) }
+	form.Set("post_logout_redirect_uri", clientA.RedirectURIs[0])
+	form.Set("state", "xyz")
+	r = httptest.NewRequest("POST", "/logout", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr = httptest.NewRecorder()
+	server.ServeHTTP(rr, r)
+	if rr.Code != http.StatusSeeOther {
+		t.Fatalf("expected a redirect, got %d: %s", rr.Code, rr.Body)
+	}
+	if got, want := rr.Header().Get("Location"), clientA.RedirectURIs[0]+"?state=xyz"; got != want {
+		t.Errorf("expected redirect to %q, got %q", want, got)
+	}
+
+	tokens, err := server.storage.ListRefreshTokens()
+	if err != nil {
+		t.Fatalf("list refresh tokens: %v", err)
+	}
+	if len(tokens) != 1 || tokens[0].Claims.SessionID != "session-b" {
+		t.Errorf("expected only the refresh token of the other session to remain, got %+v", tokens)
+	}
+	session, err := server.storage.GetOfflineSessions("1", "mock")
+	if err != nil {
+		t.Fatalf("get offline session: %v", err)
+	}
+	if _, ok := session.Refresh[clientA.ID]; ok {
+		t.Errorf("expected the offline session to drop the ended session's refresh token")
+	}
+}
+
+func TestBackchannelLogout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, server := newTestServer(ctx, t, nil)
+	defer httpServer.Close()
+	server.backchannelLogout.retryDelay = time.Millisecond
+
+	tokens := make(chan string, 2)
+	var attempts int
+	rp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Fail the first delivery to check it's retried.
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		tokens <- r.PostFormValue("logout_token")
+	}))
+	defer rp.Close()
+
+	clientA := storage.Client{ID: "client-a", Secret: "secret-a", RedirectURIs: []string{"https://a.example.com/callback"}, BackchannelLogoutURI: rp.URL}
+	clientB := storage.Client{ID: "client-b", Secret: "secret-b", RedirectURIs: []string{"https://b.example.com/callback"}, BackchannelLogoutURI: rp.URL}
+	for _, c := range []storage.Client{clientA, clientB} {
+		if err := server.storage.CreateClient(c); err != nil {
+			t.Fatalf("create client: %v", err)
+		}
+	}
+
+	var idTokens []string
+	for _, c := range []storage.Client{clientA, clientB} {
+		code := storage.AuthCode{
+			ID:          storage.NewID(),
+			ClientID:    c.ID,
+			RedirectURI: c.RedirectURIs[0],
+			Scopes:      []string{scopeOpenID, scopeOfflineAccess},
+			ConnectorID: "mock",
+			Claims:      storage.Claims{UserID: "1", SessionID: "session-" + c.ID},
+			Expiry:      server.now().Add(time.Hour),
+		}
+		if err := server.storage.CreateAuthCode(code); err != nil {
+			t.Fatalf("create auth code: %v", err)
+		}
+		rr := exchangeTestAuthCode(server, c, code.ID)
+		var resp struct {
+			IDToken string `json:"id_token"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("unmarshal token response: %v", err)
+		}
+		idTokens = append(idTokens, resp.IDToken)
+	}
+
+	rr := httptest.NewRecorder()
+	server.ServeHTTP(rr, httptest.NewRequest("GET", "/logout?id_token_hint="+idTokens[0], nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("logout: expected 200, got %d: %s", rr.Code, rr.Body)
+	}
+
+	var logoutToken string
+	select {
+	case logoutToken = <-tokens:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a logout token to be POSTed")
+	}
+	payload, err := server.verifySignature(logoutToken)
+	if err != nil {
+		t.Fatalf("verify logout token: %v", err)
+	}
+	var claims struct {
+		logoutTokenClaims
+		Nonce  *string                    `json:"nonce"`
+		Events map[string]json.RawMessage `json:"events"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		t.Fatalf("unmarshal logout token: %v", err)
+	}
+	if !claims.Audience.contains(clientA.ID) || claims.SessionID != sessionIDHash("session-client-a") {
+		t.Errorf("expected a logout token for %q with the session's sid, got aud %q and sid %q", clientA.ID, claims.Audience, claims.SessionID)
+	}
+	if string(claims.Events[backchannelLogoutEvent]) != "{}" || claims.Nonce != nil {
+		t.Errorf("expected the back-channel logout event and no nonce, got %s", payload)
+	}
+	if typ := jwsType(logoutToken); typ != logoutTokenType {
+		t.Errorf("expected logout token of type %q, got %q", logoutTokenType, typ)
+	}
+	if _, err := server.verifyIDToken(logoutToken); err == nil {
+		t.Errorf("expected logout token not to be accepted as an id token")
+	}
+
+	select {
+	case <-tokens:
+		t.Errorf("expected only the client of the ended session to be notified")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestIDTokenRejectsLogoutTokens(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, server := newTestServer(ctx, t, nil)
+	defer httpServer.Close()
+
+	keys, err := server.storage.GetKeys()
+	if err != nil {
+		t.Fatalf("get keys: %v", err)
+	}
+	signingKey, err := server.signingKey(keys)
+	if err != nil {
+		t.Fatalf("signing key: %v", err)
+	}
+	now := server.now()
+	payload, err := json.Marshal(logoutTokenClaims{
+		Issuer:   server.issuerURL.String(),
+		Subject:  "1",
+		Audience: audience{"client"},
+		IssuedAt: now.Unix(),
+		Expiry:   now.Add(time.Minute).Unix(),
+		JWTID:    storage.NewID(),
+		Events:   map[string]struct{}{backchannelLogoutEvent: {}},
+	})
+	if err != nil {
+		t.Fatalf("marshal logout token: %v", err)
+	}
+
+	// A logout token is refused for its events claim, even without a type.
+	untyped, err := signPayload(signingKey, payload)
+	if err != nil {
+		t.Fatalf("sign logout token: %v", err)
+	}
+	if _, err := server.verifyIDToken(untyped); err == nil {
+		t.Errorf("expected a token with an events claim not to be accepted as an id token")
+	}
+	if _, err := server.verifyIDTokenSignature(untyped); err == nil {
+		t.Errorf("expected a token with an events claim not to be accepted as an id_token_hint")
+	}
+}
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/dexidp/dex/connector"
+	"github.com/dexidp/dex/storage"
+)
+
+// magicLinkClaims are signed into the links magic link connectors email to
+// users. The auth request stores the ID of the last link sent, so a link can
+// only be followed once, and sending a new one invalidates the previous.
+type magicLinkClaims struct {
+	Issuer    string `json:"iss"`
+	Audience  string `json:"aud"`
+	Email     string `json:"sub"`
+	AuthReqID string `json:"req"`
+	ID        string `json:"jti"`
+	Expiry    int64  `json:"exp"`
+}
+
+var errMagicLinkUsed = errors.New("magic link already used")
+
+// newMagicLink signs a login link for an auth request, valid for the lifetime
+// the connector allows.
+func (s *Server) newMagicLink(authReq storage.AuthRequest, conn connector.MagicLinkConnector, email, id string) (string, error) {
+	claims := magicLinkClaims{
+		Issuer:    s.issuerURL.String(),
+		Audience:  s.absURL("/magiclink"),
+		Email:     email,
+		AuthReqID: authReq.ID,
+		ID:        id,
+		Expiry:    s.now().Add(conn.LinkValidFor()).Unix(),
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", fmt.Errorf("could not serialize claims: %v", err)
+	}
+	keys, err := s.getKeys()
+	if err != nil {
+		return "", err
+	}
+	signingKey, err := s.signingKey(keys)
+	if err != nil {
+		return "", err
+	}
+	token, err := signPayload(signingKey, payload)
+	if err != nil {
+		return "", err
+	}
+	return s.absURL("/magiclink") + "?" + url.Values{"token": {token}}.Encode(), nil
+}
+
+// handleMagicLinkPOST emails a login link to the address entered on the login
+// page of a magic link connector.
+func (s *Server) handleMagicLinkPOST(w http.ResponseWriter, r *http.Request, authReq storage.AuthRequest, tmpls *templates, magicLinkConn connector.MagicLinkConnector, showBacklink bool) {
+	email, ok := parseEmail(r.PostFormValue("email"))
+	if !ok {
+		if err := tmpls.magicLink(w, r.URL.String(), r.PostFormValue("email"), false, true, false, showBacklink); err != nil {
+			s.logger.Errorf("Server template error: %v", err)
+		}
+		return
+	}
+
+	id := storage.NewID()
+	link, err := s.newMagicLink(authReq, magicLinkConn, email, id)
+	if err != nil {
+		s.logger.Errorf("Failed to sign magic link: %v", err)
+		s.renderErrorWith(w, tmpls, http.StatusInternalServerError, "Login error.")
+		return
+	}
+	updater := func(a storage.AuthRequest) (storage.AuthRequest, error) {
+		a.ConnectorData = []byte(id)
+		return a, nil
+	}
+	if err := s.storage.UpdateAuthRequest(authReq.ID, updater); err != nil {
+		s.logger.Errorf("Failed to update auth request: %v", err)
+		s.renderErrorWith(w, tmpls, http.StatusInternalServerError, "Database error.")
+		return
+	}
+
+	if err := magicLinkConn.SendLink(r.Context(), email, link); err != nil {
+		if err == connector.ErrRateLimited {
+			w.WriteHeader(http.StatusTooManyRequests)
+			if err := tmpls.magicLink(w, r.URL.String(), email, false, false, true, showBacklink); err != nil {
+				s.logger.Errorf("Server template error: %v", err)
+			}
+			return
+		}
+		s.logger.Errorf("Failed to send magic link: %v", err)
+		s.renderErrorWith(w, tmpls, http.StatusInternalServerError, "Failed to send the login link.")
+		return
+	}
+	if err := tmpls.magicLink(w, r.URL.String(), email, true, false, false, showBacklink); err != nil {
+		s.logger.Errorf("Server template error: %v", err)
+	}
+}
+
+// handleMagicLink logs in the user following a link emailed by a magic link
+// connector.
+func (s *Server) handleMagicLink(w http.ResponseWriter, r *http.Request) {
+	if s.maintenance.loginsBlocked() {
+		s.renderError(w, http.StatusServiceUnavailable, "Logins are temporarily disabled for maintenance. Please try again later.")
+		return
+	}
+
+	payload, err := s.verifySignature(r.FormValue("token"))
+	if err != nil {
+		s.logger.Errorf("Invalid magic link: %v", err)
+		s.renderError(w, http.StatusBadRequest, "Invalid login link.")
+		return
+	}
+	var claims magicLinkClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		s.logger.Errorf("Invalid magic link claims: %v", err)
+		s.renderError(w, http.StatusBadRequest, "Invalid login link.")
+		return
+	}
+	if claims.Issuer != s.issuerURL.String() || claims.Audience != s.absURL("/magiclink") {
+		s.logger.Errorf("Magic link issued by %q for %q", claims.Issuer, claims.Audience)
+		s.renderError(w, http.StatusBadRequest, "Invalid login link.")
+		return
+	}
+	if s.now().Unix() > claims.Expiry {
+		s.renderError(w, http.StatusBadRequest, "The login link expired, please request a new one.")
+		return
+	}
+
+	authReq, err := s.storage.GetAuthRequest(claims.AuthReqID)
+	if err != nil {
+		s.logger.Errorf("Failed to get auth request: %v", err)
+		if err == storage.ErrNotFound {
+			s.renderError(w, http.StatusBadRequest, "Login session expired. Please return to the application and sign in again.")
+		} else {
+			s.renderError(w, http.StatusInternalServerError, "Database error.")
+		}
+		return
+	}
+	if s.now().After(authReq.Expiry) {
+		s.renderLoginExpired(w, r, authReq, authReq.ConnectorID)
+		return
+	}
+
+	conn, err := s.getConnector(authReq.ConnectorID)
+	if err != nil {
+		s.logger.Errorf("Failed to get connector with id %q : %v", authReq.ConnectorID, err)
+		s.renderError(w, http.StatusInternalServerError, "Requested resource does not exist.")
+		return
+	}
+	magicLinkConn, ok := conn.Connector.(connector.MagicLinkConnector)
+	if !ok {
+		s.renderError(w, http.StatusBadRequest, "Invalid login link.")
+		return
+	}
+
+	// Consume the link before logging the user in, so a link followed twice
+	// concurrently only logs in once.
+	updater := func(a storage.AuthRequest) (storage.AuthRequest, error) {
+		if string(a.ConnectorData) != claims.ID {
+			return a, errMagicLinkUsed
+		}
+		a.ConnectorData = nil
+		return a, nil
+	}
+	if err := s.storage.UpdateAuthRequest(authReq.ID, updater); err != nil {
+		if err == errMagicLinkUsed {
+			s.renderError(w, http.StatusBadRequest, "The login link was already used, please request a new one.")
+			return
+		}
+		s.logger.Errorf("Failed to update auth request: %v", err)
+		s.renderError(w, http.StatusInternalServerError, "Database error.")
+		return
+	}
+
+	identity, err := magicLinkConn.Identity(claims.Email)
+	if err != nil {
+		s.logger.Errorf("Failed to get identity: %v", err)
+		s.renderError(w, http.StatusInternalServerError, "Login error.")
+		return
+	}
+	redirectURL, err := s.finalizeLogin(identity, authReq, conn)
+	if loginDenied(err) {
+		s.denyLogin(w, r, authReq, identity, err)
+		return
+	}
+	if err != nil {
+		s.logger.Errorf("Failed to finalize login: %v", err)
+		s.renderError(w, http.StatusInternalServerError, "Login error.")
+		return
+	}
+	http.Redirect(w, r, redirectURL, http.StatusSeeOther)
+}
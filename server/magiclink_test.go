@@ -0,0 +1,165 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dexidp/dex/connector"
+	"github.com/dexidp/dex/storage"
+)
+
+type magicLinkConnector struct {
+	links       []string
+	rateLimited bool
+}
+
+func (c *magicLinkConnector) SendLink(ctx context.Context, email, link string) error {
+	if c.rateLimited {
+		return connector.ErrRateLimited
+	}
+	c.links = append(c.links, link)
+	return nil
+}
+
+func (c *magicLinkConnector) LinkValidFor() time.Duration { return 10 * time.Minute }
+
+func (c *magicLinkConnector) Identity(email string) (connector.Identity, error) {
+	return connector.Identity{UserID: email, Username: email, Email: email, EmailVerified: true}, nil
+}
+
+func TestMagicLink(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	now := time.Now()
+	httpServer, server := newTestServer(ctx, t, func(c *Config) {
+		c.Now = func() time.Time { return now }
+	})
+	defer httpServer.Close()
+
+	client := storage.Client{ID: "client", Secret: "secret", RedirectURIs: []string{"https://example.com/callback"}}
+	if err := server.storage.CreateClient(client); err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+	if err := server.storage.CreateConnector(storage.Connector{ID: "email", Type: "mockCallback", Name: "Email", ResourceVersion: "1"}); err != nil {
+		t.Fatalf("create connector: %v", err)
+	}
+	conn := &magicLinkConnector{}
+	server.mu.Lock()
+	server.connectors["email"] = Connector{ResourceVersion: "1", Connector: conn}
+	server.mu.Unlock()
+
+	do := func(method, target string, form url.Values) *httptest.ResponseRecorder {
+		var r *http.Request
+		if form != nil {
+			r = httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		} else {
+			r = httptest.NewRequest(method, target, nil)
+		}
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, r)
+		return rr
+	}
+	newAuthReq := func() string {
+		authReq := storage.AuthRequest{
+			ID:            storage.NewID(),
+			ClientID:      client.ID,
+			RedirectURI:   client.RedirectURIs[0],
+			State:         "state",
+			ResponseTypes: []string{responseTypeCode},
+			Scopes:        []string{scopeOpenID},
+			Expiry:        now.Add(time.Hour),
+		}
+		if err := server.storage.CreateAuthRequest(authReq); err != nil {
+			t.Fatalf("create auth request: %v", err)
+		}
+		if rr := do("GET", "/auth/email?req="+authReq.ID, nil); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `name="email"`) {
+			t.Fatalf("expected the email form, got %d: %s", rr.Code, rr.Body)
+		}
+		return authReq.ID
+	}
+	// sendLink asks for a login link, returning the path it points to.
+	sendLink := func(id string) string {
+		sent := len(conn.links)
+		if rr := do("POST", "/auth/email?req="+id, url.Values{"email": {"jane@example.com"}}); rr.Code != http.StatusOK {
+			t.Fatalf("expected the link to be sent, got %d: %s", rr.Code, rr.Body)
+		}
+		if len(conn.links) != sent+1 {
+			t.Fatalf("expected a link to be sent")
+		}
+		u, err := url.Parse(conn.links[sent])
+		if err != nil {
+			t.Fatalf("parse link: %v", err)
+		}
+		return u.RequestURI()
+	}
+
+	t.Run("login", func(t *testing.T) {
+		id := newAuthReq()
+		link := sendLink(id)
+		if rr := do("GET", link, nil); rr.Code != http.StatusSeeOther {
+			t.Fatalf("expected the link to log the user in, got %d: %s", rr.Code, rr.Body)
+		}
+		a, err := server.storage.GetAuthRequest(id)
+		if err != nil {
+			t.Fatalf("get auth request: %v", err)
+		}
+		if !a.LoggedIn || a.Claims.Email != "jane@example.com" || !a.Claims.EmailVerified {
+			t.Errorf("expected jane to be logged in with a verified email, got %+v", a)
+		}
+
+		if rr := do("GET", link, nil); rr.Code != http.StatusBadRequest {
+			t.Errorf("expected a used link to be rejected, got %d", rr.Code)
+		}
+	})
+
+	t.Run("new link replaces the previous", func(t *testing.T) {
+		id := newAuthReq()
+		first := sendLink(id)
+		second := sendLink(id)
+		if rr := do("GET", first, nil); rr.Code != http.StatusBadRequest {
+			t.Errorf("expected the replaced link to be rejected, got %d", rr.Code)
+		}
+		if rr := do("GET", second, nil); rr.Code != http.StatusSeeOther {
+			t.Errorf("expected the latest link to log the user in, got %d: %s", rr.Code, rr.Body)
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		link := sendLink(newAuthReq())
+		now = now.Add(11 * time.Minute)
+		if rr := do("GET", link, nil); rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "expired") {
+			t.Errorf("expected an expired link to be rejected, got %d: %s", rr.Code, rr.Body)
+		}
+	})
+
+	t.Run("tampered", func(t *testing.T) {
+		link := sendLink(newAuthReq())
+		if rr := do("GET", link+"x", nil); rr.Code != http.StatusBadRequest {
+			t.Errorf("expected a tampered link to be rejected, got %d", rr.Code)
+		}
+	})
+
+	t.Run("invalid email", func(t *testing.T) {
+		id := newAuthReq()
+		rr := do("POST", "/auth/email?req="+id, url.Values{"email": {"Jane <jane@example.com>"}})
+		if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "Invalid email address.") {
+			t.Errorf("expected the form to be shown again, got %d: %s", rr.Code, rr.Body)
+		}
+	})
+
+	t.Run("rate limited", func(t *testing.T) {
+		id := newAuthReq()
+		conn.rateLimited = true
+		defer func() { conn.rateLimited = false }()
+		if rr := do("POST", "/auth/email?req="+id, url.Values{"email": {"jane@example.com"}}); rr.Code != http.StatusTooManyRequests {
+			t.Errorf("expected the request to be rate limited, got %d: %s", rr.Code, rr.Body)
+		}
+	})
+}
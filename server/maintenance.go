@@ -0,0 +1,94 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maintenance tracks whether the server is refusing new logins. Token requests
+// keep being served for a drain period after maintenance starts so logins that
+// were already in flight can complete.
+type maintenance struct {
+	mu sync.Mutex
+	// Zero if the server isn't in maintenance.
+	since time.Time
+
+	drain time.Duration
+}
+
+type maintenanceStatus struct {
+	Enabled    bool       `json:"enabled"`
+	Since      *time.Time `json:"since,omitempty"`
+	DrainUntil *time.Time `json:"drain_until,omitempty"`
+}
+
+func (m *maintenance) set(enabled bool, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch {
+	case !enabled:
+		m.since = time.Time{}
+	case m.since.IsZero():
+		// Don't restart the drain period if maintenance is already on.
+		m.since = now
+	}
+}
+
+func (m *maintenance) status() maintenanceStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.since.IsZero() {
+		return maintenanceStatus{}
+	}
+	since, drainUntil := m.since, m.since.Add(m.drain)
+	return maintenanceStatus{Enabled: true, Since: &since, DrainUntil: &drainUntil}
+}
+
+// loginsBlocked reports if new logins should be refused.
+func (m *maintenance) loginsBlocked() bool {
+	return m.status().Enabled
+}
+
+// tokensBlocked reports if the drain period has passed and token requests
+// should be refused as well.
+func (m *maintenance) tokensBlocked(now time.Time) bool {
+	st := m.status()
+	return st.Enabled && now.After(*st.DrainUntil)
+}
+
+// handleAdminMaintenance reports the maintenance status on GET and toggles it
+// on PUT with a body of the form {"enabled": true}.
+func (s *Server) handleAdminMaintenance(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req struct {
+			Enabled *bool `json:"enabled"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Enabled == nil {
+			s.tokenErrHelper(w, errInvalidRequest, `Request body must be of the form {"enabled": true}.`, http.StatusBadRequest)
+			return
+		}
+		s.maintenance.set(*req.Enabled, s.now())
+		if *req.Enabled {
+			s.logger.Infof("maintenance mode enabled, refusing new logins")
+		} else {
+			s.logger.Infof("maintenance mode disabled")
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		s.tokenErrHelper(w, errInvalidRequest, "Unsupported request method.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	data, err := json.Marshal(s.maintenance.status())
+	if err != nil {
+		s.logger.Errorf("failed to marshal maintenance status: %v", err)
+		s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
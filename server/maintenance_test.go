@@ -0,0 +1,88 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dexidp/dex/storage"
+)
+
+func TestMaintenanceMode(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	now := time.Now()
+	httpServer, server := newTestServer(ctx, t, func(c *Config) {
+		c.Now = func() time.Time { return now }
+		c.AdminAPIKey = "admin-key"
+		c.MaintenanceDrainPeriod = 10 * time.Minute
+	})
+	defer httpServer.Close()
+
+	client := storage.Client{
+		ID:           "client",
+		Secret:       "secret",
+		RedirectURIs: []string{"https://example.com/callback"},
+	}
+	if err := server.storage.CreateClient(client); err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	setMaintenance := func(enabled string) {
+		req := httptest.NewRequest("PUT", "/admin/maintenance", strings.NewReader(`{"enabled": `+enabled+`}`))
+		req.Header.Set("Authorization", "Bearer admin-key")
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("toggle maintenance: expected 200 got %d: %s", rr.Code, rr.Body)
+		}
+	}
+
+	authorize := func() *httptest.ResponseRecorder {
+		v := url.Values{
+			"client_id":     {client.ID},
+			"redirect_uri":  {client.RedirectURIs[0]},
+			"response_type": {responseTypeCode},
+			"scope":         {scopeOpenID},
+			"state":         {"state"},
+		}
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, httptest.NewRequest("GET", "/auth?"+v.Encode(), nil))
+		return rr
+	}
+
+	inFlight := newTestAuthCode(t, server, client)
+	afterDrain := newTestAuthCode(t, server, client)
+	setMaintenance("true")
+
+	rr := authorize()
+	if rr.Code != http.StatusSeeOther {
+		t.Fatalf("expected redirect back to the client, got %d: %s", rr.Code, rr.Body)
+	}
+	u, err := url.Parse(rr.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("parse redirect: %v", err)
+	}
+	if got := u.Query().Get("error"); got != errTemporarilyUnavailable {
+		t.Errorf("expected error %q, got %q", errTemporarilyUnavailable, got)
+	}
+
+	if rr := exchangeTestAuthCode(server, client, inFlight); rr.Code != http.StatusOK {
+		t.Errorf("expected in-flight code to be exchanged during maintenance, got %d: %s", rr.Code, rr.Body)
+	}
+
+	now = now.Add(11 * time.Minute)
+	if rr := exchangeTestAuthCode(server, client, afterDrain); rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected token requests to be refused after the drain period, got %d", rr.Code)
+	}
+
+	setMaintenance("false")
+	if rr := authorize(); strings.Contains(rr.Header().Get("Location"), errTemporarilyUnavailable) {
+		t.Errorf("expected logins to be allowed after maintenance, got redirect %q", rr.Header().Get("Location"))
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"crypto/sha256"
 	"crypto/sha512"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -15,6 +16,8 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -38,7 +41,7 @@ type authErr struct {
 }
 
 func (err *authErr) Status() int {
-	if err.State == errServerError {
+	if err.Type == errServerError {
 		return http.StatusInternalServerError
 	}
 	return http.StatusBadRequest
@@ -48,6 +51,12 @@ func (err *authErr) Error() string {
 	return err.Description
 }
 
+// oauthError returns the error as rendered to clients which can't be
+// redirected to.
+func (err *authErr) oauthError() *oauthError {
+	return &oauthError{Code: err.Type, Description: err.Description, HTTPStatus: err.Status(), State: err.State}
+}
+
 func (err *authErr) Handle() (http.Handler, bool) {
 	// Didn't get a valid redirect URI.
 	if err.RedirectURI == "" {
@@ -72,19 +81,52 @@ func (err *authErr) Handle() (http.Handler, bool) {
 	return http.HandlerFunc(hf), true
 }
 
-func tokenErr(w http.ResponseWriter, typ, description string, statusCode int) error {
-	data := struct {
-		Error       string `json:"error"`
-		Description string `json:"error_description,omitempty"`
-	}{typ, description}
-	body, err := json.Marshal(data)
-	if err != nil {
-		return fmt.Errorf("failed to marshal token error response: %v", err)
+// oauthError is an OAuth2 error response, written as JSON by writeError.
+// See: https://tools.ietf.org/html/rfc6749#section-5.2
+type oauthError struct {
+	// One of the error codes below.
+	Code        string
+	Description string
+	// Defaults to 400.
+	HTTPStatus int
+	// State of the authorization request the error answers, if any.
+	State string
+}
+
+func (err *oauthError) Error() string {
+	if err.Description == "" {
+		return err.Code
+	}
+	return err.Code + ": " + err.Description
+}
+
+func (err *oauthError) status() int {
+	if err.HTTPStatus == 0 {
+		return http.StatusBadRequest
+	}
+	return err.HTTPStatus
+}
+
+// errorStatus returns the HTTP status of an error response, which may be
+// configured for its error code.
+func (s *Server) errorStatus(err *oauthError) int {
+	if status, ok := s.errorStatusCodes[err.Code]; ok {
+		return status
+	}
+	return err.status()
+}
+
+// validateErrorStatusCodes checks the HTTP statuses configured for error
+// codes still report an error.
+func validateErrorStatusCodes(statuses map[string]int) error {
+	for code, status := range statuses {
+		if code == "" {
+			return errors.New("HTTP status configured for an empty error code")
+		}
+		if status < 400 || status > 599 {
+			return fmt.Errorf("invalid HTTP status %d for error %q, must be 4xx or 5xx", status, code)
+		}
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
-	w.WriteHeader(statusCode)
-	w.Write(body)
 	return nil
 }
 
@@ -99,6 +141,16 @@ const (
 	errUnsupportedGrantType    = "unsupported_grant_type"
 	errInvalidGrant            = "invalid_grant"
 	errInvalidClient           = "invalid_client"
+	errInvalidTarget           = "invalid_target"
+	errLoginRequired           = "login_required"
+
+	// Client registration errors, returned by the admin API.
+	// See: https://tools.ietf.org/html/rfc7591#section-3.2.2
+	errInvalidClientMetadata = "invalid_client_metadata"
+
+	// Bearer token errors.
+	// See: https://tools.ietf.org/html/rfc6750#section-3.1
+	errInvalidToken = "invalid_token"
 )
 
 const (
@@ -118,6 +170,14 @@ const (
 const (
 	grantTypeAuthorizationCode = "authorization_code"
 	grantTypeRefreshToken      = "refresh_token"
+	grantTypeTokenExchange     = "urn:ietf:params:oauth:grant-type:token-exchange"
+	// Not a grant of the token endpoint, tokens returned by the implicit and
+	// hybrid flows are logged as issued through it.
+	grantTypeImplicit = "implicit"
+)
+
+const (
+	tokenTypeIDToken = "urn:ietf:params:oauth:token-type:id_token"
 )
 
 const (
@@ -126,17 +186,15 @@ const (
 	responseTypeIDToken = "id_token" // ID Token in url fragment
 )
 
-func parseScopes(scopes []string) connector.Scopes {
-	var s connector.Scopes
+func (s *Server) parseScopes(scopes []string) connector.Scopes {
+	var cs connector.Scopes
 	for _, scope := range scopes {
-		switch scope {
-		case scopeOfflineAccess:
-			s.OfflineAccess = true
-		case scopeGroups:
-			s.Groups = true
+		if scope == scopeOfflineAccess {
+			cs.OfflineAccess = true
 		}
 	}
-	return s
+	cs.Groups = s.releasesGroups(scopes)
+	return cs
 }
 
 // Determine the signature algorithm for a JWT.
@@ -153,9 +211,6 @@ func signatureAlgorithm(jwk *jose.JSONWebKey) (alg jose.SignatureAlgorithm, err
 		// See https://github.com/dexidp/dex/issues/692
 		return jose.RS256, nil
 	case *ecdsa.PrivateKey:
-		// We don't actually support ECDSA keys yet, but they're tested for
-		// in case we want to in the future.
-		//
 		// These values are prescribed depending on the ECDSA key type. We
 		// can't return different values.
 		switch key.Params() {
@@ -173,15 +228,26 @@ func signatureAlgorithm(jwk *jose.JSONWebKey) (alg jose.SignatureAlgorithm, err
 	}
 }
 
-func signPayload(key *jose.JSONWebKey, alg jose.SignatureAlgorithm, payload []byte) (jws string, err error) {
-	signingKey := jose.SigningKey{Key: key, Algorithm: alg}
+func signPayload(signingKey jose.SigningKey, payload []byte) (jws string, err error) {
+	return signTypedPayload(signingKey, "", payload)
+}
 
-	signer, err := jose.NewSigner(signingKey, &jose.SignerOptions{})
+// signTypedPayload signs a payload with a "typ" header, if typ is not empty,
+// which keeps other kinds of JWTs from being accepted as ID tokens.
+func signTypedPayload(signingKey jose.SigningKey, typ jose.ContentType, payload []byte) (jws string, err error) {
+	opts := &jose.SignerOptions{}
+	if typ != "" {
+		opts = opts.WithType(typ)
+	}
+	signer, err := jose.NewSigner(signingKey, opts)
 	if err != nil {
 		return "", fmt.Errorf("new signier: %v", err)
 	}
 	signature, err := signer.Sign(payload)
 	if err != nil {
+		if _, ok := err.(signerError); ok {
+			return "", err
+		}
 		return "", fmt.Errorf("signing payload: %v", err)
 	}
 	return signature.CompactSerialize()
@@ -232,6 +298,55 @@ func (a audience) contains(aud string) bool {
 	return false
 }
 
+// withClientFirst returns the audience with the client first, followed by the
+// other entries sorted and without duplicates. Some verifiers expect the
+// client ID at the start of the array, and a stable order keeps tokens for
+// the same request reproducible.
+func (a audience) withClientFirst(clientID string) audience {
+	others := make(audience, 0, len(a))
+	for _, aud := range a {
+		if aud != clientID {
+			others = append(others, aud)
+		}
+	}
+	return append(audience{clientID}, others.sorted()...)
+}
+
+// sorted returns the audience sorted and without duplicates.
+func (a audience) sorted() audience {
+	entries := append([]string(nil), a...)
+	sort.Strings(entries)
+
+	sorted := make(audience, 0, len(entries))
+	for i, aud := range entries {
+		if i == 0 || aud != entries[i-1] {
+			sorted = append(sorted, aud)
+		}
+	}
+	return sorted
+}
+
+// Policies for the audience of ID tokens requested with cross-client scopes.
+const (
+	// The requesting client, followed by the peers.
+	crossClientAudienceClientFirst = "client-first"
+	// Only the peers the client requested.
+	crossClientAudiencePeersOnly = "peers-only"
+)
+
+func validCrossClientAudience(policy string) bool {
+	return policy == crossClientAudienceClientFirst || policy == crossClientAudiencePeersOnly
+}
+
+// crossClientAudiencePolicy returns the audience policy applying to a client,
+// its own or the server's default.
+func (s *Server) crossClientAudiencePolicy(client storage.Client) string {
+	if client.CrossClientAudience != "" {
+		return client.CrossClientAudience
+	}
+	return s.crossClientAudience
+}
+
 func (a audience) MarshalJSON() ([]byte, error) {
 	if len(a) == 1 {
 		return json.Marshal(a[0])
@@ -239,14 +354,27 @@ func (a audience) MarshalJSON() ([]byte, error) {
 	return json.Marshal([]string(a))
 }
 
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var aud string
+	if err := json.Unmarshal(b, &aud); err == nil {
+		*a = audience{aud}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(a))
+}
+
 type idTokenClaims struct {
 	Issuer           string   `json:"iss"`
 	Subject          string   `json:"sub"`
 	Audience         audience `json:"aud"`
 	Expiry           int64    `json:"exp"`
 	IssuedAt         int64    `json:"iat"`
+	JWTID            string   `json:"jti,omitempty"`
+	AuthTime         int64    `json:"auth_time,omitempty"`
+	NotBefore        int64    `json:"nbf,omitempty"`
 	AuthorizingParty string   `json:"azp,omitempty"`
 	Nonce            string   `json:"nonce,omitempty"`
+	SessionID        string   `json:"sid,omitempty"`
 
 	AccessTokenHash string `json:"at_hash,omitempty"`
 
@@ -255,9 +383,18 @@ type idTokenClaims struct {
 
 	Groups []string `json:"groups,omitempty"`
 
-	Name string `json:"name,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Picture   string `json:"picture,omitempty"`
+	UpdatedAt int64  `json:"updated_at,omitempty"`
 
 	FederatedIDClaims *federatedIDClaims `json:"federated_claims,omitempty"`
+
+	// Granted scopes, only set for clients asking for them.
+	Scope string `json:"scope,omitempty"`
+
+	// Set on tokens issued through token exchange.
+	Actor  *actor `json:"act,omitempty"`
+	MayAct *actor `json:"may_act,omitempty"`
 }
 
 type federatedIDClaims struct {
@@ -265,21 +402,140 @@ type federatedIDClaims struct {
 	UserID      string `json:"user_id,omitempty"`
 }
 
-func (s *Server) newIDToken(clientID string, claims storage.Claims, scopes []string, nonce, accessToken, connID string) (idToken string, expiry time.Time, err error) {
-	keys, err := s.storage.GetKeys()
+// verifyIDToken checks that an ID token was signed by one of the server's
+// current or rotated keys and hasn't expired or been revoked. It does not
+// check the audience.
+func (s *Server) verifyIDToken(rawIDToken string) (idTokenClaims, error) {
+	claims, err := s.verifyIDTokenSignature(rawIDToken)
+	if err != nil {
+		return idTokenClaims{}, err
+	}
+	if s.now().Unix() > claims.Expiry {
+		return idTokenClaims{}, errors.New("id token has expired")
+	}
+	if s.now().Unix() < claims.NotBefore {
+		return idTokenClaims{}, errors.New("id token is not valid yet")
+	}
+	revoked, err := s.tokenRevoked(claims.JWTID)
+	if err != nil {
+		return idTokenClaims{}, err
+	}
+	if revoked {
+		return idTokenClaims{}, errors.New("id token has been revoked")
+	}
+	return claims, nil
+}
+
+// verifyIDTokenSignature checks that an ID token was issued by the server,
+// or one of its peers, regardless of its expiry.
+func (s *Server) verifyIDTokenSignature(rawIDToken string) (idTokenClaims, error) {
+	payload, err := s.verifySignature(rawIDToken)
+	if err != nil && s.peerKeys != nil {
+		payload, err = s.verifyPeerSignature(rawIDToken, err)
+	}
+	if err != nil {
+		return idTokenClaims{}, fmt.Errorf("id token: %v", err)
+	}
+
+	var claims idTokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return idTokenClaims{}, fmt.Errorf("unmarshal id token claims: %v", err)
+	}
+	// Access and logout tokens are signed with the same keys, but carry a
+	// type of their own and must never be accepted as ID tokens. Logout tokens
+	// are also refused by their events claim, see the OpenID Connect
+	// Back-Channel Logout spec, section 2.4.
+	switch typ := jwsType(rawIDToken); typ {
+	case "", "JWT":
+	default:
+		return idTokenClaims{}, fmt.Errorf("token of type %q is not an id token", typ)
+	}
+	var events struct {
+		Events json.RawMessage `json:"events"`
+	}
+	if err := json.Unmarshal(payload, &events); err != nil || events.Events != nil {
+		return idTokenClaims{}, errors.New("token with an events claim is not an id token")
+	}
+	if claims.Issuer != s.issuerURL.String() {
+		return idTokenClaims{}, fmt.Errorf("id token issued by %q, expected %q", claims.Issuer, s.issuerURL.String())
+	}
+	return claims, nil
+}
+
+// jwsType returns the "typ" header of a JWS, or an empty string if it has none.
+func jwsType(raw string) string {
+	jws, err := jose.ParseSigned(raw)
+	if err != nil || len(jws.Signatures) == 0 {
+		return ""
+	}
+	typ, _ := jws.Signatures[0].Header.ExtraHeaders[jose.HeaderType].(string)
+	return typ
+}
+
+// verifySignature checks that a JWS was signed by one of the server's current or
+// previous signing keys, and returns its payload.
+func (s *Server) verifySignature(raw string) ([]byte, error) {
+	jws, err := jose.ParseSigned(raw)
+	if err != nil {
+		return nil, fmt.Errorf("malformed jws: %v", err)
+	}
+
+	keys, err := s.getKeys()
+	if err != nil {
+		return nil, fmt.Errorf("get keys: %v", err)
+	}
+	pubKeys := []*jose.JSONWebKey{keys.SigningKeyPub}
+	for _, vk := range keys.VerificationKeys {
+		pubKeys = append(pubKeys, vk.PublicKey)
+	}
+
+	for _, key := range pubKeys {
+		if key == nil {
+			continue
+		}
+		if payload, err := jws.Verify(key); err == nil {
+			return payload, nil
+		}
+	}
+	return nil, errors.New("not signed by a known key")
+}
+
+// verifyPeerSignature checks that a JWS the server's own keys didn't verify,
+// failing with localErr, was signed by one of its peers.
+func (s *Server) verifyPeerSignature(raw string, localErr error) ([]byte, error) {
+	jws, err := jose.ParseSigned(raw)
+	if err != nil {
+		return nil, localErr
+	}
+	payload, err := s.peerKeys.verify(jws)
+	if err != nil {
+		return nil, fmt.Errorf("%v, %v", localErr, err)
+	}
+	return payload, nil
+}
+
+// essentialClaimError is returned when a claim the client requested as
+// essential has no value for the end user.
+type essentialClaimError struct {
+	claim string
+}
+
+func (e essentialClaimError) Error() string {
+	return fmt.Sprintf("Essential claim %q is not available for this user.", e.claim)
+}
+
+func (s *Server) newIDToken(clientID string, claims storage.Claims, scopes []string, requestedClaims map[string]bool, nonce, accessToken, connID string) (idToken string, expiry time.Time, err error) {
+	keys, err := s.getKeys()
 	if err != nil {
 		s.logger.Errorf("Failed to get keys: %v", err)
 		return "", expiry, err
 	}
 
-	signingKey := keys.SigningKey
-	if signingKey == nil {
-		return "", expiry, fmt.Errorf("no key to sign payload with")
-	}
-	signingAlg, err := signatureAlgorithm(signingKey)
+	signingKey, err := s.signingKey(keys)
 	if err != nil {
 		return "", expiry, err
 	}
+	signingAlg := signingKey.Algorithm
 
 	issuedAt := s.now()
 	expiry = issuedAt.Add(s.idTokensValidFor)
@@ -301,6 +557,16 @@ func (s *Server) newIDToken(clientID string, claims storage.Claims, scopes []str
 		Nonce:    nonce,
 		Expiry:   expiry.Unix(),
 		IssuedAt: issuedAt.Unix(),
+		JWTID:    storage.NewID(),
+	}
+	if !claims.AuthTime.IsZero() {
+		tok.AuthTime = claims.AuthTime.Unix()
+	}
+	if claims.SessionID != "" {
+		tok.SessionID = sessionIDHash(claims.SessionID)
+	}
+	if s.notBefore {
+		tok.NotBefore = issuedAt.Add(-s.notBeforeLeeway).Unix()
 	}
 
 	if accessToken != "" {
@@ -312,15 +578,9 @@ func (s *Server) newIDToken(clientID string, claims storage.Claims, scopes []str
 		tok.AccessTokenHash = atHash
 	}
 
+	released := s.releasedClaims(claims, scopes)
 	for _, scope := range scopes {
 		switch {
-		case scope == scopeEmail:
-			tok.Email = claims.Email
-			tok.EmailVerified = &claims.EmailVerified
-		case scope == scopeGroups:
-			tok.Groups = claims.Groups
-		case scope == scopeProfile:
-			tok.Name = claims.Username
 		case scope == scopeFederatedID:
 			tok.FederatedIDClaims = &federatedIDClaims{
 				ConnectorID: connID,
@@ -329,8 +589,8 @@ func (s *Server) newIDToken(clientID string, claims storage.Claims, scopes []str
 		default:
 			peerID, ok := parseCrossClientScope(scope)
 			if !ok {
-				// Ignore unknown scopes. These are already validated during the
-				// initial auth request.
+				// Claims released by other scopes were looked up above, and
+				// unknown scopes were rejected during the initial auth request.
 				continue
 			}
 			isTrusted, err := s.validateCrossClientTrust(clientID, peerID)
@@ -345,37 +605,121 @@ func (s *Server) newIDToken(clientID string, claims storage.Claims, scopes []str
 		}
 	}
 
+	// Claims requested through the "claims" parameter are released in addition
+	// to the ones implied by the scopes.
+	for claim, essential := range requestedClaims {
+		value, available := claimValue(claims, requestableClaims[claim])
+		if available {
+			if released == nil {
+				released = make(map[string]interface{})
+			}
+			released[claim] = value
+		} else if essential {
+			return "", expiry, essentialClaimError{claim}
+		}
+	}
+
+	client, err := s.storage.GetClient(clientID)
+	if err != nil && err != storage.ErrNotFound {
+		return "", expiry, fmt.Errorf("failed to get client: %v", err)
+	}
+
 	if len(tok.Audience) == 0 {
 		// Client didn't ask for cross client audience. Set the current
 		// client as the audience.
 		tok.Audience = audience{clientID}
 	} else {
-		// Client asked for cross client audience:
-		// if the current client was not requested explicitly
-		if !tok.Audience.contains(clientID) {
-			// by default it becomes one of entries in Audience
-			tok.Audience = append(tok.Audience, clientID)
+		// Client asked for cross client audience. The current client becomes
+		// the authorizing party, and is part of the audience unless the
+		// policy restricts it to the peers.
+		if s.crossClientAudiencePolicy(client) == crossClientAudiencePeersOnly {
+			tok.Audience = tok.Audience.sorted()
+		} else {
+			tok.Audience = tok.Audience.withClientFirst(clientID)
 		}
-		// The current client becomes the authorizing party.
 		tok.AuthorizingParty = clientID
 	}
 
+	if client.IDTokenScope {
+		tok.Scope = strings.Join(scopes, " ")
+	}
+
 	payload, err := json.Marshal(tok)
 	if err != nil {
 		return "", expiry, fmt.Errorf("could not serialize claims: %v", err)
 	}
+	if tok.FederatedIDClaims != nil && s.connectorIDClaim != "" {
+		if released == nil {
+			released = make(map[string]interface{})
+		}
+		released[s.connectorIDClaim] = connID
+	}
+	if len(released) > 0 {
+		if payload, err = addClaims(payload, released); err != nil {
+			return "", expiry, fmt.Errorf("could not serialize claims: %v", err)
+		}
+	}
+	if s.tokenWebhook != nil {
+		var draft map[string]interface{}
+		if err := json.Unmarshal(payload, &draft); err != nil {
+			return "", expiry, fmt.Errorf("could not serialize claims: %v", err)
+		}
+		extra, err := s.tokenWebhook.claims(clientID, connID, scopes, claims, draft)
+		if err != nil {
+			return "", expiry, err
+		}
+		if len(extra) > 0 {
+			if payload, err = addClaims(payload, extra); err != nil {
+				return "", expiry, fmt.Errorf("could not serialize claims: %v", err)
+			}
+		}
+	}
 
-	if idToken, err = signPayload(signingKey, signingAlg, payload); err != nil {
+	// Claims are renamed last, for legacy clients expecting other names.
+	// Clients without renames get the standard names.
+	if len(client.ClaimRenames) > 0 {
+		if err := ValidateClaimRenames(client.ClaimRenames); err != nil {
+			return "", expiry, fmt.Errorf("invalid claim renames of client %q: %v", clientID, err)
+		}
+		if payload, err = renameClaims(payload, client.ClaimRenames); err != nil {
+			return "", expiry, fmt.Errorf("could not serialize claims: %v", err)
+		}
+	}
+
+	if idToken, err = signPayload(signingKey, payload); err != nil {
+		if _, ok := err.(signerError); ok {
+			return "", expiry, err
+		}
 		return "", expiry, fmt.Errorf("failed to sign payload: %v", err)
 	}
+	if idToken, err = s.fitIDToken(clientID, signingKey, payload, idToken, requestedClaims, client.ClaimRenames); err != nil {
+		return "", expiry, err
+	}
 	return idToken, expiry, nil
 }
 
+// newIDTokenIfOpenID issues an ID token to requests with the "openid" scope.
+// Plain OAuth2 requests get none, only the expiry the access token issued with
+// it would have had.
+func (s *Server) newIDTokenIfOpenID(clientID string, claims storage.Claims, scopes []string, requestedClaims map[string]bool, nonce, accessToken, connID string) (idToken string, expiry time.Time, err error) {
+	for _, scope := range scopes {
+		if scope == scopeOpenID {
+			return s.newIDToken(clientID, claims, scopes, requestedClaims, nonce, accessToken, connID)
+		}
+	}
+	return "", s.now().Add(s.idTokensValidFor), nil
+}
+
 // parse the initial request from the OAuth2 client.
 func (s *Server) parseAuthorizationRequest(r *http.Request) (req storage.AuthRequest, oauth2Err *authErr) {
 	if err := r.ParseForm(); err != nil {
 		return req, &authErr{"", "", errInvalidRequest, "Failed to parse request body."}
 	}
+	// Checked before anything is looked up, or the redirect URI validated, so
+	// oversized requests are rejected without being sent back to the client.
+	if description := s.authRequestLimits.check(r); description != "" {
+		return req, &authErr{"", "", errInvalidRequest, description}
+	}
 	q := r.Form
 	redirectURI, err := url.QueryUnescape(q.Get("redirect_uri"))
 	if err != nil {
@@ -399,7 +743,12 @@ func (s *Server) parseAuthorizationRequest(r *http.Request) (req storage.AuthReq
 		return req, &authErr{"", "", errServerError, ""}
 	}
 
-	if !validateRedirectURI(client, redirectURI) {
+	// Clients may designate the redirect URI used when none is provided. It's
+	// validated like a provided one.
+	if redirectURI == "" {
+		redirectURI = client.DefaultRedirectURI
+	}
+	if !validateRedirectURI(client, redirectURI, s.ignoreTrailingSlash) {
 		description := fmt.Sprintf("Unregistered redirect_uri (%q).", redirectURI)
 		return req, &authErr{"", "", errInvalidRequest, description}
 	}
@@ -409,22 +758,40 @@ func (s *Server) parseAuthorizationRequest(r *http.Request) (req storage.AuthReq
 		return &authErr{state, redirectURI, typ, fmt.Sprintf(format, a...)}
 	}
 
+	// Legacy clients which don't send a scope may have defaults configured.
+	// They're validated like requested scopes, so must include "openid".
+	if len(scopes) == 0 {
+		scopes = client.DefaultScopes
+	}
+	scopes = uniqueScopes(scopes)
+	if max := s.authRequestLimits.ScopeCount; max > 0 && len(scopes) > max {
+		return req, newErr(errInvalidScope, "Requested %d scopes, more than the maximum of %d.", len(scopes), max)
+	}
+
 	var (
 		unrecognized  []string
 		invalidScopes []string
+		disallowed    []string
 	)
 	hasOpenIDScope := false
 	for _, scope := range scopes {
 		switch scope {
 		case scopeOpenID:
 			hasOpenIDScope = true
-		case scopeOfflineAccess, scopeEmail, scopeProfile, scopeGroups, scopeFederatedID:
+		case scopeOfflineAccess, scopeFederatedID:
 		default:
+			if _, ok := s.scopeClaims[scope]; ok {
+				continue
+			}
 			peerID, ok := parseCrossClientScope(scope)
 			if !ok {
 				unrecognized = append(unrecognized, scope)
 				continue
 			}
+			if !clientAllowsAudience(client, peerID) {
+				disallowed = append(disallowed, peerID)
+				continue
+			}
 
 			isTrusted, err := s.validateCrossClientTrust(clientID, peerID)
 			if err != nil {
@@ -435,16 +802,31 @@ func (s *Server) parseAuthorizationRequest(r *http.Request) (req storage.AuthReq
 			}
 		}
 	}
-	if !hasOpenIDScope {
+	// Clients allowed to use plain OAuth2 may leave out "openid", and only
+	// get an access token.
+	if !hasOpenIDScope && !client.OAuth2Only {
 		return req, newErr("invalid_scope", `Missing required scope(s) ["openid"].`)
 	}
 	if len(unrecognized) > 0 {
 		return req, newErr("invalid_scope", "Unrecognized scope(s) %q", unrecognized)
 	}
+	if len(disallowed) > 0 {
+		return req, newErr(errInvalidTarget, "Client can't request audience(s) %q", disallowed)
+	}
 	if len(invalidScopes) > 0 {
 		return req, newErr("invalid_scope", "Client can't request scope(s) %q", invalidScopes)
 	}
 
+	// Unsupported response types may be rejected without redirecting, for
+	// clients which would rather fail fast than handle the error.
+	responseTypeErr := func(format string, a ...interface{}) *authErr {
+		err := newErr(errUnsupportedResponseType, format, a...)
+		if s.directResponseTypeErrors {
+			err.RedirectURI = ""
+		}
+		return err
+	}
+
 	var rt struct {
 		code    bool
 		idToken bool
@@ -464,13 +846,24 @@ func (s *Server) parseAuthorizationRequest(r *http.Request) (req storage.AuthReq
 		}
 
 		if !s.supportedResponseTypes[responseType] {
-			return req, newErr(errUnsupportedResponseType, "Unsupported response type %q", responseType)
+			return req, responseTypeErr("Unsupported response type %q", responseType)
 		}
 	}
 
 	if len(responseTypes) == 0 {
 		return req, newErr("invalid_requests", "No response_type provided")
 	}
+	if rt.idToken && !hasOpenIDScope {
+		return req, newErr(errInvalidRequest, "Response type 'id_token' requires the 'openid' scope.")
+	}
+
+	combination := responseTypeCombination(responseTypes)
+	if !s.responseTypeCombinations[combination] {
+		return req, responseTypeErr("Unsupported response type %q", combination)
+	}
+	if len(client.ResponseTypes) > 0 && !clientAllowsResponseTypes(client, combination) {
+		return req, responseTypeErr("Client can't use response type %q", combination)
+	}
 
 	if rt.token && !rt.code && !rt.idToken {
 		// "token" can't be provided by its own.
@@ -494,18 +887,311 @@ func (s *Server) parseAuthorizationRequest(r *http.Request) (req storage.AuthReq
 		}
 	}
 
+	// Every request is authenticated with a connector since dex doesn't keep
+	// login sessions, which satisfies any max_age, even 0. The auth_time claim
+	// of the ID token holds when that happened.
+	if maxAge := q.Get("max_age"); maxAge != "" {
+		if n, err := strconv.Atoi(maxAge); err != nil || n < 0 {
+			return req, newErr(errInvalidRequest, "Invalid max_age value %q.", maxAge)
+		}
+	}
+
+	// For the same reason prompt=login is always honored, and prompt=none
+	// never can be.
+	forceApproval := q.Get("approval_prompt") == "force"
+	if prompt := strings.Fields(q.Get("prompt")); len(prompt) > 0 {
+		for _, p := range prompt {
+			switch p {
+			case "none":
+				if len(prompt) > 1 {
+					return req, newErr(errInvalidRequest, "The prompt value \"none\" can't be combined with other values.")
+				}
+				return req, newErr(errLoginRequired, "The user must log in, dex doesn't keep login sessions.")
+			case "login", "select_account":
+			case "consent":
+				forceApproval = true
+			default:
+				return req, newErr(errInvalidRequest, "Invalid prompt value %q.", p)
+			}
+		}
+	}
+
+	if _, ok := s.requestedConnectorID(q); !ok {
+		return req, newErr(errInvalidRequest, "Parameters connector_id and %s request different connectors.", s.connectorIDParam)
+	}
+
+	requestedClaims, err := parseClaimsRequest(q.Get("claims"))
+	if err != nil {
+		return req, newErr(errInvalidRequest, "Invalid claims parameter: %v", err)
+	}
+
+	pkce, err := parsePKCE(q.Get("code_challenge"), q.Get("code_challenge_method"))
+	if err != nil {
+		return req, newErr(errInvalidRequest, "Invalid PKCE parameters: %v", err)
+	}
+	if rt.code && pkce.CodeChallenge == "" && s.pkceRequired(client) {
+		return req, newErr(errInvalidRequest, "Client must use PKCE, no code_challenge provided.")
+	}
+
+	// Other response modes are ignored, responses use the default mode of
+	// the response type.
+	var responseMode string
+	if s.jwtResponseModes {
+		if responseMode, err = jwtResponseMode(q.Get("response_mode"), rt.token || rt.idToken); err != nil {
+			return req, newErr(errInvalidRequest, "%v", err)
+		}
+	}
+
+	// Checked last, so requests rejected for other reasons don't use up the
+	// nonce.
+	if client.UniqueNonces && nonce != "" {
+		switch err := s.useNonce(client.ID, nonce); err {
+		case nil:
+		case storage.ErrAlreadyExists:
+			return req, newErr(errInvalidRequest, "The nonce was already used.")
+		default:
+			s.logger.Errorf("Failed to record nonce: %v", err)
+			return req, newErr(errServerError, "Internal server error.")
+		}
+	}
+
 	return storage.AuthRequest{
 		ID:                  storage.NewID(),
 		ClientID:            client.ID,
 		State:               state,
 		Nonce:               nonce,
-		ForceApprovalPrompt: q.Get("approval_prompt") == "force",
+		ForceApprovalPrompt: forceApproval,
 		Scopes:              scopes,
+		RequestedClaims:     requestedClaims,
 		RedirectURI:         redirectURI,
 		ResponseTypes:       responseTypes,
+		ResponseMode:        responseMode,
+		PKCE:                pkce,
 	}, nil
 }
 
+// useNonce records a nonce sent by a client, returning storage.ErrAlreadyExists
+// if it was already. Nonces are kept until the ID tokens of the request they
+// were sent with would have expired, if it took as long as allowed.
+func (s *Server) useNonce(clientID, nonce string) error {
+	sum := sha256.Sum256([]byte(clientID + "\x00" + nonce))
+	return s.storage.CreateUsedNonce(storage.UsedNonce{
+		ID:     hex.EncodeToString(sum[:]),
+		Expiry: s.now().Add(s.authRequestsValidFor + s.idTokensValidFor),
+	})
+}
+
+// addClaims adds claims whose names are only known at runtime to a serialized
+// set of claims.
+func addClaims(payload []byte, extra map[string]interface{}) ([]byte, error) {
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, err
+	}
+	for name, value := range extra {
+		claims[name] = value
+	}
+	return json.Marshal(claims)
+}
+
+// reservedClaim reports if a claim name is already used by the claims of
+// ID tokens.
+func reservedClaim(name string) bool {
+	t := reflect.TypeOf(idTokenClaims{})
+	for i := 0; i < t.NumField(); i++ {
+		if strings.Split(t.Field(i).Tag.Get("json"), ",")[0] == name {
+			return true
+		}
+	}
+	return false
+}
+
+// requestableClaims are the ID token claims which may be asked for through the
+// "claims" request parameter, mapped to the user attribute they hold.
+var requestableClaims = map[string]string{
+	"email":          attrEmail,
+	"email_verified": attrEmailVerified,
+	"groups":         attrGroups,
+	"name":           attrUsername,
+}
+
+// Claims present in every ID token, which satisfy any request for them.
+var standardIDTokenClaims = map[string]bool{
+	"iss": true,
+	"sub": true,
+	"aud": true,
+	"exp": true,
+	"iat": true,
+}
+
+// authRequestParameters are the parameters of authorization requests which
+// can't be configured as an alias of "connector_id".
+var authRequestParameters = map[string]bool{
+	"client_id":             true,
+	"redirect_uri":          true,
+	"response_type":         true,
+	"response_mode":         true,
+	"scope":                 true,
+	"state":                 true,
+	"nonce":                 true,
+	"prompt":                true,
+	"max_age":               true,
+	"login_hint":            true,
+	"claims":                true,
+	"request":               true,
+	"code_challenge":        true,
+	"code_challenge_method": true,
+	"approval_prompt":       true,
+	"connector_id":          true,
+}
+
+// requestedConnectorID returns the connector the authorization request q asks
+// to login with, from "connector_id" or the parameter configured as its alias.
+// It returns false if both are set and disagree.
+func (s *Server) requestedConnectorID(q url.Values) (string, bool) {
+	connID := q.Get("connector_id")
+	if s.connectorIDParam == "" {
+		return connID, true
+	}
+	alias := q.Get(s.connectorIDParam)
+	switch {
+	case alias == "":
+		return connID, true
+	case connID == "" || connID == alias:
+		return alias, true
+	}
+	return "", false
+}
+
+// parseClaimsRequest parses the "claims" authorization request parameter and
+// returns the ID token claims it requests, mapped to whether they're essential.
+//
+// See: https://openid.net/specs/openid-connect-core-1_0.html#ClaimsParameter
+func parseClaimsRequest(param string) (map[string]bool, error) {
+	if param == "" {
+		return nil, nil
+	}
+	var req struct {
+		IDToken map[string]*struct {
+			Essential bool `json:"essential"`
+		} `json:"id_token"`
+	}
+	if err := json.Unmarshal([]byte(param), &req); err != nil {
+		return nil, errors.New("malformed JSON")
+	}
+
+	var claims map[string]bool
+	for name, c := range req.IDToken {
+		essential := c != nil && c.Essential
+		if standardIDTokenClaims[name] {
+			continue
+		}
+		if requestableClaims[name] == "" {
+			if essential {
+				return nil, fmt.Errorf("unsupported essential claim %q", name)
+			}
+			continue
+		}
+		if claims == nil {
+			claims = make(map[string]bool)
+		}
+		claims[name] = essential
+	}
+	return claims, nil
+}
+
+// responseTypeCombination returns the canonical form of a set of response
+// types: the distinct types, sorted and space separated.
+func responseTypeCombination(responseTypes []string) string {
+	seen := make(map[string]bool, len(responseTypes))
+	var sorted []string
+	for _, t := range responseTypes {
+		if !seen[t] {
+			seen[t] = true
+			sorted = append(sorted, t)
+		}
+	}
+	sort.Strings(sorted)
+	return strings.Join(sorted, " ")
+}
+
+// validateResponseTypeCombination checks that a set of response types can be
+// requested together.
+func validateResponseTypeCombination(responseTypes []string) error {
+	if len(responseTypes) == 0 {
+		return errors.New("no response types")
+	}
+	tokenOnly := true
+	for _, t := range responseTypes {
+		switch t {
+		case responseTypeCode, responseTypeIDToken:
+			tokenOnly = false
+		case responseTypeToken:
+		default:
+			return fmt.Errorf("unknown response type %q", t)
+		}
+	}
+	if tokenOnly {
+		return errors.New("response type 'token' must be provided with type 'id_token' and/or 'code'")
+	}
+	return nil
+}
+
+// validResponseTypeCombinations returns the canonical form of every valid
+// combination of the provided response types.
+func validResponseTypeCombinations(responseTypes []string) []string {
+	var combinations []string
+	for mask := 1; mask < 1<<uint(len(responseTypes)); mask++ {
+		var subset []string
+		for i, t := range responseTypes {
+			if mask&(1<<uint(i)) != 0 {
+				subset = append(subset, t)
+			}
+		}
+		if validateResponseTypeCombination(subset) == nil {
+			combinations = append(combinations, responseTypeCombination(subset))
+		}
+	}
+	return combinations
+}
+
+// clientAllowsAudience reports if a client may request tokens for a resource
+// or another client. Clients may always request tokens for themselves.
+func clientAllowsAudience(client storage.Client, aud string) bool {
+	if aud == client.ID {
+		return true
+	}
+	for _, allowed := range client.AllowedAudiences {
+		if allowed == aud {
+			return true
+		}
+	}
+	return false
+}
+
+func clientAllowsResponseTypes(client storage.Client, combination string) bool {
+	for _, allowed := range client.ResponseTypes {
+		if responseTypeCombination(strings.Fields(allowed)) == combination {
+			return true
+		}
+	}
+	return false
+}
+
+// uniqueScopes removes repeated scopes, keeping the order they were first
+// requested in.
+func uniqueScopes(scopes []string) []string {
+	seen := make(map[string]bool, len(scopes))
+	unique := make([]string, 0, len(scopes))
+	for _, scope := range scopes {
+		if !seen[scope] {
+			seen[scope] = true
+			unique = append(unique, scope)
+		}
+	}
+	return unique
+}
+
 func parseCrossClientScope(scope string) (peerID string, ok bool) {
 	if ok = strings.HasPrefix(scope, scopeCrossClientPrefix); ok {
 		peerID = scope[len(scopeCrossClientPrefix):]
@@ -533,10 +1219,47 @@ func (s *Server) validateCrossClientTrust(clientID, peerID string) (trusted bool
 	return false, nil
 }
 
-func validateRedirectURI(client storage.Client, redirectURI string) bool {
+// grantScopes adds the scopes a connector granted to the requested ones. Scopes
+// the client couldn't have requested itself are dropped, as is
+// "offline_access", so connectors can't hand out refresh tokens.
+func (s *Server) grantScopes(client storage.Client, requested, granted []string) ([]string, error) {
+	scopes := append([]string(nil), requested...)
+	for _, scope := range uniqueScopes(granted) {
+		allowed := false
+		switch scope {
+		case scopeOpenID, scopeFederatedID:
+			allowed = true
+		case scopeOfflineAccess:
+		default:
+			if _, ok := s.scopeClaims[scope]; ok {
+				allowed = true
+			} else if peerID, ok := parseCrossClientScope(scope); ok && clientAllowsAudience(client, peerID) {
+				trusted, err := s.validateCrossClientTrust(client.ID, peerID)
+				if err != nil {
+					return nil, err
+				}
+				allowed = trusted
+			}
+		}
+		if !allowed {
+			s.logger.Errorf("connector granted scope %q which client %q can't request, ignoring it", scope, client.ID)
+			continue
+		}
+		scopes = append(scopes, scope)
+	}
+	return uniqueScopes(scopes), nil
+}
+
+// Policies comparing the paths of redirect URIs.
+const (
+	trailingSlashStrict = "strict"
+	trailingSlashIgnore = "ignore"
+)
+
+func validateRedirectURI(client storage.Client, redirectURI string, ignoreTrailingSlash bool) bool {
 	if !client.Public {
 		for _, uri := range client.RedirectURIs {
-			if redirectURI == uri {
+			if redirectURIMatches(uri, redirectURI, ignoreTrailingSlash) {
 				return true
 			}
 		}
@@ -555,9 +1278,38 @@ func validateRedirectURI(client storage.Client, redirectURI string) bool {
 	if u.Scheme != "http" {
 		return false
 	}
-	if u.Host == "localhost" {
+	if strings.EqualFold(u.Host, "localhost") {
 		return true
 	}
 	host, _, err := net.SplitHostPort(u.Host)
-	return err == nil && host == "localhost"
+	return err == nil && strings.EqualFold(host, "localhost")
+}
+
+// redirectURIMatches compares a redirect URI to one registered by a client.
+// Schemes and hosts are case insensitive, per RFC 3986, while paths must match
+// exactly, except for a trailing slash if ignoreTrailingSlash is set. Queries
+// and fragments must always match exactly.
+func redirectURIMatches(registered, redirectURI string, ignoreTrailingSlash bool) bool {
+	if registered == redirectURI {
+		return true
+	}
+	r, err := url.Parse(registered)
+	if err != nil {
+		return false
+	}
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		return false
+	}
+	if !strings.EqualFold(r.Scheme, u.Scheme) || !strings.EqualFold(r.Host, u.Host) || r.Opaque != u.Opaque || r.User.String() != u.User.String() {
+		return false
+	}
+	if r.RawQuery != u.RawQuery || r.ForceQuery != u.ForceQuery || r.Fragment != u.Fragment {
+		return false
+	}
+	registeredPath, path := r.EscapedPath(), u.EscapedPath()
+	if ignoreTrailingSlash {
+		registeredPath, path = strings.TrimSuffix(registeredPath, "/"), strings.TrimSuffix(path, "/")
+	}
+	return registeredPath == path
 }
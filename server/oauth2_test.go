@@ -2,22 +2,28 @@ package server
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	jose "gopkg.in/square/go-jose.v2"
 
+	"github.com/dexidp/dex/connector"
 	"github.com/dexidp/dex/storage"
 )
 
 func TestParseAuthorizationRequest(t *testing.T) {
 	tests := []struct {
-		name                   string
-		clients                []storage.Client
-		supportedResponseTypes []string
+		name                     string
+		clients                  []storage.Client
+		supportedResponseTypes   []string
+		responseTypeCombinations []string
 
 		usePOST bool
 
@@ -142,6 +148,249 @@ func TestParseAuthorizationRequest(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name: "enabled response type combination",
+			clients: []storage.Client{
+				{
+					ID:           "bar",
+					RedirectURIs: []string{"https://example.com/bar"},
+				},
+			},
+			supportedResponseTypes:   []string{"code", "id_token", "token"},
+			responseTypeCombinations: []string{"code", "code id_token"},
+			queryParams: map[string]string{
+				"client_id":     "bar",
+				"redirect_uri":  "https://example.com/bar",
+				"response_type": "id_token code",
+				"nonce":         "nonce",
+				"scope":         "openid",
+			},
+		},
+		{
+			name: "globally disabled response type combination",
+			clients: []storage.Client{
+				{
+					ID:           "bar",
+					RedirectURIs: []string{"https://example.com/bar"},
+				},
+			},
+			supportedResponseTypes:   []string{"code", "id_token", "token"},
+			responseTypeCombinations: []string{"code", "code id_token"},
+			queryParams: map[string]string{
+				"client_id":     "bar",
+				"redirect_uri":  "https://example.com/bar",
+				"response_type": "id_token token",
+				"nonce":         "nonce",
+				"scope":         "openid",
+			},
+			wantErr: true,
+		},
+		{
+			name: "response type combination disabled for client",
+			clients: []storage.Client{
+				{
+					ID:            "bar",
+					RedirectURIs:  []string{"https://example.com/bar"},
+					ResponseTypes: []string{"code"},
+				},
+			},
+			supportedResponseTypes: []string{"code", "id_token", "token"},
+			queryParams: map[string]string{
+				"client_id":     "bar",
+				"redirect_uri":  "https://example.com/bar",
+				"response_type": "code id_token",
+				"nonce":         "nonce",
+				"scope":         "openid",
+			},
+			wantErr: true,
+		},
+		{
+			name: "claims parameter",
+			clients: []storage.Client{
+				{
+					ID:           "foo",
+					RedirectURIs: []string{"https://example.com/foo"},
+				},
+			},
+			supportedResponseTypes: []string{"code"},
+			queryParams: map[string]string{
+				"client_id":     "foo",
+				"redirect_uri":  "https://example.com/foo",
+				"response_type": "code",
+				"scope":         "openid",
+				"claims":        `{"id_token":{"email":{"essential":true},"sub":null,"picture":null}}`,
+			},
+		},
+		{
+			name: "malformed claims parameter",
+			clients: []storage.Client{
+				{
+					ID:           "foo",
+					RedirectURIs: []string{"https://example.com/foo"},
+				},
+			},
+			supportedResponseTypes: []string{"code"},
+			queryParams: map[string]string{
+				"client_id":     "foo",
+				"redirect_uri":  "https://example.com/foo",
+				"response_type": "code",
+				"scope":         "openid",
+				"claims":        `{"id_token":`,
+			},
+			wantErr: true,
+		},
+		{
+			name: "unsupported essential claim",
+			clients: []storage.Client{
+				{
+					ID:           "foo",
+					RedirectURIs: []string{"https://example.com/foo"},
+				},
+			},
+			supportedResponseTypes: []string{"code"},
+			queryParams: map[string]string{
+				"client_id":     "foo",
+				"redirect_uri":  "https://example.com/foo",
+				"response_type": "code",
+				"scope":         "openid",
+				"claims":        `{"id_token":{"picture":{"essential":true}}}`,
+			},
+			wantErr: true,
+		},
+		{
+			name: "no scope",
+			clients: []storage.Client{
+				{
+					ID:           "foo",
+					RedirectURIs: []string{"https://example.com/foo"},
+				},
+			},
+			supportedResponseTypes: []string{"code"},
+			queryParams: map[string]string{
+				"client_id":     "foo",
+				"redirect_uri":  "https://example.com/foo",
+				"response_type": "code",
+			},
+			wantErr: true,
+		},
+		{
+			name: "no scope with client default scopes",
+			clients: []storage.Client{
+				{
+					ID:            "foo",
+					RedirectURIs:  []string{"https://example.com/foo"},
+					DefaultScopes: []string{"openid", "email"},
+				},
+			},
+			supportedResponseTypes: []string{"code"},
+			queryParams: map[string]string{
+				"client_id":     "foo",
+				"redirect_uri":  "https://example.com/foo",
+				"response_type": "code",
+			},
+		},
+		{
+			name: "client default scopes without openid",
+			clients: []storage.Client{
+				{
+					ID:            "foo",
+					RedirectURIs:  []string{"https://example.com/foo"},
+					DefaultScopes: []string{"email"},
+				},
+			},
+			supportedResponseTypes: []string{"code"},
+			queryParams: map[string]string{
+				"client_id":     "foo",
+				"redirect_uri":  "https://example.com/foo",
+				"response_type": "code",
+			},
+			wantErr: true,
+		},
+		{
+			name: "max_age of zero",
+			clients: []storage.Client{
+				{
+					ID:           "foo",
+					RedirectURIs: []string{"https://example.com/foo"},
+				},
+			},
+			supportedResponseTypes: []string{"code"},
+			queryParams: map[string]string{
+				"client_id":     "foo",
+				"redirect_uri":  "https://example.com/foo",
+				"response_type": "code",
+				"scope":         "openid",
+				"max_age":       "0",
+			},
+		},
+		{
+			name: "negative max_age",
+			clients: []storage.Client{
+				{
+					ID:           "foo",
+					RedirectURIs: []string{"https://example.com/foo"},
+				},
+			},
+			supportedResponseTypes: []string{"code"},
+			queryParams: map[string]string{
+				"client_id":     "foo",
+				"redirect_uri":  "https://example.com/foo",
+				"response_type": "code",
+				"scope":         "openid",
+				"max_age":       "-1",
+			},
+			wantErr: true,
+		},
+		{
+			name: "prompt none",
+			clients: []storage.Client{
+				{
+					ID:           "foo",
+					RedirectURIs: []string{"https://example.com/foo"},
+				},
+			},
+			supportedResponseTypes: []string{"code"},
+			queryParams: map[string]string{
+				"client_id":     "foo",
+				"redirect_uri":  "https://example.com/foo",
+				"response_type": "code",
+				"scope":         "openid",
+				"prompt":        "none",
+			},
+			wantErr: true,
+		},
+		{
+			name: "no redirect uri with multiple registered",
+			clients: []storage.Client{
+				{
+					ID:           "foo",
+					RedirectURIs: []string{"https://example.com/foo", "https://example.com/bar"},
+				},
+			},
+			supportedResponseTypes: []string{"code"},
+			queryParams: map[string]string{
+				"client_id":     "foo",
+				"response_type": "code",
+				"scope":         "openid",
+			},
+			wantErr: true,
+		},
+		{
+			name: "no redirect uri with a default",
+			clients: []storage.Client{
+				{
+					ID:                 "foo",
+					RedirectURIs:       []string{"https://example.com/foo", "https://example.com/bar"},
+					DefaultRedirectURI: "https://example.com/bar",
+				},
+			},
+			supportedResponseTypes: []string{"code"},
+			queryParams: map[string]string{
+				"client_id":     "foo",
+				"response_type": "code",
+				"scope":         "openid",
+			},
+		},
 	}
 
 	for _, tc := range tests {
@@ -151,6 +400,7 @@ func TestParseAuthorizationRequest(t *testing.T) {
 
 			httpServer, server := newTestServer(ctx, t, func(c *Config) {
 				c.SupportedResponseTypes = tc.supportedResponseTypes
+				c.ResponseTypeCombinations = tc.responseTypeCombinations
 				c.Storage = storage.WithStaticClients(c.Storage, tc.clients)
 			})
 			defer httpServer.Close()
@@ -252,10 +502,1176 @@ func TestValidRedirectURI(t *testing.T) {
 		},
 	}
 	for _, test := range tests {
-		got := validateRedirectURI(test.client, test.redirectURI)
+		got := validateRedirectURI(test.client, test.redirectURI, false)
 		if got != test.wantValid {
 			t.Errorf("client=%#v, redirectURI=%q, wanted valid=%t, got=%t",
 				test.client, test.redirectURI, test.wantValid, got)
 		}
 	}
 }
+
+func TestRedirectURIMatching(t *testing.T) {
+	client := storage.Client{RedirectURIs: []string{"https://app.example.com/callback", "https://app.example.com/"}}
+	tests := []struct {
+		redirectURI string
+		// Whether the URI is valid with the strict and ignore policies.
+		wantStrict, wantIgnore bool
+	}{
+		{"https://app.example.com/callback", true, true},
+		{"https://APP.Example.com/callback", true, true},
+		{"HTTPS://app.example.com/callback", true, true},
+		{"https://app.example.com/callback/", false, true},
+		{"https://APP.example.com/callback/", false, true},
+		{"https://app.example.com", false, true},
+		{"https://app.example.com/Callback", false, false},
+		{"https://app.example.com/callback//", false, false},
+		{"https://app.example.com/callback?a=b", false, false},
+		{"https://app.example.com/callback/?a=b", false, false},
+		{"https://app.example.com/callback#a", false, false},
+		{"https://app.example.com/callback?", false, false},
+		{"http://app.example.com/callback", false, false},
+		{"https://app.example.com:8443/callback", false, false},
+		{"https://user@app.example.com/callback", false, false},
+	}
+	for _, tc := range tests {
+		if got := validateRedirectURI(client, tc.redirectURI, false); got != tc.wantStrict {
+			t.Errorf("%s: expected valid=%t with the strict policy, got %t", tc.redirectURI, tc.wantStrict, got)
+		}
+		if got := validateRedirectURI(client, tc.redirectURI, true); got != tc.wantIgnore {
+			t.Errorf("%s: expected valid=%t when ignoring trailing slashes, got %t", tc.redirectURI, tc.wantIgnore, got)
+		}
+	}
+
+	public := storage.Client{Public: true}
+	if !validateRedirectURI(public, "http://LocalHost:8080/callback", false) {
+		t.Errorf("expected the loopback host of public clients to be case insensitive")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for _, policy := range []string{"", trailingSlashStrict, trailingSlashIgnore} {
+		httpServer, server := newTestServer(ctx, t, func(c *Config) {
+			c.RedirectURITrailingSlash = policy
+		})
+		defer httpServer.Close()
+		if err := server.storage.CreateClient(storage.Client{ID: "foo", RedirectURIs: client.RedirectURIs}); err != nil {
+			t.Fatalf("create client: %v", err)
+		}
+		q := url.Values{
+			"client_id":     {"foo"},
+			"redirect_uri":  {"https://app.example.com/callback/"},
+			"response_type": {"code"},
+			"scope":         {"openid"},
+		}
+		_, err := server.parseAuthorizationRequest(httptest.NewRequest("GET", "/auth?"+q.Encode(), nil))
+		if want := policy == trailingSlashIgnore; (err == nil) != want {
+			t.Errorf("policy %q: expected valid=%t, got error %v", policy, want, err)
+		}
+	}
+}
+
+func TestRequestedClaims(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, server := newTestServer(ctx, t, nil)
+	defer httpServer.Close()
+
+	claims := storage.Claims{
+		UserID:        "1",
+		Username:      "jane",
+		Email:         "jane.doe@example.com",
+		EmailVerified: true,
+		Groups:        []string{"a"},
+	}
+	idToken, _, err := server.newIDToken("client", claims, []string{"openid"}, map[string]bool{"email": true}, "", "", "mock")
+	if err != nil {
+		t.Fatalf("new id token: %v", err)
+	}
+	jws, err := jose.ParseSigned(idToken)
+	if err != nil {
+		t.Fatalf("parse id token: %v", err)
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(jws.UnsafePayloadWithoutVerification(), &got); err != nil {
+		t.Fatalf("unmarshal id token: %v", err)
+	}
+	if got["email"] != claims.Email {
+		t.Errorf("expected requested email claim %q, got %v", claims.Email, got["email"])
+	}
+	for _, claim := range []string{"groups", "name", "email_verified"} {
+		if _, ok := got[claim]; ok {
+			t.Errorf("claim %q was not requested but was included", claim)
+		}
+	}
+
+	claims.Groups = nil
+	_, _, err = server.newIDToken("client", claims, []string{"openid"}, map[string]bool{"groups": true}, "", "", "mock")
+	if _, ok := err.(essentialClaimError); !ok {
+		t.Errorf("expected essential claim error, got %v", err)
+	}
+}
+
+func TestIDTokenAudienceOrder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, server := newTestServer(ctx, t, nil)
+	defer httpServer.Close()
+
+	for _, id := range []string{"zeta", "alpha", "mu"} {
+		if err := server.storage.CreateClient(storage.Client{ID: id, TrustedPeers: []string{"client"}}); err != nil {
+			t.Fatalf("create client: %v", err)
+		}
+	}
+	scopes := []string{
+		scopeOpenID,
+		"audience:server:client_id:zeta",
+		"audience:server:client_id:client",
+		"audience:server:client_id:alpha",
+		"audience:server:client_id:mu",
+		"audience:server:client_id:alpha",
+	}
+	idToken, _, err := server.newIDToken("client", storage.Claims{UserID: "1"}, scopes, nil, "", "", "mock")
+	if err != nil {
+		t.Fatalf("new id token: %v", err)
+	}
+	jws, err := jose.ParseSigned(idToken)
+	if err != nil {
+		t.Fatalf("parse id token: %v", err)
+	}
+	var claims struct {
+		Audience []string `json:"aud"`
+		AZP      string   `json:"azp"`
+	}
+	if err := json.Unmarshal(jws.UnsafePayloadWithoutVerification(), &claims); err != nil {
+		t.Fatalf("unmarshal id token: %v", err)
+	}
+	want := []string{"client", "alpha", "mu", "zeta"}
+	if !reflect.DeepEqual(claims.Audience, want) {
+		t.Errorf("expected audience %q, got %q", want, claims.Audience)
+	}
+	if claims.AZP != "client" {
+		t.Errorf("expected azp %q, got %q", "client", claims.AZP)
+	}
+}
+
+func TestCrossClientAudiencePolicy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tests := []struct {
+		name         string
+		serverPolicy string
+		clientPolicy string
+		wantAudience audience
+	}{
+		{"default", "", "", audience{"client", "alpha", "mu"}},
+		{"client first", crossClientAudienceClientFirst, "", audience{"client", "alpha", "mu"}},
+		{"peers only", crossClientAudiencePeersOnly, "", audience{"alpha", "mu"}},
+		{"client overrides to peers only", crossClientAudienceClientFirst, crossClientAudiencePeersOnly, audience{"alpha", "mu"}},
+		{"client overrides to client first", crossClientAudiencePeersOnly, crossClientAudienceClientFirst, audience{"client", "alpha", "mu"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			httpServer, server := newTestServer(ctx, t, func(c *Config) {
+				c.CrossClientAudience = tc.serverPolicy
+			})
+			defer httpServer.Close()
+
+			if err := server.storage.CreateClient(storage.Client{ID: "client", CrossClientAudience: tc.clientPolicy}); err != nil {
+				t.Fatalf("create client: %v", err)
+			}
+			for _, id := range []string{"mu", "alpha"} {
+				if err := server.storage.CreateClient(storage.Client{ID: id, TrustedPeers: []string{"client"}}); err != nil {
+					t.Fatalf("create client: %v", err)
+				}
+			}
+
+			newToken := func(scopes ...string) idTokenClaims {
+				idToken, _, err := server.newIDToken("client", storage.Claims{UserID: "1"}, append([]string{scopeOpenID}, scopes...), nil, "", "", "mock")
+				if err != nil {
+					t.Fatalf("new id token: %v", err)
+				}
+				jws, err := jose.ParseSigned(idToken)
+				if err != nil {
+					t.Fatalf("parse id token: %v", err)
+				}
+				var claims idTokenClaims
+				if err := json.Unmarshal(jws.UnsafePayloadWithoutVerification(), &claims); err != nil {
+					t.Fatalf("unmarshal id token: %v", err)
+				}
+				return claims
+			}
+
+			claims := newToken("audience:server:client_id:mu", "audience:server:client_id:alpha")
+			if !reflect.DeepEqual(claims.Audience, tc.wantAudience) {
+				t.Errorf("expected audience %q, got %q", tc.wantAudience, claims.Audience)
+			}
+			if claims.AuthorizingParty != "client" {
+				t.Errorf("expected azp %q, got %q", "client", claims.AuthorizingParty)
+			}
+
+			// Without cross-client scopes the token is only for the client.
+			claims = newToken()
+			if !reflect.DeepEqual(claims.Audience, audience{"client"}) || claims.AuthorizingParty != "" {
+				t.Errorf("expected a token for the client alone, got aud %q and azp %q", claims.Audience, claims.AuthorizingParty)
+			}
+		})
+	}
+}
+
+func TestClaimRenames(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, server := newTestServer(ctx, t, nil)
+	defer httpServer.Close()
+
+	for _, client := range []storage.Client{
+		{ID: "legacy", ClaimRenames: map[string]string{"email": "user_email"}},
+		{ID: "modern"},
+	} {
+		if err := server.storage.CreateClient(client); err != nil {
+			t.Fatalf("create client: %v", err)
+		}
+	}
+	claims := storage.Claims{UserID: "1", Email: "jane.doe@example.com", EmailVerified: true}
+	tokenClaims := func(clientID string) map[string]interface{} {
+		idToken, _, err := server.newIDToken(clientID, claims, []string{scopeOpenID, scopeEmail}, nil, "", "", "mock")
+		if err != nil {
+			t.Fatalf("new id token: %v", err)
+		}
+		jws, err := jose.ParseSigned(idToken)
+		if err != nil {
+			t.Fatalf("parse id token: %v", err)
+		}
+		var got map[string]interface{}
+		if err := json.Unmarshal(jws.UnsafePayloadWithoutVerification(), &got); err != nil {
+			t.Fatalf("unmarshal id token: %v", err)
+		}
+		return got
+	}
+
+	legacy := tokenClaims("legacy")
+	if _, ok := legacy["email"]; ok || legacy["user_email"] != claims.Email {
+		t.Errorf("expected email to be renamed to user_email, got %v", legacy)
+	}
+	if legacy["email_verified"] != true {
+		t.Errorf("expected other claims to keep their names, got %v", legacy)
+	}
+	modern := tokenClaims("modern")
+	if _, ok := modern["user_email"]; ok || modern["email"] != claims.Email {
+		t.Errorf("expected other clients to get the standard names, got %v", modern)
+	}
+
+	for _, renames := range []map[string]string{
+		{"sub": "user_id"},
+		{"email": "exp"},
+		{"email": "login", "name": "login"},
+		{"email": ""},
+	} {
+		if err := ValidateClaimRenames(renames); err == nil {
+			t.Errorf("expected renames %v to be invalid", renames)
+		}
+	}
+}
+
+func TestPictureClaim(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, server := newTestServer(ctx, t, nil)
+	defer httpServer.Close()
+
+	tests := []struct {
+		picture string
+		want    string
+	}{
+		{picture: "https://avatars.example.com/u/1", want: "https://avatars.example.com/u/1"},
+		{picture: "javascript:alert(1)", want: ""},
+		{picture: "/relative/avatar.png", want: ""},
+	}
+	for _, tc := range tests {
+		authReq := storage.AuthRequest{
+			ID:          storage.NewID(),
+			ClientID:    "client",
+			ConnectorID: "mock",
+			Scopes:      []string{"openid", "profile"},
+			Expiry:      time.Now().Add(time.Hour),
+		}
+		if err := server.storage.CreateAuthRequest(authReq); err != nil {
+			t.Fatalf("create auth request: %v", err)
+		}
+		identity := connector.Identity{UserID: "1", Username: "jane", Picture: tc.picture}
+		if _, err := server.finalizeLogin(identity, authReq, server.connectors["mock"]); err != nil {
+			t.Fatalf("finalize login: %v", err)
+		}
+		got, err := server.storage.GetAuthRequest(authReq.ID)
+		if err != nil {
+			t.Fatalf("get auth request: %v", err)
+		}
+		if got.Claims.Picture != tc.want {
+			t.Errorf("picture %q: expected stored picture %q, got %q", tc.picture, tc.want, got.Claims.Picture)
+		}
+	}
+
+	claims := storage.Claims{UserID: "1", Username: "jane", Picture: "https://avatars.example.com/u/1"}
+	pictureClaim := func(scopes []string) (interface{}, bool) {
+		idToken, _, err := server.newIDToken("client", claims, scopes, nil, "", "", "mock")
+		if err != nil {
+			t.Fatalf("new id token: %v", err)
+		}
+		jws, err := jose.ParseSigned(idToken)
+		if err != nil {
+			t.Fatalf("parse id token: %v", err)
+		}
+		var payload map[string]interface{}
+		if err := json.Unmarshal(jws.UnsafePayloadWithoutVerification(), &payload); err != nil {
+			t.Fatalf("unmarshal id token: %v", err)
+		}
+		picture, ok := payload["picture"]
+		return picture, ok
+	}
+
+	if picture, ok := pictureClaim([]string{"openid", "profile"}); !ok || picture != claims.Picture {
+		t.Errorf("expected picture claim %q under the profile scope, got %v", claims.Picture, picture)
+	}
+	if picture, ok := pictureClaim([]string{"openid"}); ok {
+		t.Errorf("expected no picture claim without the profile scope, got %v", picture)
+	}
+}
+
+func TestConnectorIDClaim(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, server := newTestServer(ctx, t, func(c *Config) {
+		c.ConnectorIDClaim = "idp"
+	})
+	defer httpServer.Close()
+
+	claims := storage.Claims{UserID: "1", Username: "jane"}
+	idpClaim := func(scopes []string, connID string) (interface{}, bool) {
+		idToken, _, err := server.newIDToken("client", claims, scopes, nil, "", "", connID)
+		if err != nil {
+			t.Fatalf("new id token: %v", err)
+		}
+		jws, err := jose.ParseSigned(idToken)
+		if err != nil {
+			t.Fatalf("parse id token: %v", err)
+		}
+		var payload map[string]interface{}
+		if err := json.Unmarshal(jws.UnsafePayloadWithoutVerification(), &payload); err != nil {
+			t.Fatalf("unmarshal id token: %v", err)
+		}
+		idp, ok := payload["idp"]
+		return idp, ok
+	}
+
+	for _, connID := range []string{"mock", "github"} {
+		if idp, ok := idpClaim([]string{"openid", "federated:id"}, connID); !ok || idp != connID {
+			t.Errorf("expected idp claim %q, got %v", connID, idp)
+		}
+	}
+	if idp, ok := idpClaim([]string{"openid"}, "mock"); ok {
+		t.Errorf("expected no idp claim without the federated:id scope, got %v", idp)
+	}
+
+	config := Config{
+		Issuer:           httpServer.URL,
+		Storage:          server.storage,
+		Web:              WebConfig{Dir: "../web"},
+		Logger:           logger,
+		ConnectorIDClaim: "email",
+	}
+	if _, err := newServer(ctx, config, staticRotationStrategy(testKey)); err == nil {
+		t.Error("expected server to reject a connector ID claim named after a standard claim")
+	}
+}
+
+func TestScopeClaims(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, server := newTestServer(ctx, t, func(c *Config) {
+		c.ScopeClaims = map[string]map[string]string{
+			"employee": {"employee_id": "user_id", "login": "username"},
+			// Only release the email address, without email_verified.
+			"email": {"email": "email"},
+		}
+	})
+	defer httpServer.Close()
+
+	claims := storage.Claims{UserID: "1", Username: "jane", Email: "jane@example.com", EmailVerified: true}
+	tokenClaims := func(scopes []string) map[string]interface{} {
+		idToken, _, err := server.newIDToken("client", claims, scopes, nil, "", "", "mock")
+		if err != nil {
+			t.Fatalf("new id token: %v", err)
+		}
+		jws, err := jose.ParseSigned(idToken)
+		if err != nil {
+			t.Fatalf("parse id token: %v", err)
+		}
+		var payload map[string]interface{}
+		if err := json.Unmarshal(jws.UnsafePayloadWithoutVerification(), &payload); err != nil {
+			t.Fatalf("unmarshal id token: %v", err)
+		}
+		return payload
+	}
+
+	payload := tokenClaims([]string{"openid", "employee", "email"})
+	if payload["employee_id"] != "1" || payload["login"] != "jane" {
+		t.Errorf("expected employee scope to release employee_id and login, got %v", payload)
+	}
+	if payload["email"] != "jane@example.com" {
+		t.Errorf("expected email claim %q, got %v", "jane@example.com", payload["email"])
+	}
+	if _, ok := payload["email_verified"]; ok {
+		t.Errorf("expected no email_verified claim when the email scope doesn't release it")
+	}
+	if _, ok := tokenClaims([]string{"openid"})["employee_id"]; ok {
+		t.Error("expected no employee_id claim without the employee scope")
+	}
+	if _, ok := tokenClaims([]string{"employee"})["employee_id"]; ok {
+		t.Error("expected no employee_id claim without the openid scope")
+	}
+
+	req := httptest.NewRequest("GET", "/auth?"+url.Values{
+		"client_id":     {"test"},
+		"redirect_uri":  {"http://localhost/callback"},
+		"response_type": {"code"},
+		"scope":         {"openid employee"},
+	}.Encode(), nil)
+	if err := server.storage.CreateClient(storage.Client{ID: "test", RedirectURIs: []string{"http://localhost/callback"}}); err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+	if _, err := server.parseAuthorizationRequest(req); err != nil {
+		t.Errorf("expected custom scope to be accepted: %v", err)
+	}
+
+	for name, scopeClaims := range map[string]map[string]map[string]string{
+		"reserved claim":    {"employee": {"sub": "user_id"}},
+		"openid scope":      {"openid": {"employee_id": "user_id"}},
+		"unknown attribute": {"employee": {"employee_id": "department"}},
+	} {
+		config := Config{
+			Issuer:      httpServer.URL,
+			Storage:     server.storage,
+			Web:         WebConfig{Dir: "../web"},
+			Logger:      logger,
+			ScopeClaims: scopeClaims,
+		}
+		if _, err := newServer(ctx, config, staticRotationStrategy(testKey)); err == nil {
+			t.Errorf("%s: expected server to reject scope claims %v", name, scopeClaims)
+		}
+	}
+}
+
+func TestClaimExpressions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, server := newTestServer(ctx, t, func(c *Config) {
+		c.ClaimExpressions = map[string]string{
+			"short_name":   `{{ index (split .email "@") 0 }}`,
+			"display_name": `{{ .username }} <{{ lower .email }}>`,
+			"team":         `{{ index .groups 5 }}`,
+			"oversized":    `{{ printf "%2000s" .username }}`,
+		}
+		c.ScopeClaims = map[string]map[string]string{
+			"profile": {
+				"name":               "username",
+				"preferred_username": "short_name",
+				"display_name":       "display_name",
+				"team":               "team",
+				"oversized":          "oversized",
+			},
+		}
+	})
+	defer httpServer.Close()
+
+	claims := storage.Claims{UserID: "1", Username: "Jane", Email: "Jane.Doe@example.com", Groups: []string{"admins"}}
+	idToken, _, err := server.newIDToken("client", claims, []string{"openid", "profile"}, nil, "", "", "mock")
+	if err != nil {
+		t.Fatalf("new id token: %v", err)
+	}
+	jws, err := jose.ParseSigned(idToken)
+	if err != nil {
+		t.Fatalf("parse id token: %v", err)
+	}
+	var payload map[string]interface{}
+	if err := json.Unmarshal(jws.UnsafePayloadWithoutVerification(), &payload); err != nil {
+		t.Fatalf("unmarshal id token: %v", err)
+	}
+	if got := payload["preferred_username"]; got != "Jane.Doe" {
+		t.Errorf("expected preferred_username %q, got %v", "Jane.Doe", got)
+	}
+	if got := payload["display_name"]; got != "Jane <jane.doe@example.com>" {
+		t.Errorf("expected display_name %q, got %v", "Jane <jane.doe@example.com>", got)
+	}
+	// Failing expressions leave their claim out rather than failing the token.
+	for _, claim := range []string{"team", "oversized"} {
+		if value, ok := payload[claim]; ok {
+			t.Errorf("expected the failing %s expression to be left out, got %v", claim, value)
+		}
+	}
+	if !server.releasesGroups([]string{"profile"}) {
+		t.Error("expected groups to be looked up for an expression using them")
+	}
+
+	// Users without an email don't get claims derived from it.
+	claims.Email = ""
+	if value, ok := server.claimValue(claims, "short_name"); ok {
+		t.Errorf("expected no short_name without an email, got %v", value)
+	}
+
+	for name, exprs := range map[string]map[string]string{
+		"user attribute":   {"email": `{{ .username }}`},
+		"unknown function": {"short_name": `{{ exec "id" }}`},
+		"syntax error":     {"short_name": `{{ .email `},
+	} {
+		config := Config{
+			Issuer:           httpServer.URL,
+			Storage:          server.storage,
+			Web:              WebConfig{Dir: "../web"},
+			Logger:           logger,
+			ClaimExpressions: exprs,
+		}
+		if _, err := newServer(ctx, config, staticRotationStrategy(testKey)); err == nil {
+			t.Errorf("%s: expected server to reject claim expressions %v", name, exprs)
+		}
+	}
+}
+
+// groupScopes is a connector granting scopes to members of groups.
+type groupScopes map[string][]string
+
+func (g groupScopes) GrantScopes(identity connector.Identity, requested []string) []string {
+	var scopes []string
+	for _, group := range identity.Groups {
+		scopes = append(scopes, g[group]...)
+	}
+	return scopes
+}
+
+func TestConnectorGrantedScopes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, server := newTestServer(ctx, t, func(c *Config) {
+		c.ScopeClaims = map[string]map[string]string{
+			"admin": {"admin_login": "username"},
+		}
+	})
+	defer httpServer.Close()
+
+	client := storage.Client{
+		ID:               "client",
+		Secret:           "secret",
+		RedirectURIs:     []string{"https://example.com/callback"},
+		AllowedAudiences: []string{"listed"},
+	}
+	if err := server.storage.CreateClient(client); err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+	// Both peers trust the client, which may only request tokens for one.
+	for _, id := range []string{"listed", "unlisted"} {
+		if err := server.storage.CreateClient(storage.Client{ID: id, TrustedPeers: []string{client.ID}}); err != nil {
+			t.Fatalf("create client: %v", err)
+		}
+	}
+	conn := Connector{
+		ResourceVersion: "1",
+		Connector: groupScopes{
+			"admins": {"admin", "groups"},
+			"peers":  {"audience:server:client_id:listed", "audience:server:client_id:unlisted"},
+			// Not for connectors to grant.
+			"hackers": {"offline_access", "unknown", "audience:server:client_id:other"},
+		},
+	}
+
+	login := func(groups ...string) (scope string, claims map[string]interface{}) {
+		authReq := storage.AuthRequest{
+			ID:            storage.NewID(),
+			ClientID:      client.ID,
+			ConnectorID:   "mock",
+			ResponseTypes: []string{responseTypeCode},
+			Scopes:        []string{"openid"},
+			RedirectURI:   client.RedirectURIs[0],
+			Expiry:        time.Now().Add(time.Hour),
+		}
+		if err := server.storage.CreateAuthRequest(authReq); err != nil {
+			t.Fatalf("create auth request: %v", err)
+		}
+		identity := connector.Identity{UserID: "1", Username: "jane", Groups: groups}
+		if _, err := server.finalizeLogin(identity, authReq, conn); err != nil {
+			t.Fatalf("finalize login: %v", err)
+		}
+		authReq, err := server.storage.GetAuthRequest(authReq.ID)
+		if err != nil {
+			t.Fatalf("get auth request: %v", err)
+		}
+		rr := httptest.NewRecorder()
+		server.sendCodeResponse(rr, httptest.NewRequest("GET", "/approval", nil), authReq)
+		u, err := url.Parse(rr.Header().Get("Location"))
+		if err != nil {
+			t.Fatalf("parse redirect: %v", err)
+		}
+
+		rr = exchangeTestAuthCode(server, client, u.Query().Get("code"))
+		var resp struct {
+			Scope   string `json:"scope"`
+			IDToken string `json:"id_token"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil || resp.IDToken == "" {
+			t.Fatalf("expected an ID token, got %d: %s", rr.Code, rr.Body)
+		}
+		jws, err := jose.ParseSigned(resp.IDToken)
+		if err != nil {
+			t.Fatalf("parse id token: %v", err)
+		}
+		if err := json.Unmarshal(jws.UnsafePayloadWithoutVerification(), &claims); err != nil {
+			t.Fatalf("unmarshal id token: %v", err)
+		}
+		return resp.Scope, claims
+	}
+
+	scope, claims := login("admins", "hackers")
+	if scope != "openid admin groups" {
+		t.Errorf("expected the admin and groups scopes to be granted, got %q", scope)
+	}
+	if claims["admin_login"] != "jane" {
+		t.Errorf("expected the granted admin scope to release admin_login, got %v", claims)
+	}
+	if _, ok := claims["groups"]; !ok {
+		t.Errorf("expected the granted groups scope to release groups, got %v", claims)
+	}
+
+	// Cross-client scopes are only granted for the audiences the client may
+	// request itself.
+	scope, claims = login("peers")
+	if scope != "openid audience:server:client_id:listed" {
+		t.Errorf("expected only the allowed audience to be granted, got %q", scope)
+	}
+	if want := []interface{}{"client", "listed"}; !reflect.DeepEqual(claims["aud"], want) {
+		t.Errorf("expected audience %q, got %v", want, claims["aud"])
+	}
+
+	scope, claims = login("users")
+	if scope != "openid" {
+		t.Errorf("expected no scopes to be granted to non-members, got %q", scope)
+	}
+	if _, ok := claims["admin_login"]; ok {
+		t.Errorf("expected no admin_login claim without the admin scope, got %v", claims)
+	}
+}
+
+func TestAuthRequestLimits(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, server := newTestServer(ctx, t, func(c *Config) {
+		c.AuthRequestLimits = AuthRequestLimits{Scope: 64}
+	})
+	defer httpServer.Close()
+
+	client := storage.Client{ID: "foo", RedirectURIs: []string{"https://example.com/foo"}}
+	if err := server.storage.CreateClient(client); err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		scope   string
+		state   string
+		wantErr bool
+	}{
+		{"within limit", "openid email profile", "state", false},
+		{"long scope", "openid " + strings.Repeat("email ", 20), "state", true},
+		{"long query", "openid", strings.Repeat("a", 10000), true},
+	}
+	for _, tc := range tests {
+		q := url.Values{
+			"client_id":     {client.ID},
+			"redirect_uri":  {client.RedirectURIs[0]},
+			"response_type": {"code"},
+			"scope":         {tc.scope},
+			"state":         {tc.state},
+		}
+		_, err := server.parseAuthorizationRequest(httptest.NewRequest("GET", "/auth?"+q.Encode(), nil))
+		if !tc.wantErr {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", tc.name, err)
+			}
+			continue
+		}
+		if err == nil || err.Type != errInvalidRequest {
+			t.Errorf("%s: expected invalid_request, got %v", tc.name, err)
+			continue
+		}
+		if _, ok := err.Handle(); ok {
+			t.Errorf("%s: expected oversized request not to be redirected to the client", tc.name)
+		}
+	}
+}
+
+func TestPendingLoginLimits(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	now := time.Now()
+	httpServer, server := newTestServer(ctx, t, func(c *Config) {
+		c.Now = func() time.Time { return now }
+		c.PendingLoginLimits = PendingLoginLimits{Total: 3, PerIP: 2}
+		c.SkipApprovalScreen = true
+	})
+	defer httpServer.Close()
+
+	client := storage.Client{ID: "foo", RedirectURIs: []string{"https://example.com/foo"}}
+	if err := server.storage.CreateClient(client); err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	do := func(target, ip string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", target, nil)
+		r.RemoteAddr = ip + ":1234"
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, r)
+		return rr
+	}
+	// authorize starts a login from the IP address, returning the ID of its
+	// auth request, or an empty string if it was refused.
+	authorize := func(ip string) string {
+		t.Helper()
+		q := url.Values{
+			"client_id":     {client.ID},
+			"redirect_uri":  {client.RedirectURIs[0]},
+			"response_type": {"code"},
+			"scope":         {"openid"},
+			"state":         {"state"},
+		}
+		rr := do("/auth?"+q.Encode(), ip)
+		if rr.Code != http.StatusFound && rr.Code != http.StatusSeeOther {
+			t.Fatalf("expected a redirect, got %d: %s", rr.Code, rr.Body)
+		}
+		u, err := url.Parse(rr.Header().Get("Location"))
+		if err != nil {
+			t.Fatalf("parse redirect: %v", err)
+		}
+		if e := u.Query().Get("error"); e != "" {
+			if e != errTemporarilyUnavailable {
+				t.Fatalf("expected %s, got %s", errTemporarilyUnavailable, e)
+			}
+			return ""
+		}
+		return u.Query().Get("req")
+	}
+
+	// Logins refused before reaching a connector don't take a slot.
+	for i := 0; i < 3; i++ {
+		q := url.Values{
+			"client_id":     {client.ID},
+			"redirect_uri":  {client.RedirectURIs[0]},
+			"response_type": {"code"},
+			"scope":         {"openid"},
+			"connector_id":  {"missing"},
+		}
+		if rr := do("/auth?"+q.Encode(), "10.0.0.1"); rr.Code != http.StatusBadRequest {
+			t.Fatalf("expected an unknown connector to be refused, got %d: %s", rr.Code, rr.Body)
+		}
+	}
+
+	first := authorize("10.0.0.1")
+	if first == "" || authorize("10.0.0.1") == "" {
+		t.Fatalf("expected logins within the limits to start")
+	}
+	if authorize("10.0.0.1") != "" {
+		t.Errorf("expected the login to exceed the limit per IP address")
+	}
+	if authorize("10.0.0.2") == "" {
+		t.Fatalf("expected a login from another IP address to start")
+	}
+	if authorize("10.0.0.3") != "" {
+		t.Errorf("expected the login to exceed the total limit")
+	}
+
+	// Completing a login frees its slot.
+	do("/auth/mock?req="+first, "10.0.0.1")
+	if rr := do("/callback?state="+first, "10.0.0.1"); rr.Code != http.StatusSeeOther {
+		t.Fatalf("expected a redirect to the approval page, got %d: %s", rr.Code, rr.Body)
+	}
+	if rr := do("/approval?req="+first, "10.0.0.1"); !strings.Contains(rr.Header().Get("Location"), "code=") {
+		t.Fatalf("expected a code to be issued, got %d %q", rr.Code, rr.Header().Get("Location"))
+	}
+	if authorize("10.0.0.3") == "" {
+		t.Errorf("expected a completed login to free its slot")
+	}
+
+	// So do logins which expire.
+	now = now.Add(server.authRequestsValidFor + time.Second)
+	for _, ip := range []string{"10.0.0.1", "10.0.0.1", "10.0.0.3"} {
+		if authorize(ip) == "" {
+			t.Errorf("expected expired logins to free their slots")
+		}
+	}
+
+	if err := (PendingLoginLimits{PerIP: -1}).validate(); err == nil {
+		t.Errorf("expected negative limits to be invalid")
+	}
+}
+
+func TestErrorStatusCodes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, server := newTestServer(ctx, t, func(c *Config) {
+		c.ErrorStatusCodes = map[string]int{errInvalidGrant: http.StatusUnprocessableEntity}
+	})
+	defer httpServer.Close()
+
+	client := storage.Client{ID: "client", Secret: "secret", RedirectURIs: []string{"https://example.com/callback"}}
+	if err := server.storage.CreateClient(client); err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	token := func(form url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.SetBasicAuth(client.ID, client.Secret)
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, r)
+		return rr
+	}
+	rr := token(url.Values{"grant_type": {"unknown"}})
+	if rr.Code != http.StatusUnprocessableEntity || !strings.Contains(rr.Body.String(), errInvalidGrant) {
+		t.Errorf("expected the configured status for %s, got %d: %s", errInvalidGrant, rr.Code, rr.Body)
+	}
+	rr = token(url.Values{"grant_type": {grantTypeAuthorizationCode}, "code": {"unknown"}, "redirect_uri": {client.RedirectURIs[0]}})
+	if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), errInvalidRequest) {
+		t.Errorf("expected other errors to keep their status, got %d: %s", rr.Code, rr.Body)
+	}
+
+	for _, statuses := range []map[string]int{
+		{errTemporarilyUnavailable: http.StatusOK},
+		{errInvalidGrant: http.StatusFound},
+		{errServerError: 600},
+		{"": http.StatusBadRequest},
+	} {
+		if err := validateErrorStatusCodes(statuses); err == nil {
+			t.Errorf("expected status codes %v to be invalid", statuses)
+		}
+	}
+	if err := validateErrorStatusCodes(map[string]int{errTemporarilyUnavailable: 503, "slow_down": 429}); err != nil {
+		t.Errorf("expected status codes to be valid: %v", err)
+	}
+}
+
+func TestUniqueNonces(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	now := time.Now()
+	httpServer, server := newTestServer(ctx, t, func(c *Config) {
+		c.Now = func() time.Time { return now }
+	})
+	defer httpServer.Close()
+
+	enforced := storage.Client{ID: "enforced", RedirectURIs: []string{"https://example.com/foo"}, UniqueNonces: true}
+	relaxed := storage.Client{ID: "relaxed", RedirectURIs: []string{"https://example.com/foo"}}
+	for _, client := range []storage.Client{enforced, relaxed} {
+		if err := server.storage.CreateClient(client); err != nil {
+			t.Fatalf("create client: %v", err)
+		}
+	}
+	parse := func(client storage.Client, nonce string) *authErr {
+		q := url.Values{
+			"client_id":     {client.ID},
+			"redirect_uri":  {client.RedirectURIs[0]},
+			"response_type": {"code"},
+			"scope":         {"openid"},
+			"nonce":         {nonce},
+		}
+		_, err := server.parseAuthorizationRequest(httptest.NewRequest("GET", "/auth?"+q.Encode(), nil))
+		return err
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := parse(relaxed, "nonce"); err != nil {
+			t.Fatalf("expected a reused nonce to be allowed when not enforced, got %v", err)
+		}
+	}
+	if err := parse(enforced, "nonce"); err != nil {
+		t.Fatalf("expected the first use of a nonce to be allowed, got %v", err)
+	}
+	err := parse(enforced, "nonce")
+	if err == nil || err.Type != errInvalidRequest {
+		t.Fatalf("expected a reused nonce to be rejected with invalid_request, got %v", err)
+	}
+	if err := parse(enforced, "other"); err != nil {
+		t.Errorf("expected another nonce to be allowed, got %v", err)
+	}
+
+	// Once ID tokens it could be replayed into have expired, the nonce is
+	// garbage collected.
+	now = now.Add(server.authRequestsValidFor + server.idTokensValidFor + time.Minute)
+	if _, err := server.storage.GarbageCollect(now); err != nil {
+		t.Fatalf("garbage collect: %v", err)
+	}
+	if err := parse(enforced, "nonce"); err != nil {
+		t.Errorf("expected the nonce to be allowed once expired, got %v", err)
+	}
+}
+
+func TestAuthRequestScopeCount(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, server := newTestServer(ctx, t, func(c *Config) {
+		c.AuthRequestLimits = AuthRequestLimits{ScopeCount: 3}
+	})
+	defer httpServer.Close()
+
+	client := storage.Client{ID: "foo", RedirectURIs: []string{"https://example.com/foo"}}
+	if err := server.storage.CreateClient(client); err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		scope      string
+		wantScopes []string
+	}{
+		{"duplicates collapsed", "openid email openid email profile email", []string{"openid", "email", "profile"}},
+		{"too many scopes", "openid email profile groups", nil},
+	}
+	for _, tc := range tests {
+		q := url.Values{
+			"client_id":     {client.ID},
+			"redirect_uri":  {client.RedirectURIs[0]},
+			"response_type": {"code"},
+			"scope":         {tc.scope},
+			"state":         {"state"},
+		}
+		req, err := server.parseAuthorizationRequest(httptest.NewRequest("GET", "/auth?"+q.Encode(), nil))
+		if tc.wantScopes == nil {
+			if err == nil || err.Type != errInvalidScope {
+				t.Errorf("%s: expected invalid_scope, got %v", tc.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(req.Scopes, tc.wantScopes) {
+			t.Errorf("%s: expected scopes %q, got %q", tc.name, tc.wantScopes, req.Scopes)
+		}
+	}
+}
+
+func TestAllowedAudiences(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, server := newTestServer(ctx, t, nil)
+	defer httpServer.Close()
+
+	for _, client := range []storage.Client{
+		{ID: "foo", RedirectURIs: []string{"https://example.com/foo"}, AllowedAudiences: []string{"bar"}},
+		{ID: "bar", TrustedPeers: []string{"foo"}},
+		{ID: "baz", TrustedPeers: []string{"foo"}},
+	} {
+		if err := server.storage.CreateClient(client); err != nil {
+			t.Fatalf("create client: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		scope   string
+		wantErr string
+	}{
+		{"allowed audience", "openid audience:server:client_id:bar", ""},
+		{"own audience", "openid audience:server:client_id:foo", ""},
+		{"audience not allowed", "openid audience:server:client_id:bar audience:server:client_id:baz", errInvalidTarget},
+	}
+	for _, tc := range tests {
+		q := url.Values{
+			"client_id":     {"foo"},
+			"redirect_uri":  {"https://example.com/foo"},
+			"response_type": {"code"},
+			"scope":         {tc.scope},
+			"state":         {"state"},
+		}
+		_, err := server.parseAuthorizationRequest(httptest.NewRequest("GET", "/auth?"+q.Encode(), nil))
+		if tc.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", tc.name, err)
+			}
+			continue
+		}
+		if err == nil || err.Type != tc.wantErr {
+			t.Errorf("%s: expected %s, got %v", tc.name, tc.wantErr, err)
+		}
+	}
+}
+
+func TestIDTokenSizeLimit(t *testing.T) {
+	groups := make([]string, 200)
+	for i := range groups {
+		groups[i] = fmt.Sprintf("engineering-team-%d", i)
+	}
+	claims := storage.Claims{UserID: "1", Username: "jane", Email: "jane.doe@example.com", EmailVerified: true, Groups: groups}
+	scopes := []string{scopeOpenID, scopeEmail, scopeGroups}
+
+	tests := []struct {
+		name            string
+		limit           IDTokenSizeLimit
+		requestedClaims map[string]bool
+		wantDenied      bool
+	}{
+		{"within limit", IDTokenSizeLimit{MaxBytes: 16384}, nil, false},
+		{"reject", IDTokenSizeLimit{MaxBytes: 2048}, nil, true},
+		{"trim", IDTokenSizeLimit{MaxBytes: 2048, Policy: "trim"}, nil, false},
+		{"essential claims kept", IDTokenSizeLimit{MaxBytes: 2048, Policy: "trim"}, map[string]bool{"groups": true}, true},
+		{"trimming not enough", IDTokenSizeLimit{MaxBytes: 256, Policy: "trim", TrimClaims: []string{"groups", "email"}}, nil, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			httpServer, server := newTestServer(ctx, t, func(c *Config) {
+				c.IDTokenSizeLimit = tc.limit
+			})
+			defer httpServer.Close()
+
+			idToken, _, err := server.newIDToken("client", claims, scopes, tc.requestedClaims, "", "", "mock")
+			if tc.wantDenied {
+				if _, ok := err.(tokenDeniedError); !ok {
+					t.Fatalf("expected the token to be denied, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("new id token: %v", err)
+			}
+			if len(idToken) > tc.limit.MaxBytes {
+				t.Errorf("expected a token of at most %d bytes, got %d", tc.limit.MaxBytes, len(idToken))
+			}
+			jws, err := jose.ParseSigned(idToken)
+			if err != nil {
+				t.Fatalf("parse id token: %v", err)
+			}
+			var got map[string]interface{}
+			if err := json.Unmarshal(jws.UnsafePayloadWithoutVerification(), &got); err != nil {
+				t.Fatalf("unmarshal id token: %v", err)
+			}
+			_, hasGroups := got["groups"]
+			if wantGroups := tc.limit.Policy != "trim"; hasGroups != wantGroups {
+				t.Errorf("expected groups claim %t, got %t", wantGroups, hasGroups)
+			}
+			if got["email"] != claims.Email {
+				t.Errorf("expected the email claim to be kept, got %v", got["email"])
+			}
+		})
+	}
+}
+
+func TestIDTokenSizeLimitValidation(t *testing.T) {
+	for _, limit := range []IDTokenSizeLimit{
+		{MaxBytes: -1},
+		{MaxBytes: 4096, Policy: "truncate"},
+		{MaxBytes: 4096, Policy: "trim", TrimClaims: []string{"groups", "sub"}},
+	} {
+		if err := limit.validate(); err == nil {
+			t.Errorf("expected limit %+v to be invalid", limit)
+		}
+	}
+}
+
+func TestIDTokenScope(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, server := newTestServer(ctx, t, nil)
+	defer httpServer.Close()
+
+	for _, client := range []storage.Client{
+		{ID: "with-scope", Secret: "secret", IDTokenScope: true},
+		{ID: "without-scope", Secret: "secret"},
+	} {
+		if err := server.storage.CreateClient(client); err != nil {
+			t.Fatalf("create client: %v", err)
+		}
+	}
+
+	scopes := []string{"openid", "email", "offline_access"}
+	for clientID, want := range map[string]interface{}{
+		"with-scope":    "openid email offline_access",
+		"without-scope": nil,
+	} {
+		idToken, _, err := server.newIDToken(clientID, storage.Claims{UserID: "1", Email: "jane@example.com"}, scopes, nil, "", "", "mock")
+		if err != nil {
+			t.Fatalf("new id token: %v", err)
+		}
+		jws, err := jose.ParseSigned(idToken)
+		if err != nil {
+			t.Fatalf("parse id token: %v", err)
+		}
+		var payload map[string]interface{}
+		if err := json.Unmarshal(jws.UnsafePayloadWithoutVerification(), &payload); err != nil {
+			t.Fatalf("unmarshal id token: %v", err)
+		}
+		if got := payload["scope"]; got != want {
+			t.Errorf("client %s: expected scope claim %v, got %v", clientID, want, got)
+		}
+	}
+}
+
+func TestIDTokenNotBefore(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	now := time.Now().Truncate(time.Second)
+	for _, enabled := range []bool{false, true} {
+		httpServer, server := newTestServer(ctx, t, func(c *Config) {
+			c.Now = func() time.Time { return now }
+			c.IDTokenNotBefore = enabled
+			c.NotBeforeLeeway = 30 * time.Second
+		})
+		defer httpServer.Close()
+
+		idToken, _, err := server.newIDToken("client", storage.Claims{UserID: "1"}, []string{"openid"}, nil, "", "", "mock")
+		if err != nil {
+			t.Fatalf("new id token: %v", err)
+		}
+		jws, err := jose.ParseSigned(idToken)
+		if err != nil {
+			t.Fatalf("parse id token: %v", err)
+		}
+		var payload map[string]interface{}
+		if err := json.Unmarshal(jws.UnsafePayloadWithoutVerification(), &payload); err != nil {
+			t.Fatalf("unmarshal id token: %v", err)
+		}
+
+		nbf, ok := payload["nbf"]
+		if !enabled {
+			if ok {
+				t.Errorf("expected no nbf claim unless enabled, got %v", nbf)
+			}
+			continue
+		}
+		want := now.Add(-30 * time.Second).Unix()
+		if got, ok := nbf.(float64); !ok || int64(got) != want {
+			t.Errorf("expected nbf of %d, 30s before the token was issued, got %v", want, nbf)
+		}
+		if iat := payload["iat"].(float64); int64(iat) != now.Unix() {
+			t.Errorf("expected iat of %d, got %v", now.Unix(), iat)
+		}
+		if _, err := server.verifyIDToken(idToken); err != nil {
+			t.Errorf("expected token to be valid when issued: %v", err)
+		}
+	}
+}
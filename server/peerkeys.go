@@ -0,0 +1,150 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+const (
+	// How long the keys of a peer are cached for.
+	peerKeysValidFor = 5 * time.Minute
+	// How often the keys of a peer are fetched at most, when a token is
+	// signed by a key missing from the cache, such as one the peer just
+	// rotated to.
+	peerKeysMinRefresh = 10 * time.Second
+	// Largest key set read from a peer.
+	maxPeerKeysSize = 1 << 20
+)
+
+// peerKeys verifies tokens signed by other dex instances serving the same
+// issuer, such as the other half of a blue/green deployment, using the keys
+// they publish rather than a shared storage.
+type peerKeys struct {
+	uris   []string
+	client *http.Client
+	now    func() time.Time
+
+	mu   sync.Mutex
+	sets map[string]*peerKeySet
+}
+
+type peerKeySet struct {
+	keys    jose.JSONWebKeySet
+	expiry  time.Time
+	fetched time.Time
+	// Error of the last fetch, if it failed.
+	err error
+	// Closed once the fetch in progress, if any, completes.
+	fetching chan struct{}
+}
+
+func newPeerKeys(uris []string, now func() time.Time) *peerKeys {
+	return &peerKeys{
+		uris:   uris,
+		client: &http.Client{Timeout: 10 * time.Second},
+		now:    now,
+		sets:   make(map[string]*peerKeySet),
+	}
+}
+
+// verify checks that a JWS was signed by one of the peers' keys and returns
+// its payload. Key sets are fetched again when they expire, or when the key
+// ID of the signature is unknown.
+func (p *peerKeys) verify(jws *jose.JSONWebSignature) ([]byte, error) {
+	if len(jws.Signatures) != 1 {
+		return nil, errors.New("expected exactly one signature")
+	}
+	kid := jws.Signatures[0].Header.KeyID
+
+	var errs []error
+	for _, uri := range p.uris {
+		keys, err := p.keySet(uri, kid)
+		if err != nil {
+			// Keep using the keys fetched before, if any.
+			errs = append(errs, fmt.Errorf("fetch keys of %s: %v", uri, err))
+		}
+		for _, key := range keys.Key(kid) {
+			if payload, err := jws.Verify(&key); err == nil {
+				return payload, nil
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("not signed by a known peer key: %v", errs)
+	}
+	return nil, errors.New("not signed by a known peer key")
+}
+
+// keySet returns the keys of a peer, fetching them first if they've expired
+// or lack the key ID. The mutex isn't held while fetching, so a slow peer
+// only holds up the verifications needing its keys, which wait for the fetch
+// in progress rather than starting their own.
+func (p *peerKeys) keySet(uri, kid string) (jose.JSONWebKeySet, error) {
+	p.mu.Lock()
+	set, ok := p.sets[uri]
+	if !ok {
+		set = &peerKeySet{}
+		p.sets[uri] = set
+	}
+	now := p.now()
+	refresh := now.After(set.expiry) || len(set.keys.Key(kid)) == 0
+	if refresh && set.fetching != nil {
+		fetching := set.fetching
+		p.mu.Unlock()
+		<-fetching
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return set.keys, set.err
+	}
+	// Failed fetches are rate limited too, so an unreachable peer doesn't
+	// hold up every verification.
+	if !refresh || (!set.fetched.IsZero() && now.Sub(set.fetched) < peerKeysMinRefresh) {
+		defer p.mu.Unlock()
+		return set.keys, set.err
+	}
+	set.fetched = now
+	fetching := make(chan struct{})
+	set.fetching = fetching
+	p.mu.Unlock()
+
+	keys, err := p.fetch(uri)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err == nil {
+		set.keys = keys
+		set.expiry = now.Add(peerKeysValidFor)
+	}
+	set.err = err
+	set.fetching = nil
+	close(fetching)
+	return set.keys, set.err
+}
+
+func (p *peerKeys) fetch(uri string) (jose.JSONWebKeySet, error) {
+	var keys jose.JSONWebKeySet
+	resp, err := p.client.Get(uri)
+	if err != nil {
+		return keys, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return keys, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxPeerKeysSize))
+	if err != nil {
+		return keys, err
+	}
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return keys, fmt.Errorf("unmarshal keys: %v", err)
+	}
+	return keys, nil
+}
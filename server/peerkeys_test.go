@@ -0,0 +1,224 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	jose "gopkg.in/square/go-jose.v2"
+
+	"github.com/dexidp/dex/storage"
+)
+
+// testPeer serves the key set of a simulated peer dex instance.
+type testPeer struct {
+	mu      sync.Mutex
+	keys    map[string]*rsa.PrivateKey
+	fetches int
+}
+
+func (p *testPeer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.fetches++
+	var jwks jose.JSONWebKeySet
+	for kid, key := range p.keys {
+		jwks.Keys = append(jwks.Keys, jose.JSONWebKey{Key: key.Public(), KeyID: kid, Algorithm: string(jose.RS256), Use: "sig"})
+	}
+	json.NewEncoder(w).Encode(jwks)
+}
+
+func TestPeerKeys(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	newKey := func() *rsa.PrivateKey {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatalf("generate key: %v", err)
+		}
+		return key
+	}
+	peer := &testPeer{keys: map[string]*rsa.PrivateKey{"peer-1": newKey()}}
+	peerServer := httptest.NewServer(peer)
+	defer peerServer.Close()
+
+	httpServer, server := newTestServer(ctx, t, func(c *Config) {
+		c.PeerJWKSURIs = []string{peerServer.URL}
+	})
+	defer httpServer.Close()
+
+	now := time.Now()
+	server.peerKeys.now = func() time.Time { return now }
+
+	sign := func(key *rsa.PrivateKey, kid, issuer string) string {
+		payload, err := json.Marshal(idTokenClaims{
+			Issuer:   issuer,
+			Subject:  "peer-user",
+			Audience: audience{"client"},
+			Expiry:   server.now().Add(time.Hour).Unix(),
+			IssuedAt: server.now().Unix(),
+		})
+		if err != nil {
+			t.Fatalf("marshal claims: %v", err)
+		}
+		signingKey := jose.SigningKey{Algorithm: jose.RS256, Key: &jose.JSONWebKey{Key: key, KeyID: kid, Algorithm: string(jose.RS256)}}
+		token, err := signPayload(signingKey, payload)
+		if err != nil {
+			t.Fatalf("sign token: %v", err)
+		}
+		return token
+	}
+	issuer := server.issuerURL.String()
+
+	claims, err := server.verifyIDToken(sign(peer.keys["peer-1"], "peer-1", issuer))
+	if err != nil {
+		t.Fatalf("expected a token signed by the peer to verify: %v", err)
+	}
+	if claims.Subject != "peer-user" {
+		t.Errorf("expected subject %q, got %q", "peer-user", claims.Subject)
+	}
+	if _, err := server.verifyIDToken(sign(peer.keys["peer-1"], "peer-1", issuer)); err != nil || peer.fetches != 1 {
+		t.Errorf("expected the peer's keys to be cached, got %v after %d fetches", err, peer.fetches)
+	}
+
+	// Tokens dex signed itself are still verified with its own keys.
+	idToken, _, err := server.newIDToken("client", storage.Claims{UserID: "1"}, []string{scopeOpenID}, nil, "", "", "mock")
+	if err != nil {
+		t.Fatalf("new id token: %v", err)
+	}
+	if _, err := server.verifyIDToken(idToken); err != nil {
+		t.Errorf("expected a token signed by dex to verify: %v", err)
+	}
+
+	// A key the peer rotated to is fetched once the last fetch is old enough.
+	peer.mu.Lock()
+	peer.keys["peer-2"] = newKey()
+	peer.mu.Unlock()
+	rotated := sign(peer.keys["peer-2"], "peer-2", issuer)
+	if _, err := server.verifyIDToken(rotated); err == nil || peer.fetches != 1 {
+		t.Errorf("expected keys not to be fetched again right away, got %v after %d fetches", err, peer.fetches)
+	}
+	now = now.Add(peerKeysMinRefresh)
+	if _, err := server.verifyIDToken(rotated); err != nil || peer.fetches != 2 {
+		t.Errorf("expected the rotated key to be fetched, got %v after %d fetches", err, peer.fetches)
+	}
+
+	if _, err := server.verifyIDToken(sign(newKey(), "peer-1", issuer)); err == nil {
+		t.Error("expected a token signed by an unknown key to be rejected")
+	}
+	if _, err := server.verifyIDToken(sign(peer.keys["peer-1"], "peer-1", "https://other.example.com")); err == nil {
+		t.Error("expected a peer token for another issuer to be rejected")
+	}
+
+	// The cached keys are used while the peer is unreachable.
+	peerServer.Close()
+	now = now.Add(peerKeysValidFor + time.Second)
+	if _, err := server.verifyIDToken(sign(peer.keys["peer-1"], "peer-1", issuer)); err != nil {
+		t.Errorf("expected the cached keys to be used while the peer is down: %v", err)
+	}
+	if fetched := server.peerKeys.sets[peerServer.URL].fetched; !fetched.Equal(now) {
+		t.Errorf("expected the failed fetch to be rate limited from %s, got %s", now, fetched)
+	}
+}
+
+// slowPeer serves the keys of a peer once released.
+type slowPeer struct {
+	testPeer
+	requests chan struct{}
+	release  chan struct{}
+}
+
+func (p *slowPeer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.requests <- struct{}{}
+	<-p.release
+	p.testPeer.ServeHTTP(w, r)
+}
+
+func TestPeerKeysConcurrentFetches(t *testing.T) {
+	newKey := func() *rsa.PrivateKey {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatalf("generate key: %v", err)
+		}
+		return key
+	}
+	sign := func(key *rsa.PrivateKey, kid string) *jose.JSONWebSignature {
+		signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: &jose.JSONWebKey{Key: key, KeyID: kid}}, nil)
+		if err != nil {
+			t.Fatalf("new signer: %v", err)
+		}
+		signed, err := signer.Sign([]byte(`{}`))
+		if err != nil {
+			t.Fatalf("sign: %v", err)
+		}
+		token, err := signed.CompactSerialize()
+		if err != nil {
+			t.Fatalf("serialize: %v", err)
+		}
+		jws, err := jose.ParseSigned(token)
+		if err != nil {
+			t.Fatalf("parse: %v", err)
+		}
+		return jws
+	}
+
+	fast := &testPeer{keys: map[string]*rsa.PrivateKey{"fast": newKey()}}
+	fastServer := httptest.NewServer(fast)
+	defer fastServer.Close()
+	slow := &slowPeer{
+		testPeer: testPeer{keys: map[string]*rsa.PrivateKey{"slow": newKey()}},
+		requests: make(chan struct{}, 10),
+		release:  make(chan struct{}),
+	}
+	slowServer := httptest.NewServer(slow)
+	defer slowServer.Close()
+
+	p := newPeerKeys([]string{fastServer.URL, slowServer.URL}, time.Now)
+
+	// Verifications needing the slow peer's keys share a single fetch.
+	slowToken := sign(slow.keys["slow"], "slow")
+	errs := make(chan error, 3)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			_, err := p.verify(slowToken)
+			errs <- err
+		}()
+	}
+	select {
+	case <-slow.requests:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the slow peer's keys to be fetched")
+	}
+
+	// Others aren't held up while it's in progress.
+	done := make(chan error, 1)
+	go func() {
+		_, err := p.verify(sign(fast.keys["fast"], "fast"))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("expected a token signed by the fast peer to verify: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a token signed by the fast peer to verify while the slow peer is fetched")
+	}
+
+	close(slow.release)
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("expected a token signed by the slow peer to verify: %v", err)
+		}
+	}
+	if n := len(slow.requests); n != 0 {
+		t.Errorf("expected the slow peer's keys to be fetched once, got %d more fetches", n)
+	}
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/dexidp/dex/storage"
+)
+
+// PKCE code challenge methods.
+//
+// https://tools.ietf.org/html/rfc7636#section-4.2
+const (
+	codeChallengeMethodPlain = "plain"
+	codeChallengeMethodS256  = "S256"
+)
+
+// validPKCEValue reports if a code verifier or challenge is 43 to 128 of the
+// characters RFC 7636 allows.
+func validPKCEValue(s string) bool {
+	if len(s) < 43 || len(s) > 128 {
+		return false
+	}
+	for _, c := range s {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case c == '-', c == '.', c == '_', c == '~':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// parsePKCE validates the code challenge parameters of an authorization
+// request. Both are optional, the method defaults to "plain".
+func parsePKCE(challenge, method string) (storage.PKCE, error) {
+	if challenge == "" {
+		if method != "" {
+			return storage.PKCE{}, errors.New("code_challenge_method provided without a code_challenge")
+		}
+		return storage.PKCE{}, nil
+	}
+	if method == "" {
+		method = codeChallengeMethodPlain
+	}
+	if method != codeChallengeMethodPlain && method != codeChallengeMethodS256 {
+		return storage.PKCE{}, fmt.Errorf("unsupported code_challenge_method %q", method)
+	}
+	if !validPKCEValue(challenge) {
+		return storage.PKCE{}, errors.New("malformed code_challenge")
+	}
+	return storage.PKCE{CodeChallenge: challenge, CodeChallengeMethod: method}, nil
+}
+
+// verifyCodeVerifier checks the code verifier of a token request against the
+// challenge of the authorization request the code was issued for.
+func verifyCodeVerifier(pkce storage.PKCE, verifier string) error {
+	if pkce.CodeChallenge == "" {
+		return nil
+	}
+	if verifier == "" {
+		return errors.New("no code_verifier provided")
+	}
+	if !validPKCEValue(verifier) {
+		return errors.New("malformed code_verifier")
+	}
+	challenge := verifier
+	if pkce.CodeChallengeMethod == codeChallengeMethodS256 {
+		sum := sha256.Sum256([]byte(verifier))
+		challenge = base64.RawURLEncoding.EncodeToString(sum[:])
+	}
+	if subtle.ConstantTimeCompare([]byte(challenge), []byte(pkce.CodeChallenge)) != 1 {
+		return errors.New("code_verifier doesn't match code_challenge")
+	}
+	return nil
+}
+
+// pkceRequired reports if a client must send a code challenge with requests
+// for an authorization code. The client's own setting takes precedence over
+// the server's, which only applies to public clients.
+func (s *Server) pkceRequired(client storage.Client) bool {
+	if client.RequirePKCE != nil {
+		return *client.RequirePKCE
+	}
+	return s.requirePKCE && client.Public
+}
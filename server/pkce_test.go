@@ -0,0 +1,132 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dexidp/dex/storage"
+)
+
+func TestRequirePKCE(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	required, exempt := true, false
+	clients := []storage.Client{
+		{ID: "public", Public: true},
+		{ID: "confidential", Secret: "secret", RedirectURIs: []string{"https://app.example.com/callback"}},
+		{ID: "public-exempt", Public: true, RequirePKCE: &exempt},
+		{ID: "confidential-required", Secret: "secret", RedirectURIs: []string{"https://app.example.com/callback"}, RequirePKCE: &required},
+	}
+	redirectURIs := map[string]string{
+		"public":                "http://localhost:8080/callback",
+		"confidential":          "https://app.example.com/callback",
+		"public-exempt":         "http://localhost:8080/callback",
+		"confidential-required": "https://app.example.com/callback",
+	}
+
+	tests := []struct {
+		requirePKCE bool
+		clientID    string
+		challenge   string
+		wantErr     bool
+	}{
+		{requirePKCE: false, clientID: "public"},
+		{requirePKCE: true, clientID: "public", wantErr: true},
+		{requirePKCE: true, clientID: "public", challenge: "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"},
+		{requirePKCE: true, clientID: "confidential"},
+		{requirePKCE: true, clientID: "public-exempt"},
+		{requirePKCE: false, clientID: "confidential-required", wantErr: true},
+	}
+	for _, tc := range tests {
+		httpServer, server := newTestServer(ctx, t, func(c *Config) {
+			c.RequirePKCE = tc.requirePKCE
+		})
+		for _, c := range clients {
+			if err := server.storage.CreateClient(c); err != nil {
+				t.Fatalf("create client: %v", err)
+			}
+		}
+
+		q := url.Values{
+			"client_id":     {tc.clientID},
+			"redirect_uri":  {redirectURIs[tc.clientID]},
+			"response_type": {"code"},
+			"scope":         {"openid"},
+		}
+		if tc.challenge != "" {
+			q.Set("code_challenge", tc.challenge)
+			q.Set("code_challenge_method", "S256")
+		}
+		_, err := server.parseAuthorizationRequest(httptest.NewRequest("GET", "/auth?"+q.Encode(), nil))
+		if tc.wantErr {
+			if err == nil || err.Type != errInvalidRequest {
+				t.Errorf("requirePKCE=%t client=%s: expected invalid_request, got %v", tc.requirePKCE, tc.clientID, err)
+			}
+		} else if err != nil {
+			t.Errorf("requirePKCE=%t client=%s: expected request to be allowed, got %v", tc.requirePKCE, tc.clientID, err)
+		}
+		httpServer.Close()
+	}
+}
+
+func TestPKCEExchange(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, server := newTestServer(ctx, t, nil)
+	defer httpServer.Close()
+
+	client := storage.Client{ID: "client", Secret: "secret", RedirectURIs: []string{"https://app.example.com/callback"}}
+	if err := server.storage.CreateClient(client); err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	// Example from RFC 7636 appendix B.
+	const (
+		verifier  = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+		challenge = "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+	)
+	for _, tc := range []struct {
+		verifier string
+		wantCode int
+	}{
+		{"", http.StatusBadRequest},
+		{"dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXX", http.StatusBadRequest},
+		{verifier, http.StatusOK},
+	} {
+		code := storage.AuthCode{
+			ID:          storage.NewID(),
+			ClientID:    client.ID,
+			RedirectURI: client.RedirectURIs[0],
+			Scopes:      []string{scopeOpenID},
+			ConnectorID: "mock",
+			Claims:      storage.Claims{UserID: "1"},
+			Expiry:      server.now().Add(time.Hour),
+			PKCE:        storage.PKCE{CodeChallenge: challenge, CodeChallengeMethod: codeChallengeMethodS256},
+		}
+		if err := server.storage.CreateAuthCode(code); err != nil {
+			t.Fatalf("create auth code: %v", err)
+		}
+
+		form := url.Values{
+			"grant_type":    {grantTypeAuthorizationCode},
+			"code":          {code.ID},
+			"redirect_uri":  {code.RedirectURI},
+			"code_verifier": {tc.verifier},
+		}
+		req := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(client.ID, client.Secret)
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, req)
+		if rr.Code != tc.wantCode {
+			t.Errorf("verifier %q: expected %d, got %d: %s", tc.verifier, tc.wantCode, rr.Code, rr.Body)
+		}
+	}
+}
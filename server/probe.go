@@ -0,0 +1,149 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/dexidp/dex/connector"
+)
+
+// loginProbes periodically fetches the login URLs of connectors redirecting
+// users to an upstream provider. Health checks usually only fetch metadata, so
+// they keep passing when the page users are sent to log in is down.
+type loginProbes struct {
+	s      *Server
+	client *http.Client
+
+	up       *prometheus.GaugeVec
+	duration *prometheus.GaugeVec
+
+	mu sync.Mutex
+	// Results of the last probe of each connector, guarded by the mutex.
+	results map[string]loginProbeResult
+}
+
+type loginProbeResult struct {
+	err     error
+	latency time.Duration
+}
+
+func newLoginProbes(s *Server, timeout time.Duration) *loginProbes {
+	return &loginProbes{
+		s:      s,
+		client: &http.Client{Timeout: timeout},
+		up: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "dex_connector_login_probe_up",
+			Help: "Whether the login URL of a connector was reachable when last probed.",
+		}, []string{"connector"}),
+		duration: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "dex_connector_login_probe_duration_seconds",
+			Help: "How long the last probe of the login URL of a connector took.",
+		}, []string{"connector"}),
+	}
+}
+
+func (p *loginProbes) register(registry *prometheus.Registry) error {
+	if err := registry.Register(p.up); err != nil {
+		return err
+	}
+	return registry.Register(p.duration)
+}
+
+// start probes the connectors right away, then at every interval.
+func (p *loginProbes) start(ctx context.Context, interval time.Duration) {
+	go func() {
+		for {
+			p.probe(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
+			}
+		}
+	}()
+}
+
+// probe fetches the login URL of every connector implementing
+// connector.CallbackConnector. Errors and server errors from the upstream
+// provider fail the probe, while other responses, such as redirects to a
+// login page, show it's reachable.
+func (p *loginProbes) probe(ctx context.Context) {
+	connectors, err := p.s.storage.ListConnectors()
+	if err != nil {
+		p.s.logger.Errorf("login probe: failed to list connectors: %v", err)
+		return
+	}
+
+	results := make(map[string]loginProbeResult)
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	for _, c := range connectors {
+		conn, err := p.s.getConnector(c.ID)
+		if err != nil {
+			continue
+		}
+		callbackConn, ok := conn.Connector.(connector.CallbackConnector)
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			start := time.Now()
+			err := p.fetch(ctx, callbackConn)
+			result := loginProbeResult{err: err, latency: time.Since(start)}
+			mu.Lock()
+			results[id] = result
+			mu.Unlock()
+		}(c.ID)
+	}
+	wg.Wait()
+
+	for id, result := range results {
+		up := 1.0
+		if result.err != nil {
+			up = 0
+			p.s.logger.Errorf("connector %q login probe failed: %v", id, result.err)
+		}
+		p.up.WithLabelValues(id).Set(up)
+		p.duration.WithLabelValues(id).Set(result.latency.Seconds())
+	}
+
+	p.mu.Lock()
+	p.results = results
+	p.mu.Unlock()
+}
+
+func (p *loginProbes) fetch(ctx context.Context, conn connector.CallbackConnector) error {
+	loginURL, err := conn.LoginURL(connector.Scopes{}, p.s.absURL("/callback"), "login-probe")
+	if err != nil {
+		return fmt.Errorf("get login URL: %v", err)
+	}
+	req, err := http.NewRequest("GET", loginURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("login URL returned %s", resp.Status)
+	}
+	return nil
+}
+
+// last returns the results of the last probe.
+func (p *loginProbes) last() map[string]loginProbeResult {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.results
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dexidp/dex/connector"
+	"github.com/dexidp/dex/storage"
+)
+
+type loginURLConnector struct {
+	connector.CallbackConnector
+	loginURL string
+}
+
+func (c *loginURLConnector) LoginURL(s connector.Scopes, callbackURL, state string) (string, error) {
+	return c.loginURL, nil
+}
+
+func TestLoginProbes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, server := newTestServer(ctx, t, nil)
+	defer httpServer.Close()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/broken" {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte("login page"))
+	}))
+	defer upstream.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	loginURLs := map[string]string{
+		"up":      upstream.URL + "/authorize",
+		"broken":  upstream.URL + "/broken",
+		"offline": down.URL + "/authorize",
+	}
+	for id, loginURL := range loginURLs {
+		if err := server.storage.CreateConnector(storage.Connector{ID: id, Type: "mockCallback", Name: id, ResourceVersion: "1"}); err != nil {
+			t.Fatalf("create connector: %v", err)
+		}
+		server.mu.Lock()
+		server.connectors[id] = Connector{ResourceVersion: "1", Connector: &loginURLConnector{loginURL: loginURL}}
+		server.mu.Unlock()
+	}
+
+	server.loginProbes = newLoginProbes(server, time.Second)
+	server.loginProbes.probe(ctx)
+
+	rr := httptest.NewRecorder()
+	server.ServeHTTP(rr, httptest.NewRequest("GET", "/healthz/connectors", nil))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected failing login probes to fail the health check, got %d", rr.Code)
+	}
+	var resp struct {
+		LoginProbes map[string]loginProbeStatus `json:"loginProbes"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("unmarshal health: %v", err)
+	}
+	want := map[string]string{"up": "ok", "broken": "failed", "offline": "failed"}
+	for id, status := range want {
+		if got := resp.LoginProbes[id].Status; got != status {
+			t.Errorf("expected login probe of %q to be %q, got %q", id, status, got)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	jose "gopkg.in/square/go-jose.v2"
+
+	"github.com/dexidp/dex/server/internal"
+	"github.com/dexidp/dex/storage"
+)
+
+// Formats of the access tokens issued for a resource.
+const (
+	accessTokenFormatOpaque = "opaque"
+	accessTokenFormatJWT    = "jwt"
+)
+
+// Resource is a resource server clients may request access tokens for, by
+// passing its URI as the "resource" parameter of a token request.
+//
+// https://tools.ietf.org/html/rfc8707
+type Resource struct {
+	URI string `json:"uri"`
+
+	// The format of access tokens issued for the resource: "opaque", the
+	// default, or "jwt" for signed tokens the resource server can verify
+	// without calling dex.
+	AccessTokenFormat string `json:"accessTokenFormat"`
+}
+
+// newResources validates the configured resources, indexing them by URI.
+func newResources(resources []Resource) (map[string]Resource, error) {
+	byURI := make(map[string]Resource, len(resources))
+	for _, r := range resources {
+		u, err := url.Parse(r.URI)
+		if err != nil || !u.IsAbs() || u.Fragment != "" {
+			return nil, fmt.Errorf("resource %q must be an absolute URI without a fragment", r.URI)
+		}
+		switch r.AccessTokenFormat {
+		case "":
+			r.AccessTokenFormat = accessTokenFormatOpaque
+		case accessTokenFormatOpaque, accessTokenFormatJWT:
+		default:
+			return nil, fmt.Errorf("resource %q: unknown access token format %q", r.URI, r.AccessTokenFormat)
+		}
+		if _, ok := byURI[r.URI]; ok {
+			return nil, fmt.Errorf("resource %q configured twice", r.URI)
+		}
+		byURI[r.URI] = r
+	}
+	return byURI, nil
+}
+
+// requestedResource returns the resource a token request targets, or nil if it
+// doesn't name one. The request's form must already be parsed. Requesting
+// several resources isn't supported, since they may take access tokens of
+// different formats.
+func (s *Server) requestedResource(r *http.Request) (*Resource, error) {
+	values := r.PostForm["resource"]
+	switch len(values) {
+	case 0:
+		return nil, nil
+	case 1:
+	default:
+		return nil, errors.New("Only one resource may be requested.")
+	}
+	resource, ok := s.resources[values[0]]
+	if !ok {
+		return nil, fmt.Errorf("Unknown resource %q.", values[0])
+	}
+	return &resource, nil
+}
+
+// accessTokenClaims are the claims of JWT access tokens.
+//
+// https://tools.ietf.org/html/rfc9068
+type accessTokenClaims struct {
+	Issuer   string   `json:"iss"`
+	Subject  string   `json:"sub"`
+	Audience audience `json:"aud"`
+	Expiry   int64    `json:"exp"`
+	IssuedAt int64    `json:"iat"`
+	JWTID    string   `json:"jti"`
+	ClientID string   `json:"client_id"`
+	Scope    string   `json:"scope,omitempty"`
+}
+
+// newAccessToken returns an access token in the format of the resource it's
+// issued for. Without a resource, it's an opaque random value.
+func (s *Server) newAccessToken(resource *Resource, clientID string, claims storage.Claims, scopes []string, connID string) (string, error) {
+	if resource == nil || resource.AccessTokenFormat != accessTokenFormatJWT {
+		return s.secrets.Secret(), nil
+	}
+
+	keys, err := s.getKeys()
+	if err != nil {
+		return "", err
+	}
+	signingKey, err := s.signingKey(keys)
+	if err != nil {
+		return "", err
+	}
+	subject, err := internal.Marshal(&internal.IDTokenSubject{UserId: claims.UserID, ConnId: connID})
+	if err != nil {
+		return "", fmt.Errorf("marshal subject: %v", err)
+	}
+
+	issuedAt := s.now()
+	payload, err := json.Marshal(accessTokenClaims{
+		Issuer:   s.issuerURL.String(),
+		Subject:  subject,
+		Audience: audience{resource.URI},
+		// Access tokens are valid as long as the ID token issued with them.
+		Expiry:   issuedAt.Add(s.idTokensValidFor).Unix(),
+		IssuedAt: issuedAt.Unix(),
+		JWTID:    storage.NewID(),
+		ClientID: clientID,
+		Scope:    strings.Join(scopes, " "),
+	})
+	if err != nil {
+		return "", fmt.Errorf("marshal access token: %v", err)
+	}
+
+	// The type keeps the token from being mistaken for an ID token.
+	opts := (&jose.SignerOptions{}).WithType("at+jwt")
+	signer, err := jose.NewSigner(signingKey, opts)
+	if err != nil {
+		return "", fmt.Errorf("new signer: %v", err)
+	}
+	signature, err := signer.Sign(payload)
+	if err != nil {
+		if _, ok := err.(signerError); ok {
+			return "", err
+		}
+		return "", fmt.Errorf("signing payload: %v", err)
+	}
+	return signature.CompactSerialize()
+}
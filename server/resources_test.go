@@ -0,0 +1,113 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	jose "gopkg.in/square/go-jose.v2"
+
+	"github.com/dexidp/dex/storage"
+)
+
+func TestAccessTokenFormatByResource(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, server := newTestServer(ctx, t, func(c *Config) {
+		c.Resources = []Resource{
+			{URI: "https://a.example.com", AccessTokenFormat: "jwt"},
+			{URI: "https://b.example.com", AccessTokenFormat: "opaque"},
+			{URI: "https://internal.example.com", AccessTokenFormat: "jwt"},
+		}
+	})
+	defer httpServer.Close()
+
+	client := storage.Client{
+		ID:               "client",
+		Secret:           "secret",
+		RedirectURIs:     []string{"https://app.example.com/callback"},
+		AllowedAudiences: []string{"https://a.example.com", "https://b.example.com"},
+	}
+	if err := server.storage.CreateClient(client); err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		resources []string
+		wantCode  int
+		wantJWT   bool
+	}{
+		{"jwt resource", []string{"https://a.example.com"}, http.StatusOK, true},
+		{"opaque resource", []string{"https://b.example.com"}, http.StatusOK, false},
+		{"no resource", nil, http.StatusOK, false},
+		{"unknown resource", []string{"https://c.example.com"}, http.StatusBadRequest, false},
+		{"resource not allowed", []string{"https://internal.example.com"}, http.StatusBadRequest, false},
+		{"several resources", []string{"https://a.example.com", "https://b.example.com"}, http.StatusBadRequest, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			form := url.Values{
+				"grant_type":   {grantTypeAuthorizationCode},
+				"code":         {newTestAuthCode(t, server, client)},
+				"redirect_uri": {client.RedirectURIs[0]},
+				"resource":     tc.resources,
+			}
+			r := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r.SetBasicAuth(client.ID, client.Secret)
+			rr := httptest.NewRecorder()
+			server.ServeHTTP(rr, r)
+			if rr.Code != tc.wantCode {
+				t.Fatalf("expected %d, got %d: %s", tc.wantCode, rr.Code, rr.Body)
+			}
+
+			var resp struct {
+				AccessToken string `json:"access_token"`
+				Error       string `json:"error"`
+			}
+			if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("unmarshal token response: %v", err)
+			}
+			if tc.wantCode != http.StatusOK {
+				if resp.Error != errInvalidTarget {
+					t.Errorf("expected error %q, got %q", errInvalidTarget, resp.Error)
+				}
+				return
+			}
+
+			jws, err := jose.ParseSigned(resp.AccessToken)
+			if !tc.wantJWT {
+				if err == nil {
+					t.Errorf("expected an opaque access token, got a JWT")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected a JWT access token: %v", err)
+			}
+			if typ := jws.Signatures[0].Protected.ExtraHeaders[jose.HeaderType]; typ != "at+jwt" {
+				t.Errorf("expected type at+jwt, got %v", typ)
+			}
+			payload, err := server.verifySignature(resp.AccessToken)
+			if err != nil {
+				t.Fatalf("verify access token: %v", err)
+			}
+			var claims accessTokenClaims
+			if err := json.Unmarshal(payload, &claims); err != nil {
+				t.Fatalf("unmarshal access token: %v", err)
+			}
+			if _, err := server.verifyIDToken(resp.AccessToken); err == nil {
+				t.Errorf("expected access token not to be accepted as an id token")
+			}
+			if len(claims.Audience) != 1 || claims.Audience[0] != tc.resources[0] {
+				t.Errorf("expected audience %q, got %q", tc.resources[0], claims.Audience)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/dexidp/dex/storage"
+)
+
+// tokenRevoked reports whether the token with a "jti" claim was revoked.
+func (s *Server) tokenRevoked(jti string) (bool, error) {
+	if jti == "" {
+		return false, nil
+	}
+	switch _, err := s.storage.GetRevokedToken(jti); err {
+	case nil:
+		return true, nil
+	case storage.ErrNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("get revoked token: %v", err)
+	}
+}
+
+// issuedJTI returns the "jti" claim of a token the server just signed, so
+// its signature isn't checked.
+func issuedJTI(token string) string {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ""
+	}
+	var claims struct {
+		JWTID string `json:"jti"`
+	}
+	json.Unmarshal(payload, &claims)
+	return claims.JWTID
+}
+
+// handleAdminRevokeToken revokes a token signed by the server, such as an ID
+// token or a JWT access token, by its "jti" claim. Tokens don't outlive the ID
+// token lifetime, so the revocation is kept that long. Revoking the latest ID
+// token issued with a refresh token revokes the refresh token as well.
+func (s *Server) handleAdminRevokeToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		s.tokenErrHelper(w, errInvalidRequest, "Unsupported request method.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		JWTID string `json:"jti"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.JWTID == "" {
+		s.tokenErrHelper(w, errInvalidRequest, `Request body must be of the form {"jti": "..."}.`, http.StatusBadRequest)
+		return
+	}
+
+	revoked := storage.RevokedToken{ID: req.JWTID, Expiry: s.now().Add(s.idTokensValidFor)}
+	if err := s.storage.CreateRevokedToken(revoked); err != nil && err != storage.ErrAlreadyExists {
+		s.logger.Errorf("failed to revoke token: %v", err)
+		s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+	// The revocation is garbage collected before refresh tokens expire, so
+	// they're deleted right away rather than when they're next used.
+	if err := s.revokeRefreshTokens(req.JWTID); err != nil {
+		s.logger.Errorf("failed to revoke refresh tokens: %v", err)
+		s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+	s.logger.Infof("admin: revoked token %q", req.JWTID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// revokeRefreshTokens deletes the refresh tokens the ID token with a "jti"
+// claim was last issued with.
+func (s *Server) revokeRefreshTokens(jti string) error {
+	refreshTokens, err := s.storage.ListRefreshTokens()
+	if err != nil {
+		return fmt.Errorf("list refresh tokens: %v", err)
+	}
+	for _, refresh := range refreshTokens {
+		if refresh.IDTokenJTI != jti {
+			continue
+		}
+		if err := s.deleteRefreshToken(refresh); err != nil {
+			return err
+		}
+		s.logger.Infof("admin: revoked refresh token %s with its ID token", refresh.ID)
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dexidp/dex/storage"
+)
+
+func TestRevokeToken(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	now := time.Now()
+	httpServer, server := newTestServer(ctx, t, func(c *Config) {
+		c.Now = func() time.Time { return now }
+		c.AdminAPIKey = "admin-key"
+		c.IdentitiesClients = []string{"client"}
+	})
+	defer httpServer.Close()
+
+	user := storage.User{ID: storage.NewID(), RemoteIdentities: []storage.RemoteIdentity{{ConnectorID: "mock", ConnectorUserID: "1"}}}
+	if err := server.storage.CreateUser(user); err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	idToken, _, err := server.newIDToken("client", storage.Claims{UserID: "1"}, []string{scopeOpenID}, nil, "", "", "mock")
+	if err != nil {
+		t.Fatalf("new id token: %v", err)
+	}
+	claims, err := server.verifyIDToken(idToken)
+	if err != nil {
+		t.Fatalf("verify id token: %v", err)
+	}
+
+	identities := func() int {
+		req := httptest.NewRequest("GET", "/identities", nil)
+		req.Header.Set("Authorization", "Bearer "+idToken)
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, req)
+		return rr.Code
+	}
+	revoke := func(body string) int {
+		req := httptest.NewRequest("POST", "/admin/tokens/revoked", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer admin-key")
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if code := identities(); code != http.StatusOK {
+		t.Fatalf("expected the token to be accepted, got %d", code)
+	}
+	if code := revoke(`{}`); code != http.StatusBadRequest {
+		t.Errorf("expected a request without a jti to fail, got %d", code)
+	}
+	for i := 0; i < 2; i++ {
+		if code := revoke(`{"jti": "` + claims.JWTID + `"}`); code != http.StatusNoContent {
+			t.Fatalf("revoke token: expected 204, got %d", code)
+		}
+	}
+	if _, err := server.verifyIDToken(idToken); err == nil {
+		t.Errorf("expected a revoked token to fail verification")
+	}
+	if code := identities(); code != http.StatusUnauthorized {
+		t.Errorf("expected a revoked token to be rejected, got %d", code)
+	}
+
+	// The revocation is dropped once the token can't be valid anymore.
+	if _, err := server.storage.GarbageCollect(now.Add(25 * time.Hour)); err != nil {
+		t.Fatalf("garbage collect: %v", err)
+	}
+	if _, err := server.storage.GetRevokedToken(claims.JWTID); err != storage.ErrNotFound {
+		t.Errorf("expected the revoked token to be garbage collected, got %v", err)
+	}
+}
+
+func TestRevokeRefreshToken(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, server := newTestServer(ctx, t, func(c *Config) {
+		c.AdminAPIKey = "admin-key"
+	})
+	defer httpServer.Close()
+
+	client := storage.Client{ID: "client", Secret: "secret", RedirectURIs: []string{"https://example.com/callback"}}
+	if err := server.storage.CreateClient(client); err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	type tokenResponse struct {
+		IDToken      string `json:"id_token"`
+		RefreshToken string `json:"refresh_token"`
+		Error        string `json:"error"`
+	}
+	login := func() tokenResponse {
+		code := storage.AuthCode{
+			ID:          storage.NewID(),
+			ClientID:    client.ID,
+			RedirectURI: client.RedirectURIs[0],
+			Scopes:      []string{scopeOpenID, scopeOfflineAccess},
+			ConnectorID: "mock",
+			Claims:      storage.Claims{UserID: "1"},
+			Expiry:      server.now().Add(time.Hour),
+		}
+		if err := server.storage.CreateAuthCode(code); err != nil {
+			t.Fatalf("create auth code: %v", err)
+		}
+		var resp tokenResponse
+		if err := json.Unmarshal(exchangeTestAuthCode(server, client, code.ID).Body.Bytes(), &resp); err != nil {
+			t.Fatalf("unmarshal token response: %v", err)
+		}
+		return resp
+	}
+	refresh := func(token string) tokenResponse {
+		form := url.Values{"grant_type": {grantTypeRefreshToken}, "refresh_token": {token}}
+		req := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(client.ID, client.Secret)
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, req)
+		var resp tokenResponse
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		return resp
+	}
+	revoke := func(idToken string) {
+		body := `{"jti": "` + issuedJTI(idToken) + `"}`
+		req := httptest.NewRequest("POST", "/admin/tokens/revoked", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer admin-key")
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, req)
+		if rr.Code != http.StatusNoContent {
+			t.Fatalf("revoke token: expected 204, got %d", rr.Code)
+		}
+	}
+
+	// Revoking an ID token replaced by a refresh doesn't affect the refresh
+	// token, revoking the latest one does.
+	tokens := login()
+	refreshed := refresh(tokens.RefreshToken)
+	if refreshed.Error != "" {
+		t.Fatalf("refresh: %s", refreshed.Error)
+	}
+	revoke(tokens.IDToken)
+	if refreshed = refresh(refreshed.RefreshToken); refreshed.Error != "" {
+		t.Fatalf("expected revoking a replaced ID token to keep the refresh token, got %s", refreshed.Error)
+	}
+	revoke(refreshed.IDToken)
+	if resp := refresh(refreshed.RefreshToken); resp.Error == "" {
+		t.Errorf("expected a refresh token revoked with its ID token to be rejected")
+	}
+	refreshTokens, err := server.storage.ListRefreshTokens()
+	if err != nil {
+		t.Fatalf("list refresh tokens: %v", err)
+	}
+	if len(refreshTokens) != 0 {
+		t.Errorf("expected the revoked refresh token to be deleted, got %d refresh tokens", len(refreshTokens))
+	}
+
+	// A refresh token is also refused if its ID token was revoked without it,
+	// such as by another instance while the refresh token was being used.
+	tokens = login()
+	revoked := storage.RevokedToken{ID: issuedJTI(tokens.IDToken), Expiry: server.now().Add(time.Hour)}
+	if err := server.storage.CreateRevokedToken(revoked); err != nil {
+		t.Fatalf("create revoked token: %v", err)
+	}
+	if resp := refresh(tokens.RefreshToken); resp.Error != errInvalidGrant {
+		t.Errorf("expected a refresh token with a revoked ID token to be rejected with %q, got %q", errInvalidGrant, resp.Error)
+	}
+}
@@ -2,6 +2,9 @@ package server
 
 import (
 	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"encoding/hex"
@@ -28,9 +31,10 @@ type rotationStrategy struct {
 	// signatues?
 	idTokenValidFor time.Duration
 
-	// Keys are always RSA keys. Though cryptopasta recommends ECDSA keys, not every
-	// client may support these (e.g. github.com/coreos/go-oidc/oidc).
-	key func() (*rsa.PrivateKey, error)
+	// Keys are RSA keys unless another algorithm is configured. Though cryptopasta
+	// recommends ECDSA keys, not every client may support these (e.g.
+	// github.com/coreos/go-oidc/oidc).
+	key func() (crypto.Signer, error)
 }
 
 // staticRotationStrategy returns a strategy which never rotates keys.
@@ -39,7 +43,7 @@ func staticRotationStrategy(key *rsa.PrivateKey) rotationStrategy {
 		// Setting these values to 100 years is easier than having a flag indicating no rotation.
 		rotationFrequency: time.Hour * 8760 * 100,
 		idTokenValidFor:   time.Hour * 8760 * 100,
-		key:               func() (*rsa.PrivateKey, error) { return key, nil },
+		key:               func() (crypto.Signer, error) { return key, nil },
 	}
 }
 
@@ -49,12 +53,34 @@ func defaultRotationStrategy(rotationFrequency, idTokenValidFor time.Duration) r
 	return rotationStrategy{
 		rotationFrequency: rotationFrequency,
 		idTokenValidFor:   idTokenValidFor,
-		key: func() (*rsa.PrivateKey, error) {
+		key: func() (crypto.Signer, error) {
 			return rsa.GenerateKey(rand.Reader, 2048)
 		},
 	}
 }
 
+// keyGenerator returns a function generating signing keys for an algorithm.
+func keyGenerator(alg jose.SignatureAlgorithm) (func() (crypto.Signer, error), error) {
+	var curve elliptic.Curve
+	switch alg {
+	case jose.RS256:
+		return func() (crypto.Signer, error) {
+			return rsa.GenerateKey(rand.Reader, 2048)
+		}, nil
+	case jose.ES256:
+		curve = elliptic.P256()
+	case jose.ES384:
+		curve = elliptic.P384()
+	case jose.ES512:
+		curve = elliptic.P521()
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm %q", alg)
+	}
+	return func() (crypto.Signer, error) {
+		return ecdsa.GenerateKey(curve, rand.Reader)
+	}, nil
+}
+
 type keyRotater struct {
 	storage.Storage
 
@@ -116,15 +142,19 @@ func (k keyRotater) rotate() error {
 	}
 	keyID := hex.EncodeToString(b)
 	priv := &jose.JSONWebKey{
-		Key:       key,
-		KeyID:     keyID,
-		Algorithm: "RS256",
-		Use:       "sig",
+		Key:   key,
+		KeyID: keyID,
+		Use:   "sig",
+	}
+	alg, err := signatureAlgorithm(priv)
+	if err != nil {
+		return fmt.Errorf("generate key: %v", err)
 	}
+	priv.Algorithm = string(alg)
 	pub := &jose.JSONWebKey{
 		Key:       key.Public(),
 		KeyID:     keyID,
-		Algorithm: "RS256",
+		Algorithm: string(alg),
 		Use:       "sig",
 	}
 
@@ -1,12 +1,14 @@
 package server
 
 import (
+	"encoding/json"
 	"os"
 	"sort"
 	"testing"
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"gopkg.in/square/go-jose.v2"
 
 	"github.com/dexidp/dex/storage"
 	"github.com/dexidp/dex/storage/memory"
@@ -100,3 +102,88 @@ func TestKeyRotater(t *testing.T) {
 		}
 	}
 }
+
+func TestKeyRotaterAlgorithmChange(t *testing.T) {
+	now := time.Now()
+	rotationFrequency := time.Hour
+
+	l := &logrus.Logger{
+		Out:       os.Stderr,
+		Formatter: &logrus.TextFormatter{DisableColors: true},
+		Level:     logrus.DebugLevel,
+	}
+	r := &keyRotater{
+		Storage:  memory.New(l),
+		strategy: defaultRotationStrategy(rotationFrequency, 24*time.Hour),
+		now:      func() time.Time { return now },
+		logger:   l,
+	}
+	if err := r.rotate(); err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := keyGenerator(jose.ES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.strategy.key = key
+	now = now.Add(rotationFrequency + time.Second)
+	if err := r.rotate(); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := r.GetKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys.SigningKey.Algorithm != string(jose.ES256) {
+		t.Errorf("expected an %s signing key, got %q", jose.ES256, keys.SigningKey.Algorithm)
+	}
+
+	// Both key types must be served together while tokens signed with the
+	// RSA key are still valid.
+	data, err := json.Marshal(publicKeySet(keys))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var jwks struct {
+		Keys []map[string]string `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &jwks); err != nil {
+		t.Fatalf("unmarshal key set: %v", err)
+	}
+	if len(jwks.Keys) != 2 {
+		t.Fatalf("expected 2 keys, got %s", data)
+	}
+	want := []struct {
+		kty, alg string
+		params   []string
+	}{
+		{"EC", "ES256", []string{"crv", "x", "y"}},
+		{"RSA", "RS256", []string{"n", "e"}},
+	}
+	for i, w := range want {
+		k := jwks.Keys[i]
+		if k["kty"] != w.kty || k["alg"] != w.alg {
+			t.Errorf("key %d: expected kty %q and alg %q, got %v", i, w.kty, w.alg, k)
+		}
+		for _, param := range w.params {
+			if k[param] == "" {
+				t.Errorf("key %d: expected %s key to have %q", i, w.kty, param)
+			}
+		}
+		if k["d"] != "" {
+			t.Errorf("key %d: private key served", i)
+		}
+	}
+
+	var set jose.JSONWebKeySet
+	if err := json.Unmarshal(data, &set); err != nil {
+		t.Fatalf("parse key set: %v", err)
+	}
+	for _, k := range set.Keys {
+		if !k.Valid() || !k.IsPublic() {
+			t.Errorf("expected key %q to be a valid public key", k.KeyID)
+		}
+	}
+}
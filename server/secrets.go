@@ -0,0 +1,128 @@
+package server
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base32"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+// defaultSecretBytes is the entropy of generated secrets if not configured.
+const defaultSecretBytes = 32
+
+// SecretGenerator creates the random values the server hands out as
+// credentials: client secrets, authorization codes, access tokens and refresh
+// tokens.
+//
+// Values must be URL safe since they're passed in query strings and forms. As
+// authorization codes are stored by their value, they must also be valid
+// storage IDs, which rules out upper case letters for the kubernetes storage.
+type SecretGenerator interface {
+	Secret() string
+}
+
+// NewSecretGenerator returns a SecretGenerator which reads size bytes from
+// crypto/rand for each secret.
+func NewSecretGenerator(size int) SecretGenerator {
+	return randomSecrets{size}
+}
+
+// secretEncoding is the alphabet of storage.NewID, which is URL safe and only
+// holds characters kubernetes allows in object names.
+var secretEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+type randomSecrets struct {
+	size int
+}
+
+func (r randomSecrets) Secret() string {
+	b := make([]byte, r.size)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		panic(err)
+	}
+	return secretEncoding.EncodeToString(b)
+}
+
+// SecretPolicy rejects weak client secrets chosen by administrators. Generated
+// secrets are strong by construction, so they aren't checked. The zero value
+// accepts any secret.
+type SecretPolicy struct {
+	// Minimum number of characters of a secret.
+	MinLength int
+
+	// Minimum entropy of a secret in bits, estimated from how often each of
+	// its characters occurs. It catches secrets such as "aaaaaaaaaaaaaaaa"
+	// which are long enough but repetitive.
+	MinEntropyBits int
+
+	// Secrets which are always rejected, such as ones from breach corpora.
+	Denylist map[string]bool
+}
+
+// LoadSecretDenylist reads a file of secrets, one per line. Empty lines are
+// ignored.
+func LoadSecretDenylist(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	denylist := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimRight(scanner.Text(), "\r"); line != "" {
+			denylist[line] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read %s: %v", path, err)
+	}
+	return denylist, nil
+}
+
+// WeakSecretError is returned for a secret the SecretPolicy rejects.
+type WeakSecretError struct {
+	// Why the secret was rejected, suitable for showing to the administrator.
+	Reason string
+}
+
+func (e *WeakSecretError) Error() string {
+	return "weak client secret: " + e.Reason
+}
+
+// Check returns a *WeakSecretError if the secret doesn't meet the policy.
+func (p SecretPolicy) Check(secret string) error {
+	if p.Denylist[secret] {
+		return &WeakSecretError{Reason: "the secret is on the list of compromised secrets"}
+	}
+	if n := utf8.RuneCountInString(secret); n < p.MinLength {
+		return &WeakSecretError{Reason: fmt.Sprintf("the secret must be at least %d characters long", p.MinLength)}
+	}
+	if bits := secretEntropy(secret); bits < float64(p.MinEntropyBits) {
+		return &WeakSecretError{Reason: fmt.Sprintf("the secret is too predictable: %.0f bits of entropy, at least %d required", bits, p.MinEntropyBits)}
+	}
+	return nil
+}
+
+// secretEntropy estimates the entropy of a secret as its length times the
+// Shannon entropy of its characters.
+func secretEntropy(secret string) float64 {
+	counts := make(map[rune]int)
+	n := 0
+	for _, r := range secret {
+		counts[r]++
+		n++
+	}
+	var perChar float64
+	for _, c := range counts {
+		p := float64(c) / float64(n)
+		perChar -= p * math.Log2(p)
+	}
+	return perChar * float64(n)
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/dexidp/dex/storage"
+)
+
+func TestSecretGenerator(t *testing.T) {
+	for _, size := range []int{16, 32, 48} {
+		secrets := NewSecretGenerator(size)
+		seen := make(map[string]bool)
+		for i := 0; i < 100; i++ {
+			secret := secrets.Secret()
+			b, err := secretEncoding.DecodeString(secret)
+			if err != nil {
+				t.Fatalf("size %d: decode secret %q: %v", size, secret, err)
+			}
+			if len(b) != size {
+				t.Errorf("size %d: expected %d random bytes, got %d", size, size, len(b))
+			}
+			if url.QueryEscape(secret) != secret || url.PathEscape(secret) != secret {
+				t.Errorf("size %d: secret %q isn't URL safe", size, secret)
+			}
+			if seen[secret] {
+				t.Errorf("size %d: secret %q generated twice", size, secret)
+			}
+			seen[secret] = true
+		}
+	}
+}
+
+// sequentialSecrets is a deterministic SecretGenerator.
+type sequentialSecrets struct {
+	n int
+}
+
+func (s *sequentialSecrets) Secret() string {
+	s.n++
+	return fmt.Sprintf("secret-%d", s.n)
+}
+
+func TestInjectedSecretGenerator(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, server := newTestServer(ctx, t, func(c *Config) {
+		c.AdminAPIKey = "admin-key"
+		c.SecretGenerator = &sequentialSecrets{}
+	})
+	defer httpServer.Close()
+
+	client := storage.Client{ID: "client", Secret: "old-secret", RedirectURIs: []string{"https://example.com/callback"}}
+	if err := server.storage.CreateClient(client); err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	req := httptest.NewRequest("POST", "/admin/clients/client/secret", nil)
+	req.Header.Set("Authorization", "Bearer admin-key")
+	rr := httptest.NewRecorder()
+	server.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 rotating secret, got %d: %s", rr.Code, rr.Body)
+	}
+	var resp struct {
+		Secret string `json:"secret"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("unmarshal response: %v", err)
+	}
+	if resp.Secret != "secret-1" {
+		t.Errorf("expected the generated secret %q, got %q", "secret-1", resp.Secret)
+	}
+
+	// Sending the code also generates an access token for the implicit flow.
+	code := newTestAuthCode(t, server, client)
+	if code != "secret-3" {
+		t.Errorf("expected the generated code %q, got %q", "secret-3", code)
+	}
+	client.Secret = resp.Secret
+	rr = exchangeTestAuthCode(server, client, code)
+	var tokens struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &tokens); err != nil {
+		t.Fatalf("unmarshal token response: %v", err)
+	}
+	if tokens.AccessToken != "secret-4" {
+		t.Errorf("expected the generated access token %q, got %q", "secret-4", tokens.AccessToken)
+	}
+}
+
+func TestSecretPolicy(t *testing.T) {
+	f, err := ioutil.TempFile("", "denylist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	fmt.Fprint(f, "correcthorsebatterystaple\r\n\nTr0ub4dor&3Tr0ub4dor&3\n")
+	f.Close()
+
+	denylist, err := LoadSecretDenylist(f.Name())
+	if err != nil {
+		t.Fatalf("load denylist: %v", err)
+	}
+	policy := SecretPolicy{MinLength: 16, MinEntropyBits: 64, Denylist: denylist}
+
+	tests := []struct {
+		secret string
+		weak   bool
+	}{
+		{"short", true},
+		{"aaaaaaaaaaaaaaaaaaaaaaaa", true},
+		{"abababababababababababab", true},
+		{"correcthorsebatterystaple", true},
+		{"Tr0ub4dor&3Tr0ub4dor&3", true},
+		{"qy7T2pX9vLm4Rk8WzN3bHc6J", false},
+		{NewSecretGenerator(16).Secret(), false},
+	}
+	for _, tc := range tests {
+		err := policy.Check(tc.secret)
+		if _, ok := err.(*WeakSecretError); ok != tc.weak || (err != nil && !ok) {
+			t.Errorf("%q: expected weak=%t, got error %v", tc.secret, tc.weak, err)
+		}
+	}
+
+	if err := (SecretPolicy{}).Check("secret"); err != nil {
+		t.Errorf("expected the zero policy to accept any secret, got %v", err)
+	}
+}
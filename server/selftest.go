@@ -0,0 +1,101 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	jose "gopkg.in/square/go-jose.v2"
+
+	"github.com/dexidp/dex/connector"
+	"github.com/dexidp/dex/storage"
+)
+
+// selfTestClientID is used for the auth request and ID token created by the
+// self-test. It doesn't need to be a registered client.
+const selfTestClientID = "dex-self-test"
+
+// selfTest walks through the server side of a login before any traffic is
+// served: it round trips an auth request through the storage, issues an ID
+// token and verifies it against the published keys, and checks the health of
+// every connector which supports it.
+func (s *Server) selfTest(ctx context.Context) error {
+	authReq := storage.AuthRequest{
+		ID:       storage.NewID(),
+		ClientID: selfTestClientID,
+		Scopes:   []string{scopeOpenID},
+		Expiry:   s.now().Add(time.Minute),
+	}
+	if err := s.storage.CreateAuthRequest(authReq); err != nil {
+		return fmt.Errorf("create auth request: %v", err)
+	}
+	if _, err := s.storage.GetAuthRequest(authReq.ID); err != nil {
+		return fmt.Errorf("get auth request: %v", err)
+	}
+	if err := s.storage.DeleteAuthRequest(authReq.ID); err != nil {
+		return fmt.Errorf("delete auth request: %v", err)
+	}
+
+	claims := storage.Claims{UserID: "self-test"}
+	idToken, _, err := s.newIDToken(selfTestClientID, claims, authReq.Scopes, nil, "", "", "self-test")
+	if err != nil {
+		return fmt.Errorf("issue id token: %v", err)
+	}
+	if err := s.verifyWithPublishedKeys(idToken); err != nil {
+		return fmt.Errorf("verify id token: %v", err)
+	}
+
+	connectors, err := s.storage.ListConnectors()
+	if err != nil {
+		return fmt.Errorf("list connectors: %v", err)
+	}
+	for _, c := range connectors {
+		conn, err := s.getConnector(c.ID)
+		if err != nil {
+			return fmt.Errorf("open connector %q: %v", c.ID, err)
+		}
+		checker, ok := conn.Connector.(connector.HealthChecker)
+		if !ok {
+			continue
+		}
+		if err := checker.Healthy(ctx); err != nil {
+			return fmt.Errorf("connector %q unhealthy: %v", c.ID, err)
+		}
+	}
+	return nil
+}
+
+// verifyWithPublishedKeys checks a token the same way a client would, by looking
+// up the key ID of the signature in the set served by the keys endpoint.
+func (s *Server) verifyWithPublishedKeys(token string) error {
+	jws, err := jose.ParseSigned(token)
+	if err != nil {
+		return fmt.Errorf("parse: %v", err)
+	}
+	if len(jws.Signatures) != 1 {
+		return errors.New("expected exactly one signature")
+	}
+
+	keys, err := s.getKeys()
+	if err != nil {
+		return fmt.Errorf("get keys: %v", err)
+	}
+	if keys.SigningKeyPub == nil {
+		return errors.New("no public keys published")
+	}
+	if s.now().After(keys.NextRotation) {
+		return fmt.Errorf("signing key expired at %s and was not rotated", keys.NextRotation)
+	}
+	jwks := publicKeySet(keys)
+
+	kid := jws.Signatures[0].Header.KeyID
+	published := jwks.Key(kid)
+	if len(published) == 0 {
+		return fmt.Errorf("key ID %q is not in the published key set", kid)
+	}
+	if _, err := jws.Verify(&published[0]); err != nil {
+		return fmt.Errorf("signature does not match published key %q: %v", kid, err)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/dexidp/dex/storage"
+	"github.com/dexidp/dex/storage/memory"
+)
+
+// mismatchedKeyIDStorage publishes a public key whose key ID doesn't match the
+// key tokens are signed with.
+type mismatchedKeyIDStorage struct {
+	storage.Storage
+}
+
+func (m mismatchedKeyIDStorage) GetKeys() (storage.Keys, error) {
+	keys, err := m.Storage.GetKeys()
+	if err != nil || keys.SigningKeyPub == nil {
+		return keys, err
+	}
+	pub := *keys.SigningKeyPub
+	pub.KeyID = "not-" + pub.KeyID
+	keys.SigningKeyPub = &pub
+	return keys, nil
+}
+
+func TestSelfTest(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, _ := newTestServer(ctx, t, func(c *Config) {
+		c.SelfTest = true
+	})
+	httpServer.Close()
+}
+
+func TestSelfTestBrokenKeys(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	newConfig := func(warnOnly bool) Config {
+		s := memory.New(logger)
+		if err := s.CreateConnector(storage.Connector{ID: "mock", Type: "mockCallback", Name: "Mock"}); err != nil {
+			t.Fatalf("create connector: %v", err)
+		}
+		return Config{
+			Issuer:             "https://dex.example.com",
+			Storage:            mismatchedKeyIDStorage{s},
+			Web:                WebConfig{Dir: "../web"},
+			Logger:             logger,
+			PrometheusRegistry: prometheus.NewRegistry(),
+			SelfTest:           true,
+			SelfTestWarnOnly:   warnOnly,
+		}
+	}
+
+	if _, err := newServer(ctx, newConfig(false), staticRotationStrategy(testKey)); err == nil {
+		t.Error("expected self-test to fail startup when the key ID isn't published")
+	}
+	if _, err := newServer(ctx, newConfig(true), staticRotationStrategy(testKey)); err != nil {
+		t.Errorf("expected server to start when self-test failures are only warnings: %v", err)
+	}
+}
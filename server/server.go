@@ -12,22 +12,30 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"text/template"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/square/go-jose.v2"
 
 	"github.com/dexidp/dex/connector"
 	"github.com/dexidp/dex/connector/authproxy"
 	"github.com/dexidp/dex/connector/bitbucketcloud"
+	"github.com/dexidp/dex/connector/clientcert"
+	"github.com/dexidp/dex/connector/fallback"
 	"github.com/dexidp/dex/connector/github"
 	"github.com/dexidp/dex/connector/gitlab"
+	"github.com/dexidp/dex/connector/httpapi"
+	"github.com/dexidp/dex/connector/kerberos"
 	"github.com/dexidp/dex/connector/keystone"
 	"github.com/dexidp/dex/connector/ldap"
 	"github.com/dexidp/dex/connector/linkedin"
+	"github.com/dexidp/dex/connector/magiclink"
 	"github.com/dexidp/dex/connector/microsoft"
 	"github.com/dexidp/dex/connector/mock"
 	"github.com/dexidp/dex/connector/oidc"
 	"github.com/dexidp/dex/connector/saml"
+	"github.com/dexidp/dex/connector/webauthn"
 	"github.com/dexidp/dex/pkg/log"
 	"github.com/dexidp/dex/storage"
 	"github.com/felixge/httpsnoop"
@@ -44,6 +52,23 @@ const LocalConnector = "local"
 type Connector struct {
 	ResourceVersion string
 	Connector       connector.Connector
+
+	// Domains verified emails must belong to for users to login.
+	AllowedEmailDomains []string
+	// Clients allowed to use the connector. Empty allows all clients.
+	AllowedClients []string
+
+	// Replaces the issuer's branding on the pages of logins through the
+	// connector.
+	Branding storage.ConnectorBranding
+	// If set, only users which already exist can login through the
+	// connector, rather than being created on their first login.
+	RequireExistingUser bool
+	// Attributes identities returned by the connector must have.
+	RequiredAttributes []string
+
+	// Makes the connector's upstream requests with its configured headers.
+	httpClient *http.Client
 }
 
 // Config holds the server's configuration options.
@@ -59,21 +84,239 @@ type Config struct {
 	// flow. If no response types are supplied this value defaults to "code".
 	SupportedResponseTypes []string
 
+	// Combinations of response types, such as "code" or "code id_token", the
+	// server accepts. Each must be made up of SupportedResponseTypes. Defaults to
+	// every valid combination of them.
+	ResponseTypeCombinations []string
+
+	// If set, ID tokens issued for the "federated:id" scope also carry a claim
+	// of this name, such as "idp", holding the ID of the connector the user
+	// logged in with.
+	ConnectorIDClaim string
+
+	// If set, an authorization request parameter, such as "idp" or
+	// "kc_idp_hint", read like "connector_id" for clients built to select the
+	// identity provider of other servers.
+	ConnectorIDParameter string
+
+	// Claims released in ID tokens by each scope, mapped to the user attribute
+	// they hold: "user_id", "username", "email", "email_verified", "groups",
+	// "picture" or "updated_at". A scope listed here replaces the default
+	// claims of the "email", "groups" or "profile" scopes, and other scopes
+	// become valid for clients to request.
+	ScopeClaims map[string]map[string]string
+
+	// Attributes derived from the user's other attributes, which ScopeClaims
+	// can release, mapped to the text/template expression computing them. For
+	// example `{{ index (split .email "@") 0 }}`.
+	ClaimExpressions map[string]string
+
+	// JWKS URIs of peer dex instances serving the same issuer, such as the
+	// other half of a blue/green deployment. ID tokens they signed are accepted
+	// by the identities endpoint and token exchange, without sharing a storage.
+	PeerJWKSURIs []string
+
 	// List of allowed origins for CORS requests on discovery, token and keys endpoint.
 	// If none are indicated, CORS requests are disabled. Passing in "*" will allow any
 	// domain.
 	AllowedOrigins []string
 
+	// If enabled, public clients must use PKCE when requesting an authorization
+	// code. Clients can override this through their RequirePKCE setting.
+	RequirePKCE bool
+
+	// How the paths of redirect URIs are compared to the ones registered by
+	// clients. "strict", the default, requires them to match exactly, while
+	// "ignore" lets them differ by a trailing slash.
+	RedirectURITrailingSlash string
+
+	// Audience of ID tokens requested with cross-client scopes, unless a
+	// client sets its own: "client-first", the default, for the requesting
+	// client followed by the peers, or "peers-only" for just the peers. The
+	// requesting client is the authorized party either way.
+	CrossClientAudience string
+
+	// Maximum sizes of authorization requests and their parameters.
+	AuthRequestLimits AuthRequestLimits
+
+	// Maximum number of logins started but not completed yet.
+	PendingLoginLimits PendingLoginLimits
+
+	// Maximum size of ID tokens, and whether larger ones are trimmed or
+	// rejected.
+	IDTokenSizeLimit IDTokenSizeLimit
+
 	// If enabled, the server won't prompt the user to approve authorization requests.
 	// Logging in implies approval.
 	SkipApprovalScreen bool
 
+	// If enabled, ID tokens carry a "nbf" claim set to the time they were
+	// issued, less NotBeforeLeeway to accept clients whose clocks run behind
+	// the server's. The leeway must be shorter than IDTokensValidFor.
+	IDTokenNotBefore bool
+	NotBeforeLeeway  time.Duration
+
+	// Algorithm of the keys ID tokens are signed with: "RS256", "ES256",
+	// "ES384" or "ES512". Defaults to "RS256". A changed algorithm takes effect
+	// at the next key rotation, and keys of the previous algorithm keep
+	// verifying tokens they signed until they expire.
+	SigningAlgorithm string
+
 	RotateKeysAfter      time.Duration // Defaults to 6 hours.
 	IDTokensValidFor     time.Duration // Defaults to 24 hours
 	AuthRequestsValidFor time.Duration // Defaults to 24 hours
+	AuthCodesValidFor    time.Duration // Defaults to 30 minutes
+
+	// How long users have to complete a login once sent to a connector.
+	// Logins not completed in time are garbage collected. Zero leaves them
+	// the lifetime of the authorization request.
+	PendingLoginsValidFor time.Duration
+
+	// Refresh tokens expire RefreshTokensValidFor after the login they were
+	// issued for, or once they haven't been used for RefreshTokensIdleTimeout,
+	// whichever comes first. Using a refresh token restarts its idle timeout.
+	// Zero values disable either limit.
+	RefreshTokensValidFor    time.Duration
+	RefreshTokensIdleTimeout time.Duration
+
+	// A login session, the refresh tokens issued to all clients for one
+	// login, ends once none of them has been used for SessionIdleTimeout.
+	// Using any of them restarts it, so a session stays alive as long as one
+	// client is active, up to RefreshTokensValidFor. Zero disables it.
+	SessionIdleTimeout time.Duration
 
 	GCFrequency time.Duration // Defaults to 5 minutes
 
+	// How long connector health checks served by "/healthz/connectors" are
+	// reused for. Defaults to 10 seconds.
+	ConnectorHealthTTL time.Duration
+
+	// If set, the login URLs of connectors redirecting users to an upstream
+	// provider are fetched at this interval, and the results reported by
+	// "/healthz/connectors" and the metrics.
+	LoginProbeInterval time.Duration
+
+	// If set, responses to failed authentication attempts, such as a wrong
+	// client secret, password or two-factor code, are delayed by
+	// AuthFailureDelay plus a random duration of up to AuthFailureJitter.
+	AuthFailureDelay  time.Duration
+	AuthFailureJitter time.Duration
+
+	// If set, users created through connectors which can list their directory,
+	// such as LDAP, are checked against it at this interval. Users removed from
+	// the directory are logged, or with PruneDirectoryUsers disabled and their
+	// refresh tokens revoked.
+	DirectorySyncInterval time.Duration
+	PruneDirectoryUsers   bool
+
+	// Caching headers for the discovery, keys and token endpoints.
+	CachePolicies CachePolicies
+
+	// Headers such as Strict-Transport-Security set on every response.
+	SecurityHeaders SecurityHeaders
+
+	// If set, a webhook which can add claims to ID tokens or deny them.
+	TokenWebhook TokenWebhook
+
+	// Resource servers clients may request access tokens for, and the format
+	// of those tokens.
+	Resources []Resource
+
+	// If set, clients may exchange ID tokens issued to them for ID tokens
+	// addressed to clients which trust them, with the token exchange grant.
+	// Exchanged tokens can be exchanged again by their audience, up to this
+	// many delegations in total. Zero disables token exchange.
+	TokenExchangeMaxDepth int
+
+	// If set, clients may ask for the authorization response to be returned
+	// as a JWT signed by the server, with the response modes "jwt",
+	// "query.jwt" and "fragment.jwt".
+	JWTResponseModes bool
+
+	// What to do when a connector returns an identity without an email:
+	// "proceed" (the default) logs the user in without one, "reject" refuses
+	// the login, and "prompt" asks the user to enter an email, which is never
+	// considered verified.
+	MissingEmailPolicy string
+
+	// If set, users with a phone number may be asked for a code texted to it
+	// as their second factor.
+	SMS SMSConfig
+
+	// What to do when the issuer uses plaintext HTTP, usually because dex is
+	// deployed behind an edge which doesn't terminate TLS: "allow" (the
+	// default) serves the discovery document as usual, "warn" adds a warning
+	// field to it, and "reject" refuses to serve it.
+	HTTPIssuerPolicy string
+
+	// If set, the token endpoint also takes requests with a JSON object as
+	// their body, rather than form encoded parameters.
+	JSONTokenRequests bool
+
+	// If set, authorization requests with a response type the server or client
+	// doesn't support are rejected with an error page, rather than redirecting
+	// the unsupported_response_type error to the client.
+	DirectResponseTypeErrors bool
+
+	// HTTP status codes of OAuth2 error responses, by error code, replacing
+	// the defaults. Each must be a 4xx or 5xx status.
+	ErrorStatusCodes map[string]int
+
+	// If set, every ID token issued is logged with its "jti" claim, client,
+	// subject, connector, scopes and lifetime, but not the token itself.
+	LogTokenIssuance bool
+
+	// Generates client secrets, authorization codes, access tokens and refresh
+	// tokens. Defaults to 32 random bytes per secret.
+	SecretGenerator SecretGenerator
+
+	// Rejects weak client secrets set through the admin API.
+	SecretPolicy SecretPolicy
+
+	// If set, tokens are signed by an external KMS or HSM instead of keys
+	// generated and rotated by dex.
+	Signer Signer
+
+	// If enabled, the server runs an in-process check of the login flow on
+	// startup and fails to start if it doesn't pass. With SelfTestWarnOnly set
+	// a failure is logged instead.
+	SelfTest         bool
+	SelfTestWarnOnly bool
+
+	// If enabled, every client in the storage is validated on startup and
+	// problems, such as malformed redirect URIs, are logged. With
+	// ValidateClientsStrict set an invalid client stops the server from
+	// starting.
+	ValidateClients       bool
+	ValidateClientsStrict bool
+
+	// If set, client validation reports redirect URIs using plaintext HTTP,
+	// except loopback ones used by native apps.
+	RequireHTTPSRedirectURIs bool
+
+	// Bearer token granting access to the admin HTTP endpoints, which are
+	// disabled if no key is provided.
+	AdminAPIKey string
+
+	// IDs of the clients whose ID tokens users may present as bearer tokens to
+	// the /identities endpoint. ID tokens issued to other clients are refused.
+	IdentitiesClients []string
+
+	// bcrypt cost used to hash passwords of users created through the admin
+	// API. Defaults to 12.
+	PasswordHashCost int
+
+	// If set, the admin endpoints are only served by InternalHandler so they
+	// can be bound to an internal interface, away from the public endpoints.
+	InternalAdminAPI bool
+
+	// If set, the server starts in maintenance mode, refusing new logins. The
+	// mode can be toggled at runtime through the admin API.
+	MaintenanceMode bool
+	// How long token requests are still served after maintenance starts.
+	// Defaults to the lifetime of authorization codes.
+	MaintenanceDrainPeriod time.Duration
+
 	// If specified, the server will use this function for determining time.
 	Now func() time.Time
 
@@ -99,6 +342,17 @@ type WebConfig struct {
 	//
 	Dir string
 
+	// If set, a directory holding a complete theme, which is used instead of
+	// Dir. It may contain the following directories:
+	//
+	//   * static - Assets served at both "( issuer URL )/static" and
+	//     "( issuer URL )/theme".
+	//   * templates - HTML templates replacing the ones of the same name.
+	//
+	// Anything the theme doesn't provide falls back to the templates and assets
+	// compiled into dex.
+	ThemeDir string
+
 	// Defaults to "( issuer URL )/theme/logo.png"
 	LogoURL string
 
@@ -129,6 +383,10 @@ type Server struct {
 
 	mux http.Handler
 
+	// Handler for endpoints which shouldn't be reachable from the public
+	// listener. Always set, but empty unless Config.InternalAdminAPI is.
+	internalMux http.Handler
+
 	templates *templates
 
 	// If enabled, don't prompt user for approval after logging in through connector.
@@ -136,20 +394,128 @@ type Server struct {
 
 	supportedResponseTypes map[string]bool
 
+	// Canonical forms of the enabled response type combinations.
+	responseTypeCombinations map[string]bool
+
 	now func() time.Time
 
-	idTokensValidFor     time.Duration
-	authRequestsValidFor time.Duration
+	idTokensValidFor      time.Duration
+	authRequestsValidFor  time.Duration
+	pendingLoginsValidFor time.Duration
+	authCodesValidFor     time.Duration
+
+	refreshTokensValidFor    time.Duration
+	refreshTokensIdleTimeout time.Duration
+	sessionIdleTimeout       time.Duration
+
+	adminAPIKey string
+
+	// Audiences of the ID tokens accepted by bearerUser.
+	identitiesClients []string
+
+	passwordHashCost int
+
+	cachePolicies CachePolicies
+
+	connectorIDClaim string
+
+	// Alias of the "connector_id" authorization request parameter, if any.
+	connectorIDParam string
+
+	requirePKCE bool
+
+	// Whether redirect URIs may differ from the registered ones by a trailing
+	// slash.
+	ignoreTrailingSlash bool
+
+	// Default audience policy of ID tokens with cross-client scopes.
+	crossClientAudience string
+
+	// Whether ID tokens carry a "nbf" claim, and how long before their issue
+	// time it's set.
+	notBefore       bool
+	notBeforeLeeway time.Duration
+
+	authRequestLimits AuthRequestLimits
+	pendingLogins     *pendingLoginLimiter
+	idTokenSizeLimit  IDTokenSizeLimit
+
+	tokenWebhook *tokenWebhook
+
+	// Resources by URI.
+	resources map[string]Resource
+
+	tokenExchangeMaxDepth int
+
+	jwtResponseModes bool
+
+	missingEmailPolicy string
+
+	httpIssuerPolicy string
+
+	jsonTokenRequests bool
+
+	directResponseTypeErrors bool
+	errorStatusCodes         map[string]int
+
+	logTokenIssuance bool
+
+	backchannelLogout *backchannelLogout
+
+	// Codes exchanged by clients with a code reuse grace period.
+	redeemedCodes redeemedCodes
+
+	secrets      SecretGenerator
+	secretPolicy SecretPolicy
+
+	requireHTTPSRedirectURIs bool
+
+	signer Signer
+
+	// Claims released by each scope, mapped to the user attribute they hold.
+	scopeClaims map[string]map[string]string
+	claimExprs  map[string]*template.Template
+
+	// Verifies ID tokens signed by peer instances. Nil if there are none.
+	peerKeys *peerKeys
+
+	// How often signing keys are rotated, advertised in discovery.
+	keyRotationInterval time.Duration
+
+	// Algorithm of new signing keys, advertised in discovery.
+	signingAlgorithm jose.SignatureAlgorithm
+
+	maintenance *maintenance
+
+	// Health of the connectors, served by "/healthz/connectors" and used to
+	// route logins through chain connectors.
+	connectorHealth *connectorHealth
+	loginProbes     *loginProbes
+
+	failureDelay *failureDelay
+
+	// Texts second factor codes, if the SMS second factor is enabled.
+	smsSender       SMSSender
+	smsCodeValidFor time.Duration
+	smsLimiter      *smsLimiter
 
 	logger log.Logger
 }
 
 // NewServer constructs a server from the provided config.
 func NewServer(ctx context.Context, c Config) (*Server, error) {
-	return newServer(ctx, c, defaultRotationStrategy(
+	strategy := defaultRotationStrategy(
 		value(c.RotateKeysAfter, 6*time.Hour),
 		value(c.IDTokensValidFor, 24*time.Hour),
-	))
+	)
+	if c.SigningAlgorithm != "" {
+		key, err := keyGenerator(jose.SignatureAlgorithm(c.SigningAlgorithm))
+		if err != nil {
+			return nil, fmt.Errorf("server: %v", err)
+		}
+		strategy.key = key
+	}
+	return newServer(ctx, c, strategy)
 }
 
 func newServer(ctx context.Context, c Config, rotationStrategy rotationStrategy) (*Server, error) {
@@ -164,6 +530,12 @@ func newServer(ctx context.Context, c Config, rotationStrategy rotationStrategy)
 	if len(c.SupportedResponseTypes) == 0 {
 		c.SupportedResponseTypes = []string{responseTypeCode}
 	}
+	if c.SigningAlgorithm == "" {
+		c.SigningAlgorithm = string(jose.RS256)
+	}
+	if c.SecretGenerator == nil {
+		c.SecretGenerator = NewSecretGenerator(defaultSecretBytes)
+	}
 
 	supported := make(map[string]bool)
 	for _, respType := range c.SupportedResponseTypes {
@@ -175,8 +547,122 @@ func newServer(ctx context.Context, c Config, rotationStrategy rotationStrategy)
 		supported[respType] = true
 	}
 
+	combinations := make(map[string]bool)
+	if len(c.ResponseTypeCombinations) == 0 {
+		for _, combination := range validResponseTypeCombinations(c.SupportedResponseTypes) {
+			combinations[combination] = true
+		}
+	}
+	for _, combination := range c.ResponseTypeCombinations {
+		responseTypes := strings.Fields(combination)
+		if err := validateResponseTypeCombination(responseTypes); err != nil {
+			return nil, fmt.Errorf("invalid response_type combination %q: %v", combination, err)
+		}
+		for _, respType := range responseTypes {
+			if !supported[respType] {
+				return nil, fmt.Errorf("response_type combination %q includes unsupported response_type %q", combination, respType)
+			}
+		}
+		combinations[responseTypeCombination(responseTypes)] = true
+	}
+
+	if c.ConnectorIDClaim != "" && reservedClaim(c.ConnectorIDClaim) {
+		return nil, fmt.Errorf("server: connector ID claim %q conflicts with a standard claim", c.ConnectorIDClaim)
+	}
+	if c.ConnectorIDParameter != "" && authRequestParameters[c.ConnectorIDParameter] {
+		return nil, fmt.Errorf("server: connector ID parameter %q conflicts with a standard parameter", c.ConnectorIDParameter)
+	}
+
+	if c.NotBeforeLeeway < 0 || c.NotBeforeLeeway >= value(c.IDTokensValidFor, 24*time.Hour) {
+		return nil, fmt.Errorf("server: not before leeway %s can't be negative or exceed the ID token lifetime", c.NotBeforeLeeway)
+	}
+
+	if c.AuthFailureDelay < 0 || c.AuthFailureJitter < 0 {
+		return nil, errors.New("server: auth failure delay and jitter can't be negative")
+	}
+
+	if err := validateLifetimes(c); err != nil {
+		return nil, fmt.Errorf("server: %v", err)
+	}
+	if err := c.IDTokenSizeLimit.validate(); err != nil {
+		return nil, fmt.Errorf("server: invalid ID token size limit: %v", err)
+	}
+	if err := c.PendingLoginLimits.validate(); err != nil {
+		return nil, fmt.Errorf("server: %v", err)
+	}
+
+	claimExprs, err := newClaimExprs(c.ClaimExpressions)
+	if err != nil {
+		return nil, fmt.Errorf("server: invalid claim expressions: %v", err)
+	}
+	scopeClaims, err := newScopeClaims(c.ScopeClaims, c.ConnectorIDClaim, claimExprs)
+	if err != nil {
+		return nil, fmt.Errorf("server: invalid scope claims: %v", err)
+	}
+
+	missingEmailPolicy := c.MissingEmailPolicy
+	if missingEmailPolicy == "" {
+		missingEmailPolicy = missingEmailProceed
+	}
+	if !validMissingEmailPolicy(missingEmailPolicy) {
+		return nil, fmt.Errorf("server: unknown missing email policy %q", c.MissingEmailPolicy)
+	}
+
+	switch c.RedirectURITrailingSlash {
+	case "", trailingSlashStrict, trailingSlashIgnore:
+	default:
+		return nil, fmt.Errorf("server: unknown redirect URI trailing slash policy %q", c.RedirectURITrailingSlash)
+	}
+
+	crossClientAudience := c.CrossClientAudience
+	if crossClientAudience == "" {
+		crossClientAudience = crossClientAudienceClientFirst
+	}
+	if !validCrossClientAudience(crossClientAudience) {
+		return nil, fmt.Errorf("server: unknown cross-client audience policy %q", c.CrossClientAudience)
+	}
+
+	httpIssuerPolicy := c.HTTPIssuerPolicy
+	if httpIssuerPolicy == "" {
+		httpIssuerPolicy = httpIssuerAllow
+	}
+	if !validHTTPIssuerPolicy(httpIssuerPolicy) {
+		return nil, fmt.Errorf("server: unknown HTTP issuer policy %q", c.HTTPIssuerPolicy)
+	}
+
+	if err := validateErrorStatusCodes(c.ErrorStatusCodes); err != nil {
+		return nil, fmt.Errorf("server: %v", err)
+	}
+
+	if err := c.SMS.validate(); err != nil {
+		return nil, fmt.Errorf("server: invalid SMS config: %v", err)
+	}
+
+	if c.TokenExchangeMaxDepth < 0 {
+		return nil, errors.New("server: token exchange max depth can't be negative")
+	}
+
+	resources, err := newResources(c.Resources)
+	if err != nil {
+		return nil, fmt.Errorf("server: invalid resources: %v", err)
+	}
+
+	passwordHashCost := c.PasswordHashCost
+	if passwordHashCost == 0 {
+		passwordHashCost = recCost
+	}
+	if passwordHashCost < bcrypt.DefaultCost || passwordHashCost > upBoundCost {
+		return nil, fmt.Errorf("server: password hash cost must be between %d and %d", bcrypt.DefaultCost, upBoundCost)
+	}
+
+	cachePolicies := c.CachePolicies
+	if cachePolicies.Token, err = tokenCachePolicy(c.CachePolicies.Token); err != nil {
+		return nil, fmt.Errorf("server: invalid token cache policy: %v", err)
+	}
+
 	web := webConfig{
 		dir:       c.Web.Dir,
+		themeDir:  c.Web.ThemeDir,
 		logoURL:   c.Web.LogoURL,
 		issuerURL: c.Issuer,
 		issuer:    c.Web.Issuer,
@@ -194,16 +680,69 @@ func newServer(ctx context.Context, c Config, rotationStrategy rotationStrategy)
 	}
 
 	s := &Server{
-		issuerURL:              *issuerURL,
-		connectors:             make(map[string]Connector),
-		storage:                newKeyCacher(c.Storage, now),
-		supportedResponseTypes: supported,
-		idTokensValidFor:       value(c.IDTokensValidFor, 24*time.Hour),
-		authRequestsValidFor:   value(c.AuthRequestsValidFor, 24*time.Hour),
-		skipApproval:           c.SkipApprovalScreen,
-		now:                    now,
-		templates:              tmpls,
-		logger:                 c.Logger,
+		issuerURL:                *issuerURL,
+		connectors:               make(map[string]Connector),
+		storage:                  newKeyCacher(c.Storage, now),
+		supportedResponseTypes:   supported,
+		responseTypeCombinations: combinations,
+		idTokensValidFor:         value(c.IDTokensValidFor, 24*time.Hour),
+		notBefore:                c.IDTokenNotBefore,
+		notBeforeLeeway:          c.NotBeforeLeeway,
+		authRequestsValidFor:     value(c.AuthRequestsValidFor, 24*time.Hour),
+		pendingLoginsValidFor:    c.PendingLoginsValidFor,
+		authCodesValidFor:        value(c.AuthCodesValidFor, 30*time.Minute),
+		refreshTokensValidFor:    c.RefreshTokensValidFor,
+		refreshTokensIdleTimeout: c.RefreshTokensIdleTimeout,
+		sessionIdleTimeout:       c.SessionIdleTimeout,
+		skipApproval:             c.SkipApprovalScreen,
+		adminAPIKey:              c.AdminAPIKey,
+		identitiesClients:        c.IdentitiesClients,
+		passwordHashCost:         passwordHashCost,
+		cachePolicies:            cachePolicies,
+		connectorIDClaim:         c.ConnectorIDClaim,
+		connectorIDParam:         c.ConnectorIDParameter,
+		scopeClaims:              scopeClaims,
+		claimExprs:               claimExprs,
+		requirePKCE:              c.RequirePKCE,
+		ignoreTrailingSlash:      c.RedirectURITrailingSlash == trailingSlashIgnore,
+		crossClientAudience:      crossClientAudience,
+		authRequestLimits:        c.AuthRequestLimits.withDefaults(),
+		pendingLogins:            newPendingLoginLimiter(c.PendingLoginLimits),
+		idTokenSizeLimit:         c.IDTokenSizeLimit.withDefaults(),
+		tokenWebhook:             newTokenWebhook(c.TokenWebhook, c.ConnectorIDClaim, c.Logger),
+		resources:                resources,
+		tokenExchangeMaxDepth:    c.TokenExchangeMaxDepth,
+		jwtResponseModes:         c.JWTResponseModes,
+		missingEmailPolicy:       missingEmailPolicy,
+		httpIssuerPolicy:         httpIssuerPolicy,
+		jsonTokenRequests:        c.JSONTokenRequests,
+		directResponseTypeErrors: c.DirectResponseTypeErrors,
+		errorStatusCodes:         c.ErrorStatusCodes,
+		failureDelay:             newFailureDelay(c.AuthFailureDelay, c.AuthFailureJitter),
+		smsSender:                c.SMS.Sender,
+		smsCodeValidFor:          value(c.SMS.CodeValidFor, 5*time.Minute),
+		smsLimiter:               newSMSLimiter(c.SMS.MaxCodes, c.SMS.RateLimitPeriod),
+		logTokenIssuance:         c.LogTokenIssuance,
+		backchannelLogout:        &backchannelLogout{client: &http.Client{Timeout: 10 * time.Second}, attempts: 5, retryDelay: time.Second},
+		secrets:                  c.SecretGenerator,
+		secretPolicy:             c.SecretPolicy,
+		requireHTTPSRedirectURIs: c.RequireHTTPSRedirectURIs,
+		signer:                   c.Signer,
+		keyRotationInterval:      rotationStrategy.rotationFrequency,
+		signingAlgorithm:         jose.SignatureAlgorithm(c.SigningAlgorithm),
+		maintenance:              &maintenance{drain: value(c.MaintenanceDrainPeriod, value(c.AuthCodesValidFor, 30*time.Minute))},
+		now:                      now,
+		templates:                tmpls,
+		logger:                   c.Logger,
+	}
+
+	if len(c.PeerJWKSURIs) > 0 {
+		for _, uri := range c.PeerJWKSURIs {
+			if u, err := url.Parse(uri); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+				return nil, fmt.Errorf("server: invalid peer JWKS URI %q", uri)
+			}
+		}
+		s.peerKeys = newPeerKeys(c.PeerJWKSURIs, now)
 	}
 
 	// Retrieves connector objects in backend storage. This list includes the static connectors
@@ -261,6 +800,17 @@ func newServer(ctx context.Context, c Config, rotationStrategy rotationStrategy)
 	}
 	r.NotFoundHandler = http.HandlerFunc(http.NotFound)
 
+	internal := mux.NewRouter()
+	internal.NotFoundHandler = http.HandlerFunc(http.NotFound)
+	handleAdmin := func(p string, h http.HandlerFunc) {
+		handleFunc(p, s.requireAdmin(h))
+	}
+	if c.InternalAdminAPI {
+		handleAdmin = func(p string, h http.HandlerFunc) {
+			internal.Handle(path.Join(issuerURL.Path, p), instrumentHandlerCounter(p, s.requireAdmin(h)))
+		}
+	}
+
 	discoveryHandler, err := s.discoveryHandler()
 	if err != nil {
 		return nil, err
@@ -270,6 +820,7 @@ func newServer(ctx context.Context, c Config, rotationStrategy rotationStrategy)
 	// TODO(ericchiang): rate limit certain paths based on IP.
 	handleWithCORS("/token", s.handleToken)
 	handleWithCORS("/keys", s.handlePublicKeys)
+	handleWithCORS("/connectors", s.handleConnectors)
 	handleFunc("/auth", s.handleAuthorization)
 	handleFunc("/auth/{connector}", s.handleConnectorLogin)
 	r.HandleFunc(path.Join(issuerURL.Path, "/callback"), func(w http.ResponseWriter, r *http.Request) {
@@ -286,13 +837,95 @@ func newServer(ctx context.Context, c Config, rotationStrategy rotationStrategy)
 	// "authproxy" connector.
 	handleFunc("/callback/{connector}", s.handleConnectorCallback)
 	handleFunc("/approval", s.handleApproval)
+	handleFunc("/identities", s.handleIdentities)
+	handleFunc("/logout", s.handleLogout)
+	handleFunc("/totp", s.handleTOTP)
+	handleFunc("/sms", s.handleSMS)
+	handleFunc("/email", s.handleEmailPrompt)
+	handleFunc("/magiclink", s.handleMagicLink)
+	if c.AdminAPIKey != "" {
+		handleAdmin("/admin/users", s.handleAdminCreateUser)
+		handleAdmin("/admin/users/{user}/identities", s.handleAdminUserIdentities)
+		handleAdmin("/admin/users/{user}/disabled", s.handleAdminUserDisabled)
+		handleAdmin("/admin/users/{user}/totp", s.handleAdminUserTOTP)
+		handleAdmin("/admin/users/{user}/totp/confirm", s.handleAdminUserTOTPConfirm)
+		handleAdmin("/admin/users/{user}/phone", s.handleAdminUserPhone)
+		handleAdmin("/admin/connectors/{connector}/webauthn/{user}", s.handleAdminWebAuthnCredentials)
+		handleAdmin("/admin/clients/{client}/secret", s.handleAdminClientSecret)
+		handleAdmin("/admin/maintenance", s.handleAdminMaintenance)
+		handleAdmin("/admin/tokens/revoked", s.handleAdminRevokeToken)
+		// Private keys are only exported through the internal handler.
+		if c.InternalAdminAPI {
+			handleAdmin("/admin/keys/export", s.handleAdminKeysExport)
+			handleAdmin("/admin/keys/import", s.handleAdminKeysImport)
+		}
+	}
 	handle("/healthz", s.newHealthChecker(ctx))
+	s.connectorHealth = &connectorHealth{
+		s:   s,
+		ttl: value(c.ConnectorHealthTTL, 10*time.Second),
+		recoveries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "dex_connector_recoveries_total",
+			Help: "Count of connectors reopened after recovering from a failed health check.",
+		}, []string{"connector"}),
+		reopen: s.reopenConnector,
+	}
+	if err := c.PrometheusRegistry.Register(s.connectorHealth.recoveries); err != nil {
+		return nil, fmt.Errorf("server: Failed to register connector recovery metrics: %v", err)
+	}
+	handle("/healthz/connectors", s.connectorHealth)
 	handlePrefix("/static", static)
 	handlePrefix("/theme", theme)
-	s.mux = r
+	s.mux = c.SecurityHeaders.handler(issuerURL, r)
+	s.internalMux = internal
+
+	if c.MaintenanceMode {
+		s.maintenance.set(true, now())
+	}
 
-	s.startKeyRotation(ctx, rotationStrategy, now)
+	if c.Signer != nil {
+		pub, err := c.Signer.PublicKey()
+		if err != nil {
+			return nil, fmt.Errorf("server: get public key of signer: %v", err)
+		}
+		if err := checkSignerKey(pub); err != nil {
+			return nil, fmt.Errorf("server: %v", err)
+		}
+		s.logger.Infof("signing tokens with external key %q", pub.KeyID)
+	} else {
+		s.startKeyRotation(ctx, rotationStrategy, now)
+	}
 	s.startGarbageCollection(ctx, value(c.GCFrequency, 5*time.Minute), now)
+	if c.DirectorySyncInterval > 0 {
+		s.startDirectorySync(ctx, c.DirectorySyncInterval, c.PruneDirectoryUsers)
+	}
+	if c.LoginProbeInterval > 0 {
+		s.loginProbes = newLoginProbes(s, 10*time.Second)
+		if err := s.loginProbes.register(c.PrometheusRegistry); err != nil {
+			return nil, fmt.Errorf("server: Failed to register login probe metrics: %v", err)
+		}
+		s.loginProbes.start(ctx, c.LoginProbeInterval)
+	}
+
+	if c.SelfTest {
+		if err := s.selfTest(ctx); err != nil {
+			if !c.SelfTestWarnOnly {
+				return nil, fmt.Errorf("server: self-test failed: %v", err)
+			}
+			s.logger.Errorf("SELF-TEST FAILED, serving traffic anyway: %v", err)
+		} else {
+			s.logger.Infof("self-test passed")
+		}
+	}
+
+	if c.ValidateClients {
+		if err := s.validateClients(); err != nil {
+			if c.ValidateClientsStrict {
+				return nil, fmt.Errorf("server: client validation failed: %v", err)
+			}
+			s.logger.Errorf("client validation failed, serving traffic anyway: %v", err)
+		}
+	}
 
 	return s, nil
 }
@@ -301,6 +934,13 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	s.mux.ServeHTTP(w, r)
 }
 
+// InternalHandler serves the endpoints moved off the public handler by
+// Config.InternalAdminAPI. Discovery and tokens still reference the issuer, so
+// this handler is meant to be bound to an internal address only.
+func (s *Server) InternalHandler() http.Handler {
+	return s.internalMux
+}
+
 func (s *Server) absPath(pathItems ...string) string {
 	paths := make([]string, len(pathItems)+1)
 	paths[0] = s.issuerURL.Path
@@ -410,6 +1050,14 @@ func (k *keyCacher) GetKeys() (storage.Keys, error) {
 	return storageKeys, nil
 }
 
+// UpdateKeys drops the cached keys, so keys replaced before their next
+// rotation, such as by an import, are used right away.
+func (k *keyCacher) UpdateKeys(updater func(old storage.Keys) (storage.Keys, error)) error {
+	err := k.Storage.UpdateKeys(updater)
+	k.keys.Store((*storage.Keys)(nil))
+	return err
+}
+
 func (s *Server) startGarbageCollection(ctx context.Context, frequency time.Duration, now func() time.Time) {
 	go func() {
 		for {
@@ -419,8 +1067,9 @@ func (s *Server) startGarbageCollection(ctx context.Context, frequency time.Dura
 			case <-time.After(frequency):
 				if r, err := s.storage.GarbageCollect(now()); err != nil {
 					s.logger.Errorf("garbage collection failed: %v", err)
-				} else if r.AuthRequests > 0 || r.AuthCodes > 0 {
-					s.logger.Infof("garbage collection run, delete auth requests=%d, auth codes=%d", r.AuthRequests, r.AuthCodes)
+				} else if r.AuthRequests > 0 || r.AuthCodes > 0 || r.RevokedTokens > 0 || r.UsedNonces > 0 || r.WebAuthnChallenges > 0 {
+					s.logger.Infof("garbage collection run, delete auth requests=%d, auth codes=%d, revoked tokens=%d, used nonces=%d, webauthn challenges=%d",
+						r.AuthRequests, r.AuthCodes, r.RevokedTokens, r.UsedNonces, r.WebAuthnChallenges)
 				}
 			}
 		}
@@ -448,12 +1097,18 @@ var ConnectorsConfig = map[string]func() ConnectorConfig{
 	"linkedin":        func() ConnectorConfig { return new(linkedin.Config) },
 	"microsoft":       func() ConnectorConfig { return new(microsoft.Config) },
 	"bitbucket-cloud": func() ConnectorConfig { return new(bitbucketcloud.Config) },
+	"httpapi":         func() ConnectorConfig { return new(httpapi.Config) },
+	"kerberos":        func() ConnectorConfig { return new(kerberos.Config) },
+	"clientcert":      func() ConnectorConfig { return new(clientcert.Config) },
+	"webauthn":        func() ConnectorConfig { return new(webauthn.Config) },
+	"magiclink":       func() ConnectorConfig { return new(magiclink.Config) },
+	"fallback":        func() ConnectorConfig { return new(fallback.Config) },
 	// Keep around for backwards compatibility.
 	"samlExperimental": func() ConnectorConfig { return new(saml.Config) },
 }
 
 // openConnector will parse the connector config and open the connector.
-func openConnector(logger log.Logger, conn storage.Connector) (connector.Connector, error) {
+func openConnector(logger log.Logger, conn storage.Connector, httpClient *http.Client, s storage.Storage) (connector.Connector, error) {
 	var c connector.Connector
 
 	f, ok := ConnectorsConfig[conn.Type]
@@ -469,6 +1124,13 @@ func openConnector(logger log.Logger, conn storage.Connector) (connector.Connect
 		}
 	}
 
+	if oidcConfig, ok := connConfig.(*oidc.Config); ok {
+		oidcConfig.HTTPClient = httpClient
+	}
+	if webauthnConfig, ok := connConfig.(*webauthn.Config); ok {
+		webauthnConfig.Storage = s
+	}
+
 	c, err := connConfig.Open(conn.ID, logger)
 	if err != nil {
 		return c, fmt.Errorf("failed to create connector %s: %v", conn.ID, err)
@@ -479,21 +1141,38 @@ func openConnector(logger log.Logger, conn storage.Connector) (connector.Connect
 
 // OpenConnector updates server connector map with specified connector object.
 func (s *Server) OpenConnector(conn storage.Connector) (Connector, error) {
+	if err := validateEmailDomains(conn.AllowedEmailDomains); err != nil {
+		return Connector{}, fmt.Errorf("failed to open connector: %v", err)
+	}
+	if err := validateConnectorHeaders(conn); err != nil {
+		return Connector{}, fmt.Errorf("failed to open connector: %v", err)
+	}
+	if err := validateRequiredAttributes(conn.RequiredAttributes); err != nil {
+		return Connector{}, fmt.Errorf("failed to open connector: %v", err)
+	}
+	httpClient := newConnectorHTTPClient(conn.Headers)
+
 	var c connector.Connector
 
 	if conn.Type == LocalConnector {
 		c = newPasswordDB(s.storage)
 	} else {
 		var err error
-		c, err = openConnector(s.logger, conn)
+		c, err = openConnector(s.logger, conn, httpClient, s.storage)
 		if err != nil {
 			return Connector{}, fmt.Errorf("failed to open connector: %v", err)
 		}
 	}
 
 	connector := Connector{
-		ResourceVersion: conn.ResourceVersion,
-		Connector:       c,
+		ResourceVersion:     conn.ResourceVersion,
+		Connector:           c,
+		AllowedEmailDomains: conn.AllowedEmailDomains,
+		AllowedClients:      conn.AllowedClients,
+		Branding:            conn.Branding,
+		RequireExistingUser: conn.JITProvisioning != nil && !*conn.JITProvisioning,
+		RequiredAttributes:  conn.RequiredAttributes,
+		httpClient:          httpClient,
 	}
 	s.mu.Lock()
 	s.connectors[conn.ID] = connector
@@ -156,6 +156,171 @@ func TestDiscovery(t *testing.T) {
 	}
 }
 
+func TestIssuerPathPrefix(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, server := newTestServer(ctx, t, func(c *Config) {
+		c.Issuer = c.Issuer + "/dex"
+	})
+	defer httpServer.Close()
+	issuer := httpServer.URL
+
+	p, err := oidc.NewProvider(ctx, issuer)
+	if err != nil {
+		t.Fatalf("failed to get provider: %v", err)
+	}
+	var got struct {
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := p.Claims(&got); err != nil {
+		t.Fatalf("failed to decode claims: %v", err)
+	}
+	if want := issuer + "/keys"; got.JWKSURI != want {
+		t.Errorf("expected jwks_uri %q, got %q", want, got.JWKSURI)
+	}
+
+	idToken, _, err := server.newIDToken("client", storage.Claims{UserID: "1"}, []string{scopeOpenID}, nil, "", "", "mock")
+	if err != nil {
+		t.Fatalf("new id token: %v", err)
+	}
+	// Verification fetches the keys from jwks_uri and checks the token's iss.
+	token, err := p.Verifier(&oidc.Config{ClientID: "client"}).Verify(ctx, idToken)
+	if err != nil {
+		t.Fatalf("failed to verify id token: %v", err)
+	}
+	if token.Issuer != issuer {
+		t.Errorf("expected iss %q, got %q", issuer, token.Issuer)
+	}
+}
+
+func TestDiscoveryResponseTypes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, _ := newTestServer(ctx, t, func(c *Config) {
+		c.SupportedResponseTypes = []string{"code", "id_token", "token"}
+		c.ResponseTypeCombinations = []string{"code", "id_token code"}
+	})
+	defer httpServer.Close()
+
+	p, err := oidc.NewProvider(ctx, httpServer.URL)
+	if err != nil {
+		t.Fatalf("failed to get provider: %v", err)
+	}
+	var got struct {
+		ResponseTypes []string `json:"response_types_supported"`
+	}
+	if err := p.Claims(&got); err != nil {
+		t.Fatalf("failed to decode claims: %v", err)
+	}
+	want := []string{"code", "code id_token"}
+	if diff := pretty.Compare(want, got.ResponseTypes); diff != "" {
+		t.Errorf("unexpected response_types_supported: %s", diff)
+	}
+}
+
+func TestDiscoverySigningAlgorithms(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, _ := newTestServer(ctx, t, func(c *Config) {
+		c.SigningAlgorithm = "ES256"
+	})
+	defer httpServer.Close()
+
+	p, err := oidc.NewProvider(ctx, httpServer.URL)
+	if err != nil {
+		t.Fatalf("failed to get provider: %v", err)
+	}
+	var got struct {
+		IDTokenAlgs []string `json:"id_token_signing_alg_values_supported"`
+	}
+	if err := p.Claims(&got); err != nil {
+		t.Fatalf("failed to decode claims: %v", err)
+	}
+	want := []string{"RS256", "ES256"}
+	if diff := pretty.Compare(want, got.IDTokenAlgs); diff != "" {
+		t.Errorf("unexpected id_token_signing_alg_values_supported: %s", diff)
+	}
+}
+
+func TestDiscoveryHTTPIssuer(t *testing.T) {
+	tests := []struct {
+		policy      string
+		wantCode    int
+		wantWarning bool
+	}{
+		{"", http.StatusOK, false},
+		{"allow", http.StatusOK, false},
+		{"warn", http.StatusOK, true},
+		{"reject", http.StatusInternalServerError, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.policy, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			// The test server's issuer is a plaintext HTTP URL.
+			httpServer, server := newTestServer(ctx, t, func(c *Config) {
+				c.HTTPIssuerPolicy = tc.policy
+			})
+			defer httpServer.Close()
+
+			rr := httptest.NewRecorder()
+			server.ServeHTTP(rr, httptest.NewRequest("GET", "/.well-known/openid-configuration", nil))
+			if rr.Code != tc.wantCode {
+				t.Fatalf("expected status %d, got %d: %s", tc.wantCode, rr.Code, rr.Body)
+			}
+			var got struct {
+				Issuer      string `json:"issuer"`
+				Warning     string `json:"warning"`
+				Error       string `json:"error"`
+				Description string `json:"error_description"`
+			}
+			if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+				t.Fatalf("decode response: %v", err)
+			}
+			if tc.wantCode != http.StatusOK {
+				if got.Error != errServerError || !strings.Contains(got.Description, "plaintext HTTP") {
+					t.Errorf("expected an error about the HTTP issuer, got %+v", got)
+				}
+				return
+			}
+			if got.Issuer != httpServer.URL {
+				t.Errorf("expected issuer %q, got %q", httpServer.URL, got.Issuer)
+			}
+			if gotWarning := got.Warning != ""; gotWarning != tc.wantWarning {
+				t.Errorf("expected warning %t, got %q", tc.wantWarning, got.Warning)
+			}
+		})
+	}
+
+	// HTTPS issuers are served regardless of the policy.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	httpServer, server := newTestServer(ctx, t, func(c *Config) {
+		c.Issuer = "https://dex.example.com"
+		c.HTTPIssuerPolicy = "reject"
+	})
+	defer httpServer.Close()
+	rr := httptest.NewRecorder()
+	server.ServeHTTP(rr, httptest.NewRequest("GET", "/.well-known/openid-configuration", nil))
+	if rr.Code != http.StatusOK || strings.Contains(rr.Body.String(), "warning") {
+		t.Errorf("expected the discovery document of an HTTPS issuer, got %d: %s", rr.Code, rr.Body)
+	}
+
+	if _, err := NewServer(ctx, Config{
+		Issuer:           "http://dex.example.com",
+		Storage:          memory.New(logger),
+		Web:              WebConfig{Dir: "../web"},
+		Logger:           logger,
+		HTTPIssuerPolicy: "deny",
+	}); err == nil || !strings.Contains(err.Error(), "HTTP issuer policy") {
+		t.Errorf("expected an unknown policy to be rejected, got %v", err)
+	}
+}
+
 // TestOAuth2CodeFlow runs integration tests against a test server. The tests stand up a server
 // which requires no interaction to login, logs in through a test client, then passes the client
 // and returned token to the test.
@@ -771,9 +936,10 @@ func TestCrossClientScopes(t *testing.T) {
 
 	redirectURL := oauth2Server.URL + "/callback"
 	client := storage.Client{
-		ID:           testClientID,
-		Secret:       "testclientsecret",
-		RedirectURIs: []string{redirectURL},
+		ID:               testClientID,
+		Secret:           "testclientsecret",
+		RedirectURIs:     []string{redirectURL},
+		AllowedAudiences: []string{peerID},
 	}
 	if err := s.storage.CreateClient(client); err != nil {
 		t.Fatalf("failed to create client: %v", err)
@@ -893,9 +1059,10 @@ func TestCrossClientScopesWithAzpInAudienceByDefault(t *testing.T) {
 
 	redirectURL := oauth2Server.URL + "/callback"
 	client := storage.Client{
-		ID:           testClientID,
-		Secret:       "testclientsecret",
-		RedirectURIs: []string{redirectURL},
+		ID:               testClientID,
+		Secret:           "testclientsecret",
+		RedirectURIs:     []string{redirectURL},
+		AllowedAudiences: []string{peerID},
 	}
 	if err := s.storage.CreateClient(client); err != nil {
 		t.Fatalf("failed to create client: %v", err)
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	jose "gopkg.in/square/go-jose.v2"
+
+	"github.com/dexidp/dex/storage"
+)
+
+// Signer signs tokens with a key held outside of dex, such as in a cloud KMS
+// or an HSM, so the private key never enters dex's memory or storage. Dex
+// doesn't rotate such a key; rotating it is up to the KMS.
+type Signer interface {
+	// PublicKey returns the public half of the signing key, with its key ID
+	// and algorithm set. It's called for every token and every request for
+	// the key set, so implementations should cache it.
+	PublicKey() (*jose.JSONWebKey, error)
+
+	// Sign returns the signature of a JWS signing input, the encoded header
+	// and payload joined by a period. ECDSA signatures must be in the JWS
+	// format, the concatenated R and S values, rather than ASN.1.
+	Sign(signingInput []byte) ([]byte, error)
+}
+
+// externalKeysMaxAge is how long clients may cache the key set when tokens are
+// signed by a Signer. Its key may be rotated without dex knowing in advance.
+const externalKeysMaxAge = 5 * time.Minute
+
+// signerError is returned when the Signer fails, so token requests can be
+// told to try again later rather than that the server failed.
+type signerError struct {
+	err error
+}
+
+func (e signerError) Error() string {
+	return fmt.Sprintf("external signer: %v", e.err)
+}
+
+// checkSignerKey validates the public key of a Signer.
+func checkSignerKey(pub *jose.JSONWebKey) error {
+	if pub == nil || pub.Key == nil || !pub.IsPublic() {
+		return errors.New("signer must return a public key")
+	}
+	if pub.KeyID == "" {
+		return errors.New("signer's public key has no key ID")
+	}
+	switch jose.SignatureAlgorithm(pub.Algorithm) {
+	case jose.RS256, jose.RS384, jose.RS512, jose.ES256, jose.ES384, jose.ES512, jose.PS256, jose.PS384, jose.PS512:
+	default:
+		return fmt.Errorf("signer's public key has unsupported algorithm %q", pub.Algorithm)
+	}
+	return nil
+}
+
+// opaqueSigner adapts a Signer for go-jose.
+type opaqueSigner struct {
+	signer Signer
+	pub    *jose.JSONWebKey
+}
+
+func (o opaqueSigner) Public() *jose.JSONWebKey {
+	return o.pub
+}
+
+func (o opaqueSigner) Algs() []jose.SignatureAlgorithm {
+	return []jose.SignatureAlgorithm{jose.SignatureAlgorithm(o.pub.Algorithm)}
+}
+
+func (o opaqueSigner) SignPayload(payload []byte, alg jose.SignatureAlgorithm) ([]byte, error) {
+	signature, err := o.signer.Sign(payload)
+	if err != nil {
+		return nil, signerError{err}
+	}
+	return signature, nil
+}
+
+// getKeys returns the keys tokens are signed and verified with. With a Signer,
+// its public key is published as the signing key, and the key dex signed with
+// before the Signer was configured is kept for as long as tokens it signed may
+// be valid.
+func (s *Server) getKeys() (storage.Keys, error) {
+	keys, err := s.storage.GetKeys()
+	if s.signer == nil {
+		return keys, err
+	}
+	if err != nil && err != storage.ErrNotFound {
+		return keys, err
+	}
+
+	pub, err := s.signer.PublicKey()
+	if err != nil {
+		return storage.Keys{}, signerError{err}
+	}
+	if err := checkSignerKey(pub); err != nil {
+		return storage.Keys{}, signerError{err}
+	}
+
+	now := s.now()
+	external := storage.Keys{
+		SigningKeyPub: pub,
+		NextRotation:  now.Add(externalKeysMaxAge),
+	}
+	if keys.SigningKeyPub != nil && now.Before(keys.NextRotation.Add(s.idTokensValidFor)) {
+		external.VerificationKeys = append(external.VerificationKeys, storage.VerificationKey{
+			PublicKey: keys.SigningKeyPub,
+			Expiry:    keys.NextRotation.Add(s.idTokensValidFor),
+		})
+	}
+	for _, vk := range keys.VerificationKeys {
+		if now.Before(vk.Expiry) {
+			external.VerificationKeys = append(external.VerificationKeys, vk)
+		}
+	}
+	return external, nil
+}
+
+// signingKey returns the key to sign tokens with, out of the keys returned by
+// getKeys.
+func (s *Server) signingKey(keys storage.Keys) (jose.SigningKey, error) {
+	if s.signer != nil {
+		pub := keys.SigningKeyPub
+		return jose.SigningKey{Key: opaqueSigner{s.signer, pub}, Algorithm: jose.SignatureAlgorithm(pub.Algorithm)}, nil
+	}
+	if keys.SigningKey == nil {
+		return jose.SigningKey{}, errors.New("no key to sign payload with")
+	}
+	alg, err := signatureAlgorithm(keys.SigningKey)
+	if err != nil {
+		return jose.SigningKey{}, err
+	}
+	return jose.SigningKey{Key: keys.SigningKey, Algorithm: alg}, nil
+}
+
+// signingErrHelper responds to a token request which failed to create a
+// token.
+func (s *Server) signingErrHelper(w http.ResponseWriter, err error) {
+	if _, ok := err.(signerError); ok {
+		s.tokenErrHelper(w, errTemporarilyUnavailable, "Token signing is temporarily unavailable.", http.StatusServiceUnavailable)
+		return
+	}
+	s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	jose "gopkg.in/square/go-jose.v2"
+
+	"github.com/dexidp/dex/storage"
+)
+
+// mockSigner is a Signer holding its key in memory, as a KMS would remotely.
+type mockSigner struct {
+	key  *ecdsa.PrivateKey
+	fail bool
+}
+
+func (m *mockSigner) PublicKey() (*jose.JSONWebKey, error) {
+	return &jose.JSONWebKey{Key: m.key.Public(), KeyID: "kms-key-1", Algorithm: string(jose.ES256), Use: "sig"}, nil
+}
+
+func (m *mockSigner) Sign(signingInput []byte) ([]byte, error) {
+	if m.fail {
+		return nil, errors.New("kms unavailable")
+	}
+	digest := sha256.Sum256(signingInput)
+	r, s, err := ecdsa.Sign(rand.Reader, m.key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	// JWS signatures are R and S, each left-padded to the size of the curve.
+	size := (m.key.Curve.Params().BitSize + 7) / 8
+	sig := make([]byte, 2*size)
+	rBytes, sBytes := r.Bytes(), s.Bytes()
+	copy(sig[size-len(rBytes):size], rBytes)
+	copy(sig[2*size-len(sBytes):], sBytes)
+	return sig, nil
+}
+
+func TestExternalSigner(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := &mockSigner{key: key}
+	httpServer, server := newTestServer(ctx, t, func(c *Config) {
+		c.Signer = signer
+	})
+	defer httpServer.Close()
+
+	client := storage.Client{ID: "client", Secret: "secret", RedirectURIs: []string{"https://example.com/callback"}}
+	if err := server.storage.CreateClient(client); err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	rr := exchangeTestAuthCode(server, client, newTestAuthCode(t, server, client))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 exchanging code, got %d: %s", rr.Code, rr.Body)
+	}
+	var resp struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("unmarshal token response: %v", err)
+	}
+
+	rr = httptest.NewRecorder()
+	server.ServeHTTP(rr, httptest.NewRequest("GET", "/keys", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 getting keys, got %d: %s", rr.Code, rr.Body)
+	}
+	var jwks jose.JSONWebKeySet
+	if err := json.Unmarshal(rr.Body.Bytes(), &jwks); err != nil {
+		t.Fatalf("unmarshal keys: %v", err)
+	}
+	jws, err := jose.ParseSigned(resp.IDToken)
+	if err != nil {
+		t.Fatalf("parse id token: %v", err)
+	}
+	if kid := jws.Signatures[0].Header.KeyID; kid != "kms-key-1" {
+		t.Errorf("expected the id token to be signed with the signer's key ID, got %q", kid)
+	}
+	published := jwks.Key("kms-key-1")
+	if len(published) != 1 {
+		t.Fatalf("expected the signer's key to be published, got %s", rr.Body)
+	}
+	if _, err := jws.Verify(&published[0]); err != nil {
+		t.Errorf("expected the id token to validate against the published key: %v", err)
+	}
+	for _, k := range jwks.Keys {
+		if !k.IsPublic() {
+			t.Errorf("key %q published with private material", k.KeyID)
+		}
+	}
+
+	signer.fail = true
+	rr = exchangeTestAuthCode(server, client, newTestAuthCode(t, server, client))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 when the signer fails, got %d: %s", rr.Code, rr.Body)
+	}
+	var errResp struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &errResp); err != nil || errResp.Error != errTemporarilyUnavailable {
+		t.Errorf("expected a %q error, got %s", errTemporarilyUnavailable, rr.Body)
+	}
+
+	// Token exchanges fail the same way.
+	claims, err := server.verifyIDToken(resp.IDToken)
+	if err != nil {
+		t.Fatalf("verify id token: %v", err)
+	}
+	_, _, err = server.newExchangedIDToken(resp.IDToken, claims, "peer", client.ID, &actor{Subject: client.ID}, nil)
+	if _, ok := err.(signerError); !ok {
+		t.Errorf("expected a signer error exchanging a token, got %v", err)
+	}
+}
@@ -0,0 +1,422 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/dexidp/dex/connector"
+	"github.com/dexidp/dex/pkg/log"
+	"github.com/dexidp/dex/storage"
+)
+
+// SMSSender sends text messages to phone numbers, for the SMS second factor.
+type SMSSender interface {
+	SendSMS(ctx context.Context, phone, message string) error
+}
+
+// SMSConfig enables the SMS second factor. Users with a phone number who
+// didn't enroll a TOTP device are texted a one-time code after logging in
+// through a connector, which they must enter to complete the login.
+type SMSConfig struct {
+	Sender SMSSender
+
+	// How long codes are valid for. Defaults to 5 minutes, and can't be more
+	// than 15.
+	CodeValidFor time.Duration
+
+	// At most MaxCodes are sent to a user per RateLimitPeriod. Default to 3
+	// codes per 15 minutes.
+	MaxCodes        int
+	RateLimitPeriod time.Duration
+}
+
+const (
+	smsCodeDigits = 6
+
+	maxSMSCodeValidFor = 15 * time.Minute
+
+	// Number of invalid codes after which a login is refused.
+	maxSMSFailures = 5
+)
+
+var (
+	// E.164 phone numbers: a "+", the country code and the subscriber number,
+	// at most 15 digits in total.
+	phoneRegexp = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`)
+
+	errSMSCodeUsed = errors.New("SMS code already used")
+)
+
+func (c SMSConfig) validate() error {
+	if c.Sender == nil {
+		return nil
+	}
+	if c.CodeValidFor < 0 || c.CodeValidFor > maxSMSCodeValidFor {
+		return fmt.Errorf("code lifetime must be between 0 and %v", maxSMSCodeValidFor)
+	}
+	if c.MaxCodes < 0 || c.RateLimitPeriod < 0 {
+		return errors.New("rate limit can't be negative")
+	}
+	return nil
+}
+
+// logSMSSender logs messages instead of sending them.
+type logSMSSender struct {
+	logger log.Logger
+}
+
+// NewLogSMSSender returns a sender which logs the messages, codes included,
+// rather than sending them. It's only meant for development and tests.
+func NewLogSMSSender(logger log.Logger) SMSSender {
+	return logSMSSender{logger}
+}
+
+func (s logSMSSender) SendSMS(ctx context.Context, phone, message string) error {
+	s.logger.Infof("sms to %q: %s", phone, message)
+	return nil
+}
+
+// webhookSMSSender posts messages to a gateway, which sends them on.
+type webhookSMSSender struct {
+	url    string
+	client *http.Client
+}
+
+// NewWebhookSMSSender returns a sender posting each message as a JSON object of
+// the form {"phone": "+15551234567", "message": "..."} to a URL, for a gateway
+// to deliver. Responses other than 2xx are errors.
+func NewWebhookSMSSender(url string, client *http.Client) SMSSender {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	return webhookSMSSender{url, client}
+}
+
+func (s webhookSMSSender) SendSMS(ctx context.Context, phone, message string) error {
+	body, err := json.Marshal(struct {
+		Phone   string `json:"phone"`
+		Message string `json:"message"`
+	}{phone, message})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("sms webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// newSMSCode returns a random, zero padded, 6-digit code.
+func newSMSCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%0*d", smsCodeDigits, n.Int64()), nil
+}
+
+// hashSMSCode returns the hash of a code kept in the auth request, so codes
+// can't be read from the storage.
+func hashSMSCode(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// validSMSCode reports if a code matches the one last sent for an auth request,
+// and hasn't expired.
+func validSMSCode(sent storage.SMSCode, code string, now time.Time) bool {
+	if sent.Hash == "" || len(code) != smsCodeDigits || now.After(sent.Expiry) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hashSMSCode(code)), []byte(sent.Hash)) == 1
+}
+
+// maskPhone hides all but the last digits of a phone number, to remind users
+// which one a code was sent to.
+func maskPhone(phone string) string {
+	if len(phone) <= 4 {
+		return phone
+	}
+	return strings.Repeat("•", 4) + phone[len(phone)-4:]
+}
+
+// smsLimiter limits the number of codes sent to each user.
+type smsLimiter struct {
+	codes  int
+	period time.Duration
+
+	mu sync.Mutex
+	// When codes were sent to each user within the last period, guarded by
+	// the mutex. They're only kept in memory, so each dex instance enforces
+	// the limit separately.
+	sent map[string][]time.Time
+}
+
+func newSMSLimiter(codes int, period time.Duration) *smsLimiter {
+	if codes == 0 {
+		codes = 3
+	}
+	return &smsLimiter{
+		codes:  codes,
+		period: value(period, 15*time.Minute),
+		sent:   make(map[string][]time.Time),
+	}
+}
+
+// allow records a code being sent to a user, unless too many already were
+// within the period.
+func (l *smsLimiter) allow(userID string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for id, times := range l.sent {
+		recent := times[:0]
+		for _, t := range times {
+			if now.Sub(t) < l.period {
+				recent = append(recent, t)
+			}
+		}
+		if len(recent) == 0 {
+			delete(l.sent, id)
+		} else {
+			l.sent[id] = recent
+		}
+	}
+	if len(l.sent[userID]) >= l.codes {
+		return false
+	}
+	l.sent[userID] = append(l.sent[userID], now)
+	return true
+}
+
+// sendSMSCode texts a new code to a user, replacing the one previously sent
+// for the auth request. It returns connector.ErrRateLimited if the user was
+// sent too many codes.
+func (s *Server) sendSMSCode(ctx context.Context, authReq storage.AuthRequest, user storage.User) error {
+	if !s.smsLimiter.allow(user.ID, s.now()) {
+		s.logger.Infof("too many SMS codes sent to user %q", user.ID)
+		return connector.ErrRateLimited
+	}
+	code, err := newSMSCode()
+	if err != nil {
+		return fmt.Errorf("generate code: %v", err)
+	}
+	updater := func(a storage.AuthRequest) (storage.AuthRequest, error) {
+		a.SMSCode = storage.SMSCode{
+			Hash:   hashSMSCode(code),
+			Expiry: s.now().Add(s.smsCodeValidFor),
+		}
+		return a, nil
+	}
+	if err := s.storage.UpdateAuthRequest(authReq.ID, updater); err != nil {
+		return fmt.Errorf("update auth request: %v", err)
+	}
+	message := fmt.Sprintf("Your %s login code is %s. It expires in %v.", s.issuerURL.Host, code, s.smsCodeValidFor)
+	return s.smsSender.SendSMS(ctx, user.Phone, message)
+}
+
+// handleSMS texts a code to users with a phone number after they've logged in
+// through a connector, and marks the authorization request as logged in once
+// they've entered it. A code is sent when the page is first shown, or when the
+// previous one expired or the user asks for a new one.
+func (s *Server) handleSMS(w http.ResponseWriter, r *http.Request) {
+	if s.maintenance.loginsBlocked() {
+		s.renderError(w, http.StatusServiceUnavailable, "Logins are temporarily disabled for maintenance. Please try again later.")
+		return
+	}
+
+	authReq, err := s.storage.GetAuthRequest(r.FormValue("req"))
+	if err != nil {
+		s.logger.Errorf("Failed to get auth request: %v", err)
+		if err == storage.ErrNotFound {
+			s.renderError(w, http.StatusBadRequest, "Login session expired.")
+		} else {
+			s.renderError(w, http.StatusInternalServerError, "Database error.")
+		}
+		return
+	}
+	if authReq.LoggedIn || authReq.Claims.UserID == "" || s.awaitingEmail(authReq) {
+		s.renderError(w, http.StatusBadRequest, "Login process is not awaiting a second factor.")
+		return
+	}
+
+	user, err := s.storage.GetUserByRemoteIdentity(authReq.ConnectorID, authReq.Claims.UserID)
+	if err != nil {
+		s.logger.Errorf("Failed to get user: %v", err)
+		s.renderError(w, http.StatusInternalServerError, "Database error.")
+		return
+	}
+	if s.secondFactorPath(user) != "/sms" {
+		s.renderError(w, http.StatusBadRequest, "Two-factor authentication by text message is not enabled for this user.")
+		return
+	}
+	phone := maskPhone(user.Phone)
+
+	// send texts a new code and renders the form, or the rate limit error.
+	send := func() {
+		if err := s.sendSMSCode(r.Context(), authReq, user); err != nil {
+			if err == connector.ErrRateLimited {
+				w.WriteHeader(http.StatusTooManyRequests)
+				if err := s.templates.sms(w, r.URL.String(), phone, false, true); err != nil {
+					s.logger.Errorf("Server template error: %v", err)
+				}
+				return
+			}
+			s.logger.Errorf("Failed to send SMS code: %v", err)
+			s.renderError(w, http.StatusInternalServerError, "Failed to send the code.")
+			return
+		}
+		if err := s.templates.sms(w, r.URL.String(), phone, false, false); err != nil {
+			s.logger.Errorf("Server template error: %v", err)
+		}
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if authReq.SMSCode.Hash == "" || s.now().After(authReq.SMSCode.Expiry) {
+			send()
+			return
+		}
+		if err := s.templates.sms(w, r.URL.String(), phone, false, false); err != nil {
+			s.logger.Errorf("Server template error: %v", err)
+		}
+	case http.MethodPost:
+		if r.PostFormValue("resend") != "" {
+			send()
+			return
+		}
+
+		code := strings.Replace(r.PostFormValue("code"), " ", "", -1)
+		if validSMSCode(authReq.SMSCode, code, s.now()) {
+			// Consume the code while logging the user in, so a code entered
+			// twice concurrently only logs in once.
+			updater := func(a storage.AuthRequest) (storage.AuthRequest, error) {
+				if a.SMSCode.Hash != authReq.SMSCode.Hash {
+					return a, errSMSCodeUsed
+				}
+				a.SMSCode = storage.SMSCode{}
+				a.LoggedIn = true
+				return a, nil
+			}
+			if err := s.storage.UpdateAuthRequest(authReq.ID, updater); err != nil {
+				if err == errSMSCodeUsed {
+					s.renderError(w, http.StatusBadRequest, "The code was already used.")
+					return
+				}
+				s.logger.Errorf("Failed to update auth request: %v", err)
+				s.renderError(w, http.StatusInternalServerError, "Database error.")
+				return
+			}
+			s.logger.Infof("login successful: connector %q, username=%q, email=%q, groups=%q",
+				authReq.ConnectorID, authReq.Claims.Username, authReq.Claims.Email, authReq.Claims.Groups)
+			http.Redirect(w, r, s.absPath("/approval")+"?req="+authReq.ID, http.StatusSeeOther)
+			return
+		}
+
+		s.failureDelay.wait(r.Context())
+		var failures int
+		updater := func(a storage.AuthRequest) (storage.AuthRequest, error) {
+			a.SecondFactorFailures++
+			failures = a.SecondFactorFailures
+			return a, nil
+		}
+		if err := s.storage.UpdateAuthRequest(authReq.ID, updater); err != nil {
+			s.logger.Errorf("Failed to update auth request: %v", err)
+			s.renderError(w, http.StatusInternalServerError, "Database error.")
+			return
+		}
+		if failures >= maxSMSFailures {
+			identity := connector.Identity{Username: authReq.Claims.Username, Email: authReq.Claims.Email}
+			s.denyLogin(w, r, authReq, identity, errSMSFailed)
+			return
+		}
+		if err := s.templates.sms(w, r.URL.String(), phone, true, false); err != nil {
+			s.logger.Errorf("Server template error: %v", err)
+		}
+	default:
+		s.renderError(w, http.StatusBadRequest, "Unsupported request method.")
+	}
+}
+
+// handleAdminUserPhone reports the phone number codes are texted to on GET,
+// and sets it on PUT with a body of the form {"phone": "+15551234567"}. An
+// empty number turns the SMS second factor off for the user.
+func (s *Server) handleAdminUserPhone(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["user"]
+
+	var u storage.User
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		u, err = s.storage.GetUser(userID)
+	case http.MethodPut:
+		var req struct {
+			Phone *string `json:"phone"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Phone == nil {
+			s.tokenErrHelper(w, errInvalidRequest, `Request body must be of the form {"phone": "+15551234567"}.`, http.StatusBadRequest)
+			return
+		}
+		if *req.Phone != "" && !phoneRegexp.MatchString(*req.Phone) {
+			s.tokenErrHelper(w, errInvalidRequest, "Phone number must be in E.164 format, such as +15551234567.", http.StatusBadRequest)
+			return
+		}
+		err = s.storage.UpdateUser(userID, func(old storage.User) (storage.User, error) {
+			old.Phone = *req.Phone
+			u = old
+			return old, nil
+		})
+		if err == nil {
+			s.logger.Infof("phone number of user %q updated", userID)
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		s.tokenErrHelper(w, errInvalidRequest, "Unsupported request method.", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		if err == storage.ErrNotFound {
+			s.tokenErrHelper(w, errInvalidRequest, "User not found.", http.StatusNotFound)
+			return
+		}
+		s.logger.Errorf("failed to update user: %v", err)
+		s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+
+	data, err := json.Marshal(struct {
+		ID    string `json:"id"`
+		Phone string `json:"phone"`
+	}{u.ID, u.Phone})
+	if err != nil {
+		s.logger.Errorf("failed to marshal user: %v", err)
+		s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
@@ -0,0 +1,271 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dexidp/dex/storage"
+)
+
+type smsMessage struct {
+	phone   string
+	message string
+}
+
+// capturingSMSSender records messages instead of sending them.
+type capturingSMSSender struct {
+	sent []smsMessage
+}
+
+func (s *capturingSMSSender) SendSMS(ctx context.Context, phone, message string) error {
+	s.sent = append(s.sent, smsMessage{phone, message})
+	return nil
+}
+
+var smsCodeRegexp = regexp.MustCompile(`\b[0-9]{6}\b`)
+
+func TestSMSCode(t *testing.T) {
+	now := time.Now()
+	seen := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		code, err := newSMSCode()
+		if err != nil {
+			t.Fatalf("generate code: %v", err)
+		}
+		if !regexp.MustCompile(`^[0-9]{6}$`).MatchString(code) {
+			t.Fatalf("expected 6 digits, got %q", code)
+		}
+		seen[code] = true
+
+		sent := storage.SMSCode{Hash: hashSMSCode(code), Expiry: now.Add(time.Minute)}
+		if !validSMSCode(sent, code, now) {
+			t.Errorf("expected code %s to be valid", code)
+		}
+		if validSMSCode(sent, code, now.Add(2*time.Minute)) {
+			t.Errorf("expected code %s to expire", code)
+		}
+		if validSMSCode(storage.SMSCode{}, code, now) {
+			t.Errorf("expected code %s to be invalid once used", code)
+		}
+	}
+	if len(seen) < 2 {
+		t.Errorf("expected random codes, got %v", seen)
+	}
+
+	sent := storage.SMSCode{Hash: hashSMSCode("012345"), Expiry: now.Add(time.Minute)}
+	for _, code := range []string{"012346", "12345", "0123456", ""} {
+		if validSMSCode(sent, code, now) {
+			t.Errorf("expected code %q to be invalid", code)
+		}
+	}
+}
+
+func TestSMSLogin(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	now := time.Now()
+	sender := &capturingSMSSender{}
+	httpServer, server := newTestServer(ctx, t, func(c *Config) {
+		c.Now = func() time.Time { return now }
+		c.SMS = SMSConfig{Sender: sender, CodeValidFor: 5 * time.Minute, MaxCodes: 100}
+	})
+	defer httpServer.Close()
+
+	client := storage.Client{ID: "client", Secret: "secret", RedirectURIs: []string{"https://example.com/callback"}}
+	if err := server.storage.CreateClient(client); err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+	// The mock connector returns this user ID.
+	user := storage.User{
+		ID:               storage.NewID(),
+		Phone:            "+15551234567",
+		RemoteIdentities: []storage.RemoteIdentity{{ConnectorID: "mock", ConnectorUserID: "0-385-28089-0"}},
+	}
+	if err := server.storage.CreateUser(user); err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+
+	do := func(method, target string, form url.Values) *httptest.ResponseRecorder {
+		var r *http.Request
+		if form != nil {
+			r = httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		} else {
+			r = httptest.NewRequest(method, target, nil)
+		}
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, r)
+		return rr
+	}
+	// login logs in through the connector and shows the SMS page, returning
+	// the ID of the auth request and the code sent.
+	login := func() (string, string) {
+		authReq := storage.AuthRequest{
+			ID:            storage.NewID(),
+			ClientID:      client.ID,
+			ConnectorID:   "mock",
+			RedirectURI:   client.RedirectURIs[0],
+			State:         "state",
+			ResponseTypes: []string{responseTypeCode},
+			Scopes:        []string{scopeOpenID},
+			Expiry:        now.Add(time.Hour),
+		}
+		if err := server.storage.CreateAuthRequest(authReq); err != nil {
+			t.Fatalf("create auth request: %v", err)
+		}
+		rr := do("GET", "/callback?state="+authReq.ID, nil)
+		if location := rr.Header().Get("Location"); rr.Code != http.StatusSeeOther || !strings.HasPrefix(location, "/sms?") {
+			t.Fatalf("expected a redirect to the SMS page, got %d %q", rr.Code, location)
+		}
+		if a, err := server.storage.GetAuthRequest(authReq.ID); err != nil || a.LoggedIn {
+			t.Fatalf("expected auth request not to be logged in before entering a code: %v", err)
+		}
+
+		sent := len(sender.sent)
+		if rr := do("GET", "/sms?req="+authReq.ID, nil); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "4567") {
+			t.Fatalf("expected the code form, got %d: %s", rr.Code, rr.Body)
+		}
+		if len(sender.sent) != sent+1 {
+			t.Fatalf("expected a code to be sent")
+		}
+		m := sender.sent[sent]
+		if m.phone != user.Phone {
+			t.Errorf("expected the code to be sent to %s, got %s", user.Phone, m.phone)
+		}
+		return authReq.ID, smsCodeRegexp.FindString(m.message)
+	}
+	loggedIn := func(id string) bool {
+		a, err := server.storage.GetAuthRequest(id)
+		if err != nil {
+			t.Fatalf("get auth request: %v", err)
+		}
+		return a.LoggedIn
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		id, code := login()
+		// Showing the page again doesn't send another code.
+		sent := len(sender.sent)
+		if do("GET", "/sms?req="+id, nil); len(sender.sent) != sent {
+			t.Errorf("expected no other code to be sent, got %d", len(sender.sent)-sent)
+		}
+		rr := do("POST", "/sms?req="+id, url.Values{"code": {code}})
+		if location := rr.Header().Get("Location"); rr.Code != http.StatusSeeOther || !strings.HasPrefix(location, "/approval?") {
+			t.Fatalf("expected a redirect to the approval page, got %d %q: %s", rr.Code, location, rr.Body)
+		}
+		if !loggedIn(id) {
+			t.Errorf("expected the auth request to be logged in")
+		}
+		if rr := do("POST", "/sms?req="+id, url.Values{"code": {code}}); rr.Code != http.StatusBadRequest {
+			t.Errorf("expected a used code to be rejected, got %d", rr.Code)
+		}
+	})
+
+	t.Run("resend replaces the previous code", func(t *testing.T) {
+		id, first := login()
+		if rr := do("POST", "/sms?req="+id, url.Values{"resend": {"1"}}); rr.Code != http.StatusOK {
+			t.Fatalf("expected a new code to be sent, got %d: %s", rr.Code, rr.Body)
+		}
+		second := smsCodeRegexp.FindString(sender.sent[len(sender.sent)-1].message)
+		if first != second {
+			if rr := do("POST", "/sms?req="+id, url.Values{"code": {first}}); rr.Code != http.StatusOK || loggedIn(id) {
+				t.Fatalf("expected the replaced code to be rejected, got %d", rr.Code)
+			}
+		}
+		if rr := do("POST", "/sms?req="+id, url.Values{"code": {second}}); rr.Code != http.StatusSeeOther {
+			t.Errorf("expected the latest code to log the user in, got %d: %s", rr.Code, rr.Body)
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		id, code := login()
+		now = now.Add(6 * time.Minute)
+		rr := do("POST", "/sms?req="+id, url.Values{"code": {code}})
+		if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "Invalid or expired code.") {
+			t.Fatalf("expected an expired code to be rejected, got %d: %s", rr.Code, rr.Body)
+		}
+		if loggedIn(id) {
+			t.Errorf("expected the auth request not to be logged in")
+		}
+	})
+
+	t.Run("too many attempts", func(t *testing.T) {
+		id, code := login()
+		wrong := "000000"
+		if code == wrong {
+			wrong = "000001"
+		}
+		for i := 1; i < maxSMSFailures; i++ {
+			if rr := do("POST", "/sms?req="+id, url.Values{"code": {wrong}}); rr.Code != http.StatusOK {
+				t.Fatalf("attempt %d: expected the form to be shown again, got %d", i, rr.Code)
+			}
+		}
+		rr := do("POST", "/sms?req="+id, url.Values{"code": {wrong}})
+		if location := rr.Header().Get("Location"); rr.Code != http.StatusSeeOther || !strings.Contains(location, "error=access_denied") {
+			t.Fatalf("expected the login to be denied, got %d %q", rr.Code, location)
+		}
+		if _, err := server.storage.GetAuthRequest(id); err != storage.ErrNotFound {
+			t.Errorf("expected the auth request to be deleted, got %v", err)
+		}
+		if rr := do("POST", "/sms?req="+id, url.Values{"code": {code}}); rr.Code != http.StatusBadRequest {
+			t.Errorf("expected the correct code to be rejected after the lockout, got %d", rr.Code)
+		}
+	})
+
+	t.Run("rate limited", func(t *testing.T) {
+		server.smsLimiter = newSMSLimiter(1, time.Hour)
+		id, _ := login()
+		if rr := do("POST", "/sms?req="+id, url.Values{"resend": {"1"}}); rr.Code != http.StatusTooManyRequests {
+			t.Errorf("expected the code to be rate limited, got %d: %s", rr.Code, rr.Body)
+		}
+	})
+}
+
+func TestAdminUserPhone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, server := newTestServer(ctx, t, func(c *Config) {
+		c.AdminAPIKey = "admin-key"
+	})
+	defer httpServer.Close()
+
+	user := storage.User{ID: storage.NewID()}
+	if err := server.storage.CreateUser(user); err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+
+	tests := []struct {
+		body      string
+		wantCode  int
+		wantPhone string
+	}{
+		{`{"phone": "+15551234567"}`, http.StatusOK, "+15551234567"},
+		{`{"phone": "555-1234"}`, http.StatusBadRequest, "+15551234567"},
+		{`{}`, http.StatusBadRequest, "+15551234567"},
+		{`{"phone": ""}`, http.StatusOK, ""},
+	}
+	for _, tc := range tests {
+		r := httptest.NewRequest("PUT", "/admin/users/"+user.ID+"/phone", strings.NewReader(tc.body))
+		r.Header.Set("Authorization", "Bearer admin-key")
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, r)
+		if rr.Code != tc.wantCode {
+			t.Errorf("%s: expected %d, got %d: %s", tc.body, tc.wantCode, rr.Code, rr.Body)
+		}
+		u, err := server.storage.GetUser(user.ID)
+		if err != nil {
+			t.Fatalf("get user: %v", err)
+		}
+		if u.Phone != tc.wantPhone {
+			t.Errorf("%s: expected phone %q, got %q", tc.body, tc.wantPhone, u.Phone)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/dexidp/dex/connector"
+	"github.com/dexidp/dex/storage"
+)
+
+// startDirectorySync periodically checks users against the directories of the
+// connectors they were created through.
+func (s *Server) startDirectorySync(ctx context.Context, frequency time.Duration, prune bool) {
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(frequency):
+				if err := s.syncDirectoryUsers(ctx, prune); err != nil {
+					s.logger.Errorf("directory sync failed: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// syncDirectoryUsers finds users created through a connector implementing
+// connector.UserLister who no longer exist in its directory. With prune set
+// they're disabled and their refresh tokens revoked, otherwise they're only
+// logged.
+//
+// Users are never pruned for a directory that lists no users at all, which is
+// more likely a misconfigured search than an empty directory.
+func (s *Server) syncDirectoryUsers(ctx context.Context, prune bool) error {
+	connectors, err := s.storage.ListConnectors()
+	if err != nil {
+		return fmt.Errorf("list connectors: %v", err)
+	}
+	remoteIDs := make(map[string]map[string]bool)
+	for _, c := range connectors {
+		conn, err := s.getConnector(c.ID)
+		if err != nil {
+			return err
+		}
+		lister, ok := conn.Connector.(connector.UserLister)
+		if !ok {
+			continue
+		}
+		ids, err := lister.ListUserIDs(ctx)
+		if err != nil {
+			return fmt.Errorf("list users of connector %q: %v", c.ID, err)
+		}
+		if len(ids) == 0 {
+			s.logger.Errorf("directory sync: connector %q listed no users, skipping it", c.ID)
+			continue
+		}
+		remoteIDs[c.ID] = make(map[string]bool, len(ids))
+		for _, id := range ids {
+			remoteIDs[c.ID][id] = true
+		}
+	}
+	if len(remoteIDs) == 0 {
+		return nil
+	}
+
+	users, err := s.storage.ListUsers()
+	if err != nil {
+		return fmt.Errorf("list users: %v", err)
+	}
+	for _, u := range users {
+		if u.Disabled || len(u.RemoteIdentities) == 0 {
+			continue
+		}
+		// Identities linked later don't make a user originate from another
+		// connector.
+		origin := u.RemoteIdentities[0]
+		ids, ok := remoteIDs[origin.ConnectorID]
+		if !ok || ids[origin.ConnectorUserID] {
+			continue
+		}
+		if !prune {
+			s.logger.Infof("directory sync: user %q was removed from connector %q", u.ID, origin.ConnectorID)
+			continue
+		}
+
+		s.logger.Infof("directory sync: user %q was removed from connector %q, disabling it", u.ID, origin.ConnectorID)
+		err := s.storage.UpdateUser(u.ID, func(old storage.User) (storage.User, error) {
+			old.Disabled = true
+			u = old
+			return old, nil
+		})
+		if err != nil {
+			return fmt.Errorf("disable user %q: %v", u.ID, err)
+		}
+		if err := s.revokeUserSessions(u); err != nil {
+			return fmt.Errorf("revoke sessions of user %q: %v", u.ID, err)
+		}
+	}
+	return nil
+}
@@ -4,20 +4,32 @@ import (
 	"fmt"
 	"html/template"
 	"io"
+	"io/fs"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
+
+	"github.com/dexidp/dex/storage"
+	"github.com/dexidp/dex/web"
 )
 
 const (
-	tmplApproval = "approval.html"
-	tmplLogin    = "login.html"
-	tmplPassword = "password.html"
-	tmplOOB      = "oob.html"
-	tmplError    = "error.html"
+	tmplApproval  = "approval.html"
+	tmplLogin     = "login.html"
+	tmplPassword  = "password.html"
+	tmplOOB       = "oob.html"
+	tmplTOTP      = "totp.html"
+	tmplSMS       = "sms.html"
+	tmplEmail     = "email.html"
+	tmplWebAuthn  = "webauthn.html"
+	tmplMagicLink = "magiclink.html"
+	tmplLogout    = "logout.html"
+	tmplError     = "error.html"
 )
 
 var requiredTmpls = []string{
@@ -25,19 +37,39 @@ var requiredTmpls = []string{
 	tmplLogin,
 	tmplPassword,
 	tmplOOB,
+	tmplTOTP,
+	tmplSMS,
+	tmplEmail,
+	tmplWebAuthn,
+	tmplMagicLink,
+	tmplLogout,
 	tmplError,
 }
 
 type templates struct {
-	loginTmpl    *template.Template
-	approvalTmpl *template.Template
-	passwordTmpl *template.Template
-	oobTmpl      *template.Template
-	errorTmpl    *template.Template
+	loginTmpl     *template.Template
+	approvalTmpl  *template.Template
+	passwordTmpl  *template.Template
+	oobTmpl       *template.Template
+	totpTmpl      *template.Template
+	smsTmpl       *template.Template
+	emailTmpl     *template.Template
+	webauthnTmpl  *template.Template
+	magicLinkTmpl *template.Template
+	logoutTmpl    *template.Template
+	errorTmpl     *template.Template
+
+	// A copy of the templates which is never executed, so it can still be
+	// cloned to render the pages of connectors with their own branding.
+	unbranded *template.Template
+
+	mu      sync.Mutex
+	branded map[storage.ConnectorBranding]*templates
 }
 
 type webConfig struct {
 	dir       string
+	themeDir  string
 	logoURL   string
 	issuer    string
 	theme     string
@@ -95,6 +127,9 @@ func loadWebConfig(c webConfig) (static, theme http.Handler, templates *template
 	if c.logoURL == "" {
 		c.logoURL = join(c.issuerURL, "theme/logo.png")
 	}
+	if c.themeDir != "" {
+		return loadThemeBundle(c)
+	}
 
 	if err := dirExists(c.dir); err != nil {
 		return nil, nil, nil, fmt.Errorf("load web dir: %v", err)
@@ -117,6 +152,92 @@ func loadWebConfig(c webConfig) (static, theme http.Handler, templates *template
 	return
 }
 
+// overlayFS serves files from the first of its file systems that has them.
+type overlayFS []http.FileSystem
+
+func (o overlayFS) Open(name string) (http.File, error) {
+	var err error
+	for _, fsys := range o {
+		var f http.File
+		if f, err = fsys.Open(name); err == nil {
+			return f, nil
+		}
+	}
+	return nil, err
+}
+
+// loadThemeBundle loads a theme bundle from a directory laid out as:
+//
+//    ( theme directory )
+//    |- static
+//    |- templates
+//
+// Templates and assets the bundle doesn't provide fall back to the ones
+// compiled into dex. The bundle's static assets are served at both "/static"
+// and "/theme", so it can replace the theme's logo and stylesheet.
+func loadThemeBundle(c webConfig) (static, theme http.Handler, templates *templates, err error) {
+	if err := dirExists(c.themeDir); err != nil {
+		return nil, nil, nil, fmt.Errorf("load theme dir: %v", err)
+	}
+	builtinStatic, err := fs.Sub(web.FS, "static")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	themeDir := path.Join("themes", c.theme)
+	if _, err := fs.Stat(web.FS, themeDir); err != nil {
+		return nil, nil, nil, fmt.Errorf("unknown theme %q", c.theme)
+	}
+	builtinTheme, err := fs.Sub(web.FS, themeDir)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	bundleStatic := http.Dir(filepath.Join(c.themeDir, "static"))
+	static = http.FileServer(overlayFS{bundleStatic, http.FS(builtinStatic)})
+	theme = http.FileServer(overlayFS{bundleStatic, http.FS(builtinTheme)})
+
+	templates, err = loadThemeTemplates(c, os.DirFS(c.themeDir))
+	return
+}
+
+// loadThemeTemplates parses the compiled-in templates, then the templates of a
+// theme bundle, which replace the compiled-in templates of the same name.
+func loadThemeTemplates(c webConfig, bundle fs.FS) (*templates, error) {
+	tmpls, err := template.New("").Funcs(templateFuncs(c)).ParseFS(web.FS, "templates/*.html")
+	if err != nil {
+		return nil, fmt.Errorf("parse compiled-in templates: %v", err)
+	}
+
+	files, err := fs.ReadDir(bundle, "templates")
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("read dir: %v", err)
+	}
+	filenames := []string{}
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		filenames = append(filenames, path.Join("templates", file.Name()))
+	}
+	if len(filenames) > 0 {
+		if tmpls, err = tmpls.ParseFS(bundle, filenames...); err != nil {
+			return nil, fmt.Errorf("parse theme templates: %v", err)
+		}
+	}
+	return lookupTemplates(tmpls)
+}
+
+func templateFuncs(c webConfig) template.FuncMap {
+	return template.FuncMap{
+		"issuer": func() string { return c.issuer },
+		"logo":   func() string { return c.logoURL },
+		"url":    func(s string) string { return join(c.issuerURL, s) },
+		"lower":  strings.ToLower,
+		// Only connectors have a support contact, see withBranding.
+		"support": func() string { return "" },
+	}
+}
+
 // loadTemplates parses the expected templates from the provided directory.
 func loadTemplates(c webConfig, templatesDir string) (*templates, error) {
 	files, err := ioutil.ReadDir(templatesDir)
@@ -135,17 +256,27 @@ func loadTemplates(c webConfig, templatesDir string) (*templates, error) {
 		return nil, fmt.Errorf("no files in template dir %q", templatesDir)
 	}
 
-	funcs := map[string]interface{}{
-		"issuer": func() string { return c.issuer },
-		"logo":   func() string { return c.logoURL },
-		"url":    func(s string) string { return join(c.issuerURL, s) },
-		"lower":  strings.ToLower,
+	tmpls, err := template.New("").Funcs(templateFuncs(c)).ParseFiles(filenames...)
+	if err != nil {
+		return nil, fmt.Errorf("parse files: %v", err)
 	}
+	return lookupTemplates(tmpls)
+}
 
-	tmpls, err := template.New("").Funcs(funcs).ParseFiles(filenames...)
+// lookupTemplates checks all the templates dex renders have been parsed.
+func lookupTemplates(tmpls *template.Template) (*templates, error) {
+	t, err := newTemplates(tmpls)
 	if err != nil {
-		return nil, fmt.Errorf("parse files: %v", err)
+		return nil, err
 	}
+	// html/template can't clone templates once they've been executed.
+	if t.unbranded, err = tmpls.Clone(); err != nil {
+		return nil, fmt.Errorf("clone templates: %v", err)
+	}
+	return t, nil
+}
+
+func newTemplates(tmpls *template.Template) (*templates, error) {
 	missingTmpls := []string{}
 	for _, tmplName := range requiredTmpls {
 		if tmpls.Lookup(tmplName) == nil {
@@ -156,14 +287,57 @@ func loadTemplates(c webConfig, templatesDir string) (*templates, error) {
 		return nil, fmt.Errorf("missing template(s): %s", missingTmpls)
 	}
 	return &templates{
-		loginTmpl:    tmpls.Lookup(tmplLogin),
-		approvalTmpl: tmpls.Lookup(tmplApproval),
-		passwordTmpl: tmpls.Lookup(tmplPassword),
-		oobTmpl:      tmpls.Lookup(tmplOOB),
-		errorTmpl:    tmpls.Lookup(tmplError),
+		loginTmpl:     tmpls.Lookup(tmplLogin),
+		approvalTmpl:  tmpls.Lookup(tmplApproval),
+		passwordTmpl:  tmpls.Lookup(tmplPassword),
+		oobTmpl:       tmpls.Lookup(tmplOOB),
+		totpTmpl:      tmpls.Lookup(tmplTOTP),
+		smsTmpl:       tmpls.Lookup(tmplSMS),
+		emailTmpl:     tmpls.Lookup(tmplEmail),
+		webauthnTmpl:  tmpls.Lookup(tmplWebAuthn),
+		magicLinkTmpl: tmpls.Lookup(tmplMagicLink),
+		logoutTmpl:    tmpls.Lookup(tmplLogout),
+		errorTmpl:     tmpls.Lookup(tmplError),
 	}, nil
 }
 
+// withBranding returns the templates rendering pages with a connector's
+// branding. Fields the connector doesn't set keep the issuer's branding.
+func (t *templates) withBranding(b storage.ConnectorBranding) *templates {
+	if b == (storage.ConnectorBranding{}) || t.unbranded == nil {
+		return t
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if branded, ok := t.branded[b]; ok {
+		return branded
+	}
+
+	tmpls, err := t.unbranded.Clone()
+	if err != nil {
+		return t
+	}
+	funcs := template.FuncMap{}
+	if b.Name != "" {
+		funcs["issuer"] = func() string { return b.Name }
+	}
+	if b.LogoURL != "" {
+		funcs["logo"] = func() string { return b.LogoURL }
+	}
+	if b.SupportContact != "" {
+		funcs["support"] = func() string { return b.SupportContact }
+	}
+	branded, err := newTemplates(tmpls.Funcs(funcs))
+	if err != nil {
+		return t
+	}
+	if t.branded == nil {
+		t.branded = make(map[storage.ConnectorBranding]*templates)
+	}
+	t.branded[b] = branded
+	return branded
+}
+
 var scopeDescriptions = map[string]string{
 	"offline_access": "Have offline access",
 	"profile":        "View basic profile information",
@@ -201,7 +375,59 @@ func (t *templates) password(w http.ResponseWriter, postURL, lastUsername, usern
 	return renderTemplate(w, t.passwordTmpl, data)
 }
 
-func (t *templates) approval(w http.ResponseWriter, authReqID, username, clientName string, scopes []string) error {
+func (t *templates) totp(w http.ResponseWriter, postURL string, lastWasInvalid bool) error {
+	data := struct {
+		PostURL string
+		Invalid bool
+	}{postURL, lastWasInvalid}
+	return renderTemplate(w, t.totpTmpl, data)
+}
+
+// sms renders the form asking for a code texted to the masked phone number.
+func (t *templates) sms(w http.ResponseWriter, postURL, phone string, lastWasInvalid, rateLimited bool) error {
+	data := struct {
+		PostURL     string
+		Phone       string
+		Invalid     bool
+		RateLimited bool
+	}{postURL, phone, lastWasInvalid, rateLimited}
+	return renderTemplate(w, t.smsTmpl, data)
+}
+
+func (t *templates) email(w http.ResponseWriter, postURL, lastEmail string, lastWasInvalid bool) error {
+	data := struct {
+		PostURL string
+		Email   string
+		Invalid bool
+	}{postURL, lastEmail, lastWasInvalid}
+	return renderTemplate(w, t.emailTmpl, data)
+}
+
+func (t *templates) webauthn(w http.ResponseWriter, postURL, options string, lastWasInvalid, showBacklink bool) error {
+	data := struct {
+		PostURL  string
+		Options  string
+		Invalid  bool
+		BackLink bool
+	}{postURL, options, lastWasInvalid, showBacklink}
+	return renderTemplate(w, t.webauthnTmpl, data)
+}
+
+// magicLink renders the form asking for an email to send a login link to. Once
+// sent, the page tells the user to check their email instead.
+func (t *templates) magicLink(w http.ResponseWriter, postURL, lastEmail string, sent, lastWasInvalid, rateLimited, showBacklink bool) error {
+	data := struct {
+		PostURL     string
+		Email       string
+		Sent        bool
+		Invalid     bool
+		RateLimited bool
+		BackLink    bool
+	}{postURL, lastEmail, sent, lastWasInvalid, rateLimited, showBacklink}
+	return renderTemplate(w, t.magicLinkTmpl, data)
+}
+
+func (t *templates) approval(w http.ResponseWriter, authReqID, username string, client storage.Client, scopes []string) error {
 	accesses := []string{}
 	for _, scope := range scopes {
 		access, ok := scopeDescriptions[scope]
@@ -215,7 +441,11 @@ func (t *templates) approval(w http.ResponseWriter, authReqID, username, clientN
 		Client    string
 		AuthReqID string
 		Scopes    []string
-	}{username, clientName, authReqID, accesses}
+		LogoURL   string
+		ClientURL string
+		PolicyURL string
+		TOSURL    string
+	}{username, client.Name, authReqID, accesses, client.LogoURL, client.ClientURL, client.PolicyURL, client.TOSURL}
 	return renderTemplate(w, t.approvalTmpl, data)
 }
 
@@ -226,12 +456,22 @@ func (t *templates) oob(w http.ResponseWriter, code string) error {
 	return renderTemplate(w, t.oobTmpl, data)
 }
 
+func (t *templates) logout(w http.ResponseWriter) error {
+	return renderTemplate(w, t.logoutTmpl, nil)
+}
+
 func (t *templates) err(w http.ResponseWriter, errCode int, errMsg string) error {
+	return t.retry(w, errCode, errMsg, "")
+}
+
+// retry renders an error page with a link to try again, if retryURL is set.
+func (t *templates) retry(w http.ResponseWriter, errCode int, errMsg, retryURL string) error {
 	w.WriteHeader(errCode)
 	data := struct {
-		ErrType string
-		ErrMsg  string
-	}{http.StatusText(errCode), errMsg}
+		ErrType  string
+		ErrMsg   string
+		RetryURL string
+	}{http.StatusText(errCode), errMsg, retryURL}
 	if err := t.errorTmpl.Execute(w, data); err != nil {
 		return fmt.Errorf("Error rendering template %s: %s", t.errorTmpl.Name(), err)
 	}
@@ -1 +1,140 @@
 package server
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dexidp/dex/storage"
+)
+
+func TestLoadThemeBundle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dex-theme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"templates/header.html": `<html><head><title>Acme Sign In</title></head><body>`,
+		"static/logo.png":       "acme logo",
+	}
+	for name, data := range files {
+		name = filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	static, theme, tmpls, err := loadWebConfig(webConfig{themeDir: dir, issuerURL: "https://dex.example.com"})
+	if err != nil {
+		t.Fatalf("load theme bundle: %v", err)
+	}
+
+	rr := httptest.NewRecorder()
+	if err := tmpls.login(rr, []connectorInfo{{ID: "mock", Name: "Mock", URL: "/auth/mock"}}); err != nil {
+		t.Fatalf("render login page: %v", err)
+	}
+	if body := rr.Body.String(); !strings.Contains(body, "<title>Acme Sign In</title>") || !strings.Contains(body, "Mock") {
+		t.Errorf("expected login page with the theme's title, got %s", body)
+	}
+
+	get := func(h http.Handler, path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		return rr
+	}
+	if rr := get(theme, "/logo.png"); rr.Code != http.StatusOK || rr.Body.String() != "acme logo" {
+		t.Errorf("expected the theme's logo, got %d: %q", rr.Code, rr.Body)
+	}
+	if rr := get(static, "/main.css"); rr.Code != http.StatusOK {
+		t.Errorf("expected compiled-in stylesheet as a fallback, got %d", rr.Code)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "templates", "login.html"), []byte(`{{ template "header.html" }`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := loadWebConfig(webConfig{themeDir: dir}); err == nil {
+		t.Errorf("expected a theme with a malformed template to fail to load")
+	}
+}
+
+func TestConnectorBranding(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, server := newTestServer(ctx, t, nil)
+	defer httpServer.Close()
+
+	branding := storage.ConnectorBranding{
+		Name:           "Example Corp",
+		LogoURL:        "https://example.com/brand.png",
+		SupportContact: "help@example.com",
+	}
+	for _, c := range []storage.Connector{
+		{ID: "branded", Type: "mockPassword", Name: "Branded", ResourceVersion: "1", Config: []byte(`{"username":"foo","password":"bar"}`), Branding: branding},
+		{ID: "plain", Type: "mockPassword", Name: "Plain", ResourceVersion: "1", Config: []byte(`{"username":"foo","password":"bar"}`)},
+	} {
+		if err := server.storage.CreateConnector(c); err != nil {
+			t.Fatalf("create connector: %v", err)
+		}
+	}
+	client := storage.Client{ID: "client", Secret: "secret", RedirectURIs: []string{"https://example.com/callback"}}
+	if err := server.storage.CreateClient(client); err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	loginPage := func(connID string) string {
+		q := url.Values{
+			"client_id":     {client.ID},
+			"redirect_uri":  {client.RedirectURIs[0]},
+			"response_type": {"code"},
+			"scope":         {"openid"},
+			"connector_id":  {connID},
+		}
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, httptest.NewRequest("GET", "/auth?"+q.Encode(), nil))
+		if rr.Code != http.StatusFound {
+			t.Fatalf("%s: expected a redirect to the connector, got %d", connID, rr.Code)
+		}
+		location := rr.Header().Get("Location")
+		rr = httptest.NewRecorder()
+		server.ServeHTTP(rr, httptest.NewRequest("GET", location, nil))
+		return rr.Body.String()
+	}
+
+	body := loginPage("branded")
+	if !strings.Contains(body, "<title>Example Corp</title>") || !strings.Contains(body, branding.LogoURL) {
+		t.Errorf("expected the login page with the connector's branding, got %s", body)
+	}
+	body = loginPage("plain")
+	if !strings.Contains(body, "<title>dex</title>") || !strings.Contains(body, "theme/logo.png") || strings.Contains(body, "Example Corp") {
+		t.Errorf("expected the login page with the global branding, got %s", body)
+	}
+
+	errorPage := func(connID string) string {
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, httptest.NewRequest("GET", "/auth/"+connID+"?req=missing", nil))
+		if rr.Code != http.StatusBadRequest {
+			t.Fatalf("%s: expected an error page, got %d", connID, rr.Code)
+		}
+		return rr.Body.String()
+	}
+	body = errorPage("branded")
+	if !strings.Contains(body, "<title>Example Corp</title>") || !strings.Contains(body, "contact help@example.com") {
+		t.Errorf("expected the error page with the connector's branding, got %s", body)
+	}
+	body = errorPage("plain")
+	if !strings.Contains(body, "<title>dex</title>") || strings.Contains(body, "contact") {
+		t.Errorf("expected the error page with the global branding, got %s", body)
+	}
+}
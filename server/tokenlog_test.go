@@ -0,0 +1,92 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/dexidp/dex/storage"
+)
+
+// logBuffer collects the output of a logger, which background goroutines may
+// write to while a test reads it.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// messageFormatter formats log entries as their message alone.
+type messageFormatter struct{}
+
+func (messageFormatter) Format(e *logrus.Entry) ([]byte, error) {
+	return []byte(e.Message + "\n"), nil
+}
+
+func TestLogTokenIssuance(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logs := new(logBuffer)
+	httpServer, server := newTestServer(ctx, t, func(c *Config) {
+		c.Logger = &logrus.Logger{Out: logs, Formatter: messageFormatter{}, Level: logrus.InfoLevel}
+		c.LogTokenIssuance = true
+	})
+	defer httpServer.Close()
+
+	client := storage.Client{ID: "client", Secret: "secret", RedirectURIs: []string{"https://example.com/callback"}}
+	if err := server.storage.CreateClient(client); err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	jtis := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		rr := exchangeTestAuthCode(server, client, newTestAuthCode(t, server, client))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("exchange code: %d %s", rr.Code, rr.Body)
+		}
+		var resp struct {
+			AccessToken string `json:"access_token"`
+			IDToken     string `json:"id_token"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("unmarshal token response: %v", err)
+		}
+		claims, err := server.verifyIDToken(resp.IDToken)
+		if err != nil {
+			t.Fatalf("verify id token: %v", err)
+		}
+		if claims.JWTID == "" || jtis[claims.JWTID] {
+			t.Fatalf("expected a unique jti, got %q", claims.JWTID)
+		}
+		jtis[claims.JWTID] = true
+
+		out := logs.String()
+		want := `token issued: grant_type="authorization_code" client_id="client" sub="` + claims.Subject + `" connector_id="mock" scope="openid"`
+		if !strings.Contains(out, want) || !strings.Contains(out, `jti="`+claims.JWTID+`"`) {
+			t.Errorf("expected the issuance to be logged with jti %q, got:\n%s", claims.JWTID, out)
+		}
+		for _, secret := range []string{resp.IDToken, resp.AccessToken} {
+			if strings.Contains(out, secret) {
+				t.Errorf("issued token %q was logged", secret)
+			}
+		}
+	}
+}
@@ -0,0 +1,361 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/dexidp/dex/connector"
+	"github.com/dexidp/dex/storage"
+)
+
+// TOTP parameters, the defaults of RFC 6238 that authenticator apps expect.
+//
+// https://tools.ietf.org/html/rfc6238#section-4
+const (
+	totpDigits = 6
+	totpPeriod = 30 // seconds
+
+	// Number of periods before and after the current one a code is accepted
+	// for, to allow for clock drift and slow typists.
+	totpSkew = 1
+
+	// Number of invalid codes after which a login is refused.
+	maxTOTPFailures = 5
+
+	// Number of invalid codes, across logins, after which a user may only
+	// try one code every totpLockout.
+	maxUserTOTPFailures = 10
+	totpLockout         = 15 * time.Minute
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// newTOTPSecret returns a random, base32 encoded TOTP key.
+func newTOTPSecret() (string, error) {
+	key := make([]byte, 20)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(key), nil
+}
+
+// totpCode computes the HOTP value of a key for a counter.
+//
+// https://tools.ietf.org/html/rfc4226#section-5.3
+func totpCode(key []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// totpStep returns the time step a code matches the secret at, if it's the
+// step of the given time or within totpSkew periods of it.
+func totpStep(secret, code string, now time.Time) (int64, bool) {
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(key) == 0 {
+		return 0, false
+	}
+	counter := now.Unix() / totpPeriod
+	step, valid := int64(0), false
+	for i := int64(-totpSkew); i <= totpSkew; i++ {
+		if counter+i < 0 {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, uint64(counter+i))), []byte(code)) == 1 {
+			step, valid = counter+i, true
+		}
+	}
+	return step, valid
+}
+
+// useTOTP checks a code against the secret of a user, confirming it if the
+// user is enrolling. A valid code can only be used once: codes of its time
+// step or earlier ones are refused afterwards. Invalid codes are counted
+// against the user, and errTOTPLocked is returned while a user who entered
+// too many has to wait.
+func (s *Server) useTOTP(userID, code string, enrolling bool) (valid bool, err error) {
+	now := s.now()
+	err = s.storage.UpdateUser(userID, func(old storage.User) (storage.User, error) {
+		valid = false
+		t := old.TOTP
+		if t.Secret == "" || t.Confirmed == enrolling {
+			return old, errTOTPEnrolled
+		}
+		if t.Failures >= maxUserTOTPFailures && now.Before(t.LastFailure.Add(totpLockout)) {
+			return old, errTOTPLocked
+		}
+		if step, ok := totpStep(t.Secret, code, now); ok && step > t.LastStep {
+			t.LastStep = step
+			t.Failures = 0
+			t.Confirmed = true
+			valid = true
+		} else {
+			t.Failures++
+			t.LastFailure = now
+		}
+		old.TOTP = t
+		return old, nil
+	})
+	return valid, err
+}
+
+// totpURI returns the otpauth URI authenticator apps are enrolled with,
+// usually by scanning it as a QR code.
+//
+// https://github.com/google/google-authenticator/wiki/Key-Uri-Format
+func totpURI(issuer, account, secret string) string {
+	q := url.Values{
+		"secret": {secret},
+		"issuer": {issuer},
+	}
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + account,
+		RawQuery: q.Encode(),
+	}
+	return u.String()
+}
+
+// handleTOTP asks users who enrolled a TOTP device for a code after they've
+// logged in through a connector, and marks the authorization request as
+// logged in once they've entered a valid one.
+func (s *Server) handleTOTP(w http.ResponseWriter, r *http.Request) {
+	if s.maintenance.loginsBlocked() {
+		s.renderError(w, http.StatusServiceUnavailable, "Logins are temporarily disabled for maintenance. Please try again later.")
+		return
+	}
+
+	authReq, err := s.storage.GetAuthRequest(r.FormValue("req"))
+	if err != nil {
+		s.logger.Errorf("Failed to get auth request: %v", err)
+		if err == storage.ErrNotFound {
+			s.renderError(w, http.StatusBadRequest, "Login session expired.")
+		} else {
+			s.renderError(w, http.StatusInternalServerError, "Database error.")
+		}
+		return
+	}
+	if authReq.LoggedIn || authReq.Claims.UserID == "" || s.awaitingEmail(authReq) {
+		s.renderError(w, http.StatusBadRequest, "Login process is not awaiting a second factor.")
+		return
+	}
+
+	user, err := s.storage.GetUserByRemoteIdentity(authReq.ConnectorID, authReq.Claims.UserID)
+	if err != nil {
+		s.logger.Errorf("Failed to get user: %v", err)
+		s.renderError(w, http.StatusInternalServerError, "Database error.")
+		return
+	}
+	if !user.TOTP.Confirmed {
+		s.renderError(w, http.StatusBadRequest, "Two-factor authentication is not enabled for this user.")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if err := s.templates.totp(w, r.URL.String(), false); err != nil {
+			s.logger.Errorf("Server template error: %v", err)
+		}
+	case http.MethodPost:
+		code := strings.Replace(r.FormValue("code"), " ", "", -1)
+		valid, err := s.useTOTP(user.ID, code, false)
+		switch err {
+		case nil:
+		case errTOTPLocked:
+			s.logger.Errorf("user %q entered too many invalid TOTP codes, refusing login", user.ID)
+			s.renderError(w, http.StatusTooManyRequests, "Too many invalid codes. Please try again later.")
+			return
+		case errTOTPEnrolled:
+			s.renderError(w, http.StatusBadRequest, "Two-factor authentication is not enabled for this user.")
+			return
+		default:
+			s.logger.Errorf("Failed to update user: %v", err)
+			s.renderError(w, http.StatusInternalServerError, "Database error.")
+			return
+		}
+		if valid {
+			updater := func(a storage.AuthRequest) (storage.AuthRequest, error) {
+				a.LoggedIn = true
+				return a, nil
+			}
+			if err := s.storage.UpdateAuthRequest(authReq.ID, updater); err != nil {
+				s.logger.Errorf("Failed to update auth request: %v", err)
+				s.renderError(w, http.StatusInternalServerError, "Database error.")
+				return
+			}
+			s.logger.Infof("login successful: connector %q, username=%q, email=%q, groups=%q",
+				authReq.ConnectorID, authReq.Claims.Username, authReq.Claims.Email, authReq.Claims.Groups)
+			http.Redirect(w, r, s.absPath("/approval")+"?req="+authReq.ID, http.StatusSeeOther)
+			return
+		}
+
+		s.failureDelay.wait(r.Context())
+		var failures int
+		updater := func(a storage.AuthRequest) (storage.AuthRequest, error) {
+			a.SecondFactorFailures++
+			failures = a.SecondFactorFailures
+			return a, nil
+		}
+		if err := s.storage.UpdateAuthRequest(authReq.ID, updater); err != nil {
+			s.logger.Errorf("Failed to update auth request: %v", err)
+			s.renderError(w, http.StatusInternalServerError, "Database error.")
+			return
+		}
+		if failures >= maxTOTPFailures {
+			identity := connector.Identity{Username: authReq.Claims.Username, Email: authReq.Claims.Email}
+			s.denyLogin(w, r, authReq, identity, errTOTPFailed)
+			return
+		}
+		if err := s.templates.totp(w, r.URL.String(), true); err != nil {
+			s.logger.Errorf("Server template error: %v", err)
+		}
+	default:
+		s.renderError(w, http.StatusBadRequest, "Unsupported request method.")
+	}
+}
+
+type totpEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// handleAdminUserTOTP enrolls a user on POST, returning a new TOTP secret which
+// isn't required at login until it's been confirmed through
+// handleAdminUserTOTPConfirm. On DELETE it removes the enrollment, for users
+// who've lost their device.
+func (s *Server) handleAdminUserTOTP(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["user"]
+	switch r.Method {
+	case http.MethodPost:
+		s.enrollTOTP(w, userID)
+	case http.MethodDelete:
+		err := s.storage.UpdateUser(userID, func(old storage.User) (storage.User, error) {
+			old.TOTP = storage.TOTP{}
+			return old, nil
+		})
+		switch err {
+		case nil:
+			s.logger.Infof("two-factor authentication of user %q reset", userID)
+			w.WriteHeader(http.StatusNoContent)
+		case storage.ErrNotFound:
+			s.tokenErrHelper(w, errInvalidRequest, "User not found.", http.StatusNotFound)
+		default:
+			s.logger.Errorf("failed to update user: %v", err)
+			s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+		}
+	default:
+		w.Header().Set("Allow", "POST, DELETE")
+		s.tokenErrHelper(w, errInvalidRequest, "Unsupported request method.", http.StatusMethodNotAllowed)
+	}
+}
+
+// enrollTOTP generates a new TOTP secret for a user who hasn't confirmed one.
+func (s *Server) enrollTOTP(w http.ResponseWriter, userID string) {
+	secret, err := newTOTPSecret()
+	if err != nil {
+		s.logger.Errorf("failed to generate TOTP secret: %v", err)
+		s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+	var u storage.User
+	err = s.storage.UpdateUser(userID, func(old storage.User) (storage.User, error) {
+		if old.TOTP.Confirmed {
+			return old, errTOTPEnrolled
+		}
+		old.TOTP = storage.TOTP{Secret: secret}
+		u = old
+		return old, nil
+	})
+	switch err {
+	case nil:
+	case storage.ErrNotFound:
+		s.tokenErrHelper(w, errInvalidRequest, "User not found.", http.StatusNotFound)
+		return
+	case errTOTPEnrolled:
+		s.tokenErrHelper(w, errInvalidRequest, "Two-factor authentication is already enabled.", http.StatusConflict)
+		return
+	default:
+		s.logger.Errorf("failed to update user: %v", err)
+		s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+
+	account := u.Email
+	if account == "" && len(u.RemoteIdentities) > 0 {
+		account = u.RemoteIdentities[0].Email
+	}
+	if account == "" {
+		account = u.ID
+	}
+	data, err := json.Marshal(totpEnrollment{
+		Secret: secret,
+		URI:    totpURI(s.issuerURL.Host, account, secret),
+	})
+	if err != nil {
+		s.logger.Errorf("failed to marshal TOTP enrollment: %v", err)
+		s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(data)
+}
+
+// handleAdminUserTOTPConfirm completes an enrollment started through
+// handleAdminUserTOTP when given a valid code, in a body of the form
+// {"code": "123456"}.
+func (s *Server) handleAdminUserTOTPConfirm(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		s.tokenErrHelper(w, errInvalidRequest, "Unsupported request method.", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		s.tokenErrHelper(w, errInvalidRequest, `Request body must be of the form {"code": "123456"}.`, http.StatusBadRequest)
+		return
+	}
+
+	userID := mux.Vars(r)["user"]
+	valid, err := s.useTOTP(userID, strings.Replace(req.Code, " ", "", -1), true)
+	switch {
+	case err == storage.ErrNotFound:
+		s.tokenErrHelper(w, errInvalidRequest, "User not found.", http.StatusNotFound)
+	case err == errTOTPEnrolled:
+		s.tokenErrHelper(w, errInvalidRequest, "No two-factor authentication enrollment in progress.", http.StatusConflict)
+	case err == errTOTPLocked:
+		s.tokenErrHelper(w, errInvalidRequest, "Too many invalid codes, try again later.", http.StatusTooManyRequests)
+	case err != nil:
+		s.logger.Errorf("failed to update user: %v", err)
+		s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+	case !valid:
+		s.tokenErrHelper(w, errInvalidRequest, "Invalid code.", http.StatusBadRequest)
+	default:
+		s.logger.Infof("user %q enabled two-factor authentication", userID)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
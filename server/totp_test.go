@@ -0,0 +1,281 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dexidp/dex/storage"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// Test vectors from RFC 6238 appendix B, truncated to 6 digits.
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, tc := range tests {
+		if got := totpCode([]byte("12345678901234567890"), uint64(tc.unix/totpPeriod)); got != tc.code {
+			t.Errorf("time %d: expected code %s, got %s", tc.unix, tc.code, got)
+		}
+		if step, ok := totpStep(secret, tc.code, time.Unix(tc.unix, 0)); !ok || step != tc.unix/totpPeriod {
+			t.Errorf("time %d: expected code %s to be valid for step %d, got %d %t", tc.unix, tc.code, tc.unix/totpPeriod, step, ok)
+		}
+	}
+}
+
+func TestTOTPLogin(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	now := time.Now()
+	httpServer, server := newTestServer(ctx, t, func(c *Config) {
+		c.Now = func() time.Time { return now }
+	})
+	defer httpServer.Close()
+
+	client := storage.Client{ID: "client", Secret: "secret", RedirectURIs: []string{"https://example.com/callback"}}
+	if err := server.storage.CreateClient(client); err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	secret, err := newTOTPSecret()
+	if err != nil {
+		t.Fatalf("generate secret: %v", err)
+	}
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		t.Fatalf("decode secret: %v", err)
+	}
+	// The mock connector returns this user ID.
+	user := storage.User{
+		ID:               storage.NewID(),
+		TOTP:             storage.TOTP{Secret: secret, Confirmed: true},
+		RemoteIdentities: []storage.RemoteIdentity{{ConnectorID: "mock", ConnectorUserID: "0-385-28089-0"}},
+	}
+	if err := server.storage.CreateUser(user); err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		codeTime time.Time
+		wantCode int
+	}{
+		{"previous period", now.Add(-totpPeriod * time.Second), http.StatusSeeOther},
+		{"valid", now, http.StatusSeeOther},
+		{"replayed", now, http.StatusOK},
+		{"earlier than last used", now.Add(-totpPeriod * time.Second), http.StatusOK},
+		{"expired", now.Add(-3 * totpPeriod * time.Second), http.StatusOK},
+	}
+	for _, tc := range tests {
+		authReq := storage.AuthRequest{
+			ID:            storage.NewID(),
+			ClientID:      client.ID,
+			ConnectorID:   "mock",
+			RedirectURI:   client.RedirectURIs[0],
+			ResponseTypes: []string{responseTypeCode},
+			Scopes:        []string{scopeOpenID},
+			Expiry:        now.Add(time.Minute),
+		}
+		if err := server.storage.CreateAuthRequest(authReq); err != nil {
+			t.Fatalf("create auth request: %v", err)
+		}
+
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, httptest.NewRequest("GET", "/callback?state="+authReq.ID, nil))
+		if location := rr.Header().Get("Location"); rr.Code != http.StatusSeeOther || !strings.HasPrefix(location, "/totp?") {
+			t.Fatalf("%s: expected a redirect to the TOTP page, got %d %q", tc.name, rr.Code, location)
+		}
+		if a, err := server.storage.GetAuthRequest(authReq.ID); err != nil || a.LoggedIn {
+			t.Fatalf("%s: expected auth request not to be logged in before entering a code: %v", tc.name, err)
+		}
+
+		code := totpCode(key, uint64(tc.codeTime.Unix()/totpPeriod))
+		form := url.Values{"code": {code}}
+		req := httptest.NewRequest("POST", "/totp?req="+authReq.ID, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr = httptest.NewRecorder()
+		server.ServeHTTP(rr, req)
+		if rr.Code != tc.wantCode {
+			t.Fatalf("%s: expected %d, got %d: %s", tc.name, tc.wantCode, rr.Code, rr.Body)
+		}
+
+		a, err := server.storage.GetAuthRequest(authReq.ID)
+		if err != nil {
+			t.Fatalf("get auth request: %v", err)
+		}
+		if wantLoggedIn := tc.wantCode == http.StatusSeeOther; a.LoggedIn != wantLoggedIn {
+			t.Errorf("%s: expected logged in %t, got %t", tc.name, wantLoggedIn, a.LoggedIn)
+		}
+		if tc.wantCode == http.StatusOK && a.SecondFactorFailures != 1 {
+			t.Errorf("%s: expected 1 failure to be recorded, got %d", tc.name, a.SecondFactorFailures)
+		}
+	}
+}
+
+func TestTOTPUserLockout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	now := time.Now()
+	httpServer, server := newTestServer(ctx, t, func(c *Config) {
+		c.Now = func() time.Time { return now }
+	})
+	defer httpServer.Close()
+
+	client := storage.Client{ID: "client", Secret: "secret", RedirectURIs: []string{"https://example.com/callback"}}
+	if err := server.storage.CreateClient(client); err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+	secret, err := newTOTPSecret()
+	if err != nil {
+		t.Fatalf("generate secret: %v", err)
+	}
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		t.Fatalf("decode secret: %v", err)
+	}
+	user := storage.User{
+		ID:               storage.NewID(),
+		TOTP:             storage.TOTP{Secret: secret, Confirmed: true},
+		RemoteIdentities: []storage.RemoteIdentity{{ConnectorID: "mock", ConnectorUserID: "0-385-28089-0"}},
+	}
+	if err := server.storage.CreateUser(user); err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+
+	// login starts a new login and enters a code, as a new auth request
+	// mustn't reset the failures counted against the user.
+	login := func(code string) int {
+		authReq := storage.AuthRequest{
+			ID:            storage.NewID(),
+			ClientID:      client.ID,
+			ConnectorID:   "mock",
+			RedirectURI:   client.RedirectURIs[0],
+			ResponseTypes: []string{responseTypeCode},
+			Scopes:        []string{scopeOpenID},
+			Expiry:        now.Add(time.Minute),
+		}
+		if err := server.storage.CreateAuthRequest(authReq); err != nil {
+			t.Fatalf("create auth request: %v", err)
+		}
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, httptest.NewRequest("GET", "/callback?state="+authReq.ID, nil))
+
+		form := url.Values{"code": {code}}
+		req := httptest.NewRequest("POST", "/totp?req="+authReq.ID, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr = httptest.NewRecorder()
+		server.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	for i := 0; i < maxUserTOTPFailures; i++ {
+		if code := login("000000"); code != http.StatusOK {
+			t.Fatalf("attempt %d: expected invalid code to be rejected with %d, got %d", i, http.StatusOK, code)
+		}
+	}
+	valid := totpCode(key, uint64(now.Unix()/totpPeriod))
+	if code := login(valid); code != http.StatusTooManyRequests {
+		t.Fatalf("expected user to be locked out with %d, got %d", http.StatusTooManyRequests, code)
+	}
+
+	now = now.Add(totpLockout)
+	valid = totpCode(key, uint64(now.Unix()/totpPeriod))
+	if code := login(valid); code != http.StatusSeeOther {
+		t.Fatalf("expected login after the lockout to succeed, got %d", code)
+	}
+	u, err := server.storage.GetUser(user.ID)
+	if err != nil {
+		t.Fatalf("get user: %v", err)
+	}
+	if u.TOTP.Failures != 0 {
+		t.Errorf("expected failures to be reset after a valid code, got %d", u.TOTP.Failures)
+	}
+}
+
+func TestAdminTOTPEnrollment(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	now := time.Now()
+	httpServer, server := newTestServer(ctx, t, func(c *Config) {
+		c.Now = func() time.Time { return now }
+		c.AdminAPIKey = "admin-key"
+	})
+	defer httpServer.Close()
+
+	user := storage.User{ID: storage.NewID(), Email: "jane@example.com"}
+	if err := server.storage.CreateUser(user); err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+
+	do := func(method, path, body, apiKey string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if apiKey != "" {
+			req.Header.Set("Authorization", "Bearer "+apiKey)
+		}
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, req)
+		return rr
+	}
+	enroll := "/admin/users/" + user.ID + "/totp"
+	confirm := enroll + "/confirm"
+
+	if rr := do("POST", enroll, "", "wrong-key"); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected enrollment without the admin key to fail with %d, got %d", http.StatusUnauthorized, rr.Code)
+	}
+
+	rr := do("POST", enroll, "", "admin-key")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected enrollment to succeed, got %d: %s", rr.Code, rr.Body)
+	}
+	var enrollment totpEnrollment
+	if err := json.Unmarshal(rr.Body.Bytes(), &enrollment); err != nil {
+		t.Fatalf("unmarshal enrollment: %v", err)
+	}
+	if !strings.Contains(enrollment.URI, "jane%40example.com") && !strings.Contains(enrollment.URI, "jane@example.com") {
+		t.Errorf("expected URI to name the user, got %q", enrollment.URI)
+	}
+	key, err := totpEncoding.DecodeString(enrollment.Secret)
+	if err != nil {
+		t.Fatalf("decode secret: %v", err)
+	}
+
+	if rr := do("POST", confirm, `{"code": "000000"}`, "admin-key"); rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected invalid code to be rejected with %d, got %d", http.StatusBadRequest, rr.Code)
+	}
+	code := totpCode(key, uint64(now.Unix()/totpPeriod))
+	if rr := do("POST", confirm, `{"code": "`+code+`"}`, "admin-key"); rr.Code != http.StatusNoContent {
+		t.Fatalf("expected valid code to confirm enrollment, got %d: %s", rr.Code, rr.Body)
+	}
+	u, err := server.storage.GetUser(user.ID)
+	if err != nil {
+		t.Fatalf("get user: %v", err)
+	}
+	if !u.TOTP.Confirmed || u.TOTP.Secret != enrollment.Secret || u.TOTP.LastStep != now.Unix()/totpPeriod {
+		t.Errorf("expected confirmed enrollment at step %d, got %+v", now.Unix()/totpPeriod, u.TOTP)
+	}
+
+	if rr := do("POST", enroll, "", "admin-key"); rr.Code != http.StatusConflict {
+		t.Errorf("expected re-enrollment of a confirmed user to fail with %d, got %d", http.StatusConflict, rr.Code)
+	}
+	if rr := do("DELETE", enroll, "", "admin-key"); rr.Code != http.StatusNoContent {
+		t.Fatalf("expected reset to succeed, got %d", rr.Code)
+	}
+	if rr := do("POST", enroll, "", "admin-key"); rr.Code != http.StatusOK {
+		t.Errorf("expected enrollment after a reset to succeed, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,674 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/dexidp/dex/connector"
+	"github.com/dexidp/dex/server/internal"
+	"github.com/dexidp/dex/storage"
+)
+
+var (
+	errIdentityNotLinked = errors.New("identity is not linked to user")
+	errLastIdentity      = errors.New("cannot unlink a user's last identity")
+	errUserDisabled      = errors.New("user is disabled")
+	errUserNotFound      = errors.New("user does not exist")
+	errAttributeMissing  = errors.New("identity is missing a required attribute")
+
+	errEmailDomainNotAllowed = errors.New("email domain is not allowed")
+	errEmailMissing          = errors.New("identity has no email")
+	errEmailNotVerified      = errors.New("email is not verified")
+	errTOTPFailed            = errors.New("too many invalid TOTP codes")
+	errSMSFailed             = errors.New("too many invalid SMS codes")
+	errTOTPEnrolled          = errors.New("TOTP enrollment changed")
+	errTOTPLocked            = errors.New("too many invalid TOTP codes, try again later")
+)
+
+// linkIdentity records the remote identity used to login, or refreshed by its
+// connector, against the user it belongs to, creating a new user the first time
+// an identity is seen. Connectors which don't provision users return
+// errUserNotFound instead, and identities without the connector's required
+// attributes errAttributeMissing. It returns the stored user.
+func (s *Server) linkIdentity(conn Connector, connID string, identity connector.Identity) (storage.User, error) {
+	if attr := missingAttribute(conn.RequiredAttributes, identity); attr != "" {
+		s.logger.Errorf("connector %q returned an identity without the required attribute %q: username=%q", connID, attr, identity.Username)
+		return storage.User{}, errAttributeMissing
+	}
+	now := s.now()
+	remote := storage.RemoteIdentity{
+		ConnectorID:     connID,
+		ConnectorUserID: identity.UserID,
+		Username:        identity.Username,
+		Email:           identity.Email,
+		EmailVerified:   identity.EmailVerified,
+		Groups:          identity.Groups,
+		Picture:         identity.Picture,
+		LinkedAt:        now,
+	}
+
+	u, err := s.storage.GetUserByRemoteIdentity(connID, identity.UserID)
+	switch err {
+	case nil:
+		updater := func(old storage.User) (storage.User, error) {
+			identities := make([]storage.RemoteIdentity, len(old.RemoteIdentities))
+			for i, r := range old.RemoteIdentities {
+				if r.ConnectorID == connID && r.ConnectorUserID == identity.UserID {
+					if !sameProfile(r, remote) {
+						old.UpdatedAt = now
+					}
+					// Refresh the profile but keep the original link time.
+					remote.LinkedAt = r.LinkedAt
+					r = remote
+				}
+				identities[i] = r
+			}
+			old.RemoteIdentities = identities
+			u = old
+			return old, nil
+		}
+		if err := s.storage.UpdateUser(u.ID, updater); err != nil {
+			return storage.User{}, err
+		}
+		return u, nil
+	case storage.ErrNotFound:
+		if conn.RequireExistingUser {
+			return storage.User{}, errUserNotFound
+		}
+		u = storage.User{
+			ID:               storage.NewID(),
+			UpdatedAt:        now,
+			RemoteIdentities: []storage.RemoteIdentity{remote},
+		}
+		if err := s.storage.CreateUser(u); err != nil {
+			return storage.User{}, err
+		}
+		return u, nil
+	default:
+		return storage.User{}, err
+	}
+}
+
+// sameProfile reports if two versions of a remote identity hold the same
+// profile information.
+func sameProfile(a, b storage.RemoteIdentity) bool {
+	if a.Username != b.Username || a.Email != b.Email || a.EmailVerified != b.EmailVerified ||
+		a.Picture != b.Picture || len(a.Groups) != len(b.Groups) {
+		return false
+	}
+	for i := range a.Groups {
+		if a.Groups[i] != b.Groups[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// bearerToken returns the token from a request's "Authorization: Bearer" header.
+func bearerToken(r *http.Request) (string, bool) {
+	const prefix = "bearer "
+	auth := r.Header.Get("Authorization")
+	if len(auth) <= len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return "", false
+	}
+	return auth[len(prefix):], true
+}
+
+// isAdmin reports if the request was authenticated with the admin API key.
+func (s *Server) isAdmin(r *http.Request) bool {
+	token, ok := bearerToken(r)
+	if !ok || s.adminAPIKey == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.adminAPIKey)) == 1
+}
+
+// requireAdmin wraps an admin endpoint, refusing requests not authenticated
+// with the admin API key.
+func (s *Server) requireAdmin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.isAdmin(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			s.tokenErrHelper(w, errAccessDenied, "Admin API key required.", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// handleIdentities serves the remote identities of the user an ID token, passed
+// as a bearer token, was issued to.
+func (s *Server) handleIdentities(w http.ResponseWriter, r *http.Request) {
+	u, ok := s.bearerUser(w, r)
+	if !ok {
+		return
+	}
+	s.handleUserIdentities(w, r, u.ID)
+}
+
+// bearerUser returns the user an ID token, passed as a bearer token, was
+// issued to. Only ID tokens issued to one of the identities clients are
+// accepted, not any token dex signed. If it can't, an error has been written
+// to the response.
+func (s *Server) bearerUser(w http.ResponseWriter, r *http.Request) (storage.User, bool) {
+	rawIDToken, ok := bearerToken(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		s.tokenErrHelper(w, errInvalidRequest, "Missing bearer token.", http.StatusUnauthorized)
+		return storage.User{}, false
+	}
+	claims, err := s.verifyIDToken(rawIDToken)
+	if err != nil {
+		s.logger.Errorf("failed to verify id token: %v", err)
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		s.tokenErrHelper(w, errInvalidToken, "Invalid bearer token.", http.StatusUnauthorized)
+		return storage.User{}, false
+	}
+	if !s.identitiesAudience(claims.Audience) {
+		s.logger.Errorf("id token issued to %q isn't accepted by the identities endpoint", claims.Audience)
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		s.tokenErrHelper(w, errInvalidToken, "Invalid bearer token.", http.StatusUnauthorized)
+		return storage.User{}, false
+	}
+
+	var sub internal.IDTokenSubject
+	if err := internal.Unmarshal(claims.Subject, &sub); err != nil {
+		s.logger.Errorf("failed to unmarshal id token subject: %v", err)
+		s.tokenErrHelper(w, errInvalidToken, "Invalid bearer token.", http.StatusUnauthorized)
+		return storage.User{}, false
+	}
+
+	u, err := s.storage.GetUserByRemoteIdentity(sub.ConnId, sub.UserId)
+	if err != nil {
+		if err == storage.ErrNotFound {
+			s.tokenErrHelper(w, errInvalidRequest, "User not found.", http.StatusNotFound)
+			return storage.User{}, false
+		}
+		s.logger.Errorf("failed to get user: %v", err)
+		s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+		return storage.User{}, false
+	}
+	return u, true
+}
+
+// identitiesAudience reports if the audience of an ID token includes one of the
+// clients allowed to authenticate users to the identities endpoint.
+func (s *Server) identitiesAudience(aud audience) bool {
+	for _, clientID := range s.identitiesClients {
+		if aud.contains(clientID) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleAdminUserIdentities serves the remote identities of any user and is
+// restricted to admins.
+func (s *Server) handleAdminUserIdentities(w http.ResponseWriter, r *http.Request) {
+	s.handleUserIdentities(w, r, mux.Vars(r)["user"])
+}
+
+type remoteIdentity struct {
+	ConnectorID   string    `json:"connector_id"`
+	RemoteID      string    `json:"remote_id"`
+	Email         string    `json:"email,omitempty"`
+	EmailVerified bool      `json:"email_verified"`
+	LinkedAt      time.Time `json:"linked_at"`
+}
+
+type userIdentities struct {
+	UserID     string           `json:"user_id"`
+	Identities []remoteIdentity `json:"identities"`
+}
+
+// handleUserIdentities lists a user's remote identities on GET and unlinks the
+// identity given by the "connector_id" and "remote_id" parameters on DELETE.
+func (s *Server) handleUserIdentities(w http.ResponseWriter, r *http.Request, userID string) {
+	switch r.Method {
+	case http.MethodGet:
+		u, err := s.storage.GetUser(userID)
+		if err != nil {
+			if err == storage.ErrNotFound {
+				s.tokenErrHelper(w, errInvalidRequest, "User not found.", http.StatusNotFound)
+				return
+			}
+			s.logger.Errorf("failed to get user: %v", err)
+			s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+			return
+		}
+
+		resp := userIdentities{
+			UserID:     u.ID,
+			Identities: make([]remoteIdentity, len(u.RemoteIdentities)),
+		}
+		for i, ri := range u.RemoteIdentities {
+			resp.Identities[i] = remoteIdentity{
+				ConnectorID:   ri.ConnectorID,
+				RemoteID:      ri.ConnectorUserID,
+				Email:         ri.Email,
+				EmailVerified: ri.EmailVerified,
+				LinkedAt:      ri.LinkedAt,
+			}
+		}
+
+		data, err := json.Marshal(resp)
+		if err != nil {
+			s.logger.Errorf("failed to marshal identities: %v", err)
+			s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data)
+	case http.MethodDelete:
+		connID, remoteID := r.FormValue("connector_id"), r.FormValue("remote_id")
+		if connID == "" || remoteID == "" {
+			s.tokenErrHelper(w, errInvalidRequest, "Missing connector_id or remote_id.", http.StatusBadRequest)
+			return
+		}
+
+		updater := func(old storage.User) (storage.User, error) {
+			var identities []storage.RemoteIdentity
+			for _, ri := range old.RemoteIdentities {
+				if ri.ConnectorID != connID || ri.ConnectorUserID != remoteID {
+					identities = append(identities, ri)
+				}
+			}
+			if len(identities) == len(old.RemoteIdentities) {
+				return old, errIdentityNotLinked
+			}
+			if len(identities) == 0 {
+				return old, errLastIdentity
+			}
+			old.RemoteIdentities = identities
+			return old, nil
+		}
+		switch err := s.storage.UpdateUser(userID, updater); err {
+		case nil:
+			w.WriteHeader(http.StatusNoContent)
+		case storage.ErrNotFound:
+			s.tokenErrHelper(w, errInvalidRequest, "User not found.", http.StatusNotFound)
+		case errIdentityNotLinked:
+			s.tokenErrHelper(w, errInvalidRequest, "Identity is not linked to this user.", http.StatusNotFound)
+		case errLastIdentity:
+			s.tokenErrHelper(w, errInvalidRequest, "Cannot unlink the only identity of a user.", http.StatusConflict)
+		default:
+			s.logger.Errorf("failed to unlink identity: %v", err)
+			s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+		}
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		s.tokenErrHelper(w, errInvalidRequest, "Unsupported request method.", http.StatusMethodNotAllowed)
+	}
+}
+
+var errEmailInUse = errors.New("email is already in use")
+
+type createUserRequest struct {
+	Email         string `json:"email"`
+	Name          string `json:"name"`
+	EmailVerified bool   `json:"email_verified"`
+
+	// Either a password for the local connector or the identity of the user
+	// with another connector.
+	Password    string `json:"password"`
+	ConnectorID string `json:"connector_id"`
+	RemoteID    string `json:"remote_id"`
+}
+
+// handleAdminCreateUser creates a user on POST. Users created with a password
+// can login through the local connector, others are linked to the given
+// connector identity up front.
+func (s *Server) handleAdminCreateUser(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		s.tokenErrHelper(w, errInvalidRequest, "Unsupported request method.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req createUserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.tokenErrHelper(w, errInvalidRequest, "Request body must be a JSON object.", http.StatusBadRequest)
+		return
+	}
+	req.Email = strings.ToLower(strings.TrimSpace(req.Email))
+	if req.Email == "" {
+		s.tokenErrHelper(w, errInvalidRequest, "Missing email.", http.StatusBadRequest)
+		return
+	}
+	withPassword := req.Password != ""
+	withIdentity := req.ConnectorID != "" || req.RemoteID != ""
+	if withPassword == withIdentity || (withIdentity && (req.ConnectorID == "" || req.RemoteID == "")) {
+		s.tokenErrHelper(w, errInvalidRequest, "Either a password or a connector_id and remote_id are required.", http.StatusBadRequest)
+		return
+	}
+
+	u := storage.User{
+		ID:            storage.NewID(),
+		Email:         req.Email,
+		Name:          req.Name,
+		EmailVerified: req.EmailVerified,
+		UpdatedAt:     s.now(),
+	}
+	var err error
+	if withPassword {
+		err = s.createPasswordUser(u, req.Password)
+	} else {
+		u.RemoteIdentities = []storage.RemoteIdentity{{
+			ConnectorID:     req.ConnectorID,
+			ConnectorUserID: req.RemoteID,
+			Email:           req.Email,
+			EmailVerified:   req.EmailVerified,
+			LinkedAt:        s.now(),
+		}}
+		if err = s.checkEmailAvailable(req.Email); err == nil {
+			err = s.storage.CreateUser(u)
+		}
+	}
+	switch err {
+	case nil:
+	case errEmailInUse:
+		s.tokenErrHelper(w, errInvalidRequest, "A user with this email already exists.", http.StatusConflict)
+		return
+	case storage.ErrAlreadyExists:
+		s.tokenErrHelper(w, errInvalidRequest, "A user with this email or identity already exists.", http.StatusConflict)
+		return
+	default:
+		s.logger.Errorf("failed to create user: %v", err)
+		s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+
+	data, err := json.Marshal(struct {
+		ID string `json:"id"`
+	}{u.ID})
+	if err != nil {
+		s.logger.Errorf("failed to marshal user: %v", err)
+		s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(data)
+}
+
+// checkEmailAvailable returns errEmailInUse if a password or a user already
+// exists for the normalized email.
+func (s *Server) checkEmailAvailable(email string) error {
+	switch _, err := s.storage.GetPassword(email); err {
+	case nil:
+		return errEmailInUse
+	case storage.ErrNotFound:
+	default:
+		return err
+	}
+	users, err := s.storage.ListUsers()
+	if err != nil {
+		return err
+	}
+	for _, u := range users {
+		if u.Email == email {
+			return errEmailInUse
+		}
+	}
+	return nil
+}
+
+// createPasswordUser stores a password for the local connector along with a
+// user already linked to the identity the connector will return for it.
+func (s *Server) createPasswordUser(u storage.User, password string) error {
+	if err := s.checkEmailAvailable(u.Email); err != nil {
+		return err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), s.passwordHashCost)
+	if err != nil {
+		return fmt.Errorf("hash password: %v", err)
+	}
+
+	// Creating the password first relies on the storage to reject concurrent
+	// requests for the same email.
+	p := storage.Password{
+		Email:    u.Email,
+		Hash:     hash,
+		Username: u.Name,
+		UserID:   u.ID,
+	}
+	if err := s.storage.CreatePassword(p); err != nil {
+		return err
+	}
+	u.RemoteIdentities = []storage.RemoteIdentity{{
+		ConnectorID:     LocalConnector,
+		ConnectorUserID: u.ID,
+		Username:        u.Name,
+		Email:           u.Email,
+		EmailVerified:   u.EmailVerified,
+		LinkedAt:        s.now(),
+	}}
+	if err := s.storage.CreateUser(u); err != nil {
+		if err := s.storage.DeletePassword(u.Email); err != nil {
+			s.logger.Errorf("failed to delete password of user that couldn't be created: %v", err)
+		}
+		return err
+	}
+	return nil
+}
+
+// userDisabled reports if the user a remote identity is linked to has been
+// disabled. Identities which aren't linked to a user are never disabled.
+func (s *Server) userDisabled(connID, connUserID string) (bool, error) {
+	u, err := s.storage.GetUserByRemoteIdentity(connID, connUserID)
+	switch err {
+	case nil:
+		return u.Disabled, nil
+	case storage.ErrNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("get user: %v", err)
+	}
+}
+
+// loginDenied reports if finalizeLogin refused a login, rather than failing
+// to complete it. Refused logins are ended with denyLogin.
+func loginDenied(err error) bool {
+	switch err {
+	case errUserDisabled, errUserNotFound, errAttributeMissing, errEmailDomainNotAllowed, errEmailMissing, errEmailNotVerified:
+		return true
+	}
+	return false
+}
+
+// denyLogin ends a login attempt refused with errUserDisabled,
+// errUserNotFound, errAttributeMissing, errEmailDomainNotAllowed,
+// errEmailMissing, errEmailNotVerified, errTOTPFailed or errSMSFailed, sending
+// the user back to the client with an access_denied error.
+func (s *Server) denyLogin(w http.ResponseWriter, r *http.Request, authReq storage.AuthRequest, identity connector.Identity, reason error) {
+	description := "User account is disabled."
+	switch reason {
+	case errUserNotFound:
+		description = "User account does not exist."
+	case errAttributeMissing:
+		description = "The login provider didn't return all the required user information."
+	case errEmailDomainNotAllowed:
+		description = "Email domain is not allowed to login through this connector."
+	case errEmailMissing:
+		description = "User account has no email address."
+	case errEmailNotVerified:
+		description = "Email address is not verified."
+	case errTOTPFailed, errSMSFailed:
+		description = "Too many invalid two-factor authentication codes."
+	}
+	s.logger.Infof("login refused, %v: connector %q, username=%q, email=%q", reason, authReq.ConnectorID, identity.Username, identity.Email)
+	if !s.checkRedirectURI(w, authReq) {
+		return
+	}
+	if err := s.storage.DeleteAuthRequest(authReq.ID); err != nil && err != storage.ErrNotFound {
+		s.logger.Errorf("Failed to delete authorization request: %v", err)
+	}
+	s.pendingLogins.end(authReq.ID)
+	err := &authErr{authReq.State, authReq.RedirectURI, errAccessDenied, description}
+	if handler, ok := err.Handle(); ok {
+		handler.ServeHTTP(w, r)
+		return
+	}
+	s.renderError(w, http.StatusForbidden, description)
+}
+
+// identityAttributes are the attributes of identities connectors can be
+// required to return, and whether an identity has them.
+var identityAttributes = map[string]func(connector.Identity) bool{
+	"userID":   func(i connector.Identity) bool { return i.UserID != "" },
+	"username": func(i connector.Identity) bool { return i.Username != "" },
+	"email":    func(i connector.Identity) bool { return i.Email != "" },
+	"groups":   func(i connector.Identity) bool { return len(i.Groups) > 0 },
+	"picture":  func(i connector.Identity) bool { return i.Picture != "" },
+}
+
+// validateRequiredAttributes checks the required attributes of a connector
+// are ones identities have.
+func validateRequiredAttributes(attrs []string) error {
+	for _, attr := range attrs {
+		if _, ok := identityAttributes[attr]; !ok {
+			return fmt.Errorf("unknown required attribute %q", attr)
+		}
+	}
+	return nil
+}
+
+// missingAttribute returns the first of the required attributes the identity
+// doesn't have, or "" if it has them all.
+func missingAttribute(required []string, identity connector.Identity) string {
+	for _, attr := range required {
+		if has, ok := identityAttributes[attr]; ok && !has(identity) {
+			return attr
+		}
+	}
+	return ""
+}
+
+// validateEmailDomains checks the allowed email domains of a connector. Each
+// is a domain name, optionally prefixed with "*." to match its subdomains.
+func validateEmailDomains(domains []string) error {
+	for _, domain := range domains {
+		name := strings.TrimPrefix(domain, "*.")
+		if name == "" || strings.ContainsAny(name, "*@ \t") || strings.HasPrefix(name, ".") || strings.HasSuffix(name, ".") {
+			return fmt.Errorf("invalid email domain %q", domain)
+		}
+	}
+	return nil
+}
+
+// emailDomainAllowed reports if the domain of an email matches one of the
+// allowed domains. Any email is allowed if the list is empty.
+func emailDomainAllowed(allowed []string, email string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	i := strings.LastIndex(email, "@")
+	if i < 0 {
+		return false
+	}
+	domain := strings.ToLower(email[i+1:])
+	for _, a := range allowed {
+		a = strings.ToLower(a)
+		if strings.HasPrefix(a, "*.") {
+			// "*.example.com" matches "a.example.com" and "a.b.example.com",
+			// but not "example.com".
+			if strings.HasSuffix(domain, a[1:]) {
+				return true
+			}
+			continue
+		}
+		if domain == a {
+			return true
+		}
+	}
+	return false
+}
+
+// handleAdminUserDisabled reports whether a user is disabled on GET and sets
+// it on PUT with a body of the form {"disabled": true}. Disabling a user also
+// revokes their refresh tokens.
+func (s *Server) handleAdminUserDisabled(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["user"]
+
+	var u storage.User
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		u, err = s.storage.GetUser(userID)
+	case http.MethodPut:
+		var req struct {
+			Disabled *bool `json:"disabled"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Disabled == nil {
+			s.tokenErrHelper(w, errInvalidRequest, `Request body must be of the form {"disabled": true}.`, http.StatusBadRequest)
+			return
+		}
+		err = s.storage.UpdateUser(userID, func(old storage.User) (storage.User, error) {
+			old.Disabled = *req.Disabled
+			u = old
+			return old, nil
+		})
+		if err == nil && u.Disabled {
+			s.logger.Infof("user %q disabled, revoking sessions", u.ID)
+			err = s.revokeUserSessions(u)
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		s.tokenErrHelper(w, errInvalidRequest, "Unsupported request method.", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		if err == storage.ErrNotFound {
+			s.tokenErrHelper(w, errInvalidRequest, "User not found.", http.StatusNotFound)
+			return
+		}
+		s.logger.Errorf("failed to update user: %v", err)
+		s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+
+	data, err := json.Marshal(struct {
+		ID       string `json:"id"`
+		Disabled bool   `json:"disabled"`
+	}{u.ID, u.Disabled})
+	if err != nil {
+		s.logger.Errorf("failed to marshal user: %v", err)
+		s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// revokeUserSessions deletes the refresh tokens and offline sessions of each of
+// the user's remote identities.
+func (s *Server) revokeUserSessions(u storage.User) error {
+	for _, ri := range u.RemoteIdentities {
+		session, err := s.storage.GetOfflineSessions(ri.ConnectorUserID, ri.ConnectorID)
+		if err != nil {
+			if err == storage.ErrNotFound {
+				continue
+			}
+			return fmt.Errorf("get offline session: %v", err)
+		}
+		for _, ref := range session.Refresh {
+			if err := s.storage.DeleteRefresh(ref.ID); err != nil && err != storage.ErrNotFound {
+				return fmt.Errorf("delete refresh token: %v", err)
+			}
+		}
+		if err := s.storage.DeleteOfflineSessions(ri.ConnectorUserID, ri.ConnectorID); err != nil && err != storage.ErrNotFound {
+			return fmt.Errorf("delete offline session: %v", err)
+		}
+	}
+	return nil
+}
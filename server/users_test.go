@@ -0,0 +1,817 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/dexidp/dex/connector"
+	"github.com/dexidp/dex/server/internal"
+	"github.com/dexidp/dex/storage"
+)
+
+func TestHandleIdentities(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, server := newTestServer(ctx, t, func(c *Config) {
+		c.AdminAPIKey = "admin-key"
+		// The resource is allowed too, to check access tokens issued for it
+		// are refused for their type rather than their audience.
+		c.IdentitiesClients = []string{"client", "https://api.example.com"}
+		c.Resources = []Resource{{URI: "https://api.example.com", AccessTokenFormat: accessTokenFormatJWT}}
+	})
+	defer httpServer.Close()
+
+	identity := connector.Identity{
+		UserID:        "0-385-28089-0",
+		Username:      "Kilgore Trout",
+		Email:         "kilgore@kilgore.trout",
+		EmailVerified: true,
+	}
+	if _, err := server.linkIdentity(Connector{}, "mock", identity); err != nil {
+		t.Fatalf("link identity: %v", err)
+	}
+	u, err := server.storage.GetUserByRemoteIdentity("mock", identity.UserID)
+	if err != nil {
+		t.Fatalf("get user: %v", err)
+	}
+
+	claims := storage.Claims{UserID: identity.UserID, Email: identity.Email, EmailVerified: true}
+	idToken, _, err := server.newIDToken("client", claims, []string{"openid"}, nil, "", "", "mock")
+	if err != nil {
+		t.Fatalf("new id token: %v", err)
+	}
+
+	do := func(method, target, bearer string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		if bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+bearer)
+		}
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := do("GET", "/identities", idToken)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 got %d: %s", rr.Code, rr.Body)
+	}
+	var resp userIdentities
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("unmarshal response: %v", err)
+	}
+	if resp.UserID != u.ID || len(resp.Identities) != 1 {
+		t.Fatalf("unexpected response: %+v", resp)
+	}
+	if got := resp.Identities[0]; got.ConnectorID != "mock" || got.RemoteID != identity.UserID || !got.EmailVerified {
+		t.Errorf("unexpected identity: %+v", got)
+	}
+
+	if rr := do("GET", "/identities", ""); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without bearer token got %d", rr.Code)
+	}
+	if rr := do("GET", "/identities", "garbage"); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for invalid bearer token got %d", rr.Code)
+	}
+	otherIDToken, _, err := server.newIDToken("other", claims, []string{"openid"}, nil, "", "", "mock")
+	if err != nil {
+		t.Fatalf("new id token: %v", err)
+	}
+	if rr := do("GET", "/identities", otherIDToken); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for an id token issued to another client got %d", rr.Code)
+	}
+	resource := server.resources["https://api.example.com"]
+	accessToken, err := server.newAccessToken(&resource, "client", claims, []string{"openid"}, "mock")
+	if err != nil {
+		t.Fatalf("new access token: %v", err)
+	}
+	if rr := do("GET", "/identities", accessToken); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a JWT access token got %d", rr.Code)
+	}
+	if rr := do("GET", "/admin/users/"+u.ID+"/identities", idToken); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for non-admin got %d", rr.Code)
+	}
+	if rr := do("GET", "/admin/users/"+u.ID+"/identities", "admin-key"); rr.Code != http.StatusOK {
+		t.Errorf("expected 200 for admin got %d", rr.Code)
+	}
+	if rr := do("GET", "/admin/users/missing/identities", "admin-key"); rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for unknown user got %d", rr.Code)
+	}
+}
+
+func TestUnlinkIdentity(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, server := newTestServer(ctx, t, func(c *Config) {
+		c.AdminAPIKey = "admin-key"
+	})
+	defer httpServer.Close()
+
+	u := storage.User{
+		ID: storage.NewID(),
+		RemoteIdentities: []storage.RemoteIdentity{
+			{ConnectorID: "mock", ConnectorUserID: "1"},
+			{ConnectorID: "github", ConnectorUserID: "2"},
+		},
+	}
+	if err := server.storage.CreateUser(u); err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+
+	unlink := func(connID, remoteID string) int {
+		req := httptest.NewRequest("DELETE", "/admin/users/"+u.ID+"/identities?connector_id="+connID+"&remote_id="+remoteID, nil)
+		req.Header.Set("Authorization", "Bearer admin-key")
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if code := unlink("ldap", "3"); code != http.StatusNotFound {
+		t.Errorf("expected 404 for unlinked identity got %d", code)
+	}
+	if code := unlink("github", "2"); code != http.StatusNoContent {
+		t.Errorf("expected 204 got %d", code)
+	}
+	if code := unlink("mock", "1"); code != http.StatusConflict {
+		t.Errorf("expected 409 removing last identity got %d", code)
+	}
+
+	got, err := server.storage.GetUser(u.ID)
+	if err != nil {
+		t.Fatalf("get user: %v", err)
+	}
+	if len(got.RemoteIdentities) != 1 || got.RemoteIdentities[0].ConnectorID != "mock" {
+		t.Errorf("unexpected remote identities after unlinking: %+v", got.RemoteIdentities)
+	}
+}
+
+func TestInternalAdminAPI(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, server := newTestServer(ctx, t, func(c *Config) {
+		c.AdminAPIKey = "admin-key"
+		c.InternalAdminAPI = true
+	})
+	defer httpServer.Close()
+
+	u := storage.User{
+		ID:               storage.NewID(),
+		RemoteIdentities: []storage.RemoteIdentity{{ConnectorID: "mock", ConnectorUserID: "1"}},
+	}
+	if err := server.storage.CreateUser(u); err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+
+	do := func(h http.Handler, target string) int {
+		req := httptest.NewRequest("GET", target, nil)
+		req.Header.Set("Authorization", "Bearer admin-key")
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	target := "/admin/users/" + u.ID + "/identities"
+	if code := do(server, target); code != http.StatusNotFound {
+		t.Errorf("expected admin endpoint to be unreachable on the public handler, got %d", code)
+	}
+	if code := do(server.InternalHandler(), target); code != http.StatusOK {
+		t.Errorf("expected admin endpoint on the internal handler, got %d", code)
+	}
+	if code := do(server, "/.well-known/openid-configuration"); code != http.StatusOK {
+		t.Errorf("expected discovery on the public handler, got %d", code)
+	}
+	if code := do(server.InternalHandler(), "/.well-known/openid-configuration"); code != http.StatusNotFound {
+		t.Errorf("expected discovery not to be served by the internal handler, got %d", code)
+	}
+}
+
+func TestAdminCreateUser(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, server := newTestServer(ctx, t, func(c *Config) {
+		c.AdminAPIKey = "admin-key"
+		c.PasswordHashCost = bcrypt.DefaultCost
+	})
+	defer httpServer.Close()
+
+	create := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/admin/users", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer admin-key")
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := create(`{"email": " Jane@Example.com", "name": "Jane", "email_verified": true, "password": "secret"}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201 creating user, got %d: %s", rr.Code, rr.Body)
+	}
+	var resp struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("unmarshal response: %v", err)
+	}
+	u, err := server.storage.GetUser(resp.ID)
+	if err != nil {
+		t.Fatalf("get user: %v", err)
+	}
+	if u.Email != "jane@example.com" || u.Name != "Jane" || !u.EmailVerified {
+		t.Errorf("unexpected user: %+v", u)
+	}
+
+	rr = create(`{"email": "JANE@example.com ", "connector_id": "mock", "remote_id": "jane"}`)
+	if rr.Code != http.StatusConflict {
+		t.Errorf("expected 409 for a duplicate email, got %d", rr.Code)
+	}
+	rr = create(`{"email": "john@example.com", "password": "secret", "connector_id": "mock", "remote_id": "john"}`)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for both a password and an identity, got %d", rr.Code)
+	}
+
+	rr = create(`{"email": "john@example.com", "connector_id": "mock", "remote_id": "john"}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201 creating connector user, got %d: %s", rr.Code, rr.Body)
+	}
+	if _, err := server.storage.GetUserByRemoteIdentity("mock", "john"); err != nil {
+		t.Errorf("expected connector user to be linked to its identity: %v", err)
+	}
+
+	ident, ok, err := newPasswordDB(server.storage).Login(ctx, connector.Scopes{}, "jane@example.com", "secret")
+	if err != nil || !ok {
+		t.Fatalf("expected created user to login with the local connector, ok=%t, err=%v", ok, err)
+	}
+	if _, err := server.linkIdentity(Connector{}, LocalConnector, ident); err != nil {
+		t.Fatalf("link identity: %v", err)
+	}
+	linked, err := server.storage.GetUserByRemoteIdentity(LocalConnector, ident.UserID)
+	if err != nil {
+		t.Fatalf("get user by remote identity: %v", err)
+	}
+	if linked.ID != resp.ID {
+		t.Errorf("expected login to resolve to user %q, got %q", resp.ID, linked.ID)
+	}
+}
+
+func TestDisabledUser(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, server := newTestServer(ctx, t, func(c *Config) {
+		c.AdminAPIKey = "admin-key"
+	})
+	defer httpServer.Close()
+
+	client := storage.Client{ID: "client", Secret: "secret", RedirectURIs: []string{"https://example.com/callback"}}
+	if err := server.storage.CreateClient(client); err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	// The identity returned by the mock connector.
+	const userID = "0-385-28089-0"
+	if _, err := server.linkIdentity(Connector{}, "mock", connector.Identity{UserID: userID}); err != nil {
+		t.Fatalf("link identity: %v", err)
+	}
+	u, err := server.storage.GetUserByRemoteIdentity("mock", userID)
+	if err != nil {
+		t.Fatalf("get user: %v", err)
+	}
+
+	newRefreshToken := func(inSession bool) string {
+		refresh := storage.RefreshToken{
+			ID:          storage.NewID(),
+			Token:       storage.NewID(),
+			ClientID:    client.ID,
+			ConnectorID: "mock",
+			Scopes:      []string{scopeOpenID, scopeOfflineAccess},
+			Claims:      storage.Claims{UserID: userID},
+		}
+		if err := server.storage.CreateRefresh(refresh); err != nil {
+			t.Fatalf("create refresh token: %v", err)
+		}
+		if inSession {
+			session := storage.OfflineSessions{
+				UserID:  userID,
+				ConnID:  "mock",
+				Refresh: map[string]*storage.RefreshTokenRef{client.ID: {ID: refresh.ID, ClientID: client.ID}},
+			}
+			if err := server.storage.CreateOfflineSessions(session); err != nil {
+				t.Fatalf("create offline session: %v", err)
+			}
+		}
+		token, err := internal.Marshal(&internal.RefreshToken{RefreshId: refresh.ID, Token: refresh.Token})
+		if err != nil {
+			t.Fatalf("marshal refresh token: %v", err)
+		}
+		return token
+	}
+	sessionToken := newRefreshToken(true)
+
+	req := httptest.NewRequest("PUT", "/admin/users/"+u.ID+"/disabled", strings.NewReader(`{"disabled": true}`))
+	req.Header.Set("Authorization", "Bearer admin-key")
+	rr := httptest.NewRecorder()
+	server.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 disabling user, got %d: %s", rr.Code, rr.Body)
+	}
+	if _, err := server.storage.GetOfflineSessions(userID, "mock"); err != storage.ErrNotFound {
+		t.Errorf("expected offline session to be revoked, got %v", err)
+	}
+
+	useRefreshToken := func(token string) (int, string) {
+		form := url.Values{
+			"grant_type":    {grantTypeRefreshToken},
+			"refresh_token": {token},
+		}
+		req := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(client.ID, client.Secret)
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, req)
+
+		var resp struct {
+			Error string `json:"error"`
+		}
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		return rr.Code, resp.Error
+	}
+	if code, _ := useRefreshToken(sessionToken); code != http.StatusBadRequest {
+		t.Errorf("expected revoked refresh token to be rejected, got %d", code)
+	}
+	if code, errType := useRefreshToken(newRefreshToken(false)); code != http.StatusBadRequest || errType != errInvalidGrant {
+		t.Errorf("expected refresh token of a disabled user to be rejected with %q, got %d %q", errInvalidGrant, code, errType)
+	}
+
+	authReq := storage.AuthRequest{
+		ID:            storage.NewID(),
+		ClientID:      client.ID,
+		ConnectorID:   "mock",
+		RedirectURI:   client.RedirectURIs[0],
+		State:         "state",
+		ResponseTypes: []string{responseTypeCode},
+		Scopes:        []string{scopeOpenID},
+		Expiry:        server.now().Add(time.Minute),
+	}
+	if err := server.storage.CreateAuthRequest(authReq); err != nil {
+		t.Fatalf("create auth request: %v", err)
+	}
+	rr = httptest.NewRecorder()
+	server.ServeHTTP(rr, httptest.NewRequest("GET", "/callback?state="+authReq.ID, nil))
+	if rr.Code != http.StatusSeeOther {
+		t.Fatalf("expected redirect back to the client, got %d: %s", rr.Code, rr.Body)
+	}
+	redirect, err := url.Parse(rr.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("parse redirect: %v", err)
+	}
+	if redirect.Host != "example.com" || redirect.Query().Get("error") != errAccessDenied || redirect.Query().Get("state") != "state" {
+		t.Errorf("expected %q redirect to the client, got %s", errAccessDenied, redirect)
+	}
+	if _, err := server.storage.GetAuthRequest(authReq.ID); err != storage.ErrNotFound {
+		t.Errorf("expected auth request of a disabled user to be deleted, got %v", err)
+	}
+}
+
+func TestUpdatedAtClaim(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	now := time.Now().Truncate(time.Second)
+	httpServer, server := newTestServer(ctx, t, func(c *Config) {
+		c.Now = func() time.Time { return now }
+	})
+	defer httpServer.Close()
+
+	// login finalizes a login for the identity and returns the updated_at claim
+	// of the ID token issued for it.
+	login := func(identity connector.Identity) int64 {
+		authReq := storage.AuthRequest{
+			ID:          storage.NewID(),
+			ClientID:    "client",
+			ConnectorID: "mock",
+			Scopes:      []string{"openid", "profile"},
+			Expiry:      now.Add(time.Hour),
+		}
+		if err := server.storage.CreateAuthRequest(authReq); err != nil {
+			t.Fatalf("create auth request: %v", err)
+		}
+		if _, err := server.finalizeLogin(identity, authReq, server.connectors["mock"]); err != nil {
+			t.Fatalf("finalize login: %v", err)
+		}
+		authReq, err := server.storage.GetAuthRequest(authReq.ID)
+		if err != nil {
+			t.Fatalf("get auth request: %v", err)
+		}
+		idToken, _, err := server.newIDToken("client", authReq.Claims, authReq.Scopes, nil, "", "", "mock")
+		if err != nil {
+			t.Fatalf("new id token: %v", err)
+		}
+		claims, err := server.verifyIDToken(idToken)
+		if err != nil {
+			t.Fatalf("verify id token: %v", err)
+		}
+		return claims.UpdatedAt
+	}
+
+	identity := connector.Identity{UserID: "1", Username: "jane", Email: "jane@example.com"}
+	created := now
+	if got := login(identity); got != created.Unix() {
+		t.Errorf("expected updated_at of the new user to be %d, got %d", created.Unix(), got)
+	}
+
+	now = now.Add(time.Hour)
+	if got := login(identity); got != created.Unix() {
+		t.Errorf("expected unchanged profile to keep updated_at %d, got %d", created.Unix(), got)
+	}
+
+	now = now.Add(time.Hour)
+	identity.Email = "jane.doe@example.com"
+	if got := login(identity); got != now.Unix() {
+		t.Errorf("expected changed profile to update updated_at to %d, got %d", now.Unix(), got)
+	}
+}
+
+func TestAllowedEmailDomains(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, server := newTestServer(ctx, t, nil)
+	defer httpServer.Close()
+
+	client := storage.Client{ID: "client", Secret: "secret", RedirectURIs: []string{"https://example.com/callback"}}
+	if err := server.storage.CreateClient(client); err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	// The mock connector returns the verified email "kilgore@kilgore.trout".
+	const userID = "0-385-28089-0"
+	tests := []struct {
+		allowed []string
+		wantErr string
+	}{
+		{allowed: nil},
+		{allowed: []string{"example.com", "kilgore.trout"}},
+		{allowed: []string{"*.trout"}},
+		{allowed: []string{"example.com"}, wantErr: errAccessDenied},
+		{allowed: []string{"*.kilgore.trout"}, wantErr: errAccessDenied},
+	}
+	for i, tc := range tests {
+		if err := server.storage.UpdateConnector("mock", func(c storage.Connector) (storage.Connector, error) {
+			c.AllowedEmailDomains = tc.allowed
+			c.ResourceVersion = strconv.Itoa(i + 2)
+			return c, nil
+		}); err != nil {
+			t.Fatalf("update connector: %v", err)
+		}
+
+		authReq := storage.AuthRequest{
+			ID:            storage.NewID(),
+			ClientID:      client.ID,
+			ConnectorID:   "mock",
+			RedirectURI:   client.RedirectURIs[0],
+			State:         "state",
+			ResponseTypes: []string{responseTypeCode},
+			Scopes:        []string{scopeOpenID},
+			Expiry:        server.now().Add(time.Minute),
+		}
+		if err := server.storage.CreateAuthRequest(authReq); err != nil {
+			t.Fatalf("create auth request: %v", err)
+		}
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, httptest.NewRequest("GET", "/callback?state="+authReq.ID, nil))
+		if rr.Code != http.StatusSeeOther {
+			t.Fatalf("allowed %q: expected a redirect, got %d: %s", tc.allowed, rr.Code, rr.Body)
+		}
+		redirect, err := url.Parse(rr.Header().Get("Location"))
+		if err != nil {
+			t.Fatalf("parse redirect: %v", err)
+		}
+		if got := redirect.Query().Get("error"); got != tc.wantErr {
+			t.Errorf("allowed %q: expected error %q, got %q", tc.allowed, tc.wantErr, got)
+		}
+
+		_, err = server.storage.GetUserByRemoteIdentity("mock", userID)
+		if tc.wantErr == "" && err != nil {
+			t.Errorf("allowed %q: expected identity to be linked: %v", tc.allowed, err)
+		}
+		if tc.wantErr != "" && err != storage.ErrNotFound {
+			t.Errorf("allowed %q: expected no user to be created, got %v", tc.allowed, err)
+		}
+		if user, err := server.storage.GetUserByRemoteIdentity("mock", userID); err == nil {
+			if err := server.storage.DeleteUser(user.ID); err != nil {
+				t.Fatalf("delete user: %v", err)
+			}
+		}
+	}
+
+	if err := validateEmailDomains([]string{"example.com", "*.example.org"}); err != nil {
+		t.Errorf("expected valid email domains, got %v", err)
+	}
+	for _, domain := range []string{"", "*", "*.", "user@example.com", "a.*.example.com", ".example.com"} {
+		if err := validateEmailDomains([]string{domain}); err == nil {
+			t.Errorf("expected email domain %q to be invalid", domain)
+		}
+	}
+}
+
+func TestRequireEmailVerified(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, server := newTestServer(ctx, t, nil)
+	defer httpServer.Close()
+
+	for _, client := range []storage.Client{
+		{ID: "strict", Secret: "secret", RequireEmailVerified: true},
+		{ID: "lenient", Secret: "secret"},
+	} {
+		if err := server.storage.CreateClient(client); err != nil {
+			t.Fatalf("create client: %v", err)
+		}
+	}
+
+	tests := []struct {
+		clientID string
+		verified bool
+		wantErr  error
+	}{
+		{clientID: "strict", verified: true},
+		{clientID: "strict", verified: false, wantErr: errEmailNotVerified},
+		{clientID: "lenient", verified: true},
+		{clientID: "lenient", verified: false},
+	}
+	for _, tc := range tests {
+		authReq := storage.AuthRequest{
+			ID:          storage.NewID(),
+			ClientID:    tc.clientID,
+			ConnectorID: "mock",
+			Scopes:      []string{scopeOpenID},
+			Expiry:      server.now().Add(time.Minute),
+		}
+		if err := server.storage.CreateAuthRequest(authReq); err != nil {
+			t.Fatalf("create auth request: %v", err)
+		}
+		identity := connector.Identity{UserID: "1", Username: "jane", Email: "jane@example.com", EmailVerified: tc.verified}
+		_, err := server.finalizeLogin(identity, authReq, server.connectors["mock"])
+		if err != tc.wantErr {
+			t.Errorf("client %s, verified %t: expected error %v, got %v", tc.clientID, tc.verified, tc.wantErr, err)
+			continue
+		}
+		a, err := server.storage.GetAuthRequest(authReq.ID)
+		if err != nil {
+			t.Fatalf("get auth request: %v", err)
+		}
+		if a.LoggedIn != (tc.wantErr == nil) {
+			t.Errorf("client %s, verified %t: expected logged in to be %t", tc.clientID, tc.verified, tc.wantErr == nil)
+		}
+	}
+}
+
+type directoryConnector struct {
+	userIDs []string
+}
+
+func (d directoryConnector) ListUserIDs(ctx context.Context) ([]string, error) {
+	return d.userIDs, nil
+}
+
+func TestRequiredAttributes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, server := newTestServer(ctx, t, nil)
+	defer httpServer.Close()
+
+	client := storage.Client{ID: "client", Secret: "secret", RedirectURIs: []string{"https://example.com/callback"}}
+	if err := server.storage.CreateClient(client); err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	// The mock connector returns no picture.
+	const userID = "0-385-28089-0"
+	tests := []struct {
+		required []string
+		wantErr  string
+	}{
+		{required: nil},
+		{required: []string{"userID", "username", "email", "groups"}},
+		{required: []string{"email", "picture"}, wantErr: errAccessDenied},
+	}
+	for i, tc := range tests {
+		if err := server.storage.UpdateConnector("mock", func(c storage.Connector) (storage.Connector, error) {
+			c.RequiredAttributes = tc.required
+			c.ResourceVersion = strconv.Itoa(i + 2)
+			return c, nil
+		}); err != nil {
+			t.Fatalf("update connector: %v", err)
+		}
+
+		authReq := storage.AuthRequest{
+			ID:            storage.NewID(),
+			ClientID:      client.ID,
+			ConnectorID:   "mock",
+			RedirectURI:   client.RedirectURIs[0],
+			State:         "state",
+			ResponseTypes: []string{responseTypeCode},
+			Scopes:        []string{scopeOpenID},
+			Expiry:        server.now().Add(time.Minute),
+		}
+		if err := server.storage.CreateAuthRequest(authReq); err != nil {
+			t.Fatalf("create auth request: %v", err)
+		}
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, httptest.NewRequest("GET", "/callback?state="+authReq.ID, nil))
+		if rr.Code != http.StatusSeeOther {
+			t.Fatalf("required %q: expected a redirect, got %d: %s", tc.required, rr.Code, rr.Body)
+		}
+		redirect, err := url.Parse(rr.Header().Get("Location"))
+		if err != nil {
+			t.Fatalf("parse redirect: %v", err)
+		}
+		if got := redirect.Query().Get("error"); got != tc.wantErr {
+			t.Errorf("required %q: expected error %q, got %q", tc.required, tc.wantErr, got)
+		}
+
+		_, err = server.storage.GetUserByRemoteIdentity("mock", userID)
+		if tc.wantErr == "" && err != nil {
+			t.Errorf("required %q: expected identity to be linked: %v", tc.required, err)
+		}
+		if tc.wantErr != "" && err != storage.ErrNotFound {
+			t.Errorf("required %q: expected no user to be created, got %v", tc.required, err)
+		}
+		if user, err := server.storage.GetUserByRemoteIdentity("mock", userID); err == nil {
+			if err := server.storage.DeleteUser(user.ID); err != nil {
+				t.Fatalf("delete user: %v", err)
+			}
+		}
+	}
+
+	if _, err := server.OpenConnector(storage.Connector{ID: "bad", Type: "mockCallback", RequiredAttributes: []string{"mail"}}); err == nil {
+		t.Error("expected a connector requiring an unknown attribute to be refused")
+	}
+}
+
+func TestJITProvisioning(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, server := newTestServer(ctx, t, nil)
+	defer httpServer.Close()
+
+	client := storage.Client{ID: "client", Secret: "secret", RedirectURIs: []string{"https://example.com/callback"}}
+	if err := server.storage.CreateClient(client); err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	const userID = "0-385-28089-0"
+	provision := func(jit *bool) {
+		if err := server.storage.UpdateConnector("mock", func(c storage.Connector) (storage.Connector, error) {
+			c.JITProvisioning = jit
+			v, _ := strconv.Atoi(c.ResourceVersion)
+			c.ResourceVersion = strconv.Itoa(v + 1)
+			return c, nil
+		}); err != nil {
+			t.Fatalf("update connector: %v", err)
+		}
+	}
+	login := func() string {
+		authReq := storage.AuthRequest{
+			ID:            storage.NewID(),
+			ClientID:      client.ID,
+			ConnectorID:   "mock",
+			RedirectURI:   client.RedirectURIs[0],
+			State:         "state",
+			ResponseTypes: []string{responseTypeCode},
+			Scopes:        []string{scopeOpenID},
+			Expiry:        server.now().Add(time.Minute),
+		}
+		if err := server.storage.CreateAuthRequest(authReq); err != nil {
+			t.Fatalf("create auth request: %v", err)
+		}
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, httptest.NewRequest("GET", "/callback?state="+authReq.ID, nil))
+		if rr.Code != http.StatusSeeOther {
+			t.Fatalf("expected a redirect, got %d: %s", rr.Code, rr.Body)
+		}
+		redirect, err := url.Parse(rr.Header().Get("Location"))
+		if err != nil {
+			t.Fatalf("parse redirect: %v", err)
+		}
+		return redirect.Query().Get("error")
+	}
+
+	disabled := false
+	provision(&disabled)
+	if got := login(); got != errAccessDenied {
+		t.Errorf("expected an unknown user to be refused, got error %q", got)
+	}
+	if _, err := server.storage.GetUserByRemoteIdentity("mock", userID); err != storage.ErrNotFound {
+		t.Errorf("expected no user to be created, got %v", err)
+	}
+
+	// Users which already exist can still login.
+	user := storage.User{ID: storage.NewID(), RemoteIdentities: []storage.RemoteIdentity{{ConnectorID: "mock", ConnectorUserID: userID}}}
+	if err := server.storage.CreateUser(user); err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	if got := login(); got != "" {
+		t.Errorf("expected an existing user to login, got error %q", got)
+	}
+	if err := server.storage.DeleteUser(user.ID); err != nil {
+		t.Fatalf("delete user: %v", err)
+	}
+
+	// Users are provisioned by default.
+	provision(nil)
+	if got := login(); got != "" {
+		t.Errorf("expected a new user to be provisioned, got error %q", got)
+	}
+	if _, err := server.storage.GetUserByRemoteIdentity("mock", userID); err != nil {
+		t.Errorf("expected a user to be created: %v", err)
+	}
+}
+
+func TestSyncDirectoryUsers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, server := newTestServer(ctx, t, nil)
+	defer httpServer.Close()
+
+	if err := server.storage.CreateConnector(storage.Connector{ID: "ldap", Type: "mockCallback", Name: "LDAP", ResourceVersion: "1"}); err != nil {
+		t.Fatalf("create connector: %v", err)
+	}
+	dir := &directoryConnector{userIDs: []string{"jane"}}
+	server.mu.Lock()
+	server.connectors["ldap"] = Connector{ResourceVersion: "1", Connector: dir}
+	server.mu.Unlock()
+
+	newUser := func(identities ...storage.RemoteIdentity) storage.User {
+		u := storage.User{ID: storage.NewID(), RemoteIdentities: identities}
+		if err := server.storage.CreateUser(u); err != nil {
+			t.Fatalf("create user: %v", err)
+		}
+		return u
+	}
+	jane := newUser(storage.RemoteIdentity{ConnectorID: "ldap", ConnectorUserID: "jane"})
+	john := newUser(storage.RemoteIdentity{ConnectorID: "ldap", ConnectorUserID: "john"})
+	// Created through another connector, so not checked against the directory.
+	kilgore := newUser(
+		storage.RemoteIdentity{ConnectorID: "mock", ConnectorUserID: "kilgore"},
+		storage.RemoteIdentity{ConnectorID: "ldap", ConnectorUserID: "kilgore"},
+	)
+
+	offlineSession := storage.OfflineSessions{UserID: "john", ConnID: "ldap", Refresh: map[string]*storage.RefreshTokenRef{}}
+	if err := server.storage.CreateOfflineSessions(offlineSession); err != nil {
+		t.Fatalf("create offline session: %v", err)
+	}
+
+	disabled := func(u storage.User) bool {
+		u, err := server.storage.GetUser(u.ID)
+		if err != nil {
+			t.Fatalf("get user: %v", err)
+		}
+		return u.Disabled
+	}
+
+	if err := server.syncDirectoryUsers(ctx, false); err != nil {
+		t.Fatalf("sync without pruning: %v", err)
+	}
+	if disabled(john) {
+		t.Errorf("expected users not to be disabled without pruning")
+	}
+
+	if err := server.syncDirectoryUsers(ctx, true); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	if !disabled(john) {
+		t.Errorf("expected user removed from the directory to be disabled")
+	}
+	if disabled(jane) || disabled(kilgore) {
+		t.Errorf("expected other users not to be disabled")
+	}
+	if _, err := server.storage.GetOfflineSessions("john", "ldap"); err != storage.ErrNotFound {
+		t.Errorf("expected sessions of the disabled user to be revoked, got %v", err)
+	}
+
+	// A directory listing no users is ignored rather than pruning everyone.
+	dir.userIDs = nil
+	if err := server.syncDirectoryUsers(ctx, true); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	if disabled(jane) {
+		t.Errorf("expected an empty directory listing not to disable users")
+	}
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/dexidp/dex/connector"
+	"github.com/dexidp/dex/storage"
+)
+
+// handleWebAuthnPOST handles the requests the WebAuthn login page makes: the
+// "enroll_options" and "enroll" actions register a credential through fetch
+// calls, while the login form POSTs an assertion without an action.
+func (s *Server) handleWebAuthnPOST(w http.ResponseWriter, r *http.Request, authReq storage.AuthRequest, conn Connector, webauthnConn connector.WebAuthnConnector, scopes connector.Scopes, showBacklink bool) {
+	tmpls := s.templates.withBranding(conn.Branding)
+	switch r.PostFormValue("action") {
+	case "enroll_options":
+		options, err := webauthnConn.EnrollOptions(authReq.ID, r.PostFormValue("login"), r.PostFormValue("code"))
+		if err != nil {
+			s.logger.Errorf("Failed to start WebAuthn enrollment: %v", err)
+			http.Error(w, "Invalid username or enrollment code.", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(options)
+	case "enroll":
+		if err := webauthnConn.Enroll(authReq.ID, r); err != nil {
+			s.logger.Errorf("Failed to enroll WebAuthn credential: %v", err)
+			http.Error(w, "Failed to register the passkey.", http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case "":
+		identity, ok, err := webauthnConn.Login(r.Context(), scopes, authReq.ID, r)
+		if err != nil {
+			s.logger.Errorf("Failed to login user: %v", err)
+			s.renderErrorWith(w, tmpls, http.StatusInternalServerError, "Login error.")
+			return
+		}
+		if !ok {
+			// The connector discards a challenge once it's been answered, so
+			// the page needs new options to try again.
+			options, err := webauthnConn.LoginOptions(authReq.ID)
+			if err != nil {
+				s.logger.Errorf("Failed to create WebAuthn options: %v", err)
+				s.renderErrorWith(w, tmpls, http.StatusInternalServerError, "Login error.")
+				return
+			}
+			if err := tmpls.webauthn(w, r.URL.String(), string(options), true, showBacklink); err != nil {
+				s.logger.Errorf("Server template error: %v", err)
+			}
+			return
+		}
+		redirectURL, err := s.finalizeLogin(identity, authReq, conn)
+		if loginDenied(err) {
+			s.denyLogin(w, r, authReq, identity, err)
+			return
+		}
+		if err != nil {
+			s.logger.Errorf("Failed to finalize login: %v", err)
+			s.renderErrorWith(w, tmpls, http.StatusInternalServerError, "Login error.")
+			return
+		}
+		http.Redirect(w, r, redirectURL, http.StatusSeeOther)
+	default:
+		http.Error(w, "Unsupported action.", http.StatusBadRequest)
+	}
+}
+
+// handleAdminWebAuthnCredentials removes the credentials a user registered
+// with a WebAuthn connector on DELETE, so a user who lost their passkey can
+// enroll a new one.
+func (s *Server) handleAdminWebAuthnCredentials(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "DELETE")
+		s.tokenErrHelper(w, errInvalidRequest, "Unsupported request method.", http.StatusMethodNotAllowed)
+		return
+	}
+	connID, userID := mux.Vars(r)["connector"], mux.Vars(r)["user"]
+	creds, err := s.storage.ListWebAuthnCredentials()
+	if err != nil {
+		s.logger.Errorf("failed to list webauthn credentials: %v", err)
+		s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+	deleted := 0
+	for _, c := range creds {
+		if c.ConnectorID != connID || c.UserID != userID {
+			continue
+		}
+		if err := s.storage.DeleteWebAuthnCredential(c.ID); err != nil && err != storage.ErrNotFound {
+			s.logger.Errorf("failed to delete webauthn credential: %v", err)
+			s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+			return
+		}
+		deleted++
+	}
+	if deleted == 0 {
+		s.tokenErrHelper(w, errInvalidRequest, "No credentials registered.", http.StatusNotFound)
+		return
+	}
+	s.logger.Infof("removed %d webauthn credentials of user %q of connector %q", deleted, userID, connID)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dexidp/dex/storage"
+)
+
+func TestAdminWebAuthnCredentials(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, server := newTestServer(ctx, t, func(c *Config) {
+		c.AdminAPIKey = "admin-key"
+	})
+	defer httpServer.Close()
+
+	for _, c := range []storage.WebAuthnCredential{
+		{ID: "1", ConnectorID: "passkey", CredentialID: []byte("1"), UserID: "jane"},
+		{ID: "2", ConnectorID: "passkey", CredentialID: []byte("2"), UserID: "john"},
+		{ID: "3", ConnectorID: "other", CredentialID: []byte("3"), UserID: "jane"},
+	} {
+		if err := server.storage.CreateWebAuthnCredential(c); err != nil {
+			t.Fatalf("create credential: %v", err)
+		}
+	}
+
+	remove := func(key string) int {
+		req := httptest.NewRequest("DELETE", "/admin/connectors/passkey/webauthn/jane", nil)
+		req.Header.Set("Authorization", "Bearer "+key)
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, req)
+		return rr.Code
+	}
+	if code := remove("wrong"); code != http.StatusUnauthorized {
+		t.Errorf("expected an invalid admin key to be rejected, got %d", code)
+	}
+	if code := remove("admin-key"); code != http.StatusNoContent {
+		t.Fatalf("expected the credentials to be removed, got %d", code)
+	}
+	if code := remove("admin-key"); code != http.StatusNotFound {
+		t.Errorf("expected no credentials left to remove, got %d", code)
+	}
+
+	creds, err := server.storage.ListWebAuthnCredentials()
+	if err != nil {
+		t.Fatalf("list credentials: %v", err)
+	}
+	if len(creds) != 2 {
+		t.Errorf("expected the credentials of other users and connectors to be kept, got %v", creds)
+	}
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/dexidp/dex/pkg/log"
+	"github.com/dexidp/dex/storage"
+)
+
+// TokenWebhook configures a policy service called before each ID token is
+// issued. It may add claims to the token or deny its issuance.
+type TokenWebhook struct {
+	URL string
+
+	// Defaults to 5 seconds.
+	Timeout time.Duration
+
+	// If set, tokens are issued without the webhook's claims when it can't be
+	// reached or fails. Otherwise issuance fails too.
+	FailOpen bool
+}
+
+// tokenWebhookRequest is the body POSTed to the webhook. It only holds
+// information the client is about to receive or already knows, never secrets
+// such as the client secret, refresh tokens or connector data.
+type tokenWebhookRequest struct {
+	ClientID string                 `json:"client_id"`
+	Scopes   []string               `json:"scopes"`
+	User     tokenWebhookUser       `json:"user"`
+	Claims   map[string]interface{} `json:"claims"`
+}
+
+type tokenWebhookUser struct {
+	ConnectorID   string   `json:"connector_id"`
+	UserID        string   `json:"user_id"`
+	Username      string   `json:"username,omitempty"`
+	Email         string   `json:"email,omitempty"`
+	EmailVerified bool     `json:"email_verified"`
+	Groups        []string `json:"groups,omitempty"`
+}
+
+type tokenWebhookResponse struct {
+	// If set, the token isn't issued and the reason is returned to the client.
+	Deny   bool   `json:"deny"`
+	Reason string `json:"reason"`
+
+	// Claims to add to the token, or replace in it. Standard claims, which dex
+	// sets itself, can't be changed.
+	Claims map[string]interface{} `json:"claims"`
+}
+
+// tokenDeniedError is returned by newIDToken when the webhook denies issuing
+// a token, or the token would exceed the maximum size.
+type tokenDeniedError struct {
+	reason string
+}
+
+func (e tokenDeniedError) Error() string {
+	if e.reason == "" {
+		return "Token issuance was denied by policy."
+	}
+	return e.reason
+}
+
+type tokenWebhook struct {
+	url      string
+	client   *http.Client
+	failOpen bool
+
+	// Custom claims the webhook can't change in addition to the reserved ones.
+	protected map[string]bool
+
+	logger log.Logger
+}
+
+func newTokenWebhook(c TokenWebhook, connectorIDClaim string, logger log.Logger) *tokenWebhook {
+	if c.URL == "" {
+		return nil
+	}
+	w := &tokenWebhook{
+		url:       c.URL,
+		client:    &http.Client{Timeout: value(c.Timeout, 5*time.Second)},
+		failOpen:  c.FailOpen,
+		protected: map[string]bool{},
+		logger:    logger,
+	}
+	if connectorIDClaim != "" {
+		w.protected[connectorIDClaim] = true
+	}
+	return w
+}
+
+// claims calls the webhook with the draft claims of a token and returns the
+// claims it adds. It returns a tokenDeniedError if the webhook denies the
+// token.
+func (w *tokenWebhook) claims(clientID, connID string, scopes []string, claims storage.Claims, draft map[string]interface{}) (map[string]interface{}, error) {
+	resp, err := w.call(tokenWebhookRequest{
+		ClientID: clientID,
+		Scopes:   scopes,
+		User: tokenWebhookUser{
+			ConnectorID:   connID,
+			UserID:        claims.UserID,
+			Username:      claims.Username,
+			Email:         claims.Email,
+			EmailVerified: claims.EmailVerified,
+			Groups:        claims.Groups,
+		},
+		Claims: draft,
+	})
+	if err != nil {
+		if w.failOpen {
+			w.logger.Errorf("token webhook failed, issuing token without it: %v", err)
+			return nil, nil
+		}
+		return nil, fmt.Errorf("token webhook failed: %v", err)
+	}
+	if resp.Deny {
+		w.logger.Infof("token webhook denied token for client %q, user %q: %s", clientID, claims.UserID, resp.Reason)
+		return nil, tokenDeniedError{resp.Reason}
+	}
+
+	for name := range resp.Claims {
+		if reservedClaim(name) || w.protected[name] {
+			w.logger.Errorf("token webhook can't set claim %q, ignoring it", name)
+			delete(resp.Claims, name)
+		}
+	}
+	return resp.Claims, nil
+}
+
+func (w *tokenWebhook) call(req tokenWebhookRequest) (*tokenWebhookResponse, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	httpReq, err := http.NewRequest("POST", w.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	httpResp, err := w.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, httpResp.Body)
+		return nil, fmt.Errorf("unexpected status %s", httpResp.Status)
+	}
+	var resp tokenWebhookResponse
+	if err := json.NewDecoder(io.LimitReader(httpResp.Body, 1<<20)).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("decode response: %v", err)
+	}
+	return &resp, nil
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dexidp/dex/storage"
+)
+
+func TestTokenWebhook(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		delay    time.Duration
+		failOpen bool
+
+		wantCode   int
+		wantError  string
+		wantClaims map[string]interface{}
+	}{
+		{
+			name:       "add claim",
+			response:   `{"claims": {"department": "fiction", "sub": "someone-else"}}`,
+			wantCode:   http.StatusOK,
+			wantClaims: map[string]interface{}{"department": "fiction"},
+		},
+		{
+			name:      "deny",
+			response:  `{"deny": true, "reason": "Outside of business hours."}`,
+			wantCode:  http.StatusForbidden,
+			wantError: errAccessDenied,
+		},
+		{
+			name:      "timeout fail closed",
+			response:  `{"claims": {"department": "fiction"}}`,
+			delay:     time.Second,
+			wantCode:  http.StatusInternalServerError,
+			wantError: errServerError,
+		},
+		{
+			name:       "timeout fail open",
+			response:   `{"claims": {"department": "fiction"}}`,
+			delay:      time.Second,
+			failOpen:   true,
+			wantCode:   http.StatusOK,
+			wantClaims: map[string]interface{}{"department": nil},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			var req tokenWebhookRequest
+			webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+					t.Errorf("decode webhook request: %v", err)
+				}
+				time.Sleep(tc.delay)
+				w.Write([]byte(tc.response))
+			}))
+			defer webhook.Close()
+
+			httpServer, server := newTestServer(ctx, t, func(c *Config) {
+				c.TokenWebhook = TokenWebhook{URL: webhook.URL, Timeout: 100 * time.Millisecond, FailOpen: tc.failOpen}
+			})
+			defer httpServer.Close()
+
+			client := storage.Client{ID: "client", Secret: "secret", RedirectURIs: []string{"https://app.example.com/callback"}}
+			if err := server.storage.CreateClient(client); err != nil {
+				t.Fatalf("create client: %v", err)
+			}
+			code := storage.AuthCode{
+				ID:            storage.NewID(),
+				ClientID:      client.ID,
+				RedirectURI:   client.RedirectURIs[0],
+				Scopes:        []string{scopeOpenID, scopeEmail},
+				ConnectorID:   "mock",
+				Claims:        storage.Claims{UserID: "1", Email: "kilgore@kilgore.trout", EmailVerified: true},
+				ConnectorData: []byte(`{"token": "upstream-secret"}`),
+				Expiry:        server.now().Add(time.Hour),
+			}
+			if err := server.storage.CreateAuthCode(code); err != nil {
+				t.Fatalf("create auth code: %v", err)
+			}
+
+			form := url.Values{
+				"grant_type":   {grantTypeAuthorizationCode},
+				"code":         {code.ID},
+				"redirect_uri": {code.RedirectURI},
+			}
+			r := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r.SetBasicAuth(client.ID, client.Secret)
+			rr := httptest.NewRecorder()
+			server.ServeHTTP(rr, r)
+			if rr.Code != tc.wantCode {
+				t.Fatalf("expected %d, got %d: %s", tc.wantCode, rr.Code, rr.Body)
+			}
+
+			if req.ClientID != client.ID || req.User.Email != "kilgore@kilgore.trout" || req.Claims["email"] != "kilgore@kilgore.trout" {
+				t.Errorf("expected the webhook to receive the client, user and draft claims, got %+v", req)
+			}
+			if payload, _ := json.Marshal(req); strings.Contains(string(payload), "secret") {
+				t.Errorf("expected no secrets to be sent to the webhook, got %s", payload)
+			}
+
+			var resp struct {
+				IDToken string `json:"id_token"`
+				Error   string `json:"error"`
+			}
+			if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("unmarshal token response: %v", err)
+			}
+			if resp.Error != tc.wantError {
+				t.Errorf("expected error %q, got %q", tc.wantError, resp.Error)
+			}
+			if tc.wantClaims == nil {
+				return
+			}
+
+			parts := strings.Split(resp.IDToken, ".")
+			if len(parts) != 3 {
+				t.Fatalf("malformed id token %q", resp.IDToken)
+			}
+			data, err := base64.RawURLEncoding.DecodeString(parts[1])
+			if err != nil {
+				t.Fatalf("decode id token: %v", err)
+			}
+			var claims map[string]interface{}
+			if err := json.Unmarshal(data, &claims); err != nil {
+				t.Fatalf("unmarshal id token: %v", err)
+			}
+			for name, want := range tc.wantClaims {
+				if got := claims[name]; got != want {
+					t.Errorf("expected claim %q to be %v, got %v", name, want, got)
+				}
+			}
+			if claims["sub"] == "someone-else" {
+				t.Errorf("expected the webhook not to replace a reserved claim")
+			}
+		})
+	}
+}
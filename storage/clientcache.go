@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"sync"
+	"time"
+)
+
+// Tests for this code are in the "memory" package, since this package doesn't
+// define a concrete storage implementation.
+
+// ClientCacheConfig controls how client lookups are cached.
+type ClientCacheConfig struct {
+	// How long a client is served from the cache before being looked up
+	// again. Must be positive.
+	TTL time.Duration
+
+	// Maximum number of clients cached. Defaults to 1000.
+	Size int
+
+	// Used to expire cached clients. Defaults to time.Now.
+	Now func() time.Time
+}
+
+type cachedClient struct {
+	client Client
+	expiry time.Time
+}
+
+// clientCacheStorage serves client lookups from memory, sparing the backing
+// store a query on every authorization and token request.
+type clientCacheStorage struct {
+	Storage
+
+	ttl  time.Duration
+	size int
+	now  func() time.Time
+
+	mu      sync.Mutex
+	clients map[string]cachedClient
+	// Incremented whenever a client is changed, so lookups racing with a
+	// change don't cache what they read before it.
+	generation uint64
+}
+
+// WithClientCache caches the clients looked up in the underlying storage.
+//
+// Clients created, updated or deleted through the returned storage, including
+// secret rotations, are evicted immediately. Changes made elsewhere, such as
+// by another dex instance sharing the backing store, are only seen once the
+// cached client expires.
+func WithClientCache(s Storage, c ClientCacheConfig) Storage {
+	cache := &clientCacheStorage{
+		Storage: s,
+		ttl:     c.TTL,
+		size:    c.Size,
+		now:     c.Now,
+		clients: make(map[string]cachedClient),
+	}
+	if cache.size == 0 {
+		cache.size = 1000
+	}
+	if cache.now == nil {
+		cache.now = time.Now
+	}
+	return cache
+}
+
+func (s *clientCacheStorage) GetClient(id string) (Client, error) {
+	s.mu.Lock()
+	cached, ok := s.clients[id]
+	generation := s.generation
+	s.mu.Unlock()
+	if ok && s.now().Before(cached.expiry) {
+		return cached.client, nil
+	}
+
+	// Clients which don't exist aren't cached, so new ones are found as soon
+	// as they're created.
+	c, err := s.Storage.GetClient(id)
+	if err != nil {
+		return c, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.generation != generation {
+		return c, nil
+	}
+	if _, ok := s.clients[id]; !ok && len(s.clients) >= s.size {
+		s.evict()
+	}
+	s.clients[id] = cachedClient{client: c, expiry: s.now().Add(s.ttl)}
+	return c, nil
+}
+
+// evict makes room for a client by dropping the expired ones, or the one
+// closest to expiring if none have. It must be called with the mutex held.
+func (s *clientCacheStorage) evict() {
+	now := s.now()
+	var oldest string
+	for id, cached := range s.clients {
+		if !now.Before(cached.expiry) {
+			delete(s.clients, id)
+			continue
+		}
+		if oldest == "" || cached.expiry.Before(s.clients[oldest].expiry) {
+			oldest = id
+		}
+	}
+	if len(s.clients) >= s.size {
+		delete(s.clients, oldest)
+	}
+}
+
+// invalidate drops a client from the cache after it has been changed.
+func (s *clientCacheStorage) invalidate(id string) {
+	s.mu.Lock()
+	delete(s.clients, id)
+	s.generation++
+	s.mu.Unlock()
+}
+
+func (s *clientCacheStorage) CreateClient(c Client) error {
+	defer s.invalidate(c.ID)
+	return s.Storage.CreateClient(c)
+}
+
+func (s *clientCacheStorage) UpdateClient(id string, updater func(old Client) (Client, error)) error {
+	defer s.invalidate(id)
+	return s.Storage.UpdateClient(id, updater)
+}
+
+func (s *clientCacheStorage) DeleteClient(id string) error {
+	defer s.invalidate(id)
+	return s.Storage.DeleteClient(id)
+}
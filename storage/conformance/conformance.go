@@ -47,6 +47,11 @@ func RunTests(t *testing.T, newStorage func() storage.Storage) {
 		{"KeysCRUD", testKeysCRUD},
 		{"OfflineSessionCRUD", testOfflineSessionCRUD},
 		{"ConnectorCRUD", testConnectorCRUD},
+		{"UserCRUD", testUserCRUD},
+		{"RevokedTokenCRUD", testRevokedTokenCRUD},
+		{"UsedNonceCRUD", testUsedNonceCRUD},
+		{"WebAuthnCredentialCRUD", testWebAuthnCredentialCRUD},
+		{"WebAuthnChallengeCRUD", testWebAuthnChallengeCRUD},
 		{"GarbageCollection", testGC},
 		{"TimezoneSupport", testTimezones},
 	})
@@ -88,6 +93,7 @@ func testAuthRequestCRUD(t *testing.T, s storage.Storage) {
 		Nonce:               "foo",
 		State:               "bar",
 		ForceApprovalPrompt: true,
+		RequestedClaims:     map[string]bool{"email": true, "groups": false},
 		LoggedIn:            true,
 		Expiry:              neverExpire,
 		ConnectorID:         "ldap",
@@ -98,6 +104,17 @@ func testAuthRequestCRUD(t *testing.T, s storage.Storage) {
 			Email:         "jane.doe@example.com",
 			EmailVerified: true,
 			Groups:        []string{"a", "b"},
+			Picture:       "https://example.com/jane.png",
+		},
+		PKCE: storage.PKCE{
+			CodeChallenge:       "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM",
+			CodeChallengeMethod: "S256",
+		},
+		SecondFactorFailures: 2,
+		ResponseMode:         "query.jwt",
+		SMSCode: storage.SMSCode{
+			Hash:   "8d969eef6ecad3c29a3a629280e686cf0c3f5d5a86aff3ca12020c923adc6c92",
+			Expiry: neverExpire,
 		},
 	}
 
@@ -165,20 +182,27 @@ func testAuthRequestCRUD(t *testing.T, s storage.Storage) {
 
 func testAuthCodeCRUD(t *testing.T, s storage.Storage) {
 	a1 := storage.AuthCode{
-		ID:            storage.NewID(),
-		ClientID:      "client1",
-		RedirectURI:   "https://localhost:80/callback",
-		Nonce:         "foobar",
-		Scopes:        []string{"openid", "email"},
-		Expiry:        neverExpire,
-		ConnectorID:   "ldap",
-		ConnectorData: []byte(`{"some":"data"}`),
+		ID:              storage.NewID(),
+		ClientID:        "client1",
+		RedirectURI:     "https://localhost:80/callback",
+		Nonce:           "foobar",
+		Scopes:          []string{"openid", "email"},
+		RequestedClaims: map[string]bool{"email": true},
+		Expiry:          neverExpire,
+		ConnectorID:     "ldap",
+		ConnectorData:   []byte(`{"some":"data"}`),
 		Claims: storage.Claims{
 			UserID:        "1",
 			Username:      "jane",
 			Email:         "jane.doe@example.com",
 			EmailVerified: true,
 			Groups:        []string{"a", "b"},
+			Picture:       "https://example.com/jane.png",
+			SessionID:     "session-1",
+		},
+		PKCE: storage.PKCE{
+			CodeChallenge:       "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk",
+			CodeChallengeMethod: "plain",
 		},
 	}
 
@@ -237,13 +261,31 @@ func testAuthCodeCRUD(t *testing.T, s storage.Storage) {
 }
 
 func testClientCRUD(t *testing.T, s storage.Storage) {
+	requirePKCE := true
 	id1 := storage.NewID()
 	c1 := storage.Client{
-		ID:           id1,
-		Secret:       "foobar",
-		RedirectURIs: []string{"foo://bar.com/", "https://auth.example.com"},
-		Name:         "dex client",
-		LogoURL:      "https://goo.gl/JIyzIC",
+		ID:            id1,
+		Secret:        "foobar",
+		RedirectURIs:  []string{"foo://bar.com/", "https://auth.example.com"},
+		Name:          "dex client",
+		LogoURL:       "https://goo.gl/JIyzIC",
+		ClientURL:     "https://app.example.com",
+		PolicyURL:     "https://app.example.com/privacy",
+		TOSURL:        "https://app.example.com/terms",
+		ResponseTypes: []string{"code", "code id_token"},
+		RequirePKCE:   &requirePKCE,
+		DefaultScopes: []string{"openid", "email"},
+
+		BackchannelLogoutURI:  "https://app.example.com/logout",
+		CodeReuseGraceSeconds: 2,
+		DefaultRedirectURI:    "https://auth.example.com",
+		ClaimRenames:          map[string]string{"email": "user_email"},
+		AllowedAudiences:      []string{"https://api.example.com"},
+		UniqueNonces:          true,
+		RequireEmailVerified:  true,
+		IDTokenScope:          true,
+		OAuth2Only:            true,
+		CrossClientAudience:   "peers-only",
 	}
 	err := s.DeleteClient(id1)
 	mustBeErrNotFound(t, "client", err)
@@ -275,6 +317,7 @@ func testClientCRUD(t *testing.T, s storage.Storage) {
 			t.Errorf("get client: %v", err)
 			return
 		}
+		gc.SecretRotatedAt = gc.SecretRotatedAt.UTC()
 		if diff := pretty.Compare(want, gc); diff != "" {
 			t.Errorf("client retrieved from storage did not match: %s", diff)
 		}
@@ -283,14 +326,19 @@ func testClientCRUD(t *testing.T, s storage.Storage) {
 	getAndCompare(id1, c1)
 
 	newSecret := "barfoo"
+	rotatedAt := time.Now().UTC().Round(time.Millisecond)
 	err = s.UpdateClient(id1, func(old storage.Client) (storage.Client, error) {
+		old.PreviousSecret = old.Secret
 		old.Secret = newSecret
+		old.SecretRotatedAt = rotatedAt
 		return old, nil
 	})
 	if err != nil {
 		t.Errorf("update client: %v", err)
 	}
+	c1.PreviousSecret = c1.Secret
 	c1.Secret = newSecret
+	c1.SecretRotatedAt = rotatedAt
 	getAndCompare(id1, c1)
 
 	if err := s.DeleteClient(id1); err != nil {
@@ -308,22 +356,28 @@ func testClientCRUD(t *testing.T, s storage.Storage) {
 func testRefreshTokenCRUD(t *testing.T, s storage.Storage) {
 	id := storage.NewID()
 	refresh := storage.RefreshToken{
-		ID:          id,
-		Token:       "bar",
-		Nonce:       "foo",
-		ClientID:    "client_id",
-		ConnectorID: "client_secret",
-		Scopes:      []string{"openid", "email", "profile"},
-		CreatedAt:   time.Now().UTC().Round(time.Millisecond),
-		LastUsed:    time.Now().UTC().Round(time.Millisecond),
+		ID:              id,
+		Token:           "bar",
+		Nonce:           "foo",
+		ClientID:        "client_id",
+		ConnectorID:     "client_secret",
+		Scopes:          []string{"openid", "email", "profile"},
+		RequestedClaims: map[string]bool{"groups": true},
+		CreatedAt:       time.Now().UTC().Round(time.Millisecond),
+		LastUsed:        time.Now().UTC().Round(time.Millisecond),
 		Claims: storage.Claims{
 			UserID:        "1",
 			Username:      "jane",
 			Email:         "jane.doe@example.com",
 			EmailVerified: true,
 			Groups:        []string{"a", "b"},
+			Picture:       "https://example.com/jane.png",
+			UpdatedAt:     time.Now().UTC().Round(time.Millisecond),
+			AuthTime:      time.Now().UTC().Round(time.Millisecond),
+			SessionID:     "session-1",
 		},
 		ConnectorData: []byte(`{"some":"data"}`),
+		IDTokenJTI:    "jti-1",
 	}
 	if err := s.CreateRefresh(refresh); err != nil {
 		t.Fatalf("create refresh token: %v", err)
@@ -350,6 +404,8 @@ func testRefreshTokenCRUD(t *testing.T, s storage.Storage) {
 
 		gr.CreatedAt = time.Time{}
 		gr.LastUsed = time.Time{}
+		gr.Claims.UpdatedAt = gr.Claims.UpdatedAt.UTC()
+		gr.Claims.AuthTime = gr.Claims.AuthTime.UTC()
 		want.CreatedAt = time.Time{}
 		want.LastUsed = time.Time{}
 
@@ -391,6 +447,7 @@ func testRefreshTokenCRUD(t *testing.T, s storage.Storage) {
 	updater := func(r storage.RefreshToken) (storage.RefreshToken, error) {
 		r.Token = "spam"
 		r.LastUsed = updatedAt
+		r.IDTokenJTI = "jti-2"
 		return r, nil
 	}
 	if err := s.UpdateRefreshToken(id, updater); err != nil {
@@ -398,6 +455,7 @@ func testRefreshTokenCRUD(t *testing.T, s storage.Storage) {
 	}
 	refresh.Token = "spam"
 	refresh.LastUsed = updatedAt
+	refresh.IDTokenJTI = "jti-2"
 	getAndCompare(id, refresh)
 
 	// Ensure that updating the first token doesn't impact the second. Issue #847.
@@ -587,12 +645,24 @@ func testOfflineSessionCRUD(t *testing.T, s storage.Storage) {
 func testConnectorCRUD(t *testing.T, s storage.Storage) {
 	id1 := storage.NewID()
 	config1 := []byte(`{"issuer": "https://accounts.google.com"}`)
+	jitProvisioning := false
 	c1 := storage.Connector{
 		ID:              id1,
 		Type:            "Default",
 		Name:            "Default",
 		ResourceVersion: "1",
 		Config:          config1,
+
+		AllowedEmailDomains: []string{"example.com", "*.example.org"},
+		AllowedClients:      []string{"example-app"},
+		Headers:             map[string]string{"X-Tenant-Id": "tenant"},
+		Branding: storage.ConnectorBranding{
+			Name:           "Example Corp",
+			LogoURL:        "https://example.com/logo.png",
+			SupportContact: "help@example.com",
+		},
+		JITProvisioning:    &jitProvisioning,
+		RequiredAttributes: []string{"userID", "email"},
 	}
 
 	if err := s.CreateConnector(c1); err != nil {
@@ -668,6 +738,263 @@ func testConnectorCRUD(t *testing.T, s storage.Storage) {
 	mustBeErrNotFound(t, "connector", err)
 }
 
+func testUserCRUD(t *testing.T, s storage.Storage) {
+	u1 := storage.User{
+		ID:            storage.NewID(),
+		Email:         "jane.doe@example.com",
+		Name:          "Jane Doe",
+		EmailVerified: true,
+		UpdatedAt:     time.Now().UTC().Round(time.Millisecond),
+		TOTP: storage.TOTP{
+			Secret:      "JBSWY3DPEHPK3PXP",
+			Confirmed:   true,
+			LastStep:    56666666,
+			Failures:    2,
+			LastFailure: time.Now().UTC().Round(time.Millisecond),
+		},
+		Phone: "+15551234567",
+		RemoteIdentities: []storage.RemoteIdentity{
+			{
+				ConnectorID:     "github",
+				ConnectorUserID: "1234",
+				Username:        "jane",
+				Email:           "jane.doe@example.com",
+				EmailVerified:   true,
+				Groups:          []string{"admins"},
+				Picture:         "https://example.com/jane.png",
+				LinkedAt:        time.Now().UTC().Round(time.Millisecond),
+			},
+		},
+	}
+	if err := s.CreateUser(u1); err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+
+	// Attempt to create same user twice.
+	err := s.CreateUser(u1)
+	mustBeErrAlreadyExists(t, "user", err)
+
+	getAndCompare := func(id string, want storage.User) {
+		got, err := s.GetUser(id)
+		if err != nil {
+			t.Errorf("get user: %v", err)
+			return
+		}
+		got.UpdatedAt = got.UpdatedAt.UTC()
+		got.TOTP.LastFailure = got.TOTP.LastFailure.UTC()
+		for i := range got.RemoteIdentities {
+			got.RemoteIdentities[i].LinkedAt = got.RemoteIdentities[i].LinkedAt.UTC()
+		}
+		if diff := pretty.Compare(want, got); diff != "" {
+			t.Errorf("user retrieved from storage did not match: %s", diff)
+		}
+	}
+	getAndCompare(u1.ID, u1)
+
+	users, err := s.ListUsers()
+	if err != nil {
+		t.Fatalf("list users: %v", err)
+	}
+	if len(users) != 1 || users[0].ID != u1.ID || users[0].Email != u1.Email {
+		t.Errorf("expected to list user %q, got %+v", u1.ID, users)
+	}
+
+	linked := storage.RemoteIdentity{
+		ConnectorID:     "ldap",
+		ConnectorUserID: "cn=jane",
+		Email:           "jane@example.org",
+		LinkedAt:        time.Now().UTC().Round(time.Millisecond),
+	}
+	if err := s.UpdateUser(u1.ID, func(old storage.User) (storage.User, error) {
+		old.RemoteIdentities = append(old.RemoteIdentities, linked)
+		old.Name = "Jane"
+		old.Disabled = true
+		old.UpdatedAt = linked.LinkedAt
+		old.TOTP.LastStep++
+		old.TOTP.Failures = 0
+		return old, nil
+	}); err != nil {
+		t.Fatalf("update user: %v", err)
+	}
+	u1.RemoteIdentities = append(u1.RemoteIdentities, linked)
+	u1.Name = "Jane"
+	u1.Disabled = true
+	u1.UpdatedAt = linked.LinkedAt
+	u1.TOTP.LastStep++
+	u1.TOTP.Failures = 0
+	getAndCompare(u1.ID, u1)
+
+	got, err := s.GetUserByRemoteIdentity("ldap", "cn=jane")
+	if err != nil {
+		t.Fatalf("get user by remote identity: %v", err)
+	}
+	if got.ID != u1.ID {
+		t.Errorf("expected user %q for remote identity, got %q", u1.ID, got.ID)
+	}
+
+	_, err = s.GetUserByRemoteIdentity("ldap", "cn=john")
+	mustBeErrNotFound(t, "user", err)
+
+	if err := s.UpdateUser(u1.ID, func(old storage.User) (storage.User, error) {
+		old.RemoteIdentities = old.RemoteIdentities[1:]
+		return old, nil
+	}); err != nil {
+		t.Fatalf("update user: %v", err)
+	}
+	_, err = s.GetUserByRemoteIdentity("github", "1234")
+	mustBeErrNotFound(t, "user", err)
+
+	if err := s.DeleteUser(u1.ID); err != nil {
+		t.Fatalf("delete user: %v", err)
+	}
+
+	_, err = s.GetUser(u1.ID)
+	mustBeErrNotFound(t, "user", err)
+
+	_, err = s.GetUserByRemoteIdentity("ldap", "cn=jane")
+	mustBeErrNotFound(t, "user", err)
+}
+
+func testRevokedTokenCRUD(t *testing.T, s storage.Storage) {
+	revoked := storage.RevokedToken{
+		ID:     storage.NewID(),
+		Expiry: time.Now().UTC().Round(time.Millisecond),
+	}
+	if err := s.CreateRevokedToken(revoked); err != nil {
+		t.Fatalf("create revoked token: %v", err)
+	}
+
+	err := s.CreateRevokedToken(revoked)
+	mustBeErrAlreadyExists(t, "revoked token", err)
+
+	got, err := s.GetRevokedToken(revoked.ID)
+	if err != nil {
+		t.Fatalf("get revoked token: %v", err)
+	}
+	got.Expiry = got.Expiry.UTC()
+	if diff := pretty.Compare(revoked, got); diff != "" {
+		t.Errorf("revoked token retrieved from storage did not match: %s", diff)
+	}
+
+	_, err = s.GetRevokedToken(storage.NewID())
+	mustBeErrNotFound(t, "revoked token", err)
+}
+
+func testUsedNonceCRUD(t *testing.T, s storage.Storage) {
+	nonce := storage.UsedNonce{
+		ID:     storage.NewID(),
+		Expiry: time.Now().UTC().Round(time.Millisecond),
+	}
+	if err := s.CreateUsedNonce(nonce); err != nil {
+		t.Fatalf("create used nonce: %v", err)
+	}
+
+	err := s.CreateUsedNonce(nonce)
+	mustBeErrAlreadyExists(t, "used nonce", err)
+
+	got, err := s.GetUsedNonce(nonce.ID)
+	if err != nil {
+		t.Fatalf("get used nonce: %v", err)
+	}
+	got.Expiry = got.Expiry.UTC()
+	if diff := pretty.Compare(nonce, got); diff != "" {
+		t.Errorf("used nonce retrieved from storage did not match: %s", diff)
+	}
+
+	_, err = s.GetUsedNonce(storage.NewID())
+	mustBeErrNotFound(t, "used nonce", err)
+}
+
+func testWebAuthnCredentialCRUD(t *testing.T, s storage.Storage) {
+	cred := storage.WebAuthnCredential{
+		ID:           storage.NewID(),
+		ConnectorID:  "passkey",
+		CredentialID: []byte("credential"),
+		UserID:       "jane",
+		PublicKey:    []byte("public key"),
+		SignCount:    4294967295,
+		CreatedAt:    time.Now().UTC().Round(time.Millisecond),
+	}
+	if err := s.CreateWebAuthnCredential(cred); err != nil {
+		t.Fatalf("create webauthn credential: %v", err)
+	}
+
+	err := s.CreateWebAuthnCredential(cred)
+	mustBeErrAlreadyExists(t, "webauthn credential", err)
+
+	getAndCompare := func(want storage.WebAuthnCredential) {
+		got, err := s.GetWebAuthnCredential(want.ID)
+		if err != nil {
+			t.Errorf("get webauthn credential: %v", err)
+			return
+		}
+		got.CreatedAt = got.CreatedAt.UTC()
+		if diff := pretty.Compare(want, got); diff != "" {
+			t.Errorf("webauthn credential retrieved from storage did not match: %s", diff)
+		}
+	}
+	getAndCompare(cred)
+
+	err = s.UpdateWebAuthnCredential(cred.ID, func(old storage.WebAuthnCredential) (storage.WebAuthnCredential, error) {
+		old.SignCount = 7
+		return old, nil
+	})
+	if err != nil {
+		t.Fatalf("update webauthn credential: %v", err)
+	}
+	cred.SignCount = 7
+	getAndCompare(cred)
+
+	creds, err := s.ListWebAuthnCredentials()
+	if err != nil {
+		t.Fatalf("list webauthn credentials: %v", err)
+	}
+	if len(creds) != 1 || creds[0].ID != cred.ID {
+		t.Errorf("expected to list the webauthn credential, got %v", creds)
+	}
+
+	if err := s.DeleteWebAuthnCredential(cred.ID); err != nil {
+		t.Fatalf("delete webauthn credential: %v", err)
+	}
+	_, err = s.GetWebAuthnCredential(cred.ID)
+	mustBeErrNotFound(t, "webauthn credential", err)
+
+	err = s.UpdateWebAuthnCredential(cred.ID, func(old storage.WebAuthnCredential) (storage.WebAuthnCredential, error) {
+		return old, nil
+	})
+	mustBeErrNotFound(t, "webauthn credential", err)
+}
+
+func testWebAuthnChallengeCRUD(t *testing.T, s storage.Storage) {
+	challenge := storage.WebAuthnChallenge{
+		ID:     storage.NewID(),
+		Value:  []byte("challenge"),
+		UserID: "jane",
+		Expiry: time.Now().UTC().Round(time.Millisecond),
+	}
+	if err := s.CreateWebAuthnChallenge(challenge); err != nil {
+		t.Fatalf("create webauthn challenge: %v", err)
+	}
+
+	err := s.CreateWebAuthnChallenge(challenge)
+	mustBeErrAlreadyExists(t, "webauthn challenge", err)
+
+	got, err := s.GetWebAuthnChallenge(challenge.ID)
+	if err != nil {
+		t.Fatalf("get webauthn challenge: %v", err)
+	}
+	got.Expiry = got.Expiry.UTC()
+	if diff := pretty.Compare(challenge, got); diff != "" {
+		t.Errorf("webauthn challenge retrieved from storage did not match: %s", diff)
+	}
+
+	if err := s.DeleteWebAuthnChallenge(challenge.ID); err != nil {
+		t.Fatalf("delete webauthn challenge: %v", err)
+	}
+	err = s.DeleteWebAuthnChallenge(challenge.ID)
+	mustBeErrNotFound(t, "webauthn challenge", err)
+}
+
 func testKeysCRUD(t *testing.T, s storage.Storage) {
 	updateAndCompare := func(k storage.Keys) {
 		err := s.UpdateKeys(func(oldKeys storage.Keys) (storage.Keys, error) {
@@ -827,6 +1154,84 @@ func testGC(t *testing.T, s storage.Storage) {
 	} else if err != storage.ErrNotFound {
 		t.Errorf("expected storage.ErrNotFound, got %v", err)
 	}
+
+	revoked := storage.RevokedToken{ID: storage.NewID(), Expiry: expiry}
+	if err := s.CreateRevokedToken(revoked); err != nil {
+		t.Fatalf("failed creating revoked token: %v", err)
+	}
+
+	for _, tz := range []*time.Location{time.UTC, est, pst} {
+		result, err := s.GarbageCollect(expiry.Add(-time.Hour).In(tz))
+		if err != nil {
+			t.Errorf("garbage collection failed: %v", err)
+		} else if result.RevokedTokens != 0 {
+			t.Errorf("expected no garbage collection results, got %#v", result)
+		}
+		if _, err := s.GetRevokedToken(revoked.ID); err != nil {
+			t.Errorf("expected to be able to get revoked token after GC: %v", err)
+		}
+	}
+
+	if r, err := s.GarbageCollect(expiry.Add(time.Hour)); err != nil {
+		t.Errorf("garbage collection failed: %v", err)
+	} else if r.RevokedTokens != 1 {
+		t.Errorf("expected to garbage collect 1 objects, got %d", r.RevokedTokens)
+	}
+
+	_, err = s.GetRevokedToken(revoked.ID)
+	mustBeErrNotFound(t, "revoked token", err)
+
+	nonce := storage.UsedNonce{ID: storage.NewID(), Expiry: expiry}
+	if err := s.CreateUsedNonce(nonce); err != nil {
+		t.Fatalf("failed creating used nonce: %v", err)
+	}
+
+	for _, tz := range []*time.Location{time.UTC, est, pst} {
+		result, err := s.GarbageCollect(expiry.Add(-time.Hour).In(tz))
+		if err != nil {
+			t.Errorf("garbage collection failed: %v", err)
+		} else if result.UsedNonces != 0 {
+			t.Errorf("expected no garbage collection results, got %#v", result)
+		}
+		if _, err := s.GetUsedNonce(nonce.ID); err != nil {
+			t.Errorf("expected to be able to get used nonce after GC: %v", err)
+		}
+	}
+
+	if r, err := s.GarbageCollect(expiry.Add(time.Hour)); err != nil {
+		t.Errorf("garbage collection failed: %v", err)
+	} else if r.UsedNonces != 1 {
+		t.Errorf("expected to garbage collect 1 objects, got %d", r.UsedNonces)
+	}
+
+	_, err = s.GetUsedNonce(nonce.ID)
+	mustBeErrNotFound(t, "used nonce", err)
+
+	challenge := storage.WebAuthnChallenge{ID: storage.NewID(), Value: []byte("challenge"), Expiry: expiry}
+	if err := s.CreateWebAuthnChallenge(challenge); err != nil {
+		t.Fatalf("failed creating webauthn challenge: %v", err)
+	}
+
+	for _, tz := range []*time.Location{time.UTC, est, pst} {
+		result, err := s.GarbageCollect(expiry.Add(-time.Hour).In(tz))
+		if err != nil {
+			t.Errorf("garbage collection failed: %v", err)
+		} else if result.WebAuthnChallenges != 0 {
+			t.Errorf("expected no garbage collection results, got %#v", result)
+		}
+		if _, err := s.GetWebAuthnChallenge(challenge.ID); err != nil {
+			t.Errorf("expected to be able to get webauthn challenge after GC: %v", err)
+		}
+	}
+
+	if r, err := s.GarbageCollect(expiry.Add(time.Hour)); err != nil {
+		t.Errorf("garbage collection failed: %v", err)
+	} else if r.WebAuthnChallenges != 1 {
+		t.Errorf("expected to garbage collect 1 objects, got %d", r.WebAuthnChallenges)
+	}
+
+	_, err = s.GetWebAuthnChallenge(challenge.ID)
+	mustBeErrNotFound(t, "webauthn challenge", err)
 }
 
 // testTimezones tests that backends either fully support timezones or
@@ -0,0 +1,302 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// EncryptionKey is a key encrypting the sessions kept by the storage.
+type EncryptionKey struct {
+	// Stored alongside the data it encrypts, to find the key again after a
+	// rotation. Can't contain ":".
+	ID string
+
+	// 32 random bytes.
+	Key []byte
+}
+
+// sealedPrefix starts the ConnectorData of encrypted records, telling them
+// apart from records written before encryption was enabled.
+var sealedPrefix = []byte("dexenc1:")
+
+// sealedSession is the envelope stored in the ConnectorData of encrypted
+// records. The session is encrypted with a random data key, itself encrypted
+// with the key identified by KeyID.
+type sealedSession struct {
+	KeyID   string `json:"kid"`
+	DataKey []byte `json:"key"`
+	Data    []byte `json:"data"`
+}
+
+// session holds the fields of auth requests, auth codes and refresh tokens
+// which are encrypted.
+type session struct {
+	Claims        Claims `json:"claims"`
+	ConnectorData []byte `json:"connectorData,omitempty"`
+}
+
+// encryptedStorage encrypts the claims and connector data of auth requests,
+// auth codes and refresh tokens before passing them to the underlying storage.
+type encryptedStorage struct {
+	Storage
+
+	// The first key encrypts new records, all of them decrypt.
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+// WithEncryption encrypts the claims and connector data of auth requests, auth
+// codes and refresh tokens at rest, so a copy of the backing store doesn't
+// reveal users' identities or their upstream tokens.
+//
+// The first key encrypts the records written, while all of them decrypt, so a
+// key can be rotated by adding a new one first and removing the old one once
+// the records it encrypted have expired. Records written before encryption
+// was enabled are read as is.
+func WithEncryption(s Storage, keys []EncryptionKey) (Storage, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no encryption keys")
+	}
+	e := encryptedStorage{
+		Storage: s,
+		current: keys[0].ID,
+		keys:    make(map[string]cipher.AEAD),
+	}
+	for _, k := range keys {
+		if k.ID == "" || strings.Contains(k.ID, ":") {
+			return nil, fmt.Errorf("invalid encryption key ID %q", k.ID)
+		}
+		if _, ok := e.keys[k.ID]; ok {
+			return nil, fmt.Errorf("duplicate encryption key ID %q", k.ID)
+		}
+		if len(k.Key) != 32 {
+			return nil, fmt.Errorf("encryption key %q must be 32 bytes, got %d", k.ID, len(k.Key))
+		}
+		aead, err := newAEAD(k.Key)
+		if err != nil {
+			return nil, err
+		}
+		e.keys[k.ID] = aead
+	}
+	return e, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encrypt seals plaintext with a random nonce, which is prepended to the
+// ciphertext. The additional data binds it to the record it was written for.
+func encrypt(aead cipher.AEAD, plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func decrypt(aead cipher.AEAD, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}
+
+// seal encrypts the claims and connector data of the record id, returning
+// the connector data to store in their place.
+func (e encryptedStorage) seal(id string, claims Claims, connectorData []byte) ([]byte, error) {
+	plaintext, err := json.Marshal(session{claims, connectorData})
+	if err != nil {
+		return nil, err
+	}
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	data, err := encrypt(dataAEAD, plaintext, []byte(id))
+	if err != nil {
+		return nil, err
+	}
+	wrappedKey, err := encrypt(e.keys[e.current], dataKey, []byte(e.current))
+	if err != nil {
+		return nil, err
+	}
+	envelope, err := json.Marshal(sealedSession{e.current, wrappedKey, data})
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte{}, sealedPrefix...), envelope...), nil
+}
+
+// open decrypts the claims and connector data of the record id. Records
+// which weren't encrypted are returned unchanged.
+func (e encryptedStorage) open(id string, claims Claims, connectorData []byte) (Claims, []byte, error) {
+	if !bytes.HasPrefix(connectorData, sealedPrefix) {
+		return claims, connectorData, nil
+	}
+	var envelope sealedSession
+	if err := json.Unmarshal(connectorData[len(sealedPrefix):], &envelope); err != nil {
+		return Claims{}, nil, fmt.Errorf("decode encrypted session: %v", err)
+	}
+	aead, ok := e.keys[envelope.KeyID]
+	if !ok {
+		return Claims{}, nil, fmt.Errorf("session encrypted with unknown key %q", envelope.KeyID)
+	}
+	dataKey, err := decrypt(aead, envelope.DataKey, []byte(envelope.KeyID))
+	if err != nil {
+		return Claims{}, nil, fmt.Errorf("decrypt session key: %v", err)
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return Claims{}, nil, err
+	}
+	plaintext, err := decrypt(dataAEAD, envelope.Data, []byte(id))
+	if err != nil {
+		return Claims{}, nil, fmt.Errorf("decrypt session: %v", err)
+	}
+	var s session
+	if err := json.Unmarshal(plaintext, &s); err != nil {
+		return Claims{}, nil, fmt.Errorf("decode session: %v", err)
+	}
+	return s.Claims, s.ConnectorData, nil
+}
+
+func (e encryptedStorage) sealAuthRequest(a AuthRequest) (AuthRequest, error) {
+	data, err := e.seal(a.ID, a.Claims, a.ConnectorData)
+	if err != nil {
+		return a, fmt.Errorf("encrypt auth request: %v", err)
+	}
+	a.Claims, a.ConnectorData = Claims{}, data
+	return a, nil
+}
+
+func (e encryptedStorage) openAuthRequest(a AuthRequest) (AuthRequest, error) {
+	var err error
+	if a.Claims, a.ConnectorData, err = e.open(a.ID, a.Claims, a.ConnectorData); err != nil {
+		return a, fmt.Errorf("auth request: %v", err)
+	}
+	return a, nil
+}
+
+func (e encryptedStorage) sealRefresh(r RefreshToken) (RefreshToken, error) {
+	data, err := e.seal(r.ID, r.Claims, r.ConnectorData)
+	if err != nil {
+		return r, fmt.Errorf("encrypt refresh token: %v", err)
+	}
+	r.Claims, r.ConnectorData = Claims{}, data
+	return r, nil
+}
+
+func (e encryptedStorage) openRefresh(r RefreshToken) (RefreshToken, error) {
+	var err error
+	if r.Claims, r.ConnectorData, err = e.open(r.ID, r.Claims, r.ConnectorData); err != nil {
+		return r, fmt.Errorf("refresh token: %v", err)
+	}
+	return r, nil
+}
+
+func (e encryptedStorage) CreateAuthRequest(a AuthRequest) error {
+	a, err := e.sealAuthRequest(a)
+	if err != nil {
+		return err
+	}
+	return e.Storage.CreateAuthRequest(a)
+}
+
+func (e encryptedStorage) GetAuthRequest(id string) (AuthRequest, error) {
+	a, err := e.Storage.GetAuthRequest(id)
+	if err != nil {
+		return a, err
+	}
+	return e.openAuthRequest(a)
+}
+
+func (e encryptedStorage) UpdateAuthRequest(id string, updater func(a AuthRequest) (AuthRequest, error)) error {
+	return e.Storage.UpdateAuthRequest(id, func(old AuthRequest) (AuthRequest, error) {
+		a, err := e.openAuthRequest(old)
+		if err != nil {
+			return old, err
+		}
+		if a, err = updater(a); err != nil {
+			return old, err
+		}
+		return e.sealAuthRequest(a)
+	})
+}
+
+func (e encryptedStorage) CreateAuthCode(c AuthCode) error {
+	data, err := e.seal(c.ID, c.Claims, c.ConnectorData)
+	if err != nil {
+		return fmt.Errorf("encrypt auth code: %v", err)
+	}
+	c.Claims, c.ConnectorData = Claims{}, data
+	return e.Storage.CreateAuthCode(c)
+}
+
+func (e encryptedStorage) GetAuthCode(id string) (AuthCode, error) {
+	c, err := e.Storage.GetAuthCode(id)
+	if err != nil {
+		return c, err
+	}
+	if c.Claims, c.ConnectorData, err = e.open(c.ID, c.Claims, c.ConnectorData); err != nil {
+		return c, fmt.Errorf("auth code: %v", err)
+	}
+	return c, nil
+}
+
+func (e encryptedStorage) CreateRefresh(r RefreshToken) error {
+	r, err := e.sealRefresh(r)
+	if err != nil {
+		return err
+	}
+	return e.Storage.CreateRefresh(r)
+}
+
+func (e encryptedStorage) GetRefresh(id string) (RefreshToken, error) {
+	r, err := e.Storage.GetRefresh(id)
+	if err != nil {
+		return r, err
+	}
+	return e.openRefresh(r)
+}
+
+func (e encryptedStorage) ListRefreshTokens() ([]RefreshToken, error) {
+	tokens, err := e.Storage.ListRefreshTokens()
+	if err != nil {
+		return nil, err
+	}
+	for i, r := range tokens {
+		if tokens[i], err = e.openRefresh(r); err != nil {
+			return nil, err
+		}
+	}
+	return tokens, nil
+}
+
+func (e encryptedStorage) UpdateRefreshToken(id string, updater func(r RefreshToken) (RefreshToken, error)) error {
+	return e.Storage.UpdateRefreshToken(id, func(old RefreshToken) (RefreshToken, error) {
+		r, err := e.openRefresh(old)
+		if err != nil {
+			return old, err
+		}
+		if r, err = updater(r); err != nil {
+			return old, err
+		}
+		return e.sealRefresh(r)
+	})
+}
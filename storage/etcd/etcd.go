@@ -21,6 +21,11 @@ const (
 	passwordPrefix       = "password/"
 	offlineSessionPrefix = "offline_session/"
 	connectorPrefix      = "connector/"
+	userPrefix           = "user/"
+	revokedTokenPrefix   = "revoked_token/"
+	usedNoncePrefix      = "used_nonce/"
+	webAuthnCredPrefix   = "webauthn_credential/"
+	webAuthnChallPrefix  = "webauthn_challenge/"
 	keysName             = "openid-connect-keys"
 
 	// defaultStorageTimeout will be applied to all storage's operations.
@@ -72,6 +77,60 @@ func (c *conn) GarbageCollect(now time.Time) (result storage.GCResult, err error
 			result.AuthCodes++
 		}
 	}
+	if delErr != nil {
+		return result, delErr
+	}
+
+	revokedTokens, err := c.listRevokedTokens(ctx)
+	if err != nil {
+		return result, err
+	}
+
+	for _, t := range revokedTokens {
+		if now.After(t.Expiry) {
+			if err := c.deleteKey(ctx, keyID(revokedTokenPrefix, t.ID)); err != nil {
+				c.logger.Errorf("failed to delete revoked token %v", err)
+				delErr = fmt.Errorf("failed to delete revoked token: %v", err)
+			}
+			result.RevokedTokens++
+		}
+	}
+	if delErr != nil {
+		return result, delErr
+	}
+
+	usedNonces, err := c.listUsedNonces(ctx)
+	if err != nil {
+		return result, err
+	}
+
+	for _, n := range usedNonces {
+		if now.After(n.Expiry) {
+			if err := c.deleteKey(ctx, keyID(usedNoncePrefix, n.ID)); err != nil {
+				c.logger.Errorf("failed to delete used nonce %v", err)
+				delErr = fmt.Errorf("failed to delete used nonce: %v", err)
+			}
+			result.UsedNonces++
+		}
+	}
+	if delErr != nil {
+		return result, delErr
+	}
+
+	challenges, err := c.listWebAuthnChallenges(ctx)
+	if err != nil {
+		return result, err
+	}
+
+	for _, ch := range challenges {
+		if now.After(ch.Expiry) {
+			if err := c.deleteKey(ctx, keyID(webAuthnChallPrefix, ch.ID)); err != nil {
+				c.logger.Errorf("failed to delete webauthn challenge %v", err)
+				delErr = fmt.Errorf("failed to delete webauthn challenge: %v", err)
+			}
+			result.WebAuthnChallenges++
+		}
+	}
 	return result, delErr
 }
 
@@ -393,6 +452,182 @@ func (c *conn) ListConnectors() (connectors []storage.Connector, err error) {
 	return connectors, nil
 }
 
+func (c *conn) CreateUser(u storage.User) error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultStorageTimeout)
+	defer cancel()
+	return c.txnCreate(ctx, keyID(userPrefix, u.ID), u)
+}
+
+func (c *conn) GetUser(id string) (u storage.User, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultStorageTimeout)
+	defer cancel()
+	err = c.getKey(ctx, keyID(userPrefix, id), &u)
+	return u, err
+}
+
+// GetUserByRemoteIdentity scans all users since etcd has no secondary indexes.
+func (c *conn) GetUserByRemoteIdentity(connectorID, connectorUserID string) (storage.User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultStorageTimeout)
+	defer cancel()
+	res, err := c.db.Get(ctx, userPrefix, clientv3.WithPrefix())
+	if err != nil {
+		return storage.User{}, err
+	}
+	for _, v := range res.Kvs {
+		var u storage.User
+		if err = json.Unmarshal(v.Value, &u); err != nil {
+			return storage.User{}, err
+		}
+		for _, r := range u.RemoteIdentities {
+			if r.ConnectorID == connectorID && r.ConnectorUserID == connectorUserID {
+				return u, nil
+			}
+		}
+	}
+	return storage.User{}, storage.ErrNotFound
+}
+
+func (c *conn) ListUsers() (users []storage.User, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultStorageTimeout)
+	defer cancel()
+	res, err := c.db.Get(ctx, userPrefix, clientv3.WithPrefix())
+	if err != nil {
+		return users, err
+	}
+	for _, v := range res.Kvs {
+		var u storage.User
+		if err = json.Unmarshal(v.Value, &u); err != nil {
+			return users, err
+		}
+		users = append(users, u)
+	}
+	return users, nil
+}
+
+func (c *conn) UpdateUser(id string, updater func(u storage.User) (storage.User, error)) error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultStorageTimeout)
+	defer cancel()
+	return c.txnUpdate(ctx, keyID(userPrefix, id), func(currentValue []byte) ([]byte, error) {
+		var current storage.User
+		if len(currentValue) > 0 {
+			if err := json.Unmarshal(currentValue, &current); err != nil {
+				return nil, err
+			}
+		}
+		updated, err := updater(current)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(updated)
+	})
+}
+
+func (c *conn) DeleteUser(id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultStorageTimeout)
+	defer cancel()
+	return c.deleteKey(ctx, keyID(userPrefix, id))
+}
+
+func (c *conn) CreateRevokedToken(t storage.RevokedToken) error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultStorageTimeout)
+	defer cancel()
+	return c.txnCreate(ctx, keyID(revokedTokenPrefix, t.ID), t)
+}
+
+func (c *conn) GetRevokedToken(id string) (t storage.RevokedToken, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultStorageTimeout)
+	defer cancel()
+	err = c.getKey(ctx, keyID(revokedTokenPrefix, id), &t)
+	return t, err
+}
+
+func (c *conn) CreateUsedNonce(n storage.UsedNonce) error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultStorageTimeout)
+	defer cancel()
+	return c.txnCreate(ctx, keyID(usedNoncePrefix, n.ID), n)
+}
+
+func (c *conn) GetUsedNonce(id string) (n storage.UsedNonce, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultStorageTimeout)
+	defer cancel()
+	err = c.getKey(ctx, keyID(usedNoncePrefix, id), &n)
+	return n, err
+}
+
+func (c *conn) CreateWebAuthnCredential(cred storage.WebAuthnCredential) error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultStorageTimeout)
+	defer cancel()
+	return c.txnCreate(ctx, keyID(webAuthnCredPrefix, cred.ID), cred)
+}
+
+func (c *conn) GetWebAuthnCredential(id string) (cred storage.WebAuthnCredential, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultStorageTimeout)
+	defer cancel()
+	err = c.getKey(ctx, keyID(webAuthnCredPrefix, id), &cred)
+	return cred, err
+}
+
+func (c *conn) ListWebAuthnCredentials() (creds []storage.WebAuthnCredential, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultStorageTimeout)
+	defer cancel()
+	res, err := c.db.Get(ctx, webAuthnCredPrefix, clientv3.WithPrefix())
+	if err != nil {
+		return creds, err
+	}
+	for _, v := range res.Kvs {
+		var cred storage.WebAuthnCredential
+		if err = json.Unmarshal(v.Value, &cred); err != nil {
+			return creds, err
+		}
+		creds = append(creds, cred)
+	}
+	return creds, nil
+}
+
+func (c *conn) UpdateWebAuthnCredential(id string, updater func(c storage.WebAuthnCredential) (storage.WebAuthnCredential, error)) error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultStorageTimeout)
+	defer cancel()
+	return c.txnUpdate(ctx, keyID(webAuthnCredPrefix, id), func(currentValue []byte) ([]byte, error) {
+		if len(currentValue) == 0 {
+			return nil, storage.ErrNotFound
+		}
+		var current storage.WebAuthnCredential
+		if err := json.Unmarshal(currentValue, &current); err != nil {
+			return nil, err
+		}
+		updated, err := updater(current)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(updated)
+	})
+}
+
+func (c *conn) DeleteWebAuthnCredential(id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultStorageTimeout)
+	defer cancel()
+	return c.deleteKey(ctx, keyID(webAuthnCredPrefix, id))
+}
+
+func (c *conn) CreateWebAuthnChallenge(ch storage.WebAuthnChallenge) error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultStorageTimeout)
+	defer cancel()
+	return c.txnCreate(ctx, keyID(webAuthnChallPrefix, ch.ID), ch)
+}
+
+func (c *conn) GetWebAuthnChallenge(id string) (ch storage.WebAuthnChallenge, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultStorageTimeout)
+	defer cancel()
+	err = c.getKey(ctx, keyID(webAuthnChallPrefix, id), &ch)
+	return ch, err
+}
+
+func (c *conn) DeleteWebAuthnChallenge(id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultStorageTimeout)
+	defer cancel()
+	return c.deleteKey(ctx, keyID(webAuthnChallPrefix, id))
+}
+
 func (c *conn) GetKeys() (keys storage.Keys, err error) {
 	ctx, cancel := context.WithTimeout(context.Background(), defaultStorageTimeout)
 	defer cancel()
@@ -476,6 +711,51 @@ func (c *conn) listAuthCodes(ctx context.Context) (codes []AuthCode, err error)
 	return codes, nil
 }
 
+func (c *conn) listRevokedTokens(ctx context.Context) (tokens []storage.RevokedToken, err error) {
+	res, err := c.db.Get(ctx, revokedTokenPrefix, clientv3.WithPrefix())
+	if err != nil {
+		return tokens, err
+	}
+	for _, v := range res.Kvs {
+		var t storage.RevokedToken
+		if err = json.Unmarshal(v.Value, &t); err != nil {
+			return tokens, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, nil
+}
+
+func (c *conn) listUsedNonces(ctx context.Context) (nonces []storage.UsedNonce, err error) {
+	res, err := c.db.Get(ctx, usedNoncePrefix, clientv3.WithPrefix())
+	if err != nil {
+		return nonces, err
+	}
+	for _, v := range res.Kvs {
+		var n storage.UsedNonce
+		if err = json.Unmarshal(v.Value, &n); err != nil {
+			return nonces, err
+		}
+		nonces = append(nonces, n)
+	}
+	return nonces, nil
+}
+
+func (c *conn) listWebAuthnChallenges(ctx context.Context) (challenges []storage.WebAuthnChallenge, err error) {
+	res, err := c.db.Get(ctx, webAuthnChallPrefix, clientv3.WithPrefix())
+	if err != nil {
+		return challenges, err
+	}
+	for _, v := range res.Kvs {
+		var ch storage.WebAuthnChallenge
+		if err = json.Unmarshal(v.Value, &ch); err != nil {
+			return challenges, err
+		}
+		challenges = append(challenges, ch)
+	}
+	return challenges, nil
+}
+
 func (c *conn) txnCreate(ctx context.Context, key string, value interface{}) error {
 	b, err := json.Marshal(value)
 	if err != nil {
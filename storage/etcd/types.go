@@ -20,20 +20,26 @@ type AuthCode struct {
 	ConnectorData []byte `json:"connectorData,omitempty"`
 	Claims        Claims `json:"claims,omitempty"`
 
+	RequestedClaims map[string]bool `json:"requestedClaims,omitempty"`
+
 	Expiry time.Time `json:"expiry"`
+
+	PKCE storage.PKCE `json:"pkce"`
 }
 
 func fromStorageAuthCode(a storage.AuthCode) AuthCode {
 	return AuthCode{
-		ID:            a.ID,
-		ClientID:      a.ClientID,
-		RedirectURI:   a.RedirectURI,
-		ConnectorID:   a.ConnectorID,
-		ConnectorData: a.ConnectorData,
-		Nonce:         a.Nonce,
-		Scopes:        a.Scopes,
-		Claims:        fromStorageClaims(a.Claims),
-		Expiry:        a.Expiry,
+		ID:              a.ID,
+		ClientID:        a.ClientID,
+		RedirectURI:     a.RedirectURI,
+		ConnectorID:     a.ConnectorID,
+		ConnectorData:   a.ConnectorData,
+		Nonce:           a.Nonce,
+		Scopes:          a.Scopes,
+		Claims:          fromStorageClaims(a.Claims),
+		RequestedClaims: a.RequestedClaims,
+		Expiry:          a.Expiry,
+		PKCE:            a.PKCE,
 	}
 }
 
@@ -50,6 +56,8 @@ type AuthRequest struct {
 
 	ForceApprovalPrompt bool `json:"force_approval_prompt"`
 
+	RequestedClaims map[string]bool `json:"requested_claims,omitempty"`
+
 	Expiry time.Time `json:"expiry"`
 
 	LoggedIn bool `json:"logged_in"`
@@ -58,41 +66,59 @@ type AuthRequest struct {
 
 	ConnectorID   string `json:"connector_id"`
 	ConnectorData []byte `json:"connector_data"`
+
+	PKCE storage.PKCE `json:"pkce"`
+
+	SecondFactorFailures int `json:"second_factor_failures,omitempty"`
+
+	ResponseMode string `json:"response_mode,omitempty"`
+
+	SMSCode storage.SMSCode `json:"sms_code"`
 }
 
 func fromStorageAuthRequest(a storage.AuthRequest) AuthRequest {
 	return AuthRequest{
-		ID:                  a.ID,
-		ClientID:            a.ClientID,
-		ResponseTypes:       a.ResponseTypes,
-		Scopes:              a.Scopes,
-		RedirectURI:         a.RedirectURI,
-		Nonce:               a.Nonce,
-		State:               a.State,
-		ForceApprovalPrompt: a.ForceApprovalPrompt,
-		Expiry:              a.Expiry,
-		LoggedIn:            a.LoggedIn,
-		Claims:              fromStorageClaims(a.Claims),
-		ConnectorID:         a.ConnectorID,
-		ConnectorData:       a.ConnectorData,
+		ID:                   a.ID,
+		ClientID:             a.ClientID,
+		ResponseTypes:        a.ResponseTypes,
+		Scopes:               a.Scopes,
+		RedirectURI:          a.RedirectURI,
+		Nonce:                a.Nonce,
+		State:                a.State,
+		ForceApprovalPrompt:  a.ForceApprovalPrompt,
+		RequestedClaims:      a.RequestedClaims,
+		Expiry:               a.Expiry,
+		LoggedIn:             a.LoggedIn,
+		Claims:               fromStorageClaims(a.Claims),
+		ConnectorID:          a.ConnectorID,
+		ConnectorData:        a.ConnectorData,
+		PKCE:                 a.PKCE,
+		SecondFactorFailures: a.SecondFactorFailures,
+		ResponseMode:         a.ResponseMode,
+		SMSCode:              a.SMSCode,
 	}
 }
 
 func toStorageAuthRequest(a AuthRequest) storage.AuthRequest {
 	return storage.AuthRequest{
-		ID:                  a.ID,
-		ClientID:            a.ClientID,
-		ResponseTypes:       a.ResponseTypes,
-		Scopes:              a.Scopes,
-		RedirectURI:         a.RedirectURI,
-		Nonce:               a.Nonce,
-		State:               a.State,
-		ForceApprovalPrompt: a.ForceApprovalPrompt,
-		LoggedIn:            a.LoggedIn,
-		ConnectorID:         a.ConnectorID,
-		ConnectorData:       a.ConnectorData,
-		Expiry:              a.Expiry,
-		Claims:              toStorageClaims(a.Claims),
+		ID:                   a.ID,
+		ClientID:             a.ClientID,
+		ResponseTypes:        a.ResponseTypes,
+		Scopes:               a.Scopes,
+		RedirectURI:          a.RedirectURI,
+		Nonce:                a.Nonce,
+		State:                a.State,
+		ForceApprovalPrompt:  a.ForceApprovalPrompt,
+		RequestedClaims:      a.RequestedClaims,
+		LoggedIn:             a.LoggedIn,
+		ConnectorID:          a.ConnectorID,
+		ConnectorData:        a.ConnectorData,
+		Expiry:               a.Expiry,
+		Claims:               toStorageClaims(a.Claims),
+		PKCE:                 a.PKCE,
+		SecondFactorFailures: a.SecondFactorFailures,
+		ResponseMode:         a.ResponseMode,
+		SMSCode:              a.SMSCode,
 	}
 }
 
@@ -114,35 +140,43 @@ type RefreshToken struct {
 	Scopes []string `json:"scopes"`
 
 	Nonce string `json:"nonce"`
+
+	RequestedClaims map[string]bool `json:"requested_claims,omitempty"`
+
+	IDTokenJTI string `json:"id_token_jti,omitempty"`
 }
 
 func toStorageRefreshToken(r RefreshToken) storage.RefreshToken {
 	return storage.RefreshToken{
-		ID:            r.ID,
-		Token:         r.Token,
-		CreatedAt:     r.CreatedAt,
-		LastUsed:      r.LastUsed,
-		ClientID:      r.ClientID,
-		ConnectorID:   r.ConnectorID,
-		ConnectorData: r.ConnectorData,
-		Scopes:        r.Scopes,
-		Nonce:         r.Nonce,
-		Claims:        toStorageClaims(r.Claims),
+		ID:              r.ID,
+		Token:           r.Token,
+		CreatedAt:       r.CreatedAt,
+		LastUsed:        r.LastUsed,
+		ClientID:        r.ClientID,
+		ConnectorID:     r.ConnectorID,
+		ConnectorData:   r.ConnectorData,
+		Scopes:          r.Scopes,
+		Nonce:           r.Nonce,
+		Claims:          toStorageClaims(r.Claims),
+		RequestedClaims: r.RequestedClaims,
+		IDTokenJTI:      r.IDTokenJTI,
 	}
 }
 
 func fromStorageRefreshToken(r storage.RefreshToken) RefreshToken {
 	return RefreshToken{
-		ID:            r.ID,
-		Token:         r.Token,
-		CreatedAt:     r.CreatedAt,
-		LastUsed:      r.LastUsed,
-		ClientID:      r.ClientID,
-		ConnectorID:   r.ConnectorID,
-		ConnectorData: r.ConnectorData,
-		Scopes:        r.Scopes,
-		Nonce:         r.Nonce,
-		Claims:        fromStorageClaims(r.Claims),
+		ID:              r.ID,
+		Token:           r.Token,
+		CreatedAt:       r.CreatedAt,
+		LastUsed:        r.LastUsed,
+		ClientID:        r.ClientID,
+		ConnectorID:     r.ConnectorID,
+		ConnectorData:   r.ConnectorData,
+		Scopes:          r.Scopes,
+		Nonce:           r.Nonce,
+		Claims:          fromStorageClaims(r.Claims),
+		RequestedClaims: r.RequestedClaims,
+		IDTokenJTI:      r.IDTokenJTI,
 	}
 }
 
@@ -153,6 +187,11 @@ type Claims struct {
 	Email         string   `json:"email"`
 	EmailVerified bool     `json:"emailVerified"`
 	Groups        []string `json:"groups,omitempty"`
+	Picture       string   `json:"picture,omitempty"`
+
+	UpdatedAt time.Time `json:"updatedAt,omitempty"`
+	AuthTime  time.Time `json:"authTime,omitempty"`
+	SessionID string    `json:"sessionID,omitempty"`
 }
 
 func fromStorageClaims(i storage.Claims) Claims {
@@ -162,6 +201,10 @@ func fromStorageClaims(i storage.Claims) Claims {
 		Email:         i.Email,
 		EmailVerified: i.EmailVerified,
 		Groups:        i.Groups,
+		Picture:       i.Picture,
+		UpdatedAt:     i.UpdatedAt,
+		AuthTime:      i.AuthTime,
+		SessionID:     i.SessionID,
 	}
 }
 
@@ -172,6 +215,10 @@ func toStorageClaims(i Claims) storage.Claims {
 		Email:         i.Email,
 		EmailVerified: i.EmailVerified,
 		Groups:        i.Groups,
+		Picture:       i.Picture,
+		UpdatedAt:     i.UpdatedAt,
+		AuthTime:      i.AuthTime,
+		SessionID:     i.SessionID,
 	}
 }
 
@@ -21,6 +21,11 @@ const (
 	kindPassword        = "Password"
 	kindOfflineSessions = "OfflineSessions"
 	kindConnector       = "Connector"
+	kindUser            = "User"
+	kindRevokedToken    = "RevokedToken"
+	kindUsedNonce       = "UsedNonce"
+	kindWebAuthnCred    = "WebAuthnCredential"
+	kindWebAuthnChall   = "WebAuthnChallenge"
 )
 
 const (
@@ -32,6 +37,11 @@ const (
 	resourcePassword        = "passwords"
 	resourceOfflineSessions = "offlinesessionses" // Again attempts to pluralize.
 	resourceConnector       = "connectors"
+	resourceUser            = "users"
+	resourceRevokedToken    = "revokedtokens"
+	resourceUsedNonce       = "usednonces"
+	resourceWebAuthnCred    = "webauthncredentials"
+	resourceWebAuthnChall   = "webauthnchallenges"
 )
 
 // Config values for the Kubernetes storage type.
@@ -255,6 +265,26 @@ func (cli *client) CreateConnector(c storage.Connector) error {
 	return cli.post(resourceConnector, cli.fromStorageConnector(c))
 }
 
+func (cli *client) CreateUser(u storage.User) error {
+	return cli.post(resourceUser, cli.fromStorageUser(u))
+}
+
+func (cli *client) CreateRevokedToken(t storage.RevokedToken) error {
+	return cli.post(resourceRevokedToken, cli.fromStorageRevokedToken(t))
+}
+
+func (cli *client) CreateUsedNonce(n storage.UsedNonce) error {
+	return cli.post(resourceUsedNonce, cli.fromStorageUsedNonce(n))
+}
+
+func (cli *client) CreateWebAuthnCredential(c storage.WebAuthnCredential) error {
+	return cli.post(resourceWebAuthnCred, cli.fromStorageWebAuthnCredential(c))
+}
+
+func (cli *client) CreateWebAuthnChallenge(c storage.WebAuthnChallenge) error {
+	return cli.post(resourceWebAuthnChall, cli.fromStorageWebAuthnChallenge(c))
+}
+
 func (cli *client) GetAuthRequest(id string) (storage.AuthRequest, error) {
 	var req AuthRequest
 	if err := cli.get(resourceAuthRequest, id, &req); err != nil {
@@ -361,6 +391,86 @@ func (cli *client) GetConnector(id string) (storage.Connector, error) {
 	return toStorageConnector(c), nil
 }
 
+func (cli *client) GetUser(id string) (storage.User, error) {
+	var u User
+	if err := cli.get(resourceUser, id, &u); err != nil {
+		return storage.User{}, err
+	}
+	return toStorageUser(u), nil
+}
+
+func (cli *client) GetRevokedToken(id string) (storage.RevokedToken, error) {
+	var t RevokedToken
+	if err := cli.get(resourceRevokedToken, id, &t); err != nil {
+		return storage.RevokedToken{}, err
+	}
+	return toStorageRevokedToken(t), nil
+}
+
+func (cli *client) GetUsedNonce(id string) (storage.UsedNonce, error) {
+	var n UsedNonce
+	if err := cli.get(resourceUsedNonce, id, &n); err != nil {
+		return storage.UsedNonce{}, err
+	}
+	return toStorageUsedNonce(n), nil
+}
+
+func (cli *client) GetWebAuthnCredential(id string) (storage.WebAuthnCredential, error) {
+	var c WebAuthnCredential
+	if err := cli.get(resourceWebAuthnCred, id, &c); err != nil {
+		return storage.WebAuthnCredential{}, err
+	}
+	return toStorageWebAuthnCredential(c), nil
+}
+
+func (cli *client) GetWebAuthnChallenge(id string) (storage.WebAuthnChallenge, error) {
+	var c WebAuthnChallenge
+	if err := cli.get(resourceWebAuthnChall, id, &c); err != nil {
+		return storage.WebAuthnChallenge{}, err
+	}
+	return toStorageWebAuthnChallenge(c), nil
+}
+
+// GetUserByRemoteIdentity lists all users since Kubernetes can't index
+// arbitrary fields of a custom resource.
+
+func (cli *client) GetUserByRemoteIdentity(connectorID, connectorUserID string) (storage.User, error) {
+	var userList UserList
+	if err := cli.list(resourceUser, &userList); err != nil {
+		return storage.User{}, fmt.Errorf("failed to list users: %v", err)
+	}
+	for _, u := range userList.Users {
+		for _, r := range u.RemoteIdentities {
+			if r.ConnectorID == connectorID && r.ConnectorUserID == connectorUserID {
+				return toStorageUser(u), nil
+			}
+		}
+	}
+	return storage.User{}, storage.ErrNotFound
+}
+
+func (cli *client) ListUsers() (users []storage.User, err error) {
+	var userList UserList
+	if err = cli.list(resourceUser, &userList); err != nil {
+		return users, fmt.Errorf("failed to list users: %v", err)
+	}
+	for _, u := range userList.Users {
+		users = append(users, toStorageUser(u))
+	}
+	return
+}
+
+func (cli *client) ListWebAuthnCredentials() (creds []storage.WebAuthnCredential, err error) {
+	var credList WebAuthnCredentialList
+	if err = cli.list(resourceWebAuthnCred, &credList); err != nil {
+		return creds, fmt.Errorf("failed to list webauthn credentials: %v", err)
+	}
+	for _, c := range credList.WebAuthnCredentials {
+		creds = append(creds, toStorageWebAuthnCredential(c))
+	}
+	return
+}
+
 func (cli *client) ListClients() ([]storage.Client, error) {
 	return nil, errors.New("not implemented")
 }
@@ -445,6 +555,18 @@ func (cli *client) DeleteConnector(id string) error {
 	return cli.delete(resourceConnector, id)
 }
 
+func (cli *client) DeleteUser(id string) error {
+	return cli.delete(resourceUser, id)
+}
+
+func (cli *client) DeleteWebAuthnCredential(id string) error {
+	return cli.delete(resourceWebAuthnCred, id)
+}
+
+func (cli *client) DeleteWebAuthnChallenge(id string) error {
+	return cli.delete(resourceWebAuthnChall, id)
+}
+
 func (cli *client) UpdateRefreshToken(id string, updater func(old storage.RefreshToken) (storage.RefreshToken, error)) error {
 	r, err := cli.getRefreshToken(id)
 	if err != nil {
@@ -571,6 +693,38 @@ func (cli *client) UpdateConnector(id string, updater func(a storage.Connector)
 	return cli.put(resourceConnector, id, newConn)
 }
 
+func (cli *client) UpdateUser(id string, updater func(u storage.User) (storage.User, error)) error {
+	var u User
+	if err := cli.get(resourceUser, id, &u); err != nil {
+		return err
+	}
+
+	updated, err := updater(toStorageUser(u))
+	if err != nil {
+		return err
+	}
+
+	newUser := cli.fromStorageUser(updated)
+	newUser.ObjectMeta = u.ObjectMeta
+	return cli.put(resourceUser, id, newUser)
+}
+
+func (cli *client) UpdateWebAuthnCredential(id string, updater func(c storage.WebAuthnCredential) (storage.WebAuthnCredential, error)) error {
+	var c WebAuthnCredential
+	if err := cli.get(resourceWebAuthnCred, id, &c); err != nil {
+		return err
+	}
+
+	updated, err := updater(toStorageWebAuthnCredential(c))
+	if err != nil {
+		return err
+	}
+
+	newCred := cli.fromStorageWebAuthnCredential(updated)
+	newCred.ObjectMeta = c.ObjectMeta
+	return cli.put(resourceWebAuthnCred, id, newCred)
+}
+
 func (cli *client) GarbageCollect(now time.Time) (result storage.GCResult, err error) {
 	var authRequests AuthRequestList
 	if err := cli.list(resourceAuthRequest, &authRequests); err != nil {
@@ -605,5 +759,59 @@ func (cli *client) GarbageCollect(now time.Time) (result storage.GCResult, err e
 			result.AuthCodes++
 		}
 	}
+	if delErr != nil {
+		return result, delErr
+	}
+
+	var revokedTokens RevokedTokenList
+	if err := cli.list(resourceRevokedToken, &revokedTokens); err != nil {
+		return result, fmt.Errorf("failed to list revoked tokens: %v", err)
+	}
+
+	for _, t := range revokedTokens.RevokedTokens {
+		if now.After(t.Expiry) {
+			if err := cli.delete(resourceRevokedToken, t.ObjectMeta.Name); err != nil {
+				cli.logger.Errorf("failed to delete revoked token %v", err)
+				delErr = fmt.Errorf("failed to delete revoked token: %v", err)
+			}
+			result.RevokedTokens++
+		}
+	}
+	if delErr != nil {
+		return result, delErr
+	}
+
+	var usedNonces UsedNonceList
+	if err := cli.list(resourceUsedNonce, &usedNonces); err != nil {
+		return result, fmt.Errorf("failed to list used nonces: %v", err)
+	}
+
+	for _, n := range usedNonces.UsedNonces {
+		if now.After(n.Expiry) {
+			if err := cli.delete(resourceUsedNonce, n.ObjectMeta.Name); err != nil {
+				cli.logger.Errorf("failed to delete used nonce %v", err)
+				delErr = fmt.Errorf("failed to delete used nonce: %v", err)
+			}
+			result.UsedNonces++
+		}
+	}
+	if delErr != nil {
+		return result, delErr
+	}
+
+	var challenges WebAuthnChallengeList
+	if err := cli.list(resourceWebAuthnChall, &challenges); err != nil {
+		return result, fmt.Errorf("failed to list webauthn challenges: %v", err)
+	}
+
+	for _, c := range challenges.WebAuthnChallenges {
+		if now.After(c.Expiry) {
+			if err := cli.delete(resourceWebAuthnChall, c.ObjectMeta.Name); err != nil {
+				cli.logger.Errorf("failed to delete webauthn challenge %v", err)
+				delErr = fmt.Errorf("failed to delete webauthn challenge: %v", err)
+			}
+			result.WebAuthnChallenges++
+		}
+	}
 	return result, delErr
 }
@@ -82,6 +82,46 @@ var thirdPartyResources = []k8sapi.ThirdPartyResource{
 		Description: "Connectors available for login",
 		Versions:    []k8sapi.APIVersion{{Name: "v1"}},
 	},
+	{
+		ObjectMeta: k8sapi.ObjectMeta{
+			Name: "user.oidc.coreos.com",
+		},
+		TypeMeta:    tprMeta,
+		Description: "End users and their linked remote identities.",
+		Versions:    []k8sapi.APIVersion{{Name: "v1"}},
+	},
+	{
+		ObjectMeta: k8sapi.ObjectMeta{
+			Name: "revoked-token.oidc.coreos.com",
+		},
+		TypeMeta:    tprMeta,
+		Description: "Revoked tokens which haven't expired yet.",
+		Versions:    []k8sapi.APIVersion{{Name: "v1"}},
+	},
+	{
+		ObjectMeta: k8sapi.ObjectMeta{
+			Name: "used-nonce.oidc.coreos.com",
+		},
+		TypeMeta:    tprMeta,
+		Description: "Nonces clients may not reuse yet.",
+		Versions:    []k8sapi.APIVersion{{Name: "v1"}},
+	},
+	{
+		ObjectMeta: k8sapi.ObjectMeta{
+			Name: "web-authn-credential.oidc.coreos.com",
+		},
+		TypeMeta:    tprMeta,
+		Description: "Credentials registered with WebAuthn connectors.",
+		Versions:    []k8sapi.APIVersion{{Name: "v1"}},
+	},
+	{
+		ObjectMeta: k8sapi.ObjectMeta{
+			Name: "web-authn-challenge.oidc.coreos.com",
+		},
+		TypeMeta:    tprMeta,
+		Description: "Outstanding challenges of WebAuthn connectors.",
+		Versions:    []k8sapi.APIVersion{{Name: "v1"}},
+	},
 }
 
 var crdMeta = k8sapi.TypeMeta{
@@ -217,6 +257,81 @@ var customResourceDefinitions = []k8sapi.CustomResourceDefinition{
 			},
 		},
 	},
+	{
+		ObjectMeta: k8sapi.ObjectMeta{
+			Name: "users.dex.coreos.com",
+		},
+		TypeMeta: crdMeta,
+		Spec: k8sapi.CustomResourceDefinitionSpec{
+			Group:   apiGroup,
+			Version: "v1",
+			Names: k8sapi.CustomResourceDefinitionNames{
+				Plural:   "users",
+				Singular: "user",
+				Kind:     "User",
+			},
+		},
+	},
+	{
+		ObjectMeta: k8sapi.ObjectMeta{
+			Name: "revokedtokens.dex.coreos.com",
+		},
+		TypeMeta: crdMeta,
+		Spec: k8sapi.CustomResourceDefinitionSpec{
+			Group:   apiGroup,
+			Version: "v1",
+			Names: k8sapi.CustomResourceDefinitionNames{
+				Plural:   "revokedtokens",
+				Singular: "revokedtoken",
+				Kind:     "RevokedToken",
+			},
+		},
+	},
+	{
+		ObjectMeta: k8sapi.ObjectMeta{
+			Name: "usednonces.dex.coreos.com",
+		},
+		TypeMeta: crdMeta,
+		Spec: k8sapi.CustomResourceDefinitionSpec{
+			Group:   apiGroup,
+			Version: "v1",
+			Names: k8sapi.CustomResourceDefinitionNames{
+				Plural:   "usednonces",
+				Singular: "usednonce",
+				Kind:     "UsedNonce",
+			},
+		},
+	},
+	{
+		ObjectMeta: k8sapi.ObjectMeta{
+			Name: "webauthncredentials.dex.coreos.com",
+		},
+		TypeMeta: crdMeta,
+		Spec: k8sapi.CustomResourceDefinitionSpec{
+			Group:   apiGroup,
+			Version: "v1",
+			Names: k8sapi.CustomResourceDefinitionNames{
+				Plural:   "webauthncredentials",
+				Singular: "webauthncredential",
+				Kind:     "WebAuthnCredential",
+			},
+		},
+	},
+	{
+		ObjectMeta: k8sapi.ObjectMeta{
+			Name: "webauthnchallenges.dex.coreos.com",
+		},
+		TypeMeta: crdMeta,
+		Spec: k8sapi.CustomResourceDefinitionSpec{
+			Group:   apiGroup,
+			Version: "v1",
+			Names: k8sapi.CustomResourceDefinitionNames{
+				Plural:   "webauthnchallenges",
+				Singular: "webauthnchallenge",
+				Kind:     "WebAuthnChallenge",
+			},
+		},
+	},
 }
 
 // There will only ever be a single keys resource. Maintain this by setting a
@@ -237,10 +352,40 @@ type Client struct {
 	RedirectURIs []string `json:"redirectURIs,omitempty"`
 	TrustedPeers []string `json:"trustedPeers,omitempty"`
 
+	PreviousSecret  string    `json:"previousSecret,omitempty"`
+	SecretRotatedAt time.Time `json:"secretRotatedAt,omitempty"`
+
 	Public bool `json:"public"`
 
 	Name    string `json:"name,omitempty"`
 	LogoURL string `json:"logoURL,omitempty"`
+
+	ClientURL string `json:"clientURL,omitempty"`
+	PolicyURL string `json:"policyURL,omitempty"`
+	TOSURL    string `json:"tosURL,omitempty"`
+
+	ResponseTypes []string `json:"responseTypes,omitempty"`
+
+	RequirePKCE *bool `json:"requirePKCE,omitempty"`
+
+	DefaultScopes []string `json:"defaultScopes,omitempty"`
+
+	BackchannelLogoutURI string `json:"backchannelLogoutURI,omitempty"`
+
+	CodeReuseGraceSeconds int `json:"codeReuseGraceSeconds,omitempty"`
+
+	DefaultRedirectURI string `json:"defaultRedirectURI,omitempty"`
+
+	ClaimRenames map[string]string `json:"claimRenames,omitempty"`
+
+	AllowedAudiences []string `json:"allowedAudiences,omitempty"`
+	UniqueNonces     bool     `json:"uniqueNonces,omitempty"`
+
+	RequireEmailVerified bool `json:"requireEmailVerified,omitempty"`
+	IDTokenScope         bool `json:"idTokenScope,omitempty"`
+	OAuth2Only           bool `json:"oauth2Only,omitempty"`
+
+	CrossClientAudience string `json:"crossClientAudience,omitempty"`
 }
 
 // ClientList is a list of Clients.
@@ -260,25 +405,63 @@ func (cli *client) fromStorageClient(c storage.Client) Client {
 			Name:      cli.idToName(c.ID),
 			Namespace: cli.namespace,
 		},
-		ID:           c.ID,
-		Secret:       c.Secret,
-		RedirectURIs: c.RedirectURIs,
-		TrustedPeers: c.TrustedPeers,
-		Public:       c.Public,
-		Name:         c.Name,
-		LogoURL:      c.LogoURL,
+		ID:              c.ID,
+		Secret:          c.Secret,
+		RedirectURIs:    c.RedirectURIs,
+		TrustedPeers:    c.TrustedPeers,
+		Public:          c.Public,
+		Name:            c.Name,
+		LogoURL:         c.LogoURL,
+		ClientURL:       c.ClientURL,
+		PolicyURL:       c.PolicyURL,
+		TOSURL:          c.TOSURL,
+		ResponseTypes:   c.ResponseTypes,
+		RequirePKCE:     c.RequirePKCE,
+		DefaultScopes:   c.DefaultScopes,
+		PreviousSecret:  c.PreviousSecret,
+		SecretRotatedAt: c.SecretRotatedAt,
+
+		BackchannelLogoutURI:  c.BackchannelLogoutURI,
+		CodeReuseGraceSeconds: c.CodeReuseGraceSeconds,
+		DefaultRedirectURI:    c.DefaultRedirectURI,
+		ClaimRenames:          c.ClaimRenames,
+		AllowedAudiences:      c.AllowedAudiences,
+		UniqueNonces:          c.UniqueNonces,
+		RequireEmailVerified:  c.RequireEmailVerified,
+		IDTokenScope:          c.IDTokenScope,
+		OAuth2Only:            c.OAuth2Only,
+		CrossClientAudience:   c.CrossClientAudience,
 	}
 }
 
 func toStorageClient(c Client) storage.Client {
 	return storage.Client{
-		ID:           c.ID,
-		Secret:       c.Secret,
-		RedirectURIs: c.RedirectURIs,
-		TrustedPeers: c.TrustedPeers,
-		Public:       c.Public,
-		Name:         c.Name,
-		LogoURL:      c.LogoURL,
+		ID:              c.ID,
+		Secret:          c.Secret,
+		RedirectURIs:    c.RedirectURIs,
+		TrustedPeers:    c.TrustedPeers,
+		Public:          c.Public,
+		Name:            c.Name,
+		LogoURL:         c.LogoURL,
+		ClientURL:       c.ClientURL,
+		PolicyURL:       c.PolicyURL,
+		TOSURL:          c.TOSURL,
+		ResponseTypes:   c.ResponseTypes,
+		RequirePKCE:     c.RequirePKCE,
+		DefaultScopes:   c.DefaultScopes,
+		PreviousSecret:  c.PreviousSecret,
+		SecretRotatedAt: c.SecretRotatedAt,
+
+		BackchannelLogoutURI:  c.BackchannelLogoutURI,
+		CodeReuseGraceSeconds: c.CodeReuseGraceSeconds,
+		DefaultRedirectURI:    c.DefaultRedirectURI,
+		ClaimRenames:          c.ClaimRenames,
+		AllowedAudiences:      c.AllowedAudiences,
+		UniqueNonces:          c.UniqueNonces,
+		RequireEmailVerified:  c.RequireEmailVerified,
+		IDTokenScope:          c.IDTokenScope,
+		OAuth2Only:            c.OAuth2Only,
+		CrossClientAudience:   c.CrossClientAudience,
 	}
 }
 
@@ -289,6 +472,11 @@ type Claims struct {
 	Email         string   `json:"email"`
 	EmailVerified bool     `json:"emailVerified"`
 	Groups        []string `json:"groups,omitempty"`
+	Picture       string   `json:"picture,omitempty"`
+
+	UpdatedAt time.Time `json:"updatedAt,omitempty"`
+	AuthTime  time.Time `json:"authTime,omitempty"`
+	SessionID string    `json:"sessionID,omitempty"`
 }
 
 func fromStorageClaims(i storage.Claims) Claims {
@@ -298,6 +486,10 @@ func fromStorageClaims(i storage.Claims) Claims {
 		Email:         i.Email,
 		EmailVerified: i.EmailVerified,
 		Groups:        i.Groups,
+		Picture:       i.Picture,
+		UpdatedAt:     i.UpdatedAt,
+		AuthTime:      i.AuthTime,
+		SessionID:     i.SessionID,
 	}
 }
 
@@ -308,6 +500,10 @@ func toStorageClaims(i Claims) storage.Claims {
 		Email:         i.Email,
 		EmailVerified: i.EmailVerified,
 		Groups:        i.Groups,
+		Picture:       i.Picture,
+		UpdatedAt:     i.UpdatedAt,
+		AuthTime:      i.AuthTime,
+		SessionID:     i.SessionID,
 	}
 }
 
@@ -330,6 +526,8 @@ type AuthRequest struct {
 	// attempts.
 	ForceApprovalPrompt bool `json:"forceApprovalPrompt,omitempty"`
 
+	RequestedClaims map[string]bool `json:"requestedClaims,omitempty"`
+
 	LoggedIn bool `json:"loggedIn"`
 
 	// The identity of the end user. Generally nil until the user authenticates
@@ -340,6 +538,15 @@ type AuthRequest struct {
 	ConnectorData []byte `json:"connectorData,omitempty"`
 
 	Expiry time.Time `json:"expiry"`
+
+	CodeChallenge       string `json:"codeChallenge,omitempty"`
+	CodeChallengeMethod string `json:"codeChallengeMethod,omitempty"`
+
+	SecondFactorFailures int `json:"secondFactorFailures,omitempty"`
+
+	ResponseMode string `json:"responseMode,omitempty"`
+
+	SMSCode storage.SMSCode `json:"smsCode"`
 }
 
 // AuthRequestList is a list of AuthRequests.
@@ -359,11 +566,19 @@ func toStorageAuthRequest(req AuthRequest) storage.AuthRequest {
 		Nonce:               req.Nonce,
 		State:               req.State,
 		ForceApprovalPrompt: req.ForceApprovalPrompt,
+		RequestedClaims:     req.RequestedClaims,
 		LoggedIn:            req.LoggedIn,
 		ConnectorID:         req.ConnectorID,
 		ConnectorData:       req.ConnectorData,
 		Expiry:              req.Expiry,
 		Claims:              toStorageClaims(req.Claims),
+		PKCE: storage.PKCE{
+			CodeChallenge:       req.CodeChallenge,
+			CodeChallengeMethod: req.CodeChallengeMethod,
+		},
+		SecondFactorFailures: req.SecondFactorFailures,
+		ResponseMode:         req.ResponseMode,
+		SMSCode:              req.SMSCode,
 	}
 	return a
 }
@@ -378,18 +593,24 @@ func (cli *client) fromStorageAuthRequest(a storage.AuthRequest) AuthRequest {
 			Name:      a.ID,
 			Namespace: cli.namespace,
 		},
-		ClientID:            a.ClientID,
-		ResponseTypes:       a.ResponseTypes,
-		Scopes:              a.Scopes,
-		RedirectURI:         a.RedirectURI,
-		Nonce:               a.Nonce,
-		State:               a.State,
-		LoggedIn:            a.LoggedIn,
-		ForceApprovalPrompt: a.ForceApprovalPrompt,
-		ConnectorID:         a.ConnectorID,
-		ConnectorData:       a.ConnectorData,
-		Expiry:              a.Expiry,
-		Claims:              fromStorageClaims(a.Claims),
+		ClientID:             a.ClientID,
+		ResponseTypes:        a.ResponseTypes,
+		Scopes:               a.Scopes,
+		RedirectURI:          a.RedirectURI,
+		Nonce:                a.Nonce,
+		State:                a.State,
+		LoggedIn:             a.LoggedIn,
+		ForceApprovalPrompt:  a.ForceApprovalPrompt,
+		RequestedClaims:      a.RequestedClaims,
+		ConnectorID:          a.ConnectorID,
+		ConnectorData:        a.ConnectorData,
+		Expiry:               a.Expiry,
+		Claims:               fromStorageClaims(a.Claims),
+		CodeChallenge:        a.PKCE.CodeChallenge,
+		CodeChallengeMethod:  a.PKCE.CodeChallengeMethod,
+		SecondFactorFailures: a.SecondFactorFailures,
+		ResponseMode:         a.ResponseMode,
+		SMSCode:              a.SMSCode,
 	}
 	return req
 }
@@ -459,10 +680,15 @@ type AuthCode struct {
 
 	Claims Claims `json:"claims,omitempty"`
 
+	RequestedClaims map[string]bool `json:"requestedClaims,omitempty"`
+
 	ConnectorID   string `json:"connectorID,omitempty"`
 	ConnectorData []byte `json:"connectorData,omitempty"`
 
 	Expiry time.Time `json:"expiry"`
+
+	CodeChallenge       string `json:"codeChallenge,omitempty"`
+	CodeChallengeMethod string `json:"codeChallengeMethod,omitempty"`
 }
 
 // AuthCodeList is a list of AuthCodes.
@@ -482,28 +708,36 @@ func (cli *client) fromStorageAuthCode(a storage.AuthCode) AuthCode {
 			Name:      a.ID,
 			Namespace: cli.namespace,
 		},
-		ClientID:      a.ClientID,
-		RedirectURI:   a.RedirectURI,
-		ConnectorID:   a.ConnectorID,
-		ConnectorData: a.ConnectorData,
-		Nonce:         a.Nonce,
-		Scopes:        a.Scopes,
-		Claims:        fromStorageClaims(a.Claims),
-		Expiry:        a.Expiry,
+		ClientID:            a.ClientID,
+		RedirectURI:         a.RedirectURI,
+		ConnectorID:         a.ConnectorID,
+		ConnectorData:       a.ConnectorData,
+		Nonce:               a.Nonce,
+		Scopes:              a.Scopes,
+		Claims:              fromStorageClaims(a.Claims),
+		RequestedClaims:     a.RequestedClaims,
+		Expiry:              a.Expiry,
+		CodeChallenge:       a.PKCE.CodeChallenge,
+		CodeChallengeMethod: a.PKCE.CodeChallengeMethod,
 	}
 }
 
 func toStorageAuthCode(a AuthCode) storage.AuthCode {
 	return storage.AuthCode{
-		ID:            a.ObjectMeta.Name,
-		ClientID:      a.ClientID,
-		RedirectURI:   a.RedirectURI,
-		ConnectorID:   a.ConnectorID,
-		ConnectorData: a.ConnectorData,
-		Nonce:         a.Nonce,
-		Scopes:        a.Scopes,
-		Claims:        toStorageClaims(a.Claims),
-		Expiry:        a.Expiry,
+		ID:              a.ObjectMeta.Name,
+		ClientID:        a.ClientID,
+		RedirectURI:     a.RedirectURI,
+		ConnectorID:     a.ConnectorID,
+		ConnectorData:   a.ConnectorData,
+		Nonce:           a.Nonce,
+		Scopes:          a.Scopes,
+		Claims:          toStorageClaims(a.Claims),
+		RequestedClaims: a.RequestedClaims,
+		Expiry:          a.Expiry,
+		PKCE: storage.PKCE{
+			CodeChallenge:       a.CodeChallenge,
+			CodeChallengeMethod: a.CodeChallengeMethod,
+		},
 	}
 }
 
@@ -526,6 +760,10 @@ type RefreshToken struct {
 	Claims        Claims `json:"claims,omitempty"`
 	ConnectorID   string `json:"connectorID,omitempty"`
 	ConnectorData []byte `json:"connectorData,omitempty"`
+
+	RequestedClaims map[string]bool `json:"requestedClaims,omitempty"`
+
+	IDTokenJTI string `json:"idTokenJTI,omitempty"`
 }
 
 // RefreshList is a list of refresh tokens.
@@ -537,16 +775,18 @@ type RefreshList struct {
 
 func toStorageRefreshToken(r RefreshToken) storage.RefreshToken {
 	return storage.RefreshToken{
-		ID:            r.ObjectMeta.Name,
-		Token:         r.Token,
-		CreatedAt:     r.CreatedAt,
-		LastUsed:      r.LastUsed,
-		ClientID:      r.ClientID,
-		ConnectorID:   r.ConnectorID,
-		ConnectorData: r.ConnectorData,
-		Scopes:        r.Scopes,
-		Nonce:         r.Nonce,
-		Claims:        toStorageClaims(r.Claims),
+		ID:              r.ObjectMeta.Name,
+		Token:           r.Token,
+		CreatedAt:       r.CreatedAt,
+		LastUsed:        r.LastUsed,
+		ClientID:        r.ClientID,
+		ConnectorID:     r.ConnectorID,
+		ConnectorData:   r.ConnectorData,
+		Scopes:          r.Scopes,
+		Nonce:           r.Nonce,
+		Claims:          toStorageClaims(r.Claims),
+		RequestedClaims: r.RequestedClaims,
+		IDTokenJTI:      r.IDTokenJTI,
 	}
 }
 
@@ -560,15 +800,17 @@ func (cli *client) fromStorageRefreshToken(r storage.RefreshToken) RefreshToken
 			Name:      r.ID,
 			Namespace: cli.namespace,
 		},
-		Token:         r.Token,
-		CreatedAt:     r.CreatedAt,
-		LastUsed:      r.LastUsed,
-		ClientID:      r.ClientID,
-		ConnectorID:   r.ConnectorID,
-		ConnectorData: r.ConnectorData,
-		Scopes:        r.Scopes,
-		Nonce:         r.Nonce,
-		Claims:        fromStorageClaims(r.Claims),
+		Token:           r.Token,
+		CreatedAt:       r.CreatedAt,
+		LastUsed:        r.LastUsed,
+		ClientID:        r.ClientID,
+		ConnectorID:     r.ConnectorID,
+		ConnectorData:   r.ConnectorData,
+		Scopes:          r.Scopes,
+		Nonce:           r.Nonce,
+		Claims:          fromStorageClaims(r.Claims),
+		RequestedClaims: r.RequestedClaims,
+		IDTokenJTI:      r.IDTokenJTI,
 	}
 }
 
@@ -669,6 +911,17 @@ type Connector struct {
 	ResourceVersion string `json:"resourceVersion,omitempty"`
 	// Config holds connector specific configuration information
 	Config []byte `json:"config,omitempty"`
+
+	AllowedEmailDomains []string `json:"allowedEmailDomains,omitempty"`
+	AllowedClients      []string `json:"allowedClients,omitempty"`
+
+	Headers map[string]string `json:"headers,omitempty"`
+
+	Branding storage.ConnectorBranding `json:"branding"`
+
+	JITProvisioning *bool `json:"jitProvisioning,omitempty"`
+
+	RequiredAttributes []string `json:"requiredAttributes,omitempty"`
 }
 
 func (cli *client) fromStorageConnector(c storage.Connector) Connector {
@@ -686,6 +939,13 @@ func (cli *client) fromStorageConnector(c storage.Connector) Connector {
 		Name:            c.Name,
 		ResourceVersion: c.ResourceVersion,
 		Config:          c.Config,
+
+		AllowedEmailDomains: c.AllowedEmailDomains,
+		AllowedClients:      c.AllowedClients,
+		Headers:             c.Headers,
+		Branding:            c.Branding,
+		JITProvisioning:     c.JITProvisioning,
+		RequiredAttributes:  c.RequiredAttributes,
 	}
 }
 
@@ -696,6 +956,13 @@ func toStorageConnector(c Connector) storage.Connector {
 		Name:            c.Name,
 		ResourceVersion: c.ResourceVersion,
 		Config:          c.Config,
+
+		AllowedEmailDomains: c.AllowedEmailDomains,
+		AllowedClients:      c.AllowedClients,
+		Headers:             c.Headers,
+		Branding:            c.Branding,
+		JITProvisioning:     c.JITProvisioning,
+		RequiredAttributes:  c.RequiredAttributes,
 	}
 }
 
@@ -705,3 +972,232 @@ type ConnectorList struct {
 	k8sapi.ListMeta `json:"metadata,omitempty"`
 	Connectors      []Connector `json:"items"`
 }
+
+// User is a mirrored struct from storage with JSON struct tags and Kubernetes
+// type metadata.
+type User struct {
+	k8sapi.TypeMeta   `json:",inline"`
+	k8sapi.ObjectMeta `json:"metadata,omitempty"`
+
+	ID               string                   `json:"id,omitempty"`
+	Email            string                   `json:"email,omitempty"`
+	Name             string                   `json:"name,omitempty"`
+	EmailVerified    bool                     `json:"emailVerified,omitempty"`
+	Disabled         bool                     `json:"disabled,omitempty"`
+	RemoteIdentities []storage.RemoteIdentity `json:"remoteIdentities,omitempty"`
+	UpdatedAt        time.Time                `json:"updatedAt,omitempty"`
+	TOTP             storage.TOTP             `json:"totp,omitempty"`
+	Phone            string                   `json:"phone,omitempty"`
+}
+
+func (cli *client) fromStorageUser(u storage.User) User {
+	return User{
+		TypeMeta: k8sapi.TypeMeta{
+			Kind:       kindUser,
+			APIVersion: cli.apiVersion,
+		},
+		ObjectMeta: k8sapi.ObjectMeta{
+			Name:      u.ID,
+			Namespace: cli.namespace,
+		},
+		ID:               u.ID,
+		Email:            u.Email,
+		Name:             u.Name,
+		EmailVerified:    u.EmailVerified,
+		Disabled:         u.Disabled,
+		RemoteIdentities: u.RemoteIdentities,
+		UpdatedAt:        u.UpdatedAt,
+		TOTP:             u.TOTP,
+		Phone:            u.Phone,
+	}
+}
+
+func toStorageUser(u User) storage.User {
+	return storage.User{
+		ID:               u.ID,
+		Email:            u.Email,
+		Name:             u.Name,
+		EmailVerified:    u.EmailVerified,
+		Disabled:         u.Disabled,
+		RemoteIdentities: u.RemoteIdentities,
+		UpdatedAt:        u.UpdatedAt,
+		TOTP:             u.TOTP,
+		Phone:            u.Phone,
+	}
+}
+
+// UserList is a list of Users.
+type UserList struct {
+	k8sapi.TypeMeta `json:",inline"`
+	k8sapi.ListMeta `json:"metadata,omitempty"`
+	Users           []User `json:"items"`
+}
+
+// RevokedToken is a mirrored struct from storage with JSON struct tags and
+// Kubernetes type metadata. Its name is the ID of the token.
+type RevokedToken struct {
+	k8sapi.TypeMeta   `json:",inline"`
+	k8sapi.ObjectMeta `json:"metadata,omitempty"`
+
+	Expiry time.Time `json:"expiry"`
+}
+
+func (cli *client) fromStorageRevokedToken(t storage.RevokedToken) RevokedToken {
+	return RevokedToken{
+		TypeMeta: k8sapi.TypeMeta{
+			Kind:       kindRevokedToken,
+			APIVersion: cli.apiVersion,
+		},
+		ObjectMeta: k8sapi.ObjectMeta{
+			Name:      t.ID,
+			Namespace: cli.namespace,
+		},
+		Expiry: t.Expiry,
+	}
+}
+
+func toStorageRevokedToken(t RevokedToken) storage.RevokedToken {
+	return storage.RevokedToken{
+		ID:     t.ObjectMeta.Name,
+		Expiry: t.Expiry,
+	}
+}
+
+// RevokedTokenList is a list of RevokedTokens.
+type RevokedTokenList struct {
+	k8sapi.TypeMeta `json:",inline"`
+	k8sapi.ListMeta `json:"metadata,omitempty"`
+	RevokedTokens   []RevokedToken `json:"items"`
+}
+
+// UsedNonce is a mirrored struct from storage with JSON struct tags and
+// Kubernetes type metadata. Its name is the ID of the nonce.
+type UsedNonce struct {
+	k8sapi.TypeMeta   `json:",inline"`
+	k8sapi.ObjectMeta `json:"metadata,omitempty"`
+
+	Expiry time.Time `json:"expiry"`
+}
+
+func (cli *client) fromStorageUsedNonce(n storage.UsedNonce) UsedNonce {
+	return UsedNonce{
+		TypeMeta: k8sapi.TypeMeta{
+			Kind:       kindUsedNonce,
+			APIVersion: cli.apiVersion,
+		},
+		ObjectMeta: k8sapi.ObjectMeta{
+			Name:      n.ID,
+			Namespace: cli.namespace,
+		},
+		Expiry: n.Expiry,
+	}
+}
+
+func toStorageUsedNonce(n UsedNonce) storage.UsedNonce {
+	return storage.UsedNonce{
+		ID:     n.ObjectMeta.Name,
+		Expiry: n.Expiry,
+	}
+}
+
+// UsedNonceList is a list of UsedNonces.
+type UsedNonceList struct {
+	k8sapi.TypeMeta `json:",inline"`
+	k8sapi.ListMeta `json:"metadata,omitempty"`
+	UsedNonces      []UsedNonce `json:"items"`
+}
+
+// WebAuthnCredential is a mirrored struct from storage with JSON struct tags
+// and Kubernetes type metadata. Its name is the ID of the credential.
+type WebAuthnCredential struct {
+	k8sapi.TypeMeta   `json:",inline"`
+	k8sapi.ObjectMeta `json:"metadata,omitempty"`
+
+	ConnectorID  string    `json:"connectorID"`
+	CredentialID []byte    `json:"credentialID"`
+	UserID       string    `json:"userID"`
+	PublicKey    []byte    `json:"publicKey"`
+	SignCount    uint32    `json:"signCount"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+func (cli *client) fromStorageWebAuthnCredential(c storage.WebAuthnCredential) WebAuthnCredential {
+	return WebAuthnCredential{
+		TypeMeta: k8sapi.TypeMeta{
+			Kind:       kindWebAuthnCred,
+			APIVersion: cli.apiVersion,
+		},
+		ObjectMeta: k8sapi.ObjectMeta{
+			Name:      c.ID,
+			Namespace: cli.namespace,
+		},
+		ConnectorID:  c.ConnectorID,
+		CredentialID: c.CredentialID,
+		UserID:       c.UserID,
+		PublicKey:    c.PublicKey,
+		SignCount:    c.SignCount,
+		CreatedAt:    c.CreatedAt,
+	}
+}
+
+func toStorageWebAuthnCredential(c WebAuthnCredential) storage.WebAuthnCredential {
+	return storage.WebAuthnCredential{
+		ID:           c.ObjectMeta.Name,
+		ConnectorID:  c.ConnectorID,
+		CredentialID: c.CredentialID,
+		UserID:       c.UserID,
+		PublicKey:    c.PublicKey,
+		SignCount:    c.SignCount,
+		CreatedAt:    c.CreatedAt,
+	}
+}
+
+// WebAuthnCredentialList is a list of WebAuthnCredentials.
+type WebAuthnCredentialList struct {
+	k8sapi.TypeMeta     `json:",inline"`
+	k8sapi.ListMeta     `json:"metadata,omitempty"`
+	WebAuthnCredentials []WebAuthnCredential `json:"items"`
+}
+
+// WebAuthnChallenge is a mirrored struct from storage with JSON struct tags
+// and Kubernetes type metadata. Its name is the ID of the challenge.
+type WebAuthnChallenge struct {
+	k8sapi.TypeMeta   `json:",inline"`
+	k8sapi.ObjectMeta `json:"metadata,omitempty"`
+
+	Value  []byte    `json:"value"`
+	UserID string    `json:"userID,omitempty"`
+	Expiry time.Time `json:"expiry"`
+}
+
+func (cli *client) fromStorageWebAuthnChallenge(c storage.WebAuthnChallenge) WebAuthnChallenge {
+	return WebAuthnChallenge{
+		TypeMeta: k8sapi.TypeMeta{
+			Kind:       kindWebAuthnChall,
+			APIVersion: cli.apiVersion,
+		},
+		ObjectMeta: k8sapi.ObjectMeta{
+			Name:      c.ID,
+			Namespace: cli.namespace,
+		},
+		Value:  c.Value,
+		UserID: c.UserID,
+		Expiry: c.Expiry,
+	}
+}
+
+func toStorageWebAuthnChallenge(c WebAuthnChallenge) storage.WebAuthnChallenge {
+	return storage.WebAuthnChallenge{
+		ID:     c.ObjectMeta.Name,
+		Value:  c.Value,
+		UserID: c.UserID,
+		Expiry: c.Expiry,
+	}
+}
+
+// WebAuthnChallengeList is a list of WebAuthnChallenges.
+type WebAuthnChallengeList struct {
+	k8sapi.TypeMeta    `json:",inline"`
+	k8sapi.ListMeta    `json:"metadata,omitempty"`
+	WebAuthnChallenges []WebAuthnChallenge `json:"items"`
+}
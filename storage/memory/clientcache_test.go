@@ -0,0 +1,106 @@
+package memory
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/dexidp/dex/storage"
+)
+
+// countingStorage counts the client lookups made of the underlying storage.
+type countingStorage struct {
+	storage.Storage
+
+	lookups int
+}
+
+func (s *countingStorage) GetClient(id string) (storage.Client, error) {
+	s.lookups++
+	return s.Storage.GetClient(id)
+}
+
+func TestClientCache(t *testing.T) {
+	logger := &logrus.Logger{
+		Out:       os.Stderr,
+		Formatter: &logrus.TextFormatter{DisableColors: true},
+		Level:     logrus.DebugLevel,
+	}
+	backing := &countingStorage{Storage: New(logger)}
+	now := time.Now()
+	s := storage.WithClientCache(backing, storage.ClientCacheConfig{
+		TTL:  time.Minute,
+		Size: 2,
+		Now:  func() time.Time { return now },
+	})
+
+	if err := s.CreateClient(storage.Client{ID: "foo", Secret: "old_secret"}); err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := s.GetClient("foo"); err != nil {
+			t.Fatalf("get client: %v", err)
+		}
+	}
+	if backing.lookups != 1 {
+		t.Errorf("expected lookups within the TTL to be served from the cache, got %d lookups", backing.lookups)
+	}
+
+	// Rotating the secret must stop the old one from being served.
+	if err := s.UpdateClient("foo", func(old storage.Client) (storage.Client, error) {
+		old.PreviousSecret = ""
+		old.Secret = "new_secret"
+		return old, nil
+	}); err != nil {
+		t.Fatalf("update client: %v", err)
+	}
+	c, err := s.GetClient("foo")
+	if err != nil {
+		t.Fatalf("get client: %v", err)
+	}
+	if c.Secret != "new_secret" || backing.lookups != 2 {
+		t.Errorf("expected the rotated secret to be looked up again, got %q after %d lookups", c.Secret, backing.lookups)
+	}
+
+	// Changes made elsewhere are seen once the cached client expires.
+	if err := backing.UpdateClient("foo", func(old storage.Client) (storage.Client, error) {
+		old.Name = "Foo"
+		return old, nil
+	}); err != nil {
+		t.Fatalf("update client: %v", err)
+	}
+	if c, _ := s.GetClient("foo"); c.Name != "" {
+		t.Errorf("expected the cached client to be served within the TTL, got name %q", c.Name)
+	}
+	now = now.Add(time.Minute)
+	if c, _ := s.GetClient("foo"); c.Name != "Foo" {
+		t.Errorf("expected the client to be looked up again after the TTL, got name %q", c.Name)
+	}
+
+	if err := s.DeleteClient("foo"); err != nil {
+		t.Fatalf("delete client: %v", err)
+	}
+	if _, err := s.GetClient("foo"); err != storage.ErrNotFound {
+		t.Errorf("expected a deleted client to be gone, got %v", err)
+	}
+
+	// The cache holds at most two clients, dropping the oldest.
+	for _, id := range []string{"a", "b", "c"} {
+		if err := backing.CreateClient(storage.Client{ID: id}); err != nil {
+			t.Fatalf("create client: %v", err)
+		}
+		now = now.Add(time.Second)
+		if _, err := s.GetClient(id); err != nil {
+			t.Fatalf("get client: %v", err)
+		}
+	}
+	backing.lookups = 0
+	for _, id := range []string{"b", "c", "a"} {
+		s.GetClient(id)
+	}
+	if backing.lookups != 1 {
+		t.Errorf("expected only the evicted client to be looked up again, got %d lookups", backing.lookups)
+	}
+}
@@ -0,0 +1,155 @@
+package memory
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/dexidp/dex/storage"
+	"github.com/dexidp/dex/storage/conformance"
+)
+
+func testEncryptionKey(id string, b byte) storage.EncryptionKey {
+	return storage.EncryptionKey{ID: id, Key: bytes.Repeat([]byte{b}, 32)}
+}
+
+func TestEncryptedStorage(t *testing.T) {
+	logger := &logrus.Logger{
+		Out:       os.Stderr,
+		Formatter: &logrus.TextFormatter{DisableColors: true},
+		Level:     logrus.DebugLevel,
+	}
+
+	newStorage := func() storage.Storage {
+		s, err := storage.WithEncryption(New(logger), []storage.EncryptionKey{testEncryptionKey("1", 1)})
+		if err != nil {
+			t.Fatalf("wrap storage: %v", err)
+		}
+		return s
+	}
+	conformance.RunTests(t, newStorage)
+}
+
+func TestEncryption(t *testing.T) {
+	logger := &logrus.Logger{
+		Out:       os.Stderr,
+		Formatter: &logrus.TextFormatter{DisableColors: true},
+		Level:     logrus.DebugLevel,
+	}
+	backing := New(logger)
+	oldKey, newKey := testEncryptionKey("old", 1), testEncryptionKey("new", 2)
+
+	s, err := storage.WithEncryption(backing, []storage.EncryptionKey{oldKey})
+	if err != nil {
+		t.Fatalf("wrap storage: %v", err)
+	}
+	claims := storage.Claims{UserID: "1", Username: "jane", Email: "jane.doe@example.com", Groups: []string{"admins"}}
+	connectorData := []byte(`{"access_token":"upstream-secret"}`)
+	refresh := storage.RefreshToken{
+		ID:            "refresh",
+		Token:         "bar",
+		ClientID:      "client",
+		ConnectorID:   "mock",
+		Claims:        claims,
+		ConnectorData: connectorData,
+		CreatedAt:     time.Now().UTC().Round(time.Millisecond),
+		LastUsed:      time.Now().UTC().Round(time.Millisecond),
+	}
+	if err := s.CreateRefresh(refresh); err != nil {
+		t.Fatalf("create refresh token: %v", err)
+	}
+
+	stored, err := backing.GetRefresh(refresh.ID)
+	if err != nil {
+		t.Fatalf("get stored refresh token: %v", err)
+	}
+	if stored.Claims.UserID != "" || stored.Claims.Email != "" {
+		t.Errorf("expected claims not to be stored in plaintext, got %+v", stored.Claims)
+	}
+	for _, secret := range []string{"jane.doe@example.com", "upstream-secret", "admins"} {
+		if bytes.Contains(stored.ConnectorData, []byte(secret)) {
+			t.Errorf("expected %q not to be stored in plaintext: %s", secret, stored.ConnectorData)
+		}
+	}
+
+	check := func(s storage.Storage) {
+		t.Helper()
+		got, err := s.GetRefresh(refresh.ID)
+		if err != nil {
+			t.Fatalf("get refresh token: %v", err)
+		}
+		if got.Claims.Email != claims.Email || len(got.Claims.Groups) != 1 || !bytes.Equal(got.ConnectorData, connectorData) {
+			t.Errorf("expected the refresh token to be decrypted, got %+v", got)
+		}
+	}
+	check(s)
+
+	// Rotate the key: records encrypted with the old one are still read, and
+	// updates encrypt them with the new one.
+	rotated, err := storage.WithEncryption(backing, []storage.EncryptionKey{newKey, oldKey})
+	if err != nil {
+		t.Fatalf("wrap storage: %v", err)
+	}
+	check(rotated)
+	if err := rotated.UpdateRefreshToken(refresh.ID, func(r storage.RefreshToken) (storage.RefreshToken, error) {
+		r.Token = "baz"
+		return r, nil
+	}); err != nil {
+		t.Fatalf("update refresh token: %v", err)
+	}
+	newOnly, err := storage.WithEncryption(backing, []storage.EncryptionKey{newKey})
+	if err != nil {
+		t.Fatalf("wrap storage: %v", err)
+	}
+	check(newOnly)
+	if _, err := s.GetRefresh(refresh.ID); err == nil {
+		t.Errorf("expected the record not to decrypt once rotated away from the old key")
+	}
+
+	// Encrypted data moved to another record doesn't decrypt.
+	stored, err = backing.GetRefresh(refresh.ID)
+	if err != nil {
+		t.Fatalf("get stored refresh token: %v", err)
+	}
+	stored.ID = "moved"
+	if err := backing.CreateRefresh(stored); err != nil {
+		t.Fatalf("create refresh token: %v", err)
+	}
+	if _, err := newOnly.GetRefresh("moved"); err == nil {
+		t.Errorf("expected data moved to another record not to decrypt")
+	}
+
+	// Records written before encryption was enabled are read as is.
+	plain := storage.AuthRequest{ID: "plain", ClientID: "client", Claims: claims, ConnectorData: connectorData, Expiry: time.Now().Add(time.Hour)}
+	if err := backing.CreateAuthRequest(plain); err != nil {
+		t.Fatalf("create auth request: %v", err)
+	}
+	a, err := newOnly.GetAuthRequest(plain.ID)
+	if err != nil {
+		t.Fatalf("get auth request: %v", err)
+	}
+	if a.Claims.Email != claims.Email || !bytes.Equal(a.ConnectorData, connectorData) {
+		t.Errorf("expected the plaintext auth request to be read, got %+v", a)
+	}
+}
+
+func TestEncryptionKeys(t *testing.T) {
+	tests := []struct {
+		name string
+		keys []storage.EncryptionKey
+	}{
+		{"no keys", nil},
+		{"short key", []storage.EncryptionKey{{ID: "1", Key: []byte("short")}}},
+		{"no ID", []storage.EncryptionKey{testEncryptionKey("", 1)}},
+		{"invalid ID", []storage.EncryptionKey{testEncryptionKey("a:b", 1)}},
+		{"duplicate ID", []storage.EncryptionKey{testEncryptionKey("1", 1), testEncryptionKey("1", 2)}},
+	}
+	for _, tc := range tests {
+		if _, err := storage.WithEncryption(New(nil), tc.keys); err == nil {
+			t.Errorf("%s: expected an error", tc.name)
+		}
+	}
+}
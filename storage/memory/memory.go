@@ -13,14 +13,19 @@ import (
 // New returns an in memory storage.
 func New(logger log.Logger) storage.Storage {
 	return &memStorage{
-		clients:         make(map[string]storage.Client),
-		authCodes:       make(map[string]storage.AuthCode),
-		refreshTokens:   make(map[string]storage.RefreshToken),
-		authReqs:        make(map[string]storage.AuthRequest),
-		passwords:       make(map[string]storage.Password),
-		offlineSessions: make(map[offlineSessionID]storage.OfflineSessions),
-		connectors:      make(map[string]storage.Connector),
-		logger:          logger,
+		clients:             make(map[string]storage.Client),
+		authCodes:           make(map[string]storage.AuthCode),
+		refreshTokens:       make(map[string]storage.RefreshToken),
+		authReqs:            make(map[string]storage.AuthRequest),
+		passwords:           make(map[string]storage.Password),
+		offlineSessions:     make(map[offlineSessionID]storage.OfflineSessions),
+		connectors:          make(map[string]storage.Connector),
+		users:               make(map[string]storage.User),
+		revokedTokens:       make(map[string]storage.RevokedToken),
+		usedNonces:          make(map[string]storage.UsedNonce),
+		webAuthnCredentials: make(map[string]storage.WebAuthnCredential),
+		webAuthnChallenges:  make(map[string]storage.WebAuthnChallenge),
+		logger:              logger,
 	}
 }
 
@@ -39,13 +44,18 @@ func (c *Config) Open(logger log.Logger) (storage.Storage, error) {
 type memStorage struct {
 	mu sync.Mutex
 
-	clients         map[string]storage.Client
-	authCodes       map[string]storage.AuthCode
-	refreshTokens   map[string]storage.RefreshToken
-	authReqs        map[string]storage.AuthRequest
-	passwords       map[string]storage.Password
-	offlineSessions map[offlineSessionID]storage.OfflineSessions
-	connectors      map[string]storage.Connector
+	clients             map[string]storage.Client
+	authCodes           map[string]storage.AuthCode
+	refreshTokens       map[string]storage.RefreshToken
+	authReqs            map[string]storage.AuthRequest
+	passwords           map[string]storage.Password
+	offlineSessions     map[offlineSessionID]storage.OfflineSessions
+	connectors          map[string]storage.Connector
+	users               map[string]storage.User
+	revokedTokens       map[string]storage.RevokedToken
+	usedNonces          map[string]storage.UsedNonce
+	webAuthnCredentials map[string]storage.WebAuthnCredential
+	webAuthnChallenges  map[string]storage.WebAuthnChallenge
 
 	keys storage.Keys
 
@@ -79,6 +89,24 @@ func (s *memStorage) GarbageCollect(now time.Time) (result storage.GCResult, err
 				result.AuthRequests++
 			}
 		}
+		for id, t := range s.revokedTokens {
+			if now.After(t.Expiry) {
+				delete(s.revokedTokens, id)
+				result.RevokedTokens++
+			}
+		}
+		for id, n := range s.usedNonces {
+			if now.After(n.Expiry) {
+				delete(s.usedNonces, id)
+				result.UsedNonces++
+			}
+		}
+		for id, c := range s.webAuthnChallenges {
+			if now.After(c.Expiry) {
+				delete(s.webAuthnChallenges, id)
+				result.WebAuthnChallenges++
+			}
+		}
 	})
 	return result, nil
 }
@@ -165,6 +193,39 @@ func (s *memStorage) CreateConnector(connector storage.Connector) (err error) {
 	return
 }
 
+func (s *memStorage) CreateUser(u storage.User) (err error) {
+	s.tx(func() {
+		if _, ok := s.users[u.ID]; ok {
+			err = storage.ErrAlreadyExists
+		} else {
+			s.users[u.ID] = u
+		}
+	})
+	return
+}
+
+func (s *memStorage) CreateRevokedToken(t storage.RevokedToken) (err error) {
+	s.tx(func() {
+		if _, ok := s.revokedTokens[t.ID]; ok {
+			err = storage.ErrAlreadyExists
+		} else {
+			s.revokedTokens[t.ID] = t
+		}
+	})
+	return
+}
+
+func (s *memStorage) CreateUsedNonce(n storage.UsedNonce) (err error) {
+	s.tx(func() {
+		if _, ok := s.usedNonces[n.ID]; ok {
+			err = storage.ErrAlreadyExists
+		} else {
+			s.usedNonces[n.ID] = n
+		}
+	})
+	return
+}
+
 func (s *memStorage) GetAuthCode(id string) (c storage.AuthCode, err error) {
 	s.tx(func() {
 		var ok bool
@@ -249,6 +310,51 @@ func (s *memStorage) GetConnector(id string) (connector storage.Connector, err e
 	return
 }
 
+func (s *memStorage) GetUser(id string) (u storage.User, err error) {
+	s.tx(func() {
+		var ok bool
+		if u, ok = s.users[id]; !ok {
+			err = storage.ErrNotFound
+		}
+	})
+	return
+}
+
+func (s *memStorage) GetRevokedToken(id string) (t storage.RevokedToken, err error) {
+	s.tx(func() {
+		var ok bool
+		if t, ok = s.revokedTokens[id]; !ok {
+			err = storage.ErrNotFound
+		}
+	})
+	return
+}
+
+func (s *memStorage) GetUsedNonce(id string) (n storage.UsedNonce, err error) {
+	s.tx(func() {
+		var ok bool
+		if n, ok = s.usedNonces[id]; !ok {
+			err = storage.ErrNotFound
+		}
+	})
+	return
+}
+
+func (s *memStorage) GetUserByRemoteIdentity(connectorID, connectorUserID string) (u storage.User, err error) {
+	s.tx(func() {
+		for _, user := range s.users {
+			for _, r := range user.RemoteIdentities {
+				if r.ConnectorID == connectorID && r.ConnectorUserID == connectorUserID {
+					u = user
+					return
+				}
+			}
+		}
+		err = storage.ErrNotFound
+	})
+	return
+}
+
 func (s *memStorage) ListClients() (clients []storage.Client, err error) {
 	s.tx(func() {
 		for _, client := range s.clients {
@@ -285,6 +391,15 @@ func (s *memStorage) ListConnectors() (conns []storage.Connector, err error) {
 	return
 }
 
+func (s *memStorage) ListUsers() (users []storage.User, err error) {
+	s.tx(func() {
+		for _, u := range s.users {
+			users = append(users, u)
+		}
+	})
+	return
+}
+
 func (s *memStorage) DeletePassword(email string) (err error) {
 	email = strings.ToLower(email)
 	s.tx(func() {
@@ -367,6 +482,17 @@ func (s *memStorage) DeleteConnector(id string) (err error) {
 	return
 }
 
+func (s *memStorage) DeleteUser(id string) (err error) {
+	s.tx(func() {
+		if _, ok := s.users[id]; !ok {
+			err = storage.ErrNotFound
+			return
+		}
+		delete(s.users, id)
+	})
+	return
+}
+
 func (s *memStorage) UpdateClient(id string, updater func(old storage.Client) (storage.Client, error)) (err error) {
 	s.tx(func() {
 		client, ok := s.clients[id]
@@ -465,3 +591,104 @@ func (s *memStorage) UpdateConnector(id string, updater func(c storage.Connector
 	})
 	return
 }
+
+func (s *memStorage) UpdateUser(id string, updater func(u storage.User) (storage.User, error)) (err error) {
+	s.tx(func() {
+		r, ok := s.users[id]
+		if !ok {
+			err = storage.ErrNotFound
+			return
+		}
+		if r, err = updater(r); err == nil {
+			s.users[id] = r
+		}
+	})
+	return
+}
+
+func (s *memStorage) CreateWebAuthnCredential(c storage.WebAuthnCredential) (err error) {
+	s.tx(func() {
+		if _, ok := s.webAuthnCredentials[c.ID]; ok {
+			err = storage.ErrAlreadyExists
+		} else {
+			s.webAuthnCredentials[c.ID] = c
+		}
+	})
+	return
+}
+
+func (s *memStorage) GetWebAuthnCredential(id string) (c storage.WebAuthnCredential, err error) {
+	s.tx(func() {
+		var ok bool
+		if c, ok = s.webAuthnCredentials[id]; !ok {
+			err = storage.ErrNotFound
+		}
+	})
+	return
+}
+
+func (s *memStorage) ListWebAuthnCredentials() (creds []storage.WebAuthnCredential, err error) {
+	s.tx(func() {
+		for _, c := range s.webAuthnCredentials {
+			creds = append(creds, c)
+		}
+	})
+	return
+}
+
+func (s *memStorage) UpdateWebAuthnCredential(id string, updater func(c storage.WebAuthnCredential) (storage.WebAuthnCredential, error)) (err error) {
+	s.tx(func() {
+		c, ok := s.webAuthnCredentials[id]
+		if !ok {
+			err = storage.ErrNotFound
+			return
+		}
+		if c, err = updater(c); err == nil {
+			s.webAuthnCredentials[id] = c
+		}
+	})
+	return
+}
+
+func (s *memStorage) DeleteWebAuthnCredential(id string) (err error) {
+	s.tx(func() {
+		if _, ok := s.webAuthnCredentials[id]; !ok {
+			err = storage.ErrNotFound
+			return
+		}
+		delete(s.webAuthnCredentials, id)
+	})
+	return
+}
+
+func (s *memStorage) CreateWebAuthnChallenge(c storage.WebAuthnChallenge) (err error) {
+	s.tx(func() {
+		if _, ok := s.webAuthnChallenges[c.ID]; ok {
+			err = storage.ErrAlreadyExists
+		} else {
+			s.webAuthnChallenges[c.ID] = c
+		}
+	})
+	return
+}
+
+func (s *memStorage) GetWebAuthnChallenge(id string) (c storage.WebAuthnChallenge, err error) {
+	s.tx(func() {
+		var ok bool
+		if c, ok = s.webAuthnChallenges[id]; !ok {
+			err = storage.ErrNotFound
+		}
+	})
+	return
+}
+
+func (s *memStorage) DeleteWebAuthnChallenge(id string) (err error) {
+	s.tx(func() {
+		if _, ok := s.webAuthnChallenges[id]; !ok {
+			err = storage.ErrNotFound
+			return
+		}
+		delete(s.webAuthnChallenges, id)
+	})
+	return
+}
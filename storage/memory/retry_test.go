@@ -0,0 +1,73 @@
+package memory
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/dexidp/dex/storage"
+)
+
+// flakyStorage fails the first lookup of a client with a transient error.
+type flakyStorage struct {
+	storage.Storage
+
+	failures int
+	calls    int
+}
+
+func (s *flakyStorage) GetClient(id string) (storage.Client, error) {
+	s.calls++
+	if s.calls <= s.failures {
+		return storage.Client{}, &storage.TransientError{Err: errors.New("connection reset by peer")}
+	}
+	return s.Storage.GetClient(id)
+}
+
+func TestRetries(t *testing.T) {
+	logger := &logrus.Logger{
+		Out:       os.Stderr,
+		Formatter: &logrus.TextFormatter{DisableColors: true},
+		Level:     logrus.DebugLevel,
+	}
+	backing := New(logger)
+	if err := backing.CreateClient(storage.Client{ID: "foo", Secret: "foo_secret"}); err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	var waited []time.Duration
+	config := storage.RetryConfig{
+		Attempts:   3,
+		Backoff:    time.Second,
+		MaxBackoff: time.Second,
+		Sleep:      func(d time.Duration) { waited = append(waited, d) },
+	}
+
+	flaky := &flakyStorage{Storage: backing, failures: 1}
+	s := storage.WithRetries(flaky, config, logger)
+	c, err := s.GetClient("foo")
+	if err != nil {
+		t.Fatalf("expected lookup to succeed on the second attempt: %v", err)
+	}
+	if c.ID != "foo" || flaky.calls != 2 {
+		t.Errorf("expected client foo after 2 attempts, got %q after %d", c.ID, flaky.calls)
+	}
+	if len(waited) != 1 || waited[0] != time.Second {
+		t.Errorf("expected a single wait of 1s between attempts, got %v", waited)
+	}
+
+	flaky = &flakyStorage{Storage: backing}
+	s = storage.WithRetries(flaky, config, logger)
+	if _, err := s.GetClient("bar"); err != storage.ErrNotFound || flaky.calls != 1 {
+		t.Errorf("expected not found to be returned without retrying, got %v after %d attempts", err, flaky.calls)
+	}
+
+	flaky = &flakyStorage{Storage: backing, failures: 5}
+	s = storage.WithRetries(flaky, config, logger)
+	if _, err := s.GetClient("foo"); err == nil || storage.IsTransient(err) || flaky.calls != 3 {
+		t.Errorf("expected lookup to give up after 3 attempts, got %v after %d", err, flaky.calls)
+	}
+}
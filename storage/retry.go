@@ -0,0 +1,157 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/dexidp/dex/pkg/log"
+)
+
+// Tests for this code are in the "memory" package, since this package doesn't
+// define a concrete storage implementation.
+
+// TransientError is returned by storages when an operation failed because of
+// the backing store, such as a dropped database connection, rather than the
+// data, so it may succeed if retried.
+type TransientError struct {
+	Err error
+}
+
+func (e *TransientError) Error() string {
+	return e.Err.Error()
+}
+
+// IsTransient reports if err is a TransientError.
+func IsTransient(err error) bool {
+	_, ok := err.(*TransientError)
+	return ok
+}
+
+// RetryConfig controls how operations failing with a TransientError are
+// retried.
+type RetryConfig struct {
+	// Number of times an operation is attempted, including the first. Defaults
+	// to 3, a value of 1 disables retries.
+	Attempts int
+
+	// Delay before the first retry, doubled for each one after that. Defaults
+	// to 100ms.
+	Backoff time.Duration
+
+	// Maximum delay between two attempts. Defaults to 2s.
+	MaxBackoff time.Duration
+
+	// Used to wait between attempts. Defaults to time.Sleep.
+	Sleep func(time.Duration)
+}
+
+// retryStorage retries the operations on the login and token paths, where a
+// brief outage of the backing store would otherwise fail the request.
+//
+// Creates are retried too. An insert which failed with a transient error may
+// still have been applied, in which case its retry reports ErrAlreadyExists.
+type retryStorage struct {
+	Storage
+
+	attempts   int
+	backoff    time.Duration
+	maxBackoff time.Duration
+	sleep      func(time.Duration)
+	logger     log.Logger
+}
+
+// WithRetries retries the auth request, auth code, refresh token and client
+// lookups of the underlying storage when they fail with a TransientError.
+func WithRetries(s Storage, c RetryConfig, logger log.Logger) Storage {
+	r := retryStorage{
+		Storage:    s,
+		attempts:   c.Attempts,
+		backoff:    c.Backoff,
+		maxBackoff: c.MaxBackoff,
+		sleep:      c.Sleep,
+		logger:     logger,
+	}
+	if r.attempts == 0 {
+		r.attempts = 3
+	}
+	if r.backoff == 0 {
+		r.backoff = 100 * time.Millisecond
+	}
+	if r.maxBackoff == 0 {
+		r.maxBackoff = 2 * time.Second
+	}
+	if r.sleep == nil {
+		r.sleep = time.Sleep
+	}
+	return r
+}
+
+// retry runs op until it succeeds, fails with an error that isn't transient,
+// or runs out of attempts.
+func (s retryStorage) retry(name string, op func() error) error {
+	backoff := s.backoff
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || !IsTransient(err) {
+			return err
+		}
+		if attempt >= s.attempts {
+			return fmt.Errorf("%s failed after %d attempts: %v", name, attempt, err)
+		}
+		s.logger.Errorf("%s failed, retrying in %s: %v", name, backoff, err)
+		s.sleep(backoff)
+		if backoff *= 2; backoff > s.maxBackoff {
+			backoff = s.maxBackoff
+		}
+	}
+}
+
+func (s retryStorage) CreateAuthRequest(a AuthRequest) error {
+	return s.retry("create auth request", func() error {
+		return s.Storage.CreateAuthRequest(a)
+	})
+}
+
+func (s retryStorage) GetAuthRequest(id string) (a AuthRequest, err error) {
+	err = s.retry("get auth request", func() error {
+		a, err = s.Storage.GetAuthRequest(id)
+		return err
+	})
+	return a, err
+}
+
+func (s retryStorage) GetClient(id string) (c Client, err error) {
+	err = s.retry("get client", func() error {
+		c, err = s.Storage.GetClient(id)
+		return err
+	})
+	return c, err
+}
+
+func (s retryStorage) CreateAuthCode(c AuthCode) error {
+	return s.retry("create auth code", func() error {
+		return s.Storage.CreateAuthCode(c)
+	})
+}
+
+func (s retryStorage) GetAuthCode(id string) (c AuthCode, err error) {
+	err = s.retry("get auth code", func() error {
+		c, err = s.Storage.GetAuthCode(id)
+		return err
+	})
+	return c, err
+}
+
+func (s retryStorage) CreateRefresh(r RefreshToken) error {
+	return s.retry("create refresh token", func() error {
+		return s.Storage.CreateRefresh(r)
+	})
+}
+
+func (s retryStorage) GetRefresh(id string) (r RefreshToken, err error) {
+	err = s.retry("get refresh token", func() error {
+		r, err = s.Storage.GetRefresh(id)
+		return err
+	})
+	return r, err
+}
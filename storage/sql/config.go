@@ -2,6 +2,7 @@ package sql
 
 import (
 	"database/sql"
+	"database/sql/driver"
 	"fmt"
 	"net"
 	"regexp"
@@ -18,9 +19,37 @@ import (
 
 const (
 	// postgres error codes
-	pgErrUniqueViolation = "23505" // unique_violation
+	pgErrUniqueViolation       = "23505" // unique_violation
+	pgErrSerializationFailure  = "40001" // serialization_failure
+	pgErrTooManyConnections    = "53300" // too_many_connections
+	pgErrAdminShutdown         = "57P01" // admin_shutdown
+	pgErrCrashShutdown         = "57P02" // crash_shutdown
+	pgErrCannotConnectNow      = "57P03" // cannot_connect_now
+	pgErrClassConnectionFailed = "08"    // connection_exception
 )
 
+// transient reports if an error returned by a driver was caused by the
+// connection to the database, or contention on it, rather than the query.
+func transient(err error) bool {
+	if err == driver.ErrBadConn {
+		return true
+	}
+	switch err := err.(type) {
+	case net.Error:
+		return true
+	case *pq.Error:
+		switch err.Code {
+		case pgErrSerializationFailure, pgErrTooManyConnections,
+			pgErrAdminShutdown, pgErrCrashShutdown, pgErrCannotConnectNow:
+			return true
+		}
+		return err.Code.Class() == pgErrClassConnectionFailed
+	case sqlite3.Error:
+		return err.Code == sqlite3.ErrBusy || err.Code == sqlite3.ErrLocked
+	}
+	return false
+}
+
 // SQLite3 options for creating an SQL db.
 type SQLite3 struct {
 	// File to
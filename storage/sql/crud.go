@@ -15,6 +15,16 @@ import (
 // TODO(ericchiang): The update, insert, and select methods queries are all
 // very repetitive. Consider creating them programmatically.
 
+// queryErr adds context to the error of a failed query. Errors the query may
+// succeed after are returned as a storage.TransientError.
+func queryErr(msg string, err error) error {
+	wrapped := fmt.Errorf("%s: %v", msg, err)
+	if transient(err) {
+		return &storage.TransientError{Err: wrapped}
+	}
+	return wrapped
+}
+
 // keysRowID is the ID of the only row we expect to populate the "keys" table.
 const keysRowID = "keys"
 
@@ -100,6 +110,30 @@ func (c *conn) GarbageCollect(now time.Time) (result storage.GCResult, err error
 	if n, err := r.RowsAffected(); err == nil {
 		result.AuthCodes = n
 	}
+
+	r, err = c.Exec(`delete from revoked_token where expiry < $1`, now)
+	if err != nil {
+		return result, fmt.Errorf("gc revoked_token: %v", err)
+	}
+	if n, err := r.RowsAffected(); err == nil {
+		result.RevokedTokens = n
+	}
+
+	r, err = c.Exec(`delete from used_nonce where expiry < $1`, now)
+	if err != nil {
+		return result, fmt.Errorf("gc used_nonce: %v", err)
+	}
+	if n, err := r.RowsAffected(); err == nil {
+		result.UsedNonces = n
+	}
+
+	r, err = c.Exec(`delete from webauthn_challenge where expiry < $1`, now)
+	if err != nil {
+		return result, fmt.Errorf("gc webauthn_challenge: %v", err)
+	}
+	if n, err := r.RowsAffected(); err == nil {
+		result.WebAuthnChallenges = n
+	}
 	return
 }
 
@@ -111,10 +145,16 @@ func (c *conn) CreateAuthRequest(a storage.AuthRequest) error {
 			claims_user_id, claims_username, claims_email, claims_email_verified,
 			claims_groups,
 			connector_id, connector_data,
-			expiry
+			expiry,
+			requested_claims, claims_picture,
+			code_challenge, code_challenge_method,
+			claims_updated_at, second_factor_failures,
+			claims_auth_time, claims_session_id, response_mode,
+			sms_code_hash, sms_code_expiry
 		)
 		values (
-			$1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17
+			$1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24, $25, $26,
+			$27, $28
 		);
 	`,
 		a.ID, a.ClientID, encoder(a.ResponseTypes), encoder(a.Scopes), a.RedirectURI, a.Nonce, a.State,
@@ -123,12 +163,17 @@ func (c *conn) CreateAuthRequest(a storage.AuthRequest) error {
 		encoder(a.Claims.Groups),
 		a.ConnectorID, a.ConnectorData,
 		a.Expiry,
+		encoder(a.RequestedClaims), a.Claims.Picture,
+		a.PKCE.CodeChallenge, a.PKCE.CodeChallengeMethod,
+		a.Claims.UpdatedAt, a.SecondFactorFailures,
+		a.Claims.AuthTime, a.Claims.SessionID, a.ResponseMode,
+		a.SMSCode.Hash, a.SMSCode.Expiry,
 	)
 	if err != nil {
 		if c.alreadyExistsCheck(err) {
 			return storage.ErrAlreadyExists
 		}
-		return fmt.Errorf("insert auth request: %v", err)
+		return queryErr("insert auth request", err)
 	}
 	return nil
 }
@@ -153,15 +198,33 @@ func (c *conn) UpdateAuthRequest(id string, updater func(a storage.AuthRequest)
 				claims_email_verified = $12,
 				claims_groups = $13,
 				connector_id = $14, connector_data = $15,
-				expiry = $16
-			where id = $17;
+				expiry = $16,
+				requested_claims = $17,
+				claims_picture = $18,
+				code_challenge = $19,
+				code_challenge_method = $20,
+				claims_updated_at = $21,
+				second_factor_failures = $22,
+				claims_auth_time = $23,
+				claims_session_id = $24,
+				response_mode = $25,
+				sms_code_hash = $26,
+				sms_code_expiry = $27
+			where id = $28;
 		`,
 			a.ClientID, encoder(a.ResponseTypes), encoder(a.Scopes), a.RedirectURI, a.Nonce, a.State,
 			a.ForceApprovalPrompt, a.LoggedIn,
 			a.Claims.UserID, a.Claims.Username, a.Claims.Email, a.Claims.EmailVerified,
 			encoder(a.Claims.Groups),
 			a.ConnectorID, a.ConnectorData,
-			a.Expiry, r.ID,
+			a.Expiry,
+			encoder(a.RequestedClaims),
+			a.Claims.Picture,
+			a.PKCE.CodeChallenge, a.PKCE.CodeChallengeMethod,
+			a.Claims.UpdatedAt, a.SecondFactorFailures,
+			a.Claims.AuthTime, a.Claims.SessionID, a.ResponseMode,
+			a.SMSCode.Hash, a.SMSCode.Expiry,
+			r.ID,
 		)
 		if err != nil {
 			return fmt.Errorf("update auth request: %v", err)
@@ -182,7 +245,12 @@ func getAuthRequest(q querier, id string) (a storage.AuthRequest, err error) {
 			force_approval_prompt, logged_in,
 			claims_user_id, claims_username, claims_email, claims_email_verified,
 			claims_groups,
-			connector_id, connector_data, expiry
+			connector_id, connector_data, expiry,
+			requested_claims, claims_picture,
+			code_challenge, code_challenge_method,
+			claims_updated_at, second_factor_failures,
+			claims_auth_time, claims_session_id, response_mode,
+			sms_code_hash, sms_code_expiry
 		from auth_request where id = $1;
 	`, id).Scan(
 		&a.ID, &a.ClientID, decoder(&a.ResponseTypes), decoder(&a.Scopes), &a.RedirectURI, &a.Nonce, &a.State,
@@ -190,12 +258,17 @@ func getAuthRequest(q querier, id string) (a storage.AuthRequest, err error) {
 		&a.Claims.UserID, &a.Claims.Username, &a.Claims.Email, &a.Claims.EmailVerified,
 		decoder(&a.Claims.Groups),
 		&a.ConnectorID, &a.ConnectorData, &a.Expiry,
+		decoder(&a.RequestedClaims), &a.Claims.Picture,
+		&a.PKCE.CodeChallenge, &a.PKCE.CodeChallengeMethod,
+		&a.Claims.UpdatedAt, &a.SecondFactorFailures,
+		&a.Claims.AuthTime, &a.Claims.SessionID, &a.ResponseMode,
+		&a.SMSCode.Hash, &a.SMSCode.Expiry,
 	)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return a, storage.ErrNotFound
 		}
-		return a, fmt.Errorf("select auth request: %v", err)
+		return a, queryErr("select auth request", err)
 	}
 	return a, nil
 }
@@ -207,20 +280,26 @@ func (c *conn) CreateAuthCode(a storage.AuthCode) error {
 			claims_user_id, claims_username,
 			claims_email, claims_email_verified, claims_groups,
 			connector_id, connector_data,
-			expiry
+			expiry,
+			requested_claims, claims_picture,
+			code_challenge, code_challenge_method,
+			claims_updated_at, claims_auth_time, claims_session_id
 		)
-		values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13);
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20);
 	`,
 		a.ID, a.ClientID, encoder(a.Scopes), a.Nonce, a.RedirectURI, a.Claims.UserID,
 		a.Claims.Username, a.Claims.Email, a.Claims.EmailVerified, encoder(a.Claims.Groups),
 		a.ConnectorID, a.ConnectorData, a.Expiry,
+		encoder(a.RequestedClaims), a.Claims.Picture,
+		a.PKCE.CodeChallenge, a.PKCE.CodeChallengeMethod,
+		a.Claims.UpdatedAt, a.Claims.AuthTime, a.Claims.SessionID,
 	)
 
 	if err != nil {
 		if c.alreadyExistsCheck(err) {
 			return storage.ErrAlreadyExists
 		}
-		return fmt.Errorf("insert auth code: %v", err)
+		return queryErr("insert auth code", err)
 	}
 	return nil
 }
@@ -232,18 +311,24 @@ func (c *conn) GetAuthCode(id string) (a storage.AuthCode, err error) {
 			claims_user_id, claims_username,
 			claims_email, claims_email_verified, claims_groups,
 			connector_id, connector_data,
-			expiry
+			expiry,
+			requested_claims, claims_picture,
+			code_challenge, code_challenge_method,
+			claims_updated_at, claims_auth_time, claims_session_id
 		from auth_code where id = $1;
 	`, id).Scan(
 		&a.ID, &a.ClientID, decoder(&a.Scopes), &a.Nonce, &a.RedirectURI, &a.Claims.UserID,
 		&a.Claims.Username, &a.Claims.Email, &a.Claims.EmailVerified, decoder(&a.Claims.Groups),
 		&a.ConnectorID, &a.ConnectorData, &a.Expiry,
+		decoder(&a.RequestedClaims), &a.Claims.Picture,
+		&a.PKCE.CodeChallenge, &a.PKCE.CodeChallengeMethod,
+		&a.Claims.UpdatedAt, &a.Claims.AuthTime, &a.Claims.SessionID,
 	)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return a, storage.ErrNotFound
 		}
-		return a, fmt.Errorf("select auth code: %v", err)
+		return a, queryErr("select auth code", err)
 	}
 	return a, nil
 }
@@ -255,21 +340,27 @@ func (c *conn) CreateRefresh(r storage.RefreshToken) error {
 			claims_user_id, claims_username, claims_email, claims_email_verified,
 			claims_groups,
 			connector_id, connector_data,
-			token, created_at, last_used
+			token, created_at, last_used,
+			requested_claims, claims_picture,
+			claims_updated_at, claims_auth_time, claims_session_id,
+			id_token_jti
 		)
-		values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14);
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20);
 	`,
 		r.ID, r.ClientID, encoder(r.Scopes), r.Nonce,
 		r.Claims.UserID, r.Claims.Username, r.Claims.Email, r.Claims.EmailVerified,
 		encoder(r.Claims.Groups),
 		r.ConnectorID, r.ConnectorData,
 		r.Token, r.CreatedAt, r.LastUsed,
+		encoder(r.RequestedClaims), r.Claims.Picture,
+		r.Claims.UpdatedAt, r.Claims.AuthTime, r.Claims.SessionID,
+		r.IDTokenJTI,
 	)
 	if err != nil {
 		if c.alreadyExistsCheck(err) {
 			return storage.ErrAlreadyExists
 		}
-		return fmt.Errorf("insert refresh_token: %v", err)
+		return queryErr("insert refresh_token", err)
 	}
 	return nil
 }
@@ -298,15 +389,28 @@ func (c *conn) UpdateRefreshToken(id string, updater func(old storage.RefreshTok
 				connector_data = $10,
 				token = $11,
 				created_at = $12,
-				last_used = $13
+				last_used = $13,
+				requested_claims = $14,
+				claims_picture = $15,
+				claims_updated_at = $16,
+				claims_auth_time = $17,
+				claims_session_id = $18,
+				id_token_jti = $19
 			where
-				id = $14
+				id = $20
 		`,
 			r.ClientID, encoder(r.Scopes), r.Nonce,
 			r.Claims.UserID, r.Claims.Username, r.Claims.Email, r.Claims.EmailVerified,
 			encoder(r.Claims.Groups),
 			r.ConnectorID, r.ConnectorData,
-			r.Token, r.CreatedAt, r.LastUsed, id,
+			r.Token, r.CreatedAt, r.LastUsed,
+			encoder(r.RequestedClaims),
+			r.Claims.Picture,
+			r.Claims.UpdatedAt,
+			r.Claims.AuthTime,
+			r.Claims.SessionID,
+			r.IDTokenJTI,
+			id,
 		)
 		if err != nil {
 			return fmt.Errorf("update refresh token: %v", err)
@@ -326,7 +430,10 @@ func getRefresh(q querier, id string) (storage.RefreshToken, error) {
 			claims_user_id, claims_username, claims_email, claims_email_verified,
 			claims_groups,
 			connector_id, connector_data,
-			token, created_at, last_used
+			token, created_at, last_used,
+			requested_claims, claims_picture,
+			claims_updated_at, claims_auth_time, claims_session_id,
+			id_token_jti
 		from refresh_token where id = $1;
 	`, id))
 }
@@ -338,7 +445,10 @@ func (c *conn) ListRefreshTokens() ([]storage.RefreshToken, error) {
 			claims_user_id, claims_username, claims_email, claims_email_verified,
 			claims_groups,
 			connector_id, connector_data,
-			token, created_at, last_used
+			token, created_at, last_used,
+			requested_claims, claims_picture,
+			claims_updated_at, claims_auth_time, claims_session_id,
+			id_token_jti
 		from refresh_token;
 	`)
 	if err != nil {
@@ -365,12 +475,15 @@ func scanRefresh(s scanner) (r storage.RefreshToken, err error) {
 		decoder(&r.Claims.Groups),
 		&r.ConnectorID, &r.ConnectorData,
 		&r.Token, &r.CreatedAt, &r.LastUsed,
+		decoder(&r.RequestedClaims), &r.Claims.Picture,
+		&r.Claims.UpdatedAt, &r.Claims.AuthTime, &r.Claims.SessionID,
+		&r.IDTokenJTI,
 	)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return r, storage.ErrNotFound
 		}
-		return r, fmt.Errorf("scan refresh_token: %v", err)
+		return r, queryErr("scan refresh_token", err)
 	}
 	return r, nil
 }
@@ -470,9 +583,30 @@ func (c *conn) UpdateClient(id string, updater func(old storage.Client) (storage
 				trusted_peers = $3,
 				public = $4,
 				name = $5,
-				logo_url = $6
-			where id = $7;
-		`, nc.Secret, encoder(nc.RedirectURIs), encoder(nc.TrustedPeers), nc.Public, nc.Name, nc.LogoURL, id,
+				logo_url = $6,
+				response_types = $7,
+				previous_secret = $8,
+				secret_rotated_at = $9,
+				client_url = $10,
+				policy_url = $11,
+				tos_url = $12,
+				require_pkce = $13,
+				default_scopes = $14,
+				backchannel_logout_uri = $15,
+				code_reuse_grace_seconds = $16,
+				default_redirect_uri = $17,
+				claim_renames = $18,
+				allowed_audiences = $19,
+				unique_nonces = $20,
+				require_email_verified = $21,
+				id_token_scope = $22,
+				oauth2_only = $23,
+				cross_client_audience = $24
+			where id = $25;
+		`, nc.Secret, encoder(nc.RedirectURIs), encoder(nc.TrustedPeers), nc.Public, nc.Name, nc.LogoURL,
+			encoder(nc.ResponseTypes), nc.PreviousSecret, nc.SecretRotatedAt,
+			nc.ClientURL, nc.PolicyURL, nc.TOSURL, encoder(nc.RequirePKCE), encoder(nc.DefaultScopes),
+			nc.BackchannelLogoutURI, nc.CodeReuseGraceSeconds, nc.DefaultRedirectURI, encoder(nc.ClaimRenames), encoder(nc.AllowedAudiences), nc.UniqueNonces, nc.RequireEmailVerified, nc.IDTokenScope, nc.OAuth2Only, nc.CrossClientAudience, id,
 		)
 		if err != nil {
 			return fmt.Errorf("update client: %v", err)
@@ -484,12 +618,22 @@ func (c *conn) UpdateClient(id string, updater func(old storage.Client) (storage
 func (c *conn) CreateClient(cli storage.Client) error {
 	_, err := c.Exec(`
 		insert into client (
-			id, secret, redirect_uris, trusted_peers, public, name, logo_url
+			id, secret, redirect_uris, trusted_peers, public, name, logo_url,
+			response_types, previous_secret, secret_rotated_at,
+			client_url, policy_url, tos_url, require_pkce, default_scopes,
+			backchannel_logout_uri, code_reuse_grace_seconds, default_redirect_uri,
+			claim_renames, allowed_audiences, unique_nonces, require_email_verified, id_token_scope,
+			oauth2_only, cross_client_audience
 		)
-		values ($1, $2, $3, $4, $5, $6, $7);
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24, $25);
 	`,
 		cli.ID, cli.Secret, encoder(cli.RedirectURIs), encoder(cli.TrustedPeers),
-		cli.Public, cli.Name, cli.LogoURL,
+		cli.Public, cli.Name, cli.LogoURL, encoder(cli.ResponseTypes),
+		cli.PreviousSecret, cli.SecretRotatedAt,
+		cli.ClientURL, cli.PolicyURL, cli.TOSURL, encoder(cli.RequirePKCE), encoder(cli.DefaultScopes),
+		cli.BackchannelLogoutURI, cli.CodeReuseGraceSeconds, cli.DefaultRedirectURI,
+		encoder(cli.ClaimRenames), encoder(cli.AllowedAudiences), cli.UniqueNonces, cli.RequireEmailVerified, cli.IDTokenScope,
+		cli.OAuth2Only, cli.CrossClientAudience,
 	)
 	if err != nil {
 		if c.alreadyExistsCheck(err) {
@@ -503,7 +647,12 @@ func (c *conn) CreateClient(cli storage.Client) error {
 func getClient(q querier, id string) (storage.Client, error) {
 	return scanClient(q.QueryRow(`
 		select
-			id, secret, redirect_uris, trusted_peers, public, name, logo_url
+			id, secret, redirect_uris, trusted_peers, public, name, logo_url,
+			response_types, previous_secret, secret_rotated_at,
+			client_url, policy_url, tos_url, require_pkce, default_scopes,
+			backchannel_logout_uri, code_reuse_grace_seconds, default_redirect_uri,
+			claim_renames, allowed_audiences, unique_nonces, require_email_verified, id_token_scope,
+			oauth2_only, cross_client_audience
 	    from client where id = $1;
 	`, id))
 }
@@ -515,7 +664,12 @@ func (c *conn) GetClient(id string) (storage.Client, error) {
 func (c *conn) ListClients() ([]storage.Client, error) {
 	rows, err := c.Query(`
 		select
-			id, secret, redirect_uris, trusted_peers, public, name, logo_url
+			id, secret, redirect_uris, trusted_peers, public, name, logo_url,
+			response_types, previous_secret, secret_rotated_at,
+			client_url, policy_url, tos_url, require_pkce, default_scopes,
+			backchannel_logout_uri, code_reuse_grace_seconds, default_redirect_uri,
+			claim_renames, allowed_audiences, unique_nonces, require_email_verified, id_token_scope,
+			oauth2_only, cross_client_audience
 		from client;
 	`)
 	if err != nil {
@@ -538,13 +692,18 @@ func (c *conn) ListClients() ([]storage.Client, error) {
 func scanClient(s scanner) (cli storage.Client, err error) {
 	err = s.Scan(
 		&cli.ID, &cli.Secret, decoder(&cli.RedirectURIs), decoder(&cli.TrustedPeers),
-		&cli.Public, &cli.Name, &cli.LogoURL,
+		&cli.Public, &cli.Name, &cli.LogoURL, decoder(&cli.ResponseTypes),
+		&cli.PreviousSecret, &cli.SecretRotatedAt,
+		&cli.ClientURL, &cli.PolicyURL, &cli.TOSURL, decoder(&cli.RequirePKCE), decoder(&cli.DefaultScopes),
+		&cli.BackchannelLogoutURI, &cli.CodeReuseGraceSeconds, &cli.DefaultRedirectURI,
+		decoder(&cli.ClaimRenames), decoder(&cli.AllowedAudiences), &cli.UniqueNonces, &cli.RequireEmailVerified, &cli.IDTokenScope,
+		&cli.OAuth2Only, &cli.CrossClientAudience,
 	)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return cli, storage.ErrNotFound
 		}
-		return cli, fmt.Errorf("get client: %v", err)
+		return cli, queryErr("get client", err)
 	}
 	return cli, nil
 }
@@ -720,13 +879,17 @@ func scanOfflineSessions(s scanner) (o storage.OfflineSessions, err error) {
 func (c *conn) CreateConnector(connector storage.Connector) error {
 	_, err := c.Exec(`
 		insert into connector (
-			id, type, name, resource_version, config
+			id, type, name, resource_version, config,
+			allowed_email_domains, allowed_clients, headers, branding,
+			jit_provisioning, required_attributes
 		)
 		values (
-			$1, $2, $3, $4, $5
+			$1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11
 		);
 	`,
 		connector.ID, connector.Type, connector.Name, connector.ResourceVersion, connector.Config,
+		encoder(connector.AllowedEmailDomains), encoder(connector.AllowedClients), encoder(connector.Headers),
+		encoder(connector.Branding), encoder(connector.JITProvisioning), encoder(connector.RequiredAttributes),
 	)
 	if err != nil {
 		if c.alreadyExistsCheck(err) {
@@ -754,10 +917,19 @@ func (c *conn) UpdateConnector(id string, updater func(s storage.Connector) (sto
 			    type = $1,
 			    name = $2,
 			    resource_version = $3,
-			    config = $4
-			where id = $5;
+			    config = $4,
+			    allowed_email_domains = $5,
+			    allowed_clients = $6,
+			    headers = $7,
+			    branding = $8,
+			    jit_provisioning = $9,
+			    required_attributes = $10
+			where id = $11;
 		`,
-			newConn.Type, newConn.Name, newConn.ResourceVersion, newConn.Config, connector.ID,
+			newConn.Type, newConn.Name, newConn.ResourceVersion, newConn.Config,
+			encoder(newConn.AllowedEmailDomains), encoder(newConn.AllowedClients), encoder(newConn.Headers),
+			encoder(newConn.Branding), encoder(newConn.JITProvisioning), encoder(newConn.RequiredAttributes),
+			connector.ID,
 		)
 		if err != nil {
 			return fmt.Errorf("update connector: %v", err)
@@ -773,7 +945,9 @@ func (c *conn) GetConnector(id string) (storage.Connector, error) {
 func getConnector(q querier, id string) (storage.Connector, error) {
 	return scanConnector(q.QueryRow(`
 		select
-			id, type, name, resource_version, config
+			id, type, name, resource_version, config,
+			allowed_email_domains, allowed_clients, headers, branding,
+			jit_provisioning, required_attributes
 		from connector
 		where id = $1;
 		`, id))
@@ -782,6 +956,8 @@ func getConnector(q querier, id string) (storage.Connector, error) {
 func scanConnector(s scanner) (c storage.Connector, err error) {
 	err = s.Scan(
 		&c.ID, &c.Type, &c.Name, &c.ResourceVersion, &c.Config,
+		decoder(&c.AllowedEmailDomains), decoder(&c.AllowedClients), decoder(&c.Headers),
+		decoder(&c.Branding), decoder(&c.JITProvisioning), decoder(&c.RequiredAttributes),
 	)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -795,7 +971,9 @@ func scanConnector(s scanner) (c storage.Connector, err error) {
 func (c *conn) ListConnectors() ([]storage.Connector, error) {
 	rows, err := c.Query(`
 		select
-			id, type, name, resource_version, config
+			id, type, name, resource_version, config,
+			allowed_email_domains, allowed_clients, headers, branding,
+			jit_provisioning, required_attributes
 		from connector;
 	`)
 	if err != nil {
@@ -815,6 +993,394 @@ func (c *conn) ListConnectors() ([]storage.Connector, error) {
 	return connectors, nil
 }
 
+func (c *conn) CreateUser(u storage.User) error {
+	return c.ExecTx(func(tx *trans) error {
+		_, err := tx.Exec(`
+			insert into user_account (
+				id, remote_identities, email, name, email_verified, disabled,
+				updated_at, totp_secret, totp_confirmed, phone,
+				totp_last_step, totp_failures, totp_last_failure
+			)
+			values (
+				$1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13
+			);
+		`,
+			u.ID, encoder(u.RemoteIdentities), u.Email, u.Name, u.EmailVerified, u.Disabled,
+			u.UpdatedAt, u.TOTP.Secret, u.TOTP.Confirmed, u.Phone,
+			u.TOTP.LastStep, u.TOTP.Failures, u.TOTP.LastFailure,
+		)
+		if err != nil {
+			if c.alreadyExistsCheck(err) {
+				return storage.ErrAlreadyExists
+			}
+			return fmt.Errorf("insert user: %v", err)
+		}
+		return insertRemoteIdentities(tx, u)
+	})
+}
+
+// insertRemoteIdentities adds the index rows for each of the user's remote
+// identities. Linking an identity already held by another user fails with
+// storage.ErrAlreadyExists.
+func insertRemoteIdentities(tx *trans, u storage.User) error {
+	for _, r := range u.RemoteIdentities {
+		_, err := tx.Exec(`
+			insert into remote_identity (
+				connector_id, connector_user_id, user_id
+			)
+			values (
+				$1, $2, $3
+			);
+		`,
+			r.ConnectorID, r.ConnectorUserID, u.ID,
+		)
+		if err != nil {
+			if tx.c.alreadyExistsCheck(err) {
+				return storage.ErrAlreadyExists
+			}
+			return fmt.Errorf("insert remote identity: %v", err)
+		}
+	}
+	return nil
+}
+
+func (c *conn) UpdateUser(id string, updater func(u storage.User) (storage.User, error)) error {
+	return c.ExecTx(func(tx *trans) error {
+		u, err := getUser(tx, id)
+		if err != nil {
+			return err
+		}
+
+		nu, err := updater(u)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`
+			update user_account
+			set
+				remote_identities = $1,
+				email = $2,
+				name = $3,
+				email_verified = $4,
+				disabled = $5,
+				updated_at = $6,
+				totp_secret = $7,
+				totp_confirmed = $8,
+				phone = $9,
+				totp_last_step = $10,
+				totp_failures = $11,
+				totp_last_failure = $12
+			where id = $13;
+		`,
+			encoder(nu.RemoteIdentities), nu.Email, nu.Name, nu.EmailVerified, nu.Disabled,
+			nu.UpdatedAt, nu.TOTP.Secret, nu.TOTP.Confirmed, nu.Phone,
+			nu.TOTP.LastStep, nu.TOTP.Failures, nu.TOTP.LastFailure, u.ID,
+		)
+		if err != nil {
+			return fmt.Errorf("update user: %v", err)
+		}
+
+		if _, err := tx.Exec(`delete from remote_identity where user_id = $1`, u.ID); err != nil {
+			return fmt.Errorf("delete remote identities: %v", err)
+		}
+		nu.ID = u.ID
+		return insertRemoteIdentities(tx, nu)
+	})
+}
+
+func (c *conn) GetUser(id string) (storage.User, error) {
+	return getUser(c, id)
+}
+
+func getUser(q querier, id string) (storage.User, error) {
+	return scanUser(q.QueryRow(`
+		select
+			id, remote_identities, email, name, email_verified, disabled,
+			updated_at, totp_secret, totp_confirmed, phone,
+			totp_last_step, totp_failures, totp_last_failure
+		from user_account
+		where id = $1;
+		`, id))
+}
+
+func (c *conn) ListUsers() ([]storage.User, error) {
+	rows, err := c.Query(`
+		select
+			id, remote_identities, email, name, email_verified, disabled,
+			updated_at, totp_secret, totp_confirmed, phone,
+			totp_last_step, totp_failures, totp_last_failure
+		from user_account;
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	var users []storage.User
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (c *conn) GetUserByRemoteIdentity(connectorID, connectorUserID string) (storage.User, error) {
+	return scanUser(c.QueryRow(`
+		select
+			u.id, u.remote_identities, u.email, u.name, u.email_verified, u.disabled,
+			u.updated_at, u.totp_secret, u.totp_confirmed, u.phone,
+			u.totp_last_step, u.totp_failures, u.totp_last_failure
+		from user_account u
+		join remote_identity r on r.user_id = u.id
+		where r.connector_id = $1 AND r.connector_user_id = $2;
+		`, connectorID, connectorUserID))
+}
+
+func scanUser(s scanner) (u storage.User, err error) {
+	err = s.Scan(
+		&u.ID, decoder(&u.RemoteIdentities), &u.Email, &u.Name, &u.EmailVerified, &u.Disabled,
+		&u.UpdatedAt, &u.TOTP.Secret, &u.TOTP.Confirmed, &u.Phone,
+		&u.TOTP.LastStep, &u.TOTP.Failures, &u.TOTP.LastFailure,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return u, storage.ErrNotFound
+		}
+		return u, fmt.Errorf("select user: %v", err)
+	}
+	return u, nil
+}
+
+func (c *conn) DeleteUser(id string) error {
+	return c.ExecTx(func(tx *trans) error {
+		if _, err := tx.Exec(`delete from remote_identity where user_id = $1`, id); err != nil {
+			return fmt.Errorf("delete remote identities: %v", err)
+		}
+		result, err := tx.Exec(`delete from user_account where id = $1`, id)
+		if err != nil {
+			return fmt.Errorf("delete user: %v", err)
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("rows affected: %v", err)
+		}
+		if n < 1 {
+			return storage.ErrNotFound
+		}
+		return nil
+	})
+}
+
+func (c *conn) CreateRevokedToken(t storage.RevokedToken) error {
+	_, err := c.Exec(`
+		insert into revoked_token (
+			id, expiry
+		)
+		values (
+			$1, $2
+		);
+	`,
+		t.ID, t.Expiry,
+	)
+	if err != nil {
+		if c.alreadyExistsCheck(err) {
+			return storage.ErrAlreadyExists
+		}
+		return fmt.Errorf("insert revoked token: %v", err)
+	}
+	return nil
+}
+
+func (c *conn) GetRevokedToken(id string) (t storage.RevokedToken, err error) {
+	err = c.QueryRow(`
+		select
+			id, expiry
+		from revoked_token
+		where id = $1;
+		`, id).Scan(&t.ID, &t.Expiry)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return t, storage.ErrNotFound
+		}
+		return t, fmt.Errorf("select revoked token: %v", err)
+	}
+	return t, nil
+}
+
+func (c *conn) CreateUsedNonce(n storage.UsedNonce) error {
+	_, err := c.Exec(`
+		insert into used_nonce (
+			id, expiry
+		)
+		values (
+			$1, $2
+		);
+	`,
+		n.ID, n.Expiry,
+	)
+	if err != nil {
+		if c.alreadyExistsCheck(err) {
+			return storage.ErrAlreadyExists
+		}
+		return fmt.Errorf("insert used nonce: %v", err)
+	}
+	return nil
+}
+
+func (c *conn) GetUsedNonce(id string) (n storage.UsedNonce, err error) {
+	err = c.QueryRow(`
+		select
+			id, expiry
+		from used_nonce
+		where id = $1;
+		`, id).Scan(&n.ID, &n.Expiry)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return n, storage.ErrNotFound
+		}
+		return n, fmt.Errorf("select used nonce: %v", err)
+	}
+	return n, nil
+}
+
+func (c *conn) CreateWebAuthnCredential(cred storage.WebAuthnCredential) error {
+	_, err := c.Exec(`
+		insert into webauthn_credential (
+			id, connector_id, credential_id, user_id, public_key, sign_count, created_at
+		)
+		values (
+			$1, $2, $3, $4, $5, $6, $7
+		);
+	`,
+		cred.ID, cred.ConnectorID, cred.CredentialID, cred.UserID, cred.PublicKey, int64(cred.SignCount), cred.CreatedAt,
+	)
+	if err != nil {
+		if c.alreadyExistsCheck(err) {
+			return storage.ErrAlreadyExists
+		}
+		return fmt.Errorf("insert webauthn credential: %v", err)
+	}
+	return nil
+}
+
+func (c *conn) UpdateWebAuthnCredential(id string, updater func(c storage.WebAuthnCredential) (storage.WebAuthnCredential, error)) error {
+	return c.ExecTx(func(tx *trans) error {
+		cred, err := getWebAuthnCredential(tx, id)
+		if err != nil {
+			return err
+		}
+
+		nc, err := updater(cred)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`
+			update webauthn_credential
+			set
+				user_id = $1, public_key = $2, sign_count = $3
+			where id = $4;
+		`,
+			nc.UserID, nc.PublicKey, int64(nc.SignCount), id,
+		)
+		if err != nil {
+			return fmt.Errorf("update webauthn credential: %v", err)
+		}
+		return nil
+	})
+}
+
+func (c *conn) GetWebAuthnCredential(id string) (storage.WebAuthnCredential, error) {
+	return getWebAuthnCredential(c, id)
+}
+
+func getWebAuthnCredential(q querier, id string) (storage.WebAuthnCredential, error) {
+	return scanWebAuthnCredential(q.QueryRow(`
+		select
+			id, connector_id, credential_id, user_id, public_key, sign_count, created_at
+		from webauthn_credential where id = $1;
+	`, id))
+}
+
+func (c *conn) ListWebAuthnCredentials() ([]storage.WebAuthnCredential, error) {
+	rows, err := c.Query(`
+		select
+			id, connector_id, credential_id, user_id, public_key, sign_count, created_at
+		from webauthn_credential;
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	var creds []storage.WebAuthnCredential
+	for rows.Next() {
+		cred, err := scanWebAuthnCredential(rows)
+		if err != nil {
+			return nil, err
+		}
+		creds = append(creds, cred)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return creds, nil
+}
+
+func scanWebAuthnCredential(s scanner) (cred storage.WebAuthnCredential, err error) {
+	var signCount int64
+	err = s.Scan(
+		&cred.ID, &cred.ConnectorID, &cred.CredentialID, &cred.UserID, &cred.PublicKey, &signCount, &cred.CreatedAt,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return cred, storage.ErrNotFound
+		}
+		return cred, fmt.Errorf("select webauthn credential: %v", err)
+	}
+	cred.SignCount = uint32(signCount)
+	return cred, nil
+}
+
+func (c *conn) CreateWebAuthnChallenge(ch storage.WebAuthnChallenge) error {
+	_, err := c.Exec(`
+		insert into webauthn_challenge (
+			id, value, user_id, expiry
+		)
+		values (
+			$1, $2, $3, $4
+		);
+	`,
+		ch.ID, ch.Value, ch.UserID, ch.Expiry,
+	)
+	if err != nil {
+		if c.alreadyExistsCheck(err) {
+			return storage.ErrAlreadyExists
+		}
+		return fmt.Errorf("insert webauthn challenge: %v", err)
+	}
+	return nil
+}
+
+func (c *conn) GetWebAuthnChallenge(id string) (ch storage.WebAuthnChallenge, err error) {
+	err = c.QueryRow(`
+		select
+			id, value, user_id, expiry
+		from webauthn_challenge
+		where id = $1;
+		`, id).Scan(&ch.ID, &ch.Value, &ch.UserID, &ch.Expiry)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ch, storage.ErrNotFound
+		}
+		return ch, fmt.Errorf("select webauthn challenge: %v", err)
+	}
+	return ch, nil
+}
+
 func (c *conn) DeleteAuthRequest(id string) error { return c.delete("auth_request", "id", id) }
 func (c *conn) DeleteAuthCode(id string) error    { return c.delete("auth_code", "id", id) }
 func (c *conn) DeleteClient(id string) error      { return c.delete("client", "id", id) }
@@ -823,6 +1389,12 @@ func (c *conn) DeletePassword(email string) error {
 	return c.delete("password", "email", strings.ToLower(email))
 }
 func (c *conn) DeleteConnector(id string) error { return c.delete("connector", "id", id) }
+func (c *conn) DeleteWebAuthnCredential(id string) error {
+	return c.delete("webauthn_credential", "id", id)
+}
+func (c *conn) DeleteWebAuthnChallenge(id string) error {
+	return c.delete("webauthn_challenge", "id", id)
+}
 
 func (c *conn) DeleteOfflineSessions(userID string, connID string) error {
 	result, err := c.Exec(`delete from offline_session where user_id = $1 AND conn_id = $2`, userID, connID)
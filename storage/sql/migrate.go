@@ -187,4 +187,311 @@ var migrations = []migration{
 			);
 		`,
 	},
+	{
+		stmt: `
+			create table user_account (
+				id text not null primary key,
+				remote_identities bytea not null -- JSON array
+			);
+
+			-- remote_identity indexes the identities held by user_account so users
+			-- can be looked up by connector ID and remote user ID.
+			create table remote_identity (
+				connector_id text not null,
+				connector_user_id text not null,
+				user_id text not null,
+				PRIMARY KEY (connector_id, connector_user_id)
+			);
+		`,
+	},
+	{
+		stmt: `
+			alter table auth_request
+				add column requested_claims bytea not null default 'null'; -- JSON object
+			alter table auth_code
+				add column requested_claims bytea not null default 'null'; -- JSON object
+			alter table refresh_token
+				add column requested_claims bytea not null default 'null'; -- JSON object
+		`,
+	},
+	{
+		stmt: `
+			alter table auth_request
+				add column claims_picture text not null default '';
+			alter table auth_code
+				add column claims_picture text not null default '';
+			alter table refresh_token
+				add column claims_picture text not null default '';
+		`,
+	},
+	{
+		stmt: `
+			alter table client
+				add column response_types bytea not null default 'null'; -- JSON array of strings
+		`,
+	},
+	{
+		stmt: `
+			alter table user_account
+				add column email text not null default '';
+			alter table user_account
+				add column name text not null default '';
+			alter table user_account
+				add column email_verified boolean not null default false;
+		`,
+	},
+	{
+		stmt: `
+			alter table user_account
+				add column disabled boolean not null default false;
+		`,
+	},
+	{
+		stmt: `
+			alter table client
+				add column previous_secret text not null default '';
+			alter table client
+				add column secret_rotated_at timestamptz not null default '0001-01-01 00:00:00 UTC';
+		`,
+	},
+	{
+		stmt: `
+			alter table client
+				add column client_url text not null default '';
+			alter table client
+				add column policy_url text not null default '';
+			alter table client
+				add column tos_url text not null default '';
+		`,
+	},
+	{
+		stmt: `
+			alter table auth_request
+				add column code_challenge text not null default '';
+			alter table auth_request
+				add column code_challenge_method text not null default '';
+			alter table auth_code
+				add column code_challenge text not null default '';
+			alter table auth_code
+				add column code_challenge_method text not null default '';
+			alter table client
+				add column require_pkce bytea not null default 'null'; -- JSON boolean
+		`,
+	},
+	{
+		stmt: `
+			alter table auth_request
+				add column claims_updated_at timestamptz not null default '0001-01-01 00:00:00 UTC';
+			alter table auth_code
+				add column claims_updated_at timestamptz not null default '0001-01-01 00:00:00 UTC';
+			alter table refresh_token
+				add column claims_updated_at timestamptz not null default '0001-01-01 00:00:00 UTC';
+			alter table user_account
+				add column updated_at timestamptz not null default '0001-01-01 00:00:00 UTC';
+		`,
+	},
+	{
+		stmt: `
+			alter table connector
+				add column allowed_email_domains bytea not null default 'null'; -- JSON array of strings
+		`,
+	},
+	{
+		stmt: `
+			alter table user_account
+				add column totp_secret text not null default '';
+			alter table user_account
+				add column totp_confirmed boolean not null default false;
+			alter table auth_request
+				add column totp_failures integer not null default 0;
+		`,
+	},
+	{
+		stmt: `
+			alter table client
+				add column default_scopes bytea not null default 'null'; -- JSON array of strings
+		`,
+	},
+	{
+		stmt: `
+			alter table auth_request
+				add column claims_auth_time timestamptz not null default '0001-01-01 00:00:00 UTC';
+			alter table auth_code
+				add column claims_auth_time timestamptz not null default '0001-01-01 00:00:00 UTC';
+			alter table refresh_token
+				add column claims_auth_time timestamptz not null default '0001-01-01 00:00:00 UTC';
+		`,
+	},
+	{
+		stmt: `
+			alter table auth_request
+				add column claims_session_id text not null default '';
+			alter table auth_code
+				add column claims_session_id text not null default '';
+			alter table refresh_token
+				add column claims_session_id text not null default '';
+		`,
+	},
+	{
+		stmt: `
+			alter table client
+				add column backchannel_logout_uri text not null default '';
+		`,
+	},
+	{
+		stmt: `
+			alter table client
+				add column code_reuse_grace_seconds integer not null default 0;
+		`,
+	},
+	{
+		stmt: `
+			alter table connector
+				add column allowed_clients bytea not null default 'null'; -- JSON array of strings
+		`,
+	},
+	{
+		stmt: `
+			alter table client
+				add column default_redirect_uri text not null default '';
+		`,
+	},
+	{
+		stmt: `
+			alter table auth_request
+				add column response_mode text not null default '';
+		`,
+	},
+	{
+		stmt: `
+			create table revoked_token (
+				id text not null primary key,
+				expiry timestamptz not null
+			);
+		`,
+	},
+	{
+		stmt: `
+			alter table client
+				add column claim_renames bytea not null default 'null'; -- JSON object
+		`,
+	},
+	{
+		stmt: `
+			alter table client
+				add column allowed_audiences bytea not null default 'null'; -- JSON array of strings
+		`,
+	},
+	{
+		stmt: `
+			alter table user_account
+				add column phone text not null default '';
+			alter table auth_request
+				add column sms_code_hash text not null default '';
+			alter table auth_request
+				add column sms_code_expiry timestamptz not null default '0001-01-01 00:00:00 UTC';
+		`,
+	},
+	{
+		stmt: `
+			alter table client
+				add column unique_nonces boolean not null default false;
+			create table used_nonce (
+				id text not null primary key,
+				expiry timestamptz not null
+			);
+		`,
+	},
+	{
+		stmt: `
+			alter table client
+				add column require_email_verified boolean not null default false;
+		`,
+	},
+	{
+		stmt: `
+			alter table connector
+				add column headers bytea not null default 'null'; -- JSON object
+		`,
+	},
+	{
+		stmt: `
+			alter table client
+				add column id_token_scope boolean not null default false;
+		`,
+	},
+	{
+		stmt: `
+			create table webauthn_credential (
+				id text not null primary key,
+				connector_id text not null,
+				credential_id bytea not null,
+				user_id text not null,
+				public_key bytea not null,
+				sign_count bigint not null,
+				created_at timestamptz not null
+			);
+			create table webauthn_challenge (
+				id text not null primary key,
+				value bytea not null,
+				user_id text not null,
+				expiry timestamptz not null
+			);
+		`,
+	},
+	{
+		stmt: `
+			alter table user_account
+				add column totp_last_step bigint not null default 0;
+			alter table user_account
+				add column totp_failures integer not null default 0;
+			alter table user_account
+				add column totp_last_failure timestamptz not null default '0001-01-01 00:00:00 UTC';
+		`,
+	},
+	{
+		stmt: `
+			alter table refresh_token
+				add column id_token_jti text not null default '';
+		`,
+	},
+	{
+		stmt: `
+			alter table connector
+				add column branding bytea not null default 'null'; -- JSON object
+		`,
+	},
+	{
+		stmt: `
+			alter table client
+				add column oauth2_only boolean not null default false;
+		`,
+	},
+	{
+		stmt: `
+			alter table connector
+				add column jit_provisioning bytea not null default 'null'; -- JSON boolean
+		`,
+	},
+	{
+		stmt: `
+			alter table connector
+				add column required_attributes bytea not null default 'null'; -- JSON array of strings
+		`,
+	},
+	{
+		stmt: `
+			alter table client
+				add column cross_client_audience text not null default '';
+		`,
+	},
+	{
+		// Failed TOTP and SMS codes are counted together. The old column is
+		// left in place, as not all supported databases can rename columns.
+		stmt: `
+			alter table auth_request
+				add column second_factor_failures integer not null default 0;
+			update auth_request set second_factor_failures = totp_failures;
+		`,
+	},
 }
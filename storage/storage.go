@@ -34,10 +34,24 @@ func NewID() string {
 	return string(buff[0]%26+'a') + strings.TrimRight(encoding.EncodeToString(buff[1:]), "=")
 }
 
+// UsedNonce is a nonce sent by a client which must not reuse nonces. It's
+// garbage collected once the ID tokens it could be replayed into have expired.
+type UsedNonce struct {
+	// A hash of the client ID and the nonce.
+	ID string `json:"id"`
+
+	// A time after which the nonce may be used again.
+	Expiry time.Time `json:"expiry"`
+}
+
 // GCResult returns the number of objects deleted by garbage collection.
 type GCResult struct {
-	AuthRequests int64
-	AuthCodes    int64
+	AuthRequests  int64
+	AuthCodes     int64
+	RevokedTokens int64
+	UsedNonces    int64
+
+	WebAuthnChallenges int64
 }
 
 // Storage is the storage interface used by the server. Implementations are
@@ -54,6 +68,11 @@ type Storage interface {
 	CreatePassword(p Password) error
 	CreateOfflineSessions(s OfflineSessions) error
 	CreateConnector(c Connector) error
+	CreateUser(u User) error
+	CreateRevokedToken(t RevokedToken) error
+	CreateUsedNonce(n UsedNonce) error
+	CreateWebAuthnCredential(c WebAuthnCredential) error
+	CreateWebAuthnChallenge(c WebAuthnChallenge) error
 
 	// TODO(ericchiang): return (T, bool, error) so we can indicate not found
 	// requests that way instead of using ErrNotFound.
@@ -65,11 +84,21 @@ type Storage interface {
 	GetPassword(email string) (Password, error)
 	GetOfflineSessions(userID string, connID string) (OfflineSessions, error)
 	GetConnector(id string) (Connector, error)
+	GetUser(id string) (User, error)
+	GetRevokedToken(id string) (RevokedToken, error)
+	GetUsedNonce(id string) (UsedNonce, error)
+	GetWebAuthnCredential(id string) (WebAuthnCredential, error)
+	GetWebAuthnChallenge(id string) (WebAuthnChallenge, error)
+
+	// GetUserByRemoteIdentity returns the user a remote identity has been linked to.
+	GetUserByRemoteIdentity(connectorID, connectorUserID string) (User, error)
 
 	ListClients() ([]Client, error)
 	ListRefreshTokens() ([]RefreshToken, error)
 	ListPasswords() ([]Password, error)
 	ListConnectors() ([]Connector, error)
+	ListUsers() ([]User, error)
+	ListWebAuthnCredentials() ([]WebAuthnCredential, error)
 
 	// Delete methods MUST be atomic.
 	DeleteAuthRequest(id string) error
@@ -79,6 +108,9 @@ type Storage interface {
 	DeletePassword(email string) error
 	DeleteOfflineSessions(userID string, connID string) error
 	DeleteConnector(id string) error
+	DeleteUser(id string) error
+	DeleteWebAuthnCredential(id string) error
+	DeleteWebAuthnChallenge(id string) error
 
 	// Update methods take a function for updating an object then performs that update within
 	// a transaction. "updater" functions may be called multiple times by a single update call.
@@ -101,8 +133,11 @@ type Storage interface {
 	UpdatePassword(email string, updater func(p Password) (Password, error)) error
 	UpdateOfflineSessions(userID string, connID string, updater func(s OfflineSessions) (OfflineSessions, error)) error
 	UpdateConnector(id string, updater func(c Connector) (Connector, error)) error
+	UpdateUser(id string, updater func(u User) (User, error)) error
+	UpdateWebAuthnCredential(id string, updater func(c WebAuthnCredential) (WebAuthnCredential, error)) error
 
-	// GarbageCollect deletes all expired AuthCodes and AuthRequests.
+	// GarbageCollect deletes all expired AuthCodes, AuthRequests, RevokedTokens,
+	// UsedNonces and WebAuthnChallenges.
 	GarbageCollect(now time.Time) (GCResult, error)
 }
 
@@ -116,6 +151,12 @@ type Client struct {
 	ID     string `json:"id" yaml:"id"`
 	Secret string `json:"secret" yaml:"secret"`
 
+	// The secret in use before the last rotation. It's accepted as well as
+	// Secret until it's retired, so deployments can switch over gradually.
+	PreviousSecret string `json:"previousSecret,omitempty" yaml:"previousSecret"`
+	// When Secret replaced PreviousSecret.
+	SecretRotatedAt time.Time `json:"secretRotatedAt" yaml:"secretRotatedAt"`
+
 	// A registered set of redirect URIs. When redirecting from dex to the client, the URI
 	// requested to redirect to MUST match one of these values, unless the client is "public".
 	RedirectURIs []string `json:"redirectURIs" yaml:"redirectURIs"`
@@ -133,6 +174,77 @@ type Client struct {
 	// Name and LogoURL used when displaying this client to the end user.
 	Name    string `json:"name" yaml:"name"`
 	LogoURL string `json:"logoURL" yaml:"logoURL"`
+
+	// Links to the client's home page, privacy policy and terms of service,
+	// shown to the end user when they're asked to approve the client.
+	ClientURL string `json:"clientURL,omitempty" yaml:"clientURL"`
+	PolicyURL string `json:"policyURL,omitempty" yaml:"policyURL"`
+	TOSURL    string `json:"tosURL,omitempty" yaml:"tosURL"`
+
+	// ResponseTypes restricts the response_type combinations, such as "code"
+	// or "code id_token", the client may request. If empty, the client may use
+	// any combination enabled on the server.
+	ResponseTypes []string `json:"responseTypes,omitempty" yaml:"responseTypes"`
+
+	// If set, overrides whether the server requires the client to use PKCE.
+	// By default it's only required of public clients, and only if the server
+	// is configured to.
+	RequirePKCE *bool `json:"requirePKCE,omitempty" yaml:"requirePKCE"`
+
+	// DefaultScopes are used for authorization requests without a scope
+	// parameter, for legacy clients which don't send one. They must include
+	// "openid", unless the client uses plain OAuth2. If empty, such requests
+	// are rejected.
+	DefaultScopes []string `json:"defaultScopes,omitempty" yaml:"defaultScopes"`
+
+	// BackchannelLogoutURI is where the server POSTs a logout token when a
+	// session the client took part in ends, as in OpenID Connect Back-Channel
+	// Logout.
+	BackchannelLogoutURI string `json:"backchannelLogoutURI,omitempty" yaml:"backchannelLogoutURI"`
+
+	// If set, repeating the exchange of an authorization code within this
+	// many seconds returns the tokens of the first exchange, for clients which
+	// can't help sending the same request twice. It weakens the single use of
+	// codes, so it's off by default.
+	CodeReuseGraceSeconds int `json:"codeReuseGraceSeconds,omitempty" yaml:"codeReuseGraceSeconds"`
+
+	// Redirect URI used for authorization requests which don't provide one.
+	// Must be one of RedirectURIs. Without it, the redirect_uri parameter is
+	// required.
+	DefaultRedirectURI string `json:"defaultRedirectURI,omitempty" yaml:"defaultRedirectURI"`
+
+	// ClaimRenames maps ID token claims describing the user, such as "email",
+	// to the names the client expects them under, for legacy clients which
+	// don't use the standard names.
+	ClaimRenames map[string]string `json:"claimRenames,omitempty" yaml:"claimRenames"`
+
+	// AllowedAudiences are the resources, and the clients through cross-client
+	// scopes or token exchange, the client may request tokens for. If empty,
+	// the client may only request tokens for itself.
+	AllowedAudiences []string `json:"allowedAudiences,omitempty" yaml:"allowedAudiences"`
+
+	// If set, authorization requests reusing a nonce the client already sent
+	// are rejected, for as long as ID tokens carrying it are valid.
+	UniqueNonces bool `json:"uniqueNonces,omitempty" yaml:"uniqueNonces"`
+
+	// If set, users whose email isn't verified by the connector can't login
+	// to the client, or refresh its tokens.
+	RequireEmailVerified bool `json:"requireEmailVerified,omitempty" yaml:"requireEmailVerified"`
+
+	// If set, ID tokens issued to the client carry a "scope" claim with the
+	// granted scopes, for clients which don't read them from the token
+	// response.
+	IDTokenScope bool `json:"idTokenScope,omitempty" yaml:"idTokenScope"`
+
+	// If set, the client may use plain OAuth2: authorization requests without
+	// the "openid" scope are accepted, and get an access token but no ID
+	// token.
+	OAuth2Only bool `json:"oauth2Only,omitempty" yaml:"oauth2Only"`
+
+	// Audience of ID tokens the client gets for cross-client scopes:
+	// "client-first" for the client followed by the peers, or "peers-only"
+	// for just the peers. If empty, the server's default is used.
+	CrossClientAudience string `json:"crossClientAudience,omitempty" yaml:"crossClientAudience"`
 }
 
 // Claims represents the ID Token claims supported by the server.
@@ -143,6 +255,20 @@ type Claims struct {
 	EmailVerified bool
 
 	Groups []string
+
+	// URL of the user's profile picture, if the connector provided one.
+	Picture string
+
+	// When the user's profile last changed, if the user is known to the server.
+	UpdatedAt time.Time
+
+	// When the user last authenticated with the connector. Refreshing a token
+	// doesn't change it.
+	AuthTime time.Time
+
+	// Identifies the login the claims were issued for. Tokens refreshed from
+	// the same login share it, so logging out can end all of them.
+	SessionID string
 }
 
 // AuthRequest represents a OAuth2 client authorization request. It holds the state
@@ -161,12 +287,20 @@ type AuthRequest struct {
 	RedirectURI   string
 	Nonce         string
 	State         string
+	// How the response is returned to the client, if the client asked for a
+	// signed response with one of the JWT response modes.
+	ResponseMode string
 
 	// The client has indicated that the end user must be shown an approval prompt
 	// on all requests. The server cannot cache their initial action for subsequent
 	// attempts.
 	ForceApprovalPrompt bool
 
+	// Claims the client asked to have included in the ID token through the
+	// "claims" request parameter, mapped to whether the client marked them
+	// as essential.
+	RequestedClaims map[string]bool
+
 	Expiry time.Time
 
 	// Has the user proved their identity through a backing identity provider?
@@ -182,6 +316,34 @@ type AuthRequest struct {
 	// Set when the user authenticates.
 	ConnectorID   string
 	ConnectorData []byte
+
+	// The PKCE code challenge of the request, if the client sent one.
+	PKCE PKCE
+
+	// Number of wrong TOTP or SMS codes entered by a user whose connector
+	// login succeeded, but who still has to provide their second factor.
+	SecondFactorFailures int
+
+	// The last code sent by text message to a user who has to provide their
+	// second factor.
+	SMSCode SMSCode
+}
+
+// SMSCode is a one-time code sent by text message as a second factor.
+type SMSCode struct {
+	// SHA-256 hash of the code, hex encoded.
+	Hash   string    `json:"hash,omitempty"`
+	Expiry time.Time `json:"expiry"`
+}
+
+// PKCE holds the code challenge a client sent with its authorization request,
+// which must be matched by the code verifier when the code is exchanged.
+//
+// https://tools.ietf.org/html/rfc7636
+type PKCE struct {
+	CodeChallenge string
+	// "S256" or "plain".
+	CodeChallengeMethod string
 }
 
 // AuthCode represents a code which can be exchanged for an OAuth2 token response.
@@ -211,12 +373,18 @@ type AuthCode struct {
 	// Scopes authorized by the end user for the client.
 	Scopes []string
 
+	// Claims requested for the ID token by the initial authorization request.
+	RequestedClaims map[string]bool
+
 	// Authentication data provided by an upstream source.
 	ConnectorID   string
 	ConnectorData []byte
 	Claims        Claims
 
 	Expiry time.Time
+
+	// The PKCE code challenge of the initial authorization request.
+	PKCE PKCE
 }
 
 // RefreshToken is an OAuth2 refresh token which allows a client to request new
@@ -248,6 +416,13 @@ type RefreshToken struct {
 	// Nonce value supplied during the initial redirect. This is required to be part
 	// of the claims of any future id_token generated by the client.
 	Nonce string
+
+	// Claims requested for the ID token by the initial authorization request.
+	RequestedClaims map[string]bool
+
+	// The "jti" claim of the last ID token issued with the refresh token.
+	// Revoking that ID token revokes the refresh token as well.
+	IDTokenJTI string
 }
 
 // RefreshTokenRef is a reference object that contains metadata about refresh tokens.
@@ -309,6 +484,149 @@ type Connector struct {
 	// Config holds all the configuration information specific to the connector type. Since there
 	// no generic struct we can use for this purpose, it is stored as a byte stream.
 	Config []byte `json:"email"`
+	// If set, users with a verified email outside of these domains can't login
+	// through the connector. A "*." prefix matches any subdomain.
+	AllowedEmailDomains []string `json:"allowedEmailDomains,omitempty"`
+	// If set, only these clients may have users login through the connector.
+	AllowedClients []string `json:"allowedClients,omitempty"`
+	// Headers added to the HTTP requests the connector makes upstream. Only
+	// connector types making their requests through dex's client accept them.
+	Headers map[string]string `json:"headers,omitempty"`
+	// Branding of the pages shown while users login through the connector.
+	Branding ConnectorBranding `json:"branding"`
+	// If set to false, users logging in through the connector must already
+	// exist, rather than being created the first time they login.
+	JITProvisioning *bool `json:"jitProvisioning,omitempty"`
+	// Attributes, such as "email", identities returned by the connector must
+	// have for users to login.
+	RequiredAttributes []string `json:"requiredAttributes,omitempty"`
+}
+
+// ConnectorBranding replaces the issuer's branding on the login and error
+// pages shown while users login through a connector. Unset fields fall back
+// to the issuer's.
+type ConnectorBranding struct {
+	Name    string `json:"name,omitempty"`
+	LogoURL string `json:"logoURL,omitempty"`
+	// A support email address or URL shown on error pages.
+	SupportContact string `json:"supportContact,omitempty"`
+}
+
+// User is an end user known to the server. A user is identified by one or more
+// remote identities, each of which was asserted by a connector during login.
+type User struct {
+	// Randomly generated ID of the user.
+	ID string `json:"id"`
+
+	// Profile information set when the user was created through the admin API.
+	// The email is normalized to lower case.
+	Email         string `json:"email"`
+	Name          string `json:"name"`
+	EmailVerified bool   `json:"emailVerified"`
+
+	// Disabled users can't login or refresh tokens, but are kept for auditing.
+	Disabled bool `json:"disabled"`
+
+	// The last time the profile of the user, or of one of its remote
+	// identities, changed.
+	UpdatedAt time.Time `json:"updatedAt"`
+
+	// The user's TOTP second factor, if they enrolled one.
+	TOTP TOTP `json:"totp"`
+
+	// Phone number in E.164 format, such as "+15551234567", which codes are
+	// texted to if the SMS second factor is enabled and the user didn't enroll
+	// a TOTP device.
+	Phone string `json:"phone,omitempty"`
+
+	// Identities from upstream providers which have been linked to this user.
+	//
+	// A remote identity should only ever be linked to a single user.
+	RemoteIdentities []RemoteIdentity `json:"remoteIdentities"`
+}
+
+// TOTP is a time-based one-time password second factor.
+type TOTP struct {
+	// Base32 encoded shared secret.
+	Secret string `json:"secret,omitempty"`
+
+	// Set once the user proved they enrolled the secret by entering a code
+	// generated from it. Logins only ask for a code after that.
+	Confirmed bool `json:"confirmed,omitempty"`
+
+	// The time step of the last accepted code. Codes of this or earlier steps
+	// are refused, so an observed code can't be replayed.
+	LastStep int64 `json:"lastStep,omitempty"`
+
+	// Number of invalid codes entered since the last valid one, across all
+	// logins, and when the last one was.
+	Failures    int       `json:"failures,omitempty"`
+	LastFailure time.Time `json:"lastFailure"`
+}
+
+// RemoteIdentity is a user's identity as asserted by a connector.
+type RemoteIdentity struct {
+	// The connector which asserted the identity.
+	ConnectorID string `json:"connectorID"`
+
+	// The ID the connector returned for the user. This is the UserID field of
+	// the connector.Identity.
+	ConnectorUserID string `json:"connectorUserID"`
+
+	// Optional values returned by the connector at the time the identity was
+	// last used to login.
+	Username      string   `json:"username"`
+	Email         string   `json:"email"`
+	EmailVerified bool     `json:"emailVerified"`
+	Groups        []string `json:"groups,omitempty"`
+	Picture       string   `json:"picture,omitempty"`
+
+	// The time the identity was first linked to the user.
+	LinkedAt time.Time `json:"linkedAt"`
+}
+
+// RevokedToken is a token signed by the server, identified by its "jti" claim,
+// which must no longer be accepted. It's garbage collected once the token has
+// expired.
+type RevokedToken struct {
+	// The "jti" claim of the token.
+	ID string `json:"id"`
+
+	// A time after which the token has expired.
+	Expiry time.Time `json:"expiry"`
+}
+
+// WebAuthnCredential is a public key credential registered with a WebAuthn
+// connector.
+type WebAuthnCredential struct {
+	// A hash of the connector and credential IDs, set by the connector.
+	ID string `json:"id"`
+
+	ConnectorID  string `json:"connectorID"`
+	CredentialID []byte `json:"credentialID"`
+	UserID       string `json:"userID"`
+
+	// PKIX, ASN.1 DER encoded public key.
+	PublicKey []byte `json:"publicKey"`
+
+	// The authenticator's signature counter at the last login.
+	SignCount uint32 `json:"signCount"`
+
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// WebAuthnChallenge is an outstanding challenge of a WebAuthn login or
+// enrollment. It's garbage collected once it can no longer be answered.
+type WebAuthnChallenge struct {
+	// A hash of the connector ID, ceremony and state, set by the connector.
+	ID string `json:"id"`
+
+	Value []byte `json:"value"`
+
+	// The user enrolling a credential, empty for logins.
+	UserID string `json:"userID"`
+
+	Expiry time.Time `json:"expiry"`
 }
 
 // VerificationKey is a rotated signing key which can still be used to verify
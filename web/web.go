@@ -0,0 +1,11 @@
+// Package web holds the frontend templates and assets compiled into dex. They
+// make up the fallback of theme bundles loaded from a directory.
+package web
+
+import "embed"
+
+// FS holds the "static", "templates" and "themes" directories of the web
+// directory.
+//
+//go:embed static templates themes
+var FS embed.FS